@@ -0,0 +1,50 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// parseAdvertiseOrder reads lighthouse.advertise_order, the cidrs whose addresses we advertise ahead of the others in
+// the order they are listed
+func parseAdvertiseOrder(c *config.C) ([]*net.IPNet, error) {
+	rawOrder := c.GetStringSlice("lighthouse.advertise_order", []string{})
+
+	order := make([]*net.IPNet, len(rawOrder))
+	for i, rawCidr := range rawOrder {
+		_, cidr, err := net.ParseCIDR(rawCidr)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v in lighthouse.advertise_order failed to parse: %v", i+1, err)
+		}
+
+		order[i] = cidr
+	}
+
+	return order, nil
+}
+
+// advertisePriority returns the priority we advertise ip with so peers try it in the order of lighthouse.advertise_order.
+// The first cidr that contains ip gives the highest priority, an address outside every cidr has none.
+func advertisePriority(ip net.IP, order []*net.IPNet) uint32 {
+	for i, cidr := range order {
+		if cidr.Contains(ip) {
+			return uint32(len(order) - i)
+		}
+	}
+	return 0
+}
+
+// orderAdvertiseAddrs sorts addrs by the first cidr in order that contains them, addresses outside every cidr go last.
+// Addresses in the same cidr keep their order.
+func orderAdvertiseAddrs(addrs []netIpAndPort, order []*net.IPNet) {
+	if len(order) == 0 {
+		return
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return advertisePriority(addrs[i].ip, order) > advertisePriority(addrs[j].ip, order)
+	})
+}
@@ -0,0 +1,104 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseAdvertiseOrder(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	order, err := parseAdvertiseOrder(c)
+	assert.NoError(t, err)
+	assert.Empty(t, order)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_order": []interface{}{"1.2.3.4/32", "fd00::/8"}}
+	order, err = parseAdvertiseOrder(c)
+	assert.NoError(t, err)
+	assert.Len(t, order, 2)
+	assert.Equal(t, "1.2.3.4/32", order[0].String())
+	assert.Equal(t, "fd00::/8", order[1].String())
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_order": []interface{}{"1.2.3.4/32", "nope"}}
+	_, err = parseAdvertiseOrder(c)
+	assert.EqualError(t, err, "entry 2 in lighthouse.advertise_order failed to parse: invalid CIDR address: nope")
+}
+
+func TestLighthouse_advertiseOrder(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"hosts":            []interface{}{"10.128.0.2"},
+		"advertise_addrs":  []interface{}{"10.1.0.5:0", "1.2.3.4:0", "192.168.1.5:0", "1.2.3.5:5555"},
+		"advertise_order":  []interface{}{"1.2.3.5/32", "192.168.0.0/16"},
+		"local_allow_list": map[interface{}]interface{}{"0.0.0.0/0": false, "::/0": false},
+	}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+
+	filter := NebulaMeta_HostUpdateNotification
+	w := &testEncWriter{metaFilter: &filter}
+	lh.ifce = w
+
+	// The configured cidrs go first in order, the rest follow in the order they were found
+	want := []*udp.Addr{
+		{IP: net.IP{1, 2, 3, 5}, Port: 5555},
+		{IP: net.IP{192, 168, 1, 5}, Port: 4242},
+		{IP: net.IP{10, 1, 0, 5}, Port: 4242},
+		{IP: net.IP{1, 2, 3, 4}, Port: 4242},
+	}
+	sent := lh.SendUpdate()
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts, want...)
+	assertUdpAddrInArray(t, sent, want...)
+
+	// Each address carries its place in the order so peers try them in that order
+	var priorities []uint32
+	for _, v := range w.lastReply.msg.Details.Ip4AndPorts {
+		priorities = append(priorities, v.Priority)
+	}
+	assert.Equal(t, []uint32{2, 1, 0, 0}, priorities)
+
+	// The order is reloadable
+	rc, err := yaml.Marshal(map[interface{}]interface{}{
+		"lighthouse": map[interface{}]interface{}{
+			"hosts":            []interface{}{"10.128.0.2"},
+			"advertise_addrs":  []interface{}{"10.1.0.5:0", "1.2.3.4:0", "192.168.1.5:0", "1.2.3.5:5555"},
+			"advertise_order":  []interface{}{"10.0.0.0/8"},
+			"local_allow_list": map[interface{}]interface{}{"0.0.0.0/0": false, "::/0": false},
+		},
+		"static_host_map": map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}},
+		"listen":          map[interface{}]interface{}{"port": 4242},
+	})
+	assert.NoError(t, err)
+	c.ReloadConfigString(string(rc))
+	assert.NoError(t, lh.reload(c, false))
+	lh.SendUpdate()
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts,
+		&udp.Addr{IP: net.IP{10, 1, 0, 5}, Port: 4242},
+		&udp.Addr{IP: net.IP{1, 2, 3, 4}, Port: 4242},
+		&udp.Addr{IP: net.IP{192, 168, 1, 5}, Port: 4242},
+		&udp.Addr{IP: net.IP{1, 2, 3, 5}, Port: 5555},
+	)
+}
+
+func TestRankAnswers_priority(t *testing.T) {
+	learned := NewIp4AndPort(net.IP{1, 2, 3, 4}, 4242)
+	reported := []*Ip4AndPort{
+		{Ip: NewIp4AndPort(net.IP{10, 1, 0, 5}, 4242).Ip, Port: 4242, Priority: 2},
+		{Ip: learned.Ip, Port: 4242, Priority: 1},
+	}
+
+	// The learned address still goes first but keeps the priority the host gave it
+	answers := rankAnswers(nil, learned, reported, 0)
+	assert.Equal(t, []*Ip4AndPort{reported[1], reported[0]}, answers)
+}
@@ -0,0 +1,163 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// advertiseScope limits the addresses we advertise within cidr to the peers that have at least one of groups
+type advertiseScope struct {
+	cidr   *net.IPNet
+	groups []string
+}
+
+// parseAdvertiseScopes reads lighthouse.advertise_scopes, a list of cidrs and the peer groups that may be handed the
+// addresses within them
+func parseAdvertiseScopes(c *config.C) ([]advertiseScope, error) {
+	r := c.Get("lighthouse.advertise_scopes")
+	if r == nil {
+		return nil, nil
+	}
+
+	rawScopes, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("lighthouse.advertise_scopes is not an array")
+	}
+
+	scopes := make([]advertiseScope, len(rawScopes))
+	for i, rs := range rawScopes {
+		m, ok := rs.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %v in lighthouse.advertise_scopes is invalid", i+1)
+		}
+
+		rCidr, ok := m["cidr"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.cidr in lighthouse.advertise_scopes is not present", i+1)
+		}
+
+		_, cidr, err := net.ParseCIDR(fmt.Sprintf("%v", rCidr))
+		if err != nil {
+			return nil, fmt.Errorf("entry %v.cidr in lighthouse.advertise_scopes failed to parse: %v", i+1, err)
+		}
+
+		rGroups, ok := m["groups"].([]interface{})
+		if !ok || len(rGroups) == 0 {
+			return nil, fmt.Errorf("entry %v.groups in lighthouse.advertise_scopes must be a list of at least one group", i+1)
+		}
+
+		groups := make([]string, len(rGroups))
+		for j, g := range rGroups {
+			groups[j] = fmt.Sprintf("%v", g)
+		}
+
+		scopes[i] = advertiseScope{cidr: cidr, groups: groups}
+	}
+
+	return scopes, nil
+}
+
+// scopedAddrs sorts the addresses we advertise into the ones anyone can have and the ones limited by
+// lighthouse.advertise_scopes. An address is limited by the first scope that contains it.
+type scopedAddrs struct {
+	scopes []advertiseScope
+	v4     []*Ip4AndPort
+	v6     []*Ip6AndPort
+	// scoped has an entry for every scope, nil until an address falls into it
+	scoped []*ScopedAddrs
+}
+
+func newScopedAddrs(scopes []advertiseScope) *scopedAddrs {
+	return &scopedAddrs{scopes: scopes, scoped: make([]*ScopedAddrs, len(scopes))}
+}
+
+// add files ip under its scope, priority is carried to the peers so they try it in the order of
+// lighthouse.advertise_order
+func (sa *scopedAddrs) add(ip net.IP, port uint32, priority uint32) {
+	var s *ScopedAddrs
+	for i, scope := range sa.scopes {
+		if scope.cidr.Contains(ip) {
+			if sa.scoped[i] == nil {
+				sa.scoped[i] = &ScopedAddrs{Groups: scope.groups}
+			}
+			s = sa.scoped[i]
+			break
+		}
+	}
+
+	ip4 := ip.To4()
+	switch {
+	case ip4 != nil:
+		v := NewIp4AndPort(ip4, port)
+		v.Priority = priority
+		if s != nil {
+			s.Ip4AndPorts = append(s.Ip4AndPorts, v)
+		} else {
+			sa.v4 = append(sa.v4, v)
+		}
+	default:
+		v := NewIp6AndPort(ip, port)
+		v.Priority = priority
+		if s != nil {
+			s.Ip6AndPorts = append(s.Ip6AndPorts, v)
+		} else {
+			sa.v6 = append(sa.v6, v)
+		}
+	}
+}
+
+// list returns the scopes that at least one address fell into
+func (sa *scopedAddrs) list() []*ScopedAddrs {
+	var out []*ScopedAddrs
+	for _, s := range sa.scoped {
+		if s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// scopedFor returns the scoped addresses in c that a peer with groups may be handed
+func (c *cache) scopedFor(groups []string) (v4 []*Ip4AndPort, v6 []*Ip6AndPort) {
+	for _, s := range c.scoped {
+		if !hasAnyGroup(s.Groups, groups) {
+			continue
+		}
+
+		v4 = append(v4, s.Ip4AndPorts...)
+		v6 = append(v6, s.Ip6AndPorts...)
+	}
+	return v4, v6
+}
+
+func hasAnyGroup(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peerGroups returns the groups in the certificate of the peer at vpnIp, nil if we do not have a tunnel to it
+func (lh *LightHouse) peerGroups(vpnIp iputil.VpnIp) []string {
+	if lh.hostMap == nil {
+		return nil
+	}
+
+	hostinfo := lh.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		return nil
+	}
+
+	c := hostinfo.GetCert()
+	if c == nil {
+		return nil
+	}
+	return c.Details.Groups
+}
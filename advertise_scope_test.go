@@ -0,0 +1,142 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAdvertiseScopes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	scopes, err := parseAdvertiseScopes(c)
+	assert.NoError(t, err)
+	assert.Nil(t, scopes)
+
+	assert.NoError(t, c.LoadString(`
+lighthouse:
+  advertise_scopes:
+    - cidr: 10.1.0.0/16
+      groups: [office, ops]
+    - cidr: fd00::/8
+      groups: [ops]
+`))
+	scopes, err = parseAdvertiseScopes(c)
+	assert.NoError(t, err)
+	assert.Len(t, scopes, 2)
+	assert.Equal(t, "10.1.0.0/16", scopes[0].cidr.String())
+	assert.Equal(t, []string{"office", "ops"}, scopes[0].groups)
+	assert.Equal(t, "fd00::/8", scopes[1].cidr.String())
+	assert.Equal(t, []string{"ops"}, scopes[1].groups)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_scopes": "10.1.0.0/16"}
+	_, err = parseAdvertiseScopes(c)
+	assert.EqualError(t, err, "lighthouse.advertise_scopes is not an array")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_scopes": []interface{}{
+		map[interface{}]interface{}{"groups": []interface{}{"ops"}},
+	}}
+	_, err = parseAdvertiseScopes(c)
+	assert.EqualError(t, err, "entry 1.cidr in lighthouse.advertise_scopes is not present")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_scopes": []interface{}{
+		map[interface{}]interface{}{"cidr": "10.1.0.0/16", "groups": []interface{}{}},
+	}}
+	_, err = parseAdvertiseScopes(c)
+	assert.EqualError(t, err, "entry 1.groups in lighthouse.advertise_scopes must be a list of at least one group")
+}
+
+func Test_scopedAddrs(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.1.0.0/16")
+	_, wide, _ := net.ParseCIDR("10.0.0.0/8")
+	sa := newScopedAddrs([]advertiseScope{
+		{cidr: office, groups: []string{"office"}},
+		{cidr: wide, groups: []string{"ops"}},
+	})
+
+	sa.add(net.ParseIP("1.1.1.1"), 4242, 0)
+	sa.add(net.ParseIP("10.1.0.5"), 4242, 0)
+	sa.add(net.ParseIP("1::1"), 4242, 0)
+
+	assert.Equal(t, []*Ip4AndPort{NewIp4AndPort(net.ParseIP("1.1.1.1"), 4242)}, sa.v4)
+	assert.Equal(t, []*Ip6AndPort{NewIp6AndPort(net.ParseIP("1::1"), 4242)}, sa.v6)
+
+	// The first scope that contains the address wins and scopes without an address are not sent
+	assert.Equal(t, []*ScopedAddrs{
+		{Groups: []string{"office"}, Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(net.ParseIP("10.1.0.5"), 4242)}},
+	}, sa.list())
+}
+
+func TestLighthouse_advertiseScopes(t *testing.T) {
+	l := test.NewLogger()
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+
+	hostVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+	hostUdpAddr := &udp.Addr{IP: net.ParseIP("1.1.1.1"), Port: 4242}
+	officeVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))
+	officeUdpAddr := &udp.Addr{IP: net.ParseIP("1.1.1.2"), Port: 4242}
+	otherVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.4"))
+	otherUdpAddr := &udp.Addr{IP: net.ParseIP("1.1.1.3"), Port: 4242}
+
+	// The lighthouse finds the groups of the querying peer in its hostmap
+	lh.hostMap = NewHostMap(l, nil, &net.IPNet{}, nil)
+	addPeer := func(vpnIp iputil.VpnIp, groups ...string) {
+		lh.hostMap.unlockedAddHostInfo(&HostInfo{
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups}},
+			},
+			vpnIp: vpnIp,
+		}, &Interface{})
+	}
+	addPeer(hostVpnIp, "servers")
+	addPeer(officeVpnIp, "office")
+	addPeer(otherVpnIp, "laptops")
+
+	lhh := lh.NewRequestHandler()
+	privateAddr := NewIp4AndPort(net.ParseIP("10.1.0.5"), 4242)
+	update := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:       uint32(hostVpnIp),
+			Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(hostUdpAddr.IP, uint32(hostUdpAddr.Port))},
+			ScopedAddrs: []*ScopedAddrs{{Groups: []string{"office"}, Ip4AndPorts: []*Ip4AndPort{privateAddr}}},
+		},
+	}
+	b, err := update.Marshal()
+	assert.NoError(t, err)
+	lhh.HandleRequest(hostUdpAddr, hostVpnIp, b, &testEncWriter{})
+
+	// A peer in the group gets the scoped address ahead of the reported ones
+	r := newLHHostRequest(officeUdpAddr, officeVpnIp, hostVpnIp, lhh)
+	assert.Equal(t, []*Ip4AndPort{privateAddr, NewIp4AndPort(hostUdpAddr.IP, uint32(hostUdpAddr.Port))}, r.msg.Details.Ip4AndPorts)
+
+	// Anyone else does not
+	r = newLHHostRequest(otherUdpAddr, otherVpnIp, hostVpnIp, lhh)
+	assert.Equal(t, []*Ip4AndPort{NewIp4AndPort(hostUdpAddr.IP, uint32(hostUdpAddr.Port))}, r.msg.Details.Ip4AndPorts)
+
+	// Neither does a peer we have no tunnel to, we can not know its groups
+	r = newLHHostRequest(otherUdpAddr, iputil.Ip2VpnIp(net.ParseIP("10.128.0.5")), hostVpnIp, lhh)
+	assert.Equal(t, []*Ip4AndPort{NewIp4AndPort(hostUdpAddr.IP, uint32(hostUdpAddr.Port))}, r.msg.Details.Ip4AndPorts)
+
+	// An update without scoped addresses clears them
+	update.Details.ScopedAddrs = nil
+	b, err = update.Marshal()
+	assert.NoError(t, err)
+	lhh.HandleRequest(hostUdpAddr, hostVpnIp, b, &testEncWriter{})
+
+	r = newLHHostRequest(officeUdpAddr, officeVpnIp, hostVpnIp, lhh)
+	assert.Equal(t, []*Ip4AndPort{NewIp4AndPort(hostUdpAddr.IP, uint32(hostUdpAddr.Port))}, r.msg.Details.Ip4AndPorts)
+}
@@ -15,17 +15,19 @@ type Bits struct {
 	outOfWindowCounter metrics.Counter
 }
 
-func NewBits(bits uint64) *Bits {
+func NewBits(registry metrics.Registry, bits uint64) *Bits {
 	return &Bits{
 		length:             bits,
 		bits:               make([]bool, bits, bits),
 		current:            0,
-		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", nil),
-		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", nil),
-		outOfWindowCounter: metrics.GetOrRegisterCounter("network.packets.out_of_window", nil),
+		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", registry),
+		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", registry),
+		outOfWindowCounter: metrics.GetOrRegisterCounter("network.packets.out_of_window", registry),
 	}
 }
 
+// Check reports whether i could be accepted, it runs before the packet is decrypted so it does not count anything. An
+// unauthenticated packet must not be able to move the duplicate and out of window counters, Update counts the rejects.
 func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 	// If i is the next number, return true.
 	if i > b.current || (i == 0 && b.firstSeen == false && b.current < b.length) {
@@ -33,12 +35,7 @@ func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 	}
 
 	// If i is within the window, check if it's been set already. The first window will fail this check
-	if i > b.current-b.length {
-		return !b.bits[i%b.length]
-	}
-
-	// If i is within the first window
-	if i < b.length {
+	if i > b.current-b.length || i < b.length {
 		return !b.bits[i%b.length]
 	}
 
@@ -47,6 +44,8 @@ func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 	return false
 }
 
+// Update records i as received, it must only be called once the packet has been decrypted. Duplicates and packets too
+// far behind the window are rejected and counted.
 func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	// If i is the next number, return true and update current.
 	if i == b.current+1 {
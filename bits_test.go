@@ -3,13 +3,14 @@ package nebula
 import (
 	"testing"
 
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestBits(t *testing.T) {
 	l := test.NewLogger()
-	b := NewBits(10)
+	b := NewBits(nil, 10)
 
 	// make sure it is the right size
 	assert.Len(t, b.bits, 10)
@@ -62,13 +63,13 @@ func TestBits(t *testing.T) {
 	assert.Equal(t, g, b.bits)
 
 	// make sure we handle wrapping around once to the current position
-	b = NewBits(10)
+	b = NewBits(nil, 10)
 	assert.True(t, b.Update(l, 1))
 	assert.True(t, b.Update(l, 11))
 	assert.Equal(t, []bool{false, true, false, false, false, false, false, false, false, false}, b.bits)
 
 	// Walk through a few windows in order
-	b = NewBits(10)
+	b = NewBits(nil, 10)
 	for i := uint64(0); i <= 100; i++ {
 		assert.True(t, b.Check(l, i), "Error while checking %v", i)
 		assert.True(t, b.Update(l, i), "Error while updating %v", i)
@@ -77,7 +78,7 @@ func TestBits(t *testing.T) {
 
 func TestBitsDupeCounter(t *testing.T) {
 	l := test.NewLogger()
-	b := NewBits(10)
+	b := NewBits(nil, 10)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -102,7 +103,7 @@ func TestBitsDupeCounter(t *testing.T) {
 
 func TestBitsOutOfWindowCounter(t *testing.T) {
 	l := test.NewLogger()
-	b := NewBits(10)
+	b := NewBits(nil, 10)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -132,7 +133,7 @@ func TestBitsOutOfWindowCounter(t *testing.T) {
 
 func TestBitsLostCounter(t *testing.T) {
 	l := test.NewLogger()
-	b := NewBits(10)
+	b := NewBits(nil, 10)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -153,7 +154,7 @@ func TestBitsLostCounter(t *testing.T) {
 	assert.Equal(t, int64(0), b.dupeCounter.Count())
 	assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
 
-	b = NewBits(10)
+	b = NewBits(nil, 10)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -215,7 +216,7 @@ func TestBitsLostCounter(t *testing.T) {
 }
 
 func BenchmarkBits(b *testing.B) {
-	z := NewBits(10)
+	z := NewBits(nil, 10)
 	for n := 0; n < b.N; n++ {
 		for i := range z.bits {
 			z.bits[i] = true
@@ -226,3 +227,73 @@ func BenchmarkBits(b *testing.B) {
 
 	}
 }
+
+func TestBitsReorderedWindow(t *testing.T) {
+	l := test.NewLogger()
+
+	for _, window := range []uint64{64, 1024} {
+		b := NewBits(nil, window)
+		b.Update(l, 0)
+		b.dupeCounter.Clear()
+		b.outOfWindowCounter.Clear()
+
+		// receive is what outside.go does, check before decrypting and update after
+		receive := func(i uint64) bool {
+			return b.Check(l, i) && b.Update(l, i)
+		}
+
+		// Deliver the counters in reverse within each block of the window size, every packet is accepted
+		top := window * 4
+		for start := uint64(1); start <= top; start += window {
+			for i := start + window - 1; i >= start; i-- {
+				assert.True(t, receive(i), "window %v, counter %v", window, i)
+			}
+		}
+		assert.Equal(t, int64(0), b.dupeCounter.Count())
+		assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
+
+		// The oldest counter still in the window was seen, so it is a replay, one more behind is out of the window.
+		// Check rejects them before decrypting, which proves nothing about the packet so nothing is counted.
+		assert.False(t, receive(top-window+1))
+		assert.False(t, receive(top-window))
+		assert.Equal(t, int64(0), b.dupeCounter.Count())
+		assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
+
+		// Jump ahead and deliver a straggler that is just within the window, then one just beyond it
+		assert.True(t, receive(top+window))
+		assert.True(t, receive(top+1))
+		assert.False(t, receive(top))
+
+		// Replaying anything accepted is rejected
+		assert.False(t, receive(top+window))
+		assert.False(t, receive(top+1))
+		assert.Equal(t, int64(0), b.dupeCounter.Count())
+		assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
+
+		// Packets that decrypted, like two copies that both passed Check before either was decrypted, are counted
+		assert.False(t, b.Update(l, top+1))
+		assert.Equal(t, int64(1), b.dupeCounter.Count())
+		assert.False(t, b.Update(l, top))
+		assert.Equal(t, int64(1), b.outOfWindowCounter.Count())
+	}
+}
+
+func TestGetReplayWindow(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	w, err := getReplayWindow(c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(ReplayWindow), w)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"replay_window": 8192}
+	w, err = getReplayWindow(c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8192), w)
+
+	for _, v := range []int{0, -1024, 32, 1000, 1 << 17} {
+		c.Settings["handshakes"] = map[interface{}]interface{}{"replay_window": v}
+		_, err = getReplayWindow(c)
+		assert.Error(t, err, "replay_window %v", v)
+	}
+}
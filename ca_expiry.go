@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// caExpiryWarnInterval is how often a root CA that is about to expire, or has expired, is logged again
+	caExpiryWarnInterval = time.Hour
+	// caGraceSlack moves the time certificates are verified at during pki.ca_expiry.grace to before the root expired,
+	// nebula-cert signs certificates that expire one second before their CA by default
+	caGraceSlack = time.Second
+)
+
+// caExpiry holds pki.ca_expiry. warnBefore is how long before a root CA expires to start warning about it, grace is
+// how long after it expired to keep accepting the certificates it signed. A grace of 0 refuses them right away.
+type caExpiry struct {
+	warnBefore time.Duration
+	grace      time.Duration
+}
+
+func parseCAExpiry(c *config.C) (*caExpiry, error) {
+	ce := &caExpiry{
+		warnBefore: c.GetDuration("pki.ca_expiry.warn_before", 30*24*time.Hour),
+		grace:      c.GetDuration("pki.ca_expiry.grace", 0),
+	}
+
+	if ce.warnBefore < 0 {
+		return nil, fmt.Errorf("pki.ca_expiry.warn_before can not be negative: %v", ce.warnBefore)
+	}
+
+	if ce.grace < 0 {
+		return nil, fmt.Errorf("pki.ca_expiry.grace can not be negative: %v", ce.grace)
+	}
+
+	return ce, nil
+}
+
+// inGrace returns true if the root CA ca has expired at now but pki.ca_expiry.grace has not run out since
+func (ce *caExpiry) inGrace(ca *cert.NebulaCertificate, now time.Time) bool {
+	return ce.grace > 0 && ca.Details.NotAfter.Before(now) && !ca.Details.NotAfter.Add(ce.grace).Before(now)
+}
+
+// rootForCert returns the root CA c chains to in pool, or nil if the chain can not be followed to one
+func rootForCert(c *cert.NebulaCertificate, pool *cert.NebulaCAPool) *cert.NebulaCertificate {
+	issuer := c.Details.Issuer
+	if chain := pool.GetChainForCert(c); len(chain) > 0 {
+		issuer = chain[len(chain)-1].Details.Issuer
+	}
+	return pool.CAs[issuer]
+}
+
+// VerifyCert verifies c against pool at now. A certificate that was only refused because its root CA has expired is
+// verified again as of the moment before the root expired while pki.ca_expiry.grace lasts, so certificates that
+// expired along with the root keep working. A certificate that had expired before its root did is still refused.
+func (p *PKI) VerifyCert(c *cert.NebulaCertificate, pool *cert.NebulaCAPool, now time.Time, useCache bool) (bool, error) {
+	verify := c.Verify
+	if useCache {
+		verify = c.VerifyWithCache
+	}
+
+	valid, err := verify(now, pool)
+	if valid || !errors.Is(err, cert.ErrRootExpired) {
+		return valid, err
+	}
+
+	ce := p.caExpiry.Load()
+	root := rootForCert(c, pool)
+	if ce == nil || root == nil || !ce.inGrace(root, now) {
+		return valid, err
+	}
+
+	return verify(root.Details.NotAfter.Add(-caGraceSlack), pool)
+}
+
+// checkCAExpiry warns about every root CA that expires within pki.ca_expiry.warn_before, and logs an error for every
+// root CA that has expired, at most once per caExpiryWarnInterval unless force is set.
+func (p *PKI) checkCAExpiry(now time.Time, force bool) {
+	last := p.caExpiryWarned.Load()
+	if !force && now.Sub(time.Unix(0, last)) < caExpiryWarnInterval {
+		return
+	}
+	if !p.caExpiryWarned.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	ce := p.caExpiry.Load()
+	pool := p.caPool.Load()
+	if ce == nil || pool == nil {
+		return
+	}
+
+	for fingerprint, ca := range pool.CAs {
+		l := p.l.WithField("caName", ca.Details.Name).
+			WithField("caFingerprint", fingerprint).
+			WithField("notAfter", ca.Details.NotAfter)
+
+		switch {
+		case ce.inGrace(ca, now):
+			l.WithField("graceEnds", ca.Details.NotAfter.Add(ce.grace)).
+				Error("CA certificate has expired, the certificates it signed are only accepted until pki.ca_expiry.grace runs out. Replace the CA now")
+		case ca.Details.NotAfter.Before(now):
+			l.Error("CA certificate has expired, the certificates it signed are refused")
+		case ca.Details.NotAfter.Before(now.Add(ce.warnBefore)):
+			l.WithField("expiresIn", ca.Details.NotAfter.Sub(now).Round(time.Second)).
+				Warn("CA certificate expires soon, the certificates it signed will be refused once it does. Replace the CA before then")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestExpiringCA returns a root CA valid until notAfter, its PEM, and a function that signs host certificates with it
+func newTestExpiringCA(t *testing.T, notAfter time.Time) (*cert.NebulaCertificate, []byte, func(notAfter time.Time) *cert.NebulaCertificate) {
+	caPub, caKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: notAfter.Add(-365 * 24 * time.Hour),
+			NotAfter:  notAfter,
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	assert.NoError(t, ca.Sign(cert.Curve_CURVE25519, caKey))
+	caPEM, err := ca.MarshalToPEM()
+	assert.NoError(t, err)
+	caFingerprint, err := ca.Sha256Sum()
+	assert.NoError(t, err)
+
+	return ca, caPEM, func(notAfter time.Time) *cert.NebulaCertificate {
+		c := &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      "host",
+				Ips:       []*net.IPNet{{IP: net.IP{10, 1, 1, 1}, Mask: net.IPMask{255, 255, 255, 0}}},
+				NotBefore: ca.Details.NotBefore,
+				NotAfter:  notAfter,
+				PublicKey: make([]byte, 32),
+				Issuer:    caFingerprint,
+			},
+		}
+		assert.NoError(t, c.Sign(cert.Curve_CURVE25519, caKey))
+		return c
+	}
+}
+
+func TestParseCAExpiry(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	ce, err := parseCAExpiry(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, ce.warnBefore)
+	assert.Equal(t, time.Duration(0), ce.grace)
+
+	c.Settings["pki"] = map[interface{}]interface{}{"ca_expiry": map[interface{}]interface{}{"grace": "-1h"}}
+	_, err = parseCAExpiry(c)
+	assert.EqualError(t, err, "pki.ca_expiry.grace can not be negative: -1h0m0s")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"ca_expiry": map[interface{}]interface{}{"warn_before": "-1h"}}
+	_, err = parseCAExpiry(c)
+	assert.EqualError(t, err, "pki.ca_expiry.warn_before can not be negative: -1h0m0s")
+}
+
+func TestPKI_VerifyCert(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	caNotAfter := now.Add(-time.Hour)
+	_, caPEM, sign := newTestExpiringCA(t, caNotAfter)
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	assert.ErrorIs(t, err, cert.ErrExpired)
+
+	// Signed like nebula-cert does by default, expiring a second before the CA
+	host := sign(caNotAfter.Add(-time.Second))
+	// Expired long before the CA did
+	stale := sign(caNotAfter.Add(-24 * time.Hour))
+
+	p := &PKI{l: test.NewLogger()}
+
+	// Without pki.ca_expiry everything signed by an expired CA is refused
+	ok, err := p.VerifyCert(host, caPool, now, false)
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, cert.ErrRootExpired)
+
+	// So it is with the default grace of 0, the hard fail
+	p.caExpiry.Store(&caExpiry{})
+	ok, err = p.VerifyCert(host, caPool, now, false)
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, cert.ErrRootExpired)
+
+	// Within the grace period the certificates that expired along with the CA are accepted
+	p.caExpiry.Store(&caExpiry{grace: 2 * time.Hour})
+	ok, err = p.VerifyCert(host, caPool, now, false)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	ok, err = p.VerifyCert(host, caPool, now, true)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	// But not the ones that had expired before it
+	ok, err = p.VerifyCert(stale, caPool, now, false)
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, cert.ErrExpired)
+
+	// Once the grace period runs out they are refused again
+	p.caExpiry.Store(&caExpiry{grace: 30 * time.Minute})
+	ok, err = p.VerifyCert(host, caPool, now, false)
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, cert.ErrRootExpired)
+
+	// Other failures are never covered by the grace period
+	p.caExpiry.Store(&caExpiry{grace: 2 * time.Hour})
+	fingerprint, err := host.Sha256Sum()
+	assert.NoError(t, err)
+	caPool.BlocklistFingerprint(fingerprint)
+	ok, err = p.VerifyCert(host, caPool, now, false)
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, cert.ErrBlockListed)
+}
+
+func TestLoadCAPoolFromConfig_caExpiry(t *testing.T) {
+	l := test.NewLogger()
+	_, caPEM, _ := newTestExpiringCA(t, time.Now().Add(-time.Hour))
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": string(caPEM)}
+
+	// A pool with only expired roots is refused
+	_, err := loadCAPoolFromConfig(l, c, &caExpiry{})
+	assert.EqualError(t, err, "no valid CA certificates present")
+
+	// Unless they are within the grace period
+	caPool, err := loadCAPoolFromConfig(l, c, &caExpiry{grace: 2 * time.Hour})
+	assert.NoError(t, err)
+	assert.Len(t, caPool.CAs, 1)
+
+	_, err = loadCAPoolFromConfig(l, c, &caExpiry{grace: 30 * time.Minute})
+	assert.EqualError(t, err, "no valid CA certificates present")
+}
+
+func TestPKI_checkCAExpiry(t *testing.T) {
+	l, hook := logtest.NewNullLogger()
+	// Certificates only hold whole seconds
+	now := time.Now().Truncate(time.Second)
+	_, caPEM, _ := newTestExpiringCA(t, now.Add(24*time.Hour))
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	assert.NoError(t, err)
+
+	p := &PKI{l: l}
+	p.caPool.Store(caPool)
+	p.caExpiry.Store(&caExpiry{warnBefore: 48 * time.Hour, grace: time.Hour})
+
+	// A CA expiring within warn_before is warned about
+	p.checkCAExpiry(now, true)
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, 24*time.Hour, hook.LastEntry().Data["expiresIn"])
+
+	// Again only once caExpiryWarnInterval has passed
+	hook.Reset()
+	p.checkCAExpiry(now.Add(time.Minute), false)
+	assert.Empty(t, hook.AllEntries())
+	p.checkCAExpiry(now.Add(caExpiryWarnInterval), false)
+	assert.Len(t, hook.AllEntries(), 1)
+
+	// Within the grace period and after it runs out an error is logged
+	hook.Reset()
+	p.checkCAExpiry(now.Add(24*time.Hour+time.Minute), true)
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Data, "graceEnds")
+
+	hook.Reset()
+	p.checkCAExpiry(now.Add(26*time.Hour), true)
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	assert.NotContains(t, hook.LastEntry().Data, "graceEnds")
+
+	// Nothing is logged for a CA that is far from expiring
+	hook.Reset()
+	p.caExpiry.Store(&caExpiry{warnBefore: time.Hour})
+	p.checkCAExpiry(now, true)
+	assert.Empty(t, hook.AllEntries())
+}
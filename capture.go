@@ -0,0 +1,205 @@
+package nebula
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/iputil"
+)
+
+const (
+	// maxCaptureDuration bounds every capture, including one that is waiting on a packet count from an idle peer
+	maxCaptureDuration = time.Hour
+	// maxCaptureBytes bounds the size of a capture file, the capture stops before writing past it
+	maxCaptureBytes = 64 * 1024 * 1024
+	// captureQueueLen is how many packets can wait to be written before more are dropped from the capture
+	captureQueueLen = 1024
+
+	pcapMagic     = 0xa1b2c3d4
+	pcapSnapLen   = 65535
+	pcapLinkRaw   = 101
+	pcapHeadLen   = 24
+	pcapRecordLen = 16
+)
+
+var errCaptureRunning = errors.New("a capture is already running")
+
+type capturedPacket struct {
+	at     time.Time
+	packet []byte
+}
+
+// packetCapture writes the inner packets to and from one peer to w in pcap format. The packets are copied off the hot
+// path into a queue and written by run, packets that arrive while the queue is full are left out of the capture.
+type packetCapture struct {
+	l        *logrus.Logger
+	vpnIp    iputil.VpnIp
+	w        io.WriteCloser
+	duration time.Duration
+	count    int
+
+	queue    chan capturedPacket
+	done     chan struct{}
+	stopOnce sync.Once
+	written  int
+	dropped  atomic.Int64
+}
+
+// newPacketCapture captures packets for vpnIp until duration has passed or count packets were written, whichever
+// comes first. A 0 count or duration is not a limit, maxCaptureDuration and maxCaptureBytes always are.
+func newPacketCapture(l *logrus.Logger, vpnIp iputil.VpnIp, w io.WriteCloser, duration time.Duration, count int) *packetCapture {
+	if duration <= 0 || duration > maxCaptureDuration {
+		duration = maxCaptureDuration
+	}
+
+	return &packetCapture{
+		l:        l,
+		vpnIp:    vpnIp,
+		w:        w,
+		duration: duration,
+		count:    count,
+		queue:    make(chan capturedPacket, captureQueueLen),
+		done:     make(chan struct{}),
+	}
+}
+
+// add queues a copy of packet if it is for the captured peer, it never blocks
+func (pc *packetCapture) add(vpnIp iputil.VpnIp, packet []byte) {
+	if vpnIp != pc.vpnIp {
+		return
+	}
+
+	select {
+	case pc.queue <- capturedPacket{at: time.Now(), packet: append([]byte(nil), packet...)}:
+	default:
+		pc.dropped.Add(1)
+	}
+}
+
+// stop ends the capture early, it is safe to call more than once
+func (pc *packetCapture) stop() {
+	pc.stopOnce.Do(func() { close(pc.done) })
+}
+
+// run writes queued packets until a limit is reached or stop is called, then closes w
+func (pc *packetCapture) run() {
+	defer pc.w.Close()
+	timer := time.NewTimer(pc.duration)
+	defer timer.Stop()
+
+	l := pc.l.WithField("vpnIp", pc.vpnIp)
+	bw := bufio.NewWriter(pc.w)
+	size, err := writePcapHeader(bw)
+	if err != nil {
+		l.WithError(err).Error("Failed to write the packet capture")
+		return
+	}
+
+	// write returns why the capture is over once a limit is reached
+	write := func(p capturedPacket) (string, error) {
+		if size+pcapRecordLen+len(p.packet) > maxCaptureBytes {
+			return "size", nil
+		}
+
+		n, err := writePcapRecord(bw, p.at, p.packet)
+		size += n
+		if err != nil {
+			return "", err
+		}
+
+		pc.written++
+		if pc.count > 0 && pc.written >= pc.count {
+			return "count", nil
+		}
+		return "", nil
+	}
+
+	reason := ""
+	for reason == "" && err == nil {
+		select {
+		case p := <-pc.queue:
+			reason, err = write(p)
+		case <-timer.C:
+			reason = "duration"
+		case <-pc.done:
+			reason = "stopped"
+		}
+	}
+
+	// Packets that were queued before the duration ran out or the capture was stopped are still part of it
+	queued := 0
+	if reason == "duration" || reason == "stopped" {
+		queued = len(pc.queue)
+	}
+	for ; queued > 0 && err == nil; queued-- {
+		var r string
+		r, err = write(<-pc.queue)
+		if r != "" {
+			reason = r
+			break
+		}
+	}
+
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err != nil {
+		l.WithError(err).Error("Failed to write the packet capture")
+		return
+	}
+
+	l.WithField("packets", pc.written).WithField("dropped", pc.dropped.Load()).WithField("reason", reason).
+		Info("Packet capture finished")
+}
+
+// writePcapHeader writes the pcap global header for raw ip packets
+func writePcapHeader(w io.Writer) (int, error) {
+	var b [pcapHeadLen]byte
+	binary.LittleEndian.PutUint32(b[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(b[4:6], 2)
+	binary.LittleEndian.PutUint16(b[6:8], 4)
+	binary.LittleEndian.PutUint32(b[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(b[20:24], pcapLinkRaw)
+	return w.Write(b[:])
+}
+
+// writePcapRecord writes a single packet, truncated to the snap length
+func writePcapRecord(w io.Writer, at time.Time, packet []byte) (int, error) {
+	incl := packet
+	if len(incl) > pcapSnapLen {
+		incl = incl[:pcapSnapLen]
+	}
+
+	var b [pcapRecordLen]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(incl)))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(len(packet)))
+	n, err := w.Write(b[:])
+	if err != nil {
+		return n, err
+	}
+
+	m, err := w.Write(incl)
+	return n + m, err
+}
+
+// startCapture runs pc until it finishes, only one capture can run at a time
+func (f *Interface) startCapture(pc *packetCapture) error {
+	if !f.capture.CompareAndSwap(nil, pc) {
+		return errCaptureRunning
+	}
+
+	go func() {
+		pc.run()
+		f.capture.CompareAndSwap(pc, nil)
+	}()
+	return nil
+}
@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestPacketCapture(t *testing.T) {
+	l := test.NewLogger()
+	peer := iputil.Ip2VpnIp([]byte{10, 0, 0, 2})
+	buf := &bytes.Buffer{}
+
+	f := &Interface{l: l}
+	pc := newPacketCapture(l, peer, nopWriteCloser{buf}, 0, 2)
+
+	// Only the packets of the captured peer are written, up to the count
+	assert.NoError(t, f.startCapture(pc))
+	assert.ErrorIs(t, f.startCapture(newPacketCapture(l, peer, nopWriteCloser{&bytes.Buffer{}}, 0, 1)), errCaptureRunning)
+	f.inspect(iputil.Ip2VpnIp([]byte{10, 0, 0, 3}), true, []byte{0x45, 1})
+	f.inspect(peer, true, []byte{0x45, 2, 3})
+	f.inspect(peer, false, []byte{0x45, 4})
+	f.inspect(peer, true, []byte{0x45, 5})
+	assert.Eventually(t, func() bool { return f.capture.Load() == nil }, time.Second, time.Millisecond)
+
+	b := buf.Bytes()
+	assert.Len(t, b, pcapHeadLen+pcapRecordLen+3+pcapRecordLen+2)
+	assert.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(b[0:4]))
+	assert.Equal(t, uint32(pcapLinkRaw), binary.LittleEndian.Uint32(b[20:24]))
+
+	b = b[pcapHeadLen:]
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(b[8:12]))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(b[12:16]))
+	assert.Equal(t, []byte{0x45, 2, 3}, b[pcapRecordLen:pcapRecordLen+3])
+
+	b = b[pcapRecordLen+3:]
+	assert.Equal(t, uint32(2), binary.LittleEndian.Uint32(b[8:12]))
+	assert.Equal(t, []byte{0x45, 4}, b[pcapRecordLen:])
+
+	// A stopped capture is flushed and another one can start
+	buf.Reset()
+	pc = newPacketCapture(l, peer, nopWriteCloser{buf}, time.Minute, 0)
+	assert.NoError(t, f.startCapture(pc))
+	f.inspect(peer, true, []byte{0x45, 6})
+	pc.stop()
+	assert.Eventually(t, func() bool { return f.capture.Load() == nil }, time.Second, time.Millisecond)
+	assert.Len(t, buf.Bytes(), pcapHeadLen+pcapRecordLen+2)
+}
@@ -7,8 +7,13 @@ import (
 	"time"
 )
 
+// MaxIntermediates is the most intermediate CAs allowed between a certificate and the root that anchors it
+const MaxIntermediates = 3
+
 type NebulaCAPool struct {
-	CAs           map[string]*NebulaCertificate
+	CAs map[string]*NebulaCertificate
+	// Intermediates are CAs signed by another CA, they are only trusted when they chain to one of CAs
+	Intermediates map[string]*NebulaCertificate
 	certBlocklist map[string]struct{}
 }
 
@@ -16,6 +21,7 @@ type NebulaCAPool struct {
 func NewCAPool() *NebulaCAPool {
 	ca := NebulaCAPool{
 		CAs:           make(map[string]*NebulaCertificate),
+		Intermediates: make(map[string]*NebulaCertificate),
 		certBlocklist: make(map[string]struct{}),
 	}
 
@@ -24,6 +30,7 @@ func NewCAPool() *NebulaCAPool {
 
 // NewCAPoolFromBytes will create a new CA pool from the provided
 // input bytes, which must be a PEM-encoded set of nebula certificates.
+// Intermediate CAs may be included in any order and must chain to a root in the same input.
 // If the pool contains any expired certificates, an ErrExpired will be
 // returned along with the pool. The caller must handle any such errors.
 func NewCAPoolFromBytes(caPEMs []byte) (*NebulaCAPool, error) {
@@ -44,6 +51,16 @@ func NewCAPoolFromBytes(caPEMs []byte) (*NebulaCAPool, error) {
 		}
 	}
 
+	// Intermediates can only be checked once every root is known
+	for _, c := range pool.Intermediates {
+		_, err = c.Verify(time.Now(), pool)
+		if errors.Is(err, ErrExpired) || errors.Is(err, ErrRootExpired) {
+			expired = true
+		} else if err != nil {
+			return nil, fmt.Errorf("intermediate ca %s: %w", c.Details.Name, err)
+		}
+	}
+
 	if expired {
 		return pool, ErrExpired
 	}
@@ -53,7 +70,8 @@ func NewCAPoolFromBytes(caPEMs []byte) (*NebulaCAPool, error) {
 
 // AddCACertificate verifies a Nebula CA certificate and adds it to the pool
 // Only the first pem encoded object will be consumed, any remaining bytes are returned.
-// Parsed certificates will be verified and must be a CA
+// Parsed certificates will be verified and must be a CA. A CA that is not self-signed is added as an intermediate, it
+// is not trusted until it chains to a root.
 func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
 	c, pemBytes, err := UnmarshalNebulaCertificateFromPEM(pemBytes)
 	if err != nil {
@@ -64,16 +82,17 @@ func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
 		return pemBytes, fmt.Errorf("%s: %w", c.Details.Name, ErrNotCA)
 	}
 
-	if !c.CheckSignature(c.Details.PublicKey) {
-		return pemBytes, fmt.Errorf("%s: %w", c.Details.Name, ErrNotSelfSigned)
-	}
-
 	sum, err := c.Sha256Sum()
 	if err != nil {
 		return pemBytes, fmt.Errorf("could not calculate shasum for provided CA; error: %s; %s", err, c.Details.Name)
 	}
 
-	ncp.CAs[sum] = c
+	if c.CheckSignature(c.Details.PublicKey) {
+		ncp.CAs[sum] = c
+	} else {
+		ncp.Intermediates[sum] = c
+	}
+
 	if c.Expired(time.Now()) {
 		return pemBytes, fmt.Errorf("%s: %w", c.Details.Name, ErrExpired)
 	}
@@ -123,9 +142,71 @@ func (ncp *NebulaCAPool) GetCAForCert(c *NebulaCertificate) (*NebulaCertificate,
 		return signer, nil
 	}
 
+	signer, ok = ncp.Intermediates[c.Details.Issuer]
+	if ok {
+		return signer, nil
+	}
+
 	return nil, fmt.Errorf("could not find ca for the certificate")
 }
 
+// WithIntermediates returns a pool that also has intermediates, like the ones a peer sends along with its certificate.
+// The roots and blocklist are shared with ncp, and the intermediates are only trusted if they chain to a root.
+func (ncp *NebulaCAPool) WithIntermediates(intermediates []*NebulaCertificate) *NebulaCAPool {
+	if len(intermediates) == 0 {
+		return ncp
+	}
+
+	p := &NebulaCAPool{
+		CAs:           ncp.CAs,
+		Intermediates: make(map[string]*NebulaCertificate, len(ncp.Intermediates)+len(intermediates)),
+		certBlocklist: ncp.certBlocklist,
+	}
+
+	for k, c := range ncp.Intermediates {
+		p.Intermediates[k] = c
+	}
+
+	for _, c := range intermediates {
+		if !c.Details.IsCA {
+			continue
+		}
+
+		sum, err := c.Sha256Sum()
+		if err != nil {
+			continue
+		}
+
+		if _, ok := p.CAs[sum]; !ok {
+			p.Intermediates[sum] = c
+		}
+	}
+
+	return p
+}
+
+// GetChainForCert returns the intermediate CAs between c and its root, closest to c first. It is empty if c was signed
+// by a root or the chain can not be followed to one.
+func (ncp *NebulaCAPool) GetChainForCert(c *NebulaCertificate) []*NebulaCertificate {
+	var chain []*NebulaCertificate
+	issuer := c.Details.Issuer
+	for len(chain) <= MaxIntermediates {
+		if _, ok := ncp.CAs[issuer]; ok {
+			return chain
+		}
+
+		signer, ok := ncp.Intermediates[issuer]
+		if !ok {
+			return nil
+		}
+
+		chain = append(chain, signer)
+		issuer = signer.Details.Issuer
+	}
+
+	return nil
+}
+
 // GetFingerprints returns an array of trusted CA fingerprints
 func (ncp *NebulaCAPool) GetFingerprints() []string {
 	fp := make([]string, len(ncp.CAs))
@@ -26,6 +26,16 @@ import (
 
 const publicKeyLen = 32
 
+const (
+	// Version1 is the original certificate format, every node understands it
+	Version1 uint32 = 1
+	// Version2 certificates may have ipv6 subnets. Nodes that predate it refuse them as badly signed, every node that
+	// handshakes with a version 2 certificate, and every node whose CA is one, must support it before it is issued.
+	Version2 uint32 = 2
+	// VersionMax is the newest certificate version this code understands
+	VersionMax = Version2
+)
+
 const (
 	CertBanner                       = "NEBULA CERTIFICATE"
 	X25519PrivateKeyBanner           = "NEBULA X25519 PRIVATE KEY"
@@ -63,6 +73,8 @@ type NebulaCertificateDetails struct {
 	PublicKey []byte
 	IsCA      bool
 	Issuer    string
+	// Version is Version1 unless the certificate needs something newer, a zero Version is treated as Version1
+	Version uint32
 
 	// Map of groups for faster lookup
 	InvertedGroups map[string]struct{}
@@ -108,6 +120,17 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		return nil, fmt.Errorf("encoded Subnets should be in pairs, an odd number was found")
 	}
 
+	version := rc.Details.Version
+	if version == 0 {
+		version = Version1
+	}
+	if version > VersionMax {
+		return nil, fmt.Errorf("certificate version %v is not supported, the newest supported is %v", version, VersionMax)
+	}
+	if version < Version2 && len(rc.Details.Subnets6) > 0 {
+		return nil, fmt.Errorf("encoded Subnets6 need a version %v certificate, found version %v", Version2, version)
+	}
+
 	nc := NebulaCertificate{
 		Details: NebulaCertificateDetails{
 			Name:           rc.Details.Name,
@@ -118,6 +141,7 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 			NotAfter:       time.Unix(rc.Details.NotAfter, 0),
 			PublicKey:      make([]byte, len(rc.Details.PublicKey)),
 			IsCA:           rc.Details.IsCA,
+			Version:        version,
 			InvertedGroups: make(map[string]struct{}),
 			Curve:          rc.Details.Curve,
 		},
@@ -149,6 +173,17 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		}
 	}
 
+	for _, raw := range rc.Details.Subnets6 {
+		if len(raw) != net.IPv6len*2 {
+			return nil, fmt.Errorf("encoded Subnets6 should be %v bytes each, found %v", net.IPv6len*2, len(raw))
+		}
+
+		subnet := &net.IPNet{IP: make(net.IP, net.IPv6len), Mask: make(net.IPMask, net.IPv6len)}
+		copy(subnet.IP, raw[:net.IPv6len])
+		copy(subnet.Mask, raw[net.IPv6len:])
+		nc.Details.Subnets = append(nc.Details.Subnets, subnet)
+	}
+
 	for _, g := range rc.Details.Groups {
 		nc.Details.InvertedGroups[g] = struct{}{}
 	}
@@ -518,17 +553,52 @@ func (nc *NebulaCertificate) Sign(curve Curve, key []byte) error {
 		return fmt.Errorf("curve in cert and private key supplied don't match")
 	}
 
+	if err := nc.checkVersion(); err != nil {
+		return err
+	}
+
 	b, err := proto.Marshal(nc.getRawDetails())
 	if err != nil {
 		return err
 	}
 
-	var sig []byte
+	sig, err := signBytes(curve, key, b)
+	if err != nil {
+		return err
+	}
+
+	nc.Signature = sig
+	return nil
+}
+
+// checkVersion returns an error if the details need a newer certificate version than Details.Version
+func (nc *NebulaCertificate) checkVersion() error {
+	version := nc.Details.Version
+	if version == 0 {
+		version = Version1
+	}
+
+	if version > VersionMax {
+		return fmt.Errorf("certificate version %v is not supported, the newest supported is %v", version, VersionMax)
+	}
+
+	if version < Version2 {
+		for _, subnet := range nc.Details.Subnets {
+			if subnet.IP.To4() == nil {
+				return fmt.Errorf("ipv6 subnet %v needs a version %v certificate", subnet, Version2)
+			}
+		}
+	}
+
+	return nil
+}
 
+// signBytes signs b with a private key of the given curve
+func signBytes(curve Curve, key []byte, b []byte) ([]byte, error) {
 	switch curve {
 	case Curve_CURVE25519:
 		signer := ed25519.PrivateKey(key)
-		sig = ed25519.Sign(signer, b)
+		return ed25519.Sign(signer, b), nil
 	case Curve_P256:
 		signer := &ecdsa.PrivateKey{
 			PublicKey: ecdsa.PublicKey{
@@ -543,16 +613,10 @@ func (nc *NebulaCertificate) Sign(curve Curve, key []byte) error {
 		// We need to hash first for ECDSA
 		// - https://pkg.go.dev/crypto/ecdsa#SignASN1
 		hashed := sha256.Sum256(b)
-		sig, err = ecdsa.SignASN1(rand.Reader, signer, hashed[:])
-		if err != nil {
-			return err
-		}
+		return ecdsa.SignASN1(rand.Reader, signer, hashed[:])
 	default:
-		return fmt.Errorf("invalid curve: %s", nc.Details.Curve)
+		return nil, fmt.Errorf("invalid curve: %s", curve)
 	}
-
-	nc.Signature = sig
-	return nil
 }
 
 // CheckSignature verifies the signature against the provided public key
@@ -561,14 +625,22 @@ func (nc *NebulaCertificate) CheckSignature(key []byte) bool {
 	if err != nil {
 		return false
 	}
-	switch nc.Details.Curve {
+	return checkBytesSignature(nc.Details.Curve, key, b, nc.Signature)
+}
+
+// checkBytesSignature verifies sig over b against a public key of the given curve
+func checkBytesSignature(curve Curve, key []byte, b []byte, sig []byte) bool {
+	switch curve {
 	case Curve_CURVE25519:
-		return ed25519.Verify(ed25519.PublicKey(key), b, nc.Signature)
+		return ed25519.Verify(ed25519.PublicKey(key), b, sig)
 	case Curve_P256:
 		x, y := elliptic.Unmarshal(elliptic.P256(), key)
+		if x == nil {
+			return false
+		}
 		pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 		hashed := sha256.Sum256(b)
-		return ecdsa.VerifyASN1(pubKey, hashed[:], nc.Signature)
+		return ecdsa.VerifyASN1(pubKey, hashed[:], sig)
 	default:
 		return false
 	}
@@ -621,6 +693,11 @@ func (nc *NebulaCertificate) ResetCache() {
 
 // Verify will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
 func (nc *NebulaCertificate) verify(t time.Time, ncp *NebulaCAPool, useCache bool) (bool, error) {
+	return nc.verifyChain(t, ncp, useCache, 0)
+}
+
+// verifyChain is verify for a certificate that is depth intermediates away from the certificate being verified
+func (nc *NebulaCertificate) verifyChain(t time.Time, ncp *NebulaCAPool, useCache bool, depth int) (bool, error) {
 	if ncp.isBlocklistedWithCache(nc, useCache) {
 		return false, ErrBlockListed
 	}
@@ -630,8 +707,20 @@ func (nc *NebulaCertificate) verify(t time.Time, ncp *NebulaCAPool, useCache boo
 		return false, err
 	}
 
-	if signer.Expired(t) {
-		return false, ErrRootExpired
+	if _, ok := ncp.CAs[nc.Details.Issuer]; ok {
+		if signer.Expired(t) {
+			return false, ErrRootExpired
+		}
+
+	} else {
+		// The signer is an intermediate, it has to hold up all the way to a root as well
+		if depth >= MaxIntermediates {
+			return false, ErrChainTooLong
+		}
+
+		if _, err := signer.verifyChain(t, ncp, useCache, depth+1); err != nil {
+			return false, fmt.Errorf("intermediate ca %s: %w", signer.Details.Name, err)
+		}
 	}
 
 	if nc.Expired(t) {
@@ -792,6 +881,9 @@ func (nc *NebulaCertificate) String() string {
 	s += fmt.Sprintf("\t\tIssuer: %s\n", nc.Details.Issuer)
 	s += fmt.Sprintf("\t\tPublic key: %x\n", nc.Details.PublicKey)
 	s += fmt.Sprintf("\t\tCurve: %s\n", nc.Details.Curve)
+	if nc.Details.Version > Version1 {
+		s += fmt.Sprintf("\t\tVersion: %v\n", nc.Details.Version)
+	}
 	s += "\t}\n"
 	fp, err := nc.Sha256Sum()
 	if err == nil {
@@ -819,10 +911,23 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 		rd.Ips = append(rd.Ips, ip2int(ipNet.IP), ip2int(ipNet.Mask))
 	}
 
+	// Ipv6 subnets go in their own field of a version 2 certificate, certificates that have none marshal exactly like
+	// they always have
 	for _, ipNet := range nc.Details.Subnets {
+		if ipNet.IP.To4() == nil {
+			raw := make([]byte, 0, net.IPv6len*2)
+			raw = append(raw, ipNet.IP.To16()...)
+			rd.Subnets6 = append(rd.Subnets6, append(raw, ipNet.Mask...))
+			continue
+		}
 		rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
 	}
 
+	// Left out of version 1 certificates so they are the same bytes older nodes sign and check
+	if nc.Details.Version > Version1 {
+		rd.Version = nc.Details.Version
+	}
+
 	copy(rd.PublicKey, nc.Details.PublicKey[:])
 
 	// I know, this is terrible
@@ -932,6 +1037,7 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 			PublicKey:      make([]byte, len(nc.Details.PublicKey)),
 			IsCA:           nc.Details.IsCA,
 			Issuer:         nc.Details.Issuer,
+			Version:        nc.Details.Version,
 			InvertedGroups: make(map[string]struct{}, len(nc.Details.InvertedGroups)),
 		},
 		Signature: make([]byte, len(nc.Signature)),
@@ -967,6 +1073,10 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 }
 
 func netMatch(certIp *net.IPNet, rootIps []*net.IPNet) bool {
+	if certIp.IP.To4() == nil {
+		return netMatch6(certIp, rootIps)
+	}
+
 	for _, net := range rootIps {
 		if net.Contains(certIp.IP) && maskContains(net.Mask, certIp.Mask) {
 			return true
@@ -976,6 +1086,19 @@ func netMatch(certIp *net.IPNet, rootIps []*net.IPNet) bool {
 	return false
 }
 
+// netMatch6 is netMatch for an ipv6 network, it can only be within another ipv6 network
+func netMatch6(certIp *net.IPNet, rootIps []*net.IPNet) bool {
+	certOnes, certBits := certIp.Mask.Size()
+	for _, n := range rootIps {
+		ones, bits := n.Mask.Size()
+		if bits == net.IPv6len*8 && bits == certBits && ones <= certOnes && n.Contains(certIp.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func maskContains(caMask, certMask net.IPMask) bool {
 	caM := maskTo4(caMask)
 	cM := maskTo4(certMask)
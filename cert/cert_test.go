@@ -262,6 +262,102 @@ func TestNebulaCertificate_Verify(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_VerifyChain(t *testing.T) {
+	root, _, rootKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	inter, _, interKey, err := newTestIntermediateCert(root, rootKey, "test intermediate", time.Now(), time.Now().Add(8*time.Minute), []string{"test1"})
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(inter, interKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{"test1"})
+	assert.Nil(t, err)
+
+	rootPem, err := root.MarshalToPEM()
+	assert.Nil(t, err)
+	interPem, err := inter.MarshalToPEM()
+	assert.Nil(t, err)
+
+	// A pool with only the root can not build the chain
+	rootPool, err := NewCAPoolFromBytes(rootPem)
+	assert.Nil(t, err)
+	v, err := c.Verify(time.Now(), rootPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+	assert.Empty(t, rootPool.GetChainForCert(c))
+
+	// Unless the intermediate is provided along with the certificate
+	v, err = c.Verify(time.Now(), rootPool.WithIntermediates([]*NebulaCertificate{inter}))
+	assert.True(t, v)
+	assert.Nil(t, err)
+	assert.Empty(t, rootPool.Intermediates)
+
+	// The bundle can hold the intermediate in any order
+	pool, err := NewCAPoolFromBytes(append(interPem, rootPem...))
+	assert.Nil(t, err)
+	assert.Len(t, pool.CAs, 1)
+	assert.Len(t, pool.Intermediates, 1)
+	v, err = c.Verify(time.Now(), pool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+	chain := pool.GetChainForCert(c)
+	assert.Len(t, chain, 1)
+	assert.Equal(t, inter.Signature, chain[0].Signature)
+
+	// Every link is checked, the intermediate expires before the root does
+	v, err = c.Verify(time.Now().Add(9*time.Minute), pool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "intermediate ca test intermediate: certificate is expired")
+	assert.ErrorIs(t, err, ErrExpired)
+
+	v, err = c.Verify(time.Now().Add(time.Hour), pool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "intermediate ca test intermediate: root certificate is expired")
+
+	interFp, err := inter.Sha256Sum()
+	assert.Nil(t, err)
+	pool.BlocklistFingerprint(interFp)
+	v, err = c.Verify(time.Now(), pool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "intermediate ca test intermediate: certificate is in the block list")
+	pool.ResetCertBlocklist()
+
+	// The intermediate constrains what it signs like a root does
+	c2, _, _, err := newTestCert(inter, interKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{"test2"})
+	assert.Nil(t, err)
+	v, err = c2.Verify(time.Now(), pool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained a group not present on the signing ca: test2")
+
+	// An intermediate that does not chain to a trusted root is worthless
+	otherRoot, _, otherRootKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	otherInter, _, otherInterKey, err := newTestIntermediateCert(otherRoot, otherRootKey, "other intermediate", time.Now(), time.Now().Add(8*time.Minute), nil)
+	assert.Nil(t, err)
+	c3, _, _, err := newTestCert(otherInter, otherInterKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	v, err = c3.Verify(time.Now(), rootPool.WithIntermediates([]*NebulaCertificate{otherInter}))
+	assert.False(t, v)
+	assert.EqualError(t, err, "intermediate ca other intermediate: could not find ca for the certificate")
+
+	otherInterPem, err := otherInter.MarshalToPEM()
+	assert.Nil(t, err)
+	_, err = NewCAPoolFromBytes(append(rootPem, otherInterPem...))
+	assert.EqualError(t, err, "intermediate ca other intermediate: could not find ca for the certificate")
+
+	// Chains are limited in length
+	chain = []*NebulaCertificate{inter}
+	signer, signerKey := inter, interKey
+	for i := 0; i < MaxIntermediates; i++ {
+		signer, _, signerKey, err = newTestIntermediateCert(signer, signerKey, fmt.Sprintf("intermediate %v", i), time.Now(), time.Now().Add(8*time.Minute), nil)
+		assert.Nil(t, err)
+		chain = append(chain, signer)
+	}
+	c4, _, _, err := newTestCert(signer, signerKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	v, err = c4.Verify(time.Now(), rootPool.WithIntermediates(chain))
+	assert.False(t, v)
+	assert.ErrorIs(t, err, ErrChainTooLong)
+	assert.Empty(t, rootPool.WithIntermediates(chain).GetChainForCert(c4))
+}
+
 func TestNebulaCertificate_VerifyP256(t *testing.T) {
 	ca, _, caKey, err := newTestCaCertP256(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -479,6 +575,99 @@ func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestMarshalingNebulaCertificate_Subnets6(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("9.1.1.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8:1::/48")
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	// Ipv6 subnets round trip after the ipv4 ones and the signature still verifies
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{v6, v4}, []string{})
+	assert.Nil(t, err)
+	b, err := c.Marshal()
+	assert.Nil(t, err)
+
+	c2, err := UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Len(t, c2.Details.Subnets, 2)
+	assert.Equal(t, "9.1.1.0/24", c2.Details.Subnets[0].String())
+	assert.Equal(t, "2001:db8:1::/48", c2.Details.Subnets[1].String())
+	assert.Equal(t, Version2, c2.Details.Version)
+	assert.True(t, c2.CheckSignature(ca.Details.PublicKey))
+
+	// Only a version 2 certificate can have them
+	c.Details.Version = Version1
+	assert.EqualError(t, c.Sign(Curve_CURVE25519, caKey), "ipv6 subnet 2001:db8:1::/48 needs a version 2 certificate")
+	rc := &RawNebulaCertificate{Details: c.getRawDetails(), Signature: c.Signature}
+	b, err = proto.Marshal(rc)
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Subnets6 need a version 2 certificate, found version 1")
+
+	// A version this code does not know is refused before the signature is checked
+	rc.Details.Version = VersionMax + 1
+	b, err = proto.Marshal(rc)
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "certificate version 3 is not supported, the newest supported is 2")
+	c.Details.Version = VersionMax + 1
+	assert.EqualError(t, c.Sign(Curve_CURVE25519, caKey), "certificate version 3 is not supported, the newest supported is 2")
+
+	// Version 1 certificates carry neither field, they are the same bytes older nodes sign and check
+	c, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{v4}, []string{})
+	assert.Nil(t, err)
+	assert.Equal(t, Version1, c.Details.Version)
+	assert.Nil(t, c.getRawDetails().Subnets6)
+	assert.Zero(t, c.getRawDetails().Version)
+	c.Details.Version = 0
+	assert.Nil(t, c.Sign(Curve_CURVE25519, caKey))
+	b, err = c.Marshal()
+	assert.Nil(t, err)
+	c2, err = UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Equal(t, Version1, c2.Details.Version)
+	assert.True(t, c2.CheckSignature(ca.Details.PublicKey))
+
+	// A malformed entry is refused
+	rc = &RawNebulaCertificate{Details: c.getRawDetails(), Signature: c.Signature}
+	rc.Details.Version = Version2
+	rc.Details.Subnets6 = [][]byte{make([]byte, 20)}
+	b, err = proto.Marshal(rc)
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Subnets6 should be 32 bytes each, found 20")
+}
+
+func TestNebulaCertificate_Verify_Subnets6(t *testing.T) {
+	_, caV4, _ := net.ParseCIDR("10.0.0.0/16")
+	_, caV6, _ := net.ParseCIDR("2001:db8::/32")
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{caV4, caV6}, []string{"test"})
+	assert.Nil(t, err)
+
+	caPem, err := ca.MarshalToPEM()
+	assert.Nil(t, err)
+	caPool := NewCAPool()
+	_, err = caPool.AddCACertificate(caPem)
+	assert.Nil(t, err)
+
+	verify := func(subnet string) error {
+		_, n, _ := net.ParseCIDR(subnet)
+		c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{n}, []string{"test"})
+		assert.Nil(t, err)
+		_, err = c.Verify(time.Now(), caPool)
+		return err
+	}
+
+	assert.Nil(t, verify("2001:db8:1::/48"))
+	assert.Nil(t, verify("2001:db8::/32"))
+	assert.EqualError(t, verify("2001:db8::/31"), "certificate contained a subnet assignment outside the limitations of the signing ca: 2001:db8::/31")
+	assert.EqualError(t, verify("2001:db9::/48"), "certificate contained a subnet assignment outside the limitations of the signing ca: 2001:db9::/48")
+
+	// Ipv4 subnets are still checked against the ipv4 networks of the ca
+	assert.Nil(t, verify("10.0.1.0/24"))
+	assert.EqualError(t, verify("10.1.0.0/24"), "certificate contained a subnet assignment outside the limitations of the signing ca: 10.1.0.0/24")
+}
+
 func TestNebulaCertificate_VerifyPrivateKey(t *testing.T) {
 	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -1082,6 +1271,7 @@ func newTestCaCert(before, after time.Time, ips, subnets []*net.IPNet, groups []
 
 	if len(subnets) > 0 {
 		nc.Details.Subnets = subnets
+		nc.Details.Version = testCertVersion(subnets)
 	}
 
 	if len(groups) > 0 {
@@ -1125,6 +1315,7 @@ func newTestCaCertP256(before, after time.Time, ips, subnets []*net.IPNet, group
 
 	if len(subnets) > 0 {
 		nc.Details.Subnets = subnets
+		nc.Details.Version = testCertVersion(subnets)
 	}
 
 	if len(groups) > 0 {
@@ -1138,6 +1329,42 @@ func newTestCaCertP256(before, after time.Time, ips, subnets []*net.IPNet, group
 	return nc, pub, rawPriv, nil
 }
 
+// newTestIntermediateCert returns an ed25519 CA signed by signer
+func newTestIntermediateCert(signer *NebulaCertificate, key []byte, name string, before, after time.Time, groups []string) (*NebulaCertificate, []byte, []byte, error) {
+	issuer, err := signer.Sha256Sum()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nc := &NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name:           name,
+			Groups:         groups,
+			NotBefore:      time.Unix(before.Unix(), 0),
+			NotAfter:       time.Unix(after.Unix(), 0),
+			PublicKey:      pub,
+			IsCA:           true,
+			Issuer:         issuer,
+			InvertedGroups: make(map[string]struct{}),
+		},
+	}
+
+	for _, g := range groups {
+		nc.Details.InvertedGroups[g] = struct{}{}
+	}
+
+	err = nc.Sign(Curve_CURVE25519, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return nc, pub, priv, nil
+}
+
 func newTestCert(ca *NebulaCertificate, key []byte, before, after time.Time, ips, subnets []*net.IPNet, groups []string) (*NebulaCertificate, []byte, []byte, error) {
 	issuer, err := ca.Sha256Sum()
 	if err != nil {
@@ -1194,6 +1421,7 @@ func newTestCert(ca *NebulaCertificate, key []byte, before, after time.Time, ips
 			IsCA:           false,
 			Curve:          ca.Details.Curve,
 			Issuer:         issuer,
+			Version:        testCertVersion(subnets),
 			InvertedGroups: make(map[string]struct{}),
 		},
 	}
@@ -1228,3 +1456,13 @@ func p256Keypair() ([]byte, []byte) {
 	pubkey := privkey.PublicKey()
 	return pubkey.Bytes(), privkey.Bytes()
 }
+
+// testCertVersion returns the certificate version needed for subnets
+func testCertVersion(subnets []*net.IPNet) uint32 {
+	for _, subnet := range subnets {
+		if subnet.IP.To4() == nil {
+			return Version2
+		}
+	}
+	return Version1
+}
@@ -11,4 +11,5 @@ var (
 	ErrNotSelfSigned     = errors.New("certificate is not self-signed")
 	ErrBlockListed       = errors.New("certificate is in the block list")
 	ErrSignatureMismatch = errors.New("certificate signature did not match")
+	ErrChainTooLong      = errors.New("certificate chain has too many intermediate CAs")
 )
@@ -0,0 +1,142 @@
+package cert
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const PeerPolicyBanner = "NEBULA PEER POLICY"
+
+var ErrPolicySignerUnknown = errors.New("peer policy signer is not a trusted CA")
+
+// peerPolicySigningContext is put in front of the policy before it is signed or verified, a CA signature made for a
+// certificate or anything else can never pass as the signature of a policy
+const peerPolicySigningContext = "nebula peer policy v1\x00"
+
+func peerPolicySigningBytes(b []byte) []byte {
+	return append([]byte(peerPolicySigningContext), b...)
+}
+
+// PeerPolicy lists which vpn addresses may start a tunnel with which, a lighthouse distributes it to its clients
+type PeerPolicy struct {
+	// Version must grow with every new policy, clients never replace a policy with one that has a lower version
+	Version uint64           `json:"version"`
+	Rules   []PeerPolicyRule `json:"rules"`
+}
+
+// PeerPolicyRule allows the vpn addresses in From to start tunnels with the vpn addresses in To
+type PeerPolicyRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// SignedPeerPolicy is a marshalled PeerPolicy and the signature of the CA that signed it
+type SignedPeerPolicy struct {
+	Policy []byte `json:"policy"`
+	// Signer is the fingerprint of the CA certificate that signed Policy
+	Signer    string `json:"signer"`
+	Signature []byte `json:"signature"`
+}
+
+// Validate makes sure every rule is made of two cidrs
+func (p *PeerPolicy) Validate() error {
+	for i, r := range p.Rules {
+		if _, _, err := net.ParseCIDR(r.From); err != nil {
+			return fmt.Errorf("rule %v has an invalid from cidr: %w", i, err)
+		}
+		if _, _, err := net.ParseCIDR(r.To); err != nil {
+			return fmt.Errorf("rule %v has an invalid to cidr: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SignPeerPolicy signs p with the private key of the CA certificate signer and returns it PEM encoded
+func SignPeerPolicy(p *PeerPolicy, signer *NebulaCertificate, curve Curve, key []byte) ([]byte, error) {
+	if !signer.Details.IsCA {
+		return nil, ErrNotCA
+	}
+
+	if curve != signer.Details.Curve {
+		return nil, fmt.Errorf("curve in cert and private key supplied don't match")
+	}
+
+	if err := signer.VerifyPrivateKey(curve, key); err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := signer.Sha256Sum()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signBytes(curve, key, peerPolicySigningBytes(b))
+	if err != nil {
+		return nil, err
+	}
+
+	sb, err := json.Marshal(SignedPeerPolicy{Policy: b, Signer: fp, Signature: sig})
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: PeerPolicyBanner, Bytes: sb}), nil
+}
+
+// UnmarshalSignedPeerPolicyFromPEM parses a signed peer policy, the signature is not checked
+func UnmarshalSignedPeerPolicyFromPEM(b []byte) (*SignedPeerPolicy, []byte, error) {
+	p, r := pem.Decode(b)
+	if p == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+	if p.Type != PeerPolicyBanner {
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula peer policy banner")
+	}
+
+	var sp SignedPeerPolicy
+	if err := json.Unmarshal(p.Bytes, &sp); err != nil {
+		return nil, r, err
+	}
+
+	return &sp, r, nil
+}
+
+// Verify checks that the policy was signed by one of the root CAs in signers that is valid at t and returns it
+func (sp *SignedPeerPolicy) Verify(t time.Time, signers *NebulaCAPool) (*PeerPolicy, error) {
+	signer, ok := signers.CAs[sp.Signer]
+	if !ok {
+		return nil, ErrPolicySignerUnknown
+	}
+
+	if signer.Expired(t) {
+		return nil, ErrRootExpired
+	}
+
+	if !checkBytesSignature(signer.Details.Curve, signer.Details.PublicKey, peerPolicySigningBytes(sp.Policy), sp.Signature) {
+		return nil, ErrSignatureMismatch
+	}
+
+	var p PeerPolicy
+	if err := json.Unmarshal(sp.Policy, &p); err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,112 @@
+package cert
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignPeerPolicy(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	caP256, _, caKeyP256, err := newTestCaCertP256(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	other, _, otherKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+
+	pool := NewCAPool()
+	fp, err := ca.Sha256Sum()
+	require.NoError(t, err)
+	pool.CAs[fp] = ca
+	fpP256, err := caP256.Sha256Sum()
+	require.NoError(t, err)
+	pool.CAs[fpP256] = caP256
+
+	p := &PeerPolicy{Version: 3, Rules: []PeerPolicyRule{{From: "10.1.0.0/16", To: "10.2.0.0/16"}}}
+
+	for _, tc := range []struct {
+		name   string
+		signer *NebulaCertificate
+		curve  Curve
+		key    []byte
+	}{
+		{"ed25519", ca, Curve_CURVE25519, caKey},
+		{"p256", caP256, Curve_P256, caKeyP256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := SignPeerPolicy(p, tc.signer, tc.curve, tc.key)
+			require.NoError(t, err)
+
+			sp, rest, err := UnmarshalSignedPeerPolicyFromPEM(b)
+			require.NoError(t, err)
+			assert.Empty(t, rest)
+
+			vp, err := sp.Verify(time.Now(), pool)
+			require.NoError(t, err)
+			assert.Equal(t, p, vp)
+
+			// A changed policy no longer matches the signature
+			sp.Policy = []byte(`{"version":4,"rules":[{"from":"0.0.0.0/0","to":"0.0.0.0/0"}]}`)
+			_, err = sp.Verify(time.Now(), pool)
+			assert.ErrorIs(t, err, ErrSignatureMismatch)
+
+			// A signature over the bare policy, without the signing context, is refused
+			sp.Policy, err = json.Marshal(p)
+			require.NoError(t, err)
+			sp.Signature, err = signBytes(tc.curve, tc.key, sp.Policy)
+			require.NoError(t, err)
+			_, err = sp.Verify(time.Now(), pool)
+			assert.ErrorIs(t, err, ErrSignatureMismatch)
+		})
+	}
+
+	// A CA that is not trusted can not sign a policy, even if it claims to be a trusted one
+	b, err := SignPeerPolicy(p, other, Curve_CURVE25519, otherKey)
+	require.NoError(t, err)
+	sp, _, err := UnmarshalSignedPeerPolicyFromPEM(b)
+	require.NoError(t, err)
+	_, err = sp.Verify(time.Now(), pool)
+	assert.ErrorIs(t, err, ErrPolicySignerUnknown)
+
+	sp.Signer = fp
+	_, err = sp.Verify(time.Now(), pool)
+	assert.ErrorIs(t, err, ErrSignatureMismatch)
+
+	// The signer must still be valid
+	_, err = sp.Verify(ca.Details.NotAfter.Add(time.Second), pool)
+	assert.ErrorIs(t, err, ErrRootExpired)
+
+	// Only CAs sign policies, with their own key
+	_, err = SignPeerPolicy(p, ca, Curve_CURVE25519, otherKey)
+	assert.Error(t, err)
+	_, err = SignPeerPolicy(p, ca, Curve_P256, caKeyP256)
+	assert.EqualError(t, err, "curve in cert and private key supplied don't match")
+
+	cert, _, certKey, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	require.NoError(t, err)
+	_, err = SignPeerPolicy(p, cert, Curve_CURVE25519, certKey)
+	assert.ErrorIs(t, err, ErrNotCA)
+
+	_, err = SignPeerPolicy(&PeerPolicy{Rules: []PeerPolicyRule{{From: "10.1.0.0", To: "10.2.0.0/16"}}}, ca, Curve_CURVE25519, caKey)
+	assert.EqualError(t, err, "rule 0 has an invalid from cidr: invalid CIDR address: 10.1.0.0")
+}
+
+func TestUnmarshalSignedPeerPolicyFromPEM(t *testing.T) {
+	_, _, err := UnmarshalSignedPeerPolicyFromPEM([]byte("nope"))
+	assert.EqualError(t, err, "input did not contain a valid PEM encoded block")
+
+	_, _, err = UnmarshalSignedPeerPolicyFromPEM(pem.EncodeToMemory(&pem.Block{Type: CertBanner, Bytes: []byte("{}")}))
+	assert.EqualError(t, err, "bytes did not contain a proper nebula peer policy banner")
+
+	sb, err := json.Marshal(SignedPeerPolicy{Policy: []byte("{}"), Signer: "abc", Signature: []byte{1, 2}})
+	require.NoError(t, err)
+	b := pem.EncodeToMemory(&pem.Block{Type: PeerPolicyBanner, Bytes: sb})
+	sp, rest, err := UnmarshalSignedPeerPolicyFromPEM(append(b, []byte("rest")...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("rest"), rest)
+	assert.Equal(t, &SignedPeerPolicy{Policy: []byte("{}"), Signer: "abc", Signature: []byte{1, 2}}, sp)
+}
@@ -0,0 +1,58 @@
+package cidr
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/slackhq/nebula/iputil"
+)
+
+// RouteTree holds CIDRs of both address families. IPv4 CIDRs, including v4 mapped v6 CIDRs, go into a Tree4 so
+// lookups by VpnIp stay allocation free, everything else goes into a Tree6.
+type RouteTree[T any] struct {
+	v4   *Tree4[T]
+	v6   *Tree6[T]
+	list []entry[T]
+}
+
+func NewRouteTree[T any]() *RouteTree[T] {
+	return &RouteTree[T]{
+		v4: NewTree4[T](),
+		v6: NewTree6[T](),
+	}
+}
+
+func (tree *RouteTree[T]) AddCIDR(cidr *net.IPNet, val T) {
+	if _, ipv4 := isIPV4(cidr.IP); ipv4 {
+		tree.v4.AddCIDR(cidr, val)
+	} else {
+		tree.v6.AddCIDR(cidr, val)
+	}
+
+	tree.list = append(tree.list, entry[T]{CIDR: cidr, Value: val})
+}
+
+// MostSpecificContains finds the most specific match for an ipv4 address
+func (tree *RouteTree[T]) MostSpecificContains(ip iputil.VpnIp) (ok bool, value T) {
+	return tree.v4.MostSpecificContains(ip)
+}
+
+// MostSpecificContainsIP finds the most specific match for an address of either family, 4 byte and v4 mapped v6
+// addresses are looked up in the ipv4 routes
+func (tree *RouteTree[T]) MostSpecificContainsIP(ip net.IP) (ok bool, value T) {
+	if v4, ipv4 := isIPV4(ip); ipv4 {
+		return tree.v4.MostSpecificContains(iputil.Ip2VpnIp(v4))
+	}
+
+	return tree.v6.MostSpecificContains(ip)
+}
+
+// MostSpecificContainsIP6 finds the most specific match for a 16 byte ipv6 address without allocating
+func (tree *RouteTree[T]) MostSpecificContainsIP6(ip [16]byte) (ok bool, value T) {
+	return tree.v6.MostSpecificContainsIpV6(binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:]))
+}
+
+// List will return all CIDRs and their current values in the order they were added. Do not modify the contents!
+func (tree *RouteTree[T]) List() []entry[T] {
+	return tree.list
+}
@@ -0,0 +1,105 @@
+package cidr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteTree_MostSpecificContains(t *testing.T) {
+	tree := NewRouteTree[string]()
+	tree.AddCIDR(Parse("1.0.0.0/8"), "1")
+	tree.AddCIDR(Parse("1.1.1.0/24"), "2")
+	tree.AddCIDR(Parse("::ffff:3.0.0.0/104"), "3")
+	tree.AddCIDR(Parse("fd00::/8"), "6a")
+	tree.AddCIDR(Parse("fd00:1::/32"), "6b")
+	tree.AddCIDR(Parse("fd00:1:0:0:1::/80"), "6c")
+
+	tests := []struct {
+		Found  bool
+		Result interface{}
+		IP     string
+	}{
+		{true, "1", "1.0.0.1"},
+		{true, "2", "1.1.1.1"},
+		{true, "3", "3.0.0.1"},
+		{true, "2", "::ffff:1.1.1.1"},
+		{true, "6a", "fd00::1"},
+		{true, "6b", "fd00:1::1"},
+		{true, "6c", "fd00:1:0:0:1::1"},
+		{false, "", "2.0.0.1"},
+		{false, "", "fe00::1"},
+		// The last 4 bytes of a v6 address must not be mistaken for an ipv4 address
+		{false, "", "fe00::101:101"},
+	}
+
+	for _, tt := range tests {
+		ok, r := tree.MostSpecificContainsIP(net.ParseIP(tt.IP))
+		assert.Equal(t, tt.Found, ok, tt.IP)
+		assert.Equal(t, tt.Result, r, tt.IP)
+	}
+
+	ok, r := tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("1.1.1.1")))
+	assert.True(t, ok)
+	assert.Equal(t, "2", r)
+
+	ok, r = tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("3.0.0.1")))
+	assert.True(t, ok)
+	assert.Equal(t, "3", r)
+
+	// A v6 default route does not catch ipv4 addresses
+	tree = NewRouteTree[string]()
+	tree.AddCIDR(Parse("::/0"), "cool6")
+	ok, _ = tree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("1.1.1.1")))
+	assert.False(t, ok)
+	ok, r = tree.MostSpecificContainsIP(net.ParseIP("2001:db8::1"))
+	assert.True(t, ok)
+	assert.Equal(t, "cool6", r)
+}
+
+func TestRouteTree_List(t *testing.T) {
+	tree := NewRouteTree[string]()
+	tree.AddCIDR(Parse("1.0.0.0/16"), "1")
+	tree.AddCIDR(Parse("fd00::/8"), "2")
+	tree.AddCIDR(Parse("1.0.0.0/8"), "3")
+
+	list := tree.List()
+	assert.Len(t, list, 3)
+	assert.Equal(t, "1.0.0.0/16", list[0].CIDR.String())
+	assert.Equal(t, "fd00::/8", list[1].CIDR.String())
+	assert.Equal(t, "3", list[2].Value)
+}
+
+func TestRouteTree_MostSpecificContainsAllocs(t *testing.T) {
+	tree := NewRouteTree[iputil.VpnIp]()
+	tree.AddCIDR(Parse("1.0.0.0/8"), 1)
+	tree.AddCIDR(Parse("fd00::/8"), 2)
+
+	ip := iputil.Ip2VpnIp(net.ParseIP("1.1.1.1"))
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		tree.MostSpecificContains(ip)
+	}))
+}
+
+func BenchmarkRouteTree_MostSpecificContains(b *testing.B) {
+	tree := NewRouteTree[iputil.VpnIp]()
+	tree.AddCIDR(Parse("1.1.0.0/16"), 1)
+	tree.AddCIDR(Parse("1.2.1.1/32"), 2)
+	tree.AddCIDR(Parse("fd00::/8"), 3)
+
+	ip := iputil.Ip2VpnIp(net.ParseIP("1.2.1.1"))
+	b.Run("v4", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.MostSpecificContains(ip)
+		}
+	})
+
+	ip6 := net.ParseIP("fd00::1")
+	b.Run("v6", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.MostSpecificContainsIP(ip6)
+		}
+	})
+}
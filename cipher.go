@@ -0,0 +1,50 @@
+package nebula
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/cpu"
+)
+
+// aesHardware returns true if the cpu has AES and carry-less multiplication instructions, which AES-GCM needs to be
+// fast. Without them chachapoly is considerably faster. It is a var so tests can pretend to be on other hardware.
+var aesHardware = func() bool {
+	return (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) || (cpu.ARM64.HasAES && cpu.ARM64.HasPMULL)
+}
+
+// cipherPreference returns the ciphers in the order they perform best on this cpu
+func cipherPreference(hasAESHardware bool) []string {
+	if hasAESHardware {
+		return []string{"aes", "chachapoly"}
+	}
+	return []string{"chachapoly", "aes"}
+}
+
+// logCipherSupport reports whether the cpu accelerates AES-GCM as the crypto.aes_hardware gauge and logs which cipher
+// would perform best. The cipher is not negotiated between peers, every node in the network must use the same one, so
+// a mismatch with the configured cipher is only a warning that throughput is being left on the table.
+func logCipherSupport(l *logrus.Logger, registry metrics.Registry, cipher string) {
+	hw := aesHardware()
+	preferred := cipherPreference(hw)[0]
+
+	var gauge int64
+	if hw {
+		gauge = 1
+	}
+	metrics.GetOrRegisterGauge("crypto.aes_hardware", registry).Update(gauge)
+
+	e := l.WithField("cipher", cipher).
+		WithField("aesHardware", hw).
+		WithField("preferredCipher", preferred)
+
+	if cipher != preferred {
+		if hw {
+			e.Info("This cpu accelerates AES-GCM, aes would perform better if every node in the network supports it")
+		} else {
+			e.Warn("This cpu does not accelerate AES-GCM, chachapoly would perform considerably better if used by every node in the network")
+		}
+		return
+	}
+
+	e.Info("Cipher matches the preferred cipher for this cpu")
+}
@@ -0,0 +1,45 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCipherPreference(t *testing.T) {
+	assert.Equal(t, []string{"aes", "chachapoly"}, cipherPreference(true))
+	assert.Equal(t, []string{"chachapoly", "aes"}, cipherPreference(false))
+}
+
+func TestLogCipherSupport(t *testing.T) {
+	l := test.NewLogger()
+	l.SetLevel(logrus.InfoLevel)
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	hw := aesHardware
+	defer func() { aesHardware = hw }()
+
+	// Without acceleration aes is a warning
+	aesHardware = func() bool { return false }
+	logCipherSupport(l, nil, "aes")
+	assert.Contains(t, ob.String(), "level=warning")
+	assert.Contains(t, ob.String(), "preferredCipher=chachapoly")
+	assert.Equal(t, int64(0), metrics.GetOrRegisterGauge("crypto.aes_hardware", nil).Value())
+
+	ob.Reset()
+	logCipherSupport(l, nil, "chachapoly")
+	assert.NotContains(t, ob.String(), "level=warning")
+
+	// With it the preference flips
+	aesHardware = func() bool { return true }
+	ob.Reset()
+	logCipherSupport(l, nil, "aes")
+	assert.NotContains(t, ob.String(), "level=warning")
+	assert.Contains(t, ob.String(), "preferredCipher=aes")
+	assert.Equal(t, int64(1), metrics.GetOrRegisterGauge("crypto.aes_hardware", nil).Value())
+}
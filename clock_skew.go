@@ -0,0 +1,73 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	certTimeBefore = "before"
+	certTimeAfter  = "after"
+
+	defaultClockSkewWindow = time.Hour
+)
+
+// certTimeFailure reports if c was refused only because now is outside of its validity window by no more than window.
+// bound is certTimeBefore when now is before notBefore and certTimeAfter when now is after notAfter, skew is how far our
+// clock would have to move for the certificate to be valid. A certificate that expired months ago is just expired, so
+// failures further than window from the bounds are not blamed on the clock.
+func certTimeFailure(c *cert.NebulaCertificate, caPool *cert.NebulaCAPool, now time.Time, window time.Duration) (bound string, skew time.Duration, ok bool) {
+	if c == nil || caPool == nil {
+		return "", 0, false
+	}
+
+	var valid time.Time
+	switch {
+	case c.Details.NotBefore.After(now):
+		bound, valid = certTimeBefore, c.Details.NotBefore
+		skew = valid.Sub(now)
+	case c.Details.NotAfter.Before(now):
+		bound, valid = certTimeAfter, c.Details.NotAfter
+		skew = now.Sub(valid)
+	default:
+		return "", 0, false
+	}
+
+	if skew > window {
+		return "", 0, false
+	}
+
+	// A certificate that is good in every other respect at the edge of its window points at our clock being wrong
+	// rather than a bad certificate, the root constraints keep the certificate window inside of the CA window
+	if ok, _ := c.Verify(valid, caPool); !ok {
+		return "", 0, false
+	}
+
+	return bound, skew, true
+}
+
+// checkCertTime counts and warns about a handshake that failed because of the certificate validity window
+func (f *Interface) checkCertTime(c *cert.NebulaCertificate, addr *udp.Addr, stage int) {
+	bound, skew, ok := certTimeFailure(c, f.pki.GetCAPool(), time.Now(), time.Duration(f.clockSkewWindow.Load()))
+	if !ok {
+		return
+	}
+
+	metrics.GetOrRegisterCounter("cert_time_validation_failures."+bound, f.metricsRegistry).Inc(1)
+
+	myCert := f.pki.GetCertState().Certificate
+	f.l.WithField("udpAddr", addr).
+		WithField("certName", c.Details.Name).
+		WithField("bound", bound).
+		WithField("notBefore", c.Details.NotBefore).
+		WithField("notAfter", c.Details.NotAfter).
+		WithField("localTime", time.Now()).
+		WithField("skew", skew).
+		WithField("myCertNotBefore", myCert.Details.NotBefore).
+		WithField("myCertNotAfter", myCert.Details.NotAfter).
+		WithField("handshake", m{"stage": stage, "style": "ix_psk0"}).
+		Warn("Possible clock skew, the peer certificate is only invalid because of the local time")
+}
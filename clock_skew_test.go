@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertTimeFailure(t *testing.T) {
+	now := time.Now()
+
+	caPub, caKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: now.Add(-24 * time.Hour),
+			NotAfter:  now.Add(24 * time.Hour),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	assert.NoError(t, ca.Sign(cert.Curve_CURVE25519, caKey))
+	caPEM, err := ca.MarshalToPEM()
+	assert.NoError(t, err)
+
+	caPool := cert.NewCAPool()
+	_, err = caPool.AddCACertificate(caPEM)
+	assert.NoError(t, err)
+
+	newCert := func(notBefore, notAfter time.Time) *cert.NebulaCertificate {
+		caFingerprint, err := ca.Sha256Sum()
+		assert.NoError(t, err)
+
+		c := &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      "host",
+				Ips:       []*net.IPNet{{IP: net.IP{10, 1, 1, 1}, Mask: net.IPMask{255, 255, 255, 0}}},
+				NotBefore: notBefore,
+				NotAfter:  notAfter,
+				PublicKey: make([]byte, 32),
+				Issuer:    caFingerprint,
+			},
+		}
+		assert.NoError(t, c.Sign(cert.Curve_CURVE25519, caKey))
+		return c
+	}
+
+	// Valid certificates are not a time failure
+	_, _, ok := certTimeFailure(newCert(now.Add(-time.Hour), now.Add(time.Hour)), caPool, now, 2*time.Hour)
+	assert.False(t, ok)
+
+	// Not valid yet, our clock is behind
+	bound, skew, ok := certTimeFailure(newCert(now.Add(time.Hour), now.Add(2*time.Hour)), caPool, now, 2*time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, certTimeBefore, bound)
+	assert.Equal(t, time.Hour, skew)
+
+	// Expired, our clock could be ahead
+	bound, skew, ok = certTimeFailure(newCert(now.Add(-2*time.Hour), now.Add(-time.Hour)), caPool, now, 2*time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, certTimeAfter, bound)
+	assert.Equal(t, time.Hour, skew)
+
+	// A certificate that is bad for another reason is not blamed on the clock
+	c := newCert(now.Add(time.Hour), now.Add(2*time.Hour))
+	c.Signature = []byte("nope")
+	_, _, ok = certTimeFailure(c, caPool, now, 2*time.Hour)
+	assert.False(t, ok)
+
+	_, _, ok = certTimeFailure(nil, caPool, now, 2*time.Hour)
+	assert.False(t, ok)
+
+	// Failures further from the bounds than the window are plain expired or not yet valid certificates
+	_, _, ok = certTimeFailure(newCert(now.Add(-5*time.Hour), now.Add(-3*time.Hour)), caPool, now, 2*time.Hour)
+	assert.False(t, ok)
+
+	_, _, ok = certTimeFailure(newCert(now.Add(3*time.Hour), now.Add(5*time.Hour)), caPool, now, 2*time.Hour)
+	assert.False(t, ok)
+
+	// A window of 0 turns the check off
+	_, _, ok = certTimeFailure(newCert(now.Add(time.Minute), now.Add(time.Hour)), caPool, now, 0)
+	assert.False(t, ok)
+}
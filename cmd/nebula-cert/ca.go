@@ -28,6 +28,7 @@ type caFlags struct {
 	groups           *string
 	ips              *string
 	subnets          *string
+	version          *uint
 	argonMemory      *uint
 	argonIterations  *uint
 	argonParallelism *uint
@@ -46,7 +47,8 @@ func newCaFlags() *caFlags {
 	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
 	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use for ip addresses")
-	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use in subnets")
+	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 or ipv6 address and network in CIDR notation. This will limit which addresses and networks subordinate certs can use in subnets")
+	cf.version = cf.set.Uint("version", uint(cert.Version1), "Optional: certificate version. 2 allows ipv6 subnets, nodes that do not support version 2 refuse the certificate, upgrade every node first")
 	cf.argonMemory = cf.set.Uint("argon-memory", 2*1024*1024, "Optional: Argon2 memory parameter (in KiB) used for encrypted private key passphrase")
 	cf.argonParallelism = cf.set.Uint("argon-parallelism", 4, "Optional: Argon2 parallelism parameter used for encrypted private key passphrase")
 	cf.argonIterations = cf.set.Uint("argon-iterations", 1, "Optional: Argon2 iterations parameter used for encrypted private key passphrase")
@@ -134,14 +136,16 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 				if err != nil {
 					return newHelpErrorf("invalid subnet definition: %s", err)
 				}
-				if s.IP.To4() == nil {
-					return newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
-				}
 				subnets = append(subnets, s)
 			}
 		}
 	}
 
+	version, err := certVersion(*cf.version, subnets)
+	if err != nil {
+		return err
+	}
+
 	var passphrase []byte
 	if *cf.encryption {
 		for i := 0; i < 5; i++ {
@@ -196,6 +200,7 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 			PublicKey: pub,
 			IsCA:      true,
 			Curve:     curve,
+			Version:   version,
 		},
 	}
 
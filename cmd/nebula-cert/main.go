@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
+
+	"github.com/slackhq/nebula/cert"
 )
 
 var Build string
@@ -67,6 +70,8 @@ func main() {
 		err = keygen(args[1:], os.Stdout, os.Stderr)
 	case "sign":
 		err = signCert(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
+	case "sign-policy":
+		err = signPolicy(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
 	case "print":
 		err = printCert(args[1:], os.Stdout, os.Stderr)
 	case "verify":
@@ -100,6 +105,8 @@ func handleError(mode string, e error, out io.Writer) int {
 			keygenHelp(out)
 		case "sign":
 			signHelp(out)
+		case "sign-policy":
+			signPolicyHelp(out)
 		case "print":
 			printHelp(out)
 		case "verify":
@@ -125,6 +132,7 @@ func help(err string, out io.Writer) {
 	fmt.Fprintln(out, "    "+caSummary())
 	fmt.Fprintln(out, "    "+keygenSummary())
 	fmt.Fprintln(out, "    "+signSummary())
+	fmt.Fprintln(out, "    "+signPolicySummary())
 	fmt.Fprintln(out, "    "+printSummary())
 	fmt.Fprintln(out, "    "+verifySummary())
 	fmt.Fprintln(out, "")
@@ -137,3 +145,20 @@ func mustFlagString(name string, val *string) error {
 	}
 	return nil
 }
+
+// certVersion checks the -version flag against what the subnets need and returns it as a certificate version
+func certVersion(version uint, subnets []*net.IPNet) (uint32, error) {
+	if version < uint(cert.Version1) || version > uint(cert.VersionMax) {
+		return 0, newHelpErrorf("-version must be between %d and %d: %d", cert.Version1, cert.VersionMax, version)
+	}
+
+	if version < uint(cert.Version2) {
+		for _, s := range subnets {
+			if s.IP.To4() == nil {
+				return 0, newHelpErrorf("invalid subnet definition: ipv6 subnets need -version %d, have %s", cert.Version2, s)
+			}
+		}
+	}
+
+	return uint32(version), nil
+}
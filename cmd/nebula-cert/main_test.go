@@ -21,6 +21,7 @@ func Test_help(t *testing.T) {
 		"    " + caSummary() + "\n" +
 		"    " + keygenSummary() + "\n" +
 		"    " + signSummary() + "\n" +
+		"    " + signPolicySummary() + "\n" +
 		"    " + printSummary() + "\n" +
 		"    " + verifySummary() + "\n" +
 		"\n" +
@@ -59,7 +60,7 @@ func Test_handleError(t *testing.T) {
 	assert.Equal(t, "Error: test error\n", ob.String())
 
 	// test all modes with help error
-	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "verify": verifyHelp}
+	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "sign-policy": signPolicyHelp, "verify": verifyHelp}
 	eb := &bytes.Buffer{}
 	for mode, fn := range modes {
 		ob.Reset()
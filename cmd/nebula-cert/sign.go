@@ -29,6 +29,7 @@ type signFlags struct {
 	outQRPath   *string
 	groups      *string
 	subnets     *string
+	version     *uint
 }
 
 func newSignFlags() *signFlags {
@@ -44,7 +45,8 @@ func newSignFlags() *signFlags {
 	sf.outCertPath = sf.set.String("out-crt", "", "Optional: path to write the certificate to")
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
-	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for")
+	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 or ipv6 address and network in CIDR notation. Subnets this cert can serve for")
+	sf.version = sf.set.Uint("version", uint(cert.Version1), "Optional: certificate version. 2 allows ipv6 subnets, nodes that do not support version 2 refuse the certificate, upgrade every node first")
 	return &sf
 
 }
@@ -72,43 +74,9 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		return newHelpErrorf("cannot set both -in-pub and -out-key")
 	}
 
-	rawCAKey, err := os.ReadFile(*sf.caKeyPath)
+	curve, caKey, err := readCAKey(*sf.caKeyPath, out, pr)
 	if err != nil {
-		return fmt.Errorf("error while reading ca-key: %s", err)
-	}
-
-	var curve cert.Curve
-	var caKey []byte
-
-	// naively attempt to decode the private key as though it is not encrypted
-	caKey, _, curve, err = cert.UnmarshalSigningPrivateKey(rawCAKey)
-	if err == cert.ErrPrivateKeyEncrypted {
-		// ask for a passphrase until we get one
-		var passphrase []byte
-		for i := 0; i < 5; i++ {
-			out.Write([]byte("Enter passphrase: "))
-			passphrase, err = pr.ReadPassword()
-
-			if err == ErrNoTerminal {
-				return fmt.Errorf("ca-key is encrypted and must be decrypted interactively")
-			} else if err != nil {
-				return fmt.Errorf("error reading password: %s", err)
-			}
-
-			if len(passphrase) > 0 {
-				break
-			}
-		}
-		if len(passphrase) == 0 {
-			return fmt.Errorf("cannot open encrypted ca-key without passphrase")
-		}
-
-		curve, caKey, _, err = cert.DecryptAndUnmarshalSigningPrivateKey(passphrase, rawCAKey)
-		if err != nil {
-			return fmt.Errorf("error while parsing encrypted ca-key: %s", err)
-		}
-	} else if err != nil {
-		return fmt.Errorf("error while parsing ca-key: %s", err)
+		return err
 	}
 
 	rawCACert, err := os.ReadFile(*sf.caCertPath)
@@ -167,14 +135,16 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 				if err != nil {
 					return newHelpErrorf("invalid subnet definition: %s", err)
 				}
-				if s.IP.To4() == nil {
-					return newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
-				}
 				subnets = append(subnets, s)
 			}
 		}
 	}
 
+	version, err := certVersion(*sf.version, subnets)
+	if err != nil {
+		return err
+	}
+
 	var pub, rawPriv []byte
 	if *sf.inPubPath != "" {
 		rawPub, err := os.ReadFile(*sf.inPubPath)
@@ -205,6 +175,7 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 			IsCA:      false,
 			Issuer:    issuer,
 			Curve:     curve,
+			Version:   version,
 		},
 	}
 
@@ -309,3 +280,47 @@ func signHelp(out io.Writer) {
 	sf.set.SetOutput(out)
 	sf.set.PrintDefaults()
 }
+
+// readCAKey reads the signing key of a CA, asking for the passphrase if it is encrypted
+func readCAKey(path string, out io.Writer, pr PasswordReader) (cert.Curve, []byte, error) {
+	rawCAKey, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while reading ca-key: %s", err)
+	}
+
+	var curve cert.Curve
+	var caKey []byte
+
+	// naively attempt to decode the private key as though it is not encrypted
+	caKey, _, curve, err = cert.UnmarshalSigningPrivateKey(rawCAKey)
+	if err == cert.ErrPrivateKeyEncrypted {
+		// ask for a passphrase until we get one
+		var passphrase []byte
+		for i := 0; i < 5; i++ {
+			out.Write([]byte("Enter passphrase: "))
+			passphrase, err = pr.ReadPassword()
+
+			if err == ErrNoTerminal {
+				return 0, nil, fmt.Errorf("ca-key is encrypted and must be decrypted interactively")
+			} else if err != nil {
+				return 0, nil, fmt.Errorf("error reading password: %s", err)
+			}
+
+			if len(passphrase) > 0 {
+				break
+			}
+		}
+		if len(passphrase) == 0 {
+			return 0, nil, fmt.Errorf("cannot open encrypted ca-key without passphrase")
+		}
+
+		curve, caKey, _, err = cert.DecryptAndUnmarshalSigningPrivateKey(passphrase, rawCAKey)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error while parsing encrypted ca-key: %s", err)
+		}
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("error while parsing ca-key: %s", err)
+	}
+
+	return curve, caKey, nil
+}
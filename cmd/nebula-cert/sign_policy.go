@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type signPolicyFlags struct {
+	set        *flag.FlagSet
+	caKeyPath  *string
+	caCertPath *string
+	inPath     *string
+	outPath    *string
+}
+
+func newSignPolicyFlags() *signPolicyFlags {
+	pf := signPolicyFlags{set: flag.NewFlagSet("sign-policy", flag.ContinueOnError)}
+	pf.set.Usage = func() {}
+	pf.caKeyPath = pf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	pf.caCertPath = pf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
+	pf.inPath = pf.set.String("in", "", "Required: path to a json peer policy, {\"version\": 1, \"rules\": [{\"from\": \"cidr\", \"to\": \"cidr\"}]}")
+	pf.outPath = pf.set.String("out", "", "Required: path to write the signed peer policy to")
+	return &pf
+}
+
+func signPolicy(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	pf := newSignPolicyFlags()
+	err := pf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("ca-key", pf.caKeyPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-crt", pf.caCertPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("in", pf.inPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("out", pf.outPath); err != nil {
+		return err
+	}
+
+	rawPolicy, err := os.ReadFile(*pf.inPath)
+	if err != nil {
+		return fmt.Errorf("error while reading in: %s", err)
+	}
+
+	var p cert.PeerPolicy
+	if err := json.Unmarshal(rawPolicy, &p); err != nil {
+		return fmt.Errorf("error while parsing in: %s", err)
+	}
+
+	if p.Version == 0 {
+		return fmt.Errorf("the peer policy version must be greater than 0")
+	}
+
+	curve, caKey, err := readCAKey(*pf.caKeyPath, out, pr)
+	if err != nil {
+		return err
+	}
+
+	rawCACert, err := os.ReadFile(*pf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if caCert.Expired(time.Now()) {
+		return fmt.Errorf("ca certificate is expired")
+	}
+
+	b, err := cert.SignPeerPolicy(&p, caCert, curve, caKey)
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	if _, err := os.Stat(*pf.outPath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing peer policy: %s", *pf.outPath)
+	}
+
+	err = os.WriteFile(*pf.outPath, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out: %s", err)
+	}
+
+	return nil
+}
+
+func signPolicySummary() string {
+	return "sign-policy <flags>: create and sign a peer policy for lighthouses to serve"
+}
+
+func signPolicyHelp(out io.Writer) {
+	pf := newSignPolicyFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + signPolicySummary() + "\n"))
+	pf.set.SetOutput(out)
+	pf.set.PrintDefaults()
+}
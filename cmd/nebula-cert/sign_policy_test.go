@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_signPolicySummary(t *testing.T) {
+	assert.Equal(t, "sign-policy <flags>: create and sign a peer policy for lighthouses to serve", signPolicySummary())
+}
+
+func Test_signPolicy(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+
+	// required args
+	assertHelpError(t, signPolicy([]string{"-out", "nope"}, ob, eb, nopw), "-in is required")
+	assertHelpError(t, signPolicy([]string{"-in", "nope"}, ob, eb, nopw), "-out is required")
+
+	inPath := filepath.Join(dir, "policy.json")
+	outPath := filepath.Join(dir, "policy.pem")
+	caKeyPath := filepath.Join(dir, "ca.key")
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	args := []string{"-ca-key", caKeyPath, "-ca-crt", caCrtPath, "-in", inPath, "-out", outPath}
+
+	assert.EqualError(t, signPolicy(args, ob, eb, nopw), "error while reading in: open "+inPath+": "+NoSuchFileError)
+
+	assert.NoError(t, os.WriteFile(inPath, []byte(`{"rules": []}`), 0600))
+	assert.EqualError(t, signPolicy(args, ob, eb, nopw), "the peer policy version must be greater than 0")
+
+	assert.NoError(t, os.WriteFile(inPath, []byte(`{"version": 2, "rules": [{"from": "10.1.0.0/16", "to": "10.2.0.0/16"}]}`), 0600))
+	assert.EqualError(t, signPolicy(args, ob, eb, nopw), "error while reading ca-key: open "+caKeyPath+": "+NoSuchFileError)
+
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute * 200),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	assert.NoError(t, ca.Sign(cert.Curve_CURVE25519, caPriv))
+	b, _ := ca.MarshalToPEM()
+	assert.NoError(t, os.WriteFile(caCrtPath, b, 0600))
+	assert.NoError(t, os.WriteFile(caKeyPath, cert.MarshalEd25519PrivateKey(caPriv), 0600))
+
+	// The signed policy verifies against the ca that signed it
+	assert.NoError(t, signPolicy(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	raw, err := os.ReadFile(outPath)
+	assert.NoError(t, err)
+	sp, _, err := cert.UnmarshalSignedPeerPolicyFromPEM(raw)
+	assert.NoError(t, err)
+
+	pool := cert.NewCAPool()
+	_, err = pool.AddCACertificate(b)
+	assert.NoError(t, err)
+	p, err := sp.Verify(time.Now(), pool)
+	assert.NoError(t, err)
+	assert.Equal(t, &cert.PeerPolicy{Version: 2, Rules: []cert.PeerPolicyRule{{From: "10.1.0.0/16", To: "10.2.0.0/16"}}}, p)
+
+	assert.EqualError(t, signPolicy(args, ob, eb, nopw), "refusing to overwrite existing peer policy: "+outPath)
+}
@@ -49,7 +49,9 @@ func Test_signHelp(t *testing.T) {
 			"  -out-qr string\n"+
 			"    \tOptional: output a qr code image (png) of the certificate\n"+
 			"  -subnets string\n"+
-			"    \tOptional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for\n",
+			"    \tOptional: comma separated list of ipv4 or ipv6 address and network in CIDR notation. Subnets this cert can serve for\n"+
+			"  -version uint\n"+
+			"    \tOptional: certificate version. 2 allows ipv6 subnets, nodes that do not support version 2 refuse the certificate, upgrade every node first (default 1)\n",
 		ob.String(),
 	)
 }
@@ -196,10 +198,19 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
+	// ipv6 subnet without version 2
 	ob.Reset()
 	eb.Reset()
-	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-subnets", "100::100/100"}
-	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid subnet definition: can only be ipv4, have 100::100/100")
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-subnets", "2001:db8::/64"}
+	assertHelpError(t, signCert(args, ob, eb, nopw), "invalid subnet definition: ipv6 subnets need -version 2, have 2001:db8::/64")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	// unknown version
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-version", "3"}
+	assertHelpError(t, signCert(args, ob, eb, nopw), "-version must be between 1 and 2: 3")
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
@@ -247,7 +258,7 @@ func Test_signCert(t *testing.T) {
 	// test proper cert with removed empty groups and subnets
 	ob.Reset()
 	eb.Reset()
-	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-subnets", "10.1.1.1/32, ,   10.2.2.2/32   ,   ,  ,, 10.5.5.5/32", "-groups", "1,,   2    ,        ,,,3,4,5"}
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-subnets", "10.1.1.1/32, ,   10.2.2.2/32   ,   ,  ,, 10.5.5.5/32, 2001:db8::/64", "-groups", "1,,   2    ,        ,,,3,4,5", "-version", "2"}
 	assert.Nil(t, signCert(args, ob, eb, nopw))
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
@@ -269,7 +280,7 @@ func Test_signCert(t *testing.T) {
 	assert.Len(t, lCrt.Details.Ips, 1)
 	assert.False(t, lCrt.Details.IsCA)
 	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, lCrt.Details.Groups)
-	assert.Len(t, lCrt.Details.Subnets, 3)
+	assert.Len(t, lCrt.Details.Subnets, 4)
 	assert.Len(t, lCrt.Details.PublicKey, 32)
 	assert.Equal(t, time.Duration(time.Minute*100), lCrt.Details.NotAfter.Sub(lCrt.Details.NotBefore))
 
@@ -277,7 +288,8 @@ func Test_signCert(t *testing.T) {
 	for _, sn := range lCrt.Details.Subnets {
 		sns = append(sns, sn.String())
 	}
-	assert.Equal(t, []string{"10.1.1.1/32", "10.2.2.2/32", "10.5.5.5/32"}, sns)
+	assert.Equal(t, []string{"10.1.1.1/32", "10.2.2.2/32", "10.5.5.5/32", "2001:db8::/64"}, sns)
+	assert.Equal(t, cert.Version2, lCrt.Details.Version)
 
 	issuer, _ := ca.Sha256Sum()
 	assert.Equal(t, issuer, lCrt.Details.Issuer)
@@ -52,6 +52,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if c.IsSet("overlays") {
+		runOverlays(l, c, *configTest)
+	}
+
 	ctrl, err := nebula.Main(c, *configTest, Build, l, nil)
 	if err != nil {
 		util.LogWithContextIfNeeded("Failed to start", err, l)
@@ -66,3 +70,22 @@ func main() {
 
 	os.Exit(0)
 }
+
+// runOverlays starts every overlay listed in overlays in this process and exits once they are stopped
+func runOverlays(l *logrus.Logger, c *config.C, configTest bool) {
+	ctrls, err := nebula.MainOverlays(c, configTest, Build, l)
+	if err != nil {
+		util.LogWithContextIfNeeded("Failed to start", err, l)
+		os.Exit(1)
+	}
+
+	if !configTest {
+		for _, ctrl := range ctrls {
+			ctrl.Start()
+		}
+		notifyReady(l)
+		nebula.ShutdownBlockOverlays(l, ctrls)
+	}
+
+	os.Exit(0)
+}
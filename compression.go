@@ -0,0 +1,189 @@
+package nebula
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// Compression algorithms, offered and agreed on in NebulaHandshakeDetails.Compression
+const (
+	compressionNone    uint32 = 0
+	compressionDeflate uint32 = 1
+)
+
+// compressionSampleLen is how much of the payload is inspected to guess if it is already compressed
+const compressionSampleLen = 64
+
+// compressionMaxDistinct is the number of distinct byte values in the sample above which we assume the payload is
+// already compressed or encrypted. Random data averages ~56 distinct values in 64 bytes, text is usually under 40.
+const compressionMaxDistinct = 48
+
+var ErrDecompressedTooLarge = errors.New("decompressed packet is too large")
+
+type compressState struct {
+	w   *flate.Writer
+	r   io.ReadCloser
+	buf bytes.Buffer
+	out []byte
+}
+
+// compressor compresses inner packets above threshold on tunnels where both sides agreed to it in the handshake
+type compressor struct {
+	threshold int
+	pool      sync.Pool
+
+	metricRatio   metrics.Histogram
+	metricSkipped metrics.Counter
+}
+
+// newCompressorFromConfig returns nil if handshakes.compression is not enabled
+func newCompressorFromConfig(c *config.C) (*compressor, error) {
+	if !c.GetBool("handshakes.compression", false) {
+		return nil, nil
+	}
+
+	threshold := c.GetInt("handshakes.compression_threshold", 256)
+	if threshold < 1 {
+		return nil, fmt.Errorf("handshakes.compression_threshold must be greater than 0: %v", threshold)
+	}
+
+	return newCompressor(util.MetricsRegistry(c), threshold), nil
+}
+
+func newCompressor(registry metrics.Registry, threshold int) *compressor {
+	return &compressor{
+		threshold: threshold,
+		pool: sync.Pool{
+			New: func() interface{} {
+				w, _ := flate.NewWriter(nil, flate.BestSpeed)
+				return &compressState{
+					w:   w,
+					r:   flate.NewReader(nil),
+					out: make([]byte, mtu),
+				}
+			},
+		},
+		metricRatio:   metrics.GetOrRegisterHistogram("compression.ratio", registry, metrics.NewExpDecaySample(1028, 0.015)),
+		metricSkipped: metrics.GetOrRegisterCounter("compression.skipped", registry),
+	}
+}
+
+// offer returns the algorithm to offer in a handshake
+func (c *compressor) offer() uint32 {
+	if c == nil {
+		return compressionNone
+	}
+	return compressionDeflate
+}
+
+// negotiate returns the algorithm to use for a tunnel given what the peer sent in their handshake
+func (c *compressor) negotiate(peer uint32) uint32 {
+	if c == nil || peer != compressionDeflate {
+		return compressionNone
+	}
+	return compressionDeflate
+}
+
+// compress calls send with the compressed form of p and returns true. If p is below the threshold, looks to be
+// already compressed, or would not get smaller, or larger than maxLen when maxLen is not 0, send is not called and
+// false is returned. The slice passed to send is only valid until send returns.
+func (c *compressor) compress(p []byte, maxLen int, send func(compressed []byte)) bool {
+	if len(p) < c.threshold {
+		return false
+	}
+
+	if !compressible(p) {
+		c.metricSkipped.Inc(1)
+		return false
+	}
+
+	s := c.pool.Get().(*compressState)
+	defer c.pool.Put(s)
+
+	s.buf.Reset()
+	s.w.Reset(&s.buf)
+	_, err := s.w.Write(p)
+	if err == nil {
+		err = s.w.Close()
+	}
+
+	if err != nil || s.buf.Len() >= len(p) || (maxLen > 0 && s.buf.Len() > maxLen) {
+		c.metricSkipped.Inc(1)
+		return false
+	}
+
+	c.metricRatio.Update(int64(s.buf.Len() * 100 / len(p)))
+	send(s.buf.Bytes())
+	return true
+}
+
+// decompress calls send with the decompressed form of p. The slice passed to send is only valid until send returns.
+func (c *compressor) decompress(p []byte, send func(packet []byte)) error {
+	s := c.pool.Get().(*compressState)
+	defer c.pool.Put(s)
+
+	err := s.r.(flate.Resetter).Reset(bytes.NewReader(p), nil)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(s.r, s.out)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+	case nil:
+		// We filled the buffer, make sure there was nothing left
+		if m, _ := s.r.Read(s.out[:1]); m > 0 {
+			return ErrDecompressedTooLarge
+		}
+	default:
+		return err
+	}
+
+	send(s.out[:n])
+	return nil
+}
+
+// compressible guesses if the ip payload in p is worth compressing by counting distinct byte values in a sample of it.
+// Already compressed or encrypted payloads look random and have many distinct values.
+func compressible(p []byte) bool {
+	if len(p) == 0 {
+		return false
+	}
+
+	start := 0
+	switch p[0] >> 4 {
+	case 4:
+		start = int(p[0]&0x0f) << 2
+	case 6:
+		// Extension headers are sampled as payload, they are rare and small next to it
+		start = ipv6HeaderLen
+	}
+
+	if start >= len(p) {
+		return false
+	}
+
+	sample := p[start:]
+	if len(sample) > compressionSampleLen {
+		sample = sample[:compressionSampleLen]
+	}
+
+	var seen [256]bool
+	distinct := 0
+	for _, b := range sample {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
+	}
+
+	return distinct <= compressionMaxDistinct
+}
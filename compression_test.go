@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newCompressorFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	cp, err := newCompressorFromConfig(c)
+	assert.Nil(t, err)
+	assert.Nil(t, cp)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"compression": true, "compression_threshold": 0}
+	_, err = newCompressorFromConfig(c)
+	assert.EqualError(t, err, "handshakes.compression_threshold must be greater than 0: 0")
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"compression": true}
+	cp, err = newCompressorFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 256, cp.threshold)
+}
+
+func TestCompressor_Negotiate(t *testing.T) {
+	var disabled *compressor
+	enabled := newCompressor(nil, 256)
+
+	assert.Equal(t, compressionNone, disabled.offer())
+	assert.Equal(t, compressionDeflate, enabled.offer())
+
+	// Both sides must want it
+	assert.Equal(t, compressionNone, disabled.negotiate(disabled.offer()))
+	assert.Equal(t, compressionNone, disabled.negotiate(enabled.offer()))
+	assert.Equal(t, compressionNone, enabled.negotiate(disabled.offer()))
+	assert.Equal(t, compressionDeflate, enabled.negotiate(enabled.offer()))
+
+	// Unknown algorithms are refused
+	assert.Equal(t, compressionNone, enabled.negotiate(99))
+}
+
+func TestCompressor_RoundTrip(t *testing.T) {
+	cp := newCompressor(nil, 256)
+
+	// 20 byte ipv4 header followed by a very compressible payload
+	p := append([]byte{0x45}, make([]byte, 19)...)
+	p = append(p, bytes.Repeat([]byte("hello nebula "), 100)...)
+
+	var compressed []byte
+	assert.True(t, cp.compress(p, 0, func(c []byte) {
+		compressed = append([]byte(nil), c...)
+	}))
+	assert.Less(t, len(compressed), len(p))
+
+	var res []byte
+	assert.Nil(t, cp.decompress(compressed, func(d []byte) {
+		res = append([]byte(nil), d...)
+	}))
+	assert.Equal(t, p, res)
+
+	// Too large for maxLen
+	assert.False(t, cp.compress(p, 10, func([]byte) { t.Fatal("should not have sent") }))
+
+	// Below the threshold
+	assert.False(t, cp.compress(p[:100], 0, func([]byte) { t.Fatal("should not have sent") }))
+
+	// Random looking payloads are skipped
+	r := make([]byte, 1000)
+	_, _ = rand.Read(r)
+	r[0] = 0x45
+	assert.False(t, cp.compress(r, 0, func([]byte) { t.Fatal("should not have sent") }))
+
+	// Garbage does not decompress
+	assert.NotNil(t, cp.decompress([]byte{0xff, 0xff, 0xff}, func([]byte) { t.Fatal("should not have sent") }))
+}
+
+func Test_compressible(t *testing.T) {
+	assert.False(t, compressible([]byte{}))
+	assert.False(t, compressible([]byte{0x45, 0, 0}))
+	assert.True(t, compressible(append([]byte{0x45}, make([]byte, 100)...)))
+
+	// A payload with every byte distinct looks already compressed
+	distinct := make([]byte, 100)
+	for i := range distinct {
+		distinct[i] = byte(i)
+	}
+
+	// An ipv6 header is 40 bytes, the low nibble of the first byte is not a header length
+	v6 := append([]byte{0x60}, make([]byte, ipv6HeaderLen-1)...)
+	assert.False(t, compressible(append(v6, distinct...)))
+	assert.True(t, compressible(append(v6, make([]byte, 100)...)))
+	assert.False(t, compressible(v6))
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	backupPrefix = "config-"
+	backupSuffix = ".yml"
+	// backupTimeFormat sorts lexically in the order the backups were taken
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+// backupSettings reads config.backup_count and config.backup_dir from settings. A count of 0 disables backups.
+func (c *C) backupSettings(settings map[interface{}]interface{}) (int, string, error) {
+	count := 0
+	if v := c.get("config.backup_count", settings); v != nil {
+		n, err := strconv.Atoi(fmt.Sprintf("%v", v))
+		if err != nil || n < 0 {
+			return 0, "", fmt.Errorf("config.backup_count must be a positive number: %v", v)
+		}
+		count = n
+	}
+
+	if count == 0 {
+		return 0, "", nil
+	}
+
+	dir := ""
+	if v := c.get("config.backup_dir", settings); v != nil {
+		dir = fmt.Sprintf("%v", v)
+	}
+	if dir == "" {
+		return 0, "", errors.New("config.backup_dir must be set when config.backup_count is set")
+	}
+
+	return count, dir, nil
+}
+
+// backup writes settings, the effective config that was active before a reload, to the config.backup_dir of active and
+// removes all but the newest config.backup_count backups. active is the config just loaded, so a reload that enables
+// backups immediately backs up the config it replaced. Backups hold everything the config does, including inlined keys,
+// so only the current user can read them. Returns the path of the new backup, or an empty string if backups are
+// disabled.
+func (c *C) backup(active, settings map[interface{}]interface{}) (string, error) {
+	count, dir, err := c.backupSettings(active)
+	if err != nil || count == 0 {
+		return "", err
+	}
+
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, backupPrefix+time.Now().UTC().Format(backupTimeFormat)+backupSuffix)
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil {
+		return path, err
+	}
+
+	for len(backups) > count {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return path, err
+		}
+		backups = backups[1:]
+	}
+
+	return path, nil
+}
+
+// latestBackup returns the newest backup in the config.backup_dir of settings, or an empty string if there is none
+func (c *C) latestBackup(settings map[interface{}]interface{}) string {
+	count, dir, err := c.backupSettings(settings)
+	if err != nil || count == 0 {
+		return ""
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil || len(backups) == 0 {
+		return ""
+	}
+	return backups[len(backups)-1]
+}
+
+// listBackups returns the backups in dir, oldest first
+func listBackups(dir string) ([]string, error) {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+
+	sort.Strings(backups)
+	return backups, nil
+}
@@ -37,7 +37,11 @@ func NewC(l *logrus.Logger) *C {
 	}
 }
 
-// Load will find all yaml files within path and load them in lexical order
+// Load will find all yaml files within path and load them in lexical order. If the result sets config_dir, every yaml
+// file found within that directory is then loaded in lexical order on top of them.
+//
+// Files are merged in order. Maps are merged key by key, a scalar value in a later file replaces the earlier one and
+// lists from every file are concatenated, with the entries from later files first.
 func (c *C) Load(path string) error {
 	c.path = path
 	c.files = make([]string, 0)
@@ -58,6 +62,66 @@ func (c *C) Load(path string) error {
 		return err
 	}
 
+	return c.loadConfigDir(path)
+}
+
+// loadConfigDir merges the fragments in config_dir on top of the config loaded from path. A relative config_dir is
+// relative to the directory holding path, or path itself if it is a directory. Fragments can not set config_dir again.
+func (c *C) loadConfigDir(path string) error {
+	configured := c.GetString("config_dir", "")
+	if configured == "" {
+		return nil
+	}
+
+	dir := configured
+	if !filepath.IsAbs(dir) {
+		base := path
+		if i, err := os.Stat(path); err == nil && !i.IsDir() {
+			base = filepath.Dir(path)
+		}
+		dir = filepath.Join(base, dir)
+	}
+
+	i, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("config_dir %s could not be read: %w", dir, err)
+	}
+	if !i.IsDir() {
+		return fmt.Errorf("config_dir %s is not a directory", dir)
+	}
+
+	files := c.files
+	c.files = make([]string, 0)
+	err = c.resolve(dir, false)
+	if err != nil {
+		return err
+	}
+	sort.Strings(c.files)
+
+	// A config_dir inside of a config directory was already picked up, it still has to load last
+	fragments := make(map[string]struct{}, len(c.files))
+	for _, f := range c.files {
+		fragments[f] = struct{}{}
+	}
+
+	main := make([]string, 0, len(files))
+	for _, f := range files {
+		if _, ok := fragments[f]; !ok {
+			main = append(main, f)
+		}
+	}
+	c.files = append(main, c.files...)
+
+	err = c.parse()
+	if err != nil {
+		return err
+	}
+
+	// The main config decides where fragments come from
+	if c.GetString("config_dir", "") != configured {
+		return errors.New("config_dir can not be changed by a file within config_dir")
+	}
+
 	return nil
 }
 
@@ -151,14 +215,32 @@ func (c *C) ReloadConfig() {
 	err := c.Load(c.path)
 	if err != nil {
 		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
+		if backup := c.latestBackup(c.oldSettings); backup != "" {
+			c.l.WithField("config_path", c.path).WithField("backup", backup).
+				Error("The new config was not applied, copy the backup over the config path and send a HUP to restore a known good config")
+		}
 		return
 	}
 
+	c.backupOldSettings()
+
 	for _, v := range c.callbacks {
 		v(c)
 	}
 }
 
+// backupOldSettings snapshots the config that was active before a successful reload when the new config sets
+// config.backup_count
+func (c *C) backupOldSettings() {
+	backup, err := c.backup(c.Settings, c.oldSettings)
+	if err != nil {
+		c.l.WithError(err).Error("Failed to back up the previous config")
+	}
+	if backup != "" {
+		c.l.WithField("backup", backup).Info("Backed up the previous config")
+	}
+}
+
 func (c *C) ReloadConfigString(raw string) error {
 	c.reloadLock.Lock()
 	defer c.reloadLock.Unlock()
@@ -173,6 +255,8 @@ func (c *C) ReloadConfigString(raw string) error {
 		return err
 	}
 
+	c.backupOldSettings()
+
 	for _, v := range c.callbacks {
 		v(c)
 	}
@@ -245,6 +329,17 @@ func (c *C) GetUint32(k string, d uint32) uint32 {
 	return uint32(r)
 }
 
+// GetFloat64 will get the float64 for k or return the default d if not found or invalid
+func (c *C) GetFloat64(k string, d float64) float64 {
+	r := c.GetString(k, strconv.FormatFloat(d, 'f', -1, 64))
+	v, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
 // GetBool will get the bool for k or return the default d if not found or invalid
 func (c *C) GetBool(k string, d bool) bool {
 	r := strings.ToLower(c.GetString(k, fmt.Sprintf("%v", d)))
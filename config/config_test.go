@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -66,6 +67,23 @@ func TestConfig_GetStringSlice(t *testing.T) {
 	assert.Equal(t, []string{"one", "two"}, c.GetStringSlice("slice", []string{}))
 }
 
+func TestConfig_GetFloat64(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["float"] = 0.25
+	assert.Equal(t, 0.25, c.GetFloat64("float", 1))
+
+	c.Settings["float"] = "0.5"
+	assert.Equal(t, 0.5, c.GetFloat64("float", 1))
+
+	c.Settings["float"] = 2
+	assert.Equal(t, float64(2), c.GetFloat64("float", 1))
+
+	c.Settings["float"] = "nope"
+	assert.Equal(t, float64(1), c.GetFloat64("float", 1))
+	assert.Equal(t, 0.1, c.GetFloat64("missing", 0.1))
+}
+
 func TestConfig_GetBool(t *testing.T) {
 	l := test.NewLogger()
 	c := NewC(l)
@@ -150,6 +168,145 @@ func TestConfig_ReloadConfig(t *testing.T) {
 
 }
 
+func TestConfig_ReloadConfigBackup(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	path := filepath.Join(dir, "config.yml")
+	write := func(v string) {
+		raw := fmt.Sprintf("config:\n  backup_count: 2\n  backup_dir: %s\nouter:\n  inner: %s\n", backups, v)
+		require.NoError(t, os.WriteFile(path, []byte(raw), 0600))
+	}
+
+	write("one")
+	c := NewC(l)
+	require.NoError(t, c.Load(path))
+
+	for _, v := range []string{"two", "three", "four"} {
+		prev := c.GetString("outer.inner", "")
+		write(v)
+		c.ReloadConfig()
+		assert.Equal(t, v, c.GetString("outer.inner", ""))
+
+		// The newest backup holds the config that was active before the reload
+		latest := c.latestBackup(c.Settings)
+		require.NotEmpty(t, latest)
+		b := NewC(l)
+		require.NoError(t, b.Load(latest))
+		assert.Equal(t, prev, b.GetString("outer.inner", ""))
+
+		i, err := os.Stat(latest)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), i.Mode().Perm())
+	}
+
+	// Only the newest backup_count are kept
+	found, err := listBackups(backups)
+	require.NoError(t, err)
+	assert.Len(t, found, 2)
+
+	// A failed reload writes nothing and keeps the backups around to restore from
+	require.NoError(t, os.WriteFile(path, []byte("outer: ["), 0600))
+	c.ReloadConfig()
+	after, err := listBackups(backups)
+	require.NoError(t, err)
+	assert.Equal(t, found, after)
+}
+
+func TestConfig_ReloadConfigEnablesBackup(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	path := filepath.Join(dir, "config.yml")
+
+	require.NoError(t, os.WriteFile(path, []byte("outer:\n  inner: one\n"), 0600))
+	c := NewC(l)
+	require.NoError(t, c.Load(path))
+
+	// The reload that turns backups on backs up the config it replaced right away
+	raw := fmt.Sprintf("config:\n  backup_count: 2\n  backup_dir: %s\nouter:\n  inner: two\n", backups)
+	require.NoError(t, os.WriteFile(path, []byte(raw), 0600))
+	c.ReloadConfig()
+	assert.Equal(t, "two", c.GetString("outer.inner", ""))
+
+	latest := c.latestBackup(c.Settings)
+	require.NotEmpty(t, latest)
+	b := NewC(l)
+	require.NoError(t, b.Load(latest))
+	assert.Equal(t, "one", b.GetString("outer.inner", ""))
+}
+
+func TestConfig_LoadConfigDir(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	confD := filepath.Join(dir, "conf.d")
+	require.NoError(t, os.Mkdir(confD, 0755))
+
+	main := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(main, []byte(`
+config_dir: conf.d
+listen:
+  host: 0.0.0.0
+  port: 4242
+firewall:
+  inbound:
+    - port: 22
+      proto: tcp
+`), 0644))
+
+	// Fragments load in lexical order after the main config, later files replace scalars and lists are concatenated
+	require.NoError(t, os.WriteFile(filepath.Join(confD, "20-web.yml"), []byte(`
+listen:
+  port: 5000
+firewall:
+  inbound:
+    - port: 443
+      proto: tcp
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(confD, "10-base.yaml"), []byte(`
+listen:
+  port: 4343
+  batch: 32
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(confD, "README"), []byte(`not yaml`), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.Load(main))
+	assert.Equal(t, 5000, c.GetInt("listen.port", 0))
+	assert.Equal(t, 32, c.GetInt("listen.batch", 0))
+	assert.Equal(t, "0.0.0.0", c.GetString("listen.host", ""))
+	assert.Equal(t, []interface{}{
+		map[interface{}]interface{}{"port": 443, "proto": "tcp"},
+		map[interface{}]interface{}{"port": 22, "proto": "tcp"},
+	}, c.Get("firewall.inbound"))
+
+	// Loading the whole directory gives the same result, conf.d still goes last
+	c = NewC(l)
+	require.NoError(t, c.Load(dir))
+	assert.Equal(t, 5000, c.GetInt("listen.port", 0))
+	assert.Len(t, c.Get("firewall.inbound"), 2)
+
+	// A reload picks up new and removed fragments
+	c = NewC(l)
+	require.NoError(t, c.Load(main))
+	require.NoError(t, os.Remove(filepath.Join(confD, "20-web.yml")))
+	require.NoError(t, os.WriteFile(filepath.Join(confD, "30-tun.yml"), []byte("tun:\n  mtu: 1300\n"), 0644))
+	c.ReloadConfig()
+	assert.Equal(t, 4343, c.GetInt("listen.port", 0))
+	assert.Equal(t, 1300, c.GetInt("tun.mtu", 0))
+	assert.True(t, c.HasChanged("listen.port"))
+	assert.Len(t, c.Get("firewall.inbound"), 1)
+
+	// Fragments can not move config_dir
+	require.NoError(t, os.WriteFile(filepath.Join(confD, "40-bad.yml"), []byte("config_dir: /etc\n"), 0644))
+	assert.EqualError(t, NewC(l).Load(main), "config_dir can not be changed by a file within config_dir")
+	require.NoError(t, os.Remove(filepath.Join(confD, "40-bad.yml")))
+
+	// A missing config_dir is an error
+	require.NoError(t, os.WriteFile(main, []byte("config_dir: nope\n"), 0644))
+	assert.ErrorContains(t, NewC(l).Load(main), "config_dir "+filepath.Join(dir, "nope")+" could not be read")
+}
+
 // Ensure mergo merges are done the way we expect.
 // This is needed to test for potential regressions, like:
 // - https://github.com/imdario/mergo/issues/187
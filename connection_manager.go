@@ -1,9 +1,10 @@
 package nebula
 
 import (
-	"bytes"
 	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -45,15 +46,28 @@ type connectionManager struct {
 	pendingDeletionInterval time.Duration
 	metricsTxPunchy         metrics.Counter
 
+	// keepalive overrides checkInterval for some peers, nil if there are no overrides
+	keepalive atomic.Pointer[keepaliveOverrides]
+
+	// nonceLimit is the message counter at which a tunnel is rehandshaked before it can run out of nonces
+	nonceLimit          atomic.Uint64
+	metricNonceFraction metrics.GaugeFloat64
+
 	l *logrus.Logger
 }
 
 func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy) *connectionManager {
+	// Leave room for punchy.jitter to stretch the check interval, including any keepalive override
+	longest := checkInterval
+	if longest < maxKeepaliveInterval {
+		longest = maxKeepaliveInterval
+	}
+
 	var max time.Duration
-	if checkInterval < pendingDeletionInterval {
+	if jittered := time.Duration(float64(longest) * (1 + maxJitter)); jittered < pendingDeletionInterval {
 		max = pendingDeletionInterval
 	} else {
-		max = checkInterval
+		max = jittered
 	}
 
 	nc := &connectionManager{
@@ -70,9 +84,11 @@ func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface
 		checkInterval:           checkInterval,
 		pendingDeletionInterval: pendingDeletionInterval,
 		punchy:                  punchy,
-		metricsTxPunchy:         metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
+		metricsTxPunchy:         metrics.GetOrRegisterCounter("messages.tx.punchy", intf.metricsRegistry),
+		metricNonceFraction:     metrics.GetOrRegisterGaugeFloat64("handshakes.nonce_fraction.max", intf.metricsRegistry),
 		l:                       l,
 	}
+	nc.nonceLimit.Store(nonceLimit(intf.cipher, defaultNonceSafetyMargin))
 
 	nc.Start(ctx)
 	return nc
@@ -131,15 +147,15 @@ func (n *connectionManager) getAndResetTrafficCheck(localIndex uint32) (bool, bo
 	return in, out
 }
 
-func (n *connectionManager) AddTrafficWatch(localIndex uint32) {
+func (n *connectionManager) AddTrafficWatch(hostinfo *HostInfo) {
 	// Use a write lock directly because it should be incredibly rare that we are ever already tracking this index
 	n.outLock.Lock()
-	if _, ok := n.out[localIndex]; ok {
+	if _, ok := n.out[hostinfo.localIndexId]; ok {
 		n.outLock.Unlock()
 		return
 	}
-	n.out[localIndex] = struct{}{}
-	n.trafficTimer.Add(localIndex, n.checkInterval)
+	n.out[hostinfo.localIndexId] = struct{}{}
+	n.trafficTimer.Add(hostinfo.localIndexId, n.nextCheckInterval(hostinfo))
 	n.outLock.Unlock()
 }
 
@@ -180,14 +196,11 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 
 	switch decision {
 	case deleteTunnel:
-		if n.hostMap.DeleteHostInfo(hostinfo) {
-			// Only clearing the lighthouse cache if this is the last hostinfo for this vpn ip in the hostmap
-			n.intf.lightHouse.DeleteVpnIp(hostinfo.vpnIp)
-		}
+		n.intf.closeTunnel(hostinfo, "tunnel is dead")
 
 	case closeTunnel:
 		n.intf.sendCloseTunnel(hostinfo)
-		n.intf.closeTunnel(hostinfo)
+		n.intf.closeTunnel(hostinfo, "invalid certificate")
 
 	case swapPrimary:
 		n.swapPrimary(hostinfo, primary)
@@ -231,7 +244,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			index = existing.LocalIndex
 			switch r.Type {
 			case TerminalType:
-				relayFrom = n.intf.myVpnIp
+				relayFrom = n.intf.myVpnIp.Load()
 				relayTo = existing.PeerIp
 			case ForwardingType:
 				relayFrom = existing.PeerIp
@@ -256,7 +269,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			}
 			switch r.Type {
 			case TerminalType:
-				relayFrom = n.intf.myVpnIp
+				relayFrom = n.intf.myVpnIp.Load()
 				relayTo = r.PeerIp
 			case ForwardingType:
 				relayFrom = r.PeerIp
@@ -336,7 +349,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, p, nb, out []
 			}
 		}
 
-		n.trafficTimer.Add(hostinfo.localIndexId, n.checkInterval)
+		n.trafficTimer.Add(hostinfo.localIndexId, n.nextCheckInterval(hostinfo))
 
 		if !outTraffic {
 			// Send a punch packet to keep the NAT state alive
@@ -361,7 +374,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, p, nb, out []
 			// If we aren't sending or receiving traffic then its an unused tunnel and we don't to test the tunnel.
 			// Just maintain NAT state if configured to do so.
 			n.sendPunch(hostinfo)
-			n.trafficTimer.Add(hostinfo.localIndexId, n.checkInterval)
+			n.trafficTimer.Add(hostinfo.localIndexId, n.nextCheckInterval(hostinfo))
 			return doNothing, nil, nil
 
 		}
@@ -380,6 +393,7 @@ func (n *connectionManager) makeTrafficDecision(localIndex uint32, p, nb, out []
 		}
 
 		// Send a test packet to trigger an authenticated tunnel test, this should suss out any lingering tunnel issues
+		hostinfo.testSent.Store(time.Now().UnixNano())
 		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
 
 	} else {
@@ -398,15 +412,14 @@ func (n *connectionManager) shouldSwapPrimary(current, primary *HostInfo) bool {
 	// If we are here then we have multiple tunnels for a host pair and neither side believes the same tunnel is primary.
 	// Let's sort this out.
 
-	if current.vpnIp < n.intf.myVpnIp {
+	if current.vpnIp < n.intf.myVpnIp.Load() {
 		// Only one side should flip primary because if both flip then we may never resolve to a single tunnel.
 		// vpn ip is static across all tunnels for this host pair so lets use that to determine who is flipping.
 		// The remotes vpn ip is lower than mine. I will not flip.
 		return false
 	}
 
-	certState := n.intf.pki.GetCertState()
-	return bytes.Equal(current.ConnectionState.myCert.Signature, certState.Certificate.Signature)
+	return n.intf.pki.IsCurrentCert(current.ConnectionState.myCert)
 }
 
 func (n *connectionManager) swapPrimary(current, primary *HostInfo) {
@@ -427,7 +440,7 @@ func (n *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostIn
 		return false
 	}
 
-	valid, err := remoteCert.VerifyWithCache(now, n.intf.pki.GetCAPool())
+	valid, err := n.intf.pki.VerifyCert(remoteCert, n.intf.pki.GetCAPool().WithIntermediates(hostinfo.ConnectionState.peerCertChain), now, true)
 	if valid {
 		return false
 	}
@@ -445,6 +458,53 @@ func (n *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostIn
 	return true
 }
 
+// nextCheckInterval returns how long to wait before checking on a tunnel again, which is also when an idle tunnel is
+// punched. punchy.jitter is applied so tunnels created together do not stay in step.
+func (n *connectionManager) nextCheckInterval(hostinfo *HostInfo) time.Duration {
+	interval, _ := n.keepaliveInterval(hostinfo)
+	floor := minKeepaliveInterval
+	if interval < floor {
+		floor = interval
+	}
+	return jitter(interval, n.punchy.GetJitter(), floor)
+}
+
+// keepaliveInterval returns the check interval for hostinfo before jitter, taking punchy.keepalive_overrides into
+// account, and where it came from
+func (n *connectionManager) keepaliveInterval(hostinfo *HostInfo) (time.Duration, string) {
+	var groups []string
+	if c := hostinfo.GetCert(); c != nil {
+		groups = c.Details.Groups
+	}
+	return n.keepalive.Load().resolve(hostinfo.vpnIp, groups, n.checkInterval)
+}
+
+// keepaliveIntervals returns the keepalive interval in effect for every peer in the hostmap, or just vpnIp if it is
+// not 0
+func (n *connectionManager) keepaliveIntervals(vpnIp iputil.VpnIp) []KeepaliveInfo {
+	var hostinfos []*HostInfo
+	n.hostMap.RLock()
+	if vpnIp != 0 {
+		if h, ok := n.hostMap.Hosts[vpnIp]; ok {
+			hostinfos = append(hostinfos, h)
+		}
+	} else {
+		for _, h := range n.hostMap.Hosts {
+			hostinfos = append(hostinfos, h)
+		}
+	}
+	n.hostMap.RUnlock()
+
+	sort.Slice(hostinfos, func(i, j int) bool { return hostinfos[i].vpnIp < hostinfos[j].vpnIp })
+
+	infos := make([]KeepaliveInfo, len(hostinfos))
+	for i, h := range hostinfos {
+		interval, source := n.keepaliveInterval(h)
+		infos[i] = KeepaliveInfo{VpnIp: h.vpnIp, Interval: interval.String(), Source: source}
+	}
+	return infos
+}
+
 func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 	if !n.punchy.GetPunch() {
 		// Punching is disabled
@@ -464,14 +524,28 @@ func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 }
 
 func (n *connectionManager) tryRehandshake(hostinfo *HostInfo) {
-	certState := n.intf.pki.GetCertState()
-	if bytes.Equal(hostinfo.ConnectionState.myCert.Signature, certState.Certificate.Signature) {
+	var reason string
+	if !n.intf.pki.IsCurrentCert(hostinfo.ConnectionState.myCert) {
+		reason = "local certificate is not current"
+	} else if n.nonceExhausted(hostinfo) {
+		reason = "message counter is within handshakes.nonce_safety_margin of the nonce limit"
+	} else {
 		return
 	}
 
 	n.l.WithField("vpnIp", hostinfo.vpnIp).
-		WithField("reason", "local certificate is not current").
+		WithField("reason", reason).
 		Info("Re-handshaking with remote")
 
 	n.intf.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
 }
+
+// nonceExhausted records how much of the nonce space hostinfo has used and returns true once it reaches the
+// handshakes.nonce_safety_margin
+func (n *connectionManager) nonceExhausted(hostinfo *HostInfo) bool {
+	if f := nonceFraction(hostinfo, n.intf.cipher); f > n.metricNonceFraction.Value() {
+		n.metricNonceFraction.Update(f)
+	}
+
+	return hostinfo.ConnectionState.messageCounter.Load() >= n.nonceLimit.Load()
+}
@@ -3,41 +3,91 @@ package nebula
 import (
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"sync/atomic"
 
 	"github.com/flynn/noise"
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/noiseutil"
 )
 
+// ReplayWindow is the default number of message counters behind the newest one that are still accepted, once each
 const ReplayWindow = 1024
 
+const (
+	minReplayWindow = 64
+	maxReplayWindow = 1 << 16
+)
+
+// getReplayWindow reads handshakes.replay_window, it must be a power of 2 between minReplayWindow and maxReplayWindow
+func getReplayWindow(c *config.C) (uint64, error) {
+	w := c.GetInt("handshakes.replay_window", ReplayWindow)
+	if w < minReplayWindow || w > maxReplayWindow || w&(w-1) != 0 {
+		return 0, fmt.Errorf("handshakes.replay_window must be a power of 2 between %v and %v: %v", minReplayWindow, maxReplayWindow, w)
+	}
+
+	return uint64(w), nil
+}
+
 type ConnectionState struct {
-	eKey           *NebulaCipherState
-	dKey           *NebulaCipherState
-	H              *noise.HandshakeState
-	myCert         *cert.NebulaCertificate
-	peerCert       *cert.NebulaCertificate
+	eKey     *NebulaCipherState
+	dKey     *NebulaCipherState
+	H        *noise.HandshakeState
+	myCert   *cert.NebulaCertificate
+	peerCert *cert.NebulaCertificate
+	// peerCertChain is the intermediate CAs the peer sent with its certificate, needed to verify it again later
+	peerCertChain  []*cert.NebulaCertificate
 	initiator      bool
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
+
+	// compression is the algorithm both sides agreed to in the handshake, compressionNone if either side did not enable it
+	compression uint32
+
+	// peerMetadata is the handshakes.metadata the peer sent in the handshake, nil if it sent none
+	peerMetadata map[string]string
+
+	// chainPool caches the ca pool with peerCertChain added, see caPool
+	chainPool atomic.Pointer[peerChainPool]
 }
 
-func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
-	var dhFunc noise.DHFunc
-	switch certState.Certificate.Details.Curve {
-	case cert.Curve_CURVE25519:
-		dhFunc = noise.DH25519
-	case cert.Curve_P256:
-		dhFunc = noiseutil.DHP256
-	default:
-		l.Errorf("invalid curve: %s", certState.Certificate.Details.Curve)
+// peerChainPool is a ca pool with the intermediates of a peer added and the pool it was built from
+type peerChainPool struct {
+	base *cert.NebulaCAPool
+	pool *cert.NebulaCAPool
+}
+
+// caPool returns pool with the intermediate CAs the peer sent added, so the issuers of the peer certificate can be
+// followed to the root. It is built once for every pool the pki hands out.
+func (cs *ConnectionState) caPool(pool *cert.NebulaCAPool) *cert.NebulaCAPool {
+	if len(cs.peerCertChain) == 0 {
+		return pool
+	}
+
+	if p := cs.chainPool.Load(); p != nil && p.base == pool {
+		return p.pool
+	}
+
+	p := &peerChainPool{base: pool, pool: pool.WithIntermediates(cs.peerCertChain)}
+	cs.chainPool.Store(p)
+	return p.pool
+}
+
+func NewConnectionState(l *logrus.Logger, registry metrics.Registry, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int, replayWindow uint64) *ConnectionState {
+	dhFunc, err := dhFuncForCurve(certState.Certificate.Details.Curve)
+	if err != nil {
+		l.Error(err)
 		return nil
 	}
 
+	// Our static private key is only used through certState.StaticKey
+	dhFunc = staticKeyDH{DHFunc: dhFunc, key: certState.StaticKey}
+
 	var cs noise.CipherSuite
 	if cipher == "chachapoly" {
 		cs = noise.NewCipherSuite(dhFunc, noise.CipherChaChaPoly, noise.HashSHA256)
@@ -45,9 +95,9 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 		cs = noise.NewCipherSuite(dhFunc, noiseutil.CipherAESGCM, noise.HashSHA256)
 	}
 
-	static := noise.DHKey{Private: certState.PrivateKey, Public: certState.PublicKey}
+	static := noise.DHKey{Public: certState.PublicKey}
 
-	b := NewBits(ReplayWindow)
+	b := NewBits(registry, replayWindow)
 	// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
 	b.Update(l, 0)
 
@@ -81,5 +131,7 @@ func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 		"certificate":     cs.peerCert,
 		"initiator":       cs.initiator,
 		"message_counter": cs.messageCounter.Load(),
+		"compression":     cs.compression != compressionNone,
+		"metadata":        cs.peerMetadata,
 	})
 }
@@ -2,15 +2,21 @@ package nebula
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/udp"
 )
 
@@ -27,13 +33,21 @@ type controlHostLister interface {
 }
 
 type Control struct {
-	f               *Interface
-	l               *logrus.Logger
-	cancel          context.CancelFunc
-	sshStart        func()
-	statsStart      func()
-	dnsStart        func()
-	lighthouseStart func()
+	f                  *Interface
+	l                  *logrus.Logger
+	cancel             context.CancelFunc
+	sshStart           func()
+	statsStart         func()
+	pprofStart         func()
+	dnsStart           func()
+	listenForwardStart func()
+	lighthouseStart    func()
+	keepWarmStart      func()
+	mtuProbeStart      func()
+	peerPolicyStart    func()
+	privilegeDrop      *privilegeDrop
+	config             *config.C
+	grpc               *grpcControl
 }
 
 type ControlHostInfo struct {
@@ -46,6 +60,7 @@ type ControlHostInfo struct {
 	CurrentRemote          *udp.Addr               `json:"currentRemote"`
 	CurrentRelaysToMe      []iputil.VpnIp          `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []iputil.VpnIp          `json:"currentRelaysThroughMe"`
+	Metadata               map[string]string       `json:"metadata,omitempty"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -53,6 +68,15 @@ func (c *Control) Start() {
 	// Activate the interface
 	c.f.activate()
 
+	// Everything that needs root is done, the listeners started below bind with the capabilities we keep
+	if c.privilegeDrop != nil {
+		if err := c.privilegeDrop.drop(); err != nil {
+			c.l.WithError(err).WithField("user", c.privilegeDrop.user).Fatal("Failed to drop privileges")
+		}
+		c.l.WithField("user", c.privilegeDrop.user).WithField("uid", c.privilegeDrop.uid).
+			WithField("gid", c.privilegeDrop.gid).Info("Dropped privileges")
+	}
+
 	// Call all the delayed funcs that waited patiently for the interface to be created.
 	if c.sshStart != nil {
 		go c.sshStart()
@@ -60,12 +84,32 @@ func (c *Control) Start() {
 	if c.statsStart != nil {
 		go c.statsStart()
 	}
+	if c.pprofStart != nil {
+		go c.pprofStart()
+	}
 	if c.dnsStart != nil {
 		go c.dnsStart()
 	}
+	if c.listenForwardStart != nil {
+		c.listenForwardStart()
+	}
 	if c.lighthouseStart != nil {
 		c.lighthouseStart()
 	}
+	if c.keepWarmStart != nil {
+		c.keepWarmStart()
+	}
+	if c.mtuProbeStart != nil {
+		c.mtuProbeStart()
+	}
+	if c.peerPolicyStart != nil {
+		c.peerPolicyStart()
+	}
+	if c.grpc != nil {
+		if err := c.grpc.start(c); err != nil {
+			c.l.WithError(err).Warn("Failed to run the gRPC control server")
+		}
+	}
 
 	// Start reading packets.
 	c.f.run()
@@ -77,10 +121,16 @@ func (c *Control) Stop() {
 	// being created while we're shutting them all down.
 	c.cancel()
 
+	if c.grpc != nil {
+		c.grpc.stop()
+	}
+
 	c.CloseAllTunnels(false)
 	if err := c.f.Close(); err != nil {
 		c.l.WithError(err).Error("Close interface failed")
 	}
+	c.f.eventStream.close()
+	removeOverlay(c)
 	c.l.Info("Goodbye")
 }
 
@@ -107,6 +157,140 @@ func (c *Control) RebindUDPServer() {
 	c.f.rebindCount++
 }
 
+// RefreshMTU re-reads the mtu of the tun device and updates any route mtus that depend on it. Returns the current mtu
+func (c *Control) RefreshMTU() (int, error) {
+	r, ok := c.f.inside.(overlay.MTURefresher)
+	if !ok {
+		return 0, errors.New("tun device does not support refreshing the mtu")
+	}
+
+	return r.RefreshMTU()
+}
+
+// WriteDiagnostics writes a gzipped tarball of redacted diagnostics to w, to attach to a support ticket. See the diag
+// ssh command for what it holds.
+func (c *Control) WriteDiagnostics(w io.Writer) error {
+	return writeDiagnostics(w, c.f, c.config)
+}
+
+// ListOverlays returns every overlay running in this process, this one included, sorted by overlay.name
+func (c *Control) ListOverlays() []ControlOverlay {
+	return listOverlays()
+}
+
+// PromoteCert makes the loaded certificate with fingerprint the primary, it is used for every handshake we initiate
+// from now on. Tunnels using the previous primary are kept until it is removed from pki.certs.
+func (c *Control) PromoteCert(fingerprint string) error {
+	return c.f.pki.PromoteCert(fingerprint)
+}
+
+// ClearTofu forgets the certificate fingerprint learned under pki.tofu for vpnIp, the next one it presents is learned
+// instead. Returns false if nothing was learned for vpnIp.
+func (c *Control) ClearTofu(vpnIp iputil.VpnIp) (bool, error) {
+	return c.f.pki.ClearTofu(vpnIp)
+}
+
+// RefreshLighthouses discovers our local addresses right away and sends them to every lighthouse instead of waiting
+// for the next lighthouse.interval. Returns the addresses that were sent.
+func (c *Control) RefreshLighthouses() []*udp.Addr {
+	return c.f.lightHouse.SendUpdate()
+}
+
+// DumpFirewall returns the active firewall rules and the settings that affect how they are evaluated
+func (c *Control) DumpFirewall() FirewallDump {
+	return c.f.firewall.Dump()
+}
+
+// DumpConntrack returns the active conntrack entries, optionally only the ones for the peer with vpnIp and of proto.
+// Use 0 and firewall.ProtoAny to return every entry.
+func (c *Control) DumpConntrack(vpnIp iputil.VpnIp, proto uint8) []ConntrackEntry {
+	return c.f.firewall.DumpConntrack(vpnIp, proto)
+}
+
+// KeepaliveIntervals returns the keepalive interval in effect for every peer with a tunnel, or just vpnIp if it is not 0
+func (c *Control) KeepaliveIntervals(vpnIp iputil.VpnIp) []KeepaliveInfo {
+	return c.f.connectionManager.keepaliveIntervals(vpnIp)
+}
+
+// StartMaintenance advertises this node as down for maintenance until timeout passes or EndMaintenance is called.
+// Lighthouses stop handing out our addresses, we stop accepting new relays and peers relaying through us re-handshake
+// to select another relay. Calling it again while in maintenance restarts the timeout.
+func (c *Control) StartMaintenance(timeout time.Duration) error {
+	return c.f.startMaintenance(timeout)
+}
+
+// EndMaintenance returns this node to normal before the maintenance timeout passes, returns false if it was not in
+// maintenance
+func (c *Control) EndMaintenance() bool {
+	return c.f.endMaintenance()
+}
+
+// PingAll sends a test packet to every peer in the host map, the static host map, and the lighthouses, handshaking with
+// them if needed, and reports which replied within timeout, directly or through a relay, along with the round trip time.
+// At most concurrency peers are pinged at the same time.
+func (c *Control) PingAll(timeout time.Duration, concurrency int) []PingResult {
+	return c.f.pingAll(timeout, concurrency)
+}
+
+// Ping sends a test packet to vpnIp over a specific underlay path and reports if it replied within timeout along with
+// the path used and the round trip time. The test packet goes to remote instead of the address the tunnel is using, and
+// is sent from the local address when it is set, which must be one this node can send from. Without either it is the
+// same as a single peer from PingAll.
+func (c *Control) Ping(vpnIp iputil.VpnIp, remote *udp.Addr, local net.IP, timeout time.Duration) PingResult {
+	if remote != nil {
+		remote = remote.Copy()
+	}
+	if local != nil {
+		local = append(net.IP{}, local...)
+	}
+	return c.f.pingPath(vpnIp, remote, local, timeout)
+}
+
+// SetPacketInspector registers i to observe every packet that passes the firewall, replacing any inspector that was
+// registered before. A nil i removes the inspector. See PacketInspector for the constraints i must respect.
+func (c *Control) SetPacketInspector(i PacketInspector) {
+	if i == nil {
+		c.f.inspector.Store(nil)
+		return
+	}
+	c.f.inspector.Store(&i)
+}
+
+// SimulateResult describes what would happen to a packet without sending it. Route is one of local, when the peer is
+// in our vpn network, via, when an unsafe route matched, or drop when there is no route.
+type SimulateResult struct {
+	Route        string          `json:"route"`
+	Peer         iputil.VpnIp    `json:"peer,omitempty"`
+	TunnelExists bool            `json:"tunnelExists"`
+	Firewall     FirewallVerdict `json:"firewall"`
+}
+
+// SimulatePacket evaluates routing and the firewall for the packet as if it was sent or received, without affecting
+// any state. For outgoing packets the remote ip is the destination, for incoming packets it is the source.
+func (c *Control) SimulatePacket(fp firewall.Packet, incoming bool) SimulateResult {
+	return simulatePacket(c.f, fp, incoming)
+}
+
+func simulatePacket(f *Interface, fp firewall.Packet, incoming bool) SimulateResult {
+	r := SimulateResult{Route: "local", Peer: fp.RemoteIP}
+	if !ipMaskContains(f.lightHouse.myVpnIp.Load(), f.lightHouse.myVpnZeros, fp.RemoteIP) {
+		r.Route = "via"
+		r.Peer = f.inside.RouteFor(fp.RemoteIP)
+		if r.Peer == 0 {
+			r.Route = "drop"
+		}
+	}
+
+	var hostinfo *HostInfo
+	if r.Peer != 0 {
+		hostinfo = f.hostMap.QueryVpnIp(r.Peer)
+		r.TunnelExists = hostinfo != nil
+	}
+
+	r.Firewall = f.firewall.Simulate(fp, incoming, hostinfo, f.pki.GetCAPool())
+	return r
+}
+
 // ListHostmapHosts returns details about the actual or pending (handshaking) hostmap by vpn ip
 func (c *Control) ListHostmapHosts(pendingMap bool) []ControlHostInfo {
 	if pendingMap {
@@ -116,6 +300,16 @@ func (c *Control) ListHostmapHosts(pendingMap bool) []ControlHostInfo {
 	}
 }
 
+// SubscribeHostMapEvents streams host map changes: peers coming up and going down, tunnels moving to another underlay
+// address and tunnels losing a relay. Tunnels that are already up are not sent, see ListHostmapHosts. The channel is
+// closed by unsubscribe, when the overlay stops, or after an overflow event once more than buffer events are waiting.
+func (c *Control) SubscribeHostMapEvents(buffer int) (events <-chan TunnelEvent, unsubscribe func()) {
+	ch := c.f.eventStream.subscribe(buffer)
+	return ch, func() {
+		c.f.eventStream.unsubscribe(ch)
+	}
+}
+
 // ListHostmapIndexes returns details about the actual or pending (handshaking) hostmap by local index id
 func (c *Control) ListHostmapIndexes(pendingMap bool) []ControlHostInfo {
 	if pendingMap {
@@ -174,7 +368,7 @@ func (c *Control) CloseTunnel(vpnIp iputil.VpnIp, localOnly bool) bool {
 		)
 	}
 
-	c.f.closeTunnel(hostInfo)
+	c.f.closeTunnel(hostInfo, "closed by control")
 	return true
 }
 
@@ -191,7 +385,7 @@ func (c *Control) CloseAllTunnels(excludeLighthouses bool) (closed int) {
 			}
 		}
 		c.f.send(header.CloseTunnel, 0, h.ConnectionState, h, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
-		c.f.closeTunnel(h)
+		c.f.closeTunnel(h, "closed by control")
 
 		c.l.WithField("vpnIp", h.vpnIp).WithField("udpAddr", h.remote).
 			Debug("Sending close tunnel message")
@@ -239,6 +433,13 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+
+		if len(h.ConnectionState.peerMetadata) > 0 {
+			chi.Metadata = make(map[string]string, len(h.ConnectionState.peerMetadata))
+			for k, v := range h.ConnectionState.peerMetadata {
+				chi.Metadata[k] = v
+			}
+		}
 	}
 
 	if c := h.GetCert(); c != nil {
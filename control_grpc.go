@@ -0,0 +1,261 @@
+package nebula
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/controlapi"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcControl serves the controlapi gRPC service in front of a Control
+type grpcControl struct {
+	l       *logrus.Logger
+	network string
+	address string
+	token   string
+	// tls is set when control.grpc.cert and control.grpc.key are, the service is then only served over tls
+	tls    *tls.Config
+	server *grpc.Server
+}
+
+// newGRPCControlFromConfig reads control.grpc, it returns nil when no listener is configured. control.grpc.listen is
+// either unix:/path/to/socket or a tcp host:port. A token is required for tcp, for a unix socket the file permissions
+// are the authentication and the token is optional. A tcp listener that is not on loopback also requires tls, so the
+// token is never sent over the network in the clear.
+func newGRPCControlFromConfig(l *logrus.Logger, c *config.C) (*grpcControl, error) {
+	listen := c.GetString("control.grpc.listen", "")
+	if listen == "" {
+		return nil, nil
+	}
+
+	g := &grpcControl{l: l, token: c.GetString("control.grpc.token", "")}
+	if strings.HasPrefix(listen, "unix:") {
+		g.network = "unix"
+		g.address = strings.TrimPrefix(strings.TrimPrefix(listen, "unix:"), "//")
+		if g.address == "" {
+			return nil, fmt.Errorf("control.grpc.listen has no socket path: %s", listen)
+		}
+		return g, nil
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control.grpc.listen address: %s", err)
+	}
+
+	if g.token == "" {
+		return nil, errors.New("control.grpc.token must be provided when control.grpc.listen is not a unix socket")
+	}
+
+	g.network = "tcp"
+	g.address = listen
+
+	certFile := c.GetString("control.grpc.cert", "")
+	keyFile := c.GetString("control.grpc.key", "")
+	if certFile == "" && keyFile == "" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errors.New("control.grpc.cert and control.grpc.key must be provided when control.grpc.listen is not a unix socket or a loopback address")
+		}
+		return g, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("control.grpc.cert and control.grpc.key must both be provided to use tls")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading control.grpc tls certificate: %s", err)
+	}
+
+	g.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return g, nil
+}
+
+// listen binds the configured address, a stale unix socket left behind by a previous run is removed first
+func (g *grpcControl) listen() (net.Listener, error) {
+	if g.network == "unix" {
+		if err := os.Remove(g.address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen(g.network, g.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.network == "unix" {
+		if err := os.Chmod(g.address, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// start begins serving the service for control, it returns once the listener is bound
+func (g *grpcControl) start(control *Control) error {
+	ln, err := g.listen()
+	if err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(g.authorize)}
+	if g.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(g.tls)))
+	}
+
+	g.server = grpc.NewServer(opts...)
+	controlapi.RegisterControlServer(g.server, &grpcControlServer{c: control})
+
+	g.l.WithField("network", g.network).WithField("listen", g.address).WithField("tls", g.tls != nil).
+		Info("gRPC control server is listening")
+	go func() {
+		if err := g.server.Serve(ln); err != nil {
+			g.l.WithError(err).Warn("gRPC control server stopped")
+		}
+	}()
+	return nil
+}
+
+func (g *grpcControl) stop() {
+	if g.server != nil {
+		g.server.Stop()
+	}
+}
+
+// authorize rejects calls that do not carry the configured token as `authorization: Bearer {token}` metadata
+func (g *grpcControl) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if g.token == "" {
+		return handler(ctx, req)
+	}
+
+	given := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			given = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(given), []byte(g.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	return handler(ctx, req)
+}
+
+// grpcControlServer implements controlapi.ControlServer with the methods of Control
+type grpcControlServer struct {
+	c *Control
+}
+
+func (s *grpcControlServer) ListTunnels(_ context.Context, _ *controlapi.ListTunnelsRequest) (*controlapi.ListTunnelsResponse, error) {
+	return &controlapi.ListTunnelsResponse{Tunnels: grpcHostInfos(s.c.ListHostmapHosts(false))}, nil
+}
+
+func (s *grpcControlServer) CloseTunnel(_ context.Context, req *controlapi.CloseTunnelRequest) (*controlapi.CloseTunnelResponse, error) {
+	ip := net.ParseIP(req.VpnIp).To4()
+	if ip == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid vpn ip: %s", req.VpnIp)
+	}
+
+	return &controlapi.CloseTunnelResponse{Closed: s.c.CloseTunnel(iputil.Ip2VpnIp(ip), req.LocalOnly)}, nil
+}
+
+func (s *grpcControlServer) DumpHostmap(_ context.Context, req *controlapi.DumpHostmapRequest) (*controlapi.DumpHostmapResponse, error) {
+	var hosts []ControlHostInfo
+	if req.ByIndex {
+		hosts = s.c.ListHostmapIndexes(req.Pending)
+	} else {
+		hosts = s.c.ListHostmapHosts(req.Pending)
+	}
+
+	return &controlapi.DumpHostmapResponse{Hosts: grpcHostInfos(hosts)}, nil
+}
+
+func (s *grpcControlServer) DumpRoutes(_ context.Context, _ *controlapi.DumpRoutesRequest) (*controlapi.DumpRoutesResponse, error) {
+	rl, ok := s.c.f.inside.(overlay.RouteLister)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the tun device does not report its routes")
+	}
+
+	res := &controlapi.DumpRoutesResponse{}
+	for _, r := range rl.ListRoutes() {
+		gr := &controlapi.Route{
+			Cidr:    r.Cidr.String(),
+			MTU:     int32(r.MTU),
+			Metric:  int32(r.Metric),
+			Install: r.Install,
+			Tag:     r.Tag,
+		}
+		if r.Via != nil {
+			gr.Via = r.Via.String()
+		}
+		res.Routes = append(res.Routes, gr)
+	}
+
+	return res, nil
+}
+
+func (s *grpcControlServer) Reload(_ context.Context, _ *controlapi.ReloadRequest) (*controlapi.ReloadResponse, error) {
+	if s.c.config == nil {
+		return nil, status.Error(codes.FailedPrecondition, "there is no config to reload")
+	}
+
+	s.c.config.ReloadConfig()
+	return &controlapi.ReloadResponse{}, nil
+}
+
+func grpcHostInfos(hosts []ControlHostInfo) []*controlapi.HostInfo {
+	out := make([]*controlapi.HostInfo, 0, len(hosts))
+	for _, h := range hosts {
+		gh := &controlapi.HostInfo{
+			VpnIp:          h.VpnIp.String(),
+			LocalIndex:     h.LocalIndex,
+			RemoteIndex:    h.RemoteIndex,
+			MessageCounter: h.MessageCounter,
+		}
+
+		for _, a := range h.RemoteAddrs {
+			gh.RemoteAddrs = append(gh.RemoteAddrs, a.String())
+		}
+
+		if h.CurrentRemote != nil {
+			gh.CurrentRemote = h.CurrentRemote.String()
+		}
+
+		for _, ip := range h.CurrentRelaysToMe {
+			gh.CurrentRelaysToMe = append(gh.CurrentRelaysToMe, ip.String())
+		}
+
+		for _, ip := range h.CurrentRelaysThroughMe {
+			gh.CurrentRelaysThroughMe = append(gh.CurrentRelaysThroughMe, ip.String())
+		}
+
+		if h.Cert != nil {
+			gh.Cert, _ = h.Cert.Marshal()
+		}
+
+		out = append(out, gh)
+	}
+
+	return out
+}
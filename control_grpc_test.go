@@ -0,0 +1,181 @@
+package nebula
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/controlapi"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewGRPCControlFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	g, err := newGRPCControlFromConfig(l, c)
+	assert.NoError(t, err)
+	assert.Nil(t, g)
+
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "unix:///run/nebula.sock"}}
+	g, err = newGRPCControlFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, "unix", g.network)
+	assert.Equal(t, "/run/nebula.sock", g.address)
+
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "127.0.0.1:4243"}}
+	_, err = newGRPCControlFromConfig(l, c)
+	assert.EqualError(t, err, "control.grpc.token must be provided when control.grpc.listen is not a unix socket")
+
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "127.0.0.1:4243", "token": "secret"}}
+	g, err = newGRPCControlFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", g.network)
+	assert.Nil(t, g.tls)
+
+	// The token is never sent over the network in the clear
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "0.0.0.0:4243", "token": "secret"}}
+	_, err = newGRPCControlFromConfig(l, c)
+	assert.EqualError(t, err, "control.grpc.cert and control.grpc.key must be provided when control.grpc.listen is not a unix socket or a loopback address")
+
+	certFile, keyFile, _ := writeTestTLSCert(t)
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "0.0.0.0:4243", "token": "secret", "cert": certFile}}
+	_, err = newGRPCControlFromConfig(l, c)
+	assert.EqualError(t, err, "control.grpc.cert and control.grpc.key must both be provided to use tls")
+
+	c.Settings["control"] = map[interface{}]interface{}{"grpc": map[interface{}]interface{}{"listen": "0.0.0.0:4243", "token": "secret", "cert": certFile, "key": keyFile}}
+	g, err = newGRPCControlFromConfig(l, c)
+	require.NoError(t, err)
+	assert.NotNil(t, g.tls)
+}
+
+// writeTestTLSCert writes a self signed certificate for localhost and its key to files, the pool trusts it
+func writeTestTLSCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "control.crt")
+	keyFile := filepath.Join(dir, "control.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(crt)
+	return certFile, keyFile, pool
+}
+
+func TestGRPCControl(t *testing.T) {
+	l := test.NewLogger()
+	hm := NewHostMap(l, nil, &net.IPNet{}, make([]*net.IPNet, 0))
+	vpnIp := iputil.Ip2VpnIp(net.IPv4(10, 1, 0, 2))
+	hm.unlockedAddHostInfo(&HostInfo{
+		remote:          udp.NewAddr(net.ParseIP("192.168.1.2"), 4242),
+		remotes:         NewRemoteList(nil),
+		ConnectionState: &ConnectionState{},
+		remoteIndexId:   200,
+		localIndexId:    201,
+		vpnIp:           vpnIp,
+		relayState: RelayState{
+			relays:        map[iputil.VpnIp]struct{}{},
+			relayForByIp:  map[iputil.VpnIp]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}, &Interface{})
+
+	control := &Control{f: &Interface{hostMap: hm}, l: l}
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	g := &grpcControl{l: l, network: "unix", address: sock, token: "secret"}
+	require.NoError(t, g.start(control))
+	defer g.stop()
+
+	conn, err := grpc.Dial("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := controlapi.NewControlClient(conn)
+
+	// Calls without the token are refused
+	_, err = client.ListTunnels(context.Background(), &controlapi.ListTunnelsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	res, err := client.ListTunnels(ctx, &controlapi.ListTunnelsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Tunnels, 1)
+	assert.Equal(t, "10.1.0.2", res.Tunnels[0].VpnIp)
+	assert.Equal(t, uint32(201), res.Tunnels[0].LocalIndex)
+	assert.Equal(t, "192.168.1.2:4242", res.Tunnels[0].CurrentRemote)
+
+	dump, err := client.DumpHostmap(ctx, &controlapi.DumpHostmapRequest{Pending: false, ByIndex: true})
+	require.NoError(t, err)
+	require.Len(t, dump.Hosts, 1)
+
+	_, err = client.CloseTunnel(ctx, &controlapi.CloseTunnelRequest{VpnIp: "not an ip"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	closed, err := client.CloseTunnel(ctx, &controlapi.CloseTunnelRequest{VpnIp: "10.1.0.3", LocalOnly: true})
+	require.NoError(t, err)
+	assert.False(t, closed.Closed)
+}
+
+func TestGRPCControl_tls(t *testing.T) {
+	l := test.NewLogger()
+	certFile, keyFile, pool := writeTestTLSCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	control := &Control{f: &Interface{hostMap: NewHostMap(l, nil, &net.IPNet{}, make([]*net.IPNet, 0))}, l: l}
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	g := &grpcControl{l: l, network: "unix", address: sock, token: "secret", tls: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	require.NoError(t, g.start(control))
+	defer g.stop()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+
+	// A client that does not speak tls gets nowhere
+	conn, err := grpc.Dial("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = controlapi.NewControlClient(conn).ListTunnels(ctx, &controlapi.ListTunnelsRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	tlsConn, err := grpc.Dial("unix://"+sock, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "localhost"})))
+	require.NoError(t, err)
+	defer tlsConn.Close()
+	res, err := controlapi.NewControlClient(tlsConn).ListTunnels(ctx, &controlapi.ListTunnelsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, res.Tunnels)
+}
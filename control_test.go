@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"context"
 	"net"
 	"reflect"
 	"testing"
@@ -8,7 +9,12 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
@@ -18,7 +24,7 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 	l := test.NewLogger()
 	// Special care must be taken to re-use all objects provided to the hostmap and certificate in the expectedInfo object
 	// To properly ensure we are not exposing core memory to the caller
-	hm := NewHostMap(l, &net.IPNet{}, make([]*net.IPNet, 0))
+	hm := NewHostMap(l, nil, &net.IPNet{}, make([]*net.IPNet, 0))
 	remote1 := udp.NewAddr(net.ParseIP("0.0.0.100"), 4444)
 	remote2 := udp.NewAddr(net.ParseIP("1:2:3:4:5:6:7:8"), 4444)
 	ipNet := net.IPNet{
@@ -54,7 +60,8 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		remote:  remote1,
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
-			peerCert: crt,
+			peerCert:     crt,
+			peerMetadata: map[string]string{"dc": "us-east"},
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
@@ -101,10 +108,11 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          udp.NewAddr(net.ParseIP("0.0.0.100"), 4444),
 		CurrentRelaysToMe:      []iputil.VpnIp{},
 		CurrentRelaysThroughMe: []iputil.VpnIp{},
+		Metadata:               map[string]string{"dc": "us-east"},
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "Metadata"}, thi)
 	test.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
 	// Make sure we don't panic if the host info doesn't have a cert yet
@@ -122,3 +130,115 @@ func assertFields(t *testing.T, expected []string, actualStruct interface{}) {
 
 	assert.Equal(t, expected, fields)
 }
+
+type simulateTestDevice struct {
+	overlay.Device
+	routes *cidr.Tree4[iputil.VpnIp]
+}
+
+func (d *simulateTestDevice) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
+	_, r := d.routes.MostSpecificContains(ip)
+	return r
+}
+
+func TestControl_SimulatePacket(t *testing.T) {
+	l := test.NewLogger()
+	_, vpnNet, _ := net.ParseCIDR("10.128.0.0/24")
+	myIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 1))
+	peerIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 2))
+	viaIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 3))
+
+	crt := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Ips:            []*net.IPNet{{IP: net.IPv4(10, 128, 0, 2), Mask: vpnNet.Mask}},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+		},
+	}
+	myCrt := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Ips: []*net.IPNet{{IP: net.IPv4(10, 128, 0, 1), Mask: vpnNet.Mask}},
+		},
+	}
+
+	hm := NewHostMap(l, nil, vpnNet, []*net.IPNet{})
+	hi := &HostInfo{
+		ConnectionState: &ConnectionState{peerCert: crt},
+		vpnIp:           peerIp,
+		localIndexId:    1,
+		remoteIndexId:   2,
+	}
+	hi.CreateRemoteCIDR(crt)
+	hm.unlockedAddHostInfo(hi, &Interface{})
+
+	routes := cidr.NewTree4[iputil.VpnIp]()
+	_, unsafeNet, _ := net.ParseCIDR("192.168.0.0/24")
+	routes.AddCIDR(unsafeNet, viaIp)
+
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, myCrt)
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+
+	lh := &LightHouse{myVpnZeros: 8}
+	lh.myVpnIp.Store(myIp)
+	c := Control{
+		f: &Interface{
+			hostMap:    hm,
+			firewall:   fw,
+			pki:        &PKI{},
+			inside:     &simulateTestDevice{routes: routes},
+			lightHouse: lh,
+		},
+		l: l,
+	}
+
+	// A peer in our network with a tunnel
+	r := c.SimulatePacket(firewall.Packet{LocalIP: myIp, RemoteIP: peerIp, LocalPort: 1, RemotePort: 2, Protocol: firewall.ProtoTCP}, false)
+	assert.Equal(t, "local", r.Route)
+	assert.Equal(t, peerIp, r.Peer)
+	assert.True(t, r.TunnelExists)
+	assert.Equal(t, "allow", r.Firewall.Verdict)
+
+	// Unsafe route through a via that has no tunnel yet
+	r = c.SimulatePacket(firewall.Packet{LocalIP: myIp, RemoteIP: iputil.Ip2VpnIp(net.IPv4(192, 168, 0, 5)), Protocol: firewall.ProtoTCP}, false)
+	assert.Equal(t, "via", r.Route)
+	assert.Equal(t, viaIp, r.Peer)
+	assert.False(t, r.TunnelExists)
+	assert.Equal(t, "unknown", r.Firewall.Verdict)
+
+	// No route at all
+	r = c.SimulatePacket(firewall.Packet{LocalIP: myIp, RemoteIP: iputil.Ip2VpnIp(net.IPv4(172, 16, 0, 5)), Protocol: firewall.ProtoTCP}, false)
+	assert.Equal(t, "drop", r.Route)
+	assert.Equal(t, iputil.VpnIp(0), r.Peer)
+	assert.False(t, r.TunnelExists)
+
+	// Inbound with no matching rule
+	r = c.SimulatePacket(firewall.Packet{LocalIP: myIp, RemoteIP: peerIp, LocalPort: 22, RemotePort: 2, Protocol: firewall.ProtoTCP}, true)
+	assert.Equal(t, "local", r.Route)
+	assert.Equal(t, "deny", r.Firewall.Verdict)
+}
+
+func TestControl_RefreshLighthouses(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"hosts":            []interface{}{"10.128.0.2"},
+		"advertise_addrs":  []interface{}{"1.2.3.4:4242"},
+		"local_allow_list": map[interface{}]interface{}{"0.0.0.0/0": false, "::/0": false},
+	}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+
+	filter := NebulaMeta_HostUpdateNotification
+	w := &testEncWriter{metaFilter: &filter}
+	lh.ifce = w
+
+	ctrl := Control{f: &Interface{lightHouse: lh}, l: l}
+	sent := ctrl.RefreshLighthouses()
+	assertUdpAddrInArray(t, sent, &udp.Addr{IP: net.IP{1, 2, 3, 4}, Port: 4242})
+
+	// The update went to the lighthouse with the same addresses
+	assert.Equal(t, header.LightHouse, w.lastReply.nebType)
+	assert.Equal(t, iputil.Ip2VpnIp(net.IP{10, 128, 0, 2}), w.lastReply.vpnIp)
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts, &udp.Addr{IP: net.IP{1, 2, 3, 4}, Port: 4242})
+}
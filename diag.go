@@ -0,0 +1,259 @@
+package nebula
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"runtime"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/overlay"
+	"gopkg.in/yaml.v2"
+)
+
+// redactedConfigKeys are the config keys whose values are secret anywhere in the config, like pki.key,
+// pki.certs[].key, handshakes.psk, sshd.host_key and the sshd.control tokens
+var redactedConfigKeys = map[string]struct{}{
+	"key":            {},
+	"host_key":       {},
+	"psk":            {},
+	"token":          {},
+	"observer_token": {},
+}
+
+const redactedValue = "<redacted>"
+
+type diagVersion struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Time      string `json:"time"`
+}
+
+type diagRoute struct {
+	Cidr    string `json:"cidr"`
+	Via     string `json:"via,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
+	Metric  int    `json:"metric,omitempty"`
+	Install bool   `json:"install"`
+	Tag     string `json:"tag,omitempty"`
+	Src     string `json:"src,omitempty"`
+	// OnUnreachable is only set when it is not the default, drop
+	OnUnreachable string `json:"onUnreachable,omitempty"`
+}
+
+type diagRoutes struct {
+	Device string      `json:"device"`
+	Cidr   string      `json:"cidr"`
+	Routes []diagRoute `json:"routes,omitempty"`
+	// Error is set when the device can not list its routes
+	Error string `json:"error,omitempty"`
+}
+
+type diagConntrack struct {
+	Total       int            `json:"total"`
+	Peers       int            `json:"peers"`
+	ByProtocol  map[string]int `json:"byProtocol"`
+	ByDirection map[string]int `json:"byDirection"`
+}
+
+// writeDiagnostics writes a gzipped tarball to w for support tickets. It holds the effective config with secrets
+// redacted, the hostmaps, routes, firewall rules, a conntrack summary, a snapshot of every metric and version info.
+func writeDiagnostics(w io.Writer, f *Interface, c *config.C) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, b []byte) error {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: now})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+
+	addJson := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %s", name, err)
+		}
+		return add(name, b)
+	}
+
+	cb, err := yaml.Marshal(redactConfig(c.Settings))
+	if err != nil {
+		return fmt.Errorf("failed to marshal config.yml: %s", err)
+	}
+
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"version.json", diagVersion{
+			Version:   f.version,
+			GoVersion: runtime.Version(),
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			Time:      now.UTC().Format(time.RFC3339),
+		}},
+		{"hostmap.json", listHostMapHosts(f.hostMap)},
+		{"pending_hostmap.json", listHostMapHosts(f.handshakeManager)},
+		{"routes.json", diagListRoutes(f.inside)},
+		{"firewall.json", f.firewall.Dump()},
+		{"conntrack.json", diagSummarizeConntrack(f.firewall.DumpConntrack(0, firewall.ProtoAny))},
+		{"metrics.json", diagSnapshotMetrics(f.metricsRegistry)},
+	}
+
+	if err := add("config.yml", cb); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := addJson(file.name, file.v); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// redactConfig returns a copy of settings with the values of redactedConfigKeys replaced, at any depth. Any other
+// string that is a url, like events.webhook_url, keeps its scheme, host and path but loses the credentials that may be
+// in its userinfo or query.
+func redactConfig(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			if _, ok := redactedConfigKeys[fmt.Sprintf("%v", k)]; ok && val != nil {
+				out[k] = redactedValue
+				continue
+			}
+			out[k] = redactConfig(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = redactConfig(val)
+		}
+		return out
+	case string:
+		return redactURL(v)
+	default:
+		return v
+	}
+}
+
+// redactURL replaces the userinfo, query and fragment of s if it is an absolute url, anything else is returned as is
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+
+	if u.User == nil && u.RawQuery == "" && u.Fragment == "" {
+		return s
+	}
+
+	host := u.Host
+	if u.User != nil {
+		host = redactedValue + "@" + host
+	}
+
+	out := u.Scheme + "://" + host + u.EscapedPath()
+	if u.RawQuery != "" {
+		out += "?" + redactedValue
+	}
+	if u.Fragment != "" {
+		out += "#" + redactedValue
+	}
+	return out
+}
+
+func diagListRoutes(d overlay.Device) diagRoutes {
+	dr := diagRoutes{Device: d.Name(), Cidr: d.Cidr().String()}
+
+	rl, ok := d.(overlay.RouteLister)
+	if !ok {
+		dr.Error = fmt.Sprintf("%T does not support listing routes", d)
+		return dr
+	}
+
+	for _, r := range rl.ListRoutes() {
+		route := diagRoute{Cidr: r.Cidr.String(), MTU: r.MTU, Metric: r.Metric, Install: r.Install, Tag: r.Tag}
+		if r.Via != nil {
+			route.Via = r.Via.String()
+		}
+		if r.Src != nil {
+			route.Src = r.Src.String()
+		}
+		if r.OnUnreachable != overlay.OnUnreachableDrop {
+			route.OnUnreachable = r.OnUnreachable.String()
+		}
+		dr.Routes = append(dr.Routes, route)
+	}
+	return dr
+}
+
+// diagSummarizeConntrack counts the conntrack entries instead of listing them, the flows of a busy node are too many
+// and too revealing for a support ticket
+func diagSummarizeConntrack(entries []ConntrackEntry) diagConntrack {
+	s := diagConntrack{
+		Total:       len(entries),
+		ByProtocol:  map[string]int{},
+		ByDirection: map[string]int{},
+	}
+
+	peers := map[string]struct{}{}
+	for _, e := range entries {
+		s.ByProtocol[e.Protocol]++
+		s.ByDirection[e.Direction]++
+		peers[e.Peer] = struct{}{}
+	}
+	s.Peers = len(peers)
+	return s
+}
+
+// diagSnapshotMetrics returns the current value of every metric in registry by name
+func diagSnapshotMetrics(registry metrics.Registry) map[string]interface{} {
+	out := map[string]interface{}{}
+	registry.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			out[name] = m.Count()
+		case metrics.Gauge:
+			out[name] = m.Value()
+		case metrics.GaugeFloat64:
+			if v := m.Value(); !math.IsNaN(v) && !math.IsInf(v, 0) {
+				out[name] = v
+			}
+		case metrics.Meter:
+			s := m.Snapshot()
+			out[name] = map[string]interface{}{"count": s.Count(), "rate1": s.Rate1()}
+		case metrics.Histogram:
+			s := m.Snapshot()
+			out[name] = diagHistogram(s.Count(), s.Min(), s.Max(), s.Mean(), s.Percentiles([]float64{0.5, 0.99}))
+		case metrics.Timer:
+			s := m.Snapshot()
+			out[name] = diagHistogram(s.Count(), s.Min(), s.Max(), s.Mean(), s.Percentiles([]float64{0.5, 0.99}))
+		}
+	})
+	return out
+}
+
+func diagHistogram(count, min, max int64, mean float64, ps []float64) map[string]interface{} {
+	return map[string]interface{}{"count": count, "min": min, "max": max, "mean": mean, "p50": ps[0], "p99": ps[1]}
+}
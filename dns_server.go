@@ -15,9 +15,15 @@ import (
 
 // This whole thing should be rewritten to use context
 
-var dnsR *dnsRecords
-var dnsServer *dns.Server
-var dnsAddr string
+// dnsServer answers lighthouse.serve_dns queries from the host map of one overlay, every overlay in a process runs its
+// own
+type dnsServer struct {
+	sync.Mutex
+	l       *logrus.Logger
+	records *dnsRecords
+	addr    string
+	server  *dns.Server
+}
 
 type dnsRecords struct {
 	sync.RWMutex
@@ -66,7 +72,7 @@ func (d *dnsRecords) Add(host, data string) {
 	d.dnsMap[strings.ToLower(host)] = data
 }
 
-func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
+func parseQuery(l *logrus.Logger, dnsR *dnsRecords, m *dns.Msg, w dns.ResponseWriter) {
 	for _, q := range m.Question {
 		switch q.Qtype {
 		case dns.TypeA:
@@ -98,33 +104,28 @@ func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
 	}
 }
 
-func handleDnsRequest(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg) {
+func handleDnsRequest(l *logrus.Logger, dnsR *dnsRecords, w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		parseQuery(l, m, w)
+		parseQuery(l, dnsR, m, w)
 	}
 
 	w.WriteMsg(m)
 }
 
-func dnsMain(l *logrus.Logger, hostMap *HostMap, c *config.C) func() {
-	dnsR = newDnsRecords(hostMap)
-
-	// attach request handler func
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		handleDnsRequest(l, w, r)
-	})
+func dnsMain(l *logrus.Logger, records *dnsRecords, c *config.C) func() {
+	d := &dnsServer{l: l, records: records}
 
 	c.RegisterReloadCallback(func(c *config.C) {
-		reloadDns(l, c)
+		d.reload(c)
 	})
 
 	return func() {
-		startDns(l, c)
+		d.start(c)
 	}
 }
 
@@ -132,24 +133,40 @@ func getDnsServerAddr(c *config.C) string {
 	return c.GetString("lighthouse.dns.host", "") + ":" + strconv.Itoa(c.GetInt("lighthouse.dns.port", 53))
 }
 
-func startDns(l *logrus.Logger, c *config.C) {
-	dnsAddr = getDnsServerAddr(c)
-	dnsServer = &dns.Server{Addr: dnsAddr, Net: "udp"}
-	l.WithField("dnsListener", dnsAddr).Info("Starting DNS responder")
-	err := dnsServer.ListenAndServe()
-	defer dnsServer.Shutdown()
+func (d *dnsServer) start(c *config.C) {
+	// attach request handler func, on a mux of our own so overlays do not answer from each others host map
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		handleDnsRequest(d.l, d.records, w, r)
+	})
+
+	d.Lock()
+	d.addr = getDnsServerAddr(c)
+	server := &dns.Server{Addr: d.addr, Net: "udp", Handler: mux}
+	d.server = server
+	d.Unlock()
+
+	d.l.WithField("dnsListener", server.Addr).Info("Starting DNS responder")
+	err := server.ListenAndServe()
+	defer server.Shutdown()
 	if err != nil {
-		l.Errorf("Failed to start server: %s\n ", err.Error())
+		d.l.Errorf("Failed to start server: %s\n ", err.Error())
 	}
 }
 
-func reloadDns(l *logrus.Logger, c *config.C) {
-	if dnsAddr == getDnsServerAddr(c) {
-		l.Debug("No DNS server config change detected")
+func (d *dnsServer) reload(c *config.C) {
+	d.Lock()
+	if d.addr == getDnsServerAddr(c) {
+		d.Unlock()
+		d.l.Debug("No DNS server config change detected")
 		return
 	}
+	server := d.server
+	d.Unlock()
 
-	l.Debug("Restarting DNS server")
-	dnsServer.Shutdown()
-	go startDns(l, c)
+	d.l.Debug("Restarting DNS server")
+	if server != nil {
+		server.Shutdown()
+	}
+	go d.start(c)
 }
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParsequery(t *testing.T) {
@@ -17,3 +19,22 @@ func TestParsequery(t *testing.T) {
 
 	//parseQuery(m)
 }
+
+func TestParseQuery_PerOverlay(t *testing.T) {
+	l := test.NewLogger()
+	office := newDnsRecords(&HostMap{})
+	office.Add("printer.", "10.1.0.5")
+	home := newDnsRecords(&HostMap{})
+	home.Add("printer.", "10.2.0.5")
+
+	answer := func(records *dnsRecords) []dns.RR {
+		m := new(dns.Msg)
+		m.SetQuestion("printer.", dns.TypeA)
+		parseQuery(l, records, m, nil)
+		return m.Answer
+	}
+
+	// Each overlay answers from its own records
+	assert.Equal(t, "10.1.0.5", answer(office)[0].(*dns.A).A.String())
+	assert.Equal(t, "10.2.0.5", answer(home)[0].(*dns.A).A.String())
+}
@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// duplicateVpnIpPolicy decides which tunnel wins when a handshake claims a vpn ip that another node holds a tunnel for
+type duplicateVpnIpPolicy uint32
+
+const (
+	// duplicateVpnIpLowestFingerprint keeps the tunnel with the node whose certificate has the lowest fingerprint. Every
+	// node picks the same winner no matter which handshake it saw first, and the loser is rejected however often it
+	// handshakes, so this is the default.
+	duplicateVpnIpLowestFingerprint duplicateVpnIpPolicy = iota
+	// duplicateVpnIpKeepExisting rejects the new handshake while the existing tunnel is up
+	duplicateVpnIpKeepExisting
+	// duplicateVpnIpTakeNew replaces the existing tunnel with the new one, the same as any newer handshake
+	duplicateVpnIpTakeNew
+)
+
+var ErrDuplicateVpnIp = errors.New("duplicate vpn ip")
+
+func (p duplicateVpnIpPolicy) String() string {
+	switch p {
+	case duplicateVpnIpLowestFingerprint:
+		return "lowest_fingerprint"
+	case duplicateVpnIpKeepExisting:
+		return "keep_existing"
+	case duplicateVpnIpTakeNew:
+		return "take_new"
+	}
+	return fmt.Sprintf("duplicateVpnIpPolicy(%d)", uint32(p))
+}
+
+// getDuplicateVpnIpPolicy reads handshakes.duplicate_vpn_ip
+func getDuplicateVpnIpPolicy(c *config.C) (duplicateVpnIpPolicy, error) {
+	switch v := c.GetString("handshakes.duplicate_vpn_ip", "lowest_fingerprint"); v {
+	case "lowest_fingerprint":
+		return duplicateVpnIpLowestFingerprint, nil
+	case "keep_existing":
+		return duplicateVpnIpKeepExisting, nil
+	case "take_new":
+		return duplicateVpnIpTakeNew, nil
+	default:
+		return 0, fmt.Errorf("handshakes.duplicate_vpn_ip must be lowest_fingerprint, keep_existing or take_new: %v", v)
+	}
+}
+
+// isDuplicateVpnIp returns true when hostinfo is for the same vpn ip as existing but is a different node, one that
+// presents a different certificate from a different underlay address. A node rehandshaking with a renewed certificate
+// does so from the address we already know it by. Relayed handshakes have no address to compare and are never
+// considered a duplicate.
+func isDuplicateVpnIp(existing, hostinfo *HostInfo) bool {
+	if existing == nil || existing.ConnectionState == nil || hostinfo.ConnectionState == nil {
+		return false
+	}
+
+	if existing.remote == nil || hostinfo.remote == nil || existing.remote.Equals(hostinfo.remote) {
+		return false
+	}
+
+	oldCert := existing.ConnectionState.peerCert
+	newCert := hostinfo.ConnectionState.peerCert
+	if oldCert == nil || newCert == nil {
+		return false
+	}
+
+	oldFingerprint, _ := oldCert.Sha256Sum()
+	newFingerprint, _ := newCert.Sha256Sum()
+	return oldFingerprint != newFingerprint
+}
+
+// checkDuplicateVpnIp counts and warns about hostinfo claiming the vpn ip of a different node in existing. Returns
+// ErrDuplicateVpnIp if hostinfo must be rejected, the caller must hold the main host map lock.
+func (hm *HandshakeManager) checkDuplicateVpnIp(existing, hostinfo *HostInfo) error {
+	if !isDuplicateVpnIp(existing, hostinfo) {
+		return nil
+	}
+
+	hm.metricDuplicateVpnIp.Inc(1)
+
+	policy := duplicateVpnIpPolicy(hm.duplicateVpnIp.Load())
+	oldCert := existing.ConnectionState.peerCert
+	newCert := hostinfo.ConnectionState.peerCert
+	oldFingerprint, _ := oldCert.Sha256Sum()
+	newFingerprint, _ := newCert.Sha256Sum()
+
+	hm.l.WithField("vpnIp", hostinfo.vpnIp).
+		WithField("existing", m{"certName": oldCert.Details.Name, "fingerprint": oldFingerprint, "udpAddr": existing.remote}).
+		WithField("new", m{"certName": newCert.Details.Name, "fingerprint": newFingerprint, "udpAddr": hostinfo.remote}).
+		WithField("policy", policy).
+		Warn("Two different nodes claim the same vpn ip, check the certificates")
+
+	switch policy {
+	case duplicateVpnIpKeepExisting:
+		return ErrDuplicateVpnIp
+	case duplicateVpnIpLowestFingerprint:
+		if newFingerprint > oldFingerprint {
+			return ErrDuplicateVpnIp
+		}
+	}
+	return nil
+}
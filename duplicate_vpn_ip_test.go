@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDuplicateVpnIpPolicy(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	p, err := getDuplicateVpnIpPolicy(c)
+	assert.NoError(t, err)
+	assert.Equal(t, duplicateVpnIpLowestFingerprint, p)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"duplicate_vpn_ip": "keep_existing"}
+	p, err = getDuplicateVpnIpPolicy(c)
+	assert.NoError(t, err)
+	assert.Equal(t, duplicateVpnIpKeepExisting, p)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"duplicate_vpn_ip": "take_new"}
+	p, err = getDuplicateVpnIpPolicy(c)
+	assert.NoError(t, err)
+	assert.Equal(t, duplicateVpnIpTakeNew, p)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"duplicate_vpn_ip": "flap"}
+	_, err = getDuplicateVpnIpPolicy(c)
+	assert.EqualError(t, err, "handshakes.duplicate_vpn_ip must be lowest_fingerprint, keep_existing or take_new: flap")
+}
+
+func TestIsDuplicateVpnIp(t *testing.T) {
+	withCert := func(name string, key byte, remote *udp.Addr) *HostInfo {
+		return &HostInfo{remote: remote, ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{Name: name, PublicKey: []byte{key}},
+		}}}
+	}
+	addr1 := udp.NewAddr(net.IP{192, 0, 2, 1}, 4242)
+	addr2 := udp.NewAddr(net.IP{192, 0, 2, 2}, 4242)
+
+	existing := withCert("host1", 1, addr1)
+	assert.False(t, isDuplicateVpnIp(nil, existing))
+	assert.False(t, isDuplicateVpnIp(existing, withCert("host1", 1, addr2)), "the same certificate from a new address")
+	assert.False(t, isDuplicateVpnIp(existing, withCert("host1-renewed", 2, addr1)), "a renewed certificate from the same address")
+	assert.True(t, isDuplicateVpnIp(existing, withCert("host2", 2, addr2)), "a different node")
+	assert.False(t, isDuplicateVpnIp(existing, withCert("host2", 2, nil)), "a relayed handshake")
+	assert.False(t, isDuplicateVpnIp(&HostInfo{remote: addr1, ConnectionState: &ConnectionState{}}, existing), "no certificate yet")
+}
+
+func TestCheckDuplicateVpnIp(t *testing.T) {
+	withCert := func(name string, key byte, remote *udp.Addr) *HostInfo {
+		return &HostInfo{remote: remote, ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{Name: name, PublicKey: []byte{key}},
+		}}}
+	}
+	a := withCert("host1", 1, udp.NewAddr(net.IP{192, 0, 2, 1}, 4242))
+	b := withCert("host2", 2, udp.NewAddr(net.IP{192, 0, 2, 2}, 4242))
+	aFingerprint, _ := a.ConnectionState.peerCert.Sha256Sum()
+	bFingerprint, _ := b.ConnectionState.peerCert.Sha256Sum()
+	low, high := a, b
+	if bFingerprint < aFingerprint {
+		low, high = b, a
+	}
+
+	hm := &HandshakeManager{l: test.NewLogger(), metricDuplicateVpnIp: metrics.NewCounter()}
+
+	// Whichever node holds the tunnel, the lowest fingerprint wins every time both keep handshaking
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, hm.checkDuplicateVpnIp(high, low))
+		assert.ErrorIs(t, hm.checkDuplicateVpnIp(low, high), ErrDuplicateVpnIp)
+	}
+
+	hm.duplicateVpnIp.Store(uint32(duplicateVpnIpKeepExisting))
+	assert.ErrorIs(t, hm.checkDuplicateVpnIp(high, low), ErrDuplicateVpnIp)
+	assert.ErrorIs(t, hm.checkDuplicateVpnIp(low, high), ErrDuplicateVpnIp)
+
+	hm.duplicateVpnIp.Store(uint32(duplicateVpnIpTakeNew))
+	assert.NoError(t, hm.checkDuplicateVpnIp(high, low))
+	assert.NoError(t, hm.checkDuplicateVpnIp(low, high))
+
+	assert.Equal(t, int64(10), hm.metricDuplicateVpnIp.Count())
+}
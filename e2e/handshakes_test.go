@@ -6,11 +6,16 @@ package e2e
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/e2e/router"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
@@ -360,16 +365,660 @@ func TestRelays(t *testing.T) {
 	relayControl.Start()
 	theirControl.Start()
 
+	forwardLatency := metrics.GetOrRegisterHistogram("relay.forward_latency", nil, metrics.NewExpDecaySample(1028, 0.015))
+	forwarded := forwardLatency.Count()
+
 	t.Log("Trigger a handshake from me to them via the relay")
 	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
 
 	p := r.RouteForAllUntilTxTun(theirControl)
 	r.Log("Assert the tunnel works")
 	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	r.Log("Assert the relay timed a sample of the packets it forwarded")
+	assert.Equal(t, forwarded, forwardLatency.Count())
+	// One in 64 forwarded packets is timed
+	for i := 0; i < 64; i++ {
+		myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+		r.RouteForAllUntilTxTun(theirControl)
+	}
+	assert.Greater(t, forwardLatency.Count(), forwarded)
 	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
 	//TODO: assert we actually used the relay even though it should be impossible for a tunnel to have occurred without it
 }
 
+func TestRelays_peerRelays(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{
+		"use_relays": true,
+		// Nothing told me about the relay, the config is enough
+		"peer_relays": m{"10.128.0.2": []string{"10.128.0.129", "10.128.0.128"}},
+	}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	// The preferred relay 10.128.0.129 does not exist so the handshake has to fall back to the second one
+	myControl.InjectLightHouseAddr(relayVpnIpNet.IP, relayUdpAddr)
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relayControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the configured relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	r.Log("Assert the tunnel works")
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Nil(t, hi.CurrentRemote)
+	assert.Equal(t, []iputil.VpnIp{iputil.Ip2VpnIp(relayVpnIpNet.IP)}, hi.CurrentRelaysToMe)
+	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
+}
+
+func TestRelays_auto(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{
+		"lighthouse":      m{"hosts": []string{"10.128.0.128"}},
+		"static_host_map": m{"10.128.0.128": []string{"10.0.0.128:4242"}},
+		"relay":           m{"use_relays": true, "auto": true, "auto_after": 2},
+	})
+	relayControl, relayVpnIpNet, _, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{
+		"lighthouse":      m{"hosts": []string{"10.128.0.128"}},
+		"static_host_map": m{"10.128.0.128": []string{"10.0.0.128:4242"}},
+		"relay":           m{"use_relays": true},
+	})
+
+	// Nobody tells me how to reach them directly and they advertise no relays, the handshake can only complete once
+	// the direct attempts run out and my lighthouse is used as a relay
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relayControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	established := metrics.GetOrRegisterCounter("relay.auto.established", nil)
+	before := established.Count()
+
+	t.Log("Trigger a handshake from me to them that falls back to the lighthouse relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	r.Log("Assert the tunnel works")
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Nil(t, hi.CurrentRemote)
+	assert.Equal(t, []iputil.VpnIp{iputil.Ip2VpnIp(relayVpnIpNet.IP)}, hi.CurrentRelaysToMe)
+	assert.Equal(t, before+1, established.Count())
+	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
+}
+
+func TestRequireGroups(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	withGroups := func(name string, udpIp net.IP, groups ...string) m {
+		vpnIpNet := &net.IPNet{IP: net.IP{10, 128, udpIp[2], udpIp[3]}, Mask: net.IPMask{255, 255, 255, 0}}
+		_, _, key, crt := newTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, groups)
+		return m{"pki": m{"cert": string(crt), "key": string(key)}}
+	}
+
+	myOverrides := withGroups("me", net.IP{10, 0, 0, 1}, "prod")
+	myOverrides["pki"].(m)["require_groups"] = []string{"prod", "ops"}
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, myOverrides)
+	prodControl, prodVpnIpNet, prodUdpAddr, _ := newSimpleServer(ca, caKey, "prod", net.IP{10, 0, 0, 2}, withGroups("prod", net.IP{10, 0, 0, 2}, "web", "prod"))
+	devControl, devVpnIpNet, devUdpAddr, _ := newSimpleServer(ca, caKey, "dev", net.IP{10, 0, 0, 3}, withGroups("dev", net.IP{10, 0, 0, 3}, "web", "dev"))
+
+	myControl.InjectLightHouseAddr(prodVpnIpNet.IP, prodUdpAddr)
+	myControl.InjectLightHouseAddr(devVpnIpNet.IP, devUdpAddr)
+	devControl.InjectLightHouseAddr(myVpnIpNet.IP, &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 4242})
+
+	r := router.NewR(t, myControl, prodControl, devControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	prodControl.Start()
+	devControl.Start()
+
+	t.Log("A peer with a required group gets a tunnel")
+	myControl.InjectTunUDPPacket(prodVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(prodControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, prodVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, prodVpnIpNet.IP, myControl, prodControl, r)
+
+	t.Log("A peer without one is refused when it starts the handshake")
+	responderFailed := metrics.GetOrRegisterCounter("handshakes.responder.failed.groups", nil)
+	before := responderFailed.Count()
+	devControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from dev"))
+	r.RouteExitFunc(devControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return responderFailed.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(devVpnIpNet.IP), false))
+
+	t.Log("And when we start the handshake")
+	initiatorFailed := metrics.GetOrRegisterCounter("handshakes.initiator.failed.groups", nil)
+	before = initiatorFailed.Count()
+	myControl.InjectTunUDPPacket(devVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteExitFunc(myControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	r.RouteExitFunc(devControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return initiatorFailed.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(devVpnIpNet.IP), false))
+
+	r.RenderHostmaps("Final hostmaps", myControl, prodControl, devControl)
+	myControl.Stop()
+	prodControl.Stop()
+	devControl.Stop()
+}
+
+func TestStaticHostFingerprint(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	withCert := func(name string, udpIp net.IP) (m, string) {
+		vpnIpNet := &net.IPNet{IP: net.IP{10, 128, udpIp[2], udpIp[3]}, Mask: net.IPMask{255, 255, 255, 0}}
+		c, _, key, crt := newTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, []string{})
+		fingerprint, err := c.Sha256Sum()
+		if err != nil {
+			panic(err)
+		}
+		return m{"pki": m{"cert": string(crt), "key": string(key)}}, fingerprint
+	}
+
+	// prod is pinned to its own certificate, dev is pinned to prod's certificate and will not match
+	prodOverrides, prodFingerprint := withCert("prod", net.IP{10, 0, 0, 2})
+	devOverrides, _ := withCert("dev", net.IP{10, 0, 0, 3})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"static_host_map": m{
+			"10.128.0.2": m{"addrs": []string{"10.0.0.2:4242"}, "fingerprint": prodFingerprint},
+			"10.128.0.3": m{"addrs": []string{"10.0.0.3:4242"}, "fingerprint": prodFingerprint},
+		},
+	})
+	prodControl, prodVpnIpNet, _, _ := newSimpleServer(ca, caKey, "prod", net.IP{10, 0, 0, 2}, prodOverrides)
+	devControl, devVpnIpNet, _, _ := newSimpleServer(ca, caKey, "dev", net.IP{10, 0, 0, 3}, devOverrides)
+
+	devControl.InjectLightHouseAddr(myVpnIpNet.IP, &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 4242})
+
+	r := router.NewR(t, myControl, prodControl, devControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	prodControl.Start()
+	devControl.Start()
+
+	t.Log("A peer whose certificate matches the pin gets a tunnel")
+	myControl.InjectTunUDPPacket(prodVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(prodControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, prodVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, prodVpnIpNet.IP, myControl, prodControl, r)
+
+	t.Log("A peer whose certificate does not match is refused when it starts the handshake")
+	responderFailed := metrics.GetOrRegisterCounter("handshakes.responder.failed.fingerprint", nil)
+	before := responderFailed.Count()
+	devControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from dev"))
+	r.RouteExitFunc(devControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return responderFailed.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(devVpnIpNet.IP), false))
+
+	t.Log("And when we start the handshake")
+	initiatorFailed := metrics.GetOrRegisterCounter("handshakes.initiator.failed.fingerprint", nil)
+	before = initiatorFailed.Count()
+	myControl.InjectTunUDPPacket(devVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteExitFunc(myControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	r.RouteExitFunc(devControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return initiatorFailed.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(devVpnIpNet.IP), false))
+
+	r.RenderHostmaps("Final hostmaps", myControl, prodControl, devControl)
+	myControl.Stop()
+	prodControl.Stop()
+	devControl.Stop()
+}
+
+func TestTofu(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	tofuPath := filepath.Join(t.TempDir(), "tofu.yml")
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"pki": m{"tofu": m{"path": tofuPath}},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// The impostor has a valid certificate for their vpn ip but it is not the one we saw first
+	_, _, key, crt := newTestCert(ca, caKey, "impostor", time.Now(), time.Now().Add(5*time.Minute), theirVpnIpNet, nil, []string{})
+	impostorControl, _, _, _ := newSimpleServer(ca, caKey, "impostor", net.IP{10, 0, 0, 3}, m{
+		"pki": m{"cert": string(crt), "key": string(key)},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	impostorControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, impostorControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	impostorControl.Start()
+
+	t.Log("The first certificate seen for their vpn ip is learned")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	// It is saved in the background
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(tofuPath)
+		return err == nil && strings.Contains(string(b), theirVpnIpNet.IP.String())
+	}, time.Second, time.Millisecond)
+
+	t.Log("A different certificate for their vpn ip is refused")
+	theirVpnIp := iputil.Ip2VpnIp(theirVpnIpNet.IP)
+	assert.True(t, myControl.CloseTunnel(theirVpnIp, true))
+	responderFailed := metrics.GetOrRegisterCounter("handshakes.responder.failed.fingerprint", nil)
+	before := responderFailed.Count()
+	impostorControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from the impostor"))
+	r.RouteExitFunc(impostorControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return responderFailed.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(theirVpnIp, false))
+
+	t.Log("Until the learned fingerprint is cleared")
+	cleared, err := myControl.ClearTofu(theirVpnIp)
+	assert.NoError(t, err)
+	assert.True(t, cleared)
+	impostorControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from the impostor"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from the impostor"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, impostorControl)
+	myControl.Stop()
+	theirControl.Stop()
+	impostorControl.Stop()
+}
+
+func TestPeerPolicy(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+
+	// Them may start tunnels with me but not the other way around
+	policy, err := cert.SignPeerPolicy(&cert.PeerPolicy{
+		Version: 1,
+		Rules:   []cert.PeerPolicyRule{{From: "10.128.0.2/32", To: "10.128.0.1/32"}},
+	}, ca, cert.Curve_CURVE25519, caKey)
+	if err != nil {
+		panic(err)
+	}
+	policyPath := filepath.Join(t.TempDir(), "policy.pem")
+	if err := os.WriteFile(policyPath, policy, 0600); err != nil {
+		panic(err)
+	}
+
+	lhControl, lhVpnIpNet, lhUdpAddr, _ := newSimpleServer(ca, caKey, "lh", net.IP{10, 0, 0, 3}, m{
+		"lighthouse": m{"am_lighthouse": true, "peer_policy": policyPath},
+	})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"lighthouse":      m{"hosts": []string{lhVpnIpNet.IP.String()}},
+		"static_host_map": m{lhVpnIpNet.IP.String(): []string{lhUdpAddr.String()}},
+		"peer_policy":     m{"enabled": true},
+		"stats":           m{"lighthouse_metrics": true},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	r := router.NewR(t, lhControl, myControl, theirControl)
+	defer r.RenderFlow()
+
+	policyReplies := metrics.GetOrRegisterCounter("lighthouse.rx.PeerPolicyReply", nil)
+	before := policyReplies.Count()
+
+	lhControl.Start()
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Route until the policy has arrived from the lighthouse, the update ack may come first")
+	for policyReplies.Count() == before {
+		r.RouteForAllUntilAfterMsgTypeTo(myControl, header.LightHouse, 0)
+		for i := 0; i < 10 && policyReplies.Count() == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Log("The policy allows the tunnel when they start it")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p := r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	myControl.CloseTunnel(iputil.Ip2VpnIp(theirVpnIpNet.IP), true)
+	theirControl.CloseTunnel(iputil.Ip2VpnIp(myVpnIpNet.IP), true)
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	t.Log("And refuses it when I start it")
+	initiatorFailed := metrics.GetOrRegisterCounter("handshakes.initiator.failed.policy", nil)
+	failed := initiatorFailed.Count()
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteForAllUntilAfterMsgTypeTo(myControl, header.Handshake, header.HandshakeIXPSK0)
+	assert.Eventually(t, func() bool { return initiatorFailed.Count() == failed+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false))
+
+	r.RenderHostmaps("Final hostmaps", lhControl, myControl, theirControl)
+	lhControl.Stop()
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestDuplicateVpnIp(t *testing.T) {
+	testDuplicateVpnIp(t, "lowest_fingerprint")
+}
+
+func TestDuplicateVpnIpTakeNew(t *testing.T) {
+	testDuplicateVpnIp(t, "take_new")
+}
+
+func TestDuplicateVpnIpKeepExisting(t *testing.T) {
+	testDuplicateVpnIp(t, "keep_existing")
+}
+
+func testDuplicateVpnIp(t *testing.T, policy string) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"duplicate_vpn_ip": policy}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// The imposter has a certificate for their vpn ip under a different name
+	imposterCert, _, imposterKey, imposterPEM := newTestCert(ca, caKey, "imposter", time.Now(), time.Now().Add(5*time.Minute), theirVpnIpNet, nil, []string{})
+	imposterControl, _, _, _ := newSimpleServer(ca, caKey, "imposter", net.IP{10, 0, 0, 3}, m{"pki": m{"cert": string(imposterPEM), "key": string(imposterKey)}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	imposterControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, imposterControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	imposterControl.Start()
+
+	t.Log("Get a tunnel up with them")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	theirVpnIp := iputil.Ip2VpnIp(theirVpnIpNet.IP)
+	hi := myControl.GetHostInfoByVpnIp(theirVpnIp, false)
+	assert.NotNil(t, hi)
+
+	t.Log("The imposter handshakes with the same vpn ip")
+	duplicates := metrics.GetOrRegisterCounter("handshakes.duplicate_vpn_ip", nil)
+	before := duplicates.Count()
+	imposterControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from the imposter"))
+	r.RouteExitFunc(imposterControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return duplicates.Count() == before+1 }, time.Second, 10*time.Millisecond)
+
+	if policy == "lowest_fingerprint" {
+		theirFingerprint, _ := hi.Cert.Sha256Sum()
+		imposterFingerprint, _ := imposterCert.Sha256Sum()
+		if imposterFingerprint < theirFingerprint {
+			policy = "take_new"
+		} else {
+			policy = "keep_existing"
+		}
+	}
+
+	current := myControl.GetHostInfoByVpnIp(theirVpnIp, false)
+	if policy == "take_new" {
+		t.Log("The imposter replaces the tunnel")
+		assert.Equal(t, "imposter", current.Cert.Details.Name)
+		assert.NotEqual(t, hi.LocalIndex, current.LocalIndex)
+	} else {
+		t.Log("The existing tunnel is kept")
+		assert.Equal(t, "them", current.Cert.Details.Name)
+		assert.Equal(t, hi.LocalIndex, current.LocalIndex)
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	}
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, imposterControl)
+	myControl.Stop()
+	theirControl.Stop()
+	imposterControl.Stop()
+}
+
+func TestDuplicateVpnIpStable(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirCert, _, theirKey, theirPEM := newTestCert(ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), &net.IPNet{IP: net.IP{10, 128, 0, 2}, Mask: net.IPMask{255, 255, 255, 0}}, nil, []string{})
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"pki": m{"cert": string(theirPEM), "key": string(theirKey)}})
+	imposterCert, _, imposterKey, imposterPEM := newTestCert(ca, caKey, "imposter", time.Now(), time.Now().Add(5*time.Minute), theirVpnIpNet, nil, []string{})
+	imposterControl, _, _, _ := newSimpleServer(ca, caKey, "imposter", net.IP{10, 0, 0, 3}, m{"pki": m{"cert": string(imposterPEM), "key": string(imposterKey)}})
+
+	r := router.NewR(t, myControl, theirControl, imposterControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	imposterControl.Start()
+
+	// With the default policy the certificate with the lowest fingerprint wins
+	theirFingerprint, _ := theirCert.Sha256Sum()
+	imposterFingerprint, _ := imposterCert.Sha256Sum()
+	winner, loser := theirControl, imposterControl
+	winnerName := "them"
+	if imposterFingerprint < theirFingerprint {
+		winner, loser = imposterControl, theirControl
+		winnerName = "imposter"
+	}
+
+	theirVpnIp := iputil.Ip2VpnIp(theirVpnIpNet.IP)
+	myVpnIp := iputil.Ip2VpnIp(myVpnIpNet.IP)
+	duplicates := metrics.GetOrRegisterCounter("handshakes.duplicate_vpn_ip", nil)
+
+	// handshake drops the tunnel c has with us and starts a new one
+	handshake := func(c *nebula.Control, name string) {
+		c.CloseTunnel(myVpnIp, true)
+		c.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+		c.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from "+name))
+	}
+
+	t.Log("The loser gets a tunnel while it is the only node with the vpn ip")
+	handshake(loser, "the loser")
+	assertUdpPacket(t, []byte("Hi from the loser"), r.RouteForAllUntilTxTun(myControl), theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	t.Log("The winner takes over")
+	before := duplicates.Count()
+	handshake(winner, "the winner")
+	assertUdpPacket(t, []byte("Hi from the winner"), r.RouteForAllUntilTxTun(myControl), theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+	assert.Greater(t, duplicates.Count(), before)
+
+	t.Log("Both nodes keep handshaking with the same vpn ip, in either order")
+	for i := 0; i < 3; i++ {
+		for _, first := range []bool{true, false} {
+			if first {
+				handshake(loser, "the loser")
+				before := duplicates.Count()
+				r.RouteExitFunc(loser, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+				assert.Eventually(t, func() bool { return duplicates.Count() > before }, time.Second, 10*time.Millisecond)
+			} else {
+				handshake(winner, "the winner")
+				assertUdpPacket(t, []byte("Hi from the winner"), r.RouteForAllUntilTxTun(myControl), theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+			}
+
+			t.Log("The winner keeps the tunnel")
+			current := myControl.GetHostInfoByVpnIp(theirVpnIp, false)
+			if assert.NotNil(t, current) {
+				assert.Equal(t, winnerName, current.Cert.Details.Name)
+			}
+		}
+	}
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, imposterControl)
+	myControl.Stop()
+	theirControl.Stop()
+	imposterControl.Stop()
+}
+
+func TestIntermediateCA(t *testing.T) {
+	ca, _, caKey, caPem := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	intermediate, _, intermediateKey, intermediatePem := newTestIntermediateCaCert(ca, caKey, time.Now(), time.Now().Add(10*time.Minute))
+	signedByIntermediate := func(name string, udpIp net.IP, bundle []byte) m {
+		vpnIpNet := &net.IPNet{IP: net.IP{10, 128, udpIp[2], udpIp[3]}, Mask: net.IPMask{255, 255, 255, 0}}
+		_, _, key, crt := newTestCert(intermediate, intermediateKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, nil)
+		return m{"pki": m{"ca": string(bundle), "cert": string(crt), "key": string(key)}}
+	}
+
+	// Only the peers signed by the intermediate have it in their bundle, I must learn it from the handshake
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, signedByIntermediate("them", net.IP{10, 0, 0, 2}, append(caPem, intermediatePem...)))
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, signedByIntermediate("other", net.IP{10, 0, 0, 3}, caPem))
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("A peer that sends its intermediate gets a tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	t.Log("A peer without its intermediate can not be verified")
+	failedCert := metrics.GetOrRegisterCounter("handshakes.initiator.failed.cert", nil)
+	before := failedCert.Count()
+	myControl.InjectTunUDPPacket(otherVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteExitFunc(myControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	r.RouteExitFunc(otherControl, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return failedCert.Count() == before+1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(otherVpnIpNet.IP), false))
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestCertRollover(t *testing.T) {
+	oldCa, _, oldCaKey, oldCaPem := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	newCa, _, newCaKey, newCaPem := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+
+	// I hold a cert from both CAs while the new one rolls out, the new one is primary
+	myVpnIpNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	oldCrt, _, oldKey, oldPem := newTestCert(oldCa, oldCaKey, "me", time.Now(), time.Now().Add(5*time.Minute), myVpnIpNet, nil, nil)
+	newCrt, _, newKey, newPem := newTestCert(newCa, newCaKey, "me", time.Now(), time.Now().Add(5*time.Minute), myVpnIpNet, nil, nil)
+	myControl, _, myUdpAddr, _ := newSimpleServer(oldCa, oldCaKey, "me", net.IP{10, 0, 0, 1}, m{"pki": m{
+		"ca": string(append(oldCaPem, newCaPem...)),
+		"certs": []m{
+			{"cert": string(oldPem), "key": string(oldKey)},
+			{"cert": string(newPem), "key": string(newKey), "primary": true},
+		},
+	}})
+
+	// They only trust the old CA, other only the new one
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(oldCa, oldCaKey, "them", net.IP{10, 0, 0, 2}, nil)
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(newCa, newCaKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("A peer that does not trust the new CA yet gets my old cert when it handshakes with me")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p := r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	hi := theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, oldCrt.Signature, hi.Cert.Signature)
+
+	t.Log("Handshakes I initiate use the primary")
+	myControl.InjectTunUDPPacket(otherVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p = r.RouteForAllUntilTxTun(otherControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, otherVpnIpNet.IP, 80, 80)
+	hi = otherControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, newCrt.Signature, hi.Cert.Signature)
+
+	t.Log("Only loaded certs can be promoted")
+	assert.EqualError(t, myControl.PromoteCert("nope"), "no certificate with fingerprint nope is loaded")
+	oldFingerprint, _ := oldCrt.Sha256Sum()
+	assert.NoError(t, myControl.PromoteCert(oldFingerprint))
+
+	t.Log("Both tunnels stay up")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertTunnel(t, myVpnIpNet.IP, otherVpnIpNet.IP, myControl, otherControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestRelays_maintenance(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other  ", net.IP{10, 0, 0, 129}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	// Teach me how to get to the relays and that they can be reached via the first relay
+	myControl.InjectLightHouseAddr(relayVpnIpNet.IP, relayUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relayVpnIpNet.IP})
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relayControl, otherControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relayControl.Start()
+	otherControl.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, []iputil.VpnIp{iputil.Ip2VpnIp(relayVpnIpNet.IP)}, hi.CurrentRelaysToMe)
+
+	t.Log("Put the relay in maintenance, I should move to the other relay")
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relayVpnIpNet.IP, otherVpnIpNet.IP})
+	assert.NoError(t, relayControl.StartMaintenance(time.Minute))
+
+	for i := 0; ; i++ {
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+		hi = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+		if len(hi.CurrentRelaysToMe) == 1 && hi.CurrentRelaysToMe[0] == iputil.Ip2VpnIp(otherVpnIpNet.IP) {
+			break
+		}
+
+		if i > 20 {
+			t.Fatal("Tunnel never moved off of the relay in maintenance")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.True(t, relayControl.EndMaintenance())
+	assert.False(t, relayControl.EndMaintenance())
+	r.RenderHostmaps("Final hostmaps", myControl, relayControl, otherControl, theirControl)
+
+	myControl.Stop()
+	relayControl.Stop()
+	otherControl.Stop()
+	theirControl.Stop()
+}
+
 func TestStage1RaceRelays(t *testing.T) {
 	//NOTE: this is a race between me and relay resulting in a full tunnel from me to them via relay
 	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
@@ -908,6 +1557,196 @@ func TestRehandshakingLoser(t *testing.T) {
 	theirControl.Stop()
 }
 
+func TestRehandshakingPreviousKey(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 2}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 1}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel between me and them")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	oldIndex := theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false).LocalIndex
+
+	r.Log("Hold on to a packet sent with the first tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from the old key"))
+	late := myControl.GetFromUDP(true)
+
+	r.Log("Rehandshake and have them drop the first tunnel")
+	myControl.ReHandshake(iputil.Ip2VpnIp(theirVpnIpNet.IP))
+	r.RouteForAllUntilAfterMsgTypeTo(myControl, header.Handshake, header.HandshakeIXPSK0)
+	theirHostmap := theirControl.GetHostmap()
+	assert.Len(t, theirHostmap.Indexes, 2)
+	theirHostmap.DeleteHostInfo(theirHostmap.QueryIndex(oldIndex))
+
+	r.Log("The late packet still decrypts with the previous key")
+	r.InjectUDPPacket(myControl, theirControl, late)
+	assertUdpPacket(t, []byte("Hi from the old key"), theirControl.GetFromTun(true), myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	// The first tunnel stays gone
+	assert.Len(t, theirHostmap.Indexes, 1)
+	assert.Nil(t, theirHostmap.QueryIndex(oldIndex))
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRenumber(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	lhControl, lhVpnIpNet, lhUdpAddr, _ := newSimpleServer(ca, caKey, "lh", net.IP{10, 0, 0, 1}, m{
+		"lighthouse": m{"am_lighthouse": true},
+	})
+	// Only the router knows our addresses, advertise the one it routes for us and nothing from the local interfaces
+	withLighthouse := func(udpIp net.IP) m {
+		return m{
+			"lighthouse": m{
+				"hosts":            []string{lhVpnIpNet.IP.String()},
+				"advertise_addrs":  []string{fmt.Sprintf("%s:4242", udpIp)},
+				"local_allow_list": m{"0.0.0.0/0": false, "::/0": false},
+			},
+			"static_host_map": m{lhVpnIpNet.IP.String(): []string{lhUdpAddr.String()}},
+		}
+	}
+	myOverrides := withLighthouse(net.IP{10, 0, 0, 2})
+	myOverrides["pki"] = m{"allow_renumber": true}
+	myControl, myVpnIpNet, _, myConfig := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 2}, myOverrides)
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 3}, withLighthouse(net.IP{10, 0, 0, 3}))
+	otherControl, otherVpnIpNet, _, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 4}, withLighthouse(net.IP{10, 0, 0, 4}))
+
+	r := router.NewR(t, lhControl, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	lhControl.Start()
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("Stand up a tunnel between me and them through the lighthouse")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	t.Log("Load a certificate with a new vpn ip")
+	myNewVpnIpNet := &net.IPNet{IP: net.IP{10, 128, 0, 5}, Mask: myVpnIpNet.Mask}
+	_, _, myNewKey, myNewPEM := newTestCert(ca, caKey, "me", time.Now(), time.Now().Add(5*time.Minute), myNewVpnIpNet, nil, []string{})
+	caB, err := ca.MarshalToPEM()
+	if err != nil {
+		panic(err)
+	}
+
+	myConfig.Settings["pki"] = m{
+		"ca":             string(caB),
+		"cert":           string(myNewPEM),
+		"key":            string(myNewKey),
+		"allow_renumber": true,
+	}
+	rc, err := yaml.Marshal(myConfig.Settings)
+	assert.NoError(t, err)
+	myConfig.ReloadConfigString(string(rc))
+	assert.Equal(t, iputil.Ip2VpnIp(myNewVpnIpNet.IP), myControl.GetVpnIp())
+
+	t.Log("Traffic from the tun device uses the new vpn ip, they learn it from the re-handshake")
+	assertTunnel(t, myNewVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	c := theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myNewVpnIpNet.IP), false)
+	if assert.NotNil(t, c) {
+		assert.Equal(t, myNewVpnIpNet.IP.String(), c.Cert.Details.Ips[0].IP.String())
+	}
+
+	t.Log("A node that never talked to me finds the new vpn ip through the lighthouse")
+	otherControl.InjectTunUDPPacket(myNewVpnIpNet.IP, 80, 80, []byte("Hi from other"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from other"), p, otherVpnIpNet.IP, myNewVpnIpNet.IP, 80, 80)
+
+	t.Log("The lighthouse forgot the old vpn ip")
+	assert.Nil(t, lhControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	r.RenderHostmaps("Final hostmaps", lhControl, myControl, theirControl, otherControl)
+	lhControl.Stop()
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestAdvertiseOrder(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	lhControl, lhVpnIpNet, lhUdpAddr, _ := newSimpleServer(ca, caKey, "lh", net.IP{10, 0, 0, 1}, m{
+		"lighthouse": m{"am_lighthouse": true},
+		"stats":      m{"lighthouse_metrics": true},
+	})
+	// I am reachable on three addresses and want to be tried on 192.168.1.2 first, then on the address the lighthouse
+	// sees. Without the order a public address would be tried first.
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 2}, m{
+		"lighthouse": m{
+			"hosts":            []string{lhVpnIpNet.IP.String()},
+			"advertise_addrs":  []string{"10.0.0.2:4242", "1.2.3.4:4242", "192.168.1.2:4242"},
+			"advertise_order":  []string{"192.168.0.0/16", "10.0.0.0/8"},
+			"local_allow_list": m{"0.0.0.0/0": false, "::/0": false},
+		},
+		"static_host_map": m{lhVpnIpNet.IP.String(): []string{lhUdpAddr.String()}},
+	})
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 3}, m{
+		"lighthouse":      m{"hosts": []string{lhVpnIpNet.IP.String()}},
+		"static_host_map": m{lhVpnIpNet.IP.String(): []string{lhUdpAddr.String()}},
+	})
+
+	r := router.NewR(t, lhControl, myControl, theirControl)
+	r.AddRoute(net.IP{1, 2, 3, 4}, 4242, myControl)
+	r.AddRoute(net.IP{192, 168, 1, 2}, 4242, myControl)
+	defer r.RenderFlow()
+
+	updates := metrics.GetOrRegisterCounter("lighthouse.rx.HostUpdateNotification", nil)
+	before := updates.Count()
+
+	lhControl.Start()
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Route until the lighthouse has my addresses")
+	for updates.Count() == before {
+		r.RouteForAllUntilAfterMsgTypeTo(lhControl, header.LightHouse, 0)
+		for i := 0; i < 10 && updates.Count() == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Log("They find me through the lighthouse")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p := r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	t.Log("They try my addresses in the order I advertised them")
+	hi := theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	if assert.NotNil(t, hi) {
+		assert.Equal(t, []string{"192.168.1.2:4242", "10.0.0.2:4242", "1.2.3.4:4242"}, udpAddrStrings(hi.RemoteAddrs))
+	}
+
+	r.RenderHostmaps("Final hostmaps", lhControl, myControl, theirControl)
+	lhControl.Stop()
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func udpAddrStrings(addrs []*udp.Addr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
+
 func TestRaceRegression(t *testing.T) {
 	// This test forces stage 1, stage 2, stage 1 to be received by me from them
 	// We had a bug where we were not finding the duplicate handshake and responding to the final stage 1 which
@@ -0,0 +1,694 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentedPacket(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"tun": m{"fragment": true, "fragment_size": 500}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"tun": m{"fragment": true, "fragment_size": 500}})
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up the tunnel with small packets")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	reassembled := metrics.GetOrRegisterCounter("fragments.reassembled", nil)
+	before := reassembled.Count()
+
+	t.Log("Send a packet that must be split into multiple fragments")
+	payload := bytes.Repeat([]byte("Hi from me "), 200)
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, payload)
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, payload, p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	t.Log("And a large one back")
+	payload = bytes.Repeat([]byte("Hi from them "), 300)
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, payload)
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, payload, p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	assert.Equal(t, before+2, reassembled.Count())
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestCompressedPacket(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"compression": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"compression": true}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up the tunnels with small packets")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertTunnel(t, myVpnIpNet.IP, otherVpnIpNet.IP, myControl, otherControl, r)
+
+	ratio := metrics.GetOrRegisterHistogram("compression.ratio", nil, metrics.NewExpDecaySample(1028, 0.015))
+	before := ratio.Count()
+
+	t.Log("Send a large compressible packet both ways to a peer that negotiated compression")
+	payload := bytes.Repeat([]byte("Hi from me "), 200)
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, payload)
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, payload, p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, payload)
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, payload, p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+	assert.Equal(t, before+2, ratio.Count())
+
+	t.Log("Peers that did not enable compression get uncompressed packets")
+	myControl.InjectTunUDPPacket(otherVpnIpNet.IP, 80, 80, payload)
+	p = r.RouteForAllUntilTxTun(otherControl)
+	assertUdpPacket(t, payload, p, myVpnIpNet.IP, otherVpnIpNet.IP, 80, 80)
+	assert.Equal(t, before+2, ratio.Count())
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakeMetadata(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"metadata": m{"dc": "us-east", "role": "db"}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"metadata": m{"dc": "us-west"}}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertTunnel(t, myVpnIpNet.IP, otherVpnIpNet.IP, myControl, otherControl, r)
+
+	t.Log("Both ends of the tunnel have the metadata of the other")
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, map[string]string{"dc": "us-west"}, hi.Metadata)
+	hi = theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, map[string]string{"dc": "us-east", "role": "db"}, hi.Metadata)
+
+	t.Log("A peer without metadata configured sends none")
+	hi = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(otherVpnIpNet.IP), false)
+	assert.Nil(t, hi.Metadata)
+	hi = otherControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, map[string]string{"dc": "us-east", "role": "db"}, hi.Metadata)
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakePadding(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"padding": m{"min": 200, "max": 200}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"padding": m{"min": 0, "max": 64}}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	t.Log("Our stage 0 packet is padded")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	padded := myControl.GetFromUDP(true)
+	otherControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from other"))
+	plain := otherControl.GetFromUDP(true)
+	// The certificates differ by a few bytes of name
+	assert.Greater(t, len(padded.Data), len(plain.Data)+190)
+
+	t.Log("Padded handshakes complete with a padded peer and a peer without padding")
+	theirControl.InjectUDPPacket(padded)
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	myControl.InjectUDPPacket(plain)
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from other"), p, otherVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertTunnel(t, myVpnIpNet.IP, otherVpnIpNet.IP, myControl, otherControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakeMetrics(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	counter := func(name string) int64 {
+		return metrics.GetOrRegisterCounter(name, nil).Count()
+	}
+	names := []string{
+		"handshakes.initiator.stage1.sent",
+		"handshakes.initiator.stage2.received",
+		"handshakes.initiator.completed",
+		"handshakes.initiator.failed.decrypt",
+		"handshakes.responder.stage1.received",
+		"handshakes.responder.stage2.sent",
+		"handshakes.responder.completed",
+	}
+	before := map[string]int64{}
+	for _, n := range names {
+		before[n] = counter(n)
+	}
+
+	t.Log("Send a udp packet through to begin standing up the tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+
+	t.Log("Have them consume my stage 1 packet. They have a tunnel now")
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+
+	t.Log("I consume a garbage stage 2 packet and then the real one")
+	stage2Packet := theirControl.GetFromUDP(true)
+	badPacket := stage2Packet.Copy()
+	badPacket.Data = badPacket.Data[:len(badPacket.Data)-header.Len]
+	myControl.InjectUDPPacket(badPacket)
+	myControl.InjectUDPPacket(stage2Packet)
+
+	t.Log("Wait until we see my cached packet come through")
+	myControl.WaitForType(1, 0, theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	// Retries may have sent more than one stage 1 before we got around to delivering it
+	assert.GreaterOrEqual(t, counter("handshakes.initiator.stage1.sent"), before["handshakes.initiator.stage1.sent"]+1)
+	assert.Equal(t, before["handshakes.initiator.stage2.received"]+2, counter("handshakes.initiator.stage2.received"))
+	assert.Equal(t, before["handshakes.initiator.failed.decrypt"]+1, counter("handshakes.initiator.failed.decrypt"))
+	assert.Equal(t, before["handshakes.initiator.completed"]+1, counter("handshakes.initiator.completed"))
+	assert.Equal(t, before["handshakes.responder.stage1.received"]+1, counter("handshakes.responder.stage1.received"))
+	assert.Equal(t, before["handshakes.responder.stage2.sent"]+1, counter("handshakes.responder.stage2.sent"))
+	assert.Equal(t, before["handshakes.responder.completed"]+1, counter("handshakes.responder.completed"))
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+// packetCounter is an example PacketInspector plugin, it counts the packets for each peer and drops udp packets to
+// port 81
+type packetCounter struct {
+	sync.Mutex
+	in, out map[iputil.VpnIp]int
+}
+
+func (pc *packetCounter) inspect(vpnIp iputil.VpnIp, incoming bool, packet []byte) bool {
+	pc.Lock()
+	if incoming {
+		pc.in[vpnIp]++
+	} else {
+		pc.out[vpnIp]++
+	}
+	pc.Unlock()
+
+	ihl := int(packet[0]&0x0f) << 2
+	return packet[9] != 17 || len(packet) < ihl+4 || binary.BigEndian.Uint16(packet[ihl+2:ihl+4]) != 81
+}
+
+func (pc *packetCounter) counts(vpnIp net.IP) (in, out int) {
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.in[iputil.Ip2VpnIp(vpnIp)], pc.out[iputil.Ip2VpnIp(vpnIp)]
+}
+
+func TestPacketInspector(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	pc := &packetCounter{in: map[iputil.VpnIp]int{}, out: map[iputil.VpnIp]int{}}
+	myControl.SetPacketInspector(pc.inspect)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up the tunnel, the inspector sees a packet each way")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	in, out := pc.counts(theirVpnIpNet.IP)
+	assert.Equal(t, 1, in)
+	assert.Equal(t, 1, out)
+
+	t.Log("Packets the inspector refuses never make it out of the tunnel")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 81, 80, []byte("Dropped"))
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p := r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 81, 80, []byte("Dropped"))
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p = r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	in, out = pc.counts(theirVpnIpNet.IP)
+	assert.Equal(t, 3, in)
+	assert.Equal(t, 3, out)
+
+	t.Log("Removing the inspector lets everything through again")
+	myControl.SetPacketInspector(nil)
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 81, 80, []byte("Not dropped"))
+	p = r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Not dropped"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 81)
+
+	in, out = pc.counts(theirVpnIpNet.IP)
+	assert.Equal(t, 3, in)
+	assert.Equal(t, 3, out)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPingAll(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	otherCa, _, otherCaKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, _, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{
+		"relay": m{"use_relays": true},
+		// A host we will never complete a handshake with since it has a cert from another ca
+		"static_host_map": m{"10.128.0.3": []string{"10.0.0.3:4242"}},
+	})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+	deadControl, deadVpnIpNet, _, _ := newSimpleServer(otherCa, otherCaKey, "dead   ", net.IP{10, 0, 0, 3}, nil)
+
+	myControl.InjectLightHouseAddr(relayVpnIpNet.IP, relayUdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relayVpnIpNet.IP})
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relayControl, theirControl, deadControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+	deadControl.Start()
+
+	t.Log("Stand up a tunnel to them through the relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteForAllUntilTxTun(theirControl)
+
+	results := make(chan []nebula.PingResult)
+	go func() {
+		results <- myControl.PingAll(time.Second, 2)
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.RouteForAllExitFunc(func(*udp.Packet, *nebula.Control) router.ExitType {
+		select {
+		case <-done:
+			return router.ExitNow
+		default:
+			return router.KeepRouting
+		}
+	})
+
+	res := <-results
+	assert.Len(t, res, 3)
+	for _, p := range res {
+		switch p.VpnIp {
+		case iputil.Ip2VpnIp(relayVpnIpNet.IP):
+			assert.Equal(t, nebula.PingOk, p.Status)
+			assert.NotZero(t, p.Rtt)
+		case iputil.Ip2VpnIp(theirVpnIpNet.IP):
+			assert.Equal(t, nebula.PingRelayed, p.Status)
+			assert.NotZero(t, p.Rtt)
+		case iputil.Ip2VpnIp(deadVpnIpNet.IP):
+			assert.Equal(t, nebula.PingFailed, p.Status)
+			assert.Zero(t, p.Rtt)
+		default:
+			t.Errorf("Unexpected ping result for %s", p.VpnIp)
+		}
+	}
+
+	myControl.Stop()
+	relayControl.Stop()
+	theirControl.Stop()
+	deadControl.Stop()
+}
+
+func TestPingPath(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Both of us are multi-homed, give each a second address
+	myOtherIp := net.IP{10, 0, 1, 1}
+	theirOtherAddr := udp.NewAddr(net.IP{10, 0, 1, 2}, uint16(theirUdpAddr.Port))
+	r.AddRoute(myOtherIp, uint16(myUdpAddr.Port), myControl)
+	r.AddRoute(theirOtherAddr.IP, theirOtherAddr.Port, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel over the primary addresses")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteForAllUntilTxTun(theirControl)
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	t.Log("Ping them over the second addresses")
+	results := make(chan nebula.PingResult)
+	go func() {
+		results <- myControl.Ping(iputil.Ip2VpnIp(theirVpnIpNet.IP), theirOtherAddr, myOtherIp, time.Second)
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	sawPath := make(chan struct{}, 1)
+	go r.RouteForAllExitFunc(func(p *udp.Packet, receiver *nebula.Control) router.ExitType {
+		if receiver == theirControl && p.FromIp.Equal(myOtherIp) && p.ToIp.Equal(theirOtherAddr.IP) {
+			select {
+			case sawPath <- struct{}{}:
+			default:
+			}
+		}
+
+		select {
+		case <-done:
+			return router.ExitNow
+		default:
+			return router.KeepRouting
+		}
+	})
+
+	res := <-results
+	assert.Equal(t, nebula.PingOk, res.Status)
+	assert.NotZero(t, res.Rtt)
+	assert.Equal(t, theirOtherAddr, res.Remote)
+	assert.True(t, myOtherIp.Equal(res.Local))
+
+	select {
+	case <-sawPath:
+	default:
+		t.Error("The ping did not take the requested path")
+	}
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRouteTagMetrics(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"tun": m{"unsafe_routes": []m{
+		{"route": "192.168.1.0/24", "via": "10.128.0.2", "tag": "office"},
+		{"route": "192.168.2.0/24", "via": "10.128.0.2", "tag": "office"},
+		{"route": "192.168.3.0/24", "via": "10.128.0.2", "tag": "cloud"},
+		{"route": "192.168.4.0/24", "via": "10.128.0.2"},
+	}}})
+
+	// Their certificate must cover the unsafe networks or our firewall drops the packets
+	_, unsafeNet, _ := net.ParseCIDR("192.168.0.0/16")
+	theirVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 2}, Mask: net.IPMask{255, 255, 255, 0}}
+	_, _, theirKey, theirPEM := newTestCert(ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), theirVpnNet, []*net.IPNet{unsafeNet}, []string{})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"pki": m{"cert": string(theirPEM), "key": string(theirKey)}})
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	counter := func(name string) int64 {
+		return metrics.GetOrRegisterCounter(name, nil).Count()
+	}
+	officeBefore := counter("route_tags.office.tx.packets")
+	cloudBefore := counter("route_tags.cloud.tx.packets")
+	cloudBytesBefore := counter("route_tags.cloud.tx.bytes")
+
+	t.Log("Send through both office routes, the cloud route and the untagged route")
+	for _, ip := range []net.IP{{192, 168, 1, 5}, {192, 168, 2, 5}, {192, 168, 3, 5}, {192, 168, 4, 5}} {
+		myControl.InjectTunUDPPacket(ip, 80, 80, []byte("Hi from me"))
+		p := myControl.GetFromUDP(true)
+		assert.Equal(t, theirUdpAddr.IP.String(), p.ToIp.String())
+	}
+
+	// The counters are bumped once the packet is sent
+	assert.Eventually(t, func() bool {
+		return counter("route_tags.office.tx.packets") == officeBefore+2 && counter("route_tags.cloud.tx.packets") == cloudBefore+1
+	}, time.Second, 10*time.Millisecond)
+	// A udp packet with a 10 byte payload is 38 bytes
+	assert.Equal(t, cloudBytesBefore+38, counter("route_tags.cloud.tx.bytes"))
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestUnsafeRouteOnUnreachable(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"handshakes": m{"try_interval": "20ms", "retries": 3},
+		"tun": m{"unsafe_routes": []m{
+			{"route": "192.168.0.0/16", "via": "10.128.0.2"},
+			// Nobody is at 10.128.0.3
+			{"route": "192.168.1.0/24", "via": "10.128.0.3"},
+			{"route": "192.168.2.0/24", "via": "10.128.0.3", "on_unreachable": "reject"},
+			{"route": "192.168.3.0/24", "via": "10.128.0.3", "on_unreachable": "next"},
+		}},
+	})
+
+	// Their certificate must cover the unsafe networks or our firewall drops the packets
+	_, unsafeNet, _ := net.ParseCIDR("192.168.0.0/16")
+	theirVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 2}, Mask: net.IPMask{255, 255, 255, 0}}
+	_, _, theirKey, theirPEM := newTestCert(ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), theirVpnNet, []*net.IPNet{unsafeNet}, []string{})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"pki": m{"cert": string(theirPEM), "key": string(theirKey)}})
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	t.Log("Let the handshake with the missing via time out")
+	timedOut := metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil)
+	timedOutBefore := timedOut.Count()
+	myControl.InjectTunUDPPacket(net.IP{192, 168, 1, 5}, 80, 80, []byte("Hi from me"))
+	assert.Eventually(t, func() bool {
+		return timedOut.Count() > timedOutBefore
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Log("reject answers with a host unreachable from our vpn ip")
+	myControl.InjectTunUDPPacket(net.IP{192, 168, 2, 5}, 80, 80, []byte("Hi from me"))
+	p := gopacket.NewPacket(myControl.GetFromTun(true), layers.LayerTypeIPv4, gopacket.Lazy)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	assert.Equal(t, myVpnIpNet.IP.To4(), ip.SrcIP.To4())
+	assert.Equal(t, myVpnIpNet.IP.To4(), ip.DstIP.To4())
+	icmp := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	assert.Equal(t, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost), icmp.TypeCode)
+
+	t.Log("next sends the packet over the less specific route to them")
+	myControl.InjectTunUDPPacket(net.IP{192, 168, 3, 5}, 80, 80, []byte("Hi from me"))
+	assert.Equal(t, theirUdpAddr.IP.String(), myControl.GetFromUDP(true).ToIp.String())
+
+	t.Log("drop does not answer")
+	myControl.InjectTunUDPPacket(net.IP{192, 168, 1, 5}, 80, 80, []byte("Hi from me"))
+	select {
+	case p := <-myControl.GetTunTxChan():
+		t.Errorf("Unexpected packet on the tun: %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestSubscribeHostMapEvents(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	events, unsubscribe := myControl.SubscribeHostMapEvents(16)
+	defer unsubscribe()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, "up", e.Event)
+		assert.Equal(t, theirVpnIpNet.IP.String(), e.VpnIp)
+		assert.Equal(t, "them", e.CertName)
+		assert.Equal(t, theirUdpAddr.String(), e.UnderlayAddr)
+		// assertTunnel has them send first
+		assert.Equal(t, "handshake completed as responder", e.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The tunnel coming up was not streamed")
+	}
+
+	t.Log("Stopping ends the stream")
+	myControl.Stop()
+	theirControl.Stop()
+	for e := range events {
+		assert.Equal(t, "down", e.Event)
+	}
+}
+
+func TestOverlayIsolation(t *testing.T) {
+	blueCa, _, blueCaKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	greenCa, _, greenCaKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+
+	// Both overlays use the same vpn network, every node runs in this process under its own overlay.name
+	newOverlay := func(ca *cert.NebulaCertificate, caKey []byte, name string, udpIp, vpnIp net.IP) (*nebula.Control, *net.UDPAddr, *config.C) {
+		vpnIpNet := &net.IPNet{IP: vpnIp, Mask: net.IPMask{255, 255, 255, 0}}
+		_, _, key, crt := newTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, []string{})
+		control, _, udpAddr, c := newSimpleServer(ca, caKey, name, udpIp, m{
+			"pki":     m{"cert": string(crt), "key": string(key)},
+			"overlay": m{"name": name},
+		})
+		return control, udpAddr, c
+	}
+
+	vpnA, vpnB, vpnC := net.IP{10, 128, 0, 1}, net.IP{10, 128, 0, 2}, net.IP{10, 128, 0, 3}
+	blueA, _, _ := newOverlay(blueCa, blueCaKey, "blue-a", net.IP{10, 0, 0, 1}, vpnA)
+	blueB, blueBUdpAddr, blueBConfig := newOverlay(blueCa, blueCaKey, "blue-b", net.IP{10, 0, 0, 2}, vpnB)
+	greenA, _, _ := newOverlay(greenCa, greenCaKey, "green-a", net.IP{10, 0, 0, 3}, vpnA)
+	greenB, greenBUdpAddr, greenBConfig := newOverlay(greenCa, greenCaKey, "green-b", net.IP{10, 0, 0, 4}, vpnB)
+	greenC, _, _ := newOverlay(greenCa, greenCaKey, "green-c", net.IP{10, 0, 0, 5}, vpnC)
+
+	blueA.InjectLightHouseAddr(vpnB, blueBUdpAddr)
+	greenA.InjectLightHouseAddr(vpnB, greenBUdpAddr)
+	// green-c is pointed at the blue node that holds the same vpn ip
+	greenC.InjectLightHouseAddr(vpnB, blueBUdpAddr)
+
+	r := router.NewR(t, blueA, blueB, greenA, greenB, greenC)
+	defer r.RenderFlow()
+
+	for _, c := range []*nebula.Control{blueA, blueB, greenA, greenB, greenC} {
+		c.Start()
+	}
+
+	// Overlays left running by other tests share the process, only look for the ones this test started
+	var names []string
+	for _, o := range blueA.ListOverlays() {
+		switch o.Name {
+		case "blue-a", "blue-b", "green-a", "green-b", "green-c":
+			names = append(names, o.Name)
+		}
+	}
+	assert.Equal(t, []string{"blue-a", "blue-b", "green-a", "green-b", "green-c"}, names)
+
+	t.Log("Each overlay tunnels between its own nodes with the same vpn ips")
+	blueA.InjectTunUDPPacket(vpnB, 80, 80, []byte("Hi from blue"))
+	assertUdpPacket(t, []byte("Hi from blue"), r.RouteForAllUntilTxTun(blueB), vpnA, vpnB, 80, 80)
+	greenA.InjectTunUDPPacket(vpnB, 80, 80, []byte("Hi from green"))
+	assertUdpPacket(t, []byte("Hi from green"), r.RouteForAllUntilTxTun(greenB), vpnA, vpnB, 80, 80)
+	assertTunnel(t, vpnA, vpnB, blueA, blueB, r)
+	assertTunnel(t, vpnA, vpnB, greenA, greenB, r)
+
+	t.Log("A node of the other overlay is refused")
+	blueFailed := metrics.GetOrRegisterCounter("handshakes.responder.failed.cert", util.MetricsRegistry(blueBConfig))
+	greenFailed := metrics.GetOrRegisterCounter("handshakes.responder.failed.cert", util.MetricsRegistry(greenBConfig))
+	greenC.InjectTunUDPPacket(vpnB, 80, 80, []byte("Hi from green-c"))
+	r.RouteExitFunc(greenC, func(*udp.Packet, *nebula.Control) router.ExitType { return router.RouteAndExit })
+	assert.Eventually(t, func() bool { return blueFailed.Count() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), greenFailed.Count())
+	assert.Nil(t, blueB.GetHostInfoByVpnIp(iputil.Ip2VpnIp(vpnC), false))
+	assert.Nil(t, greenB.GetHostInfoByVpnIp(iputil.Ip2VpnIp(vpnC), false))
+
+	r.RenderHostmaps("Final hostmaps", blueA, blueB, greenA, greenB, greenC)
+	for _, c := range []*nebula.Control{blueA, blueB, greenA, greenB, greenC} {
+		c.Stop()
+	}
+}
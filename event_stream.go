@@ -0,0 +1,133 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/iputil"
+)
+
+const (
+	// tunnelEventOverflow is the last event a subscriber that fell too far behind receives, the events it missed are
+	// gone and it has to subscribe again
+	tunnelEventOverflow = "overflow"
+)
+
+// eventStream fans host map changes out to subscribers: the first tunnel to a peer coming up, the last one going down,
+// a tunnel moving to another underlay address and a tunnel losing a relay. Publishing never blocks, a subscriber that
+// can not keep up is sent an overflow event and dropped.
+type eventStream struct {
+	sync.Mutex
+	subscribers map[chan TunnelEvent]struct{}
+	closed      bool
+
+	metricSubscribers metrics.Gauge
+	metricOverflows   metrics.Counter
+}
+
+func newEventStream(registry metrics.Registry) *eventStream {
+	return &eventStream{
+		subscribers:       map[chan TunnelEvent]struct{}{},
+		metricSubscribers: metrics.GetOrRegisterGauge("events.stream.subscribers", registry),
+		metricOverflows:   metrics.GetOrRegisterCounter("events.stream.overflows", registry),
+	}
+}
+
+// subscribe returns a channel that receives every event published from now on. It is closed by unsubscribe, by close,
+// or after an overflow event once more than buffer events are waiting. buffer must be at least 2.
+func (s *eventStream) subscribe(buffer int) chan TunnelEvent {
+	if buffer < 2 {
+		buffer = 2
+	}
+
+	c := make(chan TunnelEvent, buffer)
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		close(c)
+		return c
+	}
+
+	s.subscribers[c] = struct{}{}
+	s.metricSubscribers.Update(int64(len(s.subscribers)))
+	return c
+}
+
+func (s *eventStream) unsubscribe(c chan TunnelEvent) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.subscribers[c]; ok {
+		s.unlockedRemove(c)
+	}
+}
+
+// close ends every subscription, nothing can subscribe afterwards
+func (s *eventStream) close() {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.subscribers {
+		s.unlockedRemove(c)
+	}
+	s.closed = true
+}
+
+func (s *eventStream) unlockedRemove(c chan TunnelEvent) {
+	delete(s.subscribers, c)
+	close(c)
+	s.metricSubscribers.Update(int64(len(s.subscribers)))
+}
+
+func (s *eventStream) publish(e TunnelEvent) {
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.subscribers {
+		// Only publish sends and it holds the lock, the last free slot is always there for the overflow event
+		if len(c) < cap(c)-1 {
+			c <- e
+			continue
+		}
+
+		c <- TunnelEvent{Event: tunnelEventOverflow, Time: time.Now()}
+		s.unlockedRemove(c)
+		s.metricOverflows.Inc(1)
+	}
+}
+
+// tunnelUp streams an up event for the first tunnel to hostinfo.vpnIp
+func (s *eventStream) tunnelUp(hostinfo *HostInfo) {
+	if s == nil {
+		return
+	}
+
+	s.publish(newTunnelEvent(tunnelEventUp, hostinfo, tunnelUpReason(hostinfo)))
+}
+
+// tunnelDown streams a down event once the last tunnel to hostinfo.vpnIp is gone
+func (s *eventStream) tunnelDown(hostinfo *HostInfo, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.publish(newTunnelEvent(tunnelEventDown, hostinfo, reason))
+}
+
+// endpointChanged streams an endpoint event after the tunnel to hostinfo.vpnIp moved to another underlay address
+func (s *eventStream) endpointChanged(hostinfo *HostInfo, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.publish(newTunnelEvent(tunnelEventEndpoint, hostinfo, reason))
+}
+
+// relayLost streams a relay_lost event when the tunnel to hostinfo.vpnIp can no longer use relay
+func (s *eventStream) relayLost(hostinfo *HostInfo, relay iputil.VpnIp, reason string) {
+	if s == nil {
+		return
+	}
+
+	e := newTunnelEvent(tunnelEventRelayLost, hostinfo, reason)
+	e.Relay = relay.String()
+	s.publish(e)
+}
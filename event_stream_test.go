@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStream(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hostMap := NewHostMap(l, nil, vpncidr, nil)
+	f := &Interface{
+		hostMap:     hostMap,
+		lightHouse:  newTestLighthouse(),
+		eventStream: newEventStream(nil),
+		l:           l,
+	}
+
+	events := f.eventStream.subscribe(8)
+	hostinfo := &HostInfo{
+		vpnIp:           iputil.Ip2VpnIp(net.ParseIP("172.1.1.2")),
+		localIndexId:    1,
+		remoteIndexId:   1,
+		remote:          udp.NewAddr(net.ParseIP("192.168.1.2"), 4242),
+		ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host2"}}},
+	}
+
+	t.Log("A subscriber hears about a tunnel being established")
+	hostMap.unlockedAddHostInfo(hostinfo, f)
+	require.Len(t, events, 1)
+	e := <-events
+	assert.Equal(t, tunnelEventUp, e.Event)
+	assert.Equal(t, "172.1.1.2", e.VpnIp)
+	assert.Equal(t, "host2", e.CertName)
+	assert.Equal(t, "192.168.1.2:4242", e.UnderlayAddr)
+	assert.Equal(t, "handshake completed as responder", e.Reason)
+
+	t.Log("Then about the tunnel moving and going down")
+	hostinfo.remote = udp.NewAddr(net.ParseIP("192.168.1.3"), 4242)
+	f.eventStream.endpointChanged(hostinfo, "roamed")
+	f.closeTunnel(hostinfo, "test")
+	require.Len(t, events, 2)
+	e = <-events
+	assert.Equal(t, tunnelEventEndpoint, e.Event)
+	assert.Equal(t, "192.168.1.3:4242", e.UnderlayAddr)
+	e = <-events
+	assert.Equal(t, tunnelEventDown, e.Event)
+	assert.Equal(t, "test", e.Reason)
+
+	t.Log("A relayed tunnel reports its relays instead of an underlay address")
+	relayed := &HostInfo{vpnIp: iputil.Ip2VpnIp(net.ParseIP("172.1.1.3")), relayState: RelayState{relays: map[iputil.VpnIp]struct{}{}}}
+	relayed.relayState.InsertRelayTo(iputil.Ip2VpnIp(net.ParseIP("172.1.1.4")))
+	f.eventStream.relayLost(relayed, iputil.Ip2VpnIp(net.ParseIP("172.1.1.5")), "gone")
+	e = <-events
+	assert.Equal(t, tunnelEventRelayLost, e.Event)
+	assert.Empty(t, e.UnderlayAddr)
+	assert.Equal(t, []string{"172.1.1.4"}, e.Relays)
+	assert.Equal(t, "172.1.1.5", e.Relay)
+
+	t.Log("Unsubscribing closes the channel")
+	f.eventStream.unsubscribe(events)
+	_, ok := <-events
+	assert.False(t, ok)
+	f.eventStream.unsubscribe(events)
+}
+
+func TestEventStream_overflow(t *testing.T) {
+	s := newEventStream(nil)
+	slow := s.subscribe(3)
+	fast := s.subscribe(16)
+
+	hostinfo := &HostInfo{vpnIp: iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))}
+	for i := 0; i < 5; i++ {
+		s.tunnelDown(hostinfo, "test")
+	}
+
+	// The slow subscriber gets what fit, then the overflow, then nothing
+	var got []string
+	for e := range slow {
+		got = append(got, e.Event)
+	}
+	assert.Equal(t, []string{tunnelEventDown, tunnelEventDown, tunnelEventOverflow}, got)
+	assert.Equal(t, int64(1), s.metricOverflows.Count())
+	assert.Len(t, fast, 5)
+
+	// Stopping ends every subscription and nothing can subscribe after
+	s.close()
+	assert.Len(t, fast, 5)
+	_, ok := <-s.subscribe(8)
+	assert.False(t, ok)
+
+	var nilStream *eventStream
+	nilStream.tunnelUp(hostinfo)
+}
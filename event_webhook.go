@@ -0,0 +1,204 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+const (
+	tunnelEventUp   = "up"
+	tunnelEventDown = "down"
+	// tunnelEventEndpoint and tunnelEventRelayLost are only streamed to host map event subscribers
+	tunnelEventEndpoint  = "endpoint"
+	tunnelEventRelayLost = "relay_lost"
+)
+
+// TunnelEvent is the body posted to events.webhook_url and a host map event streamed to subscribers
+type TunnelEvent struct {
+	Event        string `json:"event"`
+	VpnIp        string `json:"vpnIp"`
+	CertName     string `json:"certName"`
+	UnderlayAddr string `json:"underlayAddr"`
+	// Relays are the vpn ips of the relays the tunnel goes through when it has no underlay address
+	Relays []string `json:"relays,omitempty"`
+	// Relay is the vpn ip of the relay a relay_lost event is about
+	Relay  string    `json:"relay,omitempty"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// eventWebhook posts tunnel up and down events to events.webhook_url. Delivery is best effort, events are dropped when
+// the queue is full or every retry has failed so the data path never waits on the webhook.
+type eventWebhook struct {
+	url     string
+	client  *http.Client
+	queue   chan TunnelEvent
+	retries int
+	backoff time.Duration
+	l       *logrus.Logger
+
+	metricSent    metrics.Counter
+	metricFailed  metrics.Counter
+	metricDropped metrics.Counter
+}
+
+// newEventWebhookFromConfig returns nil if events.webhook_url is not set
+func newEventWebhookFromConfig(ctx context.Context, l *logrus.Logger, c *config.C) (*eventWebhook, error) {
+	rawURL := c.GetString("events.webhook_url", "")
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("events.webhook_url must be an http or https url: %s", rawURL)
+	}
+
+	queueLen := c.GetInt("events.webhook_queue", 1024)
+	if queueLen < 1 {
+		return nil, fmt.Errorf("events.webhook_queue must be at least 1: %v", queueLen)
+	}
+
+	registry := util.MetricsRegistry(c)
+	w := &eventWebhook{
+		url:           rawURL,
+		client:        &http.Client{Timeout: c.GetDuration("events.webhook_timeout", 5*time.Second)},
+		queue:         make(chan TunnelEvent, queueLen),
+		retries:       c.GetInt("events.webhook_retries", 3),
+		backoff:       time.Second,
+		l:             l,
+		metricSent:    metrics.GetOrRegisterCounter("events.webhook.sent", registry),
+		metricFailed:  metrics.GetOrRegisterCounter("events.webhook.failed", registry),
+		metricDropped: metrics.GetOrRegisterCounter("events.webhook.dropped", registry),
+	}
+
+	go w.run(ctx)
+	return w, nil
+}
+
+// tunnelUp queues an up event for the first tunnel to hostinfo.vpnIp
+func (w *eventWebhook) tunnelUp(hostinfo *HostInfo) {
+	if w == nil {
+		return
+	}
+
+	w.enqueue(newTunnelEvent(tunnelEventUp, hostinfo, tunnelUpReason(hostinfo)))
+}
+
+func tunnelUpReason(hostinfo *HostInfo) string {
+	if hostinfo.ConnectionState != nil && hostinfo.ConnectionState.initiator {
+		return "handshake completed as initiator"
+	}
+	return "handshake completed as responder"
+}
+
+// tunnelDown queues a down event once the last tunnel to hostinfo.vpnIp is gone
+func (w *eventWebhook) tunnelDown(hostinfo *HostInfo, reason string) {
+	if w == nil {
+		return
+	}
+
+	w.enqueue(newTunnelEvent(tunnelEventDown, hostinfo, reason))
+}
+
+func newTunnelEvent(event string, hostinfo *HostInfo, reason string) TunnelEvent {
+	e := TunnelEvent{
+		Event:  event,
+		VpnIp:  hostinfo.vpnIp.String(),
+		Reason: reason,
+		Time:   time.Now(),
+	}
+
+	if c := hostinfo.GetCert(); c != nil {
+		e.CertName = c.Details.Name
+	}
+
+	if remote := hostinfo.remote; remote != nil {
+		e.UnderlayAddr = remote.String()
+	} else {
+		for _, relay := range hostinfo.relayState.CopyRelayIps() {
+			e.Relays = append(e.Relays, relay.String())
+		}
+	}
+
+	return e
+}
+
+func (w *eventWebhook) enqueue(e TunnelEvent) {
+	select {
+	case w.queue <- e:
+	default:
+		w.metricDropped.Inc(1)
+	}
+}
+
+func (w *eventWebhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			w.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver posts e, retrying with a linear backoff until it is accepted or we run out of retries
+func (w *eventWebhook) deliver(ctx context.Context, e TunnelEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		w.l.WithError(err).Error("Failed to marshal tunnel event")
+		return
+	}
+
+	for try := 0; ; try++ {
+		err = w.post(ctx, b)
+		if err == nil {
+			w.metricSent.Inc(1)
+			return
+		}
+
+		if try >= w.retries {
+			w.metricFailed.Inc(1)
+			w.l.WithError(err).WithField("event", e.Event).WithField("vpnIp", e.VpnIp).
+				Warn("Failed to deliver tunnel event to events.webhook_url")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.backoff * time.Duration(try+1)):
+		}
+	}
+}
+
+func (w *eventWebhook) post(ctx context.Context, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", res.Status)
+	}
+
+	return nil
+}
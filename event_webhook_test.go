@@ -0,0 +1,122 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEventWebhookFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := newEventWebhookFromConfig(ctx, l, c)
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	// nil is safe to use
+	w.tunnelUp(&HostInfo{})
+	w.tunnelDown(&HostInfo{}, "test")
+
+	c.Settings["events"] = map[interface{}]interface{}{"webhook_url": "nope"}
+	_, err = newEventWebhookFromConfig(ctx, l, c)
+	assert.EqualError(t, err, "events.webhook_url must be an http or https url: nope")
+
+	c.Settings["events"] = map[interface{}]interface{}{"webhook_url": "http://127.0.0.1/events", "webhook_queue": 0}
+	_, err = newEventWebhookFromConfig(ctx, l, c)
+	assert.EqualError(t, err, "events.webhook_queue must be at least 1: 0")
+}
+
+func TestEventWebhook_deliver(t *testing.T) {
+	l := test.NewLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan TunnelEvent, 10)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		// Fail the first attempt to exercise the retry
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var e TunnelEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received <- e
+	}))
+	defer srv.Close()
+
+	c := config.NewC(l)
+	c.Settings["events"] = map[interface{}]interface{}{"webhook_url": srv.URL}
+	w, err := newEventWebhookFromConfig(ctx, l, c)
+	assert.NoError(t, err)
+	w.backoff = time.Millisecond
+
+	hostinfo := &HostInfo{
+		vpnIp:  iputil.Ip2VpnIp(net.ParseIP("10.1.1.2")),
+		remote: udp.NewAddr(net.ParseIP("192.168.1.2"), 4242),
+		ConnectionState: &ConnectionState{
+			initiator: true,
+			peerCert:  &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host2"}},
+		},
+	}
+
+	sent := w.metricSent.Count()
+	w.tunnelUp(hostinfo)
+	w.tunnelDown(hostinfo, "close tunnel received")
+
+	select {
+	case e := <-received:
+		assert.Equal(t, tunnelEventUp, e.Event)
+		assert.Equal(t, "10.1.1.2", e.VpnIp)
+		assert.Equal(t, "host2", e.CertName)
+		assert.Equal(t, "192.168.1.2:4242", e.UnderlayAddr)
+		assert.Equal(t, "handshake completed as initiator", e.Reason)
+		assert.WithinDuration(t, time.Now(), e.Time, time.Minute)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the up event was not delivered")
+	}
+
+	select {
+	case e := <-received:
+		assert.Equal(t, tunnelEventDown, e.Event)
+		assert.Equal(t, "close tunnel received", e.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the down event was not delivered")
+	}
+
+	assert.Equal(t, 3, attempts)
+	assert.Eventually(t, func() bool { return w.metricSent.Count() == sent+2 }, time.Second, time.Millisecond)
+}
+
+func TestEventWebhook_queueFull(t *testing.T) {
+	// Without a running delivery routine the queue fills and events are dropped instead of blocking
+	w := &eventWebhook{
+		queue:         make(chan TunnelEvent, 1),
+		metricDropped: metrics.NewCounter(),
+	}
+
+	w.tunnelDown(&HostInfo{}, "test")
+	w.tunnelDown(&HostInfo{}, "test")
+	assert.Len(t, w.queue, 1)
+	assert.Equal(t, int64(1), w.metricDropped.Count())
+}
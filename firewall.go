@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -8,9 +9,12 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -19,6 +23,9 @@ import (
 	"github.com/slackhq/nebula/cidr"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
 )
 
 const tcpACK = 0x10
@@ -28,6 +35,12 @@ type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error
 }
 
+// RemotePortFirewall is implemented by a FirewallInterface that can also match inbound packets on the underlay source
+// port of the peer, rules with remote_port are only accepted by one
+type RemotePortFirewall interface {
+	AddRemotePortRule(proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, remoteStartPort int32, remoteEndPort int32) error
+}
+
 type conn struct {
 	Expires time.Time // Time when this conntrack entry will expire
 	Sent    time.Time // If tcp rtt tracking is enabled this will be when Seq was last set
@@ -38,6 +51,13 @@ type conn struct {
 	// fields pack for free after the uint32 above
 	incoming     bool
 	rulesVersion uint16
+
+	// peer is the vpn ip of the tunnel that created this entry and created is when, for DumpConntrack
+	peer    iputil.VpnIp
+	created time.Time
+
+	// flow is only set while flow_export is enabled
+	flow *connFlow
 }
 
 // TODO: need conntrack max tracked connections handling
@@ -47,6 +67,10 @@ type Firewall struct {
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
+	// inRemotePortRules are the inbound rules that also select on the underlay source port of the peer, they are
+	// checked when InRules does not match
+	inRemotePortRules []*remotePortTable
+
 	InSendReject  bool
 	OutSendReject bool
 
@@ -56,16 +80,31 @@ type Firewall struct {
 	UDPTimeout     time.Duration //linux: 180s max
 	DefaultTimeout time.Duration //linux: 600s
 
-	// Used to ensure we don't emit local packets for ips we don't own
-	localIps *cidr.Tree4[struct{}]
+	// Used to ensure we don't emit local packets for ips we don't own, replaced when our vpn ip is renumbered
+	localIps atomic.Pointer[cidr.RouteTree[struct{}]]
 
 	rules        string
 	rulesVersion uint16
 
+	// inRuleList and outRuleList keep the rules in the order they were added, for Dump and Simulate
+	inRuleList  []firewallRuleEntry
+	outRuleList []firewallRuleEntry
+
 	trackTCPRTT     bool
 	metricTCPRTT    metrics.Histogram
 	incomingMetrics firewallMetrics
 	outgoingMetrics firewallMetrics
+	metricsRegistry metrics.Registry
+
+	// flows receives the flow records of expired conntrack entries, nil unless flow_export is enabled
+	flows *flowExporter
+
+	// rpf drops forwarded inbound packets whose source would not route back through the tunnel they arrived on
+	rpf bool
+
+	// defaultDenySample logs 1 in every defaultDenySample packets that matched no rule, 0 disables the logging
+	defaultDenySample uint64
+	defaultDenies     atomic.Uint64
 
 	l *logrus.Logger
 }
@@ -74,6 +113,7 @@ type firewallMetrics struct {
 	droppedLocalIP  metrics.Counter
 	droppedRemoteIP metrics.Counter
 	droppedNoRule   metrics.Counter
+	droppedRPF      metrics.Counter
 }
 
 type FirewallConntrack struct {
@@ -88,6 +128,11 @@ type FirewallTable struct {
 	UDP      firewallPort
 	ICMP     firewallPort
 	AnyProto firewallPort
+
+	// groupMap maps a certificate group to the rule groups it also satisfies, from firewall.group_map
+	groupMap map[string][]string
+	// mappedFrom is groupMap inverted, a rule group to the certificate groups that satisfy it
+	mappedFrom map[string][]string
 }
 
 func newFirewallTable() *FirewallTable {
@@ -112,6 +157,16 @@ type FirewallRule struct {
 	Groups    [][]string
 	CIDR      *cidr.Tree4[struct{}]
 	LocalCIDR *cidr.Tree4[struct{}]
+	// CIDR6 and LocalCIDR6 hold the ipv6 cidrs, they only match ipv6 packets
+	CIDR6      *cidr.Tree6[struct{}]
+	LocalCIDR6 *cidr.Tree6[struct{}]
+}
+
+// remotePortTable holds the inbound rules for a single range of peer underlay source ports
+type remotePortTable struct {
+	startPort int32
+	endPort   int32
+	table     *FirewallTable
 }
 
 // Even though ports are uint16, int32 maps are faster for lookup
@@ -119,7 +174,7 @@ type FirewallRule struct {
 type firewallPort map[int32]*FirewallCA
 
 // NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
-func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate) *Firewall {
+func NewFirewall(l *logrus.Logger, registry metrics.Registry, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate) *Firewall {
 	//TODO: error on 0 duration
 	var min, max time.Duration
 
@@ -137,16 +192,7 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		max = defaultTimeout
 	}
 
-	localIps := cidr.NewTree4[struct{}]()
-	for _, ip := range c.Details.Ips {
-		localIps.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
-	}
-
-	for _, n := range c.Details.Subnets {
-		localIps.AddCIDR(n, struct{}{})
-	}
-
-	return &Firewall{
+	fw := &Firewall{
 		Conntrack: &FirewallConntrack{
 			Conns:      make(map[firewall.Packet]*conn),
 			TimerWheel: NewTimerWheel[firewall.Packet](min, max),
@@ -156,26 +202,46 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		TCPTimeout:     tcpTimeout,
 		UDPTimeout:     UDPTimeout,
 		DefaultTimeout: defaultTimeout,
-		localIps:       localIps,
 		l:              l,
 
-		metricTCPRTT: metrics.GetOrRegisterHistogram("network.tcp.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricsRegistry: registry,
+		metricTCPRTT:    metrics.GetOrRegisterHistogram("network.tcp.rtt", registry, metrics.NewExpDecaySample(1028, 0.015)),
 		incomingMetrics: firewallMetrics{
-			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", nil),
-			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", nil),
-			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", registry),
+			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", registry),
+			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", registry),
+			droppedRPF:      metrics.GetOrRegisterCounter("firewall.incoming.dropped.rpf", registry),
 		},
 		outgoingMetrics: firewallMetrics{
-			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", nil),
-			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", nil),
-			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", registry),
+			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", registry),
+			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", registry),
+			droppedRPF:      metrics.GetOrRegisterCounter("firewall.outgoing.dropped.rpf", registry),
 		},
 	}
+
+	fw.setLocalIps(c)
+	return fw
+}
+
+// setLocalIps makes the vpn ips and subnets in c the ones we accept packets for
+func (f *Firewall) setLocalIps(c *cert.NebulaCertificate) {
+	localIps := cidr.NewRouteTree[struct{}]()
+	for _, ip := range c.Details.Ips {
+		localIps.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+	}
+
+	for _, n := range c.Details.Subnets {
+		localIps.AddCIDR(n, struct{}{})
+	}
+
+	f.localIps.Store(localIps)
 }
 
 func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *config.C) (*Firewall, error) {
 	fw := NewFirewall(
 		l,
+		util.MetricsRegistry(c),
 		c.GetDuration("firewall.conntrack.tcp_timeout", time.Minute*12),
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
@@ -205,7 +271,27 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	fw.rpf = c.GetBool("firewall.rpf", false)
+	if fw.rpf {
+		// Make sure turning rpf on or off shows up in the rule hash
+		fw.rules += "rpf\n"
+	}
+
+	if c.GetBool("firewall.log_default_deny", false) {
+		sample := c.GetInt("firewall.log_default_deny_sample", 100)
+		if sample < 1 {
+			return nil, fmt.Errorf("firewall.log_default_deny_sample must be greater than 0: %v", sample)
+		}
+		fw.defaultDenySample = uint64(sample)
+	}
+
+	groupMap, err := parseFirewallGroupMap(c)
+	if err != nil {
+		return nil, err
+	}
+	fw.setGroupMap(groupMap)
+
+	err = AddFirewallRulesFromConfig(l, false, c, fw)
 	if err != nil {
 		return nil, err
 	}
@@ -218,8 +304,35 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 	return fw, nil
 }
 
+// setGroupMap installs the certificate group to rule group mapping for both tables
+func (f *Firewall) setGroupMap(groupMap map[string][]string) {
+	f.InRules.setGroupMap(groupMap)
+	f.OutRules.setGroupMap(groupMap)
+	for _, rt := range f.inRemotePortRules {
+		rt.table.setGroupMap(groupMap)
+	}
+
+	if len(groupMap) > 0 {
+		// Make sure a mapping change shows up in the rule hash
+		f.rules += fmt.Sprintf("groupMap: %v\n", groupMap)
+	}
+}
+
 // AddRule properly creates the in memory rule structure for a firewall table.
 func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string) error {
+	return f.addRule(incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, 0, 0)
+}
+
+// AddRemotePortRule adds an inbound rule that only matches packets from peers whose underlay source port is within
+// remoteStartPort and remoteEndPort. Relayed peers have no underlay port of their own and never match.
+func (f *Firewall) AddRemotePortRule(proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, remoteStartPort int32, remoteEndPort int32) error {
+	if remoteStartPort < 1 || remoteEndPort > 65535 || remoteStartPort > remoteEndPort {
+		return fmt.Errorf("remote port range %v-%v is not valid", remoteStartPort, remoteEndPort)
+	}
+	return f.addRule(true, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha, remoteStartPort, remoteEndPort)
+}
+
+func (f *Firewall) addRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, remoteStartPort int32, remoteEndPort int32) error {
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -236,40 +349,349 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, localIp: %v, caName: %v, caSha: %s",
 		incoming, proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha,
 	)
+	if remoteStartPort != 0 {
+		ruleString += fmt.Sprintf(", remoteStartPort: %v, remoteEndPort: %v", remoteStartPort, remoteEndPort)
+	}
 	f.rules += ruleString + "\n"
 
 	direction := "incoming"
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}).
+	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha, "remoteStartPort": remoteStartPort, "remoteEndPort": remoteEndPort}).
 		Info("Firewall rule added")
 
-	var (
-		ft *FirewallTable
-		fp firewallPort
-	)
-
+	ft := f.OutRules
 	if incoming {
 		ft = f.InRules
+	}
+	if remoteStartPort != 0 {
+		ft = f.remotePortTable(remoteStartPort, remoteEndPort)
+	}
+
+	fp := ft.portFor(proto)
+	if fp == nil {
+		return fmt.Errorf("unknown protocol %v", proto)
+	}
+
+	err := fp.addRule(startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	if err != nil {
+		return err
+	}
+
+	ri := firewallRuleEntry{
+		info: FirewallRuleInfo{
+			Proto:     firewallProtoName(proto),
+			StartPort: startPort,
+			EndPort:   endPort,
+			Groups:    groups,
+			Host:      host,
+			Cidr:      sIp,
+			LocalCidr: lIp,
+			CAName:    caName,
+			CASha:     caSha,
+
+			RemoteStartPort: remoteStartPort,
+			RemoteEndPort:   remoteEndPort,
+		},
+		proto:   proto,
+		ip:      ip,
+		localIp: localIp,
+	}
+	if incoming {
+		f.inRuleList = append(f.inRuleList, ri)
 	} else {
-		ft = f.OutRules
+		f.outRuleList = append(f.outRuleList, ri)
+	}
+
+	return nil
+}
+
+// remotePortTable returns the table for inbound rules on the peer underlay source ports startPort to endPort
+func (f *Firewall) remotePortTable(startPort, endPort int32) *FirewallTable {
+	for _, rt := range f.inRemotePortRules {
+		if rt.startPort == startPort && rt.endPort == endPort {
+			return rt.table
+		}
+	}
+
+	ft := newFirewallTable()
+	ft.setGroupMap(f.InRules.groupMap)
+	f.inRemotePortRules = append(f.inRemotePortRules, &remotePortTable{startPort: startPort, endPort: endPort, table: ft})
+	return ft
+}
+
+// firewallRuleEntry holds a rule as it was added, so it can be evaluated on its own
+type firewallRuleEntry struct {
+	info    FirewallRuleInfo
+	proto   uint8
+	ip      *net.IPNet
+	localIp *net.IPNet
+}
+
+// FirewallRuleInfo is a single parsed firewall rule. A port of 0 means any port and -1 means fragments. RemoteStartPort
+// and RemoteEndPort are only set for inbound rules that select on the underlay source port of the peer.
+type FirewallRuleInfo struct {
+	Proto     string   `json:"proto"`
+	StartPort int32    `json:"startPort"`
+	EndPort   int32    `json:"endPort"`
+	Groups    []string `json:"groups,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	Cidr      string   `json:"cidr,omitempty"`
+	LocalCidr string   `json:"localCidr,omitempty"`
+	CAName    string   `json:"caName,omitempty"`
+	CASha     string   `json:"caSha,omitempty"`
+
+	RemoteStartPort int32 `json:"remoteStartPort,omitempty"`
+	RemoteEndPort   int32 `json:"remoteEndPort,omitempty"`
+}
+
+type FirewallConntrackInfo struct {
+	TCPTimeout     string `json:"tcpTimeout"`
+	UDPTimeout     string `json:"udpTimeout"`
+	DefaultTimeout string `json:"defaultTimeout"`
+	TrackTCPRTT    bool   `json:"trackTcpRtt"`
+}
+
+// FirewallDump is the live state of the firewall as it is evaluated. Packets are first allowed if they match a
+// conntrack entry, then dropped if the remote ip is not in the peer certificate or the local ip is not in LocalCidrs,
+// then checked against the rules. Anything that does not match a rule is denied.
+type FirewallDump struct {
+	InboundAction  string                `json:"inboundAction"`
+	OutboundAction string                `json:"outboundAction"`
+	DefaultPolicy  string                `json:"defaultPolicy"`
+	Conntrack      FirewallConntrackInfo `json:"conntrack"`
+	RulesHash      string                `json:"rulesHash"`
+	RulesVersion   uint16                `json:"rulesVersion"`
+	LocalCidrs     []string              `json:"localCidrs"`
+	GroupMap       map[string][]string   `json:"groupMap,omitempty"`
+	Inbound        []FirewallRuleInfo    `json:"inbound"`
+	Outbound       []FirewallRuleInfo    `json:"outbound"`
+}
+
+// Dump returns a copy of the parsed rules, in order, along with the settings that affect how they are evaluated
+func (f *Firewall) Dump() FirewallDump {
+	action := func(reject bool) string {
+		if reject {
+			return "reject"
+		}
+		return "drop"
+	}
+
+	d := FirewallDump{
+		InboundAction:  action(f.InSendReject),
+		OutboundAction: action(f.OutSendReject),
+		DefaultPolicy:  "deny",
+		Conntrack: FirewallConntrackInfo{
+			TCPTimeout:     f.TCPTimeout.String(),
+			UDPTimeout:     f.UDPTimeout.String(),
+			DefaultTimeout: f.DefaultTimeout.String(),
+			TrackTCPRTT:    f.trackTCPRTT,
+		},
+		RulesHash:    f.GetRuleHash(),
+		RulesVersion: f.rulesVersion,
+		LocalCidrs:   []string{},
+		GroupMap:     f.InRules.groupMap,
+		Inbound:      []FirewallRuleInfo{},
+		Outbound:     []FirewallRuleInfo{},
+	}
+
+	for _, r := range f.inRuleList {
+		d.Inbound = append(d.Inbound, r.info)
+	}
+
+	for _, r := range f.outRuleList {
+		d.Outbound = append(d.Outbound, r.info)
+	}
+
+	for _, e := range f.localIps.Load().List() {
+		d.LocalCidrs = append(d.LocalCidrs, e.CIDR.String())
+	}
+
+	return d
+}
+
+// ConntrackEntry is a single conntrack entry as returned by DumpConntrack. BytesIn and BytesOut are only counted while
+// flow_export is enabled and are omitted otherwise.
+type ConntrackEntry struct {
+	Protocol   string  `json:"protocol"`
+	LocalIP    string  `json:"localIp"`
+	LocalPort  uint16  `json:"localPort"`
+	RemoteIP   string  `json:"remoteIp"`
+	RemotePort uint16  `json:"remotePort"`
+	Direction  string  `json:"direction"`
+	Peer       string  `json:"peer"`
+	Age        string  `json:"age"`
+	ExpiresIn  string  `json:"expiresIn"`
+	BytesIn    *uint64 `json:"bytesIn,omitempty"`
+	BytesOut   *uint64 `json:"bytesOut,omitempty"`
+}
+
+// DumpConntrack returns a copy of the conntrack entries, sorted by peer and then remote address. A non zero peer only
+// returns the entries for that peer and a proto other than firewall.ProtoAny only returns the entries for that protocol.
+func (f *Firewall) DumpConntrack(peer iputil.VpnIp, proto uint8) []ConntrackEntry {
+	type dumped struct {
+		fp firewall.Packet
+		c  conn
+	}
+
+	var found []dumped
+	f.Conntrack.Lock()
+	for fp, c := range f.Conntrack.Conns {
+		if peer != 0 && c.peer != peer {
+			continue
+		}
+
+		if proto != firewall.ProtoAny && fp.Protocol != proto {
+			continue
+		}
+
+		d := dumped{fp: fp, c: *c}
+		if c.flow != nil {
+			flow := *c.flow
+			d.c.flow = &flow
+		}
+		found = append(found, d)
+	}
+	f.Conntrack.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.c.peer != b.c.peer {
+			return a.c.peer < b.c.peer
+		}
+
+		if c := bytes.Compare(a.fp.RemoteAddr(), b.fp.RemoteAddr()); c != 0 {
+			return c < 0
+		}
+
+		if a.fp.RemotePort != b.fp.RemotePort {
+			return a.fp.RemotePort < b.fp.RemotePort
+		}
+
+		if c := bytes.Compare(a.fp.LocalAddr(), b.fp.LocalAddr()); c != 0 {
+			return c < 0
+		}
+
+		if a.fp.LocalPort != b.fp.LocalPort {
+			return a.fp.LocalPort < b.fp.LocalPort
+		}
+
+		return a.fp.Protocol < b.fp.Protocol
+	})
+
+	now := time.Now()
+	entries := make([]ConntrackEntry, len(found))
+	for i, d := range found {
+		e := ConntrackEntry{
+			Protocol:   firewallProtoName(d.fp.Protocol),
+			LocalIP:    d.fp.LocalAddr().String(),
+			LocalPort:  d.fp.LocalPort,
+			RemoteIP:   d.fp.RemoteAddr().String(),
+			RemotePort: d.fp.RemotePort,
+			Direction:  "outbound",
+			Peer:       d.c.peer.String(),
+			Age:        now.Sub(d.c.created).Round(time.Second).String(),
+			ExpiresIn:  d.c.Expires.Sub(now).Round(time.Second).String(),
+		}
+
+		if d.c.incoming {
+			e.Direction = "inbound"
+		}
+
+		if d.c.flow != nil {
+			e.BytesIn = &d.c.flow.bytes[flowIngress]
+			e.BytesOut = &d.c.flow.bytes[flowEgress]
+		}
+
+		entries[i] = e
+	}
+
+	return entries
+}
+
+// FirewallVerdict is the outcome of a simulated packet. Verdict is one of allow, deny, or unknown when there is no
+// peer certificate to evaluate the rules against.
+type FirewallVerdict struct {
+	Verdict string            `json:"verdict"`
+	Reason  string            `json:"reason"`
+	Rule    *FirewallRuleInfo `json:"rule,omitempty"`
+}
+
+// Simulate evaluates a packet the same way Drop does without touching conntrack. h may be nil if there is no tunnel
+// to the peer, in which case rules can not be evaluated since they depend on the peer certificate.
+func (f *Firewall) Simulate(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool) FirewallVerdict {
+	f.Conntrack.Lock()
+	_, ok := f.Conntrack.Conns[fp]
+	f.Conntrack.Unlock()
+	if ok {
+		return FirewallVerdict{Verdict: "allow", Reason: "matches an existing conntrack entry"}
+	}
+
+	if err := f.checkAddrs(fp, h); err != nil {
+		return FirewallVerdict{Verdict: "deny", Reason: err.Error()}
+	}
+
+	if h == nil || h.ConnectionState == nil || h.ConnectionState.peerCert == nil {
+		return FirewallVerdict{Verdict: "unknown", Reason: "no tunnel to the peer, the peer certificate is required to evaluate rules"}
+	}
+
+	rules := f.outRuleList
+	if incoming {
+		rules = f.inRuleList
 	}
 
+	// Evaluate each rule on its own, in order, to find the first one that allows the packet
+	for _, r := range rules {
+		ft := newFirewallTable()
+		ft.setGroupMap(f.InRules.groupMap)
+		port := ft.portFor(r.proto)
+		if port == nil || port.addRule(r.info.StartPort, r.info.EndPort, r.info.Groups, r.info.Host, r.ip, r.localIp, r.info.CAName, r.info.CASha) != nil {
+			continue
+		}
+
+		if r.info.RemoteStartPort != 0 && !inRemotePortRange(h.remote, r.info.RemoteStartPort, r.info.RemoteEndPort) {
+			continue
+		}
+
+		if ft.match(fp, incoming, h.ConnectionState.peerCert, h.ConnectionState.caPool(caPool)) {
+			ri := r.info
+			return FirewallVerdict{Verdict: "allow", Reason: "matches a rule", Rule: &ri}
+		}
+	}
+
+	return FirewallVerdict{Verdict: "deny", Reason: ErrNoMatchingRule.Error()}
+}
+
+func (ft *FirewallTable) portFor(proto uint8) firewallPort {
+	switch proto {
+	case firewall.ProtoTCP:
+		return ft.TCP
+	case firewall.ProtoUDP:
+		return ft.UDP
+	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+		return ft.ICMP
+	case firewall.ProtoAny:
+		return ft.AnyProto
+	}
+	return nil
+}
+
+func firewallProtoName(proto uint8) string {
 	switch proto {
 	case firewall.ProtoTCP:
-		fp = ft.TCP
+		return "tcp"
 	case firewall.ProtoUDP:
-		fp = ft.UDP
+		return "udp"
 	case firewall.ProtoICMP:
-		fp = ft.ICMP
+		return "icmp"
+	case firewall.ProtoICMPv6:
+		return "icmpv6"
 	case firewall.ProtoAny:
-		fp = ft.AnyProto
+		return "any"
 	default:
-		return fmt.Errorf("unknown protocol %v", proto)
+		return strconv.Itoa(int(proto))
 	}
-
-	return fp.addRule(startPort, endPort, groups, host, ip, localIp, caName, caSha)
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -296,6 +718,11 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 		return fmt.Errorf("%s failed to parse, should be an array of rules", table)
 	}
 
+	cidrSets, err := parseFirewallCidrSets(c)
+	if err != nil {
+		return err
+	}
+
 	for i, t := range rs {
 		var groups []string
 		r, err := convertRule(l, t, table, i)
@@ -352,25 +779,47 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
 		}
 
-		var cidr *net.IPNet
-		if r.Cidr != "" {
-			_, cidr, err = net.ParseCIDR(r.Cidr)
-			if err != nil {
-				return fmt.Errorf("%s rule #%v; cidr did not parse; %s", table, i, err)
-			}
+		cidrs, err := resolveRuleCidr(r.Cidr, cidrSets)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; cidr %s", table, i, err)
+		}
+
+		localCidrs, err := resolveRuleCidr(r.LocalCidr, cidrSets)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; local_cidr %s", table, i, err)
 		}
 
-		var localCidr *net.IPNet
-		if r.LocalCidr != "" {
-			_, localCidr, err = net.ParseCIDR(r.LocalCidr)
+		remoteStartPort, remoteEndPort := int32(0), int32(0)
+		var rpf RemotePortFirewall
+		if r.RemotePort != "" {
+			if !inbound {
+				return fmt.Errorf("%s rule #%v; remote_port is only supported for inbound rules", table, i)
+			}
+
+			var ok bool
+			if rpf, ok = fw.(RemotePortFirewall); !ok {
+				return fmt.Errorf("%s rule #%v; remote_port is not supported by this firewall", table, i)
+			}
+
+			remoteStartPort, remoteEndPort, err = parseRemotePort(r.RemotePort)
 			if err != nil {
-				return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
+				return fmt.Errorf("%s rule #%v; remote_port %s", table, i, err)
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
-		if err != nil {
-			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+		// A rule that references a cidr set is added once for every cidr in it, the cidr trees of the rule table match
+		// against all of them at once
+		for _, cidr := range cidrs {
+			for _, localCidr := range localCidrs {
+				if r.RemotePort != "" {
+					err = rpf.AddRemotePortRule(proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha, remoteStartPort, remoteEndPort)
+				} else {
+					err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+				}
+				if err != nil {
+					return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+				}
+			}
 		}
 	}
 
@@ -380,52 +829,105 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
 var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
 var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+var ErrReversePath = errors.New("remote IP does not route back through the tunnel it arrived on")
 
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
+	if f.flows != nil {
+		// Every packet has to be counted against its conntrack entry
+		localCache = nil
+	}
+
 	// Check if we spoke to this tuple, if we did then allow this packet
 	if f.inConns(packet, fp, incoming, h, caPool, localCache) {
 		return nil
 	}
 
-	// Make sure remote address matches nebula certificate
-	if remoteCidr := h.remoteCidr; remoteCidr != nil {
-		ok, _ := remoteCidr.Contains(fp.RemoteIP)
-		if !ok {
+	// Make sure the addresses match the nebula certificates
+	if err := f.checkAddrs(fp, h); err != nil {
+		if err == ErrInvalidRemoteIP {
 			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
+		} else {
+			f.metrics(incoming).droppedLocalIP.Inc(1)
 		}
-	} else {
-		// Simple case: Certificate has one IP and no subnets
-		if fp.RemoteIP != h.vpnIp {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
+		return err
+	}
+
+	if !f.matchRules(fp, incoming, h.ConnectionState.peerCert, h.remote, h.ConnectionState.caPool(caPool)) {
+		f.metrics(incoming).droppedNoRule.Inc(1)
+		f.logDefaultDeny(fp, incoming, h)
+		return ErrNoMatchingRule
+	}
+
+	// We always want to conntrack since it is a faster operation
+	f.addConn(packet, fp, incoming, h)
+
+	return nil
+}
+
+// checkAddrs makes sure the remote address of fp is allowed by the peer certificate and the local address by ours. An
+// ipv6 address can only be in the ipv6 subnets of a certificate since vpn ips are ipv4. h is nil when simulating without
+// a tunnel, only the local address is checked then.
+func (f *Firewall) checkAddrs(fp firewall.Packet, h *HostInfo) error {
+	localIps := f.localIps.Load()
+	if fp.IPv6 {
+		if h != nil {
+			if h.remoteCidr == nil {
+				return ErrInvalidRemoteIP
+			}
+
+			if ok, _ := h.remoteCidr.MostSpecificContainsIP6(fp.RemoteIP6); !ok {
+				return ErrInvalidRemoteIP
+			}
+		}
+
+		if ok, _ := localIps.MostSpecificContainsIP6(fp.LocalIP6); !ok {
+			return ErrInvalidLocalIP
+		}
+		return nil
+	}
+
+	if h != nil {
+		if remoteCidr := h.remoteCidr; remoteCidr != nil {
+			if ok, _ := remoteCidr.MostSpecificContains(fp.RemoteIP); !ok {
+				return ErrInvalidRemoteIP
+			}
+		} else if fp.RemoteIP != h.vpnIp {
+			// Simple case: Certificate has one IP and no subnets
 			return ErrInvalidRemoteIP
 		}
 	}
 
 	// Make sure we are supposed to be handling this local ip address
-	ok, _ := f.localIps.Contains(fp.LocalIP)
-	if !ok {
-		f.metrics(incoming).droppedLocalIP.Inc(1)
+	if ok, _ := localIps.MostSpecificContains(fp.LocalIP); !ok {
 		return ErrInvalidLocalIP
 	}
 
-	table := f.OutRules
-	if incoming {
-		table = f.InRules
-	}
+	return nil
+}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
-		f.metrics(incoming).droppedNoRule.Inc(1)
-		return ErrNoMatchingRule
+// logDefaultDeny logs a sample of the packets that no rule matched with the remote certificate groups, to show which
+// rule is missing
+func (f *Firewall) logDefaultDeny(fp firewall.Packet, incoming bool, h *HostInfo) {
+	if f.defaultDenySample == 0 || (f.defaultDenies.Add(1)-1)%f.defaultDenySample != 0 {
+		return
 	}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(packet, fp, incoming)
+	var groups []string
+	var name string
+	if peerCert := h.ConnectionState.peerCert; peerCert != nil {
+		groups = peerCert.Details.Groups
+		name = peerCert.Details.Name
+	}
 
-	return nil
+	h.logger(f.l).
+		WithField("fwPacket", fp).
+		WithField("incoming", incoming).
+		WithField("certName", name).
+		WithField("groups", groups).
+		WithField("sample", f.defaultDenySample).
+		Info("Packet denied by default, no firewall rule matched")
 }
 
 func (f *Firewall) metrics(incoming bool) firewallMetrics {
@@ -447,8 +949,8 @@ func (f *Firewall) EmitStats() {
 	conntrack.Lock()
 	conntrackCount := len(conntrack.Conns)
 	conntrack.Unlock()
-	metrics.GetOrRegisterGauge("firewall.conntrack.count", nil).Update(int64(conntrackCount))
-	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(f.rulesVersion))
+	metrics.GetOrRegisterGauge("firewall.conntrack.count", f.metricsRegistry).Update(int64(conntrackCount))
+	metrics.GetOrRegisterGauge("firewall.rules.version", f.metricsRegistry).Update(int64(f.rulesVersion))
 }
 
 func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) bool {
@@ -476,13 +978,7 @@ func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *
 	if c.rulesVersion != f.rulesVersion {
 		// This conntrack entry was for an older rule set, validate
 		// it still passes with the current rule set
-		table := f.OutRules
-		if c.incoming {
-			table = f.InRules
-		}
-
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
+		if !f.matchRules(fp, c.incoming, h.ConnectionState.peerCert, h.remote, h.ConnectionState.caPool(caPool)) {
 			if f.l.Level >= logrus.DebugLevel {
 				h.logger(f.l).
 					WithField("fwPacket", fp).
@@ -491,6 +987,7 @@ func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *
 					WithField("oldRulesVersion", c.rulesVersion).
 					Debugln("dropping old conntrack entry, does not match new ruleset")
 			}
+			f.exportFlow(fp, c)
 			delete(conntrack.Conns, fp)
 			conntrack.Unlock()
 			return false
@@ -522,6 +1019,10 @@ func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *
 		c.Expires = time.Now().Add(f.DefaultTimeout)
 	}
 
+	if c.flow != nil {
+		c.flow.count(incoming, len(packet))
+	}
+
 	conntrack.Unlock()
 
 	if localCache != nil {
@@ -531,10 +1032,15 @@ func (f *Firewall) inConns(packet []byte, fp firewall.Packet, incoming bool, h *
 	return true
 }
 
-func (f *Firewall) addConn(packet []byte, fp firewall.Packet, incoming bool) {
+func (f *Firewall) addConn(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo) {
 	var timeout time.Duration
 	c := &conn{}
 
+	if f.flows != nil {
+		c.flow = &connFlow{peer: h.vpnIp, start: time.Now()}
+		c.flow.count(incoming, len(packet))
+	}
+
 	switch fp.Protocol {
 	case firewall.ProtoTCP:
 		timeout = f.TCPTimeout
@@ -558,7 +1064,9 @@ func (f *Firewall) addConn(packet []byte, fp firewall.Packet, incoming bool) {
 	// firewall reload
 	c.incoming = incoming
 	c.rulesVersion = f.rulesVersion
-	c.Expires = time.Now().Add(timeout)
+	c.peer = h.vpnIp
+	c.created = time.Now()
+	c.Expires = c.created.Add(timeout)
 	conntrack.Conns[fp] = c
 	conntrack.Unlock()
 }
@@ -584,25 +1092,135 @@ func (f *Firewall) evict(p firewall.Packet) {
 	}
 
 	// This conn is done
+	f.exportFlow(p, t)
 	delete(conntrack.Conns, p)
 }
 
+// drainConntrack checks every conntrack entry from an older rule set against the current rules and drops the ones that
+// are no longer allowed, instead of leaving them until their next packet or timeout. peer returns the tunnel an entry
+// belongs to, entries without one or without a certificate are left to expire. Returns the number of entries dropped.
+// Caller must own the connMutex lock!
+func (f *Firewall) drainConntrack(peer func(iputil.VpnIp) *HostInfo, caPool *cert.NebulaCAPool) int {
+	dropped := 0
+	for fp, c := range f.Conntrack.Conns {
+		if c.rulesVersion == f.rulesVersion {
+			continue
+		}
+
+		h := peer(c.peer)
+		if h == nil {
+			continue
+		}
+
+		pc := h.GetCert()
+		if pc == nil {
+			continue
+		}
+
+		if f.matchRules(fp, c.incoming, pc, h.remote, h.ConnectionState.caPool(caPool)) {
+			c.rulesVersion = f.rulesVersion
+			continue
+		}
+
+		f.exportFlow(fp, c)
+		delete(f.Conntrack.Conns, fp)
+		dropped++
+	}
+
+	if dropped > 0 {
+		metrics.GetOrRegisterCounter("firewall.conntrack.drained", f.metricsRegistry).Inc(int64(dropped))
+	}
+
+	return dropped
+}
+
+// exportFlow hands the traffic counted for a finished conntrack entry to flow_export
+func (f *Firewall) exportFlow(p firewall.Packet, c *conn) {
+	if f.flows == nil || c.flow == nil {
+		return
+	}
+
+	f.flows.add(flowRecords(p, c.flow))
+}
+
+// matchRules checks p against the rules for its direction. Inbound packets are also checked against the rules that
+// select on the underlay source port of the peer at remote, which is nil for relayed peers.
+func (f *Firewall) matchRules(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, remote *udp.Addr, caPool *cert.NebulaCAPool) bool {
+	if !incoming {
+		return f.OutRules.match(p, incoming, c, caPool)
+	}
+
+	if f.InRules.match(p, incoming, c, caPool) {
+		return true
+	}
+
+	for _, rt := range f.inRemotePortRules {
+		if inRemotePortRange(remote, rt.startPort, rt.endPort) && rt.table.match(p, incoming, c, caPool) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inRemotePortRange returns true if remote is a direct underlay address with a port from startPort to endPort
+func inRemotePortRange(remote *udp.Addr, startPort, endPort int32) bool {
+	if remote == nil {
+		return false
+	}
+	port := int32(remote.Port)
+	return port >= startPort && port <= endPort
+}
+
 func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
-	if ft.AnyProto.match(p, incoming, c, caPool) {
+	if ft.AnyProto.match(p, incoming, c, ft.mappedFrom, caPool) {
 		return true
 	}
 
 	switch p.Protocol {
 	case firewall.ProtoTCP:
-		if ft.TCP.match(p, incoming, c, caPool) {
+		if ft.TCP.match(p, incoming, c, ft.mappedFrom, caPool) {
 			return true
 		}
 	case firewall.ProtoUDP:
-		if ft.UDP.match(p, incoming, c, caPool) {
+		if ft.UDP.match(p, incoming, c, ft.mappedFrom, caPool) {
 			return true
 		}
-	case firewall.ProtoICMP:
-		if ft.ICMP.match(p, incoming, c, caPool) {
+	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+		if ft.ICMP.match(p, incoming, c, ft.mappedFrom, caPool) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setGroupMap installs the certificate group to rule group mapping, inverted so matching a packet does not have to build
+// the set of groups a certificate satisfies
+func (ft *FirewallTable) setGroupMap(groupMap map[string][]string) {
+	ft.groupMap = groupMap
+	ft.mappedFrom = nil
+	if len(groupMap) == 0 {
+		return
+	}
+
+	ft.mappedFrom = make(map[string][]string)
+	for certGroup, ruleGroups := range groupMap {
+		for _, g := range ruleGroups {
+			ft.mappedFrom[g] = append(ft.mappedFrom[g], certGroup)
+		}
+	}
+}
+
+// hasGroup returns true if c has the group g or a group that firewall.group_map maps to g. mappedFrom is the inverted
+// group map, see FirewallTable.setGroupMap.
+func hasGroup(c *cert.NebulaCertificate, g string, mappedFrom map[string][]string) bool {
+	if _, ok := c.Details.InvertedGroups[g]; ok {
+		return true
+	}
+
+	for _, certGroup := range mappedFrom[g] {
+		if _, ok := c.Details.InvertedGroups[certGroup]; ok {
 			return true
 		}
 	}
@@ -631,7 +1249,7 @@ func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string,
 	return nil
 }
 
-func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCertificate, mappedFrom map[string][]string, caPool *cert.NebulaCAPool) bool {
 	// We don't have any allowed ports, bail
 	if fp == nil {
 		return false
@@ -647,20 +1265,22 @@ func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.NebulaCer
 		port = int32(p.RemotePort)
 	}
 
-	if fp[port].match(p, c, caPool) {
+	if fp[port].match(p, c, mappedFrom, caPool) {
 		return true
 	}
 
-	return fp[firewall.PortAny].match(p, c, caPool)
+	return fp[firewall.PortAny].match(p, c, mappedFrom, caPool)
 }
 
 func (fc *FirewallCA) addRule(groups []string, host string, ip, localIp *net.IPNet, caName, caSha string) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
-			Hosts:     make(map[string]struct{}),
-			Groups:    make([][]string, 0),
-			CIDR:      cidr.NewTree4[struct{}](),
-			LocalCIDR: cidr.NewTree4[struct{}](),
+			Hosts:      make(map[string]struct{}),
+			Groups:     make([][]string, 0),
+			CIDR:       cidr.NewTree4[struct{}](),
+			LocalCIDR:  cidr.NewTree4[struct{}](),
+			CIDR6:      cidr.NewTree6[struct{}](),
+			LocalCIDR6: cidr.NewTree6[struct{}](),
 		}
 	}
 
@@ -695,27 +1315,40 @@ func (fc *FirewallCA) addRule(groups []string, host string, ip, localIp *net.IPN
 	return nil
 }
 
-func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fc *FirewallCA) match(p firewall.Packet, c *cert.NebulaCertificate, mappedFrom map[string][]string, caPool *cert.NebulaCAPool) bool {
 	if fc == nil {
 		return false
 	}
 
-	if fc.Any.match(p, c) {
+	if fc.Any.match(p, c, mappedFrom) {
 		return true
 	}
 
-	if t, ok := fc.CAShas[c.Details.Issuer]; ok {
-		if t.match(p, c) {
+	// Every CA from the issuer of c up to the root can be named by a rule
+	signed := c
+	for i := 0; i <= cert.MaxIntermediates; i++ {
+		if t, ok := fc.CAShas[signed.Details.Issuer]; ok {
+			if t.match(p, c, mappedFrom) {
+				return true
+			}
+		}
+
+		s, err := caPool.GetCAForCert(signed)
+		if err != nil {
+			return false
+		}
+
+		if fc.CANames[s.Details.Name].match(p, c, mappedFrom) {
 			return true
 		}
-	}
 
-	s, err := caPool.GetCAForCert(c)
-	if err != nil {
-		return false
+		if s.Details.Issuer == "" {
+			return false
+		}
+		signed = s
 	}
 
-	return fc.CANames[s.Details.Name].match(p, c)
+	return false
 }
 
 func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, localIp *net.IPNet) error {
@@ -730,6 +1363,8 @@ func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, loc
 		fr.Hosts = make(map[string]struct{})
 		fr.CIDR = cidr.NewTree4[struct{}]()
 		fr.LocalCIDR = cidr.NewTree4[struct{}]()
+		fr.CIDR6 = cidr.NewTree6[struct{}]()
+		fr.LocalCIDR6 = cidr.NewTree6[struct{}]()
 	} else {
 		if len(groups) > 0 {
 			fr.Groups = append(fr.Groups, groups)
@@ -740,11 +1375,19 @@ func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, loc
 		}
 
 		if ip != nil {
-			fr.CIDR.AddCIDR(ip, struct{}{})
+			if ip.IP.To4() == nil {
+				fr.CIDR6.AddCIDR(ip, struct{}{})
+			} else {
+				fr.CIDR.AddCIDR(ip, struct{}{})
+			}
 		}
 
 		if localIp != nil {
-			fr.LocalCIDR.AddCIDR(localIp, struct{}{})
+			if localIp.IP.To4() == nil {
+				fr.LocalCIDR6.AddCIDR(localIp, struct{}{})
+			} else {
+				fr.LocalCIDR.AddCIDR(localIp, struct{}{})
+			}
 		}
 	}
 
@@ -762,22 +1405,12 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip, localIp *net.IPN
 		}
 	}
 
-	if host == "any" {
-		return true
-	}
-
-	if ip != nil && ip.Contains(net.IPv4(0, 0, 0, 0)) {
-		return true
-	}
-
-	if localIp != nil && localIp.Contains(net.IPv4(0, 0, 0, 0)) {
-		return true
-	}
-
-	return false
+	// A cidr of 0.0.0.0/0 or ::/0 is not any, each only matches packets of its own address family
+	return host == "any"
 }
 
-func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool {
+// match checks p and c against the rule, groups is the set of groups c satisfies
+func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate, mappedFrom map[string][]string) bool {
 	if fr == nil {
 		return false
 	}
@@ -792,7 +1425,7 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		found := false
 
 		for _, g := range sg {
-			if _, ok := c.Details.InvertedGroups[g]; !ok {
+			if !hasGroup(c, g, mappedFrom) {
 				found = false
 				break
 			}
@@ -811,6 +1444,10 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 		}
 	}
 
+	if p.IPv6 {
+		return fr.match6(p)
+	}
+
 	if fr.CIDR != nil {
 		ok, _ := fr.CIDR.Contains(p.RemoteIP)
 		if ok {
@@ -829,6 +1466,29 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.NebulaCertificate) bool
 	return false
 }
 
+// match6 checks an ipv6 packet against the ipv6 cidrs of the rule
+func (fr *FirewallRule) match6(p firewall.Packet) bool {
+	if fr.CIDR6 != nil {
+		ok, _ := fr.CIDR6.MostSpecificContainsIpV6(ip6ToUint64s(p.RemoteIP6))
+		if ok {
+			return true
+		}
+	}
+
+	if fr.LocalCIDR6 != nil {
+		ok, _ := fr.LocalCIDR6.MostSpecificContainsIpV6(ip6ToUint64s(p.LocalIP6))
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ip6ToUint64s(ip [16]byte) (hi, lo uint64) {
+	return binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])
+}
+
 type rule struct {
 	Port      string
 	Code      string
@@ -840,6 +1500,101 @@ type rule struct {
 	LocalCidr string
 	CAName    string
 	CASha     string
+	// RemotePort is the underlay source port, or range of ports, of the peer
+	RemotePort string
+}
+
+// parseFirewallGroupMap reads firewall.group_map, a map of certificate group to the rule group or list of rule groups
+// it should also satisfy
+func parseFirewallGroupMap(c *config.C) (map[string][]string, error) {
+	raw := c.GetMap("firewall.group_map", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	groupMap := make(map[string][]string, len(raw))
+	for k, v := range raw {
+		certGroup := fmt.Sprintf("%v", k)
+		switch rv := v.(type) {
+		case string:
+			groupMap[certGroup] = []string{rv}
+		case []interface{}:
+			for _, g := range rv {
+				gs, ok := g.(string)
+				if !ok {
+					return nil, fmt.Errorf("firewall.group_map entry %s must be a group name or a list of group names", certGroup)
+				}
+				groupMap[certGroup] = append(groupMap[certGroup], gs)
+			}
+		default:
+			return nil, fmt.Errorf("firewall.group_map entry %s must be a group name or a list of group names", certGroup)
+		}
+
+		for _, g := range groupMap[certGroup] {
+			if g == "" || g == "any" {
+				return nil, fmt.Errorf("firewall.group_map entry %s can not map to %q", certGroup, g)
+			}
+		}
+	}
+
+	return groupMap, nil
+}
+
+// cidrSetPattern limits cidr set names to what can be referenced from a rule without quoting surprises
+var cidrSetPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// parseFirewallCidrSets reads firewall.cidr_sets, a map of set name to a list of cidrs that rules can use as their cidr
+// or local_cidr with @name
+func parseFirewallCidrSets(c *config.C) (map[string][]*net.IPNet, error) {
+	raw := c.GetMap("firewall.cidr_sets", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	sets := make(map[string][]*net.IPNet, len(raw))
+	for k, v := range raw {
+		name := fmt.Sprintf("%v", k)
+		if !cidrSetPattern.MatchString(name) {
+			return nil, fmt.Errorf("firewall.cidr_sets name %q must only contain letters, numbers, _ and -", name)
+		}
+
+		rv, ok := v.([]interface{})
+		if !ok || len(rv) == 0 {
+			return nil, fmt.Errorf("firewall.cidr_sets entry %s must be a list of cidrs", name)
+		}
+
+		for _, rc := range rv {
+			_, cidr, err := net.ParseCIDR(fmt.Sprintf("%v", rc))
+			if err != nil {
+				return nil, fmt.Errorf("firewall.cidr_sets entry %s has an invalid cidr; %s", name, err)
+			}
+			sets[name] = append(sets[name], cidr)
+		}
+	}
+
+	return sets, nil
+}
+
+// resolveRuleCidr returns the cidrs a rule cidr or local_cidr value stands for. An empty value is a single nil cidr, a
+// value starting with @ is every cidr in the named set.
+func resolveRuleCidr(v string, sets map[string][]*net.IPNet) ([]*net.IPNet, error) {
+	if v == "" {
+		return []*net.IPNet{nil}, nil
+	}
+
+	if strings.HasPrefix(v, "@") {
+		set, ok := sets[v[1:]]
+		if !ok {
+			return nil, fmt.Errorf("references unknown cidr set `%s`", v[1:])
+		}
+		return set, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, fmt.Errorf("did not parse; %s", err)
+	}
+	return []*net.IPNet{cidr}, nil
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -866,6 +1621,7 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	r.LocalCidr = toString("local_cidr", m)
 	r.CAName = toString("ca_name", m)
 	r.CASha = toString("ca_sha", m)
+	r.RemotePort = toString("remote_port", m)
 
 	// Make sure group isn't an array
 	if v, ok := m["group"].([]interface{}); ok {
@@ -896,6 +1652,28 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 	return r, nil
 }
 
+// parseRemotePort parses a remote_port, a single port or a range of ports from 1 to 65535
+func parseRemotePort(s string) (startPort, endPort int32, err error) {
+	if s == "any" || s == "fragment" {
+		return 0, 0, fmt.Errorf("must be a port or a range of ports; `%s`", s)
+	}
+
+	startPort, endPort, err = parsePort(s)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if startPort < 1 || endPort > 65535 {
+		return 0, 0, fmt.Errorf("must be between 1 and 65535; `%s`", s)
+	}
+
+	if startPort > endPort {
+		return 0, 0, fmt.Errorf("start port was higher than end port; `%s`", s)
+	}
+
+	return startPort, endPort, nil
+}
+
 func parsePort(s string) (startPort, endPort int32, err error) {
 	if s == "any" {
 		startPort = firewall.PortAny
@@ -3,6 +3,7 @@ package firewall
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 
 	"github.com/slackhq/nebula/iputil"
 )
@@ -14,6 +15,8 @@ const (
 	ProtoTCP  = 6
 	ProtoUDP  = 17
 	ProtoICMP = 1
+	// ProtoICMPv6 is matched by `icmp` rules
+	ProtoICMPv6 = 58
 
 	PortAny      = 0  // Special value for matching `port: any`
 	PortFragment = -1 // Special value for matching `port: fragment`
@@ -26,6 +29,11 @@ type Packet struct {
 	RemotePort uint16
 	Protocol   uint8
 	Fragment   bool
+
+	// IPv6 is true when the addresses are in LocalIP6 and RemoteIP6 instead of LocalIP and RemoteIP
+	IPv6      bool
+	LocalIP6  [16]byte
+	RemoteIP6 [16]byte
 }
 
 func (fp *Packet) Copy() *Packet {
@@ -36,7 +44,28 @@ func (fp *Packet) Copy() *Packet {
 		RemotePort: fp.RemotePort,
 		Protocol:   fp.Protocol,
 		Fragment:   fp.Fragment,
+		IPv6:       fp.IPv6,
+		LocalIP6:   fp.LocalIP6,
+		RemoteIP6:  fp.RemoteIP6,
+	}
+}
+
+// LocalAddr returns the local address of the packet, whichever family it is
+func (fp *Packet) LocalAddr() net.IP {
+	if fp.IPv6 {
+		ip := fp.LocalIP6
+		return ip[:]
+	}
+	return fp.LocalIP.ToIP()
+}
+
+// RemoteAddr returns the remote address of the packet, whichever family it is
+func (fp *Packet) RemoteAddr() net.IP {
+	if fp.IPv6 {
+		ip := fp.RemoteIP6
+		return ip[:]
 	}
+	return fp.RemoteIP.ToIP()
 }
 
 func (fp Packet) MarshalJSON() ([]byte, error) {
@@ -46,14 +75,16 @@ func (fp Packet) MarshalJSON() ([]byte, error) {
 		proto = "tcp"
 	case ProtoICMP:
 		proto = "icmp"
+	case ProtoICMPv6:
+		proto = "icmpv6"
 	case ProtoUDP:
 		proto = "udp"
 	default:
 		proto = fmt.Sprintf("unknown %v", fp.Protocol)
 	}
 	return json.Marshal(m{
-		"LocalIP":    fp.LocalIP.String(),
-		"RemoteIP":   fp.RemoteIP.String(),
+		"LocalIP":    fp.LocalAddr().String(),
+		"RemoteIP":   fp.RemoteAddr().String(),
 		"LocalPort":  fp.LocalPort,
 		"RemotePort": fp.RemotePort,
 		"Protocol":   proto,
@@ -3,6 +3,7 @@ package nebula
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"math"
 	"net"
@@ -15,13 +16,14 @@ import (
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewFirewall(t *testing.T) {
 	l := test.NewLogger()
 	c := &cert.NebulaCertificate{}
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	conntrack := fw.Conntrack
 	assert.NotNil(t, conntrack)
 	assert.NotNil(t, conntrack.Conns)
@@ -36,23 +38,23 @@ func TestNewFirewall(t *testing.T) {
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Second, time.Hour, time.Minute, c)
+	fw = NewFirewall(l, nil, time.Second, time.Hour, time.Minute, c)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Hour, time.Second, time.Minute, c)
+	fw = NewFirewall(l, nil, time.Hour, time.Second, time.Minute, c)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Hour, time.Minute, time.Second, c)
+	fw = NewFirewall(l, nil, time.Hour, time.Minute, time.Second, c)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Minute, time.Hour, time.Second, c)
+	fw = NewFirewall(l, nil, time.Minute, time.Hour, time.Second, c)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 
-	fw = NewFirewall(l, time.Minute, time.Second, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Minute, time.Second, time.Hour, c)
 	assert.Equal(t, time.Hour, conntrack.TimerWheel.wheelDuration)
 	assert.Equal(t, 3602, conntrack.TimerWheel.wheelLen)
 }
@@ -63,7 +65,7 @@ func TestFirewall_AddRule(t *testing.T) {
 	l.SetOutput(ob)
 
 	c := &cert.NebulaCertificate{}
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.NotNil(t, fw.InRules)
 	assert.NotNil(t, fw.OutRules)
 
@@ -75,19 +77,19 @@ func TestFirewall_AddRule(t *testing.T) {
 	assert.Empty(t, fw.InRules.TCP[1].Any.Groups)
 	assert.Empty(t, fw.InRules.TCP[1].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "", ""))
 	assert.False(t, fw.InRules.UDP[1].Any.Any)
 	assert.Contains(t, fw.InRules.UDP[1].Any.Groups[0], "g1")
 	assert.Empty(t, fw.InRules.UDP[1].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoICMP, 1, 1, []string{}, "h1", nil, nil, "", ""))
 	assert.False(t, fw.InRules.ICMP[1].Any.Any)
 	assert.Empty(t, fw.InRules.ICMP[1].Any.Groups)
 	assert.Contains(t, fw.InRules.ICMP[1].Any.Hosts, "h1")
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 1, 1, []string{}, "", ti, nil, "", ""))
 	assert.False(t, fw.OutRules.AnyProto[1].Any.Any)
 	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Groups)
@@ -95,7 +97,7 @@ func TestFirewall_AddRule(t *testing.T) {
 	ok, _ := fw.OutRules.AnyProto[1].Any.CIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 1, 1, []string{}, "", nil, ti, "", ""))
 	assert.False(t, fw.OutRules.AnyProto[1].Any.Any)
 	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Groups)
@@ -103,16 +105,16 @@ func TestFirewall_AddRule(t *testing.T) {
 	ok, _ = fw.OutRules.AnyProto[1].Any.LocalCIDR.Match(iputil.Ip2VpnIp(ti.IP))
 	assert.True(t, ok)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "ca-name", ""))
 	assert.Contains(t, fw.InRules.UDP[1].CANames, "ca-name")
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 1, 1, []string{"g1"}, "", nil, nil, "", "ca-sha"))
 	assert.Contains(t, fw.InRules.UDP[1].CAShas, "ca-sha")
 
 	// Set any and clear fields
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"g1", "g2"}, "h1", ti, ti, "", ""))
 	assert.Equal(t, []string{"g1", "g2"}, fw.OutRules.AnyProto[0].Any.Groups[0])
 	assert.Contains(t, fw.OutRules.AnyProto[0].Any.Hosts, "h1")
@@ -129,17 +131,30 @@ func TestFirewall_AddRule(t *testing.T) {
 	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Groups)
 	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Hosts)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
 	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
 
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	_, anyIp, _ := net.ParseCIDR("0.0.0.0/0")
 	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "", anyIp, nil, "", ""))
-	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
+	// 0.0.0.0/0 is any ipv4 address, not any packet
+	assert.False(t, fw.OutRules.AnyProto[0].Any.Any)
+	ok, _ = fw.OutRules.AnyProto[0].Any.CIDR.Contains(iputil.Ip2VpnIp(ti.IP))
+	assert.True(t, ok)
+
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
+	_, ti6, _ := net.ParseCIDR("fd00::/8")
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "", ti6, ti6, "", ""))
+	assert.False(t, fw.OutRules.AnyProto[0].Any.Any)
+	ok, _ = fw.OutRules.AnyProto[0].Any.CIDR6.MostSpecificContains(net.ParseIP("fd00::1"))
+	assert.True(t, ok)
+	ok, _ = fw.OutRules.AnyProto[0].Any.LocalCIDR6.MostSpecificContains(net.ParseIP("fd00::1"))
+	assert.True(t, ok)
+	assert.Empty(t, fw.OutRules.AnyProto[0].Any.CIDR.List())
 
 	// Test error conditions
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
 	assert.Error(t, fw.AddRule(true, math.MaxUint8, 0, 0, []string{}, "", nil, nil, "", ""))
 	assert.Error(t, fw.AddRule(true, firewall.ProtoAny, 10, 0, []string{}, "", nil, nil, "", ""))
 }
@@ -180,7 +195,7 @@ func TestFirewall_Drop(t *testing.T) {
 	}
 	h.CreateRemoteCIDR(&c)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
@@ -199,32 +214,104 @@ func TestFirewall_Drop(t *testing.T) {
 	p.RemoteIP = oldRemote
 
 	// ensure signer doesn't get in the way of group checks
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum-bad"))
 	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
 
 	// test caSha doesn't drop on match
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "", "signer-shasum-bad"))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "", "signer-shasum"))
 	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
 
 	// ensure ca name doesn't get in the way of group checks
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good-bad", ""))
 	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
 
 	// test caName doesn't drop on match
 	cp.CAs["signer-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-good"}}
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"nope"}, "", nil, nil, "ca-good-bad", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group"}, "", nil, nil, "ca-good", ""))
 	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
 }
 
+func TestFirewall_DropIntermediateCA(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			InvertedGroups: map[string]struct{}{},
+			Issuer:         "intermediate-shasum",
+		},
+	}
+
+	// The root is in our pool, the intermediate between it and the peer certificate came from the peer
+	intermediate := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-intermediate", IsCA: true, Issuer: "root-shasum"}}
+	cp := cert.NewCAPool()
+	cp.CAs["root-shasum"] = &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "ca-root", IsCA: true}}
+	cp.Intermediates["intermediate-shasum"] = intermediate
+
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	for _, tc := range []struct {
+		name   string
+		caName string
+		caSha  string
+		allow  bool
+	}{
+		{name: "issuer name", caName: "ca-intermediate", allow: true},
+		{name: "issuer sha", caSha: "intermediate-shasum", allow: true},
+		{name: "root name", caName: "ca-root", allow: true},
+		{name: "root sha", caSha: "root-shasum", allow: true},
+		{name: "unrelated name", caName: "ca-other"},
+		{name: "unrelated sha", caSha: "other-shasum"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
+			assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, nil, "host1", nil, nil, tc.caName, tc.caSha))
+			err := fw.Drop([]byte{}, p, true, &h, cp, nil)
+			if tc.allow {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, ErrNoMatchingRule, err)
+			}
+		})
+	}
+
+	// The root can not be found without the intermediate, unless the peer sent it with its certificate
+	delete(cp.Intermediates, "intermediate-shasum")
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, nil, "host1", nil, nil, "ca-root", ""))
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// Intermediates the peer sent are keyed by their real fingerprint
+	intermediateSha, err := intermediate.Sha256Sum()
+	assert.NoError(t, err)
+	c.Details.Issuer = intermediateSha
+	h.ConnectionState.peerCertChain = []*cert.NebulaCertificate{intermediate}
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+}
+
 func BenchmarkFirewallTable_match(b *testing.B) {
 	ft := FirewallTable{
 		TCP: firewallPort{},
@@ -393,7 +480,7 @@ func TestFirewall_Drop2(t *testing.T) {
 	}
 	h1.CreateRemoteCIDR(&c1)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"default-group", "test-group"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
@@ -475,7 +562,7 @@ func TestFirewall_Drop3(t *testing.T) {
 	}
 	h3.CreateRemoteCIDR(&c3)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "host1", nil, nil, "", ""))
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 1, 1, []string{}, "", nil, nil, "", "signer-sha"))
 	cp := cert.NewCAPool()
@@ -526,7 +613,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	}
 	h.CreateRemoteCIDR(&c)
 
-	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
 	cp := cert.NewCAPool()
 
@@ -539,7 +626,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
 
 	oldFw := fw
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 10, 10, []string{"any"}, "", nil, nil, "", ""))
 	fw.Conntrack = oldFw.Conntrack
 	fw.rulesVersion = oldFw.rulesVersion + 1
@@ -548,7 +635,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
 
 	oldFw = fw
-	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	fw = NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
 	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 11, 11, []string{"any"}, "", nil, nil, "", ""))
 	fw.Conntrack = oldFw.Conntrack
 	fw.rulesVersion = oldFw.rulesVersion + 1
@@ -728,6 +815,536 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	assert.EqualError(t, err, "firewall.inbound rule #0; only one of group or groups should be defined, both provided")
 }
 
+func TestFirewall_Dump(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Ips: []*net.IPNet{{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}},
+		},
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound_action": "reject",
+		"conntrack":      map[interface{}]interface{}{"udp_timeout": "1m"},
+		"outbound":       []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "groups": []interface{}{"a", "b"}},
+			map[interface{}]interface{}{"code": "any", "proto": "icmp", "cidr": "10.0.0.0/8", "ca_name": "ca"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.Nil(t, err)
+
+	d := fw.Dump()
+	assert.Equal(t, "reject", d.InboundAction)
+	assert.Equal(t, "drop", d.OutboundAction)
+	assert.Equal(t, "deny", d.DefaultPolicy)
+	assert.Equal(t, FirewallConntrackInfo{TCPTimeout: "12m0s", UDPTimeout: "1m0s", DefaultTimeout: "10m0s"}, d.Conntrack)
+	assert.Equal(t, fw.GetRuleHash(), d.RulesHash)
+	assert.Equal(t, []string{"1.2.3.4/32"}, d.LocalCidrs)
+	assert.Equal(t, []FirewallRuleInfo{{Proto: "any", Host: "any"}}, d.Outbound)
+	assert.Equal(t, []FirewallRuleInfo{
+		{Proto: "tcp", StartPort: 443, EndPort: 443, Groups: []string{"a", "b"}},
+		{Proto: "icmp", Cidr: "10.0.0.0/8", CAName: "ca"},
+	}, d.Inbound)
+}
+
+func TestFirewall_DumpConntrack(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Ips: []*net.IPNet{{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}},
+		},
+	}
+
+	fw := NewFirewall(l, nil, time.Minute, time.Minute, time.Minute, c)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+	assert.NoError(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{}, "any", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	peer := func(ip net.IP) *HostInfo {
+		return &HostInfo{
+			ConnectionState: &ConnectionState{peerCert: &cert.NebulaCertificate{}},
+			vpnIp:           iputil.Ip2VpnIp(ip),
+		}
+	}
+	h1 := peer(net.IPv4(1, 2, 3, 5))
+	h2 := peer(net.IPv4(1, 2, 3, 6))
+
+	tcp := firewall.Packet{LocalIP: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)), RemoteIP: h1.vpnIp, LocalPort: 22, RemotePort: 50000, Protocol: firewall.ProtoTCP}
+	udp := firewall.Packet{LocalIP: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)), RemoteIP: h1.vpnIp, LocalPort: 40000, RemotePort: 53, Protocol: firewall.ProtoUDP}
+	icmp := firewall.Packet{LocalIP: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)), RemoteIP: h2.vpnIp, Protocol: firewall.ProtoICMP}
+	assert.NoError(t, fw.Drop([]byte{}, tcp, true, h1, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, udp, false, h1, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, icmp, false, h2, cp, nil))
+
+	// Bytes are only reported while flow_export is counting them
+	fw.Conntrack.Conns[tcp].flow = &connFlow{bytes: [2]uint64{100, 200}}
+
+	entries := fw.DumpConntrack(0, firewall.ProtoAny)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, ConntrackEntry{
+		Protocol:   "tcp",
+		LocalIP:    "1.2.3.4",
+		LocalPort:  22,
+		RemoteIP:   "1.2.3.5",
+		RemotePort: 50000,
+		Direction:  "inbound",
+		Peer:       "1.2.3.5",
+		Age:        "0s",
+		ExpiresIn:  "1m0s",
+		BytesIn:    &[]uint64{100}[0],
+		BytesOut:   &[]uint64{200}[0],
+	}, entries[1])
+	assert.Equal(t, "udp", entries[0].Protocol)
+	assert.Equal(t, "outbound", entries[0].Direction)
+	assert.Nil(t, entries[0].BytesIn)
+	assert.Equal(t, "icmp", entries[2].Protocol)
+	assert.Equal(t, "1.2.3.6", entries[2].Peer)
+
+	b, err := json.Marshal(entries[0])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"protocol":"udp","localIp":"1.2.3.4","localPort":40000,"remoteIp":"1.2.3.5","remotePort":53,"direction":"outbound","peer":"1.2.3.5","age":"0s","expiresIn":"1m0s"}`, string(b))
+
+	// Filter by peer, protocol, or both
+	entries = fw.DumpConntrack(h2.vpnIp, firewall.ProtoAny)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "icmp", entries[0].Protocol)
+
+	entries = fw.DumpConntrack(0, firewall.ProtoTCP)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint16(22), entries[0].LocalPort)
+
+	assert.Empty(t, fw.DumpConntrack(h2.vpnIp, firewall.ProtoTCP))
+}
+
+func TestFirewall_GroupMap(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Ips: []*net.IPNet{&ipNet}}}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"group_map": map[interface{}]interface{}{
+			"team-a": "internal",
+			"team-b": "internal",
+			"ops":    []interface{}{"internal", "admin"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "admin"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "group": "internal"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "groups": []interface{}{"internal", "team-a"}},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"team-a": {"internal"},
+		"team-b": {"internal"},
+		"ops":    {"internal", "admin"},
+	}, fw.Dump().GroupMap)
+
+	drop := func(port uint16, groups ...string) error {
+		c := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:           "host1",
+				Ips:            []*net.IPNet{&ipNet},
+				Groups:         groups,
+				InvertedGroups: map[string]struct{}{},
+			},
+		}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+		h.CreateRemoteCIDR(&c)
+
+		resetConntrack(fw)
+		p := firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+			LocalPort:  port,
+			RemotePort: 1000,
+			Protocol:   firewall.ProtoTCP,
+		}
+		return fw.Drop([]byte{}, p, true, &h, cp, nil)
+	}
+
+	// Many certificate groups map to one rule group
+	assert.NoError(t, drop(80, "team-a"))
+	assert.NoError(t, drop(80, "team-b"))
+	assert.NoError(t, drop(80, "ops"))
+	assert.Equal(t, ErrNoMatchingRule, drop(80, "team-c"))
+
+	// The rule group itself still matches
+	assert.NoError(t, drop(80, "internal"))
+
+	// One certificate group can map to many rule groups
+	assert.NoError(t, drop(22, "ops"))
+	assert.Equal(t, ErrNoMatchingRule, drop(22, "team-a"))
+
+	// All groups in a rule must be satisfied, mapped or not
+	assert.NoError(t, drop(443, "team-a"))
+	assert.Equal(t, ErrNoMatchingRule, drop(443, "team-b"))
+	assert.NoError(t, drop(443, "team-b", "team-a"))
+
+	// Matching through the mapping does not allocate per packet
+	opsCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{InvertedGroups: map[string]struct{}{"ops": {}}}}
+	p := firewall.Packet{LocalPort: 22, Protocol: firewall.ProtoTCP}
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		fw.InRules.match(p, true, opsCert, cp)
+	}))
+
+	// The mapping is part of the rule hash
+	delete(conf.Settings["firewall"].(map[interface{}]interface{}), "group_map")
+	fw2, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+	assert.NotEqual(t, fw.GetRuleHash(), fw2.GetRuleHash())
+	assert.Nil(t, fw2.Dump().GroupMap)
+}
+
+func TestFirewall_drainConntrack(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Ips: []*net.IPNet{&ipNet}}}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"group_map": map[interface{}]interface{}{"team-a": "internal"},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "group": "internal"},
+			map[interface{}]interface{}{"port": "443", "proto": "tcp", "group": "team-a"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+
+	peerCert := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}},
+			Groups:         []string{"team-a"},
+			InvertedGroups: map[string]struct{}{"team-a": {}},
+		},
+	}
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: peerCert}, vpnIp: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5))}
+	h.CreateRemoteCIDR(peerCert)
+
+	packet := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  port,
+			RemotePort: 1000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	// One flow is only allowed through the mapped group, the other by the certificate group itself
+	assert.NoError(t, fw.Drop([]byte{}, packet(80), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(443), true, h, cp, nil))
+	assert.Len(t, fw.Conntrack.Conns, 2)
+
+	// Removing the mapping drains the flow it allowed and keeps the other
+	delete(conf.Settings["firewall"].(map[interface{}]interface{}), "group_map")
+	fw2, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+	fw2.Conntrack = fw.Conntrack
+	fw2.rulesVersion = fw.rulesVersion + 1
+
+	drained := metrics.GetOrRegisterCounter("firewall.conntrack.drained", nil)
+	before := drained.Count()
+	peers := func(vpnIp iputil.VpnIp) *HostInfo {
+		if vpnIp == h.vpnIp {
+			return h
+		}
+		return nil
+	}
+	assert.Equal(t, 1, fw2.drainConntrack(peers, cp))
+	assert.Equal(t, before+1, drained.Count())
+	assert.NotContains(t, fw2.Conntrack.Conns, packet(80))
+	assert.Equal(t, fw2.rulesVersion, fw2.Conntrack.Conns[packet(443)].rulesVersion)
+	assert.Equal(t, ErrNoMatchingRule, fw2.Drop([]byte{}, packet(80), true, h, cp, nil))
+
+	// Entries already checked against this rule set, or for peers we no longer have a tunnel to, are left alone
+	assert.Equal(t, 0, fw2.drainConntrack(peers, cp))
+	fw2.rulesVersion++
+	assert.Equal(t, 0, fw2.drainConntrack(func(iputil.VpnIp) *HostInfo { return nil }, cp))
+	assert.Len(t, fw2.Conntrack.Conns, 1)
+}
+
+func TestParseFirewallGroupMap(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	groupMap, err := parseFirewallGroupMap(c)
+	assert.NoError(t, err)
+	assert.Nil(t, groupMap)
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"group_map": map[interface{}]interface{}{"a": 1}}
+	_, err = parseFirewallGroupMap(c)
+	assert.EqualError(t, err, "firewall.group_map entry a must be a group name or a list of group names")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"group_map": map[interface{}]interface{}{"a": []interface{}{"b", 1}}}
+	_, err = parseFirewallGroupMap(c)
+	assert.EqualError(t, err, "firewall.group_map entry a must be a group name or a list of group names")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"group_map": map[interface{}]interface{}{"a": "any"}}
+	_, err = parseFirewallGroupMap(c)
+	assert.EqualError(t, err, "firewall.group_map entry a can not map to \"any\"")
+}
+
+func TestFirewall_Simulate(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnIp: iputil.Ip2VpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		RemoteIP:   iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4)),
+		LocalPort:  443,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 0, 0, []string{}, "any", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "any", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoTCP, 443, 443, []string{"default-group"}, "", nil, nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// Allowed by the 3rd rule
+	v := fw.Simulate(p, true, &h, cp)
+	assert.Equal(t, "allow", v.Verdict)
+	assert.Equal(t, &FirewallRuleInfo{Proto: "tcp", StartPort: 443, EndPort: 443, Groups: []string{"default-group"}}, v.Rule)
+
+	// Simulating does not create conntrack entries
+	assert.Empty(t, fw.Conntrack.Conns)
+
+	// No outbound rules
+	v = fw.Simulate(p, false, &h, cp)
+	assert.Equal(t, FirewallVerdict{Verdict: "deny", Reason: ErrNoMatchingRule.Error()}, v)
+
+	// No tunnel, no certificate to evaluate with
+	v = fw.Simulate(p, true, nil, cp)
+	assert.Equal(t, "unknown", v.Verdict)
+
+	// Remote does not match the peer certificate
+	p2 := p
+	p2.RemoteIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 10))
+	v = fw.Simulate(p2, true, &h, cp)
+	assert.Equal(t, FirewallVerdict{Verdict: "deny", Reason: ErrInvalidRemoteIP.Error()}, v)
+
+	// Not one of our ips
+	p2 = p
+	p2.LocalIP = iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 10))
+	v = fw.Simulate(p2, true, &h, cp)
+	assert.Equal(t, FirewallVerdict{Verdict: "deny", Reason: ErrInvalidLocalIP.Error()}, v)
+
+	// Outbound is allowed once conntrack knows about it
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	v = fw.Simulate(p, false, &h, cp)
+	assert.Equal(t, "allow", v.Verdict)
+	assert.Nil(t, v.Rule)
+}
+
+func TestFirewall_MixedFamilies(t *testing.T) {
+	l := test.NewLogger()
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			InvertedGroups: map[string]struct{}{},
+		},
+	}
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{
+		map[interface{}]interface{}{"port": "80", "proto": "tcp", "cidr": "10.0.0.0/8"},
+		map[interface{}]interface{}{"port": "80", "proto": "tcp", "cidr": "fd00::/8"},
+		map[interface{}]interface{}{"port": "22", "proto": "tcp", "cidr": "0.0.0.0/0"},
+		map[interface{}]interface{}{"port": "53", "proto": "udp", "cidr": "::/0"},
+		map[interface{}]interface{}{"code": "any", "proto": "icmp", "local_cidr": "fd01::/16"},
+	}}
+
+	fw := NewFirewall(l, nil, time.Second, time.Minute, time.Hour, c)
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, fw))
+	cp := cert.NewCAPool()
+
+	v4 := func(remote string, proto uint8, port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:   iputil.Ip2VpnIp(net.ParseIP("10.1.1.1")),
+			RemoteIP:  iputil.Ip2VpnIp(net.ParseIP(remote)),
+			LocalPort: port,
+			Protocol:  proto,
+		}
+	}
+
+	v6 := func(local, remote string, proto uint8, port uint16) firewall.Packet {
+		p := firewall.Packet{IPv6: true, LocalPort: port, Protocol: proto}
+		copy(p.LocalIP6[:], net.ParseIP(local))
+		copy(p.RemoteIP6[:], net.ParseIP(remote))
+		return p
+	}
+
+	// Each cidr only matches its own family
+	assert.True(t, fw.InRules.match(v4("10.2.2.2", firewall.ProtoTCP, 80), true, c, cp))
+	assert.False(t, fw.InRules.match(v4("192.168.0.1", firewall.ProtoTCP, 80), true, c, cp))
+	assert.True(t, fw.InRules.match(v6("fe80::1", "fd00::2", firewall.ProtoTCP, 80), true, c, cp))
+	assert.False(t, fw.InRules.match(v6("fe80::1", "2001:db8::1", firewall.ProtoTCP, 80), true, c, cp))
+
+	// 0.0.0.0/0 is any ipv4 address and nothing else
+	assert.True(t, fw.InRules.match(v4("192.168.0.1", firewall.ProtoTCP, 22), true, c, cp))
+	assert.False(t, fw.InRules.match(v6("fe80::1", "2001:db8::1", firewall.ProtoTCP, 22), true, c, cp))
+
+	// ::/0 is any ipv6 address and nothing else
+	assert.True(t, fw.InRules.match(v6("fe80::1", "2001:db8::1", firewall.ProtoUDP, 53), true, c, cp))
+	assert.False(t, fw.InRules.match(v4("192.168.0.1", firewall.ProtoUDP, 53), true, c, cp))
+
+	// An ipv4-mapped address is still an ipv6 packet
+	assert.False(t, fw.InRules.match(v6("fe80::1", "::ffff:10.2.2.2", firewall.ProtoTCP, 80), true, c, cp))
+
+	// icmp rules match icmpv6
+	assert.True(t, fw.InRules.match(v6("fd01::1", "2001:db8::1", firewall.ProtoICMPv6, 0), true, c, cp))
+	assert.False(t, fw.InRules.match(v6("fd02::1", "2001:db8::1", firewall.ProtoICMPv6, 0), true, c, cp))
+	assert.False(t, fw.InRules.match(v4("10.2.2.2", firewall.ProtoICMP, 0), true, c, cp))
+
+	// A certificate without ipv6 subnets never makes it past the remote check
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: c}, vpnIp: iputil.Ip2VpnIp(net.ParseIP("10.2.2.2"))}
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop([]byte{}, v6("fe80::1", "fd00::2", firewall.ProtoTCP, 80), true, h, cp, nil))
+
+	// Ipv6 subnets in the certificates authorize ipv6 addresses on both ends
+	_, local6, _ := net.ParseCIDR("fe80::/64")
+	_, remote6, _ := net.ParseCIDR("fd00::/64")
+	fw.setLocalIps(&cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Subnets: []*net.IPNet{local6}}})
+	c.Details.Ips = []*net.IPNet{{IP: net.ParseIP("10.2.2.2").To4(), Mask: net.IPMask{255, 255, 255, 0}}}
+	c.Details.Subnets = []*net.IPNet{remote6}
+	h.CreateRemoteCIDR(c)
+	assert.NoError(t, fw.Drop([]byte{}, v6("fe80::1", "fd00::2", firewall.ProtoTCP, 80), true, h, cp, nil))
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop([]byte{}, v6("fe80::1", "fd00:1::2", firewall.ProtoTCP, 80), true, h, cp, nil))
+	assert.Equal(t, ErrInvalidLocalIP, fw.Drop([]byte{}, v6("fe80:1::1", "fd00::2", firewall.ProtoTCP, 80), true, h, cp, nil))
+}
+
+func TestFirewall_CidrSets(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Ips: []*net.IPNet{&ipNet}}}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{
+			"office": []interface{}{"10.0.0.0/24", "10.1.0.0/24"},
+		},
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "cidr": "@office"},
+		},
+	}
+
+	drop := func(fw *Firewall, remote string) error {
+		c := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:           "host1",
+				Ips:            []*net.IPNet{{IP: net.ParseIP(remote).To4(), Mask: net.IPv4Mask(255, 255, 255, 255)}},
+				InvertedGroups: map[string]struct{}{},
+			},
+		}
+		h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(net.ParseIP(remote))}
+		h.CreateRemoteCIDR(&c)
+
+		resetConntrack(fw)
+		p := firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   iputil.Ip2VpnIp(net.ParseIP(remote)),
+			LocalPort:  80,
+			RemotePort: 1000,
+			Protocol:   firewall.ProtoTCP,
+		}
+		return fw.Drop([]byte{}, p, true, &h, cp, nil)
+	}
+
+	// Every cidr in the set matches
+	fw, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+	assert.NoError(t, drop(fw, "10.0.0.5"))
+	assert.NoError(t, drop(fw, "10.1.0.5"))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, "10.2.0.5"))
+
+	// Reloading the set changes the rules that reference it
+	assert.NoError(t, conf.ReloadConfigString("firewall:\n  cidr_sets:\n    office: [10.2.0.0/24]\n  inbound:\n    - port: 80\n      proto: tcp\n      cidr: \"@office\"\n"))
+	assert.True(t, conf.HasChanged("firewall"))
+	fw2, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+	assert.NotEqual(t, fw.GetRuleHash(), fw2.GetRuleHash())
+	assert.Equal(t, ErrNoMatchingRule, drop(fw2, "10.0.0.5"))
+	assert.NoError(t, drop(fw2, "10.2.0.5"))
+
+	// local_cidr resolves sets too
+	mf := &mockFirewall{}
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{"lan": []interface{}{"192.168.0.0/16"}},
+		"inbound":   []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "local_cidr": "@lan"}},
+	}
+	assert.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	_, lan, _ := net.ParseCIDR("192.168.0.0/16")
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, host: "a", localIp: lan}, mf.lastCall)
+
+	// Unknown and invalid sets are errors
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "cidr": "@nope"}},
+	}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; cidr references unknown cidr set `nope`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{"lan": []interface{}{"192.168.0.0"}},
+	}
+	_, err = parseFirewallCidrSets(conf)
+	assert.EqualError(t, err, "firewall.cidr_sets entry lan has an invalid cidr; invalid CIDR address: 192.168.0.0")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{"lan": []interface{}{}},
+	}
+	_, err = parseFirewallCidrSets(conf)
+	assert.EqualError(t, err, "firewall.cidr_sets entry lan must be a list of cidrs")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"cidr_sets": map[interface{}]interface{}{"my lan": []interface{}{"192.168.0.0/16"}},
+	}
+	_, err = parseFirewallCidrSets(conf)
+	assert.EqualError(t, err, "firewall.cidr_sets name \"my lan\" must only contain letters, numbers, _ and -")
+}
+
 func TestAddFirewallRulesFromConfig(t *testing.T) {
 	l := test.NewLogger()
 	// Test adding tcp rule
@@ -814,6 +1431,93 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	mf.nextCallReturn = errors.New("test error")
 	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a"}}}
 	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; `test error`")
+
+	// Test remote_port
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "remote_port": "1000-2000"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, host: "a", remoteStartPort: 1000, remoteEndPort: 2000}, mf.lastCall)
+
+	for _, v := range []string{"any", "fragment", "0", "70000", "2000-1000", "a"} {
+		conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "remote_port": v}}}
+		assert.Error(t, AddFirewallRulesFromConfig(l, true, conf, mf), "remote_port %v", v)
+	}
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "remote_port": "4242"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, false, conf, mf), "firewall.outbound rule #0; remote_port is only supported for inbound rules")
+
+	// A firewall that only implements FirewallInterface refuses remote_port rules and still takes the others
+	addRuleOnly := struct{ FirewallInterface }{mf}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "host": "a", "remote_port": "4242"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, addRuleOnly), "firewall.inbound rule #0; remote_port is not supported by this firewall")
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "2", "proto": "any", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, addRuleOnly))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 2, endPort: 2, host: "a"}, mf.lastCall)
+}
+
+func TestFirewall_DropRemotePort(t *testing.T) {
+	l := test.NewLogger()
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+	myCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Ips: []*net.IPNet{&ipNet}}}
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "host": "any", "remote_port": "4242"},
+			map[interface{}]interface{}{"port": "80", "proto": "tcp", "host": "any"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, myCert, conf)
+	assert.NoError(t, err)
+
+	peerCert := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{{IP: net.IPv4(1, 2, 3, 5), Mask: net.IPMask{255, 255, 255, 0}}},
+			InvertedGroups: map[string]struct{}{},
+		},
+	}
+	h := &HostInfo{
+		ConnectionState: &ConnectionState{peerCert: peerCert},
+		vpnIp:           iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5)),
+		remote:          udp.NewAddr(net.IPv4(192, 0, 2, 1), 4242),
+	}
+	h.CreateRemoteCIDR(peerCert)
+
+	packet := func(port uint16) firewall.Packet {
+		return firewall.Packet{
+			LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+			RemoteIP:   h.vpnIp,
+			LocalPort:  port,
+			RemotePort: 1000,
+			Protocol:   firewall.ProtoTCP,
+		}
+	}
+
+	// The inner ports are unaffected, only the underlay port is checked
+	assert.NoError(t, fw.Drop([]byte{}, packet(22), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(80), true, h, cp, nil))
+	assert.Equal(t, "allow", fw.Simulate(packet(22), true, h, cp).Verdict)
+
+	// From another underlay port the rule does not apply, rules without remote_port still do
+	resetConntrack(fw)
+	h.remote = udp.NewAddr(net.IPv4(192, 0, 2, 1), 4243)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(22), true, h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, packet(80), true, h, cp, nil))
+	assert.Equal(t, "deny", fw.Simulate(packet(22), true, h, cp).Verdict)
+
+	// Relayed peers have no underlay port and never match
+	h.remote = nil
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, packet(22), true, h, cp, nil))
+
+	// The dump shows the remote port
+	assert.Equal(t, int32(4242), fw.Dump().Inbound[0].RemoteStartPort)
+	assert.Equal(t, int32(4242), fw.Dump().Inbound[0].RemoteEndPort)
 }
 
 func TestTCPRTTTracking(t *testing.T) {
@@ -954,6 +1658,9 @@ type addRuleCall struct {
 	localIp   *net.IPNet
 	caName    string
 	caSha     string
+
+	remoteStartPort int32
+	remoteEndPort   int32
 }
 
 type mockFirewall struct {
@@ -980,8 +1687,87 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 	return err
 }
 
+func (mf *mockFirewall) AddRemotePortRule(proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, localIp *net.IPNet, caName string, caSha string, remoteStartPort int32, remoteEndPort int32) error {
+	err := mf.AddRule(true, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	mf.lastCall.remoteStartPort = remoteStartPort
+	mf.lastCall.remoteEndPort = remoteEndPort
+	return err
+}
+
 func resetConntrack(fw *Firewall) {
 	fw.Conntrack.Lock()
 	fw.Conntrack.Conns = map[firewall.Packet]*conn{}
 	fw.Conntrack.Unlock()
 }
+
+func TestFirewall_logDefaultDeny(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"web", "ops"},
+			InvertedGroups: map[string]struct{}{"web": {}, "ops": {}},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, vpnIp: iputil.Ip2VpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log_default_deny":        true,
+		"log_default_deny_sample": 0,
+	}
+	_, err := NewFirewallFromConfig(l, &c, conf)
+	assert.EqualError(t, err, "firewall.log_default_deny_sample must be greater than 0: 0")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{
+		"log_default_deny":        true,
+		"log_default_deny_sample": 2,
+		"inbound": []interface{}{
+			map[interface{}]interface{}{"port": "22", "proto": "tcp", "group": "ops"},
+		},
+	}
+	fw, err := NewFirewallFromConfig(l, &c, conf)
+	assert.NoError(t, err)
+	cp := cert.NewCAPool()
+	ob.Reset()
+
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   iputil.Ip2VpnIp(ipNet.IP),
+		LocalPort:  22,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// Allowed traffic is never logged
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Empty(t, ob.String())
+
+	// The first of every 2 default denies is logged with the groups that were refused
+	p.LocalPort = 80
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Contains(t, ob.String(), "Packet denied by default, no firewall rule matched")
+	assert.Contains(t, ob.String(), "groups=\"[web ops]\"")
+	assert.Contains(t, ob.String(), "certName=host1")
+	assert.Contains(t, ob.String(), "fwPacket=\"{1.2.3.4 1.2.3.4 80 5000 6 ")
+
+	ob.Reset()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Empty(t, ob.String())
+
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.NotEmpty(t, ob.String())
+
+	// Nothing is logged unless enabled
+	fw, err = NewFirewallFromConfig(l, &c, config.NewC(l))
+	assert.NoError(t, err)
+	ob.Reset()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Empty(t, ob.String())
+}
@@ -0,0 +1,276 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+// IPFIX (rfc7011) encoding of the flow records, every record uses the single template below
+const (
+	ipfixVersion       = 10
+	ipfixHeaderLen     = 16
+	ipfixSetHeaderLen  = 4
+	ipfixTemplateSetID = 2
+	ipfixTemplateID    = 256
+
+	// ipfixMaxLen keeps messages inside of a single udp packet on common underlay mtus
+	ipfixMaxLen = 1400
+
+	// flowTemplateInterval is how often the template is sent again for collectors that started after us
+	flowTemplateInterval = time.Minute
+	flowFlushInterval    = time.Second
+
+	flowIngress = 0
+	flowEgress  = 1
+)
+
+// ipfixFields is the template, pairs of information element id and length. The peer vpn ip is reported as the next hop
+// since it is the host the flow was tunneled to or from.
+var ipfixFields = [][2]uint16{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{61, 1},  // flowDirection
+	{15, 4},  // ipNextHopIPv4Address
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+const ipfixRecordLen = 50
+
+// connFlow counts the traffic of a conntrack entry while flow_export is enabled, indexed by flowIngress and flowEgress
+type connFlow struct {
+	peer    iputil.VpnIp
+	start   time.Time
+	last    time.Time
+	packets [2]uint64
+	bytes   [2]uint64
+}
+
+func (cf *connFlow) count(incoming bool, n int) {
+	d := flowEgress
+	if incoming {
+		d = flowIngress
+	}
+
+	cf.packets[d]++
+	cf.bytes[d] += uint64(n)
+	cf.last = time.Now()
+}
+
+// flowRecord is a single direction of a finished flow
+type flowRecord struct {
+	src, dst         iputil.VpnIp
+	srcPort, dstPort uint16
+	proto            uint8
+	direction        uint8
+	peer             iputil.VpnIp
+	bytes, packets   uint64
+	start, end       time.Time
+}
+
+// flowRecords turns a finished conntrack entry into a record for each direction that saw traffic
+func flowRecords(fp firewall.Packet, cf *connFlow) []flowRecord {
+	var records []flowRecord
+	for d := range cf.packets {
+		if cf.packets[d] == 0 {
+			continue
+		}
+
+		r := flowRecord{
+			src:       fp.RemoteIP,
+			dst:       fp.LocalIP,
+			srcPort:   fp.RemotePort,
+			dstPort:   fp.LocalPort,
+			proto:     fp.Protocol,
+			direction: uint8(d),
+			peer:      cf.peer,
+			bytes:     cf.bytes[d],
+			packets:   cf.packets[d],
+			start:     cf.start,
+			end:       cf.last,
+		}
+
+		if d == flowEgress {
+			r.src, r.dst = r.dst, r.src
+			r.srcPort, r.dstPort = r.dstPort, r.srcPort
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
+
+// flowExporter sends the flow records of expired conntrack entries to an IPFIX collector
+type flowExporter struct {
+	l      *logrus.Logger
+	conn   net.Conn
+	domain uint32
+
+	records chan flowRecord
+
+	// seq is the number of data records sent so far, as required in the message header
+	seq          uint32
+	lastTemplate time.Time
+
+	metricExported metrics.Counter
+	metricDropped  metrics.Counter
+}
+
+// newFlowExporterFromConfig returns nil if flow_export.collector is not set
+func newFlowExporterFromConfig(ctx context.Context, l *logrus.Logger, c *config.C) (*flowExporter, error) {
+	collector := c.GetString("flow_export.collector", "")
+	if collector == "" {
+		return nil, nil
+	}
+
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("flow_export.collector is invalid: %w", err)
+	}
+
+	// Parsed directly as a uint32, an int can not hold every observation domain on 32 bit platforms
+	rawDomain := c.GetString("flow_export.observation_domain", "0")
+	domain, err := strconv.ParseUint(rawDomain, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("flow_export.observation_domain must be a uint32: %v", rawDomain)
+	}
+
+	buffer := c.GetInt("flow_export.buffer", 4096)
+	if buffer < 1 {
+		return nil, fmt.Errorf("flow_export.buffer must be greater than 0: %v", buffer)
+	}
+
+	fe := newFlowExporter(l, util.MetricsRegistry(c), conn, uint32(domain), buffer)
+	go fe.run(ctx)
+	return fe, nil
+}
+
+func newFlowExporter(l *logrus.Logger, registry metrics.Registry, conn net.Conn, domain uint32, buffer int) *flowExporter {
+	return &flowExporter{
+		l:              l,
+		conn:           conn,
+		domain:         domain,
+		records:        make(chan flowRecord, buffer),
+		metricExported: metrics.GetOrRegisterCounter("flow_export.exported", registry),
+		metricDropped:  metrics.GetOrRegisterCounter("flow_export.dropped", registry),
+	}
+}
+
+// add queues the records of a finished flow, they are dropped if the exporter can not keep up
+func (fe *flowExporter) add(records []flowRecord) {
+	for _, r := range records {
+		select {
+		case fe.records <- r:
+		default:
+			fe.metricDropped.Inc(1)
+		}
+	}
+}
+
+func (fe *flowExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(flowFlushInterval)
+	defer ticker.Stop()
+	defer fe.conn.Close()
+
+	var batch []flowRecord
+	for {
+		select {
+		case <-ctx.Done():
+			fe.flush(batch)
+			return
+
+		case r := <-fe.records:
+			batch = append(batch, r)
+			if ipfixHeaderLen+fe.templateLen(time.Now())+ipfixSetHeaderLen+(len(batch)+1)*ipfixRecordLen > ipfixMaxLen {
+				fe.flush(batch)
+				batch = batch[:0]
+			}
+
+		case <-ticker.C:
+			fe.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (fe *flowExporter) flush(batch []flowRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	_, err := fe.conn.Write(fe.encode(batch, time.Now()))
+	if err != nil {
+		fe.metricDropped.Inc(int64(len(batch)))
+		fe.l.WithError(err).WithField("records", len(batch)).Error("Failed to send flow records")
+		return
+	}
+
+	fe.metricExported.Inc(int64(len(batch)))
+}
+
+// templateLen is the size of the template set if it is due to be sent with the next message
+func (fe *flowExporter) templateLen(now time.Time) int {
+	if now.Sub(fe.lastTemplate) < flowTemplateInterval {
+		return 0
+	}
+	return ipfixSetHeaderLen + 4 + len(ipfixFields)*4
+}
+
+// encode builds a single IPFIX message holding records, with the template set when it is due
+func (fe *flowExporter) encode(records []flowRecord, now time.Time) []byte {
+	tl := fe.templateLen(now)
+	b := make([]byte, ipfixHeaderLen, ipfixHeaderLen+tl+ipfixSetHeaderLen+len(records)*ipfixRecordLen)
+
+	binary.BigEndian.PutUint16(b[0:2], ipfixVersion)
+	binary.BigEndian.PutUint32(b[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:12], fe.seq)
+	binary.BigEndian.PutUint32(b[12:16], fe.domain)
+
+	if tl > 0 {
+		b = binary.BigEndian.AppendUint16(b, ipfixTemplateSetID)
+		b = binary.BigEndian.AppendUint16(b, uint16(tl))
+		b = binary.BigEndian.AppendUint16(b, ipfixTemplateID)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(ipfixFields)))
+		for _, f := range ipfixFields {
+			b = binary.BigEndian.AppendUint16(b, f[0])
+			b = binary.BigEndian.AppendUint16(b, f[1])
+		}
+		fe.lastTemplate = now
+	}
+
+	b = binary.BigEndian.AppendUint16(b, ipfixTemplateID)
+	b = binary.BigEndian.AppendUint16(b, uint16(ipfixSetHeaderLen+len(records)*ipfixRecordLen))
+	for _, r := range records {
+		b = binary.BigEndian.AppendUint32(b, uint32(r.src))
+		b = binary.BigEndian.AppendUint32(b, uint32(r.dst))
+		b = binary.BigEndian.AppendUint16(b, r.srcPort)
+		b = binary.BigEndian.AppendUint16(b, r.dstPort)
+		b = append(b, r.proto, r.direction)
+		b = binary.BigEndian.AppendUint32(b, uint32(r.peer))
+		b = binary.BigEndian.AppendUint64(b, r.bytes)
+		b = binary.BigEndian.AppendUint64(b, r.packets)
+		b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	}
+
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	fe.seq += uint32(len(records))
+	return b
+}
@@ -0,0 +1,147 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newFlowExporterFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	fe, err := newFlowExporterFromConfig(context.Background(), l, c)
+	assert.NoError(t, err)
+	assert.Nil(t, fe)
+
+	c.Settings["flow_export"] = map[interface{}]interface{}{"collector": "127.0.0.1:4739", "observation_domain": -1}
+	_, err = newFlowExporterFromConfig(context.Background(), l, c)
+	assert.EqualError(t, err, "flow_export.observation_domain must be a uint32: -1")
+
+	c.Settings["flow_export"] = map[interface{}]interface{}{"collector": "127.0.0.1:4739", "observation_domain": int64(4294967296)}
+	_, err = newFlowExporterFromConfig(context.Background(), l, c)
+	assert.EqualError(t, err, "flow_export.observation_domain must be a uint32: 4294967296")
+
+	// The whole uint32 range is usable on every platform
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Settings["flow_export"] = map[interface{}]interface{}{"collector": "127.0.0.1:4739", "observation_domain": int64(4294967295)}
+	fe, err = newFlowExporterFromConfig(ctx, l, c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4294967295), fe.domain)
+
+	c.Settings["flow_export"] = map[interface{}]interface{}{"collector": "nope"}
+	_, err = newFlowExporterFromConfig(context.Background(), l, c)
+	assert.ErrorContains(t, err, "flow_export.collector is invalid")
+}
+
+func TestFlowExporter_completedFlow(t *testing.T) {
+	l := test.NewLogger()
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer collector.Close()
+
+	conn, err := net.Dial("udp", collector.LocalAddr().String())
+	assert.NoError(t, err)
+	fe := newFlowExporter(l, nil, conn, 7, 16)
+
+	ipNet := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPMask{255, 255, 255, 0}}
+	c := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+		},
+	}
+	peerIp := iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2))
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: c}, vpnIp: peerIp}
+
+	fw := NewFirewall(l, nil, time.Minute, time.Minute, time.Minute, c)
+	assert.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", nil, nil, "", ""))
+	fw.flows = fe
+	cp := cert.NewCAPool()
+
+	// A request in and 2 replies out, the conntrack cache must not hide packets from the counts
+	p := firewall.Packet{
+		LocalIP:    iputil.Ip2VpnIp(ipNet.IP),
+		RemoteIP:   peerIp,
+		LocalPort:  80,
+		RemotePort: 5000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	localCache := firewall.ConntrackCache{}
+	assert.NoError(t, fw.Drop(make([]byte, 100), p, true, h, cp, localCache))
+	assert.NoError(t, fw.Drop(make([]byte, 60), p, false, h, cp, localCache))
+	assert.NoError(t, fw.Drop(make([]byte, 60), p, false, h, cp, localCache))
+
+	// Expire the flow
+	fw.Conntrack.Lock()
+	fw.Conntrack.Conns[p].Expires = time.Now().Add(-time.Second)
+	fw.evict(p)
+	fw.Conntrack.Unlock()
+	assert.Empty(t, fw.Conntrack.Conns)
+
+	records := []flowRecord{<-fe.records, <-fe.records}
+	fe.flush(records)
+
+	b := make([]byte, 2000)
+	n, err := collector.Read(b)
+	assert.NoError(t, err)
+	b = b[:n]
+
+	// Message header
+	assert.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(b[0:2]))
+	assert.Equal(t, uint16(n), binary.BigEndian.Uint16(b[2:4]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(b[8:12]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(b[12:16]))
+
+	// The template goes out with the first message
+	b = b[ipfixHeaderLen:]
+	assert.Equal(t, uint16(ipfixTemplateSetID), binary.BigEndian.Uint16(b[0:2]))
+	tl := int(binary.BigEndian.Uint16(b[2:4]))
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(b[4:6]))
+	assert.Equal(t, uint16(len(ipfixFields)), binary.BigEndian.Uint16(b[6:8]))
+	b = b[tl:]
+
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(b[0:2]))
+	assert.Equal(t, uint16(ipfixSetHeaderLen+2*ipfixRecordLen), binary.BigEndian.Uint16(b[2:4]))
+	b = b[ipfixSetHeaderLen:]
+
+	assertRecord := func(r []byte, src, dst iputil.VpnIp, srcPort, dstPort uint16, direction uint8, bytes, packets uint64) {
+		assert.Equal(t, uint32(src), binary.BigEndian.Uint32(r[0:4]))
+		assert.Equal(t, uint32(dst), binary.BigEndian.Uint32(r[4:8]))
+		assert.Equal(t, srcPort, binary.BigEndian.Uint16(r[8:10]))
+		assert.Equal(t, dstPort, binary.BigEndian.Uint16(r[10:12]))
+		assert.Equal(t, uint8(firewall.ProtoTCP), r[12])
+		assert.Equal(t, direction, r[13])
+		assert.Equal(t, uint32(peerIp), binary.BigEndian.Uint32(r[14:18]))
+		assert.Equal(t, bytes, binary.BigEndian.Uint64(r[18:26]))
+		assert.Equal(t, packets, binary.BigEndian.Uint64(r[26:34]))
+
+		start := binary.BigEndian.Uint64(r[34:42])
+		end := binary.BigEndian.Uint64(r[42:50])
+		assert.NotZero(t, start)
+		assert.GreaterOrEqual(t, end, start)
+	}
+
+	assertRecord(b[:ipfixRecordLen], peerIp, p.LocalIP, 5000, 80, flowIngress, 100, 1)
+	assertRecord(b[ipfixRecordLen:], p.LocalIP, peerIp, 80, 5000, flowEgress, 120, 2)
+
+	// The next message picks up the sequence and leaves the template out
+	msg := fe.encode(records[:1], time.Now())
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(msg[8:12]))
+	assert.Equal(t, uint16(ipfixTemplateID), binary.BigEndian.Uint16(msg[ipfixHeaderLen:]))
+	assert.Len(t, msg, ipfixHeaderLen+ipfixSetHeaderLen+ipfixRecordLen)
+}
@@ -0,0 +1,204 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// Every fragment payload starts with this header, before encryption:
+// | Packet id (uint32) | Fragment index (uint8) | Fragment count (uint8) |
+const fragmentHeaderLen = 6
+
+// maxFragments is bounded by the uint8 fragment count
+const maxFragments = 255
+
+var ErrTooManyFragments = errors.New("packet would need too many fragments")
+
+type fragmentKey struct {
+	localIndex uint32
+	id         uint32
+}
+
+type fragmentBuffer struct {
+	chunks   [][]byte
+	received int
+	size     int
+	created  time.Time
+}
+
+// fragmenter splits inner packets that are larger than size into multiple messages and reassembles them on receipt.
+// Reassembly is bounded by bufferSize bytes in flight and incomplete packets are dropped after timeout.
+type fragmenter struct {
+	sync.Mutex
+
+	size       int
+	bufferSize int
+	timeout    time.Duration
+
+	nextId    atomic.Uint32
+	pending   map[fragmentKey]*fragmentBuffer
+	buffered  int
+	lastPurge time.Time
+
+	metricSent        metrics.Counter
+	metricReassembled metrics.Counter
+	metricDropped     metrics.Counter
+}
+
+// newFragmenterFromConfig returns nil if tun.fragment is not enabled
+func newFragmenterFromConfig(c *config.C) (*fragmenter, error) {
+	if !c.GetBool("tun.fragment", false) {
+		return nil, nil
+	}
+
+	size := c.GetInt("tun.fragment_size", 1300)
+	if size <= fragmentHeaderLen {
+		return nil, fmt.Errorf("tun.fragment_size must be greater than %v: %v", fragmentHeaderLen, size)
+	}
+
+	bufferSize := c.GetInt("tun.fragment_buffer", 4*1024*1024)
+	if bufferSize < 1 {
+		return nil, fmt.Errorf("tun.fragment_buffer must be greater than 0: %v", bufferSize)
+	}
+
+	timeout := c.GetDuration("tun.fragment_timeout", 5*time.Second)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("tun.fragment_timeout must be greater than 0: %v", timeout)
+	}
+
+	return newFragmenter(util.MetricsRegistry(c), size, bufferSize, timeout), nil
+}
+
+func newFragmenter(registry metrics.Registry, size, bufferSize int, timeout time.Duration) *fragmenter {
+	return &fragmenter{
+		size:              size,
+		bufferSize:        bufferSize,
+		timeout:           timeout,
+		pending:           map[fragmentKey]*fragmentBuffer{},
+		metricSent:        metrics.GetOrRegisterCounter("fragments.sent", registry),
+		metricReassembled: metrics.GetOrRegisterCounter("fragments.reassembled", registry),
+		metricDropped:     metrics.GetOrRegisterCounter("fragments.dropped", registry),
+	}
+}
+
+// shouldFragment returns true if the packet is too large to be sent as a single message
+func (fr *fragmenter) shouldFragment(p []byte) bool {
+	return fr != nil && len(p) > fr.size
+}
+
+// split calls send with each fragment of p. The fragment passed to send is only valid until send returns.
+func (fr *fragmenter) split(p []byte, send func(fragment []byte)) error {
+	chunkSize := fr.size - fragmentHeaderLen
+	count := (len(p) + chunkSize - 1) / chunkSize
+	if count > maxFragments {
+		fr.metricDropped.Inc(1)
+		return ErrTooManyFragments
+	}
+
+	id := fr.nextId.Add(1)
+	buf := make([]byte, fr.size)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+
+		binary.BigEndian.PutUint32(buf[0:4], id)
+		buf[4] = byte(i)
+		buf[5] = byte(count)
+		n := copy(buf[fragmentHeaderLen:], p[i*chunkSize:end])
+		send(buf[:fragmentHeaderLen+n])
+	}
+
+	fr.metricSent.Inc(int64(count))
+	return nil
+}
+
+// reassemble stores a decrypted fragment from the tunnel identified by localIndex. When the last fragment for a
+// packet arrives the whole packet is written to out and returned, otherwise nil is returned.
+func (fr *fragmenter) reassemble(localIndex uint32, fragment []byte, out []byte) []byte {
+	if len(fragment) <= fragmentHeaderLen {
+		fr.metricDropped.Inc(1)
+		return nil
+	}
+
+	key := fragmentKey{localIndex: localIndex, id: binary.BigEndian.Uint32(fragment[0:4])}
+	index := int(fragment[4])
+	count := int(fragment[5])
+	data := fragment[fragmentHeaderLen:]
+	if count < 2 || index >= count {
+		fr.metricDropped.Inc(1)
+		return nil
+	}
+
+	fr.Lock()
+	defer fr.Unlock()
+
+	now := time.Now()
+	if now.Sub(fr.lastPurge) > fr.timeout {
+		fr.purge(now)
+	}
+
+	b, ok := fr.pending[key]
+	if !ok {
+		b = &fragmentBuffer{chunks: make([][]byte, count), created: now}
+		fr.pending[key] = b
+	}
+
+	if len(b.chunks) != count || b.chunks[index] != nil {
+		// Duplicate or inconsistent fragment, forget the whole packet
+		fr.drop(key, b)
+		return nil
+	}
+
+	if fr.buffered+len(data) > fr.bufferSize {
+		fr.drop(key, b)
+		return nil
+	}
+
+	b.chunks[index] = append([]byte(nil), data...)
+	b.received++
+	b.size += len(data)
+	fr.buffered += len(data)
+
+	if b.received < count {
+		return nil
+	}
+
+	out = out[:0]
+	for _, c := range b.chunks {
+		out = append(out, c...)
+	}
+
+	fr.buffered -= b.size
+	delete(fr.pending, key)
+	fr.metricReassembled.Inc(1)
+	return out
+}
+
+// drop removes an incomplete packet, must be called with the lock held
+func (fr *fragmenter) drop(key fragmentKey, b *fragmentBuffer) {
+	fr.buffered -= b.size
+	delete(fr.pending, key)
+	fr.metricDropped.Inc(int64(b.received + 1))
+}
+
+// purge drops any incomplete packets older than the timeout, must be called with the lock held
+func (fr *fragmenter) purge(now time.Time) {
+	fr.lastPurge = now
+	for k, b := range fr.pending {
+		if now.Sub(b.created) > fr.timeout {
+			fr.buffered -= b.size
+			delete(fr.pending, k)
+			fr.metricDropped.Inc(int64(b.received))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newFragmenterFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	fr, err := newFragmenterFromConfig(c)
+	assert.Nil(t, err)
+	assert.Nil(t, fr)
+	assert.False(t, fr.shouldFragment(make([]byte, 9000)))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"fragment": true, "fragment_size": 6}
+	_, err = newFragmenterFromConfig(c)
+	assert.EqualError(t, err, "tun.fragment_size must be greater than 6: 6")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"fragment": true}
+	fr, err = newFragmenterFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 1300, fr.size)
+	assert.Equal(t, 5*time.Second, fr.timeout)
+	assert.False(t, fr.shouldFragment(make([]byte, 1300)))
+	assert.True(t, fr.shouldFragment(make([]byte, 1301)))
+}
+
+func TestFragmenter_RoundTrip(t *testing.T) {
+	fr := newFragmenter(nil, 100, 10000, time.Minute)
+
+	p := make([]byte, 1000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	var fragments [][]byte
+	err := fr.split(p, func(fragment []byte) {
+		assert.LessOrEqual(t, len(fragment), 100)
+		fragments = append(fragments, append([]byte(nil), fragment...))
+	})
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 11)
+
+	// Deliver out of order, the packet is only returned once the last fragment arrives
+	out := make([]byte, 0, 9001)
+	for i := len(fragments) - 1; i > 0; i-- {
+		assert.Nil(t, fr.reassemble(1, fragments[i], out))
+	}
+	assert.Equal(t, 906, fr.buffered)
+
+	// The same packet id from another tunnel is kept separate
+	assert.Nil(t, fr.reassemble(2, fragments[0], out))
+
+	res := fr.reassemble(1, fragments[0], out)
+	assert.True(t, bytes.Equal(p, res))
+	assert.Len(t, fr.pending, 1)
+	assert.Equal(t, 94, fr.buffered)
+
+	// A second packet gets a new id
+	var second [][]byte
+	assert.Nil(t, fr.split(p[:200], func(fragment []byte) {
+		second = append(second, append([]byte(nil), fragment...))
+	}))
+	assert.Len(t, second, 3)
+	assert.NotEqual(t, fragments[0][:4], second[0][:4])
+}
+
+func TestFragmenter_Drops(t *testing.T) {
+	fr := newFragmenter(nil, 100, 150, time.Minute)
+
+	assert.Equal(t, ErrTooManyFragments, fr.split(make([]byte, 94*256), func([]byte) {}))
+
+	var fragments [][]byte
+	assert.Nil(t, fr.split(make([]byte, 300), func(fragment []byte) {
+		fragments = append(fragments, append([]byte(nil), fragment...))
+	}))
+
+	out := make([]byte, 0, 9001)
+
+	// Too short or inconsistent fragments are ignored
+	assert.Nil(t, fr.reassemble(1, fragments[0][:fragmentHeaderLen], out))
+	bad := append([]byte(nil), fragments[0]...)
+	bad[4] = 5
+	assert.Nil(t, fr.reassemble(1, bad, out))
+	assert.Empty(t, fr.pending)
+
+	// A duplicate fragment drops the whole packet
+	assert.Nil(t, fr.reassemble(1, fragments[0], out))
+	assert.Nil(t, fr.reassemble(1, fragments[0], out))
+	assert.Empty(t, fr.pending)
+	assert.Equal(t, 0, fr.buffered)
+
+	// Exceeding the reassembly buffer drops the packet
+	assert.Nil(t, fr.reassemble(1, fragments[0], out))
+	assert.Nil(t, fr.reassemble(1, fragments[1], out))
+	assert.Empty(t, fr.pending)
+	assert.Equal(t, 0, fr.buffered)
+
+	// Incomplete packets are purged after the timeout
+	fr.timeout = time.Millisecond
+	assert.Nil(t, fr.reassemble(1, fragments[0], out))
+	assert.Len(t, fr.pending, 1)
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, fr.reassemble(2, fragments[0], out))
+	assert.Len(t, fr.pending, 1)
+	assert.Equal(t, 94, fr.buffered)
+}
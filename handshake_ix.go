@@ -1,10 +1,12 @@
 package nebula
 
 import (
+	"crypto/sha256"
 	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
@@ -12,6 +14,34 @@ import (
 
 // NOISE IX Handshakes
 
+// handshakePSK returns the noise preshared key derived from handshakes.psk, nil if it is not set
+func handshakePSK(c *config.C) []byte {
+	psk := c.GetString("handshakes.psk", "")
+	if psk == "" {
+		return nil
+	}
+
+	// Noise requires exactly 32 bytes
+	k := sha256.Sum256([]byte(psk))
+	return k[:]
+}
+
+// getPSK returns the preshared key to mix into new handshakes, nil when handshakes.psk is not set
+func (f *Interface) getPSK() []byte {
+	if psk := f.psk.Load(); psk != nil {
+		return *psk
+	}
+	return nil
+}
+
+// getReplayWindow returns the handshakes.replay_window new tunnels are created with
+func (f *Interface) getReplayWindow() uint64 {
+	if w := f.replayWindow.Load(); w != 0 {
+		return w
+	}
+	return ReplayWindow
+}
+
 // This function constructs a handshake packet, but does not actually send it
 // Sending is done by the handshake manager
 func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
@@ -23,19 +53,23 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	}
 
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, []byte{}, 0)
+	ci := NewConnectionState(f.l, f.metricsRegistry, f.cipher, certState, true, noise.HandshakeIX, f.getPSK(), 0, f.getReplayWindow())
 	hh.hostinfo.ConnectionState = ci
 
 	hsProto := &NebulaHandshakeDetails{
 		InitiatorIndex: hh.hostinfo.localIndexId,
 		Time:           uint64(time.Now().UnixNano()),
 		Cert:           certState.RawCertificateNoKey,
+		CertChain:      f.pki.GetCertChain(),
+		Compression:    f.compressor.offer(),
+		Metadata:       f.handshakeMetadata.get(),
 	}
 
 	hsBytes := []byte{}
 
 	hs := &NebulaHandshake{
 		Details: hsProto,
+		Padding: f.handshakePadding.Load().pad(),
 	}
 	hsBytes, err = hs.Marshal()
 
@@ -65,8 +99,11 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 }
 
 func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []byte, h *header.H) {
+	hsMetrics := f.handshakeManager.responderMetrics
+	hsMetrics.received.Inc(1)
+
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, false, noise.HandshakeIX, []byte{}, 0)
+	ci := NewConnectionState(f.l, f.metricsRegistry, f.cipher, certState, false, noise.HandshakeIX, f.getPSK(), 0, f.getReplayWindow())
 	// Mark packet 1 as seen so it doesn't show up as missed
 	ci.window.Update(f.l, 1)
 
@@ -74,6 +111,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	if err != nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+		hsMetrics.failedDecrypt.Inc(1)
 		return
 	}
 
@@ -85,22 +123,41 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	if err != nil || hs.Details == nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
+		hsMetrics.failedMalformed.Inc(1)
 		return
 	}
 
-	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
+	remoteCert, remoteChain, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, hs.Details.CertChain, f.pki)
 	if err != nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).WithField("cert", remoteCert).
 			Info("Invalid certificate from host")
+		hsMetrics.failedCert.Inc(1)
+		f.checkCertTime(remoteCert, addr, 1)
 		return
 	}
+
+	// Answer with the certificate signed by the same CA as the initiator, if we hold one. Our static key is not part of
+	// the first message so reading it again with the new key pair yields the same state.
+	if rcs := f.pki.GetResponderCertState(remoteCert); rcs != certState {
+		certState = rcs
+		ci = NewConnectionState(f.l, f.metricsRegistry, f.cipher, certState, false, noise.HandshakeIX, f.getPSK(), 0, f.getReplayWindow())
+		ci.window.Update(f.l, 1)
+		_, _, _, err = ci.H.ReadMessage(nil, packet[header.Len:])
+		if err != nil {
+			f.l.WithError(err).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+			hsMetrics.failedDecrypt.Inc(1)
+			return
+		}
+	}
+
 	vpnIp := iputil.Ip2VpnIp(remoteCert.Details.Ips[0].IP)
 	certName := remoteCert.Details.Name
 	fingerprint, _ := remoteCert.Sha256Sum()
 	issuer := remoteCert.Details.Issuer
 
-	if vpnIp == f.myVpnIp {
+	if vpnIp == f.myVpnIp.Load() {
 		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 			WithField("certName", certName).
 			WithField("fingerprint", fingerprint).
@@ -114,6 +171,59 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
 			return
 		}
+	} else if via != nil && !f.relayManager.peerRelayAllowed(vpnIp, via.relayHI.vpnIp) {
+		f.l.WithField("vpnIp", vpnIp).WithField("relay", via.relayHI.vpnIp).
+			Info("relay.peer_relays denied incoming handshake through relay")
+		return
+	}
+
+	if !f.pki.HasRequiredGroup(remoteCert) {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("groups", remoteCert.Details.Groups).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake from a certificate without any of pki.require_groups")
+		hsMetrics.failedGroups.Inc(1)
+		return
+	}
+
+	if pinned, ok := f.lightHouse.pinnedFingerprint(vpnIp); ok {
+		if pinned != fingerprint {
+			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("pinnedFingerprint", pinned).
+				WithField("issuer", issuer).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake from a certificate that does not match the fingerprint pinned in static_host_map")
+			hsMetrics.failedFingerprint.Inc(1)
+			return
+		}
+	} else if learned, ok := f.pki.CheckTofu(vpnIp, fingerprint); !ok {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("learnedFingerprint", learned).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake from a certificate that does not match the fingerprint learned on first use, " +
+				"use the tofu-clear ssh command if the host has a new certificate")
+		hsMetrics.failedFingerprint.Inc(1)
+		return
+	}
+
+	if !f.lightHouse.peerPolicy.allows(vpnIp, f.myVpnIp.Load()) {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("peerPolicyVersion", f.lightHouse.peerPolicy.version()).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake that the peer policy does not allow")
+		hsMetrics.failedPolicy.Inc(1)
+		return
 	}
 
 	myIndex, err := generateIndex(f.l)
@@ -150,8 +260,16 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 
 	hs.Details.ResponderIndex = myIndex
 	hs.Details.Cert = certState.RawCertificateNoKey
+	hs.Details.CertChain = f.pki.GetCertChainFor(certState)
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
+	// Only agree to compression if we both want it
+	ci.compression = f.compressor.negotiate(hs.Details.Compression)
+	hs.Details.Compression = ci.compression
+	ci.peerMetadata = peerMetadata(f.l, hostinfo, hs.Details.Metadata)
+	hs.Details.Metadata = f.handshakeMetadata.get()
+	// Never echo the padding of the initiator back
+	hs.Padding = f.handshakePadding.Load().pad()
 
 	hsBytes, err := hs.Marshal()
 	if err != nil {
@@ -178,6 +296,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 			WithField("fingerprint", fingerprint).
 			WithField("issuer", issuer).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Noise did not arrive at a key")
+		hsMetrics.failedDecrypt.Inc(1)
 		return
 	}
 
@@ -194,8 +313,9 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	ci.window.Update(f.l, 2)
 
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.peerCertChain = remoteChain
+	ci.dKey = NewNebulaCipherState(dKey, f.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, f.cipher)
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
 	hostinfo.SetRemote(addr)
@@ -207,6 +327,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		case ErrAlreadySeen:
 			// Update remote if preferred
 			if existing.SetRemoteIfPreferred(f.hostMap, addr) {
+				f.eventStream.endpointChanged(existing, "preferred remote")
 				// Send a test packet to ensure the other side has also switched to
 				// the preferred remote
 				f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
@@ -224,6 +345,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 					f.l.WithField("vpnIp", existing.vpnIp).WithField("udpAddr", addr).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						Info("Handshake message sent")
+					hsMetrics.sent.Inc(1)
 				}
 				return
 			} else {
@@ -236,6 +358,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 				f.l.WithField("vpnIp", existing.vpnIp).WithField("relay", via.relayHI.vpnIp).
 					WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 					Info("Handshake message sent")
+				hsMetrics.sent.Inc(1)
 				return
 			}
 		case ErrExistingHostInfo:
@@ -253,6 +376,9 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 			// Send a test packet to trigger an authenticated tunnel test, this should suss out any lingering tunnel issues
 			f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
 			return
+		case ErrDuplicateVpnIp:
+			// A different node holds a tunnel for this vpn ip and we are keeping it, checkDuplicateVpnIp logged why
+			return
 		case ErrLocalIndexCollision:
 			// This means we failed to insert because of collision on localIndexId. Just let the next handshake packet retry
 			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
@@ -278,6 +404,21 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		}
 	}
 
+	// The fingerprint is only pinned once the handshake got this far, a handshake that failed for another reason must not
+	// decide what the vpn ip is trusted with
+	if learned, ok := f.pki.LearnTofu(vpnIp, fingerprint); !ok {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("learnedFingerprint", learned).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake, another handshake for the vpn ip learned a different fingerprint on first use")
+		hsMetrics.failedFingerprint.Inc(1)
+		f.closeTunnel(hostinfo, "fingerprint learned on first use changed")
+		return
+	}
+
 	// Do the send
 	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 	if addr != nil {
@@ -298,6 +439,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 				WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 				WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 				Info("Handshake message sent")
+			hsMetrics.sent.Inc(1)
 		}
 	} else {
 		if via == nil {
@@ -313,11 +455,13 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 			WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 			WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Handshake message sent")
+		hsMetrics.sent.Inc(1)
 	}
 
-	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.connectionManager.AddTrafficWatch(hostinfo)
 	hostinfo.ConnectionState.messageCounter.Store(2)
 	hostinfo.remotes.ResetBlockedRemotes()
+	hsMetrics.completed.Inc(1)
 
 	return
 }
@@ -339,12 +483,16 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 		}
 	}
 
+	hsMetrics := f.handshakeManager.initiatorMetrics
+	hsMetrics.received.Inc(1)
+
 	ci := hostinfo.ConnectionState
 	msg, eKey, dKey, err := ci.H.ReadMessage(nil, packet[header.Len:])
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("header", h).
 			Error("Failed to call noise.ReadMessage")
+		hsMetrics.failedDecrypt.Inc(1)
 
 		// We don't want to tear down the connection on a bad ReadMessage because it could be an attacker trying
 		// to DOS us. Every other error condition after should to allow a possible good handshake to complete in the
@@ -354,6 +502,7 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 		f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Error("Noise did not arrive at a key")
+		hsMetrics.failedDecrypt.Inc(1)
 
 		// This should be impossible in IX but just in case, if we get here then there is no chance to recover
 		// the handshake state machine. Tear it down
@@ -365,16 +514,19 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 	if err != nil || hs.Details == nil {
 		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
+		hsMetrics.failedMalformed.Inc(1)
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
 		return true
 	}
 
-	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
+	remoteCert, remoteChain, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, hs.Details.CertChain, f.pki)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
 			WithField("cert", remoteCert).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Error("Invalid certificate from host")
+		hsMetrics.failedCert.Inc(1)
+		f.checkCertTime(remoteCert, addr, 2)
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
 		return true
@@ -391,6 +543,7 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 			WithField("udpAddr", addr).WithField("certName", certName).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Incorrect host responded to handshake")
+		hsMetrics.failedCert.Inc(1)
 
 		// Release our old handshake from pending, it should not continue
 		f.handshakeManager.DeleteHostInfo(hostinfo)
@@ -421,6 +574,57 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 		return true
 	}
 
+	if !f.pki.HasRequiredGroup(remoteCert) {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("groups", remoteCert.Details.Groups).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("Refusing handshake from a certificate without any of pki.require_groups")
+		hsMetrics.failedGroups.Inc(1)
+
+		// The handshake state machine is complete, tear down and let the next attempt decide again
+		return true
+	}
+
+	if pinned, ok := f.lightHouse.pinnedFingerprint(vpnIp); ok {
+		if pinned != fingerprint {
+			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("pinnedFingerprint", pinned).
+				WithField("issuer", issuer).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+				Info("Refusing handshake from a certificate that does not match the fingerprint pinned in static_host_map")
+			hsMetrics.failedFingerprint.Inc(1)
+			return true
+		}
+	} else if learned, ok := f.pki.CheckTofu(vpnIp, fingerprint); !ok {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("learnedFingerprint", learned).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("Refusing handshake from a certificate that does not match the fingerprint learned on first use, " +
+				"use the tofu-clear ssh command if the host has a new certificate")
+		hsMetrics.failedFingerprint.Inc(1)
+		return true
+	}
+
+	if !f.lightHouse.peerPolicy.allows(f.myVpnIp.Load(), vpnIp) {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("peerPolicyVersion", f.lightHouse.peerPolicy.version()).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("Refusing handshake that the peer policy does not allow")
+		hsMetrics.failedPolicy.Inc(1)
+		return true
+	}
+
 	// Mark packet 2 as seen so it doesn't show up as missed
 	ci.window.Update(f.l, 2)
 
@@ -437,25 +641,51 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 
 	hostinfo.remoteIndexId = hs.Details.ResponderIndex
 	hostinfo.lastHandshakeTime = hs.Details.Time
+	ci.compression = f.compressor.negotiate(hs.Details.Compression)
+	ci.peerMetadata = peerMetadata(f.l, hostinfo, hs.Details.Metadata)
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.peerCertChain = remoteChain
+	ci.dKey = NewNebulaCipherState(dKey, f.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, f.cipher)
 
 	// Make sure the current udpAddr being used is set for responding
 	if addr != nil {
 		hostinfo.SetRemote(addr)
 	} else {
 		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnIp)
+		if hh.autoRelayed {
+			hostinfo.autoRelayed = true
+			f.handshakeManager.metricAutoRelayed.Inc(1)
+		}
 	}
 
 	// Build up the radix for the firewall if we have subnets in the cert
 	hostinfo.CreateRemoteCIDR(remoteCert)
 
 	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
-	f.handshakeManager.Complete(hostinfo, f)
-	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	if err := f.handshakeManager.Complete(hostinfo, f); err != nil {
+		// A different node holds a tunnel for this vpn ip and we are keeping it, tell this one to let go of the tunnel
+		f.sendCloseTunnel(hostinfo)
+		return true
+	}
+
+	// The fingerprint is only pinned once the handshake completed
+	if learned, ok := f.pki.LearnTofu(vpnIp, fingerprint); !ok {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("learnedFingerprint", learned).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("Refusing handshake, another handshake for the vpn ip learned a different fingerprint on first use")
+		hsMetrics.failedFingerprint.Inc(1)
+		f.sendCloseTunnel(hostinfo)
+		f.closeTunnel(hostinfo, "fingerprint learned on first use changed")
+		return true
+	}
+	f.connectionManager.AddTrafficWatch(hostinfo)
 
 	hostinfo.ConnectionState.messageCounter.Store(2)
 
@@ -474,6 +704,7 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 
 	hostinfo.remotes.ResetBlockedRemotes()
 	f.metricHandshakes.Update(duration)
+	hsMetrics.completed.Inc(1)
 
 	return false
 }
@@ -0,0 +1,94 @@
+package nebula
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakePSK(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.Nil(t, handshakePSK(c))
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": "correct horse battery staple"}
+	psk := handshakePSK(c)
+	assert.Len(t, psk, 32)
+	assert.Equal(t, psk, handshakePSK(c))
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": "something else"}
+	assert.NotEqual(t, psk, handshakePSK(c))
+}
+
+func TestNewConnectionState_psk(t *testing.T) {
+	l := test.NewLogger()
+
+	newCertState := func(name string, ip net.IP) *CertState {
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+
+		cs, err := newCertState(
+			newTestP256Cert(t, name, ip, key.PublicKey().Bytes()),
+			&memoryStaticKey{dhFunc: noiseutil.DHP256, private: key.Bytes()},
+			key.Bytes(),
+		)
+		assert.NoError(t, err)
+		return cs
+	}
+
+	ics := newCertState("initiator", net.IP{10, 1, 1, 1})
+	rcs := newCertState("responder", net.IP{10, 1, 1, 2})
+
+	// handshake runs an IX handshake and returns the first error seen by the responder or else the initiator
+	handshake := func(ipsk, rpsk []byte) (error, error) {
+		ci := NewConnectionState(l, nil, "aes", ics, true, noise.HandshakeIX, ipsk, 0, ReplayWindow)
+		cr := NewConnectionState(l, nil, "aes", rcs, false, noise.HandshakeIX, rpsk, 0, ReplayWindow)
+
+		msg, _, _, err := ci.H.WriteMessage(nil, nil)
+		assert.NoError(t, err)
+		_, _, _, err = cr.H.ReadMessage(nil, msg)
+		if err != nil {
+			return err, nil
+		}
+
+		msg, _, _, err = cr.H.WriteMessage(nil, nil)
+		if err != nil {
+			return err, nil
+		}
+		_, _, _, err = ci.H.ReadMessage(nil, msg)
+		return nil, err
+	}
+
+	c := config.NewC(l)
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": "correct horse battery staple"}
+	psk := handshakePSK(c)
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": "something else"}
+	otherPSK := handshakePSK(c)
+
+	// Without a psk and with a matching one
+	rErr, iErr := handshake(nil, nil)
+	assert.NoError(t, rErr)
+	assert.NoError(t, iErr)
+
+	rErr, iErr = handshake(psk, psk)
+	assert.NoError(t, rErr)
+	assert.NoError(t, iErr)
+
+	// A mismatched psk, or only one side having one, fails on the responder. Without a psk of its own the responder
+	// reads the encrypted static key as garbage and fails once it tries to use it.
+	rErr, _ = handshake(psk, otherPSK)
+	assert.Error(t, rErr)
+
+	rErr, _ = handshake(psk, nil)
+	assert.Error(t, rErr)
+
+	rErr, _ = handshake(nil, psk)
+	assert.Error(t, rErr)
+}
@@ -7,7 +7,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -21,7 +23,11 @@ const (
 	DefaultHandshakeTryInterval   = time.Millisecond * 100
 	DefaultHandshakeRetries       = 10
 	DefaultHandshakeTriggerBuffer = 64
+	DefaultAutoRelayAfter         = 5
 	DefaultUseRelays              = true
+
+	// timedOutTTL is how long a vpn ip whose handshake timed out stays unreachable without another handshake timing out
+	timedOutTTL = 10 * time.Minute
 )
 
 var (
@@ -38,8 +44,17 @@ type HandshakeConfig struct {
 	retries       int
 	triggerBuffer int
 	useRelays     bool
-
-	messageMetrics *MessageMetrics
+	jitter        float64
+	// maxConcurrent caps the number of outbound handshakes in flight, 0 is unlimited
+	maxConcurrent int
+	// autoRelay relays through the lighthouses once autoRelayAfter direct attempts failed and the peer has no relays
+	autoRelay      bool
+	autoRelayAfter int
+	// duplicateVpnIp decides which tunnel wins when two nodes claim the same vpn ip
+	duplicateVpnIp duplicateVpnIpPolicy
+
+	messageMetrics  *MessageMetrics
+	metricsRegistry metrics.Registry
 }
 
 type HandshakeManager struct {
@@ -57,11 +72,35 @@ type HandshakeManager struct {
 	messageMetrics         *MessageMetrics
 	metricInitiated        metrics.Counter
 	metricTimedOut         metrics.Counter
+	metricAutoRelayed      metrics.Counter
+	metricDuplicateVpnIp   metrics.Counter
+	initiatorMetrics       *handshakeMetrics
+	responderMetrics       *handshakeMetrics
+	metricQueued           metrics.Gauge
+	metricQueueWait        metrics.Histogram
+	metricsRegistry        metrics.Registry
 	f                      *Interface
 	l                      *logrus.Logger
 
 	// can be used to trigger outbound handshake for the given vpnIp
 	trigger chan iputil.VpnIp
+
+	// maintenance receives relays that went down for maintenance, the tunnels through them are re-handshaked
+	maintenance chan iputil.VpnIp
+
+	// active is the number of handshakes in vpnIps that are not queued, queue holds handshakes waiting for
+	// active to drop below config.maxConcurrent. Both are protected by the mutex.
+	active int
+	queue  []*HandshakeHostInfo
+
+	// duplicateVpnIp holds the handshakes.duplicate_vpn_ip duplicateVpnIpPolicy
+	duplicateVpnIp atomic.Uint32
+
+	// timedOut holds when the last outbound handshake with a vpn ip timed out, until a tunnel with it is made or
+	// timedOutTTL has passed. The via of an unsafe route in it is unreachable. Entries that expired are swept at most
+	// once per timedOutTTL, when another handshake times out. Protected by the mutex.
+	timedOut      map[iputil.VpnIp]time.Time
+	timedOutSwept time.Time
 }
 
 type HandshakeHostInfo struct {
@@ -72,6 +111,10 @@ type HandshakeHostInfo struct {
 	counter     int             // How many attempts have we made so far
 	lastRemotes []*udp.Addr     // Remotes that we sent to during the previous attempt
 	packetStore []*cachedPacket // A set of packets to be transmitted once the handshake completes
+	queuedAt    time.Time       // Time the handshake was queued by handshakes.max_concurrent, zero if it never was
+	queued      atomic.Bool     // Is the handshake waiting for a free slot
+	autoRelayed bool            // Did we ask the lighthouses to relay because the direct attempts failed
+	unreachable bool            // Did the previous handshake with this vpn ip time out without a tunnel made since
 
 	hostinfo *HostInfo
 }
@@ -102,20 +145,31 @@ func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType,
 }
 
 func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *LightHouse, outside udp.Conn, config HandshakeConfig) *HandshakeManager {
-	return &HandshakeManager{
+	hm := &HandshakeManager{
 		vpnIps:                 map[iputil.VpnIp]*HandshakeHostInfo{},
 		indexes:                map[uint32]*HandshakeHostInfo{},
+		timedOut:               map[iputil.VpnIp]time.Time{},
 		mainHostMap:            mainHostMap,
 		lightHouse:             lightHouse,
 		outside:                outside,
 		config:                 config,
 		trigger:                make(chan iputil.VpnIp, config.triggerBuffer),
-		OutboundHandshakeTimer: NewLockingTimerWheel[iputil.VpnIp](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
+		maintenance:            make(chan iputil.VpnIp, config.triggerBuffer),
+		OutboundHandshakeTimer: NewLockingTimerWheel[iputil.VpnIp](config.tryInterval, time.Duration(float64(hsTimeout(config.retries, config.tryInterval))*(1+config.jitter))),
 		messageMetrics:         config.messageMetrics,
-		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
-		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", config.metricsRegistry),
+		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", config.metricsRegistry),
+		metricAutoRelayed:      metrics.GetOrRegisterCounter("relay.auto.established", config.metricsRegistry),
+		metricDuplicateVpnIp:   metrics.GetOrRegisterCounter("handshakes.duplicate_vpn_ip", config.metricsRegistry),
+		initiatorMetrics:       newInitiatorHandshakeMetrics(config.metricsRegistry),
+		responderMetrics:       newResponderHandshakeMetrics(config.metricsRegistry),
+		metricQueued:           metrics.GetOrRegisterGauge("handshake_manager.queued", config.metricsRegistry),
+		metricQueueWait:        metrics.GetOrRegisterHistogram("handshake_manager.queue_wait", config.metricsRegistry, metrics.NewExpDecaySample(1028, 0.015)),
+		metricsRegistry:        config.metricsRegistry,
 		l:                      l,
 	}
+	hm.duplicateVpnIp.Store(uint32(config.duplicateVpnIp))
+	return hm
 }
 
 func (c *HandshakeManager) Run(ctx context.Context) {
@@ -128,6 +182,8 @@ func (c *HandshakeManager) Run(ctx context.Context) {
 			return
 		case vpnIP := <-c.trigger:
 			c.handleOutbound(vpnIP, true)
+		case relay := <-c.maintenance:
+			c.moveOffRelay(relay)
 		case now := <-clockSource.C:
 			c.NextOutboundHandshakeTimerTick(now)
 		}
@@ -178,6 +234,11 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	hh.Lock()
 	defer hh.Unlock()
 
+	// A lighthouse reply can trigger a handshake that is still waiting for a slot
+	if hh.queued.Load() {
+		return
+	}
+
 	hostinfo := hh.hostinfo
 	// If we are out of time, clean up
 	if hh.counter >= hm.config.retries {
@@ -188,17 +249,26 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
 			Info("Handshake timed out")
 		hm.metricTimedOut.Inc(1)
-		hm.DeleteHostInfo(hostinfo)
+		hm.initiatorMetrics.failedTimeout.Inc(1)
+		hm.Lock()
+		hm.unlockedAddTimedOut(vpnIp, time.Now())
+		hm.unlockedDeleteHostInfo(hostinfo)
+		hm.Unlock()
 		return
 	}
 
 	// Increment the counter to increase our delay, linear backoff
 	hh.counter++
 
+	if hh.counter == 1 && !hh.queuedAt.IsZero() {
+		// StartHandshake did not query the lighthouse while this handshake was queued
+		hm.lightHouse.QueryServer(vpnIp, hm.f)
+	}
+
 	// Check if we have a handshake packet to transmit yet
 	if !hh.ready {
 		if !ixHandshakeStage0(hm.f, hh) {
-			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
+			hm.OutboundHandshakeTimer.Add(vpnIp, hm.retryInterval(hh.counter))
 			return
 		}
 	}
@@ -221,6 +291,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 		return
 	}
 
+	prevRemotes := hh.lastRemotes
 	hh.lastRemotes = remotes
 
 	// TODO: this will generate a load of queries for hosts with only 1 ip
@@ -236,6 +307,11 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []*udp.Addr
 	hostinfo.remotes.ForEach(hm.mainHostMap.preferredRanges, func(addr *udp.Addr, _ bool) {
+		// A lighthouse reply only adds its new addresses to the race, the others are retried on the regular schedule
+		if lighthouseTriggered && udp.AddrSlice(prevRemotes).Contains(addr) {
+			return
+		}
+
 		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
 		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
 		if err != nil {
@@ -246,6 +322,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 
 		} else {
 			sentTo = append(sentTo, addr)
+			hm.initiatorMetrics.sent.Inc(1)
 		}
 	})
 
@@ -263,12 +340,27 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			Debug("Handshake message sent")
 	}
 
-	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
-		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
-		// Send a RelayRequest to all known Relay IP's
-		for _, relay := range hostinfo.remotes.relays {
+	relays, constrained := hm.f.relayManager.relaysFor(vpnIp, hostinfo.remotes.relays)
+	if hm.config.useRelays && hm.config.autoRelay && len(relays) == 0 && !constrained && hh.counter > hm.config.autoRelayAfter {
+		relays = hm.autoRelays()
+		if len(relays) > 0 && !hh.autoRelayed {
+			hh.autoRelayed = true
+			hostinfo.logger(hm.l).WithField("attempts", hh.counter-1).
+				Info("Direct handshake failed and the host has no relays, relaying through the lighthouses")
+		}
+	}
+
+	if hm.config.useRelays && len(relays) > 0 {
+		hostinfo.logger(hm.l).WithField("relays", relays).WithField("constrained", constrained).Info("Attempt to relay through hosts")
+		// Send a RelayRequest to all known Relay IP's, or only the first reachable one from relay.peer_relays
+		var selected iputil.VpnIp
+		for _, relay := range relays {
 			// Don't relay to myself, and don't relay through the host I'm trying to connect to
-			if *relay == vpnIp || *relay == hm.lightHouse.myVpnIp {
+			if *relay == vpnIp || *relay == hm.lightHouse.myVpnIp.Load() {
+				continue
+			}
+			// Don't use relays that are down for maintenance
+			if hm.lightHouse.peerMaintenance.has(*relay) {
 				continue
 			}
 			relayHostInfo := hm.mainHostMap.QueryVpnIp(*relay)
@@ -283,13 +375,14 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 				case Established:
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Send handshake via relay")
 					hm.f.SendVia(relayHostInfo, existingRelay, hostinfo.HandshakePacket[0], make([]byte, 12), make([]byte, mtu), false)
+					hm.initiatorMetrics.sent.Inc(1)
 				case Requested:
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Re-send CreateRelay request")
 					// Re-send the CreateRelay request, in case the previous one was lost.
 					m := NebulaControl{
 						Type:                NebulaControl_CreateRelayRequest,
 						InitiatorRelayIndex: existingRelay.LocalIndex,
-						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
+						RelayFromIp:         uint32(hm.lightHouse.myVpnIp.Load()),
 						RelayToIp:           uint32(vpnIp),
 					}
 					msg, err := m.Marshal()
@@ -301,7 +394,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 						// This must send over the hostinfo, not over hm.Hosts[ip]
 						hm.f.SendMessageToHostInfo(header.Control, 0, relayHostInfo, msg, make([]byte, 12), make([]byte, mtu))
 						hm.l.WithFields(logrus.Fields{
-							"relayFrom":           hm.lightHouse.myVpnIp,
+							"relayFrom":           hm.lightHouse.myVpnIp.Load(),
 							"relayTo":             vpnIp,
 							"initiatorRelayIndex": existingRelay.LocalIndex,
 							"relay":               *relay}).
@@ -325,7 +418,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 					m := NebulaControl{
 						Type:                NebulaControl_CreateRelayRequest,
 						InitiatorRelayIndex: idx,
-						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
+						RelayFromIp:         uint32(hm.lightHouse.myVpnIp.Load()),
 						RelayToIp:           uint32(vpnIp),
 					}
 					msg, err := m.Marshal()
@@ -336,7 +429,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 					} else {
 						hm.f.SendMessageToHostInfo(header.Control, 0, relayHostInfo, msg, make([]byte, 12), make([]byte, mtu))
 						hm.l.WithFields(logrus.Fields{
-							"relayFrom":           hm.lightHouse.myVpnIp,
+							"relayFrom":           hm.lightHouse.myVpnIp.Load(),
 							"relayTo":             vpnIp,
 							"initiatorRelayIndex": idx,
 							"relay":               *relay}).
@@ -344,13 +437,41 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 					}
 				}
 			}
+
+			if constrained {
+				// The most preferred reachable relay is the only one used
+				selected = *relay
+				break
+			}
+		}
+
+		if constrained {
+			peerRelayMetric(hm.metricsRegistry, vpnIp, selected).Inc(1)
+			if selected == 0 {
+				hostinfo.logger(hm.l).WithField("relays", relays).
+					Info("None of the relays in relay.peer_relays are reachable, not relaying")
+			}
 		}
 	}
 
 	// If a lighthouse triggered this attempt then we are still in the timer wheel and do not need to re-add
 	if !lighthouseTriggered {
-		hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
+		hm.OutboundHandshakeTimer.Add(vpnIp, hm.retryInterval(hh.counter))
+	}
+}
+
+// autoRelays returns the lighthouses as relays, every host is expected to keep a tunnel to them
+func (hm *HandshakeManager) autoRelays() []*iputil.VpnIp {
+	var relays []*iputil.VpnIp
+	for vpnIp := range hm.lightHouse.GetLighthouses() {
+		vpnIp := vpnIp
+		relays = append(relays, &vpnIp)
 	}
+
+	sort.Slice(relays, func(i, j int) bool {
+		return *relays[i] < *relays[j]
+	})
+	return relays
 }
 
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
@@ -394,18 +515,33 @@ func (hm *HandshakeManager) StartHandshake(vpnIp iputil.VpnIp, cacheCb func(*Han
 		},
 	}
 
+	timedOutAt, unreachable := hm.timedOut[vpnIp]
+	unreachable = unreachable && time.Since(timedOutAt) < timedOutTTL
 	hh := &HandshakeHostInfo{
-		hostinfo:  hostinfo,
-		startTime: time.Now(),
+		hostinfo:    hostinfo,
+		startTime:   time.Now(),
+		unreachable: unreachable,
 	}
 	hm.vpnIps[vpnIp] = hh
 	hm.metricInitiated.Inc(1)
-	hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval)
 
 	if cacheCb != nil {
 		cacheCb(hh)
 	}
 
+	// Lighthouses are never queued, everything else depends on them
+	if hm.config.maxConcurrent > 0 && hm.active >= hm.config.maxConcurrent && !hm.lightHouse.IsLighthouseIP(vpnIp) {
+		hh.queuedAt = time.Now()
+		hh.queued.Store(true)
+		hm.queue = append(hm.queue, hh)
+		hm.metricQueued.Update(int64(len(hm.queue)))
+		hm.Unlock()
+		return hostinfo
+	}
+
+	hm.active++
+	hm.OutboundHandshakeTimer.Add(vpnIp, hm.retryInterval(1))
+
 	// If this is a static host, we don't need to wait for the HostQueryReply
 	// We can trigger the handshake right now
 	_, doTrigger := hm.lightHouse.GetStaticHostList()[vpnIp]
@@ -443,6 +579,9 @@ var (
 //
 // ErrLocalIndexCollision if we already have an entry in the main or pending
 // hostmap for the hostinfo.localIndexId.
+//
+// ErrDuplicateVpnIp if the entry in the hostmap for this VpnIp is a different
+// node and handshakes.duplicate_vpn_ip keeps the existing tunnel.
 func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket uint8, f *Interface) (*HostInfo, error) {
 	c.mainHostMap.Lock()
 	defer c.mainHostMap.Unlock()
@@ -462,6 +601,10 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 			testHostInfo = testHostInfo.next
 		}
 
+		if err := c.checkDuplicateVpnIp(existingHostInfo, hostinfo); err != nil {
+			return existingHostInfo, err
+		}
+
 		// Is this a newer handshake?
 		if existingHostInfo.lastHandshakeTime >= hostinfo.lastHandshakeTime && !existingHostInfo.ConnectionState.initiator {
 			return existingHostInfo, ErrExistingHostInfo
@@ -492,18 +635,38 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 	}
 
 	c.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	delete(c.timedOut, hostinfo.vpnIp)
 	return existingHostInfo, nil
 }
 
+// unlockedAddTimedOut marks vpnIp as unreachable and forgets the vpn ips that timed out more than timedOutTTL ago
+func (hm *HandshakeManager) unlockedAddTimedOut(vpnIp iputil.VpnIp, now time.Time) {
+	if now.Sub(hm.timedOutSwept) >= timedOutTTL {
+		for ip, t := range hm.timedOut {
+			if now.Sub(t) >= timedOutTTL {
+				delete(hm.timedOut, ip)
+			}
+		}
+		hm.timedOutSwept = now
+	}
+
+	hm.timedOut[vpnIp] = now
+}
+
 // Complete is a simpler version of CheckAndComplete when we already know we
 // won't have a localIndexId collision because we already have an entry in the
-// pendingHostMap. An existing hostinfo is returned if there was one.
-func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
+// pendingHostMap. ErrDuplicateVpnIp is returned, and nothing is added, if the
+// existing entry for this VpnIp is a different node that we keep.
+func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) error {
 	hm.mainHostMap.Lock()
 	defer hm.mainHostMap.Unlock()
 	hm.Lock()
 	defer hm.Unlock()
 
+	if err := hm.checkDuplicateVpnIp(hm.mainHostMap.Hosts[hostinfo.vpnIp], hostinfo); err != nil {
+		return err
+	}
+
 	existingRemoteIndex, found := hm.mainHostMap.RemoteIndexes[hostinfo.remoteIndexId]
 	if found && existingRemoteIndex != nil {
 		// We have a collision, but this can happen since we can't control
@@ -516,6 +679,8 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 	// We need to remove from the pending hostmap first to avoid undoing work when after to the main hostmap.
 	hm.unlockedDeleteHostInfo(hostinfo)
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	delete(hm.timedOut, hostinfo.vpnIp)
+	return nil
 }
 
 // allocateIndex generates a unique localIndexId for this HostInfo
@@ -553,6 +718,15 @@ func (c *HandshakeManager) DeleteHostInfo(hostinfo *HostInfo) {
 }
 
 func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
+	if hh, ok := c.vpnIps[hostinfo.vpnIp]; ok {
+		if hh.queued.Load() {
+			c.unlockedDequeue(hh)
+		} else {
+			c.active--
+			c.unlockedStartQueued()
+		}
+	}
+
 	delete(c.vpnIps, hostinfo.vpnIp)
 	if len(c.vpnIps) == 0 {
 		c.vpnIps = map[iputil.VpnIp]*HandshakeHostInfo{}
@@ -570,6 +744,34 @@ func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	}
 }
 
+// unlockedDequeue removes a queued handshake that is being deleted before it started
+func (hm *HandshakeManager) unlockedDequeue(hh *HandshakeHostInfo) {
+	for i, q := range hm.queue {
+		if q == hh {
+			hm.queue = append(hm.queue[:i], hm.queue[i+1:]...)
+			break
+		}
+	}
+	hh.queued.Store(false)
+	hm.metricQueued.Update(int64(len(hm.queue)))
+}
+
+// unlockedStartQueued starts queued handshakes, oldest first, while there are free slots
+func (hm *HandshakeManager) unlockedStartQueued() {
+	for len(hm.queue) > 0 && hm.active < hm.config.maxConcurrent {
+		hh := hm.queue[0]
+		hm.queue[0] = nil
+		hm.queue = hm.queue[1:]
+
+		hm.active++
+		hh.queued.Store(false)
+		hm.metricQueueWait.Update(time.Since(hh.queuedAt).Nanoseconds())
+		hm.OutboundHandshakeTimer.Add(hh.hostinfo.vpnIp, hm.retryInterval(1))
+	}
+
+	hm.metricQueued.Update(int64(len(hm.queue)))
+}
+
 func (hm *HandshakeManager) QueryVpnIp(vpnIp iputil.VpnIp) *HostInfo {
 	hh := hm.queryVpnIp(vpnIp)
 	if hh != nil {
@@ -627,8 +829,8 @@ func (c *HandshakeManager) EmitStats() {
 	indexLen := len(c.indexes)
 	c.RUnlock()
 
-	metrics.GetOrRegisterGauge("hostmap.pending.hosts", nil).Update(int64(hostLen))
-	metrics.GetOrRegisterGauge("hostmap.pending.indexes", nil).Update(int64(indexLen))
+	metrics.GetOrRegisterGauge("hostmap.pending.hosts", c.metricsRegistry).Update(int64(hostLen))
+	metrics.GetOrRegisterGauge("hostmap.pending.indexes", c.metricsRegistry).Update(int64(indexLen))
 	c.mainHostMap.EmitStats()
 }
 
@@ -656,6 +858,12 @@ func generateIndex(l *logrus.Logger) (uint32, error) {
 	return index, nil
 }
 
+// retryInterval returns how long to wait before the next handshake attempt, linear backoff with handshakes.jitter
+// applied and never sooner than handshakes.try_interval
+func (hm *HandshakeManager) retryInterval(counter int) time.Duration {
+	return jitter(hm.config.tryInterval*time.Duration(counter), hm.config.jitter, hm.config.tryInterval)
+}
+
 func hsTimeout(tries int, interval time.Duration) time.Duration {
 	return time.Duration(tries / 2 * ((2 * int(interval)) + (tries-1)*int(interval)))
 }
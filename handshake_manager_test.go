@@ -19,7 +19,7 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	_, localrange, _ := net.ParseCIDR("10.1.1.1/24")
 	ip := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
 	preferredRanges := []*net.IPNet{localrange}
-	mainHM := NewHostMap(l, vpncidr, preferredRanges)
+	mainHM := NewHostMap(l, nil, vpncidr, preferredRanges)
 	lh := newTestLighthouse()
 
 	cs := &CertState{
@@ -62,6 +62,88 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 
 	// Confirm they have been removed
 	assert.NotContains(t, blah.vpnIps, ip)
+	assert.Contains(t, blah.timedOut, ip)
+}
+
+func Test_HandshakeManagerTimedOut(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hm := NewHandshakeManager(l, NewHostMap(l, nil, vpncidr, nil), newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	ip1 := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+	ip2 := iputil.Ip2VpnIp(net.ParseIP("172.1.1.3"))
+
+	now := time.Now()
+	hm.unlockedAddTimedOut(ip1, now)
+	hm.unlockedAddTimedOut(ip2, now.Add(timedOutTTL/2))
+	assert.Len(t, hm.timedOut, 2)
+
+	// Entries that expired are swept when another handshake times out
+	hm.unlockedAddTimedOut(ip2, now.Add(timedOutTTL+time.Second))
+	assert.Len(t, hm.timedOut, 1)
+	assert.Contains(t, hm.timedOut, ip2)
+
+	// A vpn ip whose handshake timed out too long ago is no longer unreachable
+	hm.timedOut[ip1] = now.Add(-timedOutTTL)
+	assert.NotNil(t, hm.StartHandshake(ip1, nil))
+	assert.False(t, hm.vpnIps[ip1].unreachable)
+
+	hm.timedOut[ip2] = time.Now()
+	assert.NotNil(t, hm.StartHandshake(ip2, nil))
+	assert.True(t, hm.vpnIps[ip2].unreachable)
+}
+
+func Test_HandshakeManagerMaxConcurrent(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	mainHM := NewHostMap(l, nil, vpncidr, nil)
+	lh := newTestLighthouse()
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.100"))
+
+	config := defaultHandshakeConfig
+	config.maxConcurrent = 2
+	hm := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, config)
+	hm.f = &Interface{handshakeManager: hm, pki: &PKI{}, l: l}
+
+	ips := make([]iputil.VpnIp, 4)
+	hosts := make([]*HostInfo, 4)
+	for i := range ips {
+		ips[i] = iputil.Ip2VpnIp(net.IPv4(172, 1, 1, byte(i+2)))
+		hosts[i] = hm.StartHandshake(ips[i], nil)
+	}
+
+	// Only 2 are in flight, the rest wait in order
+	assert.Equal(t, 2, hm.active)
+	assert.Len(t, hm.queue, 2)
+	assert.Equal(t, 2, testCountTimerWheelEntries(hm.OutboundHandshakeTimer))
+	assert.True(t, hm.queryVpnIp(ips[2]).queued.Load())
+	assert.True(t, hm.queryVpnIp(ips[3]).queued.Load())
+
+	// Every host is still pending so packets can be cached for them
+	assert.Len(t, hm.vpnIps, 4)
+
+	// Lighthouses skip the queue
+	lh.lighthouses.Store(&map[iputil.VpnIp]struct{}{lhIp: {}})
+	hm.StartHandshake(lhIp, nil)
+	assert.Equal(t, 3, hm.active)
+	assert.Len(t, hm.queue, 2)
+	assert.False(t, hm.queryVpnIp(lhIp).queued.Load())
+
+	// The cap is respected as handshakes finish, the lighthouse is still using a slot
+	hm.DeleteHostInfo(hosts[0])
+	assert.Equal(t, 2, hm.active)
+	assert.Len(t, hm.queue, 2)
+
+	hm.DeleteHostInfo(hosts[1])
+	assert.Equal(t, 2, hm.active)
+	assert.Len(t, hm.queue, 1)
+	assert.False(t, hm.queryVpnIp(ips[2]).queued.Load())
+	assert.True(t, hm.queryVpnIp(ips[3]).queued.Load())
+
+	// Deleting a queued handshake just takes it out of the queue
+	hm.DeleteHostInfo(hosts[3])
+	assert.Equal(t, 2, hm.active)
+	assert.Empty(t, hm.queue)
+	assert.Equal(t, int64(0), hm.metricQueued.Value())
 }
 
 func testCountTimerWheelEntries(tw *LockingTimerWheel[iputil.VpnIp]) (c int) {
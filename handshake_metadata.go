@@ -0,0 +1,110 @@
+package nebula
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// handshakeMetadataMaxLen caps the metadata we send in or accept from a handshake, counted as the total length of
+// every key and value
+const handshakeMetadataMaxLen = 512
+
+// handshakeMetadata holds the handshakes.metadata we send in every handshake. It travels in the handshake payload next
+// to our certificate. The payload is mixed into the noise handshake hash so the metadata is transcript-bound, a change
+// in flight breaks the tunnel, but it is not signed. The certificate keys can only do key agreement and the CA never
+// sees the metadata, so it is only ever a claim made by the peer.
+type handshakeMetadata struct {
+	metadata atomic.Pointer[map[string]string]
+}
+
+// newHandshakeMetadataFromConfig returns nil if handshakes.metadata is not set. A change to the metadata is sent in the
+// handshakes that start after the reload, existing tunnels keep what was exchanged when they were made.
+func newHandshakeMetadataFromConfig(l *logrus.Logger, c *config.C) (*handshakeMetadata, error) {
+	if c.Get("handshakes.metadata") == nil {
+		return nil, nil
+	}
+
+	hm := &handshakeMetadata{}
+	if err := hm.reload(c); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if !c.HasChanged("handshakes.metadata") {
+			return
+		}
+
+		if err := hm.reload(c); err != nil {
+			l.WithError(err).Error("Failed to reload handshakes.metadata, keeping the current metadata")
+			return
+		}
+
+		l.WithField("metadata", hm.get()).Info("handshakes.metadata has changed")
+	})
+
+	return hm, nil
+}
+
+func (hm *handshakeMetadata) reload(c *config.C) error {
+	raw := c.GetMap("handshakes.metadata", map[interface{}]interface{}{})
+	md := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v.(type) {
+		case map[interface{}]interface{}, []interface{}, nil:
+			return fmt.Errorf("handshakes.metadata value for %v must be a string", k)
+		}
+
+		key := fmt.Sprintf("%v", k)
+		if key == "" {
+			return fmt.Errorf("handshakes.metadata keys can not be empty")
+		}
+		md[key] = fmt.Sprintf("%v", v)
+	}
+
+	if n := metadataLen(md); n > handshakeMetadataMaxLen {
+		return fmt.Errorf("handshakes.metadata is %v bytes, it can be at most %v bytes", n, handshakeMetadataMaxLen)
+	}
+
+	hm.metadata.Store(&md)
+	return nil
+}
+
+// get returns the metadata to send in a handshake, nil if none is configured. Do not modify the result!
+func (hm *handshakeMetadata) get() map[string]string {
+	if hm == nil {
+		return nil
+	}
+
+	md := *hm.metadata.Load()
+	if len(md) == 0 {
+		return nil
+	}
+	return md
+}
+
+// peerMetadata returns the metadata a peer sent in its handshake, metadata over handshakeMetadataMaxLen is dropped so a
+// peer can not make us hold on to an arbitrary amount of it for the life of the tunnel
+func peerMetadata(l *logrus.Logger, hostinfo *HostInfo, md map[string]string) map[string]string {
+	if len(md) == 0 {
+		return nil
+	}
+
+	if n := metadataLen(md); n > handshakeMetadataMaxLen {
+		hostinfo.logger(l).WithField("length", n).
+			Warnf("Ignoring handshake metadata larger than %v bytes", handshakeMetadataMaxLen)
+		return nil
+	}
+
+	return md
+}
+
+func metadataLen(md map[string]string) int {
+	n := 0
+	for k, v := range md {
+		n += len(k) + len(v)
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package nebula
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newHandshakeMetadataFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Nothing is sent by default
+	hm, err := newHandshakeMetadataFromConfig(l, c)
+	assert.Nil(t, err)
+	assert.Nil(t, hm)
+	assert.Nil(t, hm.get())
+
+	assert.Nil(t, c.LoadString("handshakes:\n  metadata:\n    role: db\n    version: 1.2\n    primary: true"))
+	hm, err = newHandshakeMetadataFromConfig(l, c)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"role": "db", "version": "1.2", "primary": "true"}, hm.get())
+
+	t.Log("Only scalar values are allowed")
+	c = config.NewC(l)
+	assert.Nil(t, c.LoadString("handshakes:\n  metadata:\n    role: [db, web]"))
+	_, err = newHandshakeMetadataFromConfig(l, c)
+	assert.EqualError(t, err, "handshakes.metadata value for role must be a string")
+
+	t.Log("The size is limited")
+	c = config.NewC(l)
+	assert.Nil(t, c.LoadString("handshakes:\n  metadata:\n    role: "+strings.Repeat("a", handshakeMetadataMaxLen)))
+	_, err = newHandshakeMetadataFromConfig(l, c)
+	assert.EqualError(t, err, "handshakes.metadata is 516 bytes, it can be at most 512 bytes")
+}
+
+func Test_newHandshakeMetadataFromConfig_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.Nil(t, c.LoadString("handshakes:\n  metadata:\n    role: db"))
+	hm, err := newHandshakeMetadataFromConfig(l, c)
+	assert.Nil(t, err)
+
+	c.ReloadConfigString("handshakes:\n  metadata:\n    role: web")
+	assert.Equal(t, map[string]string{"role": "web"}, hm.get())
+
+	// A bad reload keeps the current metadata
+	c.ReloadConfigString("handshakes:\n  metadata:\n    role: " + strings.Repeat("a", handshakeMetadataMaxLen))
+	assert.Equal(t, map[string]string{"role": "web"}, hm.get())
+
+	// Clearing it stops sending any
+	c.ReloadConfigString("handshakes:\n  metadata: {}")
+	assert.Nil(t, hm.get())
+}
+
+func Test_peerMetadata(t *testing.T) {
+	l := test.NewLogger()
+	hostinfo := &HostInfo{}
+
+	assert.Nil(t, peerMetadata(l, hostinfo, nil))
+	assert.Equal(t, map[string]string{"dc": "us-east"}, peerMetadata(l, hostinfo, map[string]string{"dc": "us-east"}))
+
+	// Oversized metadata from a peer is dropped
+	assert.Nil(t, peerMetadata(l, hostinfo, map[string]string{"dc": strings.Repeat("a", handshakeMetadataMaxLen)}))
+}
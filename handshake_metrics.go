@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// handshakeMetrics counts the progress of IX handshakes for one role, the initiator sends stage 1 and receives
+// stage 2 while the responder receives stage 1 and sends stage 2. Counters are named `handshakes.<role>.<event>`:
+//
+//	stage1.sent / stage1.received   handshake packet 1, each retry and relayed send is counted
+//	stage2.sent / stage2.received   handshake packet 2, cached replies to a retried stage 1 are counted
+//	completed                       a tunnel was installed from the handshake
+//	failed.decrypt                  noise could not read the handshake packet or did not arrive at keys
+//	failed.malformed                the decrypted handshake packet could not be unmarshaled
+//	failed.cert                     the certificate was invalid or, for the initiator, was for a different vpn ip
+//	failed.groups                   the certificate had none of the groups in pki.require_groups
+//	failed.policy                   the peer policy from the lighthouses does not allow the tunnel
+//	failed.fingerprint              the certificate did not match the fingerprint pinned in static_host_map or learned
+//	                                with pki.tofu
+//	failed.timeout                  initiator only, no stage 2 arrived before handshakes.retries was exhausted
+type handshakeMetrics struct {
+	sent      metrics.Counter
+	received  metrics.Counter
+	completed metrics.Counter
+
+	failedDecrypt     metrics.Counter
+	failedMalformed   metrics.Counter
+	failedCert        metrics.Counter
+	failedGroups      metrics.Counter
+	failedPolicy      metrics.Counter
+	failedFingerprint metrics.Counter
+	failedTimeout     metrics.Counter
+}
+
+func newInitiatorHandshakeMetrics(registry metrics.Registry) *handshakeMetrics {
+	return newHandshakeMetrics(registry, "initiator", 1, 2)
+}
+
+func newResponderHandshakeMetrics(registry metrics.Registry) *handshakeMetrics {
+	hm := newHandshakeMetrics(registry, "responder", 2, 1)
+	// A responder keeps no state until stage 1 has been processed, there is nothing to time out
+	hm.failedTimeout = metrics.NilCounter{}
+	return hm
+}
+
+func newHandshakeMetrics(registry metrics.Registry, role string, sentStage, receivedStage int) *handshakeMetrics {
+	name := func(event string) string {
+		return fmt.Sprintf("handshakes.%s.%s", role, event)
+	}
+
+	return &handshakeMetrics{
+		sent:              metrics.GetOrRegisterCounter(name(fmt.Sprintf("stage%d.sent", sentStage)), registry),
+		received:          metrics.GetOrRegisterCounter(name(fmt.Sprintf("stage%d.received", receivedStage)), registry),
+		completed:         metrics.GetOrRegisterCounter(name("completed"), registry),
+		failedDecrypt:     metrics.GetOrRegisterCounter(name("failed.decrypt"), registry),
+		failedMalformed:   metrics.GetOrRegisterCounter(name("failed.malformed"), registry),
+		failedCert:        metrics.GetOrRegisterCounter(name("failed.cert"), registry),
+		failedGroups:      metrics.GetOrRegisterCounter(name("failed.groups"), registry),
+		failedPolicy:      metrics.GetOrRegisterCounter(name("failed.policy"), registry),
+		failedFingerprint: metrics.GetOrRegisterCounter(name("failed.fingerprint"), registry),
+		failedTimeout:     metrics.GetOrRegisterCounter(name("failed.timeout"), registry),
+	}
+}
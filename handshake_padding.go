@@ -0,0 +1,52 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// maxHandshakePadding keeps a padded handshake carrying a certificate chain below a typical underlay mtu
+const maxHandshakePadding = 512
+
+// handshakePadding is the range of filler bytes added to each handshake message we send so the size of a handshake
+// does not identify nebula. The filler is the Padding field of the handshake payload, which the receiver ignores. The
+// payload of the first message is sent in the clear, so the filler is random rather than zeros that would stand out.
+type handshakePadding struct {
+	min int
+	max int
+}
+
+// getHandshakePadding reads handshakes.padding, nil is returned when no padding is configured
+func getHandshakePadding(c *config.C) (*handshakePadding, error) {
+	min := c.GetInt("handshakes.padding.min", 0)
+	max := c.GetInt("handshakes.padding.max", 0)
+
+	if min < 0 || max < 0 || max > maxHandshakePadding {
+		return nil, fmt.Errorf("handshakes.padding min and max must be between 0 and %v: %v-%v", maxHandshakePadding, min, max)
+	}
+
+	if min > max {
+		return nil, fmt.Errorf("handshakes.padding.min must not be greater than handshakes.padding.max: %v-%v", min, max)
+	}
+
+	if max == 0 {
+		return nil, nil
+	}
+
+	return &handshakePadding{min: min, max: max}, nil
+}
+
+// pad returns between min and max random filler bytes, nil on a nil handshakePadding
+func (p *handshakePadding) pad() []byte {
+	if p == nil {
+		return nil
+	}
+
+	b := make([]byte, p.min+mrand.Intn(p.max-p.min+1))
+	// A failure leaves zeros, the size of the handshake is still hidden
+	_, _ = rand.Read(b)
+	return b
+}
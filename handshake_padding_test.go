@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHandshakePadding(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Nothing is padded by default
+	p, err := getHandshakePadding(c)
+	assert.Nil(t, err)
+	assert.Nil(t, p)
+	assert.Nil(t, p.pad())
+
+	assert.Nil(t, c.LoadString("handshakes:\n  padding:\n    min: 16\n    max: 64"))
+	p, err = getHandshakePadding(c)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		n := len(p.pad())
+		assert.GreaterOrEqual(t, n, 16)
+		assert.LessOrEqual(t, n, 64)
+	}
+
+	c = config.NewC(l)
+	assert.Nil(t, c.LoadString("handshakes:\n  padding:\n    min: 64\n    max: 16"))
+	_, err = getHandshakePadding(c)
+	assert.EqualError(t, err, "handshakes.padding.min must not be greater than handshakes.padding.max: 64-16")
+
+	c = config.NewC(l)
+	assert.Nil(t, c.LoadString("handshakes:\n  padding:\n    max: 1024"))
+	_, err = getHandshakePadding(c)
+	assert.EqualError(t, err, "handshakes.padding min and max must be between 0 and 512: 0-1024")
+}
+
+func TestHandshakePadding_ignored(t *testing.T) {
+	details := &NebulaHandshakeDetails{InitiatorIndex: 10, Cert: []byte("cert"), Metadata: map[string]string{"role": "db"}}
+	plain, err := (&NebulaHandshake{Details: details}).Marshal()
+	assert.NoError(t, err)
+
+	p := &handshakePadding{min: 100, max: 100}
+	filler := p.pad()
+	padded, err := (&NebulaHandshake{Details: details, Padding: filler}).Marshal()
+	assert.NoError(t, err)
+	assert.Len(t, padded, len(plain)+100+2)
+
+	// The first message is not encrypted, a run of zeros would be as easy to spot as no padding
+	assert.NotEqual(t, make([]byte, 100), filler)
+	assert.NotEqual(t, filler, p.pad())
+
+	// The receiver reads the same details with or without padding
+	hs := &NebulaHandshake{}
+	assert.NoError(t, hs.Unmarshal(padded))
+	assert.Equal(t, details, hs.Details)
+}
@@ -50,8 +50,10 @@ var typeMap = map[MessageType]string{
 }
 
 const (
-	MessageNone  MessageSubType = 0
-	MessageRelay MessageSubType = 1
+	MessageNone       MessageSubType = 0
+	MessageRelay      MessageSubType = 1
+	MessageFragment   MessageSubType = 2
+	MessageCompressed MessageSubType = 3
 )
 
 const (
@@ -75,8 +77,10 @@ var subTypeNoneMap = map[MessageSubType]string{0: "none"}
 
 var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Message: {
-		MessageNone:  "none",
-		MessageRelay: "relay",
+		MessageNone:       "none",
+		MessageRelay:      "relay",
+		MessageFragment:   "fragment",
+		MessageCompressed: "compressed",
 	},
 	RecvError:   &subTypeNoneMap,
 	LightHouse:  &subTypeNoneMap,
@@ -87,8 +87,10 @@ func TestTypeMap(t *testing.T) {
 
 	assert.Equal(t, map[MessageType]*map[MessageSubType]string{
 		Message: {
-			MessageNone:  "none",
-			MessageRelay: "relay",
+			MessageNone:       "none",
+			MessageRelay:      "relay",
+			MessageFragment:   "fragment",
+			MessageCompressed: "compressed",
 		},
 		RecvError:   &subTypeNoneMap,
 		LightHouse:  &subTypeNoneMap,
@@ -60,7 +60,19 @@ type HostMap struct {
 	preferredRanges []*net.IPNet
 	vpnCIDR         *net.IPNet
 	metricsEnabled  bool
+
+	// vpnNet and vpnMask are vpnCIDR as VpnIps, see vpnCIDRContains
+	vpnNet  iputil.VpnIp
+	vpnMask iputil.VpnIp
+
+	metricsRegistry metrics.Registry
 	l               *logrus.Logger
+
+	// previousKeys holds the receive keys of recently replaced tunnels by local index, see unlockedKeepPreviousKey
+	previousKeys               map[uint32]*previousKey
+	previousKeyGrace           atomic.Int64
+	previousKeyPackets         atomic.Int64
+	metricPreviousKeyDecrypted metrics.Counter
 }
 
 // For synchronization, treat the pointed-to Relay struct as immutable. To edit the Relay
@@ -205,7 +217,7 @@ type HostInfo struct {
 	localIndexId    uint32
 	vpnIp           iputil.VpnIp
 	recvError       atomic.Uint32
-	remoteCidr      *cidr.Tree4[struct{}]
+	remoteCidr      *cidr.RouteTree[struct{}]
 	relayState      RelayState
 
 	// HandshakePacket records the packets used to create this hostinfo
@@ -216,6 +228,13 @@ type HostInfo struct {
 	// This is used to limit lighthouse re-queries in chatty clients
 	nextLHQuery atomic.Int64
 
+	// tunnelUp is when the first tunnel to this vpn ip came up, it carries over to the hostinfos that replace it. For
+	// tunnelLifetimeMetrics
+	tunnelUp time.Time
+
+	// testSent is when the last tunnel test was sent in unix nanoseconds, 0 once its reply arrived. For rttMetrics
+	testSent atomic.Int64
+
 	// lastRebindCount is the other side of Interface.rebindCount, if these values don't match then we need to ask LH
 	// for a punch from the remote end of this tunnel. The goal being to prime their conntrack for our traffic just like
 	// with a handshake
@@ -229,6 +248,13 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote *udp.Addr
 
+	// autoRelayed is set when the tunnel was relayed through a lighthouse by relay.auto, it stays set once the tunnel
+	// is upgraded to direct
+	autoRelayed bool
+
+	// sendQueue is created on first use when listen.send_queue_depth is set
+	sendQueue atomic.Pointer[sendQueue]
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -238,6 +264,7 @@ type ViaSender struct {
 	relayHI   *HostInfo // relayHI is the host info object of the relay
 	remoteIdx uint32    // remoteIdx is the index included in the header of the received packet
 	relay     *Relay    // relay contains the rest of the relay information, including the PeerIP of the host trying to communicate with us.
+	relayHops uint16    // relayHops is the most relays a packet nested in the received one may still pass through
 }
 
 type cachedPacket struct {
@@ -254,23 +281,37 @@ type cachedPacketMetrics struct {
 	dropped metrics.Counter
 }
 
-func NewHostMap(l *logrus.Logger, vpnCIDR *net.IPNet, preferredRanges []*net.IPNet) *HostMap {
+func NewHostMap(l *logrus.Logger, registry metrics.Registry, vpnCIDR *net.IPNet, preferredRanges []*net.IPNet) *HostMap {
 	h := map[iputil.VpnIp]*HostInfo{}
 	i := map[uint32]*HostInfo{}
 	r := map[uint32]*HostInfo{}
 	relays := map[uint32]*HostInfo{}
 	m := HostMap{
-		Indexes:         i,
-		Relays:          relays,
-		RemoteIndexes:   r,
-		Hosts:           h,
-		preferredRanges: preferredRanges,
-		vpnCIDR:         vpnCIDR,
-		l:               l,
-	}
+		Indexes:                    i,
+		Relays:                     relays,
+		RemoteIndexes:              r,
+		Hosts:                      h,
+		preferredRanges:            preferredRanges,
+		vpnCIDR:                    vpnCIDR,
+		l:                          l,
+		previousKeys:               map[uint32]*previousKey{},
+		metricsRegistry:            registry,
+		metricPreviousKeyDecrypted: metrics.GetOrRegisterCounter("previous_key.decrypted", registry),
+	}
+	if vpnCIDR != nil && len(vpnCIDR.Mask) > 0 {
+		m.vpnMask = iputil.Ip2VpnIp(vpnCIDR.Mask)
+		m.vpnNet = iputil.Ip2VpnIp(vpnCIDR.IP) & m.vpnMask
+	}
+	m.previousKeyGrace.Store(int64(defaultPreviousKeyGrace))
+	m.previousKeyPackets.Store(defaultPreviousKeyPackets)
 	return &m
 }
 
+// vpnCIDRContains reports if vpnIp is in our vpn network, it does not allocate so it is safe to use per packet
+func (hm *HostMap) vpnCIDRContains(vpnIp iputil.VpnIp) bool {
+	return hm.vpnMask != 0 && vpnIp&hm.vpnMask == hm.vpnNet
+}
+
 // EmitStats reports host, index, and relay counts to the stats collection system
 func (hm *HostMap) EmitStats() {
 	hm.RLock()
@@ -280,10 +321,10 @@ func (hm *HostMap) EmitStats() {
 	relaysLen := len(hm.Relays)
 	hm.RUnlock()
 
-	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(hostLen))
-	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(indexLen))
-	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(remoteIndexLen))
-	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
+	metrics.GetOrRegisterGauge("hostmap.main.hosts", hm.metricsRegistry).Update(int64(hostLen))
+	metrics.GetOrRegisterGauge("hostmap.main.indexes", hm.metricsRegistry).Update(int64(indexLen))
+	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", hm.metricsRegistry).Update(int64(remoteIndexLen))
+	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", hm.metricsRegistry).Update(int64(relaysLen))
 }
 
 func (hm *HostMap) RemoveRelay(localIdx uint32) {
@@ -385,6 +426,8 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 		hm.Indexes = map[uint32]*HostInfo{}
 	}
 
+	hm.unlockedKeepPreviousKey(hostinfo)
+
 	if hm.l.Level >= logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"mapTotalSize": len(hm.Hosts),
 			"vpnIp": hostinfo.vpnIp, "indexNumber": hostinfo.localIndexId, "remoteIndexNumber": hostinfo.remoteIndexId}).
@@ -394,6 +437,10 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	for _, localRelayIdx := range hostinfo.relayState.CopyRelayForIdxs() {
 		delete(hm.Relays, localRelayIdx)
 	}
+
+	if q := hostinfo.sendQueue.Load(); q != nil {
+		q.close()
+	}
 }
 
 func (hm *HostMap) QueryIndex(index uint32) *HostInfo {
@@ -470,9 +517,9 @@ func (hm *HostMap) queryVpnIp(vpnIp iputil.VpnIp, promoteIfce *Interface) *HostI
 // unlockedAddHostInfo assumes you have a write-lock and will add a hostinfo object to the hostmap Indexes and RemoteIndexes maps.
 // If an entry exists for the Hosts table (vpnIp -> hostinfo) then the provided hostinfo will be made primary
 func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
-	if f.serveDns {
+	if f.dnsRecords != nil {
 		remoteCert := hostinfo.ConnectionState.peerCert
-		dnsR.Add(remoteCert.Details.Name+".", remoteCert.Details.Ips[0].IP.String())
+		f.dnsRecords.Add(remoteCert.Details.Name+".", remoteCert.Details.Ips[0].IP.String())
 	}
 
 	existing := hm.Hosts[hostinfo.vpnIp]
@@ -481,6 +528,12 @@ func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 	if existing != nil {
 		hostinfo.next = existing
 		existing.prev = hostinfo
+		hostinfo.tunnelUp = existing.tunnelUp
+	} else {
+		hostinfo.tunnelUp = time.Now()
+		f.events.tunnelUp(hostinfo)
+		f.eventStream.tunnelUp(hostinfo)
+		f.startupMetrics.tunnelUp(hostinfo.vpnIp, f.lightHouse, hostinfo.tunnelUp)
 	}
 
 	hm.Indexes[hostinfo.localIndexId] = hostinfo
@@ -633,7 +686,8 @@ func (i *HostInfo) CreateRemoteCIDR(c *cert.NebulaCertificate) {
 		return
 	}
 
-	remoteCidr := cidr.NewTree4[struct{}]()
+	// Ipv6 subnets go into the same tree, vpn ips are always ipv4
+	remoteCidr := cidr.NewRouteTree[struct{}]()
 	for _, ip := range c.Details.Ips {
 		remoteCidr.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
 	}
@@ -3,6 +3,7 @@ package nebula
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
@@ -12,6 +13,7 @@ func TestHostMap_MakePrimary(t *testing.T) {
 	l := test.NewLogger()
 	hm := NewHostMap(
 		l,
+		nil,
 		&net.IPNet{
 			IP:   net.IP{10, 0, 0, 1},
 			Mask: net.IPMask{255, 255, 255, 0},
@@ -93,6 +95,7 @@ func TestHostMap_DeleteHostInfo(t *testing.T) {
 	l := test.NewLogger()
 	hm := NewHostMap(
 		l,
+		nil,
 		&net.IPNet{
 			IP:   net.IP{10, 0, 0, 1},
 			Mask: net.IPMask{255, 255, 255, 0},
@@ -205,3 +208,47 @@ func TestHostMap_DeleteHostInfo(t *testing.T) {
 	prim = hm.QueryVpnIp(1)
 	assert.Nil(t, prim)
 }
+
+func TestHostMap_previousKey(t *testing.T) {
+	l := test.NewLogger()
+	hm := NewHostMap(l, nil, &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, []*net.IPNet{})
+	hm.previousKeyPackets.Store(2)
+
+	f := &Interface{}
+	newHostInfo := func(index uint32) *HostInfo {
+		return &HostInfo{vpnIp: 1, localIndexId: index, ConnectionState: &ConnectionState{dKey: &NebulaCipherState{}}}
+	}
+
+	h1 := newHostInfo(1)
+	h2 := newHostInfo(2)
+	hm.unlockedAddHostInfo(h1, f)
+	hm.unlockedAddHostInfo(h2, f)
+
+	// h2 replaced h1, its key is kept for a limited number of packets
+	hm.DeleteHostInfo(h1)
+	assert.Nil(t, hm.QueryIndex(1))
+	assert.Equal(t, h1, hm.QueryPreviousKey(1))
+	assert.Equal(t, h1, hm.QueryPreviousKey(1))
+	assert.Nil(t, hm.QueryPreviousKey(1))
+
+	// The last tunnel to a vpn ip is not kept
+	hm.DeleteHostInfo(h2)
+	assert.Nil(t, hm.QueryPreviousKey(2))
+
+	// Nor is anything once the grace period is over
+	h3 := newHostInfo(3)
+	h4 := newHostInfo(4)
+	hm.unlockedAddHostInfo(h3, f)
+	hm.unlockedAddHostInfo(h4, f)
+	hm.previousKeyGrace.Store(int64(time.Millisecond))
+	hm.DeleteHostInfo(h3)
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, hm.QueryPreviousKey(3))
+
+	// Or when disabled
+	hm.previousKeyGrace.Store(0)
+	h5 := newHostInfo(5)
+	hm.unlockedAddHostInfo(h5, f)
+	hm.DeleteHostInfo(h4)
+	assert.Nil(t, hm.QueryPreviousKey(4))
+}
@@ -1,11 +1,14 @@
 package nebula
 
 import (
+	"encoding/binary"
+
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/udp"
 )
 
@@ -18,12 +21,17 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
+	if fwPacket.IPv6 {
+		f.consumeInsidePacket6(packet, fwPacket, nb, out, q, localCache)
+		return
+	}
+
 	// Ignore local broadcast packets
 	if f.dropLocalBroadcast && fwPacket.RemoteIP == f.localBroadcast {
 		return
 	}
 
-	if fwPacket.RemoteIP == f.myVpnIp {
+	if fwPacket.RemoteIP == f.myVpnIp.Load() {
 		// Immediately forward packets from self to self.
 		// This should only happen on Darwin-based and FreeBSD hosts, which
 		// routes packets from the Nebula IP to the Nebula IP through the Nebula
@@ -44,9 +52,26 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
-	hostinfo, ready := f.getOrHandshake(fwPacket.RemoteIP, func(hh *HandshakeHostInfo) {
-		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
-	})
+	var hostinfo *HostInfo
+	var ready, unreachable bool
+	via, tag := f.routeFor(fwPacket.RemoteIP)
+	if via != 0 {
+		hostinfo, ready = f.handshakeManager.GetOrHandshake(via, func(hh *HandshakeHostInfo) {
+			// Only an unsafe route can be unreachable, traffic for a vpn ip has nowhere else to go
+			if hh.unreachable && via != fwPacket.RemoteIP && f.onUnreachable(fwPacket.RemoteIP) != overlay.OnUnreachableDrop {
+				unreachable = true
+				return
+			}
+			hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
+		})
+	}
+
+	if unreachable {
+		hostinfo, ready, tag = f.routeUnreachable(packet, fwPacket, out, q)
+		if hostinfo == nil {
+			return
+		}
+	}
 
 	if hostinfo == nil {
 		f.rejectInside(packet, out, q)
@@ -64,7 +89,14 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 
 	dropReason := f.firewall.Drop(packet, *fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q)
+		if f.routingTTL.Load() && hostinfo.vpnIp != fwPacket.RemoteIP && iputil.DecrementTTL(packet) {
+			// We are routing this packet over an unsafe route and it ran out of hops
+			f.sendTimeExceededInside(packet, out, q)
+			return
+		}
+
+		f.sendInsidePacket(hostinfo, packet, nb, out, q)
+		f.routeTagMetrics.tx(tag, len(packet))
 
 	} else {
 		f.rejectInside(packet, out, q)
@@ -77,12 +109,65 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 	}
 }
 
+// consumeInsidePacket6 sends an ipv6 packet over the unsafe route that matches its destination. Vpn ips are ipv4 so
+// ipv6 traffic only ever leaves through an unsafe route.
+func (f *Interface) consumeInsidePacket6(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	if f.dropMulticast && fwPacket.RemoteIP6[0] == 0xff {
+		return
+	}
+
+	var via iputil.VpnIp
+	var tag string
+	if t, ok := f.inside.(overlay.Route6Tagger); ok {
+		via, tag = t.RouteTagFor6(fwPacket.RemoteIP6)
+	}
+
+	if via == 0 {
+		if f.l.Level >= logrus.DebugLevel {
+			f.l.WithField("fwPacket", fwPacket).Debugln("dropping outbound ipv6 packet, not in unsafe routes")
+		}
+		return
+	}
+
+	hostinfo, ready := f.handshakeManager.GetOrHandshake(via, func(hh *HandshakeHostInfo) {
+		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
+	})
+
+	if hostinfo == nil || !ready {
+		return
+	}
+
+	dropReason := f.firewall.Drop(packet, *fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+	if dropReason != nil {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).
+				WithField("fwPacket", fwPacket).
+				WithField("reason", dropReason).
+				Debugln("dropping outbound packet")
+		}
+		return
+	}
+
+	if f.routingTTL.Load() && iputil.DecrementTTL(packet) {
+		// We have no ipv6 address to send an ICMPv6 time exceeded from, the packet is only counted and dropped
+		f.metricTTLExpired.Inc(1)
+		return
+	}
+
+	f.sendInsidePacket(hostinfo, packet, nb, out, q)
+	f.routeTagMetrics.tx(tag, len(packet))
+}
+
 func (f *Interface) rejectInside(packet []byte, out []byte, q int) {
 	if !f.firewall.InSendReject {
 		return
 	}
 
 	out = iputil.CreateRejectPacket(packet, out)
+	if out == nil {
+		return
+	}
+
 	_, err := f.readers[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
@@ -99,9 +184,115 @@ func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *
 	// Leave 100 bytes for the encrypted packet (60 byte Nebula header, 40 byte reject packet)
 	out = out[:140]
 	outPacket := iputil.CreateRejectPacket(packet, out[100:])
+	if outPacket == nil {
+		return
+	}
+
 	f.sendNoMetrics(header.Message, 0, ci, hostinfo, nil, outPacket, nb, out, q)
 }
 
+// routeUnreachable follows tun.unsafe_routes on_unreachable for a packet whose unsafe route has an unreachable via. It
+// returns the hostinfo and tag of the route the packet should take instead, a nil hostinfo if it was dropped or rejected.
+func (f *Interface) routeUnreachable(packet []byte, fwPacket *firewall.Packet, out []byte, q int) (*HostInfo, bool, string) {
+	routes := f.routesFor(fwPacket.RemoteIP)
+	for i, r := range routes {
+		// The first route is the one we already know is unreachable
+		if i > 0 {
+			unreachable := false
+			hostinfo, ready := f.handshakeManager.GetOrHandshake(r.Via, func(hh *HandshakeHostInfo) {
+				if hh.unreachable && r.OnUnreachable != overlay.OnUnreachableDrop {
+					unreachable = true
+					return
+				}
+				hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
+			})
+
+			if !unreachable {
+				return hostinfo, ready, r.Tag
+			}
+		}
+
+		if f.l.Level >= logrus.DebugLevel {
+			f.l.WithField("vpnIp", fwPacket.RemoteIP).
+				WithField("via", r.Via).
+				WithField("onUnreachable", r.OnUnreachable).
+				Debugln("unsafe route via is unreachable")
+		}
+
+		switch r.OnUnreachable {
+		case overlay.OnUnreachableReject:
+			f.sendHostUnreachable(packet, out, q)
+			return nil, false, ""
+		case overlay.OnUnreachableNext:
+			continue
+		default:
+			return nil, false, ""
+		}
+	}
+
+	// The least specific route said next, there is nothing left to fall through to
+	return nil, false, ""
+}
+
+// onUnreachable returns the on_unreachable of the unsafe route for ip
+func (f *Interface) onUnreachable(ip iputil.VpnIp) overlay.OnUnreachable {
+	routes := f.routesFor(ip)
+	if len(routes) == 0 {
+		return overlay.OnUnreachableDrop
+	}
+	return routes[0].OnUnreachable
+}
+
+// routesFor returns every unsafe route that matches ip, most specific first
+func (f *Interface) routesFor(ip iputil.VpnIp) []overlay.RouteMatch {
+	if t, ok := f.inside.(overlay.RouteMatcher); ok {
+		return t.RoutesFor(ip)
+	}
+	return nil
+}
+
+// sendHostUnreachable tells the sender of a packet for an unsafe route with an unreachable via that its destination
+// can not be reached, on_unreachable: reject
+func (f *Interface) sendHostUnreachable(packet []byte, out []byte, q int) {
+	out = iputil.CreateHostUnreachablePacket(packet, f.myVpnIp.Load().ToIP(), out)
+	if out == nil {
+		return
+	}
+
+	_, err := f.readers[q].Write(out)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+}
+
+// sendTimeExceeded tells the sender of a packet that expired while we were routing it, tun.routing_ttl, that it did
+func (f *Interface) sendTimeExceeded(packet []byte, hostinfo *HostInfo, nb []byte, q int) {
+	f.metricTTLExpired.Inc(1)
+
+	// Rare enough to not bother reusing the buffer of the packet, which may be a reassembled or decompressed one
+	outPacket := iputil.CreateTimeExceededPacket(packet, f.myVpnIp.Load().ToIP(), make([]byte, 96))
+	if outPacket == nil {
+		return
+	}
+
+	f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, outPacket, nb, make([]byte, mtu), q)
+}
+
+// sendTimeExceededInside answers a packet from the tun device that expired while we were routing it over an unsafe
+// route, tun.routing_ttl, with a time exceeded from our vpn ip written back to the tun device
+func (f *Interface) sendTimeExceededInside(packet []byte, out []byte, q int) {
+	f.metricTTLExpired.Inc(1)
+
+	out = iputil.CreateTimeExceededPacket(packet, f.myVpnIp.Load().ToIP(), out)
+	if out == nil {
+		return
+	}
+
+	if _, err := f.readers[q].Write(out); err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+}
+
 func (f *Interface) Handshake(vpnIp iputil.VpnIp) {
 	f.getOrHandshake(vpnIp, nil)
 }
@@ -109,16 +300,28 @@ func (f *Interface) Handshake(vpnIp iputil.VpnIp) {
 // getOrHandshake returns nil if the vpnIp is not routable.
 // If the 2nd return var is false then the hostinfo is not ready to be used in a tunnel
 func (f *Interface) getOrHandshake(vpnIp iputil.VpnIp, cacheCallback func(*HandshakeHostInfo)) (*HostInfo, bool) {
-	if !ipMaskContains(f.lightHouse.myVpnIp, f.lightHouse.myVpnZeros, vpnIp) {
-		vpnIp = f.inside.RouteFor(vpnIp)
-		if vpnIp == 0 {
-			return nil, false
-		}
+	vpnIp, _ = f.routeFor(vpnIp)
+	if vpnIp == 0 {
+		return nil, false
 	}
 
 	return f.handshakeManager.GetOrHandshake(vpnIp, cacheCallback)
 }
 
+// routeFor returns the vpn ip to send traffic for ip to, ip itself if it is within our network, along with the tag of
+// the unsafe route that matched. The vpn ip is 0 if ip is not routable.
+func (f *Interface) routeFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ipMaskContains(f.lightHouse.myVpnIp.Load(), f.lightHouse.myVpnZeros, ip) {
+		return ip, ""
+	}
+
+	if t, ok := f.inside.(overlay.RouteTagger); ok {
+		return t.RouteTagFor(ip)
+	}
+
+	return f.inside.RouteFor(ip), ""
+}
+
 func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte) {
 	fp := &firewall.Packet{}
 	err := newPacket(p, false, fp)
@@ -138,9 +341,49 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 		return
 	}
 
+	if st == header.MessageNone {
+		f.sendInsidePacket(hostinfo, p, nb, out, 0)
+		return
+	}
+
 	f.sendNoMetrics(header.Message, st, hostinfo.ConnectionState, hostinfo, nil, p, nb, out, 0)
 }
 
+// sendInsidePacket sends a packet read from the tun device, compressing it if the tunnel negotiated compression or
+// splitting it into fragments if it is too large
+func (f *Interface) sendInsidePacket(hostinfo *HostInfo, packet, nb, out []byte, q int) {
+	if !f.inspect(hostinfo.vpnIp, false, packet) {
+		return
+	}
+
+	if hostinfo.ConnectionState.compression != compressionNone {
+		maxLen := 0
+		if f.fragmenter != nil {
+			maxLen = f.fragmenter.size
+		}
+
+		sent := f.compressor.compress(packet, maxLen, func(compressed []byte) {
+			f.sendNoMetrics(header.Message, header.MessageCompressed, hostinfo.ConnectionState, hostinfo, nil, compressed, nb, out, q)
+		})
+		if sent {
+			return
+		}
+	}
+
+	if !f.fragmenter.shouldFragment(packet) {
+		f.sendNoMetrics(header.Message, header.MessageNone, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q)
+		return
+	}
+
+	err := f.fragmenter.split(packet, func(fragment []byte) {
+		f.sendNoMetrics(header.Message, header.MessageFragment, hostinfo.ConnectionState, hostinfo, nil, fragment, nb, out, q)
+	})
+	if err != nil && f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).WithError(err).WithField("size", len(packet)).
+			Debugln("dropping outbound packet")
+	}
+}
+
 // SendMessageToVpnIp handles real ip:port lookup and sends to the current best known address for vpnIp
 func (f *Interface) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp iputil.VpnIp, p, nb, out []byte) {
 	hostInfo, ready := f.getOrHandshake(vpnIp, func(hh *HandshakeHostInfo) {
@@ -191,6 +434,11 @@ func (f *Interface) SendVia(via *HostInfo,
 	out []byte,
 	nocopy bool,
 ) {
+	f.sendVia(via, relay, ad, nb, out, nocopy, f.relayManager.originHops())
+}
+
+// sendVia is SendVia with the reserved header field that holds the hops the packet has left, see relayHopsSet
+func (f *Interface) sendVia(via *HostInfo, relay *Relay, ad, nb, out []byte, nocopy bool, hops uint16) {
 	if noiseutil.EncryptLockNeeded {
 		// NOTE: for goboring AESGCMTLS we need to lock because of the nonce check
 		via.ConnectionState.writeLock.Lock()
@@ -198,6 +446,7 @@ func (f *Interface) SendVia(via *HostInfo,
 	c := via.ConnectionState.messageCounter.Add(1)
 
 	out = header.Encode(out, header.Version, header.Message, header.MessageRelay, relay.RemoteIndex, c)
+	binary.BigEndian.PutUint16(out[2:4], hops)
 	f.connectionManager.Out(via.localIndexId)
 
 	// Authenticate the header and payload, but do not encrypt for this message type.
@@ -294,14 +543,20 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		return
 	}
 
+	// Carry the ECN bits of the inner packet on the outer header so the underlay can signal congestion
+	var ecn byte
+	if t == header.Message && f.reflectECN.Load() {
+		ecn = iputil.ECN(p)
+	}
+
 	if remote != nil {
-		err = f.writers[q].WriteTo(out, remote)
+		err = f.writeTo(hostinfo, q, out, remote, ecn)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
 	} else if hostinfo.remote != nil {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
+		err = f.writeTo(hostinfo, q, out, hostinfo.remote, ecn)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
@@ -312,6 +567,7 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 			relayHostInfo, relay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIP)
 			if err != nil {
 				hostinfo.relayState.DeleteRelay(relayIP)
+				f.eventStream.relayLost(hostinfo, relayIP, err.Error())
 				hostinfo.logger(f.l).WithField("relay", relayIP).WithError(err).Info("sendNoMetrics failed to find HostInfo")
 				continue
 			}
@@ -321,6 +577,17 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 	}
 }
 
+// writeTo writes an encrypted packet for hostinfo to addr, through the peers send queue if listen.send_queue_depth or
+// listen.pace.rate is set. A packet dropped by a full queue is only counted, it is not an error.
+func (f *Interface) writeTo(hostinfo *HostInfo, q int, out []byte, addr *udp.Addr, ecn byte) error {
+	if f.sendQueues == nil {
+		return f.writers[q].WriteToECN(out, addr, ecn)
+	}
+
+	f.sendQueues.get(hostinfo, f.l).push(f.writers[q], addr, ecn, out)
+	return nil
+}
+
 func isMulticast(ip iputil.VpnIp) bool {
 	// Class D multicast
 	return (((ip >> 24) & 0xff) & 0xf0) == 0xe0
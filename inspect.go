@@ -0,0 +1,29 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/iputil"
+)
+
+// PacketInspector is called with every inner packet that has passed the firewall, inbound packets after they were
+// decrypted and before they are written to the tun device, outbound packets before they are encrypted. vpnIp is the
+// peer the packet was received from or is being sent to. Returning false drops the packet.
+//
+// The inspector runs on the hot path, inline with every packet from every reader routine at the same time. It must be
+// fast, safe for concurrent use and must not block. packet is only valid until the inspector returns and must not be
+// modified or retained, copy anything that is needed later.
+type PacketInspector func(vpnIp iputil.VpnIp, incoming bool, packet []byte) bool
+
+// inspect returns false if the registered PacketInspector wants the packet dropped. A running packet capture sees the
+// packet first.
+func (f *Interface) inspect(vpnIp iputil.VpnIp, incoming bool, packet []byte) bool {
+	if pc := f.capture.Load(); pc != nil {
+		pc.add(vpnIp, packet)
+	}
+
+	i := f.inspector.Load()
+	if i == nil {
+		return true
+	}
+
+	return (*i)(vpnIp, incoming, packet)
+}
@@ -43,6 +43,27 @@ type InterfaceConfig struct {
 	disconnectInvalid       bool
 	relayManager            *relayManager
 	punchy                  *Punchy
+	roaming                 bool
+	reflectECN              bool
+	routingTTL              bool
+	psk                     []byte
+	clockSkewWindow         time.Duration
+	replayWindow            uint64
+	handshakePadding        *handshakePadding
+	fragmenter              *fragmenter
+	sendQueues              *sendQueues
+	compressor              *compressor
+	handshakeMetadata       *handshakeMetadata
+	tunWriteRetry           *tunWriteRetry
+	tunWatchdog             *tunWatchdog
+	remoteCIDRFilter        *remoteCIDRFilter
+	keepaliveOverrides      *keepaliveOverrides
+	nonceLimit              uint64
+	keepWarm                *keepWarm
+	rttMetrics              *rttMetrics
+	tunnelLifetime          *tunnelLifetimeMetrics
+	events                  *eventWebhook
+	metricsRegistry         metrics.Registry
 
 	tryPromoteEvery uint32
 	reQueryEvery    uint32
@@ -61,11 +82,11 @@ type Interface struct {
 	firewall           *Firewall
 	connectionManager  *connectionManager
 	handshakeManager   *HandshakeManager
-	serveDns           bool
+	dnsRecords         *dnsRecords
 	createTime         time.Time
 	lightHouse         *LightHouse
 	localBroadcast     iputil.VpnIp
-	myVpnIp            iputil.VpnIp
+	myVpnIp            iputil.AtomicVpnIp
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	routines           int
@@ -73,6 +94,88 @@ type Interface struct {
 	closed             atomic.Bool
 	relayManager       *relayManager
 
+	// roaming allows an authenticated packet from a new udp address to update the remote for an established tunnel
+	roaming atomic.Bool
+
+	// reflectECN carries the ECN bits of inner packets on the outer header and marks congestion from the outer header on
+	// inner packets we receive
+	reflectECN atomic.Bool
+
+	// routingTTL decrements the ttl of packets we route to an unsafe network and replies with time exceeded once it
+	// runs out
+	routingTTL atomic.Bool
+
+	// psk is mixed into every handshake when handshakes.psk is set, both sides must share it
+	psk atomic.Pointer[[]byte]
+
+	// clockSkewWindow is how close to a peer certificate's validity bounds a time failure must be to warn about clock skew
+	clockSkewWindow atomic.Int64
+
+	// replayWindow is the handshakes.replay_window new tunnels are created with
+	replayWindow atomic.Uint64
+
+	// handshakePadding is nil unless handshakes.padding is set
+	handshakePadding atomic.Pointer[handshakePadding]
+
+	// inspector is nil unless a PacketInspector was registered with Control.SetPacketInspector
+	inspector atomic.Pointer[PacketInspector]
+
+	// capture is nil unless a packet capture was started with the capture ssh command
+	capture atomic.Pointer[packetCapture]
+
+	// fragmenter is nil unless tun.fragment is enabled
+	fragmenter *fragmenter
+
+	// sendQueues is nil unless listen.send_queue_depth or listen.pace.rate is set
+	sendQueues *sendQueues
+
+	// compressor is nil unless handshakes.compression is enabled
+	compressor *compressor
+
+	// handshakeMetadata is nil unless handshakes.metadata is set
+	handshakeMetadata *handshakeMetadata
+
+	// tunWriteRetry is nil if tun.write_retries is 0
+	tunWriteRetry *tunWriteRetry
+
+	// tunWatchdog is nil unless tun.watchdog.enabled is set
+	tunWatchdog *tunWatchdog
+
+	// remoteCIDRFilter is nil unless listen.allow_remote_cidrs or listen.block_remote_cidrs are set
+	remoteCIDRFilter atomic.Pointer[remoteCIDRFilter]
+
+	// events is nil unless events.webhook_url is set
+	events *eventWebhook
+
+	// eventStream streams host map changes to subscribe-hostmap and Control.SubscribeHostMapEvents
+	eventStream *eventStream
+
+	// maintenance is set while we are advertised as down for maintenance
+	maintenance *maintenance
+
+	// pinger tracks the pings sent by Control.PingAll
+	pinger *pinger
+
+	// mtuProber tracks the test replies the tun.mtu_probe is waiting on
+	mtuProber *mtuProber
+
+	// rttMetrics records the round trip time of tunnel tests
+	rttMetrics *rttMetrics
+
+	// tunnelLifetime records how long tunnels stayed up when the last one to a vpn ip is torn down
+	tunnelLifetime *tunnelLifetimeMetrics
+	// startupMetrics records how long after nebula started the first tunnels came up
+	startupMetrics *startupMetrics
+
+	// keepWarm keeps the tunnels in handshakes.keep_warm up
+	keepWarm *keepWarm
+
+	// routeTagMetrics counts the traffic sent through tagged tun.unsafe_routes entries
+	routeTagMetrics routeTagMetrics
+
+	// portMigration is set while tunnels are moving to a new listen.port
+	portMigration atomic.Pointer[portMigration]
+
 	tryPromoteEvery atomic.Uint32
 	reQueryEvery    atomic.Uint32
 	reQueryWait     atomic.Int64
@@ -89,8 +192,13 @@ type Interface struct {
 	readers []io.ReadWriteCloser
 
 	metricHandshakes    metrics.Histogram
+	metricRoams         metrics.Counter
+	metricAutoRelayUps  metrics.Counter
+	metricTTLExpired    metrics.Counter
 	messageMetrics      *MessageMetrics
 	cachedPacketMetrics *cachedPacketMetrics
+	// metricsRegistry holds the metrics of this overlay, see util.MetricsRegistry
+	metricsRegistry metrics.Registry
 
 	l *logrus.Logger
 }
@@ -165,7 +273,6 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		inside:             c.Inside,
 		cipher:             c.Cipher,
 		firewall:           c.Firewall,
-		serveDns:           c.ServeDns,
 		handshakeManager:   c.HandshakeManager,
 		createTime:         time.Now(),
 		lightHouse:         c.lightHouse,
@@ -177,26 +284,64 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		writers:            make([]udp.Conn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		disconnectInvalid:  c.disconnectInvalid,
-		myVpnIp:            myVpnIp,
 		relayManager:       c.relayManager,
+		fragmenter:         c.fragmenter,
+		sendQueues:         c.sendQueues,
+		compressor:         c.compressor,
+		handshakeMetadata:  c.handshakeMetadata,
+		tunWriteRetry:      c.tunWriteRetry,
+		tunWatchdog:        c.tunWatchdog,
+		events:             c.events,
+		eventStream:        newEventStream(c.metricsRegistry),
+		maintenance:        newMaintenance(c.metricsRegistry),
+		pinger:             newPinger(),
+		mtuProber:          newMTUProber(c.metricsRegistry),
+		rttMetrics:         c.rttMetrics,
+		tunnelLifetime:     c.tunnelLifetime,
+		startupMetrics:     newStartupMetrics(c.metricsRegistry, processStart),
+		keepWarm:           c.keepWarm,
+		routeTagMetrics:    routeTagMetrics{registry: c.metricsRegistry},
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
 
-		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
-		messageMetrics:   c.MessageMetrics,
+		metricHandshakes:   metrics.GetOrRegisterHistogram("handshakes", c.metricsRegistry, metrics.NewExpDecaySample(1028, 0.015)),
+		metricRoams:        metrics.GetOrRegisterCounter("hostinfo.roamed", c.metricsRegistry),
+		metricAutoRelayUps: metrics.GetOrRegisterCounter("relay.auto.upgraded", c.metricsRegistry),
+		metricTTLExpired:   metrics.GetOrRegisterCounter("tun.routing_ttl.expired", c.metricsRegistry),
+		messageMetrics:     c.MessageMetrics,
 		cachedPacketMetrics: &cachedPacketMetrics{
-			sent:    metrics.GetOrRegisterCounter("hostinfo.cached_packets.sent", nil),
-			dropped: metrics.GetOrRegisterCounter("hostinfo.cached_packets.dropped", nil),
+			sent:    metrics.GetOrRegisterCounter("hostinfo.cached_packets.sent", c.metricsRegistry),
+			dropped: metrics.GetOrRegisterCounter("hostinfo.cached_packets.dropped", c.metricsRegistry),
 		},
+		metricsRegistry: c.metricsRegistry,
 
 		l: c.l,
 	}
 
+	if c.ServeDns {
+		ifce.dnsRecords = newDnsRecords(c.HostMap)
+	}
+
+	ifce.myVpnIp.Store(myVpnIp)
+	ifce.roaming.Store(c.roaming)
+	ifce.reflectECN.Store(c.reflectECN)
+	ifce.routingTTL.Store(c.routingTTL)
+	if c.psk != nil {
+		ifce.psk.Store(&c.psk)
+	}
+	ifce.clockSkewWindow.Store(int64(c.clockSkewWindow))
+	ifce.replayWindow.Store(c.replayWindow)
+	ifce.handshakePadding.Store(c.handshakePadding)
+	ifce.remoteCIDRFilter.Store(c.remoteCIDRFilter)
 	ifce.tryPromoteEvery.Store(c.tryPromoteEvery)
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
 
 	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy)
+	ifce.connectionManager.keepalive.Store(c.keepaliveOverrides)
+	if c.nonceLimit != 0 {
+		ifce.connectionManager.nonceLimit.Store(c.nonceLimit)
+	}
 
 	return ifce, nil
 }
@@ -217,7 +362,7 @@ func (f *Interface) activate() {
 		WithField("boringcrypto", boringEnabled()).
 		Info("Nebula interface is active")
 
-	metrics.GetOrRegisterGauge("routines", nil).Update(int64(f.routines))
+	metrics.GetOrRegisterGauge("routines", f.metricsRegistry).Update(int64(f.routines))
 
 	// Prepare n tun queues
 	var reader io.ReadWriteCloser = f.inside
@@ -228,7 +373,7 @@ func (f *Interface) activate() {
 				f.l.Fatal(err)
 			}
 		}
-		f.readers[i] = reader
+		f.readers[i] = f.tunWriteRetry.wrap(f.tunWatchdog.wrap(reader))
 	}
 
 	if err := f.inside.Activate(); err != nil {
@@ -250,8 +395,6 @@ func (f *Interface) run() {
 }
 
 func (f *Interface) listenOut(i int) {
-	runtime.LockOSThread()
-
 	var li udp.Conn
 	// TODO clean this up with a coherent interface for each outside connection
 	if i > 0 {
@@ -260,9 +403,16 @@ func (f *Interface) listenOut(i int) {
 		li = f.outside
 	}
 
+	f.listenOn(li, i, readOutsidePackets(f))
+}
+
+// listenOn reads packets from li until it is closed
+func (f *Interface) listenOn(li udp.Conn, i int, r udp.EncReader) {
+	runtime.LockOSThread()
+
 	lhh := f.lightHouse.NewRequestHandler()
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
-	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
+	li.ListenOut(r, lhHandleRequest(lhh, f), conntrackCache, i)
 }
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
@@ -283,7 +433,8 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			}
 
 			f.l.WithError(err).Error("Error while reading outbound packet")
-			// This only seems to happen when something fatal happens to the fd, so exit.
+			// This only seems to happen when something fatal happens to the fd, or the tun watchdog gave up on
+			// recreating it, so exit.
 			os.Exit(2)
 		}
 
@@ -295,6 +446,10 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadFirewall)
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadMisc)
+	c.RegisterReloadCallback(f.reloadListenPort)
+	c.RegisterReloadCallback(f.reloadRemoteCIDRs)
+	c.RegisterReloadCallback(f.reloadKeepaliveOverrides)
+	c.RegisterReloadCallback(f.reloadKeepWarm)
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
 	}
@@ -330,8 +485,17 @@ func (f *Interface) reloadFirewall(c *config.C) {
 		fw.Conntrack = conntrack
 	}
 
+	fw.flows = oldFw.flows
 	f.firewall = fw
 
+	if fw.Conntrack == conntrack {
+		drained := fw.drainConntrack(f.hostMap.QueryVpnIp, f.pki.GetCAPool())
+
+		if drained > 0 {
+			f.l.WithField("drained", drained).Info("Dropped conntrack entries the new firewall rules no longer allow")
+		}
+	}
+
 	oldFw.Destroy()
 	f.l.WithField("firewallHash", fw.GetRuleHash()).
 		WithField("oldFirewallHash", oldFw.GetRuleHash()).
@@ -363,6 +527,43 @@ func (f *Interface) reloadSendRecvError(c *config.C) {
 	}
 }
 
+func (f *Interface) reloadRemoteCIDRs(c *config.C) {
+	if c.InitialLoad() || !(c.HasChanged("listen.allow_remote_cidrs") || c.HasChanged("listen.block_remote_cidrs")) {
+		return
+	}
+
+	rf, err := newRemoteCIDRFilterFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Error while loading the remote cidr filter, keeping the current filter")
+		return
+	}
+
+	f.remoteCIDRFilter.Store(rf)
+	f.l.Info("listen.allow_remote_cidrs or listen.block_remote_cidrs has changed")
+}
+
+// reloadKeepaliveOverrides applies to each tunnel the next time it is checked
+func (f *Interface) reloadKeepaliveOverrides(c *config.C) {
+	if c.InitialLoad() || !c.HasChanged("punchy.keepalive_overrides") {
+		return
+	}
+
+	ko, err := newKeepaliveOverridesFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Error while loading punchy.keepalive_overrides, keeping the current overrides")
+		return
+	}
+
+	f.connectionManager.keepalive.Store(ko)
+	f.l.Info("punchy.keepalive_overrides has changed")
+}
+
+func (f *Interface) reloadKeepWarm(c *config.C) {
+	if err := f.keepWarm.reload(c, f.hostMap.vpnCIDR, false); err != nil {
+		f.l.WithError(err).Error("Error while loading handshakes.keep_warm, keeping the current list")
+	}
+}
+
 func (f *Interface) reloadMisc(c *config.C) {
 	if c.HasChanged("counters.try_promote") {
 		n := c.GetUint32("counters.try_promote", defaultPromoteEvery)
@@ -376,6 +577,75 @@ func (f *Interface) reloadMisc(c *config.C) {
 		f.l.Info("counters.requery_every_packets has changed")
 	}
 
+	if c.HasChanged("handshakes.roaming") {
+		f.roaming.Store(c.GetBool("handshakes.roaming", true))
+		f.l.Info("handshakes.roaming has changed")
+	}
+
+	if c.HasChanged("listen.reflect_ecn") {
+		f.reflectECN.Store(c.GetBool("listen.reflect_ecn", false))
+		f.l.Info("listen.reflect_ecn has changed")
+	}
+
+	if c.HasChanged("tun.routing_ttl") {
+		f.routingTTL.Store(c.GetBool("tun.routing_ttl", false))
+		f.l.Info("tun.routing_ttl has changed")
+	}
+
+	if c.HasChanged("handshakes.psk") {
+		if psk := handshakePSK(c); psk != nil {
+			f.psk.Store(&psk)
+		} else {
+			f.psk.Store(nil)
+		}
+		f.l.Info("handshakes.psk has changed, new handshakes will use it")
+	}
+
+	if c.HasChanged("pki.clock_skew_window") {
+		f.clockSkewWindow.Store(int64(c.GetDuration("pki.clock_skew_window", defaultClockSkewWindow)))
+		f.l.Info("pki.clock_skew_window has changed")
+	}
+
+	if c.HasChanged("handshakes.nonce_safety_margin") {
+		limit, err := getNonceLimit(c)
+		if err != nil {
+			f.l.WithError(err).Error("Error while loading handshakes.nonce_safety_margin, keeping the current margin")
+		} else {
+			f.connectionManager.nonceLimit.Store(limit)
+			f.l.Info("handshakes.nonce_safety_margin has changed")
+		}
+	}
+
+	if c.HasChanged("handshakes.replay_window") {
+		w, err := getReplayWindow(c)
+		if err != nil {
+			f.l.WithError(err).Error("Error while loading handshakes.replay_window, keeping the current window")
+		} else {
+			f.replayWindow.Store(w)
+			f.l.Info("handshakes.replay_window has changed, new tunnels will use it")
+		}
+	}
+
+	if c.HasChanged("handshakes.padding") {
+		padding, err := getHandshakePadding(c)
+		if err != nil {
+			f.l.WithError(err).Error("Error while loading handshakes.padding, keeping the current padding")
+		} else {
+			f.handshakePadding.Store(padding)
+			f.l.Info("handshakes.padding has changed")
+		}
+	}
+
+	if c.HasChanged("handshakes.duplicate_vpn_ip") {
+		policy, err := getDuplicateVpnIpPolicy(c)
+		if err != nil {
+			f.l.WithError(err).Error("Error while loading handshakes.duplicate_vpn_ip, keeping the current policy")
+		} else {
+			f.handshakeManager.duplicateVpnIp.Store(uint32(policy))
+			f.l.WithField("policy", policy).Info("handshakes.duplicate_vpn_ip has changed")
+		}
+	}
+
 	if c.HasChanged("timers.requery_wait_duration") {
 		n := c.GetDuration("timers.requery_wait_duration", defaultReQueryWait)
 		f.reQueryWait.Store(int64(n))
@@ -387,9 +657,9 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	ticker := time.NewTicker(i)
 	defer ticker.Stop()
 
-	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	udpStats := udp.NewUDPStatsEmitter(f.writers, f.metricsRegistry)
 
-	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
+	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", f.metricsRegistry)
 
 	for {
 		select {
@@ -400,12 +670,14 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 			f.handshakeManager.EmitStats()
 			udpStats()
 			certExpirationGauge.Update(int64(f.pki.GetCertState().Certificate.Details.NotAfter.Sub(time.Now()) / time.Second))
+			f.pki.checkCAExpiry(time.Now(), false)
 		}
 	}
 }
 
 func (f *Interface) Close() error {
 	f.closed.Store(true)
+	f.tunWatchdog.close()
 
 	for _, u := range f.writers {
 		err := u.Close()
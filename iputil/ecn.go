@@ -0,0 +1,58 @@
+package iputil
+
+import "encoding/binary"
+
+// ECN codepoints from rfc3168, the low 2 bits of the ipv4 TOS and ipv6 traffic class
+const (
+	ECNNotECT byte = 0
+	ECNECT1   byte = 1
+	ECNECT0   byte = 2
+	ECNCE     byte = 3
+)
+
+// ECN returns the ECN bits of an ipv4 or ipv6 packet, ECNNotECT if the packet is neither
+func ECN(packet []byte) byte {
+	if len(packet) < 2 {
+		return ECNNotECT
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		return packet[1] & 0x03
+	case 6:
+		// The traffic class straddles the first 2 bytes, ECN is the low 2 bits of it
+		return (packet[1] >> 4) & 0x03
+	default:
+		return ECNNotECT
+	}
+}
+
+// DecapsulateECN applies the ECN bits of the outer header to the inner packet as described by rfc6040. Congestion
+// experienced on the underlay is marked on inner packets that are ECN capable, every other combination leaves the
+// inner packet as it is. The DSCP bits are never changed.
+func DecapsulateECN(packet []byte, outer byte) {
+	if outer != ECNCE {
+		return
+	}
+
+	inner := ECN(packet)
+	if inner == ECNNotECT || inner == ECNCE {
+		return
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) << 2
+		if ihl < 20 || len(packet) < ihl {
+			return
+		}
+
+		packet[1] |= ECNCE
+		packet[10] = 0
+		packet[11] = 0
+		binary.BigEndian.PutUint16(packet[10:], tcpipChecksum(packet[:ihl], 0))
+
+	case 6:
+		packet[1] |= ECNCE << 4
+	}
+}
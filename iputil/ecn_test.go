@@ -0,0 +1,55 @@
+package iputil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECN(t *testing.T) {
+	v4 := []byte{0x45, 0xb8 | ECNECT0}
+	assert.Equal(t, ECNECT0, ECN(v4))
+
+	// DSCP 46 and ECT(1) in the traffic class
+	tc := byte(0xb8 | ECNECT1)
+	v6 := []byte{0x60 | tc>>4, tc << 4}
+	assert.Equal(t, ECNECT1, ECN(v6))
+
+	assert.Equal(t, ECNNotECT, ECN([]byte{0x10, 0xff}))
+	assert.Equal(t, ECNNotECT, ECN(nil))
+}
+
+func TestDecapsulateECN(t *testing.T) {
+	newV4 := func(tos byte) []byte {
+		p := []byte{
+			0x45, tos, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00, 0x40, 0x11, 0x00, 0x00,
+			10, 0, 0, 1,
+			10, 0, 0, 2,
+		}
+		csum := tcpipChecksum(p, 0)
+		p[10], p[11] = byte(csum>>8), byte(csum)
+		return p
+	}
+
+	// Congestion is marked on capable packets and the DSCP bits and checksum survive
+	p := newV4(0xb8 | ECNECT0)
+	DecapsulateECN(p, ECNCE)
+	assert.Equal(t, byte(0xb8|ECNCE), p[1])
+	assert.Equal(t, uint16(0), tcpipChecksum(p, 0))
+
+	// Not ECN capable inner packets are left alone
+	p = newV4(0xb8)
+	DecapsulateECN(p, ECNCE)
+	assert.Equal(t, byte(0xb8), p[1])
+
+	// Only congestion experienced is carried back
+	p = newV4(0xb8 | ECNECT1)
+	DecapsulateECN(p, ECNECT0)
+	assert.Equal(t, byte(0xb8|ECNECT1), p[1])
+
+	tc := byte(0xb8 | ECNECT0)
+	v6 := []byte{0x60 | tc>>4, tc << 4, 0x00, 0x00}
+	DecapsulateECN(v6, ECNCE)
+	assert.Equal(t, ECNCE, ECN(v6))
+	assert.Equal(t, []byte{0x6b, 0xb0, 0x00, 0x00}, v6)
+}
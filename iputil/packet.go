@@ -6,8 +6,12 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
+// CreateRejectPacket returns nil for anything other than ipv4, there is no ipv6 reject yet
 func CreateRejectPacket(packet []byte, out []byte) []byte {
-	// TODO ipv4 only, need to fix when inside supports ipv6
+	if packet[0]>>4 != 4 {
+		return nil
+	}
+
 	switch packet[9] {
 	case 6: // tcp
 		return ipv4CreateRejectTCPPacket(packet, out)
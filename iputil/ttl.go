@@ -0,0 +1,138 @@
+package iputil
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+)
+
+// DecrementTTL decrements the ipv4 TTL or ipv6 hop limit of a packet being forwarded and returns true if the packet
+// expired instead. An expired packet is left as it is so it can be quoted in a time exceeded message. Anything that is
+// not a valid ipv4 or ipv6 header is left alone and never expires.
+func DecrementTTL(packet []byte) bool {
+	if len(packet) < 1 {
+		return false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) << 2
+		if ihl < ipv4.HeaderLen || len(packet) < ihl {
+			return false
+		}
+
+		if packet[8] <= 1 {
+			return true
+		}
+
+		packet[8]--
+		packet[10] = 0
+		packet[11] = 0
+		binary.BigEndian.PutUint16(packet[10:], tcpipChecksum(packet[:ihl], 0))
+
+	case 6:
+		if len(packet) < 40 {
+			return false
+		}
+
+		// There is no header checksum in ipv6
+		if packet[7] <= 1 {
+			return true
+		}
+		packet[7]--
+	}
+
+	return false
+}
+
+// CreateTimeExceededPacket returns an ICMP time exceeded in transit message from src for an expired ipv4 packet. It
+// returns nil for ipv6, an ICMPv6 error must come from an ipv6 address of ours and vpn ips are ipv4 only. It also
+// returns nil for fragments other than the first, and ICMP error messages which must never cause another error.
+func CreateTimeExceededPacket(packet []byte, src []byte, out []byte) []byte {
+	return createICMPErrorPacket(packet, src, out, 11, 0) // Time Exceeded, TTL exceeded in transit
+}
+
+// CreateHostUnreachablePacket returns an ICMP host unreachable message from src for an ipv4 packet that can not be
+// routed. Like CreateTimeExceededPacket it returns nil for packets that must not cause an error message.
+func CreateHostUnreachablePacket(packet []byte, src []byte, out []byte) []byte {
+	return createICMPErrorPacket(packet, src, out, 3, 1) // Destination Unreachable, host unreachable
+}
+
+// createICMPErrorPacket returns an ICMP error message of icmpType and code from src quoting the start of packet
+func createICMPErrorPacket(packet []byte, src []byte, out []byte, icmpType byte, code byte) []byte {
+	if len(packet) < ipv4.HeaderLen || packet[0]>>4 != 4 {
+		return nil
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if ihl < ipv4.HeaderLen || len(packet) < ihl {
+		return nil
+	}
+
+	// Only the first fragment, its offset is 0
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil
+	}
+
+	if packet[9] == 1 && len(packet) > ihl && isICMPError(packet[ihl]) {
+		return nil
+	}
+
+	// Like a reject the reply includes the header and first 8 bytes of the packet
+	packetLen := len(packet)
+	if packetLen > ihl+8 {
+		packetLen = ihl + 8
+	}
+
+	outLen := ipv4.HeaderLen + 8 + packetLen
+	out = out[:outLen]
+
+	ipHdr := out[0:ipv4.HeaderLen]
+	ipHdr[0] = ipv4.Version<<4 | (ipv4.HeaderLen >> 2)    // version, ihl
+	ipHdr[1] = 0                                          // DSCP, ECN
+	binary.BigEndian.PutUint16(ipHdr[2:], uint16(outLen)) // Total Length
+
+	ipHdr[4] = 0  // id
+	ipHdr[5] = 0  //  .
+	ipHdr[6] = 0  // flags, fragment offset
+	ipHdr[7] = 0  //  .
+	ipHdr[8] = 64 // TTL
+	ipHdr[9] = 1  // protocol (icmp)
+	ipHdr[10] = 0 // checksum
+	ipHdr[11] = 0 //  .
+
+	// From us, the router, back to the source
+	copy(ipHdr[12:16], src)
+	copy(ipHdr[16:20], packet[12:16])
+
+	// Calculate checksum
+	binary.BigEndian.PutUint16(ipHdr[10:], tcpipChecksum(ipHdr, 0))
+
+	icmpOut := out[ipv4.HeaderLen:]
+	icmpOut[0] = icmpType // type
+	icmpOut[1] = code     // code
+	icmpOut[2] = 0        // checksum
+	icmpOut[3] = 0        //  .
+	icmpOut[4] = 0        // unused
+	icmpOut[5] = 0        //  .
+	icmpOut[6] = 0        //  .
+	icmpOut[7] = 0        //  .
+
+	// Copy original IP header and first 8 bytes as body
+	copy(icmpOut[8:], packet[:packetLen])
+
+	// Calculate checksum
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, 0))
+
+	return out
+}
+
+// isICMPError returns true for the ICMP types that report an error, rfc1812 4.3.2.7
+func isICMPError(t byte) bool {
+	switch t {
+	case 3, 4, 5, 11, 12: // destination unreachable, source quench, redirect, time exceeded, parameter problem
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+package iputil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTTLTestPacket(ttl, proto byte, payload ...byte) []byte {
+	p := []byte{
+		0x45, 0x00, 0x00, byte(20 + len(payload)), 0x00, 0x00, 0x00, 0x00, ttl, proto, 0x00, 0x00,
+		10, 0, 0, 1,
+		192, 168, 0, 1,
+	}
+	csum := tcpipChecksum(p, 0)
+	p[10], p[11] = byte(csum>>8), byte(csum)
+	return append(p, payload...)
+}
+
+func TestDecrementTTL(t *testing.T) {
+	p := newTTLTestPacket(64, 17)
+	assert.False(t, DecrementTTL(p))
+	assert.Equal(t, byte(63), p[8])
+	assert.Equal(t, uint16(0), tcpipChecksum(p, 0))
+
+	// A packet that would leave with a ttl of 0 expires and is not changed
+	p = newTTLTestPacket(1, 17)
+	assert.True(t, DecrementTTL(p))
+	assert.Equal(t, byte(1), p[8])
+	assert.True(t, DecrementTTL(newTTLTestPacket(0, 17)))
+
+	v6 := make([]byte, 40)
+	v6[0] = 0x60
+	v6[7] = 2
+	assert.False(t, DecrementTTL(v6))
+	assert.Equal(t, byte(1), v6[7])
+	assert.True(t, DecrementTTL(v6))
+
+	// Garbage is left alone
+	assert.False(t, DecrementTTL(nil))
+	assert.False(t, DecrementTTL([]byte{0x45, 0x00}))
+	assert.False(t, DecrementTTL([]byte{0x60, 0x00}))
+}
+
+func TestCreateTimeExceededPacket(t *testing.T) {
+	udp := []byte{0x30, 0x39, 0x82, 0x9a, 0x00, 0x0c, 0x00, 0x00, 'h', 'i', '!', '!'}
+	p := newTTLTestPacket(1, 17, udp...)
+	out := CreateTimeExceededPacket(p, []byte{10, 0, 0, 2}, make([]byte, 96))
+
+	// ip header, icmp header, then the original ip header and first 8 bytes
+	assert.Len(t, out, 20+8+20+8)
+	assert.Equal(t, uint16(0), tcpipChecksum(out[:20], 0))
+	assert.Equal(t, byte(1), out[9])
+	assert.Equal(t, []byte{10, 0, 0, 2}, out[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 1}, out[16:20])
+
+	icmp := out[20:]
+	assert.Equal(t, byte(11), icmp[0])
+	assert.Equal(t, byte(0), icmp[1])
+	assert.Equal(t, uint16(0), tcpipChecksum(icmp, 0))
+	assert.Equal(t, p[:28], icmp[8:])
+
+	t.Log("ICMP errors never cause another error")
+	assert.Nil(t, CreateTimeExceededPacket(newTTLTestPacket(1, 1, 3, 3, 0, 0, 0, 0, 0, 0), []byte{10, 0, 0, 2}, make([]byte, 96)))
+	// But an echo request does, that is what traceroute on windows sends
+	assert.NotNil(t, CreateTimeExceededPacket(newTTLTestPacket(1, 1, 8, 0, 0, 0, 0, 0, 0, 0), []byte{10, 0, 0, 2}, make([]byte, 96)))
+
+	t.Log("Only the first fragment gets a reply")
+	p = newTTLTestPacket(1, 17, udp...)
+	p[7] = 0x10
+	assert.Nil(t, CreateTimeExceededPacket(p, []byte{10, 0, 0, 2}, make([]byte, 96)))
+
+	t.Log("There is no ipv6 time exceeded")
+	v6 := make([]byte, 40)
+	v6[0] = 0x60
+	assert.Nil(t, CreateTimeExceededPacket(v6, []byte{10, 0, 0, 2}, make([]byte, 96)))
+}
+
+func TestCreateHostUnreachablePacket(t *testing.T) {
+	udp := []byte{0x30, 0x39, 0x82, 0x9a, 0x00, 0x0c, 0x00, 0x00, 'h', 'i', '!', '!'}
+	p := newTTLTestPacket(64, 17, udp...)
+	out := CreateHostUnreachablePacket(p, []byte{10, 0, 0, 2}, make([]byte, 96))
+
+	assert.Len(t, out, 20+8+20+8)
+	assert.Equal(t, []byte{10, 0, 0, 2}, out[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 1}, out[16:20])
+
+	icmp := out[20:]
+	assert.Equal(t, byte(3), icmp[0])
+	assert.Equal(t, byte(1), icmp[1])
+	assert.Equal(t, uint16(0), tcpipChecksum(icmp, 0))
+	assert.Equal(t, p[:28], icmp[8:])
+
+	assert.Nil(t, CreateHostUnreachablePacket(newTTLTestPacket(64, 1, 3, 1, 0, 0, 0, 0, 0, 0), []byte{10, 0, 0, 2}, make([]byte, 96)))
+}
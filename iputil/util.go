@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync/atomic"
 )
 
 type VpnIp uint32
@@ -53,6 +54,19 @@ func Ip2VpnIp(ip []byte) VpnIp {
 	return VpnIp(binary.BigEndian.Uint32(ip))
 }
 
+// AtomicVpnIp is a VpnIp that can be changed while other routines read it
+type AtomicVpnIp struct {
+	v atomic.Uint32
+}
+
+func (a *AtomicVpnIp) Load() VpnIp {
+	return VpnIp(a.v.Load())
+}
+
+func (a *AtomicVpnIp) Store(ip VpnIp) {
+	a.v.Store(uint32(ip))
+}
+
 func ToNetIpAddr(ip net.IP) (netip.Addr, error) {
 	addr, ok := netip.AddrFromSlice(ip)
 	if !ok {
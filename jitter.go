@@ -0,0 +1,37 @@
+package nebula
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// maxJitter is the largest fraction of an interval that it can be moved by
+const maxJitter = 0.5
+
+// minKeepaliveInterval is the shortest a jittered tunnel check and punch interval can be
+const minKeepaliveInterval = time.Second
+
+// getJitter reads the jitter fraction at k, which must be between 0 and maxJitter
+func getJitter(c *config.C, k string) (float64, error) {
+	j := c.GetFloat64(k, 0)
+	if j < 0 || j > maxJitter {
+		return 0, fmt.Errorf("%s must be between 0 and %v: %v", k, maxJitter, j)
+	}
+	return j, nil
+}
+
+// jitter returns d moved randomly by up to fraction of d in either direction, the result is never less than min
+func jitter(d time.Duration, fraction float64, min time.Duration) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+
+	d += time.Duration((rand.Float64()*2 - 1) * fraction * float64(d))
+	if d < min {
+		return min
+	}
+	return d
+}
@@ -0,0 +1,67 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitter(t *testing.T) {
+	// No jitter leaves the interval alone
+	assert.Equal(t, 5*time.Second, jitter(5*time.Second, 0, time.Second))
+
+	var below, above bool
+	for i := 0; i < 10000; i++ {
+		d := jitter(10*time.Second, 0.2, time.Second)
+		assert.GreaterOrEqual(t, d, 8*time.Second)
+		assert.LessOrEqual(t, d, 12*time.Second)
+		below = below || d < 10*time.Second
+		above = above || d > 10*time.Second
+	}
+	assert.True(t, below && above, "jitter should move the interval in both directions")
+
+	// The minimum is respected
+	for i := 0; i < 10000; i++ {
+		d := jitter(time.Second, maxJitter, 900*time.Millisecond)
+		assert.GreaterOrEqual(t, d, 900*time.Millisecond)
+		assert.LessOrEqual(t, d, 1500*time.Millisecond)
+	}
+}
+
+func TestHandshakeManager_retryInterval(t *testing.T) {
+	hm := &HandshakeManager{config: HandshakeConfig{tryInterval: 100 * time.Millisecond, jitter: maxJitter}}
+	for counter := 1; counter <= 10; counter++ {
+		base := hm.config.tryInterval * time.Duration(counter)
+		for i := 0; i < 1000; i++ {
+			d := hm.retryInterval(counter)
+			assert.GreaterOrEqual(t, d, hm.config.tryInterval)
+			assert.GreaterOrEqual(t, d, base/2)
+			assert.LessOrEqual(t, d, base*3/2)
+		}
+	}
+}
+
+func TestGetJitter(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	j, err := getJitter(c, "handshakes.jitter")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), j)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"jitter": 0.25}
+	j, err = getJitter(c, "handshakes.jitter")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, j)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"jitter": 0.75}
+	_, err = getJitter(c, "handshakes.jitter")
+	assert.EqualError(t, err, "handshakes.jitter must be between 0 and 0.5: 0.75")
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"jitter": -0.1}
+	_, err = getJitter(c, "handshakes.jitter")
+	assert.EqualError(t, err, "handshakes.jitter must be between 0 and 0.5: -0.1")
+}
@@ -0,0 +1,134 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// keepWarmInterval is how often keepWarm makes sure every warm tunnel is up, a dropped tunnel wakes it sooner
+const keepWarmInterval = time.Second
+
+// keepWarm keeps a tunnel up to every vpn ip in handshakes.keep_warm whether or not there is traffic for it. The tunnels
+// are started once nebula is running and started again as soon as they drop.
+type keepWarm struct {
+	l   *logrus.Logger
+	ips atomic.Pointer[map[iputil.VpnIp]struct{}]
+
+	// kick wakes run right away when a warm tunnel drops
+	kick chan struct{}
+
+	metricUp   metrics.Gauge
+	metricDown metrics.Gauge
+}
+
+func newKeepWarm(l *logrus.Logger, registry metrics.Registry) *keepWarm {
+	kw := &keepWarm{
+		l:          l,
+		kick:       make(chan struct{}, 1),
+		metricUp:   metrics.GetOrRegisterGauge("handshakes.keep_warm.up", registry),
+		metricDown: metrics.GetOrRegisterGauge("handshakes.keep_warm.down", registry),
+	}
+	kw.ips.Store(&map[iputil.VpnIp]struct{}{})
+	return kw
+}
+
+// parseKeepWarm reads the vpn ips in handshakes.keep_warm, they must be within tunCidr
+func parseKeepWarm(c *config.C, tunCidr *net.IPNet) (map[iputil.VpnIp]struct{}, error) {
+	ips := map[iputil.VpnIp]struct{}{}
+	for i, v := range c.GetStringSlice("handshakes.keep_warm", []string{}) {
+		ip := net.ParseIP(v).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("entry %v in handshakes.keep_warm is not a vpn ip: %v", i+1, v)
+		}
+
+		if !tunCidr.Contains(ip) {
+			return nil, fmt.Errorf("entry %v in handshakes.keep_warm is not in our network %v: %v", i+1, tunCidr, v)
+		}
+
+		ips[iputil.Ip2VpnIp(ip)] = struct{}{}
+	}
+
+	return ips, nil
+}
+
+func (kw *keepWarm) reload(c *config.C, tunCidr *net.IPNet, initial bool) error {
+	if !initial && !c.HasChanged("handshakes.keep_warm") {
+		return nil
+	}
+
+	ips, err := parseKeepWarm(c, tunCidr)
+	if err != nil {
+		return err
+	}
+
+	kw.ips.Store(&ips)
+	if !initial {
+		kw.l.WithField("keepWarm", len(ips)).Info("handshakes.keep_warm has changed")
+		kw.wake()
+	}
+	return nil
+}
+
+// run keeps the warm tunnels up until ctx is done
+func (kw *keepWarm) run(ctx context.Context, f *Interface) {
+	ticker := time.NewTicker(keepWarmInterval)
+	defer ticker.Stop()
+
+	for {
+		kw.check(f)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kw.kick:
+		}
+	}
+}
+
+// check starts a handshake with every warm vpn ip that has no tunnel and updates the up and down gauges. A handshake
+// that is already in flight is left alone.
+func (kw *keepWarm) check(f *Interface) {
+	var up, down int64
+	for vpnIp := range *kw.ips.Load() {
+		if f.hostMap.QueryVpnIp(vpnIp) != nil {
+			up++
+			continue
+		}
+
+		down++
+		if kw.l.Level >= logrus.DebugLevel {
+			kw.l.WithField("vpnIp", vpnIp).Debug("Starting a handshake for a handshakes.keep_warm tunnel")
+		}
+		f.handshakeManager.StartHandshake(vpnIp, nil)
+	}
+
+	kw.metricUp.Update(up)
+	kw.metricDown.Update(down)
+}
+
+// dropped wakes run if the last tunnel to vpnIp was to a warm vpn ip
+func (kw *keepWarm) dropped(vpnIp iputil.VpnIp) {
+	if kw == nil {
+		return
+	}
+
+	if _, ok := (*kw.ips.Load())[vpnIp]; ok {
+		kw.wake()
+	}
+}
+
+func (kw *keepWarm) wake() {
+	select {
+	case kw.kick <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,96 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseKeepWarm(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, tunCidr, _ := net.ParseCIDR("10.1.0.0/16")
+
+	ips, err := parseKeepWarm(c, tunCidr)
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"keep_warm": []interface{}{"10.1.0.2", "10.1.5.5"}}
+	ips, err = parseKeepWarm(c, tunCidr)
+	assert.NoError(t, err)
+	assert.Equal(t, map[iputil.VpnIp]struct{}{
+		iputil.Ip2VpnIp(net.IP{10, 1, 0, 2}): {},
+		iputil.Ip2VpnIp(net.IP{10, 1, 5, 5}): {},
+	}, ips)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"keep_warm": []interface{}{"nope"}}
+	_, err = parseKeepWarm(c, tunCidr)
+	assert.EqualError(t, err, "entry 1 in handshakes.keep_warm is not a vpn ip: nope")
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"keep_warm": []interface{}{"10.1.0.2", "10.2.0.1"}}
+	_, err = parseKeepWarm(c, tunCidr)
+	assert.EqualError(t, err, "entry 2 in handshakes.keep_warm is not in our network 10.1.0.0/16: 10.2.0.1")
+}
+
+func TestKeepWarm_redial(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	warmIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+	coldIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.3"))
+
+	c := config.NewC(l)
+	c.Settings["handshakes"] = map[interface{}]interface{}{"keep_warm": []interface{}{"172.1.1.2"}}
+	kw := newKeepWarm(l, nil)
+	assert.NoError(t, kw.reload(c, vpncidr, true))
+
+	hostMap := NewHostMap(l, nil, vpncidr, nil)
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:          hostMap,
+		inside:           &test.NoopTun{},
+		outside:          &udp.NoopConn{},
+		firewall:         &Firewall{},
+		lightHouse:       lh,
+		pki:              &PKI{},
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		keepWarm:         kw,
+		l:                l,
+	}
+
+	newTunnel := func(vpnIp iputil.VpnIp, index uint32) *HostInfo {
+		hostinfo := &HostInfo{vpnIp: vpnIp, localIndexId: index, remoteIndexId: index}
+		hostinfo.ConnectionState = &ConnectionState{myCert: &cert.NebulaCertificate{}, H: &noise.HandshakeState{}}
+		hostMap.unlockedAddHostInfo(hostinfo, ifce)
+		return hostinfo
+	}
+
+	warm := newTunnel(warmIp, 1)
+	cold := newTunnel(coldIp, 2)
+
+	// Both tunnels are up, nothing to do
+	kw.check(ifce)
+	assert.Nil(t, ifce.handshakeManager.QueryVpnIp(warmIp))
+	assert.Equal(t, int64(1), kw.metricUp.Value())
+	assert.Equal(t, int64(0), kw.metricDown.Value())
+
+	// A cold tunnel dropping is left alone
+	ifce.closeTunnel(cold, "test")
+	assert.Len(t, kw.kick, 0)
+	kw.check(ifce)
+	assert.Nil(t, ifce.handshakeManager.QueryVpnIp(coldIp))
+
+	// The warm tunnel dropping wakes the loop and is handshaked again without any traffic for it
+	ifce.closeTunnel(warm, "test")
+	assert.Len(t, kw.kick, 1)
+	kw.check(ifce)
+	assert.NotNil(t, ifce.handshakeManager.QueryVpnIp(warmIp))
+	assert.Equal(t, int64(0), kw.metricUp.Value())
+	assert.Equal(t, int64(1), kw.metricDown.Value())
+}
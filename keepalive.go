@@ -0,0 +1,109 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// maxKeepaliveInterval is the longest a keepalive override can be, the traffic timer wheel is sized to hold it
+const maxKeepaliveInterval = 5 * time.Minute
+
+// keepaliveOverrides replaces timers.connection_alive_interval, how often a tunnel is checked and punched when idle, for
+// some peers. A host override wins over group overrides and the shortest interval wins when several groups match.
+type keepaliveOverrides struct {
+	hosts  map[iputil.VpnIp]time.Duration
+	groups map[string]time.Duration
+}
+
+// KeepaliveInfo is the keepalive interval in effect for a peer and where it came from, one of default, host or
+// group:<name>
+type KeepaliveInfo struct {
+	VpnIp    iputil.VpnIp `json:"vpnIp"`
+	Interval string       `json:"interval"`
+	Source   string       `json:"source"`
+}
+
+// newKeepaliveOverridesFromConfig reads punchy.keepalive_overrides, returns nil if there are none
+func newKeepaliveOverridesFromConfig(c *config.C) (*keepaliveOverrides, error) {
+	ko := &keepaliveOverrides{}
+
+	for k, v := range c.GetMap("punchy.keepalive_overrides.hosts", map[interface{}]interface{}{}) {
+		ip := net.ParseIP(fmt.Sprintf("%v", k)).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("punchy.keepalive_overrides.hosts has an invalid vpn ip: %v", k)
+		}
+
+		d, err := parseKeepaliveInterval(fmt.Sprintf("punchy.keepalive_overrides.hosts.%v", k), v)
+		if err != nil {
+			return nil, err
+		}
+
+		if ko.hosts == nil {
+			ko.hosts = map[iputil.VpnIp]time.Duration{}
+		}
+		ko.hosts[iputil.Ip2VpnIp(ip)] = d
+	}
+
+	for k, v := range c.GetMap("punchy.keepalive_overrides.groups", map[interface{}]interface{}{}) {
+		d, err := parseKeepaliveInterval(fmt.Sprintf("punchy.keepalive_overrides.groups.%v", k), v)
+		if err != nil {
+			return nil, err
+		}
+
+		if ko.groups == nil {
+			ko.groups = map[string]time.Duration{}
+		}
+		ko.groups[fmt.Sprintf("%v", k)] = d
+	}
+
+	if ko.hosts == nil && ko.groups == nil {
+		return nil, nil
+	}
+
+	return ko, nil
+}
+
+func parseKeepaliveInterval(k string, v interface{}) (time.Duration, error) {
+	d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+	if err != nil {
+		return 0, fmt.Errorf("%s failed to parse: %v", k, err)
+	}
+
+	if d < minKeepaliveInterval || d > maxKeepaliveInterval {
+		return 0, fmt.Errorf("%s must be between %s and %s: %s", k, minKeepaliveInterval, maxKeepaliveInterval, d)
+	}
+
+	return d, nil
+}
+
+// resolve returns the keepalive interval for the peer at vpnIp with groups, def if there is no override for it, along
+// with where the interval came from
+func (ko *keepaliveOverrides) resolve(vpnIp iputil.VpnIp, groups []string, def time.Duration) (time.Duration, string) {
+	if ko == nil {
+		return def, "default"
+	}
+
+	if d, ok := ko.hosts[vpnIp]; ok {
+		return d, "host"
+	}
+
+	interval, source := def, "default"
+	found := false
+	for _, g := range groups {
+		d, ok := ko.groups[g]
+		if !ok {
+			continue
+		}
+
+		if !found || d < interval {
+			interval, source = d, "group:"+g
+			found = true
+		}
+	}
+
+	return interval, source
+}
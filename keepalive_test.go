@@ -0,0 +1,88 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeepaliveOverridesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ko, err := newKeepaliveOverridesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, ko)
+
+	assert.NoError(t, c.LoadString(`
+punchy:
+  keepalive_overrides:
+    hosts:
+      10.128.0.2: 20s
+    groups:
+      mobile: 15s
+`))
+	ko, err = newKeepaliveOverridesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, map[iputil.VpnIp]time.Duration{iputil.Ip2VpnIp(net.ParseIP("10.128.0.2")): 20 * time.Second}, ko.hosts)
+	assert.Equal(t, map[string]time.Duration{"mobile": 15 * time.Second}, ko.groups)
+
+	c.Settings["punchy"] = map[interface{}]interface{}{"keepalive_overrides": map[interface{}]interface{}{
+		"hosts": map[interface{}]interface{}{"nope": "20s"},
+	}}
+	_, err = newKeepaliveOverridesFromConfig(c)
+	assert.EqualError(t, err, "punchy.keepalive_overrides.hosts has an invalid vpn ip: nope")
+
+	c.Settings["punchy"] = map[interface{}]interface{}{"keepalive_overrides": map[interface{}]interface{}{
+		"groups": map[interface{}]interface{}{"mobile": "100ms"},
+	}}
+	_, err = newKeepaliveOverridesFromConfig(c)
+	assert.EqualError(t, err, "punchy.keepalive_overrides.groups.mobile must be between 1s and 5m0s: 100ms")
+
+	c.Settings["punchy"] = map[interface{}]interface{}{"keepalive_overrides": map[interface{}]interface{}{
+		"groups": map[interface{}]interface{}{"mobile": "often"},
+	}}
+	_, err = newKeepaliveOverridesFromConfig(c)
+	assert.Error(t, err)
+}
+
+func TestKeepaliveOverrides_resolve(t *testing.T) {
+	host := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+	other := iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))
+	def := 5 * time.Second
+
+	// No overrides is always the default
+	var ko *keepaliveOverrides
+	d, source := ko.resolve(host, []string{"mobile"}, def)
+	assert.Equal(t, def, d)
+	assert.Equal(t, "default", source)
+
+	ko = &keepaliveOverrides{
+		hosts:  map[iputil.VpnIp]time.Duration{host: 20 * time.Second},
+		groups: map[string]time.Duration{"mobile": 15 * time.Second, "carrier-nat": 3 * time.Second},
+	}
+
+	// A host override wins over its groups
+	d, source = ko.resolve(host, []string{"carrier-nat"}, def)
+	assert.Equal(t, 20*time.Second, d)
+	assert.Equal(t, "host", source)
+
+	// The shortest matching group wins
+	d, source = ko.resolve(other, []string{"servers", "mobile", "carrier-nat"}, def)
+	assert.Equal(t, 3*time.Second, d)
+	assert.Equal(t, "group:carrier-nat", source)
+
+	d, source = ko.resolve(other, []string{"mobile"}, def)
+	assert.Equal(t, 15*time.Second, d)
+	assert.Equal(t, "group:mobile", source)
+
+	// Anyone else gets the default
+	d, source = ko.resolve(other, []string{"servers"}, def)
+	assert.Equal(t, def, d)
+	assert.Equal(t, "default", source)
+}
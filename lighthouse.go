@@ -2,11 +2,14 @@ package nebula
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,7 +39,7 @@ type LightHouse struct {
 	sync.RWMutex //Because we concurrently read and write to our maps
 	ctx          context.Context
 	amLighthouse bool
-	myVpnIp      iputil.VpnIp
+	myVpnIp      iputil.AtomicVpnIp
 	myVpnZeros   iputil.VpnIp
 	myVpnNet     *net.IPNet
 	punchConn    udp.Conn
@@ -59,23 +62,60 @@ type LightHouse struct {
 	// used to trigger the HandshakeManager when we receive HostQueryReply
 	handshakeTrigger chan<- iputil.VpnIp
 
+	// peerMaintenance holds the hosts that are down for maintenance, we do not hand out their addresses or use them as
+	// relays until they are back
+	peerMaintenance *peerMaintenance
+
+	// used to trigger the HandshakeManager to move tunnels off of a relay that went down for maintenance
+	maintenanceTrigger chan<- iputil.VpnIp
+
+	// peerPolicy serves or fetches the signed peer policy, it is set once the lighthouse is created
+	peerPolicy *peerPolicyManager
+
 	// staticList exists to avoid having a bool in each addrMap entry
 	// since static should be rare
 	staticList  atomic.Pointer[map[iputil.VpnIp]struct{}]
 	lighthouses atomic.Pointer[map[iputil.VpnIp]struct{}]
 
+	// staticHostMap holds the addresses of each static_host_map entry as last loaded, it is only touched by reload to
+	// find which entries changed
+	staticHostMap map[iputil.VpnIp][]string
+
+	// staticFingerprints holds the certificate fingerprint pinned by static_host_map entries, a handshake with the host
+	// is refused if its certificate has a different fingerprint
+	staticFingerprints atomic.Pointer[map[iputil.VpnIp]string]
+
+	// lazyHandshakes stops us from starting tunnels to non lighthouses that we have no traffic for
+	lazyHandshakes atomic.Bool
+
+	// maxAddressesReturned limits the addresses of each family we answer with for a host, 0 is no limit
+	maxAddressesReturned atomic.Int64
+
 	interval     atomic.Int64
 	updateCancel context.CancelFunc
 	ifce         EncWriter
-	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
+	nebulaPort   atomic.Uint32 // 32 bits because protobuf does not have a uint16
 
 	advertiseAddrs atomic.Pointer[[]netIpAndPort]
 
+	// advertiseScopes limits some of the addresses we advertise to peers in certain groups
+	advertiseScopes atomic.Pointer[[]advertiseScope]
+
+	// advertiseOrder holds the cidrs whose addresses we advertise first, in order
+	advertiseOrder atomic.Pointer[[]*net.IPNet]
+
+	// hostMap is used to find the groups of a peer when handing out scoped addresses, it is set once the interface is
+	// created
+	hostMap *HostMap
+
 	// IP's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]iputil.VpnIp]
 
 	calculatedRemotes atomic.Pointer[cidr.Tree4[[]*calculatedRemote]] // Maps VpnIp to []*calculatedRemote
 
+	// queries retries host queries and stops querying lighthouses that do not answer, see lighthouse.query
+	queries *lighthouseQueries
+
 	metrics           *MessageMetrics
 	metricHolepunchTx metrics.Counter
 	l                 *logrus.Logger
@@ -101,25 +141,27 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 
 	ones, _ := myVpnNet.Mask.Size()
 	h := LightHouse{
-		ctx:          ctx,
-		amLighthouse: amLighthouse,
-		myVpnIp:      iputil.Ip2VpnIp(myVpnNet.IP),
-		myVpnZeros:   iputil.VpnIp(32 - ones),
-		myVpnNet:     myVpnNet,
-		addrMap:      make(map[iputil.VpnIp]*RemoteList),
-		nebulaPort:   nebulaPort,
-		punchConn:    pc,
-		punchy:       p,
-		l:            l,
-	}
+		ctx:             ctx,
+		amLighthouse:    amLighthouse,
+		myVpnZeros:      iputil.VpnIp(32 - ones),
+		myVpnNet:        myVpnNet,
+		addrMap:         make(map[iputil.VpnIp]*RemoteList),
+		punchConn:       pc,
+		punchy:          p,
+		peerMaintenance: newPeerMaintenance(),
+		l:               l,
+	}
+	h.myVpnIp.Store(iputil.Ip2VpnIp(myVpnNet.IP))
+	h.nebulaPort.Store(nebulaPort)
 	lighthouses := make(map[iputil.VpnIp]struct{})
 	h.lighthouses.Store(&lighthouses)
 	staticList := make(map[iputil.VpnIp]struct{})
 	h.staticList.Store(&staticList)
 
 	if c.GetBool("stats.lighthouse_metrics", false) {
-		h.metrics = newLighthouseMetrics()
-		h.metricHolepunchTx = metrics.GetOrRegisterCounter("messages.tx.holepunch", nil)
+		registry := util.MetricsRegistry(c)
+		h.metrics = newLighthouseMetrics(registry)
+		h.metricHolepunchTx = metrics.GetOrRegisterCounter("messages.tx.holepunch", registry)
 	} else {
 		h.metricHolepunchTx = metrics.NilCounter{}
 	}
@@ -142,6 +184,22 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 	return &h, nil
 }
 
+// validateServeOnly returns an error if lighthouse.serve_only is combined with anything that needs the data plane. The
+// tun device config is checked when the device would have been created.
+func validateServeOnly(c *config.C) error {
+	if !c.GetBool("lighthouse.am_lighthouse", false) {
+		return fmt.Errorf("lighthouse.serve_only requires lighthouse.am_lighthouse")
+	}
+
+	for _, k := range []string{"firewall.inbound", "firewall.outbound"} {
+		if rules, ok := c.Get(k).([]interface{}); ok && len(rules) > 0 {
+			return fmt.Errorf("%s can not have rules when lighthouse.serve_only is true", k)
+		}
+	}
+
+	return nil
+}
+
 func (lh *LightHouse) GetStaticHostList() map[iputil.VpnIp]struct{} {
 	return *lh.staticList.Load()
 }
@@ -162,6 +220,11 @@ func (lh *LightHouse) GetAdvertiseAddrs() []netIpAndPort {
 	return *lh.advertiseAddrs.Load()
 }
 
+// SetNebulaPort changes the port advertised to lighthouses, used when listen.port changes at runtime
+func (lh *LightHouse) SetNebulaPort(port uint32) {
+	lh.nebulaPort.Store(port)
+}
+
 func (lh *LightHouse) GetRelaysForMe() []iputil.VpnIp {
 	return *lh.relaysForMe.Load()
 }
@@ -185,9 +248,7 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 				return util.NewContextualError("Unable to parse lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
 			}
 
-			if fPort == 0 {
-				fPort = uint16(lh.nebulaPort)
-			}
+			// A port of 0 is resolved to the current listen port when advertised, see SendUpdate
 
 			if ip4 := fIp.To4(); ip4 != nil && lh.myVpnNet.Contains(fIp) {
 				lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
@@ -205,6 +266,32 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.advertise_scopes") {
+		scopes, err := parseAdvertiseScopes(c)
+		if err != nil {
+			return util.NewContextualError("Unable to parse lighthouse.advertise_scopes", nil, err)
+		}
+
+		lh.advertiseScopes.Store(&scopes)
+
+		if !initial {
+			lh.l.Info("lighthouse.advertise_scopes has changed")
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.advertise_order") {
+		order, err := parseAdvertiseOrder(c)
+		if err != nil {
+			return util.NewContextualError("Unable to parse lighthouse.advertise_order", nil, err)
+		}
+
+		lh.advertiseOrder.Store(&order)
+
+		if !initial {
+			lh.l.Info("lighthouse.advertise_order has changed")
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.interval") {
 		lh.interval.Store(int64(c.GetInt("lighthouse.interval", 10)))
 
@@ -262,28 +349,30 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 	//NOTE: many things will get much simpler when we combine static_host_map and lighthouse.hosts in config
 	if initial || c.HasChanged("static_host_map") || c.HasChanged("static_map.cadence") || c.HasChanged("static_map.network") || c.HasChanged("static_map.lookup_timeout") {
 		// Clean up. Entries still in the static_host_map will be re-built.
-		// Entries no longer present must have their (possible) background DNS goroutines stopped.
+		// Entries no longer present must have their (possible) background DNS goroutines stopped and their addresses
+		// forgotten, tunnels to them are left alone.
 		if existingStaticList := lh.staticList.Load(); existingStaticList != nil {
-			lh.RLock()
 			for staticVpnIp := range *existingStaticList {
-				if am, ok := lh.addrMap[staticVpnIp]; ok && am != nil {
-					am.hr.Cancel()
-				}
+				lh.clearStaticRemotes(staticVpnIp)
 			}
-			lh.RUnlock()
 		}
 		// Build a new list based on current config.
 		staticList := make(map[iputil.VpnIp]struct{})
-		err := lh.loadStaticMap(c, lh.myVpnNet, staticList)
+		staticHostMap := make(map[iputil.VpnIp][]string)
+		staticFingerprints := make(map[iputil.VpnIp]string)
+		err := lh.loadStaticMap(c, lh.myVpnNet, staticList, staticHostMap, staticFingerprints)
 		if err != nil {
 			return err
 		}
 
 		lh.staticList.Store(&staticList)
+		lh.staticFingerprints.Store(&staticFingerprints)
+		oldStaticHostMap := lh.staticHostMap
+		lh.staticHostMap = staticHostMap
 		if !initial {
-			//TODO: we should remove any remote list entries for static hosts that were removed/modified?
 			if c.HasChanged("static_host_map") {
 				lh.l.Info("static_host_map has changed")
+				lh.logStaticHostMapChanges(oldStaticHostMap, staticHostMap)
 			}
 			if c.HasChanged("static_map.cadence") {
 				lh.l.Info("static_map.cadence has changed")
@@ -311,6 +400,39 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("handshakes.lazy") {
+		lh.lazyHandshakes.Store(c.GetBool("handshakes.lazy", false))
+		if !initial {
+			lh.l.Infof("handshakes.lazy changed to %v", lh.lazyHandshakes.Load())
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.max_addresses_returned") {
+		maxAddrs := c.GetInt("lighthouse.max_addresses_returned", 0)
+		if maxAddrs < 0 {
+			return util.NewContextualError("lighthouse.max_addresses_returned can not be negative", m{"max_addresses_returned": maxAddrs}, nil)
+		}
+
+		lh.maxAddressesReturned.Store(int64(maxAddrs))
+		if !initial {
+			lh.l.Infof("lighthouse.max_addresses_returned changed to %v", maxAddrs)
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.query") {
+		qc, err := parseLighthouseQueryConfig(c)
+		if err != nil {
+			return util.NewContextualError("Invalid lighthouse.query", nil, err)
+		}
+
+		if initial {
+			lh.queries = newLighthouseQueries(lh.l, util.MetricsRegistry(c), qc, lh.sendQuery)
+		} else {
+			lh.queries.reload(qc)
+			lh.l.Info("lighthouse.query has changed")
+		}
+	}
+
 	if initial || c.HasChanged("relay.relays") {
 		switch c.GetBool("relay.am_relay", false) {
 		case true:
@@ -394,7 +516,9 @@ func getStaticMapNetwork(c *config.C) (string, error) {
 	return network, nil
 }
 
-func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList map[iputil.VpnIp]struct{}) error {
+// loadStaticMap adds the static_host_map entries to the remote lists and marks them as static in staticList, the
+// addresses of each entry are recorded in staticHostMap and pinned fingerprints in staticFingerprints
+func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList map[iputil.VpnIp]struct{}, staticHostMap map[iputil.VpnIp][]string, staticFingerprints map[iputil.VpnIp]string) error {
 	d, err := getStaticMapCadence(c)
 	if err != nil {
 		return err
@@ -424,6 +548,21 @@ func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList
 		}
 
 		vpnIp := iputil.Ip2VpnIp(rip)
+		if entry, ok := v.(map[interface{}]interface{}); ok {
+			// The long form of an entry, its addresses and optionally the fingerprint to pin
+			if v, ok = entry["addrs"]; !ok {
+				return util.NewContextualError("static_host_map entry is missing addrs", m{"vpnIp": rip, "entry": i + 1}, nil)
+			}
+
+			if rFingerprint, ok := entry["fingerprint"]; ok {
+				fingerprint, err := parseStaticFingerprint(rFingerprint)
+				if err != nil {
+					return util.NewContextualError("Invalid static_host_map fingerprint", m{"vpnIp": rip, "entry": i + 1}, err)
+				}
+				staticFingerprints[vpnIp] = fingerprint
+			}
+		}
+
 		vals, ok := v.([]interface{})
 		if !ok {
 			vals = []interface{}{v}
@@ -437,12 +576,93 @@ func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList
 		if err != nil {
 			return err
 		}
+		staticHostMap[vpnIp] = remoteAddrs
 		i++
 	}
 
 	return nil
 }
 
+// parseStaticFingerprint returns the hex sha256 certificate fingerprint of a static_host_map entry in lower case
+func parseStaticFingerprint(v interface{}) (string, error) {
+	fingerprint := strings.ToLower(fmt.Sprintf("%v", v))
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("fingerprint must be the hex sha256 of a certificate: %v", v)
+	}
+
+	return fingerprint, nil
+}
+
+// pinnedFingerprint returns the certificate fingerprint pinned for vpnIp in static_host_map, if there is one
+func (lh *LightHouse) pinnedFingerprint(vpnIp iputil.VpnIp) (string, bool) {
+	fingerprints := lh.staticFingerprints.Load()
+	if fingerprints == nil {
+		return "", false
+	}
+
+	fingerprint, ok := (*fingerprints)[vpnIp]
+	return fingerprint, ok
+}
+
+// clearStaticRemotes stops the DNS lookups for a static host and removes the addresses we added for it from its remote
+// list. The tunnel to it, if any, keeps using its current remote.
+func (lh *LightHouse) clearStaticRemotes(vpnIp iputil.VpnIp) {
+	lh.RLock()
+	am := lh.addrMap[vpnIp]
+	lh.RUnlock()
+	if am == nil {
+		return
+	}
+
+	am.Lock()
+	am.unlockedSetHostnamesResults(nil)
+	am.unlockedSetV4(lh.myVpnIp.Load(), vpnIp, nil, lh.unlockedShouldAddV4)
+	am.unlockedSetV6(lh.myVpnIp.Load(), vpnIp, nil, lh.unlockedShouldAddV6)
+	am.Unlock()
+}
+
+// logStaticHostMapChanges logs every static_host_map entry that was added, removed or whose addresses changed. Removed
+// entries are no longer static but existing tunnels stay up until they go idle or fail. Changed entries only have their
+// new addresses in the remote list, a tunnel keeps its current remote until it roams or fails its tunnel test and the
+// new addresses are used for the next handshake.
+func (lh *LightHouse) logStaticHostMapChanges(old, new map[iputil.VpnIp][]string) {
+	for vpnIp, addrs := range new {
+		oldAddrs, ok := old[vpnIp]
+		switch {
+		case !ok:
+			lh.l.WithField("vpnIp", vpnIp).WithField("addrs", addrs).Info("static_host_map entry added")
+		case !stringSetsEqual(oldAddrs, addrs):
+			lh.l.WithField("vpnIp", vpnIp).WithField("addrs", addrs).WithField("oldAddrs", oldAddrs).
+				Info("static_host_map entry changed")
+		}
+	}
+
+	for vpnIp, addrs := range old {
+		if _, ok := new[vpnIp]; !ok {
+			lh.l.WithField("vpnIp", vpnIp).WithField("oldAddrs", addrs).Info("static_host_map entry removed")
+		}
+	}
+}
+
+func stringSetsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	set := make(map[string]int, len(a))
+	for _, v := range a {
+		set[v]++
+	}
+
+	for _, v := range b {
+		if set[v] == 0 {
+			return false
+		}
+		set[v]--
+	}
+	return true
+}
+
 func (lh *LightHouse) Query(ip iputil.VpnIp, f EncWriter) *RemoteList {
 	if !lh.IsLighthouseIP(ip) {
 		lh.QueryServer(ip, f)
@@ -467,19 +687,25 @@ func (lh *LightHouse) QueryServer(ip iputil.VpnIp, f EncWriter) {
 	}
 
 	// Send a query to the lighthouses and hope for the best next time
+	lighthouses := lh.queries.targets(lh.GetLighthouses())
+	for _, n := range lighthouses {
+		lh.sendQuery(f, n, ip)
+	}
+	lh.queries.sent(ip, lighthouses, f)
+}
+
+// sendQuery asks lighthouse for the addresses of ip
+func (lh *LightHouse) sendQuery(f EncWriter, lighthouse iputil.VpnIp, ip iputil.VpnIp) {
 	query, err := NewLhQueryByInt(ip).Marshal()
 	if err != nil {
 		lh.l.WithError(err).WithField("vpnIp", ip).Error("Failed to marshal lighthouse query payload")
 		return
 	}
 
-	lighthouses := lh.GetLighthouses()
-	lh.metricTx(NebulaMeta_HostQuery, int64(len(lighthouses)))
+	lh.metricTx(NebulaMeta_HostQuery, 1)
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
-	for n := range lighthouses {
-		f.SendMessageToVpnIp(header.LightHouse, 0, n, query, nb, out)
-	}
+	f.SendMessageToVpnIp(header.LightHouse, 0, lighthouse, query, nb, out)
 }
 
 func (lh *LightHouse) QueryCache(ip iputil.VpnIp) *RemoteList {
@@ -571,13 +797,13 @@ func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, t
 			if !lh.unlockedShouldAddV4(vpnIp, to) {
 				continue
 			}
-			am.unlockedPrependV4(lh.myVpnIp, to)
+			am.unlockedPrependV4(lh.myVpnIp.Load(), to)
 		case addrPort.Addr().Is6():
 			to := NewIp6AndPortFromNetIP(addrPort.Addr(), addrPort.Port())
 			if !lh.unlockedShouldAddV6(vpnIp, to) {
 				continue
 			}
-			am.unlockedPrependV6(lh.myVpnIp, to)
+			am.unlockedPrependV6(lh.myVpnIp.Load(), to)
 		}
 	}
 
@@ -613,7 +839,7 @@ func (lh *LightHouse) addCalculatedRemotes(vpnIp iputil.VpnIp) bool {
 	defer am.Unlock()
 	lh.Unlock()
 
-	am.unlockedSetV4(lh.myVpnIp, vpnIp, calculated, lh.unlockedShouldAddV4)
+	am.unlockedSetV4(lh.myVpnIp.Load(), vpnIp, calculated, lh.unlockedShouldAddV4)
 
 	return len(calculated) > 0
 }
@@ -637,7 +863,7 @@ func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
 		if lh.l.Level >= logrus.TraceLevel {
 			lh.l.WithField("remoteIp", vpnIp).WithField("allow", allow).Trace("remoteAllowList.Allow")
 		}
-		if !allow || ipMaskContains(lh.myVpnIp, lh.myVpnZeros, ip) {
+		if !allow || ipMaskContains(lh.myVpnIp.Load(), lh.myVpnZeros, ip) {
 			return false
 		}
 	case to.Is6():
@@ -665,7 +891,7 @@ func (lh *LightHouse) unlockedShouldAddV4(vpnIp iputil.VpnIp, to *Ip4AndPort) bo
 		lh.l.WithField("remoteIp", vpnIp).WithField("allow", allow).Trace("remoteAllowList.Allow")
 	}
 
-	if !allow || ipMaskContains(lh.myVpnIp, lh.myVpnZeros, iputil.VpnIp(to.Ip)) {
+	if !allow || ipMaskContains(lh.myVpnIp.Load(), lh.myVpnZeros, iputil.VpnIp(to.Ip)) {
 		return false
 	}
 
@@ -778,30 +1004,37 @@ func (lh *LightHouse) StartUpdateWorker() {
 	}()
 }
 
-func (lh *LightHouse) SendUpdate() {
-	var v4 []*Ip4AndPort
-	var v6 []*Ip6AndPort
+// SendUpdate discovers our local addresses and sends them, along with the advertise_addrs, to every lighthouse.
+// Returns the addresses that were sent.
+func (lh *LightHouse) SendUpdate() []*udp.Addr {
+	addrs := newScopedAddrs(*lh.advertiseScopes.Load())
+	var sent []*udp.Addr
 
+	nebulaPort := lh.nebulaPort.Load()
+	var advertise []netIpAndPort
 	for _, e := range lh.GetAdvertiseAddrs() {
-		if ip := e.ip.To4(); ip != nil {
-			v4 = append(v4, NewIp4AndPort(e.ip, uint32(e.port)))
-		} else {
-			v6 = append(v6, NewIp6AndPort(e.ip, uint32(e.port)))
+		if e.port == 0 {
+			e.port = uint16(nebulaPort)
 		}
+
+		advertise = append(advertise, e)
 	}
 
 	lal := lh.GetLocalAllowList()
 	for _, e := range *localIps(lh.l, lal) {
-		if ip4 := e.To4(); ip4 != nil && ipMaskContains(lh.myVpnIp, lh.myVpnZeros, iputil.Ip2VpnIp(ip4)) {
+		if ip4 := e.To4(); ip4 != nil && ipMaskContains(lh.myVpnIp.Load(), lh.myVpnZeros, iputil.Ip2VpnIp(ip4)) {
 			continue
 		}
 
 		// Only add IPs that aren't my VPN/tun IP
-		if ip := e.To4(); ip != nil {
-			v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort))
-		} else {
-			v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort))
-		}
+		advertise = append(advertise, netIpAndPort{ip: e, port: uint16(nebulaPort)})
+	}
+
+	order := *lh.advertiseOrder.Load()
+	orderAdvertiseAddrs(advertise, order)
+	for _, e := range advertise {
+		addrs.add(e.ip, uint32(e.port), advertisePriority(e.ip, order))
+		sent = append(sent, udp.NewAddr(e.ip, e.port))
 	}
 
 	var relays []uint32
@@ -812,10 +1045,11 @@ func (lh *LightHouse) SendUpdate() {
 	m := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       uint32(lh.myVpnIp),
-			Ip4AndPorts: v4,
-			Ip6AndPorts: v6,
+			VpnIp:       uint32(lh.myVpnIp.Load()),
+			Ip4AndPorts: addrs.v4,
+			Ip6AndPorts: addrs.v6,
 			RelayVpnIp:  relays,
+			ScopedAddrs: addrs.list(),
 		},
 	}
 
@@ -827,12 +1061,14 @@ func (lh *LightHouse) SendUpdate() {
 	mm, err := m.Marshal()
 	if err != nil {
 		lh.l.WithError(err).Error("Error while marshaling for lighthouse update")
-		return
+		return nil
 	}
 
 	for vpnIp := range lighthouses {
 		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
 	}
+
+	return sent
 }
 
 type LightHouseHandler struct {
@@ -874,10 +1110,13 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details := lhh.meta.Details
 	lhh.meta.Reset()
 
-	// Keep the array memory around
-	details.Ip4AndPorts = details.Ip4AndPorts[:0]
-	details.Ip6AndPorts = details.Ip6AndPorts[:0]
-	details.RelayVpnIp = details.RelayVpnIp[:0]
+	// Keep the array memory around, everything else must be cleared since unmarshal leaves fields that are not in the
+	// packet alone
+	*details = NebulaMetaDetails{
+		Ip4AndPorts: details.Ip4AndPorts[:0],
+		Ip6AndPorts: details.Ip6AndPorts[:0],
+		RelayVpnIp:  details.RelayVpnIp[:0],
+	}
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -924,6 +1163,15 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr *udp.Addr, vpnIp iputil.VpnIp,
 
 	case NebulaMeta_HostUpdateNotificationAck:
 		// noop
+
+	case NebulaMeta_HostMaintenanceNotification:
+		lhh.handleHostMaintenanceNotification(n, vpnIp)
+
+	case NebulaMeta_PeerPolicyRequest:
+		lhh.handlePeerPolicyRequest(n, vpnIp, w)
+
+	case NebulaMeta_PeerPolicyReply:
+		lhh.handlePeerPolicyReply(n, vpnIp, w)
 	}
 }
 
@@ -938,13 +1186,24 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 
 	//TODO: we can DRY this further
 	reqVpnIp := n.Details.VpnIp
+	if lhh.lh.peerMaintenance.has(iputil.VpnIp(reqVpnIp)) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).WithField("query", iputil.VpnIp(reqVpnIp)).
+				Debugln("Not answering query for a host that is down for maintenance")
+		}
+		return
+	}
+
+	// Looked up before taking the lighthouse lock, scoped addresses are only handed to peers in the right groups
+	groups := lhh.lh.peerGroups(vpnIp)
+
 	//TODO: Maybe instead of marshalling into n we marshal into a new `r` to not nuke our current request data
 	found, ln, err := lhh.lh.queryAndPrepMessage(iputil.VpnIp(n.Details.VpnIp), func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostQueryReply
 		n.Details.VpnIp = reqVpnIp
 
-		lhh.coalesceAnswers(c, n)
+		lhh.coalesceAnswers(c, n, groups)
 
 		return n.MarshalTo(lhh.pb)
 	})
@@ -962,12 +1221,13 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
 
 	// This signals the other side to punch some zero byte udp packets
+	groups = lhh.lh.peerGroups(iputil.VpnIp(reqVpnIp))
 	found, ln, err = lhh.lh.queryAndPrepMessage(vpnIp, func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostPunchNotification
 		n.Details.VpnIp = uint32(vpnIp)
 
-		lhh.coalesceAnswers(c, n)
+		lhh.coalesceAnswers(c, n, groups)
 
 		return n.MarshalTo(lhh.pb)
 	})
@@ -985,35 +1245,89 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp iputil.VpnIp,
 	w.SendMessageToVpnIp(header.LightHouse, 0, iputil.VpnIp(reqVpnIp), lhh.pb[:ln], lhh.nb, lhh.out[:0])
 }
 
-func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
-	if c.v4 != nil {
-		if c.v4.learned != nil {
-			n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, c.v4.learned)
-		}
-		if c.v4.reported != nil && len(c.v4.reported) > 0 {
-			n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, c.v4.reported...)
+// coalesceAnswers adds the addresses in c to n for a peer with groups, the scoped addresses the peer may have go after
+// the learned address and ahead of the reported ones
+func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta, groups []string) {
+	maxAddrs := int(lhh.lh.maxAddressesReturned.Load())
+	scoped4, scoped6 := c.scopedFor(groups)
+
+	if c.v4 != nil || len(scoped4) > 0 {
+		learned, reported := (*Ip4AndPort)(nil), scoped4
+		if c.v4 != nil {
+			learned, reported = c.v4.learned, c.v4.reported
+			if len(scoped4) > 0 {
+				reported = append(scoped4, c.v4.reported...)
+			}
 		}
+		n.Details.Ip4AndPorts = rankAnswers(n.Details.Ip4AndPorts, learned, reported, maxAddrs)
 	}
 
-	if c.v6 != nil {
-		if c.v6.learned != nil {
-			n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, c.v6.learned)
-		}
-		if c.v6.reported != nil && len(c.v6.reported) > 0 {
-			n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, c.v6.reported...)
+	if c.v6 != nil || len(scoped6) > 0 {
+		learned, reported := (*Ip6AndPort)(nil), scoped6
+		if c.v6 != nil {
+			learned, reported = c.v6.learned, c.v6.reported
+			if len(scoped6) > 0 {
+				reported = append(scoped6, c.v6.reported...)
+			}
 		}
+		n.Details.Ip6AndPorts = rankAnswers(n.Details.Ip6AndPorts, learned, reported, maxAddrs)
 	}
 
 	if c.relay != nil {
-		n.Details.RelayVpnIp = append(n.Details.RelayVpnIp, c.relay.relay...)
+		for _, r := range c.relay.relay {
+			// Relays that are down for maintenance are left out so peers pick another
+			if !lhh.lh.peerMaintenance.has(iputil.VpnIp(r)) {
+				n.Details.RelayVpnIp = append(n.Details.RelayVpnIp, r)
+			}
+		}
 	}
 }
 
+// lhAnswer is an Ip4AndPort or Ip6AndPort, addr strips everything but the address so copies with a different priority
+// compare equal
+type lhAnswer[T comparable] interface {
+	*T
+	addr() T
+}
+
+func (m *Ip4AndPort) addr() Ip4AndPort { return Ip4AndPort{Ip: m.Ip, Port: m.Port} }
+func (m *Ip6AndPort) addr() Ip6AndPort { return Ip6AndPort{Hi: m.Hi, Lo: m.Lo, Port: m.Port} }
+
+// rankAnswers appends the addresses of one family to answers. The learned address is confirmed by the host's traffic
+// to us so it goes first, the reported addresses follow in the order they were first reported. A learned address the
+// host also reported is answered with the priority the host gave it. No more than maxAddrs are appended, 0 is no limit.
+func rankAnswers[T comparable, P lhAnswer[T]](answers []P, learned P, reported []P, maxAddrs int) []P {
+	added := 0
+	learnedAt := len(answers)
+	if learned != nil {
+		answers = append(answers, learned)
+		added++
+	}
+
+	for _, v := range reported {
+		if maxAddrs > 0 && added >= maxAddrs {
+			break
+		}
+
+		if learned != nil && v.addr() == learned.addr() {
+			answers[learnedAt] = v
+			continue
+		}
+
+		answers = append(answers, v)
+		added++
+	}
+
+	return answers
+}
+
 func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp iputil.VpnIp) {
 	if !lhh.lh.IsLighthouseIP(vpnIp) {
 		return
 	}
 
+	lhh.lh.queries.answered(vpnIp, iputil.VpnIp(n.Details.VpnIp))
+
 	lhh.lh.Lock()
 	am := lhh.lh.unlockedGetRemoteList(iputil.VpnIp(n.Details.VpnIp))
 	am.Lock()
@@ -1057,6 +1371,7 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.RelayVpnIp)
+	am.unlockedSetScoped(vpnIp, certVpnIp, n.Details.ScopedAddrs, lhh.lh.unlockedShouldAddV4, lhh.lh.unlockedShouldAddV6)
 	am.Unlock()
 
 	n = lhh.resetMeta()
@@ -1109,6 +1424,14 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp i
 	// a tunnel.
 	if lhh.lh.punchy.GetRespond() {
 		queryVpnIp := iputil.VpnIp(n.Details.VpnIp)
+		if lhh.lh.lazyHandshakes.Load() && !lhh.lh.IsLighthouseIP(queryVpnIp) {
+			// Lazy handshakes only start tunnels for our own traffic, the host will still be able to handshake with us
+			if lhh.l.Level >= logrus.DebugLevel {
+				lhh.l.Debugf("Not sending a nebula test packet to vpn ip %s, handshakes.lazy is enabled", queryVpnIp)
+			}
+			return
+		}
+
 		go func() {
 			time.Sleep(lhh.lh.punchy.GetRespondDelay())
 			if lhh.l.Level >= logrus.DebugLevel {
@@ -0,0 +1,302 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// The values of the lighthouse.breaker.<lighthouse>.state gauges
+const (
+	breakerClosed int64 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// lighthouseQueryConfig is lighthouse.query
+type lighthouseQueryConfig struct {
+	timeout   time.Duration
+	retries   int
+	threshold int
+	cooldown  time.Duration
+}
+
+func parseLighthouseQueryConfig(c *config.C) (lighthouseQueryConfig, error) {
+	qc := lighthouseQueryConfig{
+		timeout:   c.GetDuration("lighthouse.query.timeout", 5*time.Second),
+		retries:   c.GetInt("lighthouse.query.retries", 0),
+		threshold: c.GetInt("lighthouse.query.breaker_threshold", 0),
+		cooldown:  c.GetDuration("lighthouse.query.breaker_cooldown", time.Minute),
+	}
+
+	if qc.timeout <= 0 {
+		return qc, fmt.Errorf("lighthouse.query.timeout must be positive: %v", qc.timeout)
+	}
+	if qc.retries < 0 {
+		return qc, fmt.Errorf("lighthouse.query.retries must not be negative: %v", qc.retries)
+	}
+	if qc.threshold < 0 {
+		return qc, fmt.Errorf("lighthouse.query.breaker_threshold must not be negative: %v", qc.threshold)
+	}
+	if qc.cooldown <= 0 {
+		return qc, fmt.Errorf("lighthouse.query.breaker_cooldown must be positive: %v", qc.cooldown)
+	}
+
+	return qc, nil
+}
+
+// lighthouseQueries retries host queries that a lighthouse did not answer in time and keeps a circuit breaker for
+// each lighthouse. A lighthouse stays silent when it does not know the host, so a query only counts as timed out for a
+// lighthouse when another one answered it. After breaker_threshold consecutive timeouts the breaker opens and the
+// lighthouse is not queried for breaker_cooldown, then the next query probes it. An answer closes the breaker, a
+// timed out probe opens it again. If every breaker is open all lighthouses are queried anyway.
+type lighthouseQueries struct {
+	sync.Mutex
+	config   lighthouseQueryConfig
+	breakers map[iputil.VpnIp]*lighthouseBreaker
+	pending  map[iputil.VpnIp]*pendingLighthouseQuery
+	registry metrics.Registry
+	l        *logrus.Logger
+
+	now       func() time.Time
+	afterFunc func(time.Duration, func())
+	send      func(f EncWriter, lighthouse iputil.VpnIp, vpnIp iputil.VpnIp)
+
+	metricRetries  metrics.Counter
+	metricTimeouts metrics.Counter
+	metricOpened   metrics.Counter
+}
+
+type lighthouseBreaker struct {
+	state int64
+	// timeouts is the number of queries in a row the lighthouse did not answer
+	timeouts int
+	openedAt time.Time
+	// probing is true while the query probing a half open breaker is outstanding
+	probing     bool
+	metricState metrics.Gauge
+}
+
+// pendingLighthouseQuery is a host query waiting for lighthouse.query.timeout
+type pendingLighthouseQuery struct {
+	f EncWriter
+	// attempts is how many times the query was sent to each lighthouse
+	attempts map[iputil.VpnIp]int
+	answered map[iputil.VpnIp]struct{}
+}
+
+func newLighthouseQueries(l *logrus.Logger, registry metrics.Registry, qc lighthouseQueryConfig, send func(EncWriter, iputil.VpnIp, iputil.VpnIp)) *lighthouseQueries {
+	return &lighthouseQueries{
+		config:   qc,
+		breakers: map[iputil.VpnIp]*lighthouseBreaker{},
+		pending:  map[iputil.VpnIp]*pendingLighthouseQuery{},
+		registry: registry,
+		l:        l,
+		now:      time.Now,
+		afterFunc: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+		send:           send,
+		metricRetries:  metrics.GetOrRegisterCounter("lighthouse.query.retries", registry),
+		metricTimeouts: metrics.GetOrRegisterCounter("lighthouse.query.timeouts", registry),
+		metricOpened:   metrics.GetOrRegisterCounter("lighthouse.breaker.opened", registry),
+	}
+}
+
+func (q *lighthouseQueries) reload(qc lighthouseQueryConfig) {
+	q.Lock()
+	defer q.Unlock()
+	q.config = qc
+	if qc.threshold == 0 {
+		// Without a breaker every lighthouse is queried again
+		for _, b := range q.breakers {
+			q.unlockedSetState(b, breakerClosed)
+			b.timeouts = 0
+			b.probing = false
+		}
+	}
+}
+
+// enabled is false when nothing has to be tracked, queries are not retried and there is no breaker
+func (q *lighthouseQueries) unlockedEnabled() bool {
+	return q.config.retries > 0 || q.config.threshold > 0
+}
+
+// targets returns the lighthouses a new query should be sent to
+func (q *lighthouseQueries) targets(lighthouses map[iputil.VpnIp]struct{}) []iputil.VpnIp {
+	all := make([]iputil.VpnIp, 0, len(lighthouses))
+	for lighthouse := range lighthouses {
+		all = append(all, lighthouse)
+	}
+
+	if q == nil {
+		return all
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if q.config.threshold == 0 {
+		return all
+	}
+
+	targets := make([]iputil.VpnIp, 0, len(all))
+	now := q.now()
+	for _, lighthouse := range all {
+		b := q.unlockedBreaker(lighthouse)
+		if b.state == breakerOpen && now.Sub(b.openedAt) >= q.config.cooldown {
+			q.unlockedSetState(b, breakerHalfOpen)
+			b.probing = false
+			q.l.WithField("lighthouse", lighthouse).Info("Probing a lighthouse that stopped answering queries")
+		}
+
+		switch b.state {
+		case breakerClosed:
+			targets = append(targets, lighthouse)
+		case breakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				targets = append(targets, lighthouse)
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return all
+	}
+	return targets
+}
+
+// sent tracks a query for vpnIp sent to targets, its answers are expected within lighthouse.query.timeout
+func (q *lighthouseQueries) sent(vpnIp iputil.VpnIp, targets []iputil.VpnIp, f EncWriter) {
+	if q == nil {
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if !q.unlockedEnabled() {
+		return
+	}
+
+	p, ok := q.pending[vpnIp]
+	if !ok {
+		p = &pendingLighthouseQuery{f: f, attempts: map[iputil.VpnIp]int{}, answered: map[iputil.VpnIp]struct{}{}}
+		q.pending[vpnIp] = p
+		q.afterFunc(q.config.timeout, func() { q.expire(vpnIp) })
+	}
+
+	// Queries repeated while one is pending ride along with it
+	for _, lighthouse := range targets {
+		if p.attempts[lighthouse] == 0 {
+			p.attempts[lighthouse] = 1
+		}
+	}
+}
+
+// answered records that lighthouse answered a query for vpnIp, which closes its breaker
+func (q *lighthouseQueries) answered(lighthouse iputil.VpnIp, vpnIp iputil.VpnIp) {
+	if q == nil {
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if p, ok := q.pending[vpnIp]; ok {
+		p.answered[lighthouse] = struct{}{}
+	}
+
+	b, ok := q.breakers[lighthouse]
+	if !ok {
+		return
+	}
+
+	b.timeouts = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		q.unlockedSetState(b, breakerClosed)
+		q.l.WithField("lighthouse", lighthouse).Info("Lighthouse is answering queries again")
+	}
+}
+
+// expire resends the query for vpnIp to the lighthouses that did not answer it and have retries left, once none do the
+// lighthouses that still did not answer have timed out
+func (q *lighthouseQueries) expire(vpnIp iputil.VpnIp) {
+	q.Lock()
+	p, ok := q.pending[vpnIp]
+	if !ok {
+		q.Unlock()
+		return
+	}
+
+	var retry []iputil.VpnIp
+	for lighthouse, attempts := range p.attempts {
+		if _, ok := p.answered[lighthouse]; !ok && attempts <= q.config.retries {
+			p.attempts[lighthouse]++
+			retry = append(retry, lighthouse)
+		}
+	}
+
+	if len(retry) > 0 {
+		q.afterFunc(q.config.timeout, func() { q.expire(vpnIp) })
+		q.metricRetries.Inc(int64(len(retry)))
+		q.Unlock()
+
+		for _, lighthouse := range retry {
+			q.send(p.f, lighthouse, vpnIp)
+		}
+		return
+	}
+
+	delete(q.pending, vpnIp)
+	defer q.Unlock()
+
+	for lighthouse := range p.attempts {
+		if _, ok := p.answered[lighthouse]; ok {
+			continue
+		}
+
+		b := q.unlockedBreaker(lighthouse)
+		b.probing = false
+		if len(p.answered) == 0 {
+			// Nobody knew the host, this says nothing about the lighthouse
+			continue
+		}
+
+		q.metricTimeouts.Inc(1)
+		b.timeouts++
+		if q.config.threshold == 0 || b.state == breakerOpen {
+			continue
+		}
+
+		if b.state == breakerHalfOpen || b.timeouts >= q.config.threshold {
+			b.openedAt = q.now()
+			q.unlockedSetState(b, breakerOpen)
+			q.metricOpened.Inc(1)
+			q.l.WithField("lighthouse", lighthouse).WithField("timeouts", b.timeouts).
+				WithField("cooldown", q.config.cooldown).
+				Warn("Lighthouse is not answering queries, relying on the other lighthouses")
+		}
+	}
+}
+
+func (q *lighthouseQueries) unlockedBreaker(lighthouse iputil.VpnIp) *lighthouseBreaker {
+	b, ok := q.breakers[lighthouse]
+	if !ok {
+		name := "lighthouse.breaker." + strings.ReplaceAll(lighthouse.String(), ".", "_") + ".state"
+		b = &lighthouseBreaker{metricState: metrics.GetOrRegisterGauge(name, q.registry)}
+		b.metricState.Update(breakerClosed)
+		q.breakers[lighthouse] = b
+	}
+	return b
+}
+
+func (q *lighthouseQueries) unlockedSetState(b *lighthouseBreaker, state int64) {
+	b.state = state
+	b.metricState.Update(state)
+}
@@ -0,0 +1,141 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLighthouseQueries_breaker(t *testing.T) {
+	l := test.NewLogger()
+	slow := iputil.Ip2VpnIp(net.ParseIP("10.128.0.1"))
+	fast := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+	lighthouses := map[iputil.VpnIp]struct{}{slow: {}, fast: {}}
+
+	now := time.Now()
+	var timers []func()
+	var sent []iputil.VpnIp
+	registry := metrics.NewRegistry()
+	q := newLighthouseQueries(l, registry, lighthouseQueryConfig{
+		timeout:   time.Second,
+		retries:   1,
+		threshold: 2,
+		cooldown:  time.Minute,
+	}, func(_ EncWriter, lighthouse iputil.VpnIp, _ iputil.VpnIp) {
+		sent = append(sent, lighthouse)
+	})
+	q.now = func() time.Time { return now }
+	q.afterFunc = func(_ time.Duration, f func()) { timers = append(timers, f) }
+	fire := func() {
+		f := timers[0]
+		timers = timers[1:]
+		f()
+	}
+
+	state := func() int64 {
+		return registry.Get("lighthouse.breaker.10_128_0_1.state").(metrics.Gauge).Value()
+	}
+
+	// query sends a query for host, only fast answers, and runs it through its retry and timeout
+	query := func(host string) []iputil.VpnIp {
+		vpnIp := iputil.Ip2VpnIp(net.ParseIP(host))
+		targets := q.targets(lighthouses)
+		q.sent(vpnIp, targets, nil)
+		q.answered(fast, vpnIp)
+		sent = nil
+		for len(timers) > 0 {
+			fire()
+		}
+		return targets
+	}
+
+	// The slow lighthouse is retried and times out, one timeout is not enough to open the breaker
+	assert.ElementsMatch(t, []iputil.VpnIp{slow, fast}, query("10.128.1.1"))
+	assert.Equal(t, breakerClosed, state())
+
+	// A second timeout in a row opens it
+	assert.ElementsMatch(t, []iputil.VpnIp{slow, fast}, query("10.128.1.2"))
+	assert.Equal(t, breakerOpen, state())
+	assert.Equal(t, int64(1), registry.Get("lighthouse.breaker.opened").(metrics.Counter).Count())
+	assert.Equal(t, int64(2), registry.Get("lighthouse.query.retries").(metrics.Counter).Count())
+	assert.Equal(t, int64(2), registry.Get("lighthouse.query.timeouts").(metrics.Counter).Count())
+
+	// Only the fast lighthouse is queried during the cooldown
+	assert.Equal(t, []iputil.VpnIp{fast}, query("10.128.1.3"))
+	assert.Equal(t, breakerOpen, state())
+
+	// After the cooldown a single query probes the slow lighthouse, a timed out probe opens the breaker again
+	now = now.Add(time.Minute)
+	vpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.1.4"))
+	assert.ElementsMatch(t, []iputil.VpnIp{slow, fast}, q.targets(lighthouses))
+	assert.Equal(t, breakerHalfOpen, state())
+	assert.Equal(t, []iputil.VpnIp{fast}, q.targets(lighthouses), "only one probe at a time")
+	q.sent(vpnIp, []iputil.VpnIp{slow, fast}, nil)
+	q.answered(fast, vpnIp)
+	fire()
+	assert.Equal(t, []iputil.VpnIp{slow}, sent, "the probe should be retried")
+	fire()
+	assert.Equal(t, breakerOpen, state())
+
+	// An answer to the next probe closes it
+	now = now.Add(time.Minute)
+	vpnIp = iputil.Ip2VpnIp(net.ParseIP("10.128.1.5"))
+	assert.ElementsMatch(t, []iputil.VpnIp{slow, fast}, q.targets(lighthouses))
+	q.sent(vpnIp, []iputil.VpnIp{slow, fast}, nil)
+	q.answered(slow, vpnIp)
+	assert.Equal(t, breakerClosed, state())
+	assert.ElementsMatch(t, []iputil.VpnIp{slow, fast}, q.targets(lighthouses))
+}
+
+func TestLighthouseQueries_unknownHost(t *testing.T) {
+	l := test.NewLogger()
+	lighthouse := iputil.Ip2VpnIp(net.ParseIP("10.128.0.1"))
+	lighthouses := map[iputil.VpnIp]struct{}{lighthouse: {}}
+
+	var timers []func()
+	q := newLighthouseQueries(l, metrics.NewRegistry(), lighthouseQueryConfig{
+		timeout:   time.Second,
+		threshold: 1,
+		cooldown:  time.Minute,
+	}, func(EncWriter, iputil.VpnIp, iputil.VpnIp) {})
+	q.afterFunc = func(_ time.Duration, f func()) { timers = append(timers, f) }
+
+	// Lighthouses do not answer for hosts they do not know, when none answered the breaker stays closed
+	q.sent(iputil.Ip2VpnIp(net.ParseIP("10.128.1.1")), q.targets(lighthouses), nil)
+	require.Len(t, timers, 1)
+	timers[0]()
+	assert.Equal(t, breakerClosed, q.breakers[lighthouse].state)
+	assert.Equal(t, []iputil.VpnIp{lighthouse}, q.targets(lighthouses))
+
+	// Every lighthouse is queried when all of their breakers are open
+	q.breakers[lighthouse].state = breakerOpen
+	q.breakers[lighthouse].openedAt = time.Now()
+	assert.Equal(t, []iputil.VpnIp{lighthouse}, q.targets(lighthouses))
+}
+
+func Test_parseLighthouseQueryConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	qc, err := parseLighthouseQueryConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, lighthouseQueryConfig{timeout: 5 * time.Second, cooldown: time.Minute}, qc)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"query": map[interface{}]interface{}{
+		"timeout": "2s", "retries": 2, "breaker_threshold": 3, "breaker_cooldown": "30s",
+	}}
+	qc, err = parseLighthouseQueryConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, lighthouseQueryConfig{timeout: 2 * time.Second, retries: 2, threshold: 3, cooldown: 30 * time.Second}, qc)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"query": map[interface{}]interface{}{"retries": -1}}
+	_, err = parseLighthouseQueryConfig(c)
+	assert.EqualError(t, err, "lighthouse.query.retries must not be negative: -1")
+}
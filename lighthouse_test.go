@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
@@ -12,6 +14,7 @@ import (
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
 )
 
@@ -66,6 +69,46 @@ func Test_lhStaticMapping(t *testing.T) {
 	assert.EqualError(t, err, "lighthouse 10.128.0.3 does not have a static_host_map entry")
 }
 
+func Test_lhStaticFingerprint(t *testing.T) {
+	l := test.NewLogger()
+	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/16")
+	fingerprint := "4F2A9C5D8E1B7F3A6C0D9E2B5A8F1C4D7E0A3B6C9F2E5D8A1B4C7F0E3D6A9B2C"
+
+	c := config.NewC(l)
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.2": []interface{}{"1.1.1.1:4242"},
+		"10.128.0.3": map[interface{}]interface{}{"addrs": []interface{}{"1.1.1.2:4242"}, "fingerprint": fingerprint},
+		"10.128.0.4": map[interface{}]interface{}{"addrs": "1.1.1.3:4242"},
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	require.NoError(t, err)
+
+	// The long form adds its addresses like the short form does
+	assert.Equal(t, []string{"1.1.1.2:4242"}, lh.staticHostMap[iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))])
+	assert.Equal(t, []string{"1.1.1.3:4242"}, lh.staticHostMap[iputil.Ip2VpnIp(net.ParseIP("10.128.0.4"))])
+
+	pinned, ok := lh.pinnedFingerprint(iputil.Ip2VpnIp(net.ParseIP("10.128.0.3")))
+	assert.True(t, ok)
+	assert.Equal(t, strings.ToLower(fingerprint), pinned)
+
+	_, ok = lh.pinnedFingerprint(iputil.Ip2VpnIp(net.ParseIP("10.128.0.2")))
+	assert.False(t, ok)
+	_, ok = lh.pinnedFingerprint(iputil.Ip2VpnIp(net.ParseIP("10.128.0.4")))
+	assert.False(t, ok)
+
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.3": map[interface{}]interface{}{"addrs": []interface{}{"1.1.1.2:4242"}, "fingerprint": "nope"},
+	}
+	_, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.EqualError(t, err, "fingerprint must be the hex sha256 of a certificate: nope")
+
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.3": map[interface{}]interface{}{"fingerprint": fingerprint},
+	}
+	_, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.EqualError(t, err, "static_host_map entry is missing addrs")
+}
+
 func TestReloadLighthouseInterval(t *testing.T) {
 	l := test.NewLogger()
 	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/16")
@@ -95,6 +138,67 @@ func TestReloadLighthouseInterval(t *testing.T) {
 	assert.Equal(t, int64(11), lh.interval.Load())
 }
 
+func TestLighthouse_reloadStaticHostMap(t *testing.T) {
+	l := test.NewLogger()
+	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/16")
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+	changed := iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))
+	removed := iputil.Ip2VpnIp(net.ParseIP("10.128.0.4"))
+	added := iputil.Ip2VpnIp(net.ParseIP("10.128.0.5"))
+
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString(`
+lighthouse:
+  hosts: [10.128.0.2]
+static_host_map:
+  10.128.0.2: [1.1.1.2:4242]
+  10.128.0.3: [1.1.1.3:4242]
+  10.128.0.4: [1.1.1.4:4242]
+`))
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+
+	addrs := func(vpnIp iputil.VpnIp) []string {
+		lh.RLock()
+		am := lh.addrMap[vpnIp]
+		lh.RUnlock()
+		if am == nil {
+			return nil
+		}
+
+		var r []string
+		for _, a := range am.CopyAddrs(nil) {
+			r = append(r, a.String())
+		}
+		return r
+	}
+
+	assert.Equal(t, map[iputil.VpnIp]struct{}{lhIp: {}, changed: {}, removed: {}}, lh.GetStaticHostList())
+	assert.Equal(t, []string{"1.1.1.3:4242"}, addrs(changed))
+
+	assert.NoError(t, c.ReloadConfigString(`
+lighthouse:
+  hosts: [10.128.0.2]
+static_host_map:
+  10.128.0.2: [1.1.1.2:4242]
+  10.128.0.3: [2.2.2.3:4242]
+  10.128.0.5: [1.1.1.5:4242]
+`))
+
+	assert.Equal(t, map[iputil.VpnIp]struct{}{lhIp: {}, changed: {}, added: {}}, lh.GetStaticHostList())
+
+	// Unchanged entries keep their address
+	assert.Equal(t, []string{"1.1.1.2:4242"}, addrs(lhIp))
+
+	// Changed entries only have the new address
+	assert.Equal(t, []string{"2.2.2.3:4242"}, addrs(changed))
+
+	// Removed entries are forgotten, so the lighthouse will be asked
+	assert.Empty(t, addrs(removed))
+
+	assert.Equal(t, []string{"1.1.1.5:4242"}, addrs(added))
+}
+
 func BenchmarkLighthouseHandleRequest(b *testing.B) {
 	l := test.NewLogger()
 	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/0")
@@ -230,6 +334,7 @@ func TestLighthouse_Memory(t *testing.T) {
 
 	// Ensure proper ordering and limiting
 	// Send 12 addrs, get 10 back, the last 2 removed, allowing the duplicate to remain (clients dedupe)
+	// The addresses we already had keep their place at the front
 	newLHHostUpdate(
 		myUdpAddr0,
 		myVpnIp,
@@ -252,7 +357,7 @@ func TestLighthouse_Memory(t *testing.T) {
 	assertIp4InArray(
 		t,
 		r.msg.Details.Ip4AndPorts,
-		myUdpAddr1, myUdpAddr2, myUdpAddr3, myUdpAddr4, myUdpAddr5, myUdpAddr5, myUdpAddr6, myUdpAddr7, myUdpAddr8, myUdpAddr9,
+		myUdpAddr1, myUdpAddr4, myUdpAddr2, myUdpAddr3, myUdpAddr5, myUdpAddr5, myUdpAddr6, myUdpAddr7, myUdpAddr8, myUdpAddr9,
 	)
 
 	// Make sure we won't add ips in our vpn network
@@ -285,6 +390,118 @@ func TestLighthouse_reload(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLighthouse_maxAddressesReturned(t *testing.T) {
+	l := test.NewLogger()
+
+	learned := &udp.Addr{IP: net.ParseIP("24.15.0.2"), Port: 4242}
+	addr1 := &udp.Addr{IP: net.ParseIP("192.168.0.2"), Port: 4242}
+	addr2 := &udp.Addr{IP: net.ParseIP("172.16.0.2"), Port: 4242}
+	addr3 := &udp.Addr{IP: net.ParseIP("100.152.0.2"), Port: 4242}
+	myVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "max_addresses_returned": 2}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	// Only the first 2 reported addresses are returned
+	newLHHostUpdate(learned, myVpnIp, []*udp.Addr{addr1, addr2, addr3}, lhh)
+	r := newLHHostRequest(learned, myVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, addr1, addr2)
+
+	// A reordered report does not change our answer, new addresses go to the back
+	newLHHostUpdate(learned, myVpnIp, []*udp.Addr{addr3, addr2, addr1}, lhh)
+	r = newLHHostRequest(learned, myVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, addr1, addr2)
+
+	// The address we learned from the hosts traffic ranks first and is not repeated
+	lh.QueryCache(myVpnIp).LearnRemote(myVpnIp, learned)
+	newLHHostUpdate(learned, myVpnIp, []*udp.Addr{addr1, learned, addr2, addr3}, lhh)
+	r = newLHHostRequest(learned, myVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, learned, addr1)
+
+	// 0 is no limit
+	assert.NoError(t, c.ReloadConfigString("lighthouse:\n  am_lighthouse: true\n  max_addresses_returned: 0\nlisten:\n  port: 4242"))
+	assert.NoError(t, lh.reload(c, false))
+	r = newLHHostRequest(learned, myVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, learned, addr1, addr2, addr3)
+
+	assert.NoError(t, c.ReloadConfigString("lighthouse:\n  am_lighthouse: true\n  max_addresses_returned: -1\nlisten:\n  port: 4242"))
+	assert.EqualError(t, lh.reload(c, false), "lighthouse.max_addresses_returned can not be negative")
+}
+
+func TestLighthouse_maintenance(t *testing.T) {
+	l := test.NewLogger()
+
+	myUdpAddr := &udp.Addr{IP: net.ParseIP("192.168.0.2"), Port: 4242}
+	relayUdpAddr := &udp.Addr{IP: net.ParseIP("192.168.0.3"), Port: 4242}
+	myVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.2"))
+	relayVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+	trigger := make(chan iputil.VpnIp, 1)
+	lh.maintenanceTrigger = trigger
+	lhh := lh.NewRequestHandler()
+
+	newLHHostUpdate(relayUdpAddr, relayVpnIp, []*udp.Addr{relayUdpAddr}, lhh)
+	update := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:       uint32(myVpnIp),
+			Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(myUdpAddr.IP, uint32(myUdpAddr.Port))},
+			RelayVpnIp:  []uint32{uint32(relayVpnIp)},
+		},
+	}
+	b, err := update.Marshal()
+	assert.NoError(t, err)
+	lhh.HandleRequest(myUdpAddr, myVpnIp, b, &testEncWriter{})
+
+	sendMaintenance := func(from, vpnIp iputil.VpnIp, seconds uint32) {
+		b, err := (&NebulaMeta{
+			Type:    NebulaMeta_HostMaintenanceNotification,
+			Details: &NebulaMetaDetails{VpnIp: uint32(vpnIp), MaintenanceSeconds: seconds},
+		}).Marshal()
+		assert.NoError(t, err)
+		lhh.HandleRequest(relayUdpAddr, from, b, &testEncWriter{})
+	}
+
+	// Hosts can only put themselves in maintenance
+	sendMaintenance(myVpnIp, relayVpnIp, 60)
+	r := newLHHostRequest(myUdpAddr, myVpnIp, relayVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, relayUdpAddr)
+	assert.Len(t, trigger, 0)
+
+	// While in maintenance the relay is not handed out at all
+	sendMaintenance(relayVpnIp, relayVpnIp, 60)
+	assert.Equal(t, relayVpnIp, <-trigger)
+	r = newLHHostRequest(myUdpAddr, myVpnIp, relayVpnIp, lhh)
+	assert.Nil(t, r.msg)
+
+	r = newLHHostRequest(relayUdpAddr, relayVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, myUdpAddr)
+	assert.Empty(t, r.msg.Details.RelayVpnIp)
+
+	// Until it tells us it is back
+	sendMaintenance(relayVpnIp, relayVpnIp, 0)
+	assert.Len(t, trigger, 0)
+	r = newLHHostRequest(myUdpAddr, myVpnIp, relayVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, relayUdpAddr)
+
+	r = newLHHostRequest(relayUdpAddr, relayVpnIp, myVpnIp, lhh)
+	assert.Equal(t, []uint32{uint32(relayVpnIp)}, r.msg.Details.RelayVpnIp)
+
+	// Or the timeout passes
+	lh.peerMaintenance.set(relayVpnIp, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	assert.False(t, lh.peerMaintenance.has(relayVpnIp))
+}
+
 func newLHHostRequest(fromAddr *udp.Addr, myVpnIp, queryVpnIp iputil.VpnIp, lhh *LightHouseHandler) testLhReply {
 	req := &NebulaMeta{
 		Type: NebulaMeta_HostQuery,
@@ -484,3 +701,123 @@ func translateV4toUdpAddr(ips []*Ip4AndPort) []*udp.Addr {
 	}
 	return addrs
 }
+
+func TestLighthouse_SetNebulaPort(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"hosts":            []interface{}{"10.128.0.2"},
+		"advertise_addrs":  []interface{}{"1.2.3.4:0", "1.2.3.5:5555"},
+		"local_allow_list": map[interface{}]interface{}{"0.0.0.0/0": false, "::/0": false},
+	}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, nil)
+	assert.NoError(t, err)
+
+	filter := NebulaMeta_HostUpdateNotification
+	w := &testEncWriter{metaFilter: &filter}
+	lh.ifce = w
+
+	lh.SendUpdate()
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts,
+		&udp.Addr{IP: net.IP{1, 2, 3, 4}, Port: 4242},
+		&udp.Addr{IP: net.IP{1, 2, 3, 5}, Port: 5555},
+	)
+
+	// Advertised addresses without a port follow the listen port
+	lh.SetNebulaPort(4343)
+	lh.SendUpdate()
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts,
+		&udp.Addr{IP: net.IP{1, 2, 3, 4}, Port: 4343},
+		&udp.Addr{IP: net.IP{1, 2, 3, 5}, Port: 5555},
+	)
+}
+
+type testPunchBackWriter struct {
+	testEncWriter
+	sent chan iputil.VpnIp
+}
+
+func (tw *testPunchBackWriter) SendMessageToVpnIp(t header.MessageType, _ header.MessageSubType, vpnIp iputil.VpnIp, _, _, _ []byte) {
+	if t == header.Test {
+		tw.sent <- vpnIp
+	}
+}
+
+func TestLighthouse_lazyHandshakes(t *testing.T) {
+	l := test.NewLogger()
+	lhIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 2})
+	peerIp := iputil.Ip2VpnIp(net.IP{10, 128, 0, 3})
+
+	newHandler := func(lazy bool) *LightHouseHandler {
+		c := config.NewC(l)
+		c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.2"}}
+		c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"1.1.1.1:4242"}}
+		c.Settings["punchy"] = map[interface{}]interface{}{"respond": true, "respond_delay": "1ms"}
+		c.Settings["handshakes"] = map[interface{}]interface{}{"lazy": lazy}
+		lh, err := NewLightHouseFromConfig(context.Background(), l, c, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, nil, NewPunchyFromConfig(l, c))
+		assert.NoError(t, err)
+		return lh.NewRequestHandler()
+	}
+
+	punchNotification := func(vpnIp iputil.VpnIp) *NebulaMeta {
+		return &NebulaMeta{
+			Type:    NebulaMeta_HostPunchNotification,
+			Details: &NebulaMetaDetails{VpnIp: uint32(vpnIp)},
+		}
+	}
+
+	w := &testPunchBackWriter{sent: make(chan iputil.VpnIp, 1)}
+	assertSent := func(vpnIp iputil.VpnIp) {
+		select {
+		case sent := <-w.sent:
+			assert.Equal(t, vpnIp, sent)
+		case <-time.After(time.Second):
+			t.Fatalf("expected a test packet to %s", vpnIp)
+		}
+	}
+
+	// By default we respond to a punch notification, which starts a tunnel to the peer
+	lhh := newHandler(false)
+	lhh.handleHostPunchNotification(punchNotification(peerIp), lhIp, w)
+	assertSent(peerIp)
+
+	// Lazy handshakes do not start a tunnel to a peer without traffic from us
+	lhh = newHandler(true)
+	lhh.handleHostPunchNotification(punchNotification(peerIp), lhIp, w)
+	select {
+	case sent := <-w.sent:
+		t.Fatalf("unexpected test packet to %s", sent)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Lighthouses are still eager
+	lhh.handleHostPunchNotification(punchNotification(lhIp), lhIp, w)
+	assertSent(lhIp)
+}
+
+func TestValidateServeOnly(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"serve_only": true}
+	assert.EqualError(t, validateServeOnly(c), "lighthouse.serve_only requires lighthouse.am_lighthouse")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "serve_only": true}
+	assert.NoError(t, validateServeOnly(c))
+
+	// Rule lists can be present as long as they are empty
+	c.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{}, "outbound": []interface{}{}}
+	assert.NoError(t, validateServeOnly(c))
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"outbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "any", "host": "any"}},
+	}
+	assert.EqualError(t, validateServeOnly(c), "firewall.outbound can not have rules when lighthouse.serve_only is true")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{
+		"inbound": []interface{}{map[interface{}]interface{}{"port": "any", "proto": "icmp", "host": "any"}},
+	}
+	assert.EqualError(t, validateServeOnly(c), "firewall.inbound can not have rules when lighthouse.serve_only is true")
+}
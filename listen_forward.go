@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// listenForwardDialTimeout bounds how long a forwarded connection waits for the tunnel and the remote end to answer
+const listenForwardDialTimeout = 30 * time.Second
+
+// listenForward is a local tcp listener whose connections are proxied to remote over the overlay
+type listenForward struct {
+	local  string
+	remote *net.TCPAddr
+}
+
+// listenForwarder accepts local connections for listen_forward, starts a tunnel to the remote if there is not one yet
+// and proxies the stream through the host network stack, which routes it over the tun device.
+type listenForwarder struct {
+	l        *logrus.Logger
+	forwards []listenForward
+
+	// handshake starts a tunnel to vpnIp if there is not one already
+	handshake func(vpnIp iputil.VpnIp)
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// newListenForwarderFromConfig reads listen_forward, a map of local address to overlay address. Returns nil if there
+// is nothing to forward.
+func newListenForwarderFromConfig(l *logrus.Logger, c *config.C) (*listenForwarder, error) {
+	raw := c.GetMap("listen_forward", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	lf := &listenForwarder{
+		l:    l,
+		dial: (&net.Dialer{Timeout: listenForwardDialTimeout}).DialContext,
+	}
+
+	for k, v := range raw {
+		local := fmt.Sprintf("%v", k)
+		if _, _, err := net.SplitHostPort(local); err != nil {
+			return nil, fmt.Errorf("listen_forward local address %s was invalid: %s", local, err)
+		}
+
+		remote, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, fmt.Errorf("listen_forward.%s was invalid: %s", local, err)
+		}
+
+		if remote.IP.To4() == nil || remote.Port == 0 {
+			return nil, fmt.Errorf("listen_forward.%s must be an overlay ipv4 address and port: %v", local, v)
+		}
+
+		lf.forwards = append(lf.forwards, listenForward{local: local, remote: remote})
+	}
+
+	// Map order is random, keep the logs and listeners stable
+	sort.Slice(lf.forwards, func(i, j int) bool {
+		return lf.forwards[i].local < lf.forwards[j].local
+	})
+
+	return lf, nil
+}
+
+// start returns a func that binds every listener and serves it until ctx is done
+func (lf *listenForwarder) start(ctx context.Context) func() {
+	if lf == nil {
+		return nil
+	}
+
+	return func() {
+		for _, fwd := range lf.forwards {
+			ln, err := net.Listen("tcp", fwd.local)
+			if err != nil {
+				lf.l.WithError(err).WithField("local", fwd.local).Error("Failed to start listen_forward listener")
+				continue
+			}
+
+			lf.l.WithField("local", fwd.local).WithField("remote", fwd.remote).Info("listen_forward listening")
+			go lf.serve(ctx, ln, fwd)
+		}
+	}
+}
+
+func (lf *listenForwarder) serve(ctx context.Context, ln net.Listener, fwd listenForward) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				lf.l.WithError(err).WithField("local", fwd.local).Error("listen_forward listener exited")
+			}
+			return
+		}
+
+		go lf.forward(ctx, conn, fwd)
+	}
+}
+
+// forward starts the tunnel for fwd if needed and proxies conn to the remote end until either side is done
+func (lf *listenForwarder) forward(ctx context.Context, conn net.Conn, fwd listenForward) {
+	defer conn.Close()
+
+	// Kick off the handshake now rather than waiting for the first packet to reach the tun device
+	lf.handshake(iputil.Ip2VpnIp(fwd.remote.IP))
+
+	ctx, cancel := context.WithTimeout(ctx, listenForwardDialTimeout)
+	remote, err := lf.dial(ctx, "tcp", fwd.remote.String())
+	cancel()
+	if err != nil {
+		lf.l.WithError(err).WithField("local", fwd.local).WithField("remote", fwd.remote).
+			Info("listen_forward failed to connect to the remote")
+		return
+	}
+	defer remote.Close()
+
+	if lf.l.Level >= logrus.DebugLevel {
+		lf.l.WithField("local", fwd.local).WithField("remote", fwd.remote).
+			WithField("client", conn.RemoteAddr()).Debug("listen_forward connection established")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		proxyStream(remote, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		proxyStream(conn, remote)
+	}()
+	wg.Wait()
+}
+
+// proxyStream copies src to dst and then closes the write side of dst so the other end sees the stream finish
+func proxyStream(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewListenForwarderFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	lf, err := newListenForwarderFromConfig(l, c)
+	assert.NoError(t, err)
+	assert.Nil(t, lf)
+	assert.Nil(t, lf.start(context.Background()))
+
+	c.Settings["listen_forward"] = map[interface{}]interface{}{
+		"127.0.0.1:2222": "10.1.0.5:22",
+		"127.0.0.1:8080": "10.1.0.6:80",
+	}
+	lf, err = newListenForwarderFromConfig(l, c)
+	assert.NoError(t, err)
+	assert.Len(t, lf.forwards, 2)
+	assert.Equal(t, "127.0.0.1:2222", lf.forwards[0].local)
+	assert.Equal(t, "10.1.0.5:22", lf.forwards[0].remote.String())
+	assert.Equal(t, "10.1.0.6:80", lf.forwards[1].remote.String())
+
+	c.Settings["listen_forward"] = map[interface{}]interface{}{"2222": "10.1.0.5:22"}
+	_, err = newListenForwarderFromConfig(l, c)
+	assert.EqualError(t, err, "listen_forward local address 2222 was invalid: address 2222: missing port in address")
+
+	c.Settings["listen_forward"] = map[interface{}]interface{}{"127.0.0.1:2222": "10.1.0.5"}
+	_, err = newListenForwarderFromConfig(l, c)
+	assert.EqualError(t, err, "listen_forward.127.0.0.1:2222 was invalid: address 10.1.0.5: missing port in address")
+
+	c.Settings["listen_forward"] = map[interface{}]interface{}{"127.0.0.1:2222": "[fd00::1]:22"}
+	_, err = newListenForwarderFromConfig(l, c)
+	assert.EqualError(t, err, "listen_forward.127.0.0.1:2222 must be an overlay ipv4 address and port: [fd00::1]:22")
+}
+
+func TestListenForwarder_forward(t *testing.T) {
+	l := test.NewLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stands in for the service on the other end of the tunnel
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	remote := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 5), Port: 22}
+	var lock sync.Mutex
+	var handshakes []iputil.VpnIp
+	var dialed []string
+	lf := &listenForwarder{
+		l: l,
+		handshake: func(vpnIp iputil.VpnIp) {
+			lock.Lock()
+			handshakes = append(handshakes, vpnIp)
+			lock.Unlock()
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, address)
+			lock.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, backend.Addr().String())
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go lf.serve(ctx, ln, listenForward{local: ln.Addr().String(), remote: remote})
+
+	// Nothing happens until a local connection arrives
+	lock.Lock()
+	assert.Empty(t, handshakes)
+	lock.Unlock()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("hello over the overlay"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	b, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello over the overlay", string(b))
+	conn.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []iputil.VpnIp{iputil.Ip2VpnIp(remote.IP)}, handshakes)
+	assert.Equal(t, []string{"10.1.0.5:22"}, dialed)
+}
@@ -0,0 +1,148 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// portMigration tracks which tunnels have moved to a new listen port, a tunnel has moved once the peer sends us a
+// packet on the new port
+type portMigration struct {
+	sync.Mutex
+	pending  map[uint32]struct{}
+	migrated int64
+}
+
+func (m *portMigration) seen(localIndex uint32) {
+	m.Lock()
+	if _, ok := m.pending[localIndex]; ok {
+		delete(m.pending, localIndex)
+		m.migrated++
+	}
+	m.Unlock()
+}
+
+// reloadListenPort moves to a new listen.port without dropping tunnels. New listeners are opened and all writes move
+// to them, the lighthouses are told about the new port and peers roam to it as they receive our packets. The old
+// listeners keep receiving for listen.port_drain and are then closed, tunnels that have not moved by then are re-established
+// through the lighthouse as they would after any other remote change.
+func (f *Interface) reloadListenPort(c *config.C) {
+	if c.InitialLoad() || !c.HasChanged("listen.port") {
+		return
+	}
+
+	if c.HasChanged("listen.host") {
+		f.l.Warn("listen.host has changed, this requires a restart")
+	}
+
+	port := c.GetInt("listen.port", 0)
+	if f.lightHouse.amLighthouse && port == 0 {
+		f.l.Error("listen.port can not be 0 on a lighthouse, keeping the current port")
+		return
+	}
+
+	swaps := make([]*udp.SwapConn, len(f.writers))
+	for i, w := range f.writers {
+		sw, ok := w.(*udp.SwapConn)
+		if !ok {
+			f.l.Warn("listen.port has changed, this requires a restart")
+			return
+		}
+		swaps[i] = sw
+	}
+
+	oldAddr, err := f.outside.LocalAddr()
+	if err != nil {
+		f.l.WithError(err).Error("Failed to get the current udp listen address, keeping the current port")
+		return
+	}
+
+	conns := make([]udp.Conn, len(swaps))
+	closeConns := func() {
+		for _, nc := range conns {
+			if nc != nil {
+				nc.Close()
+			}
+		}
+	}
+
+	for i := range conns {
+		conns[i], err = udp.NewListener(f.l, oldAddr.IP, port, len(swaps) > 1, c.GetInt("listen.batch", 64))
+		if err != nil {
+			f.l.WithError(err).WithField("port", port).WithField("queue", i).
+				Error("Failed to open udp listener for the new listen.port, keeping the current port")
+			closeConns()
+			return
+		}
+		conns[i].ReloadConfig(c)
+
+		if port == 0 {
+			// Make sure every routine shares the dynamic port
+			addr, err := conns[i].LocalAddr()
+			if err != nil {
+				f.l.WithError(err).Error("Failed to get the new udp listen address, keeping the current port")
+				closeConns()
+				return
+			}
+			port = int(addr.Port)
+		}
+	}
+
+	// Every tunnel we have now should move to the new port
+	m := &portMigration{pending: map[uint32]struct{}{}}
+	f.hostMap.RLock()
+	for index := range f.hostMap.Indexes {
+		m.pending[index] = struct{}{}
+	}
+	f.hostMap.RUnlock()
+	f.portMigration.Store(m)
+
+	olds := make([]udp.Conn, len(swaps))
+	for i, sw := range swaps {
+		olds[i] = sw.Swap(conns[i])
+		go f.listenOn(conns[i], i, f.trackPortMigration(readOutsidePackets(f)))
+	}
+
+	f.lightHouse.SetNebulaPort(uint32(port))
+	f.lightHouse.SendUpdate()
+
+	// Have every tunnel ask the lighthouse to punch on its next packet, like a rebind
+	f.rebindCount++
+
+	drain := c.GetDuration("listen.port_drain", 30*time.Second)
+	f.l.WithField("oldPort", oldAddr.Port).WithField("port", port).WithField("tunnels", len(m.pending)).
+		WithField("drain", drain).Info("listen.port has changed, moving tunnels to the new port")
+
+	time.AfterFunc(drain, func() {
+		f.portMigration.CompareAndSwap(m, nil)
+		for _, oc := range olds {
+			oc.Close()
+		}
+
+		m.Lock()
+		migrated, dropped := m.migrated, int64(len(m.pending))
+		m.Unlock()
+
+		metrics.GetOrRegisterCounter("listen.port_change.migrated", f.metricsRegistry).Inc(migrated)
+		metrics.GetOrRegisterCounter("listen.port_change.dropped", f.metricsRegistry).Inc(dropped)
+		f.l.WithField("oldPort", oldAddr.Port).WithField("port", port).
+			WithField("migrated", migrated).WithField("dropped", dropped).
+			Info("Closed the previous listen.port")
+	})
+}
+
+// trackPortMigration wraps r to record which tunnels have sent to the new listen port during a port change
+func (f *Interface) trackPortMigration(r udp.EncReader) udp.EncReader {
+	return func(addr *udp.Addr, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache, ecn byte) {
+		r(addr, out, packet, h, fwPacket, lhf, nb, q, localCache, ecn)
+		if m := f.portMigration.Load(); m != nil && h.Type != header.Handshake {
+			m.seen(h.RemoteIndex)
+		}
+	}
+}
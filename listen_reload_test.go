@@ -0,0 +1,43 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterface_trackPortMigration(t *testing.T) {
+	f := &Interface{}
+	calls := 0
+	r := f.trackPortMigration(func(_ *udp.Addr, _ []byte, packet []byte, h *header.H, _ *firewall.Packet, _ udp.LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache, _ byte) {
+		calls++
+		_ = h.Parse(packet)
+	})
+
+	packet := func(t header.MessageType, index uint32) []byte {
+		return header.Encode(make([]byte, header.Len), header.Version, t, 0, index, 1)
+	}
+	h := &header.H{}
+
+	// Not migrating, packets are only passed on
+	r(nil, nil, packet(header.Message, 1), h, nil, nil, nil, 0, nil, 0)
+	assert.Equal(t, 1, calls)
+
+	m := &portMigration{pending: map[uint32]struct{}{1: {}, 2: {}, 3: {}}}
+	f.portMigration.Store(m)
+
+	r(nil, nil, packet(header.Message, 1), h, nil, nil, nil, 0, nil, 0)
+	r(nil, nil, packet(header.Message, 1), h, nil, nil, nil, 0, nil, 0)
+	r(nil, nil, packet(header.Test, 2), h, nil, nil, nil, 0, nil, 0)
+	r(nil, nil, packet(header.Message, 4), h, nil, nil, nil, 0, nil, 0)
+
+	// Handshakes do not carry our index
+	r(nil, nil, packet(header.Handshake, 3), h, nil, nil, nil, 0, nil, 0)
+
+	assert.Equal(t, 6, calls)
+	assert.Equal(t, int64(2), m.migrated)
+	assert.Equal(t, map[uint32]struct{}{3: {}}, m.pending)
+}
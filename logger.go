@@ -3,19 +3,28 @@ package nebula
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 )
 
-func configLogger(l *logrus.Logger, c *config.C) error {
-	// set up our logging level
-	logLevel, err := logrus.ParseLevel(strings.ToLower(c.GetString("logging.level", "info")))
-	if err != nil {
-		return fmt.Errorf("%s; possible levels: %s", err, logrus.AllLevels)
+// configLogger applies the logging config to l. On a reload only the level or the format that changed is applied so a
+// level set over ssh survives reloads that do not touch logging.level.
+func configLogger(l *logrus.Logger, c *config.C, initial bool) error {
+	if initial || c.HasChanged("logging.level") {
+		logLevel, err := configLogLevel(c)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(logLevel)
+	}
+
+	if !initial && !c.HasChanged("logging.format") && !c.HasChanged("logging.disable_timestamp") &&
+		!c.HasChanged("logging.timestamp_format") {
+		return nil
 	}
-	l.SetLevel(logLevel)
 
 	disableTimestamp := c.GetBool("logging.disable_timestamp", false)
 	timestampFormat := c.GetString("logging.timestamp_format", "")
@@ -27,19 +36,72 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 	logFormat := strings.ToLower(c.GetString("logging.format", "text"))
 	switch logFormat {
 	case "text":
-		l.Formatter = &logrus.TextFormatter{
+		l.SetFormatter(&logrus.TextFormatter{
 			TimestampFormat:  timestampFormat,
 			FullTimestamp:    fullTimestamp,
 			DisableTimestamp: disableTimestamp,
-		}
+		})
 	case "json":
-		l.Formatter = &logrus.JSONFormatter{
+		l.SetFormatter(&logrus.JSONFormatter{
 			TimestampFormat:  timestampFormat,
 			DisableTimestamp: disableTimestamp,
-		}
+		})
 	default:
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
 	return nil
 }
+
+// configLogLevel returns logging.level
+func configLogLevel(c *config.C) (logrus.Level, error) {
+	logLevel, err := logrus.ParseLevel(strings.ToLower(c.GetString("logging.level", "info")))
+	if err != nil {
+		return 0, fmt.Errorf("%s; possible levels: %s", err, logrus.AllLevels)
+	}
+	return logLevel, nil
+}
+
+// logLevelOverride sets a log level that goes back to logging.level after a while, for a temporary look at debug logs
+type logLevelOverride struct {
+	l *logrus.Logger
+	c *config.C
+
+	sync.Mutex
+	reset *time.Timer
+}
+
+// set changes the log level, back to logging.level after d unless d is 0. A later set replaces a pending reset.
+func (o *logLevelOverride) set(level logrus.Level, d time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.reset != nil {
+		o.reset.Stop()
+		o.reset = nil
+	}
+
+	o.l.SetLevel(level)
+	if d <= 0 {
+		return
+	}
+
+	var reset *time.Timer
+	reset = time.AfterFunc(d, func() {
+		o.Lock()
+		defer o.Unlock()
+		if o.reset != reset {
+			return
+		}
+		o.reset = nil
+
+		configured, err := configLogLevel(o.c)
+		if err != nil {
+			o.l.WithError(err).Error("Failed to reset the log level")
+			return
+		}
+		o.l.SetLevel(configured)
+		o.l.WithField("level", configured).Info("Log level reset to logging.level")
+	})
+	o.reset = reset
+}
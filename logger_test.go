@@ -0,0 +1,58 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLogger_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString("logging:\n  level: info\n  format: text\n"))
+	assert.NoError(t, configLogger(l, c, true))
+	assert.Equal(t, logrus.InfoLevel, l.GetLevel())
+	assert.IsType(t, &logrus.TextFormatter{}, l.Formatter)
+
+	// The same logger picks up the new level and format
+	assert.NoError(t, c.ReloadConfigString("logging:\n  level: debug\n  format: json\n"))
+	assert.NoError(t, configLogger(l, c, false))
+	assert.Equal(t, logrus.DebugLevel, l.GetLevel())
+	assert.IsType(t, &logrus.JSONFormatter{}, l.Formatter)
+
+	// A level set by hand survives a reload that does not change logging.level
+	l.SetLevel(logrus.TraceLevel)
+	assert.NoError(t, c.ReloadConfigString("logging:\n  level: debug\n  format: json\nlisten:\n  port: 4242\n"))
+	assert.NoError(t, configLogger(l, c, false))
+	assert.Equal(t, logrus.TraceLevel, l.GetLevel())
+
+	assert.NoError(t, c.ReloadConfigString("logging:\n  level: nope\n"))
+	assert.EqualError(t, configLogger(l, c, false), "not a valid logrus Level: \"nope\"; possible levels: [panic fatal error warning info debug trace]")
+	assert.Equal(t, logrus.TraceLevel, l.GetLevel())
+}
+
+func TestLogLevelOverride(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString("logging:\n  level: warning\n"))
+	assert.NoError(t, configLogger(l, c, true))
+
+	o := &logLevelOverride{l: l, c: c}
+	o.set(logrus.DebugLevel, 0)
+	assert.Equal(t, logrus.DebugLevel, l.GetLevel())
+
+	// A temporary level goes back to logging.level
+	o.set(logrus.TraceLevel, 10*time.Millisecond)
+	assert.Equal(t, logrus.TraceLevel, l.GetLevel())
+	assert.Eventually(t, func() bool { return l.GetLevel() == logrus.WarnLevel }, time.Second, time.Millisecond)
+
+	// A later change cancels the pending reset
+	o.set(logrus.TraceLevel, 10*time.Millisecond)
+	o.set(logrus.ErrorLevel, 0)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, logrus.ErrorLevel, l.GetLevel())
+}
@@ -2,13 +2,13 @@ package nebula
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
 	"github.com/slackhq/nebula/udp"
@@ -43,18 +43,24 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		l.Println(string(b))
 	}
 
-	err := configLogger(l, c)
+	err := configLogger(l, c, true)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
 	}
 
 	c.RegisterReloadCallback(func(c *config.C) {
-		err := configLogger(l, c)
+		err := configLogger(l, c, false)
 		if err != nil {
 			l.WithError(err).Error("Failed to configure the logger")
 		}
 	})
 
+	if err := checkOverlayName(l, c); err != nil {
+		return nil, util.ContextualizeIfNeeded("Invalid overlay.name", err)
+	}
+	// Every named overlay keeps its metrics in its own registry, stats label them with the name
+	metricsRegistry := util.MetricsRegistry(c)
+
 	pki, err := NewPKIFromConfig(l, c)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to load PKI from config", err)
@@ -67,6 +73,18 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	}
 	l.WithField("firewallHash", fw.GetRuleHash()).Info("Firewall started")
 
+	if c.GetBool("lighthouse.serve_only", false) {
+		if err := validateServeOnly(c); err != nil {
+			return nil, util.NewContextualError("Invalid lighthouse.serve_only config", nil, err)
+		}
+		l.Info("Serving lighthouse and relay traffic only, no tun device will be created")
+	}
+
+	fw.flows, err = newFlowExporterFromConfig(ctx, l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize flow export", nil, err)
+	}
+
 	// TODO: make sure mask is 4 bytes
 	tunCidr := certificate.Details.Ips[0]
 
@@ -128,7 +146,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	if !configTest {
 		c.CatchHUP(ctx)
 
-		tun, err = overlay.NewDeviceFromConfig(c, l, tunCidr, tunFd, routines)
+		tun, err = overlay.NewDeviceFromConfig(ctx, c, l, tunCidr, tunFd, routines)
 		if err != nil {
 			return nil, util.ContextualizeIfNeeded("Failed to get a tun/tap device", err)
 		}
@@ -158,13 +176,17 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 			}
 		}
 
+		if _, _, err := udp.GetBufferSizes(c); err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to configure the udp socket buffers", err)
+		}
+
 		for i := 0; i < routines; i++ {
 			udpServer, err := udp.NewListener(l, listenHost.IP, port, routines > 1, c.GetInt("listen.batch", 64))
 			if err != nil {
 				return nil, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
 			}
 			udpServer.ReloadConfig(c)
-			udpConns[i] = udpServer
+			udpConns[i] = udp.NewSwapConn(udpServer)
 		}
 	}
 
@@ -206,8 +228,12 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
-	hostMap := NewHostMap(l, tunCidr, preferredRanges)
+	hostMap := NewHostMap(l, metricsRegistry, tunCidr, preferredRanges)
 	hostMap.metricsEnabled = c.GetBool("stats.message_metrics", false)
+	hostMap.reloadPreviousKeys(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		hostMap.reloadPreviousKeys(c, false)
+	})
 
 	l.
 		WithField("network", hostMap.vpnCIDR.String()).
@@ -220,26 +246,134 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
 
+	lightHouse.peerPolicy, err = newPeerPolicyManagerFromConfig(l, c, lightHouse, pki)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load peer_policy", nil, err)
+	}
+
+	fragmenter, err := newFragmenterFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize fragmentation", nil, err)
+	}
+
+	sendQueues, err := newSendQueuesFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize the send queues", nil, err)
+	}
+
+	compressor, err := newCompressorFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize compression", nil, err)
+	}
+
+	handshakeMetadata, err := newHandshakeMetadataFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize handshake metadata", nil, err)
+	}
+
+	tunWriteRetry, err := newTunWriteRetryFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize tun write retries", nil, err)
+	}
+
+	tunWatchdog, err := newTunWatchdogFromConfig(l, c, tun, tunFd != nil)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize the tun watchdog", nil, err)
+	}
+
+	remoteCIDRFilter, err := newRemoteCIDRFilterFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize the remote cidr filter", nil, err)
+	}
+
+	keepaliveOverrides, err := newKeepaliveOverridesFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load punchy.keepalive_overrides", nil, err)
+	}
+
+	keepWarm := newKeepWarm(l, metricsRegistry)
+	if err := keepWarm.reload(c, tunCidr, true); err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.keep_warm", nil, err)
+	}
+
+	nonceLimit, err := getNonceLimit(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.nonce_safety_margin", nil, err)
+	}
+
+	replayWindow, err := getReplayWindow(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.replay_window", nil, err)
+	}
+
+	handshakePadding, err := getHandshakePadding(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.padding", nil, err)
+	}
+
+	rttMetrics, err := newRttMetricsFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load stats.rtt", nil, err)
+	}
+
+	tunnelLifetime, err := newTunnelLifetimeMetricsFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load stats.tunnel_lifetime", nil, err)
+	}
+
+	events, err := newEventWebhookFromConfig(ctx, l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize the event webhook", nil, err)
+	}
+
 	var messageMetrics *MessageMetrics
 	if c.GetBool("stats.message_metrics", false) {
-		messageMetrics = newMessageMetrics()
+		messageMetrics = newMessageMetrics(metricsRegistry)
 	} else {
-		messageMetrics = newMessageMetricsOnlyRecvError()
+		messageMetrics = newMessageMetricsOnlyRecvError(metricsRegistry)
 	}
 
 	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) && !c.GetBool("relay.am_relay", false)
 
+	handshakeJitter, err := getJitter(c, "handshakes.jitter")
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize handshake manager", nil, err)
+	}
+
+	duplicateVpnIp, err := getDuplicateVpnIpPolicy(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.duplicate_vpn_ip", nil, err)
+	}
+
 	handshakeConfig := HandshakeConfig{
 		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
 		retries:       c.GetInt("handshakes.retries", DefaultHandshakeRetries),
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
 		useRelays:     useRelays,
+		jitter:        handshakeJitter,
+		maxConcurrent: c.GetInt("handshakes.max_concurrent", 0),
+
+		autoRelay:      c.GetBool("relay.auto", false),
+		autoRelayAfter: c.GetInt("relay.auto_after", DefaultAutoRelayAfter),
+		duplicateVpnIp: duplicateVpnIp,
+
+		messageMetrics:  messageMetrics,
+		metricsRegistry: metricsRegistry,
+	}
+
+	if handshakeConfig.autoRelay && (handshakeConfig.autoRelayAfter < 0 || handshakeConfig.autoRelayAfter >= handshakeConfig.retries) {
+		return nil, util.NewContextualError("relay.auto_after must be at least 0 and less than handshakes.retries",
+			m{"auto_after": handshakeConfig.autoRelayAfter, "retries": handshakeConfig.retries}, nil)
+	}
 
-		messageMetrics: messageMetrics,
+	relayManager, err := NewRelayManager(ctx, l, hostMap, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to initialize relay manager", nil, err)
 	}
 
 	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
+	lightHouse.maintenanceTrigger = handshakeManager.maintenance
 
 	serveDns := false
 	if c.GetBool("lighthouse.serve_dns", false) {
@@ -274,21 +408,40 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
 		disconnectInvalid:       c.GetBool("pki.disconnect_invalid", false),
-		relayManager:            NewRelayManager(ctx, l, hostMap, c),
+		relayManager:            relayManager,
 		punchy:                  punchy,
+		roaming:                 c.GetBool("handshakes.roaming", true),
+		reflectECN:              c.GetBool("listen.reflect_ecn", false),
+		routingTTL:              c.GetBool("tun.routing_ttl", false),
+		psk:                     handshakePSK(c),
+		clockSkewWindow:         c.GetDuration("pki.clock_skew_window", defaultClockSkewWindow),
+		fragmenter:              fragmenter,
+		sendQueues:              sendQueues,
+		compressor:              compressor,
+		handshakeMetadata:       handshakeMetadata,
+		tunWriteRetry:           tunWriteRetry,
+		tunWatchdog:             tunWatchdog,
+		remoteCIDRFilter:        remoteCIDRFilter,
+		keepaliveOverrides:      keepaliveOverrides,
+		nonceLimit:              nonceLimit,
+		replayWindow:            replayWindow,
+		handshakePadding:        handshakePadding,
+		keepWarm:                keepWarm,
+		rttMetrics:              rttMetrics,
+		tunnelLifetime:          tunnelLifetime,
+		events:                  events,
+		metricsRegistry:         metricsRegistry,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
 	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
+	case "aes", "chachapoly":
 	default:
 		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
 	}
+	logCipherSupport(l, metricsRegistry, ifConfig.Cipher)
 
 	var ifce *Interface
 	if !configTest {
@@ -301,6 +454,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		// I don't want to make this initial commit too far-reaching though
 		ifce.writers = udpConns
 		lightHouse.ifce = ifce
+		lightHouse.hostMap = hostMap
+		pki.renumber = ifce.renumber
 
 		ifce.RegisterConfigChangeCallbacks(c)
 		ifce.reloadSendRecvError(c)
@@ -316,10 +471,36 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to start stats emitter", err)
 	}
 
+	pprofStart, err := startPprof(l, c, configTest)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to start pprof listener", err)
+	}
+
+	listenForwarder, err := newListenForwarderFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen_forward", err)
+	}
+
+	privDrop, err := newPrivilegeDropFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load drop_privileges", err)
+	}
+
+	grpcControl, err := newGRPCControlFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load control.grpc", err)
+	}
+
 	if configTest {
 		return nil, nil
 	}
 
+	if listenForwarder != nil {
+		listenForwarder.handshake = func(vpnIp iputil.VpnIp) {
+			ifce.getOrHandshake(vpnIp, nil)
+		}
+	}
+
 	//TODO: check if we _should_ be emitting stats
 	go ifce.emitStats(ctx, c.GetDuration("stats.interval", time.Second*10))
 
@@ -329,16 +510,40 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	var dnsStart func()
 	if lightHouse.amLighthouse && serveDns {
 		l.Debugln("Starting dns server")
-		dnsStart = dnsMain(l, hostMap, c)
+		dnsStart = dnsMain(l, ifce.dnsRecords, c)
+	}
+
+	var peerPolicyStart func()
+	if lightHouse.peerPolicy.enabled {
+		peerPolicyStart = func() { go lightHouse.peerPolicy.run(ctx, ifce) }
 	}
 
-	return &Control{
+	var mtuProbeStart func()
+	autoMTU := c.GetBool("tun.auto_mtu", false)
+	if autoMTU || c.GetBool("tun.mtu_probe", false) {
+		mtuProbeStart = func() { go ifce.probeOverlayMTU(ctx, autoMTU) }
+	}
+
+	control := &Control{
 		ifce,
 		l,
 		cancel,
 		sshStart,
 		statsStart,
+		pprofStart,
 		dnsStart,
+		listenForwarder.start(ctx),
 		lightHouse.StartUpdateWorker,
-	}, nil
+		func() { go keepWarm.run(ctx, ifce) },
+		mtuProbeStart,
+		peerPolicyStart,
+		privDrop,
+		c,
+		grpcControl,
+	}
+	if err := addOverlay(control); err != nil {
+		return nil, util.ContextualizeIfNeeded("Invalid overlay.name", err)
+	}
+
+	return control, nil
 }
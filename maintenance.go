@@ -0,0 +1,223 @@
+package nebula
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// maintenance is set while this node is advertised as down for maintenance, see Control.StartMaintenance
+type maintenance struct {
+	sync.Mutex
+	until time.Time
+	timer *time.Timer
+
+	// gauge is 1 while in maintenance
+	gauge metrics.Gauge
+}
+
+func newMaintenance(registry metrics.Registry) *maintenance {
+	return &maintenance{gauge: metrics.GetOrRegisterGauge("maintenance", registry)}
+}
+
+func (m *maintenance) active() bool {
+	if m == nil {
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	return time.Now().Before(m.until)
+}
+
+// peerMaintenance holds the hosts that told us they are down for maintenance and when that ends
+type peerMaintenance struct {
+	sync.RWMutex
+	until map[iputil.VpnIp]time.Time
+}
+
+func newPeerMaintenance() *peerMaintenance {
+	return &peerMaintenance{until: map[iputil.VpnIp]time.Time{}}
+}
+
+// set marks vpnIp as down for maintenance for d, a d of 0 means it is back
+func (pm *peerMaintenance) set(vpnIp iputil.VpnIp, d time.Duration) {
+	if pm == nil {
+		return
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	now := time.Now()
+	for k, until := range pm.until {
+		if now.After(until) {
+			delete(pm.until, k)
+		}
+	}
+
+	if d == 0 {
+		delete(pm.until, vpnIp)
+		return
+	}
+	pm.until[vpnIp] = now.Add(d)
+}
+
+// has returns true if vpnIp is down for maintenance
+func (pm *peerMaintenance) has(vpnIp iputil.VpnIp) bool {
+	if pm == nil {
+		return false
+	}
+
+	pm.RLock()
+	until, ok := pm.until[vpnIp]
+	pm.RUnlock()
+	return ok && time.Now().Before(until)
+}
+
+// startMaintenance tells the lighthouses and the peers relaying through us that we are down for maintenance. It ends on
+// its own once timeout passes, the lighthouses and peers will have forgotten about it by then as well.
+func (f *Interface) startMaintenance(timeout time.Duration) error {
+	if timeout < time.Second {
+		return errors.New("maintenance timeout must be at least 1 second")
+	}
+
+	m := f.maintenance
+	m.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.until = time.Now().Add(timeout)
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		m.Lock()
+		current := m.timer == timer
+		m.Unlock()
+		if current {
+			f.endMaintenance()
+		}
+	})
+	m.timer = timer
+	m.gauge.Update(1)
+	m.Unlock()
+
+	f.l.WithField("timeout", timeout).Info("Entering maintenance")
+	f.sendMaintenance(uint32(timeout / time.Second))
+	return nil
+}
+
+// endMaintenance tells the lighthouses and the peers relaying through us that we are back, it returns false if we were
+// not in maintenance
+func (f *Interface) endMaintenance() bool {
+	m := f.maintenance
+	m.Lock()
+	if m.timer == nil {
+		m.Unlock()
+		return false
+	}
+	m.timer.Stop()
+	m.timer = nil
+	m.until = time.Time{}
+	m.gauge.Update(0)
+	m.Unlock()
+
+	f.l.Info("Leaving maintenance")
+	f.sendMaintenance(0)
+	return true
+}
+
+// sendMaintenance sends a HostMaintenanceNotification to the lighthouses and every peer that has a relay through us
+func (f *Interface) sendMaintenance(seconds uint32) {
+	m := &NebulaMeta{
+		Type: NebulaMeta_HostMaintenanceNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:              uint32(f.myVpnIp.Load()),
+			MaintenanceSeconds: seconds,
+		},
+	}
+
+	mm, err := m.Marshal()
+	if err != nil {
+		f.l.WithError(err).Error("Error while marshaling maintenance notification")
+		return
+	}
+
+	targets := map[iputil.VpnIp]struct{}{}
+	for vpnIp := range f.lightHouse.GetLighthouses() {
+		targets[vpnIp] = struct{}{}
+	}
+
+	f.hostMap.RLock()
+	for vpnIp, hostinfo := range f.hostMap.Hosts {
+		for _, r := range hostinfo.relayState.CopyAllRelayFor() {
+			if r.Type == ForwardingType {
+				targets[vpnIp] = struct{}{}
+				break
+			}
+		}
+	}
+	f.hostMap.RUnlock()
+
+	f.lightHouse.metricTx(NebulaMeta_HostMaintenanceNotification, int64(len(targets)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range targets {
+		f.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+// moveOffRelay starts a new handshake with every peer we reach through relay so they can pick another relay while it
+// is down for maintenance. The current tunnels keep working until the new ones replace them.
+func (hm *HandshakeManager) moveOffRelay(relay iputil.VpnIp) {
+	var peers []iputil.VpnIp
+	hm.mainHostMap.RLock()
+	for vpnIp, hostinfo := range hm.mainHostMap.Hosts {
+		if hostinfo.remote != nil {
+			continue
+		}
+
+		for _, r := range hostinfo.relayState.CopyRelayIps() {
+			if r == relay {
+				peers = append(peers, vpnIp)
+				break
+			}
+		}
+	}
+	hm.mainHostMap.RUnlock()
+
+	for _, vpnIp := range peers {
+		hm.l.WithField("vpnIp", vpnIp).WithField("relay", relay).
+			Info("Relay is down for maintenance, re-handshaking to select another")
+		hm.StartHandshake(vpnIp, nil)
+	}
+}
+
+func (lhh *LightHouseHandler) handleHostMaintenanceNotification(n *NebulaMeta, vpnIp iputil.VpnIp) {
+	//Simple check that the host sent this not someone else
+	if n.Details.VpnIp != uint32(vpnIp) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).WithField("answer", iputil.VpnIp(n.Details.VpnIp)).Debugln("Host sent invalid maintenance notification")
+		}
+		return
+	}
+
+	d := time.Duration(n.Details.MaintenanceSeconds) * time.Second
+	lhh.lh.peerMaintenance.set(vpnIp, d)
+	if d == 0 {
+		lhh.l.WithField("vpnIp", vpnIp).Info("Host is back from maintenance")
+		return
+	}
+
+	lhh.l.WithField("vpnIp", vpnIp).WithField("timeout", d).Info("Host is down for maintenance")
+
+	// Non-blocking attempt to trigger, skip if it would block
+	select {
+	case lhh.lh.maintenanceTrigger <- vpnIp:
+	default:
+	}
+}
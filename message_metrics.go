@@ -36,38 +36,38 @@ func (m *MessageMetrics) Tx(t header.MessageType, s header.MessageSubType, i int
 	}
 }
 
-func newMessageMetrics() *MessageMetrics {
+func newMessageMetrics(registry metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		return [][]metrics.Counter{
 			{
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), registry),
 			},
 			nil,
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.lighthouse", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), registry)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.lighthouse", t), registry)},
 			{
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_request", t), nil),
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_request", t), registry),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), registry),
 			},
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), registry)},
 		}
 	}
 	return &MessageMetrics{
 		rx: gen("rx"),
 		tx: gen("tx"),
 
-		rxUnknown: metrics.GetOrRegisterCounter("messages.rx.other", nil),
-		txUnknown: metrics.GetOrRegisterCounter("messages.tx.other", nil),
+		rxUnknown: metrics.GetOrRegisterCounter("messages.rx.other", registry),
+		txUnknown: metrics.GetOrRegisterCounter("messages.tx.other", registry),
 	}
 }
 
 // Historically we only recorded recv_error, so this is backwards compat
-func newMessageMetricsOnlyRecvError() *MessageMetrics {
+func newMessageMetricsOnlyRecvError(registry metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		return [][]metrics.Counter{
 			nil,
 			nil,
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), registry)},
 		}
 	}
 	return &MessageMetrics{
@@ -76,7 +76,7 @@ func newMessageMetricsOnlyRecvError() *MessageMetrics {
 	}
 }
 
-func newLighthouseMetrics() *MessageMetrics {
+func newLighthouseMetrics(registry metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		h := make([][]metrics.Counter, len(NebulaMeta_MessageType_name))
 		used := []NebulaMeta_MessageType{
@@ -85,9 +85,12 @@ func newLighthouseMetrics() *MessageMetrics {
 			NebulaMeta_HostUpdateNotification,
 			NebulaMeta_HostPunchNotification,
 			NebulaMeta_HostUpdateNotificationAck,
+			NebulaMeta_HostMaintenanceNotification,
+			NebulaMeta_PeerPolicyRequest,
+			NebulaMeta_PeerPolicyReply,
 		}
 		for _, i := range used {
-			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), nil)}
+			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), registry)}
 		}
 		return h
 	}
@@ -95,7 +98,7 @@ func newLighthouseMetrics() *MessageMetrics {
 		rx: gen("rx"),
 		tx: gen("tx"),
 
-		rxUnknown: metrics.GetOrRegisterCounter("lighthouse.rx.other", nil),
-		txUnknown: metrics.GetOrRegisterCounter("lighthouse.tx.other", nil),
+		rxUnknown: metrics.GetOrRegisterCounter("lighthouse.rx.other", registry),
+		txUnknown: metrics.GetOrRegisterCounter("lighthouse.tx.other", registry),
 	}
 }
@@ -0,0 +1,257 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	// aeadOverhead is the authentication tag added to every encrypted nebula message
+	aeadOverhead  = 16
+	udpHeaderLen  = 8
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+
+	// nebulaOverhead is what nebula adds to every tun packet before it goes out as a udp payload
+	nebulaOverhead = header.Len + aeadOverhead
+
+	// mtuProbeMinPayload is the udp payload that fits the minimum ipv4 mtu every path must support, the probe assumes
+	// it works
+	mtuProbeMinPayload = 576 - ipv4HeaderLen - udpHeaderLen
+	// mtuProbeMaxPayload is the largest udp payload nebula sends
+	mtuProbeMaxPayload = mtu
+
+	mtuProbeTimeout  = time.Second
+	mtuProbeAttempts = 2
+)
+
+// mtuProber tracks the test replies the mtu probe is waiting on. A probe only completes when a reply at least as large
+// as the request comes back since the peer echoes the test request payload and other test replies are small.
+type mtuProber struct {
+	sync.Mutex
+	pending map[iputil.VpnIp]*mtuProbeWait
+
+	metricMTU metrics.Gauge
+}
+
+type mtuProbeWait struct {
+	size int
+	done chan struct{}
+}
+
+func newMTUProber(registry metrics.Registry) *mtuProber {
+	return &mtuProber{
+		pending:   map[iputil.VpnIp]*mtuProbeWait{},
+		metricMTU: metrics.GetOrRegisterGauge("tun.mtu_probe.recommended", registry),
+	}
+}
+
+func (p *mtuProber) add(vpnIp iputil.VpnIp, size int) chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+	w := &mtuProbeWait{size: size, done: make(chan struct{})}
+	p.pending[vpnIp] = w
+	return w.done
+}
+
+func (p *mtuProber) remove(vpnIp iputil.VpnIp, done chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	if w, ok := p.pending[vpnIp]; ok && w.done == done {
+		delete(p.pending, vpnIp)
+	}
+}
+
+// reply is called for every test reply, it completes the probe waiting on vpnIp if the reply payload is large enough
+func (p *mtuProber) reply(vpnIp iputil.VpnIp, size int) {
+	p.Lock()
+	defer p.Unlock()
+	w, ok := p.pending[vpnIp]
+	if !ok || size < w.size {
+		return
+	}
+
+	delete(p.pending, vpnIp)
+	close(w.done)
+}
+
+// probeMTU returns the largest size in [lo, hi] that try reports as delivered, lo is assumed to be delivered. Delivery
+// is expected to be monotonic, every size below one that was delivered is also delivered.
+func probeMTU(lo, hi int, try func(size int) bool) int {
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if try(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// tunMTUForPayload returns the tun mtu that keeps every nebula message within a udp payload of size
+func tunMTUForPayload(size int) int {
+	return size - nebulaOverhead
+}
+
+// probeDatagram sends a test request that becomes a udp payload of size to hostinfo with the DF bit set and reports if
+// it was echoed back. An error means the probe could not be sent at all.
+func (f *Interface) probeDatagram(ctx context.Context, d udp.DontFragmenter, hostinfo *HostInfo, size int) (bool, error) {
+	p := make([]byte, size-nebulaOverhead)
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for i := 0; i < mtuProbeAttempts; i++ {
+		done := f.mtuProber.add(hostinfo.vpnIp, len(p))
+		if err := f.sendDontFragment(d, hostinfo, p, nb, out); err != nil {
+			f.mtuProber.remove(hostinfo.vpnIp, done)
+			return false, err
+		}
+
+		t := time.NewTimer(mtuProbeTimeout)
+		select {
+		case <-done:
+			t.Stop()
+			return true, nil
+		case <-t.C:
+			f.mtuProber.remove(hostinfo.vpnIp, done)
+		case <-ctx.Done():
+			t.Stop()
+			f.mtuProber.remove(hostinfo.vpnIp, done)
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+// sendDontFragment encrypts a test request directly to the current remote of hostinfo and sends only that packet with
+// the DF bit set. A write the kernel rejects as too large for the local interface is a failed probe, not an error.
+func (f *Interface) sendDontFragment(d udp.DontFragmenter, hostinfo *HostInfo, p, nb, out []byte) error {
+	ci := hostinfo.ConnectionState
+	if noiseutil.EncryptLockNeeded {
+		ci.writeLock.Lock()
+	}
+	c := ci.messageCounter.Add(1)
+	out = header.Encode(out, header.Version, header.Test, header.TestRequest, hostinfo.remoteIndexId, c)
+	out, err := ci.eKey.EncryptDanger(out, out, p, c, nb)
+	if noiseutil.EncryptLockNeeded {
+		ci.writeLock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.messageMetrics.Tx(header.Test, header.TestRequest, 1)
+	f.connectionManager.Out(hostinfo.localIndexId)
+	err = d.WriteToDontFragment(out, hostinfo.remote)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return nil
+	}
+	return err
+}
+
+// probeOverlayMTU finds the largest udp payload that survives the path to every lighthouse and relay with the DF bit set
+// and logs the tun mtu that fits it. When autoApply is set the tun device mtu is changed to match.
+func (f *Interface) probeOverlayMTU(ctx context.Context, autoApply bool) {
+	targets := map[iputil.VpnIp]struct{}{}
+	for vpnIp := range f.lightHouse.GetLighthouses() {
+		targets[vpnIp] = struct{}{}
+	}
+	for _, vpnIp := range f.lightHouse.GetRelaysForMe() {
+		targets[vpnIp] = struct{}{}
+	}
+	delete(targets, f.myVpnIp.Load())
+
+	if len(targets) == 0 {
+		f.l.Info("Skipping the tun mtu probe, there are no lighthouses or relays to probe")
+		return
+	}
+
+	d, ok := f.outside.(udp.DontFragmenter)
+	if !ok {
+		f.l.Warn("Skipping the tun mtu probe, the udp listener can not set the DF bit")
+		return
+	}
+
+	best := 0
+	for vpnIp := range targets {
+		// Make sure there is a direct tunnel, the probe says nothing about the path when it is relayed
+		r := f.ping(vpnIp, 5*time.Second)
+		if r.Status != PingOk {
+			f.l.WithField("vpnIp", vpnIp).WithField("status", r.Status).
+				Warn("Skipping the tun mtu probe for a peer without a direct tunnel")
+			continue
+		}
+
+		hostinfo := f.hostMap.QueryVpnIp(vpnIp)
+		if hostinfo == nil || hostinfo.remote == nil {
+			continue
+		}
+
+		var sendErr error
+		size := probeMTU(mtuProbeMinPayload, mtuProbeMaxPayload, func(size int) bool {
+			if sendErr != nil {
+				return false
+			}
+			ok, err := f.probeDatagram(ctx, d, hostinfo, size)
+			sendErr = err
+			return ok
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if sendErr != nil {
+			f.l.WithError(sendErr).WithField("vpnIp", vpnIp).Warn("Failed to send the tun mtu probe")
+			continue
+		}
+
+		ipHeaderLen := ipv4HeaderLen
+		if hostinfo.remote.IP.To4() == nil {
+			ipHeaderLen = ipv6HeaderLen
+		}
+
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", hostinfo.remote).
+			WithField("pathMtu", size+udpHeaderLen+ipHeaderLen).
+			WithField("tunMtu", tunMTUForPayload(size)).
+			Info("Probed the path mtu")
+
+		if best == 0 || size < best {
+			best = size
+		}
+	}
+
+	if best == 0 {
+		f.l.Warn("The tun mtu probe did not reach any lighthouse or relay")
+		return
+	}
+
+	tunMTU := tunMTUForPayload(best)
+	f.mtuProber.metricMTU.Update(int64(tunMTU))
+	if !autoApply {
+		f.l.WithField("tunMtu", tunMTU).Info("Recommended tun mtu, set tun.mtu or enable tun.auto_mtu to use it")
+		return
+	}
+
+	s, ok := f.inside.(overlay.MTUSetter)
+	if !ok {
+		f.l.WithField("tunMtu", tunMTU).Warn("The tun device does not support changing the mtu, set tun.mtu to use the recommended mtu")
+		return
+	}
+
+	if err := s.SetMTU(tunMTU); err != nil {
+		f.l.WithError(err).WithField("tunMtu", tunMTU).Error("Failed to apply the probed tun mtu")
+		return
+	}
+	f.l.WithField("tunMtu", tunMTU).Info("Applied the probed tun mtu")
+}
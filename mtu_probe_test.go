@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeMTU(t *testing.T) {
+	for _, pathMTU := range []int{576, 1280, 1400, 1420, 1500, 9000, 9001 + ipv4HeaderLen + udpHeaderLen, 65535} {
+		tries := 0
+		size := probeMTU(mtuProbeMinPayload, mtuProbeMaxPayload, func(size int) bool {
+			tries++
+			// A path that drops every datagram with the DF bit set that is larger than its mtu
+			return size+udpHeaderLen+ipv4HeaderLen <= pathMTU
+		})
+
+		expected := pathMTU - udpHeaderLen - ipv4HeaderLen
+		if expected > mtuProbeMaxPayload {
+			expected = mtuProbeMaxPayload
+		}
+		assert.Equal(t, expected, size, "path mtu %v", pathMTU)
+		assert.LessOrEqual(t, tries, 14, "path mtu %v", pathMTU)
+	}
+
+	// Nothing above the minimum survives
+	assert.Equal(t, mtuProbeMinPayload, probeMTU(mtuProbeMinPayload, mtuProbeMaxPayload, func(int) bool { return false }))
+
+	// A 1500 byte ethernet path fits a 1440 byte tun mtu
+	size := probeMTU(mtuProbeMinPayload, mtuProbeMaxPayload, func(size int) bool {
+		return size+udpHeaderLen+ipv4HeaderLen <= 1500
+	})
+	assert.Equal(t, 1440, tunMTUForPayload(size))
+}
+
+func TestMTUProber_reply(t *testing.T) {
+	p := newMTUProber(nil)
+	vpnIp := iputil.Ip2VpnIp([]byte{10, 0, 0, 1})
+
+	done := p.add(vpnIp, 1000)
+
+	// Replies too small to be the echo, like connection manager tests, or for someone else do not complete the probe
+	p.reply(vpnIp, 0)
+	p.reply(iputil.Ip2VpnIp([]byte{10, 0, 0, 2}), 1000)
+	select {
+	case <-done:
+		t.Fatal("probe completed on the wrong reply")
+	default:
+	}
+
+	p.reply(vpnIp, 1000)
+	select {
+	case <-done:
+	default:
+		t.Fatal("probe did not complete on the echoed reply")
+	}
+	assert.Empty(t, p.pending)
+
+	// A removed probe ignores late replies
+	done = p.add(vpnIp, 1000)
+	p.remove(vpnIp, done)
+	p.reply(vpnIp, 1000)
+	assert.Empty(t, p.pending)
+}
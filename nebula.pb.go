@@ -25,17 +25,20 @@ const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 type NebulaMeta_MessageType int32
 
 const (
-	NebulaMeta_None                      NebulaMeta_MessageType = 0
-	NebulaMeta_HostQuery                 NebulaMeta_MessageType = 1
-	NebulaMeta_HostQueryReply            NebulaMeta_MessageType = 2
-	NebulaMeta_HostUpdateNotification    NebulaMeta_MessageType = 3
-	NebulaMeta_HostMovedNotification     NebulaMeta_MessageType = 4
-	NebulaMeta_HostPunchNotification     NebulaMeta_MessageType = 5
-	NebulaMeta_HostWhoami                NebulaMeta_MessageType = 6
-	NebulaMeta_HostWhoamiReply           NebulaMeta_MessageType = 7
-	NebulaMeta_PathCheck                 NebulaMeta_MessageType = 8
-	NebulaMeta_PathCheckReply            NebulaMeta_MessageType = 9
-	NebulaMeta_HostUpdateNotificationAck NebulaMeta_MessageType = 10
+	NebulaMeta_None                        NebulaMeta_MessageType = 0
+	NebulaMeta_HostQuery                   NebulaMeta_MessageType = 1
+	NebulaMeta_HostQueryReply              NebulaMeta_MessageType = 2
+	NebulaMeta_HostUpdateNotification      NebulaMeta_MessageType = 3
+	NebulaMeta_HostMovedNotification       NebulaMeta_MessageType = 4
+	NebulaMeta_HostPunchNotification       NebulaMeta_MessageType = 5
+	NebulaMeta_HostWhoami                  NebulaMeta_MessageType = 6
+	NebulaMeta_HostWhoamiReply             NebulaMeta_MessageType = 7
+	NebulaMeta_PathCheck                   NebulaMeta_MessageType = 8
+	NebulaMeta_PathCheckReply              NebulaMeta_MessageType = 9
+	NebulaMeta_HostUpdateNotificationAck   NebulaMeta_MessageType = 10
+	NebulaMeta_HostMaintenanceNotification NebulaMeta_MessageType = 11
+	NebulaMeta_PeerPolicyRequest           NebulaMeta_MessageType = 12
+	NebulaMeta_PeerPolicyReply             NebulaMeta_MessageType = 13
 )
 
 var NebulaMeta_MessageType_name = map[int32]string{
@@ -50,20 +53,26 @@ var NebulaMeta_MessageType_name = map[int32]string{
 	8:  "PathCheck",
 	9:  "PathCheckReply",
 	10: "HostUpdateNotificationAck",
+	11: "HostMaintenanceNotification",
+	12: "PeerPolicyRequest",
+	13: "PeerPolicyReply",
 }
 
 var NebulaMeta_MessageType_value = map[string]int32{
-	"None":                      0,
-	"HostQuery":                 1,
-	"HostQueryReply":            2,
-	"HostUpdateNotification":    3,
-	"HostMovedNotification":     4,
-	"HostPunchNotification":     5,
-	"HostWhoami":                6,
-	"HostWhoamiReply":           7,
-	"PathCheck":                 8,
-	"PathCheckReply":            9,
-	"HostUpdateNotificationAck": 10,
+	"None":                        0,
+	"HostQuery":                   1,
+	"HostQueryReply":              2,
+	"HostUpdateNotification":      3,
+	"HostMovedNotification":       4,
+	"HostPunchNotification":       5,
+	"HostWhoami":                  6,
+	"HostWhoamiReply":             7,
+	"PathCheck":                   8,
+	"PathCheckReply":              9,
+	"HostUpdateNotificationAck":   10,
+	"HostMaintenanceNotification": 11,
+	"PeerPolicyRequest":           12,
+	"PeerPolicyReply":             13,
 }
 
 func (x NebulaMeta_MessageType) String() string {
@@ -180,11 +189,17 @@ func (m *NebulaMeta) GetDetails() *NebulaMetaDetails {
 }
 
 type NebulaMetaDetails struct {
-	VpnIp       uint32        `protobuf:"varint,1,opt,name=VpnIp,proto3" json:"VpnIp,omitempty"`
-	Ip4AndPorts []*Ip4AndPort `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
-	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
-	RelayVpnIp  []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
-	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	VpnIp              uint32         `protobuf:"varint,1,opt,name=VpnIp,proto3" json:"VpnIp,omitempty"`
+	Ip4AndPorts        []*Ip4AndPort  `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
+	Ip6AndPorts        []*Ip6AndPort  `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
+	RelayVpnIp         []uint32       `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
+	Counter            uint32         `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	MaintenanceSeconds uint32         `protobuf:"varint,6,opt,name=MaintenanceSeconds,proto3" json:"MaintenanceSeconds,omitempty"`
+	ScopedAddrs        []*ScopedAddrs `protobuf:"bytes,7,rep,name=ScopedAddrs,proto3" json:"ScopedAddrs,omitempty"`
+	PolicyVersion      uint64         `protobuf:"varint,8,opt,name=PolicyVersion,proto3" json:"PolicyVersion,omitempty"`
+	PolicyOffset       uint32         `protobuf:"varint,9,opt,name=PolicyOffset,proto3" json:"PolicyOffset,omitempty"`
+	PolicyLength       uint32         `protobuf:"varint,10,opt,name=PolicyLength,proto3" json:"PolicyLength,omitempty"`
+	PolicyChunk        []byte         `protobuf:"bytes,11,opt,name=PolicyChunk,proto3" json:"PolicyChunk,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -255,9 +270,52 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetMaintenanceSeconds() uint32 {
+	if m != nil {
+		return m.MaintenanceSeconds
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetScopedAddrs() []*ScopedAddrs {
+	if m != nil {
+		return m.ScopedAddrs
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetPolicyVersion() uint64 {
+	if m != nil {
+		return m.PolicyVersion
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetPolicyOffset() uint32 {
+	if m != nil {
+		return m.PolicyOffset
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetPolicyLength() uint32 {
+	if m != nil {
+		return m.PolicyLength
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetPolicyChunk() []byte {
+	if m != nil {
+		return m.PolicyChunk
+	}
+	return nil
+}
+
 type Ip4AndPort struct {
-	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
-	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
+	Ip       uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
+	Port     uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
+	Priority uint32 `protobuf:"varint,3,opt,name=Priority,proto3" json:"Priority,omitempty"`
 }
 
 func (m *Ip4AndPort) Reset()         { *m = Ip4AndPort{} }
@@ -307,10 +365,18 @@ func (m *Ip4AndPort) GetPort() uint32 {
 	return 0
 }
 
+func (m *Ip4AndPort) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
 type Ip6AndPort struct {
-	Hi   uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
-	Lo   uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
-	Port uint32 `protobuf:"varint,3,opt,name=Port,proto3" json:"Port,omitempty"`
+	Hi       uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
+	Lo       uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
+	Port     uint32 `protobuf:"varint,3,opt,name=Port,proto3" json:"Port,omitempty"`
+	Priority uint32 `protobuf:"varint,4,opt,name=Priority,proto3" json:"Priority,omitempty"`
 }
 
 func (m *Ip6AndPort) Reset()         { *m = Ip6AndPort{} }
@@ -367,6 +433,13 @@ func (m *Ip6AndPort) GetPort() uint32 {
 	return 0
 }
 
+func (m *Ip6AndPort) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
 type NebulaPing struct {
 	Type NebulaPing_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaPing_MessageType" json:"Type,omitempty"`
 	Time uint64                 `protobuf:"varint,2,opt,name=Time,proto3" json:"Time,omitempty"`
@@ -422,6 +495,8 @@ func (m *NebulaPing) GetTime() uint64 {
 type NebulaHandshake struct {
 	Details *NebulaHandshakeDetails `protobuf:"bytes,1,opt,name=Details,proto3" json:"Details,omitempty"`
 	Hmac    []byte                  `protobuf:"bytes,2,opt,name=Hmac,proto3" json:"Hmac,omitempty"`
+	// random length filler from handshakes.padding, ignored by the receiver
+	Padding []byte `protobuf:"bytes,3,opt,name=Padding,proto3" json:"Padding,omitempty"`
 }
 
 func (m *NebulaHandshake) Reset()         { *m = NebulaHandshake{} }
@@ -471,12 +546,22 @@ func (m *NebulaHandshake) GetHmac() []byte {
 	return nil
 }
 
+func (m *NebulaHandshake) GetPadding() []byte {
+	if m != nil {
+		return m.Padding
+	}
+	return nil
+}
+
 type NebulaHandshakeDetails struct {
-	Cert           []byte `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
-	InitiatorIndex uint32 `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
-	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
-	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
-	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	Cert           []byte            `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
+	InitiatorIndex uint32            `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
+	ResponderIndex uint32            `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
+	Cookie         uint64            `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
+	Time           uint64            `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	Compression    uint32            `protobuf:"varint,8,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	Metadata       map[string]string `protobuf:"bytes,9,rep,name=Metadata,proto3" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	CertChain      [][]byte          `protobuf:"bytes,10,rep,name=CertChain,proto3" json:"CertChain,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
@@ -547,6 +632,27 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetCompression() uint32 {
+	if m != nil {
+		return m.Compression
+	}
+	return 0
+}
+
+func (m *NebulaHandshakeDetails) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCertChain() [][]byte {
+	if m != nil {
+		return m.CertChain
+	}
+	return nil
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
@@ -623,6 +729,66 @@ func (m *NebulaControl) GetRelayFromIp() uint32 {
 	return 0
 }
 
+type ScopedAddrs struct {
+	Groups      []string      `protobuf:"bytes,1,rep,name=Groups,proto3" json:"Groups,omitempty"`
+	Ip4AndPorts []*Ip4AndPort `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
+	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,3,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
+}
+
+func (m *ScopedAddrs) Reset()         { *m = ScopedAddrs{} }
+func (m *ScopedAddrs) String() string { return proto.CompactTextString(m) }
+func (*ScopedAddrs) ProtoMessage()    {}
+func (*ScopedAddrs) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
+}
+func (m *ScopedAddrs) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *ScopedAddrs) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_ScopedAddrs.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *ScopedAddrs) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ScopedAddrs.Merge(m, src)
+}
+func (m *ScopedAddrs) XXX_Size() int {
+	return m.Size()
+}
+func (m *ScopedAddrs) XXX_DiscardUnknown() {
+	xxx_messageInfo_ScopedAddrs.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ScopedAddrs proto.InternalMessageInfo
+
+func (m *ScopedAddrs) GetGroups() []string {
+	if m != nil {
+		return m.Groups
+	}
+	return nil
+}
+
+func (m *ScopedAddrs) GetIp4AndPorts() []*Ip4AndPort {
+	if m != nil {
+		return m.Ip4AndPorts
+	}
+	return nil
+}
+
+func (m *ScopedAddrs) GetIp6AndPorts() []*Ip6AndPort {
+	if m != nil {
+		return m.Ip6AndPorts
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
@@ -634,58 +800,77 @@ func init() {
 	proto.RegisterType((*NebulaPing)(nil), "nebula.NebulaPing")
 	proto.RegisterType((*NebulaHandshake)(nil), "nebula.NebulaHandshake")
 	proto.RegisterType((*NebulaHandshakeDetails)(nil), "nebula.NebulaHandshakeDetails")
+	proto.RegisterMapType((map[string]string)(nil), "nebula.NebulaHandshakeDetails.MetadataEntry")
 	proto.RegisterType((*NebulaControl)(nil), "nebula.NebulaControl")
+	proto.RegisterType((*ScopedAddrs)(nil), "nebula.ScopedAddrs")
 }
 
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 707 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xda, 0x4a,
-	0x14, 0xc5, 0xc6, 0x7c, 0x5d, 0x02, 0xf1, 0xbb, 0x79, 0x8f, 0x07, 0x4f, 0xaf, 0x16, 0xf5, 0xa2,
-	0x62, 0x45, 0x22, 0x92, 0x46, 0x5d, 0x36, 0xa5, 0xaa, 0x20, 0x4a, 0x22, 0x3a, 0x4a, 0x5b, 0xa9,
-	0x9b, 0x6a, 0x62, 0xa6, 0xc1, 0x02, 0x3c, 0x8e, 0x3d, 0x54, 0xe1, 0x5f, 0xf4, 0xc7, 0xe4, 0x47,
-	0x74, 0xd7, 0x2c, 0xbb, 0xac, 0x92, 0x65, 0x97, 0xfd, 0x03, 0xd5, 0x8c, 0xc1, 0x36, 0x84, 0x76,
-	0x37, 0xe7, 0xde, 0x73, 0x66, 0xce, 0x9c, 0xb9, 0x36, 0x6c, 0x79, 0xec, 0x62, 0x36, 0xa1, 0x6d,
-	0x3f, 0xe0, 0x82, 0x63, 0x3e, 0x42, 0xf6, 0x0f, 0x1d, 0xe0, 0x4c, 0x2d, 0x4f, 0x99, 0xa0, 0xd8,
-	0x01, 0xe3, 0x7c, 0xee, 0xb3, 0xba, 0xd6, 0xd4, 0x5a, 0xd5, 0x8e, 0xd5, 0x5e, 0x68, 0x12, 0x46,
-	0xfb, 0x94, 0x85, 0x21, 0xbd, 0x64, 0x92, 0x45, 0x14, 0x17, 0xf7, 0xa1, 0xf0, 0x92, 0x09, 0xea,
-	0x4e, 0xc2, 0xba, 0xde, 0xd4, 0x5a, 0xe5, 0x4e, 0xe3, 0xa1, 0x6c, 0x41, 0x20, 0x4b, 0xa6, 0xfd,
-	0x53, 0x83, 0x72, 0x6a, 0x2b, 0x2c, 0x82, 0x71, 0xc6, 0x3d, 0x66, 0x66, 0xb0, 0x02, 0xa5, 0x1e,
-	0x0f, 0xc5, 0xeb, 0x19, 0x0b, 0xe6, 0xa6, 0x86, 0x08, 0xd5, 0x18, 0x12, 0xe6, 0x4f, 0xe6, 0xa6,
-	0x8e, 0xff, 0x41, 0x4d, 0xd6, 0xde, 0xf8, 0x43, 0x2a, 0xd8, 0x19, 0x17, 0xee, 0x47, 0xd7, 0xa1,
-	0xc2, 0xe5, 0x9e, 0x99, 0xc5, 0x06, 0xfc, 0x23, 0x7b, 0xa7, 0xfc, 0x13, 0x1b, 0xae, 0xb4, 0x8c,
-	0x65, 0x6b, 0x30, 0xf3, 0x9c, 0xd1, 0x4a, 0x2b, 0x87, 0x55, 0x00, 0xd9, 0x7a, 0x37, 0xe2, 0x74,
-	0xea, 0x9a, 0x79, 0xdc, 0x81, 0xed, 0x04, 0x47, 0xc7, 0x16, 0xa4, 0xb3, 0x01, 0x15, 0xa3, 0xee,
-	0x88, 0x39, 0x63, 0xb3, 0x28, 0x9d, 0xc5, 0x30, 0xa2, 0x94, 0xf0, 0x11, 0x34, 0x36, 0x3b, 0x3b,
-	0x72, 0xc6, 0x26, 0xd8, 0x5f, 0x35, 0xf8, 0xeb, 0x41, 0x28, 0xf8, 0x37, 0xe4, 0xde, 0xfa, 0x5e,
-	0xdf, 0x57, 0xa9, 0x57, 0x48, 0x04, 0xf0, 0x00, 0xca, 0x7d, 0xff, 0xe0, 0xc8, 0x1b, 0x0e, 0x78,
-	0x20, 0x64, 0xb4, 0xd9, 0x56, 0xb9, 0x83, 0xcb, 0x68, 0x93, 0x16, 0x49, 0xd3, 0x22, 0xd5, 0x61,
-	0xac, 0x32, 0xd6, 0x55, 0x87, 0x29, 0x55, 0x4c, 0x43, 0x0b, 0x80, 0xb0, 0x09, 0x9d, 0x47, 0x36,
-	0x72, 0xcd, 0x6c, 0xab, 0x42, 0x52, 0x15, 0xac, 0x43, 0xc1, 0xe1, 0x33, 0x4f, 0xb0, 0xa0, 0x9e,
-	0x55, 0x1e, 0x97, 0xd0, 0xde, 0x03, 0x48, 0x8e, 0xc7, 0x2a, 0xe8, 0xf1, 0x35, 0xf4, 0xbe, 0x8f,
-	0x08, 0x86, 0xac, 0xab, 0xb9, 0xa8, 0x10, 0xb5, 0xb6, 0x9f, 0x4b, 0xc5, 0x61, 0x4a, 0xd1, 0x73,
-	0x95, 0xc2, 0x20, 0x7a, 0xcf, 0x95, 0xf8, 0x84, 0x2b, 0xbe, 0x41, 0xf4, 0x13, 0x1e, 0xef, 0x90,
-	0x4d, 0xed, 0x70, 0xbd, 0x1c, 0xd9, 0x81, 0xeb, 0x5d, 0xfe, 0x79, 0x64, 0x25, 0x63, 0xc3, 0xc8,
-	0x22, 0x18, 0xe7, 0xee, 0x94, 0x2d, 0xce, 0x51, 0x6b, 0xdb, 0x7e, 0x30, 0x90, 0x52, 0x6c, 0x66,
-	0xb0, 0x04, 0xb9, 0xe8, 0x79, 0x35, 0xfb, 0x03, 0x6c, 0x47, 0xfb, 0xf6, 0xa8, 0x37, 0x0c, 0x47,
-	0x74, 0xcc, 0xf0, 0x59, 0x32, 0xfd, 0x9a, 0x9a, 0xfe, 0x35, 0x07, 0x31, 0x73, 0xfd, 0x13, 0x90,
-	0x26, 0x7a, 0x53, 0xea, 0x28, 0x13, 0x5b, 0x44, 0xad, 0xed, 0x1b, 0x0d, 0x6a, 0x9b, 0x75, 0x92,
-	0xde, 0x65, 0x81, 0x50, 0xa7, 0x6c, 0x11, 0xb5, 0xc6, 0x27, 0x50, 0xed, 0x7b, 0xae, 0x70, 0xa9,
-	0xe0, 0x41, 0xdf, 0x1b, 0xb2, 0xeb, 0x45, 0xd2, 0x6b, 0x55, 0xc9, 0x23, 0x2c, 0xf4, 0xb9, 0x37,
-	0x64, 0x0b, 0x5e, 0x94, 0xe7, 0x5a, 0x15, 0x6b, 0x90, 0xef, 0x72, 0x3e, 0x76, 0x59, 0xdd, 0x50,
-	0xc9, 0x2c, 0x50, 0x9c, 0x57, 0x2e, 0xc9, 0xeb, 0xd8, 0x28, 0xe6, 0xcd, 0xc2, 0xb1, 0x51, 0x2c,
-	0x98, 0x45, 0xfb, 0x46, 0x87, 0x4a, 0x64, 0xbb, 0xcb, 0x3d, 0x11, 0xf0, 0x09, 0x3e, 0x5d, 0x79,
-	0x95, 0xc7, 0xab, 0x99, 0x2c, 0x48, 0x1b, 0x1e, 0x66, 0x0f, 0x76, 0x62, 0xeb, 0x6a, 0xfe, 0xd2,
-	0xb7, 0xda, 0xd4, 0x92, 0x8a, 0xf8, 0x12, 0x29, 0x45, 0x74, 0xbf, 0x4d, 0x2d, 0xfc, 0x1f, 0x4a,
-	0x0a, 0x9d, 0xf3, 0xbe, 0xaf, 0xee, 0x59, 0x21, 0x49, 0x01, 0x9b, 0x50, 0x56, 0xe0, 0x55, 0xc0,
-	0xa7, 0xea, 0x5b, 0x90, 0xfd, 0x74, 0xc9, 0xee, 0xfd, 0xee, 0xcf, 0x55, 0x03, 0xec, 0x06, 0x8c,
-	0x0a, 0xa6, 0xd8, 0x84, 0x5d, 0xcd, 0x58, 0x28, 0x4c, 0x0d, 0xff, 0x85, 0x9d, 0x95, 0xba, 0xb4,
-	0x14, 0x32, 0x53, 0x7f, 0xb1, 0xff, 0xe5, 0xce, 0xd2, 0x6e, 0xef, 0x2c, 0xed, 0xfb, 0x9d, 0xa5,
-	0x7d, 0xbe, 0xb7, 0x32, 0xb7, 0xf7, 0x56, 0xe6, 0xdb, 0xbd, 0x95, 0x79, 0xdf, 0xb8, 0x74, 0xc5,
-	0x68, 0x76, 0xd1, 0x76, 0xf8, 0x74, 0x37, 0x9c, 0x50, 0x67, 0x3c, 0xba, 0xda, 0x8d, 0x22, 0xbc,
-	0xc8, 0xab, 0x1f, 0xf8, 0xfe, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0x56, 0x28, 0x74, 0xd0,
-	0x05, 0x00, 0x00,
+	// 985 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xcd, 0x72, 0x1b, 0x45,
+	0x10, 0xf6, 0xfe, 0x58, 0x3f, 0x2d, 0xc9, 0xd9, 0xb4, 0x89, 0x59, 0x1b, 0x10, 0x62, 0x8b, 0xa2,
+	0x74, 0xa0, 0x14, 0xca, 0x4e, 0x52, 0x29, 0x38, 0x19, 0xf1, 0x23, 0xa5, 0x6c, 0x23, 0x26, 0x26,
+	0x54, 0x51, 0x5c, 0xc6, 0xbb, 0x63, 0x6b, 0x4a, 0xd2, 0xcc, 0x66, 0x77, 0x94, 0x8a, 0xde, 0x02,
+	0xde, 0x85, 0x03, 0x47, 0x4e, 0x14, 0xc7, 0x1c, 0x39, 0x52, 0xf6, 0x63, 0x70, 0xa1, 0x66, 0x56,
+	0x5a, 0xad, 0x64, 0x25, 0xc5, 0x21, 0xb7, 0xe9, 0xaf, 0xbf, 0xee, 0xfd, 0xd4, 0xdd, 0xd3, 0x23,
+	0xa8, 0x0b, 0x76, 0x31, 0x1d, 0xd3, 0x4e, 0x9c, 0x48, 0x25, 0xb1, 0x94, 0x59, 0xc1, 0xef, 0x0e,
+	0xc0, 0x99, 0x39, 0x9e, 0x32, 0x45, 0xf1, 0x10, 0xdc, 0xf3, 0x59, 0xcc, 0x7c, 0xab, 0x65, 0xb5,
+	0x77, 0x0e, 0x9b, 0x9d, 0x79, 0xcc, 0x92, 0xd1, 0x39, 0x65, 0x69, 0x4a, 0xaf, 0x98, 0x66, 0x11,
+	0xc3, 0xc5, 0x23, 0x28, 0x7f, 0xc5, 0x14, 0xe5, 0xe3, 0xd4, 0xb7, 0x5b, 0x56, 0xbb, 0x76, 0xb8,
+	0x7f, 0x3b, 0x6c, 0x4e, 0x20, 0x0b, 0x66, 0xf0, 0x87, 0x0d, 0xb5, 0x42, 0x2a, 0xac, 0x80, 0x7b,
+	0x26, 0x05, 0xf3, 0xb6, 0xb0, 0x01, 0xd5, 0x9e, 0x4c, 0xd5, 0xf7, 0x53, 0x96, 0xcc, 0x3c, 0x0b,
+	0x11, 0x76, 0x72, 0x93, 0xb0, 0x78, 0x3c, 0xf3, 0x6c, 0x3c, 0x80, 0x3d, 0x8d, 0xfd, 0x10, 0x47,
+	0x54, 0xb1, 0x33, 0xa9, 0xf8, 0x25, 0x0f, 0xa9, 0xe2, 0x52, 0x78, 0x0e, 0xee, 0xc3, 0x3d, 0xed,
+	0x3b, 0x95, 0x2f, 0x58, 0xb4, 0xe2, 0x72, 0x17, 0xae, 0xc1, 0x54, 0x84, 0xc3, 0x15, 0xd7, 0x36,
+	0xee, 0x00, 0x68, 0xd7, 0x8f, 0x43, 0x49, 0x27, 0xdc, 0x2b, 0xe1, 0x2e, 0xdc, 0x59, 0xda, 0xd9,
+	0x67, 0xcb, 0x5a, 0xd9, 0x80, 0xaa, 0x61, 0x77, 0xc8, 0xc2, 0x91, 0x57, 0xd1, 0xca, 0x72, 0x33,
+	0xa3, 0x54, 0xf1, 0x03, 0xd8, 0xdf, 0xac, 0xec, 0x38, 0x1c, 0x79, 0x80, 0x1f, 0xc2, 0x7b, 0x46,
+	0x1c, 0xe5, 0x42, 0x31, 0x41, 0x45, 0xb8, 0xaa, 0xbe, 0x86, 0xf7, 0xe0, 0xee, 0x80, 0xb1, 0x64,
+	0x20, 0xc7, 0x3c, 0x9c, 0x11, 0xf6, 0x7c, 0xca, 0x52, 0xe5, 0xd5, 0xb5, 0x9c, 0x22, 0xac, 0xbf,
+	0xd5, 0x08, 0xfe, 0x74, 0xe0, 0xee, 0xad, 0x0a, 0xe3, 0x3b, 0xb0, 0xfd, 0x2c, 0x16, 0xfd, 0xd8,
+	0xb4, 0xb0, 0x41, 0x32, 0x03, 0x1f, 0x40, 0xad, 0x1f, 0x3f, 0x38, 0x16, 0xd1, 0x40, 0x26, 0x4a,
+	0xf7, 0xc9, 0x69, 0xd7, 0x0e, 0x71, 0xd1, 0xa7, 0xa5, 0x8b, 0x14, 0x69, 0x59, 0xd4, 0xa3, 0x3c,
+	0xca, 0x5d, 0x8f, 0x7a, 0x54, 0x88, 0xca, 0x69, 0xd8, 0x04, 0x20, 0x6c, 0x4c, 0x67, 0x99, 0x8c,
+	0xed, 0x96, 0xd3, 0x6e, 0x90, 0x02, 0x82, 0x3e, 0x94, 0x43, 0x39, 0x15, 0x8a, 0x25, 0xbe, 0x63,
+	0x34, 0x2e, 0x4c, 0xec, 0x00, 0x16, 0x4a, 0xf3, 0x94, 0x85, 0x52, 0x44, 0xa9, 0x5f, 0x32, 0xa4,
+	0x0d, 0x1e, 0x7c, 0x08, 0xb5, 0xa7, 0xa1, 0x8c, 0x59, 0x74, 0x1c, 0x45, 0x49, 0xea, 0x97, 0x8d,
+	0xbe, 0xdd, 0x85, 0xbe, 0x82, 0x8b, 0x14, 0x79, 0xf8, 0x31, 0x34, 0xb2, 0x4a, 0x3e, 0x63, 0x49,
+	0xca, 0xa5, 0xf0, 0x2b, 0x2d, 0xab, 0xed, 0x92, 0x55, 0x10, 0x03, 0xa8, 0x67, 0xc0, 0x77, 0x97,
+	0x97, 0x29, 0x53, 0x7e, 0xd5, 0xc8, 0x58, 0xc1, 0x96, 0x9c, 0x13, 0x26, 0xae, 0xd4, 0xd0, 0x87,
+	0x22, 0x27, 0xc3, 0xb0, 0x05, 0xb5, 0xcc, 0xee, 0x0e, 0xa7, 0x62, 0xe4, 0xd7, 0x5a, 0x56, 0xbb,
+	0x4e, 0x8a, 0x50, 0x70, 0x02, 0xb0, 0xac, 0x3a, 0xee, 0x80, 0x9d, 0x77, 0xcf, 0xee, 0xc7, 0x88,
+	0xe0, 0x6a, 0xdc, 0xdc, 0xad, 0x06, 0x31, 0x67, 0x3c, 0x80, 0xca, 0x20, 0xe1, 0x32, 0xe1, 0x6a,
+	0x36, 0xaf, 0x61, 0x6e, 0x07, 0x3f, 0x03, 0x2c, 0xbb, 0xa1, 0xb3, 0xf5, 0xb8, 0xc9, 0xe6, 0x12,
+	0xbb, 0xc7, 0xb5, 0x7d, 0x22, 0x4d, 0x2e, 0x97, 0xd8, 0x27, 0x32, 0xcf, 0xee, 0xbc, 0x26, 0xbb,
+	0xbb, 0x96, 0xfd, 0xe5, 0x62, 0x5d, 0x0c, 0xb8, 0xb8, 0x7a, 0xf3, 0xba, 0xd0, 0x8c, 0x0d, 0xeb,
+	0x02, 0xc1, 0x3d, 0xe7, 0x13, 0x36, 0xd7, 0x60, 0xce, 0x41, 0x70, 0x6b, 0x19, 0xe8, 0x60, 0x6f,
+	0x0b, 0xab, 0xb0, 0x9d, 0x8d, 0xbb, 0x15, 0xcc, 0xe0, 0x4e, 0x96, 0xb7, 0x47, 0x45, 0x94, 0x0e,
+	0xe9, 0x88, 0xe1, 0xe3, 0xe5, 0xe6, 0xb1, 0xcc, 0xe6, 0x59, 0x53, 0x90, 0x33, 0xd7, 0xd7, 0x8f,
+	0x16, 0xd1, 0x9b, 0xd0, 0xd0, 0x88, 0xa8, 0x13, 0x73, 0xd6, 0x73, 0x39, 0xa0, 0x51, 0xc4, 0xc5,
+	0x95, 0xa9, 0x46, 0x9d, 0x2c, 0xcc, 0xe0, 0x5f, 0x1b, 0xf6, 0x36, 0x67, 0xd4, 0x89, 0xba, 0x2c,
+	0x51, 0xe6, 0xfb, 0x75, 0x62, 0xce, 0xf8, 0x09, 0xec, 0xf4, 0x05, 0x57, 0x9c, 0x2a, 0x99, 0xf4,
+	0x45, 0xc4, 0x5e, 0xce, 0x7b, 0xb7, 0x86, 0x6a, 0x1e, 0x61, 0x69, 0x2c, 0x45, 0xc4, 0xe6, 0xbc,
+	0xac, 0x0b, 0x6b, 0x28, 0xee, 0x41, 0xa9, 0x2b, 0xe5, 0x88, 0x33, 0xd3, 0x0d, 0x97, 0xcc, 0xad,
+	0xbc, 0x92, 0xdb, 0xcb, 0x4a, 0xea, 0x69, 0xeb, 0xca, 0x49, 0x9c, 0xb0, 0x34, 0x9f, 0xec, 0x06,
+	0x29, 0x42, 0xd8, 0x83, 0x8a, 0xde, 0x17, 0x11, 0x55, 0xd4, 0xaf, 0x9a, 0x1b, 0xf3, 0xe9, 0x9b,
+	0xab, 0xd6, 0x59, 0xd0, 0xbf, 0x16, 0x2a, 0x99, 0x91, 0x3c, 0x1a, 0xdf, 0x87, 0xaa, 0xfe, 0xbd,
+	0xdd, 0x21, 0xe5, 0xc2, 0x87, 0x96, 0xd3, 0xae, 0x93, 0x25, 0x70, 0xf0, 0x05, 0x34, 0x56, 0x02,
+	0xd1, 0x03, 0x67, 0xc4, 0x66, 0xa6, 0x52, 0x55, 0xa2, 0x8f, 0x7a, 0x57, 0xbd, 0xa0, 0xe3, 0x69,
+	0x36, 0x0b, 0x55, 0x92, 0x19, 0x9f, 0xdb, 0x8f, 0xad, 0x27, 0x6e, 0xa5, 0xe4, 0x95, 0x9f, 0xb8,
+	0x95, 0xb2, 0x57, 0x09, 0x7e, 0xb3, 0xa1, 0x91, 0x29, 0xeb, 0x4a, 0xa1, 0x12, 0x39, 0xc6, 0x87,
+	0x2b, 0x63, 0xf7, 0xd1, 0xaa, 0xfc, 0x39, 0x69, 0xc3, 0xe4, 0x7d, 0x06, 0xbb, 0x79, 0x07, 0xcc,
+	0x3e, 0x2a, 0x36, 0x67, 0x93, 0x4b, 0x47, 0xe4, 0xbd, 0x28, 0x44, 0x64, 0x6d, 0xda, 0xe4, 0xd2,
+	0x35, 0x31, 0xd6, 0xb9, 0xec, 0xc7, 0xf3, 0xcb, 0xb3, 0x04, 0x74, 0x77, 0x8c, 0xf1, 0x4d, 0x22,
+	0x27, 0x66, 0x37, 0x9a, 0xee, 0x14, 0xa0, 0xa0, 0xf7, 0xba, 0x67, 0x71, 0x0f, 0xb0, 0x9b, 0x30,
+	0xaa, 0x98, 0x61, 0x2f, 0x9e, 0x06, 0x0b, 0xdf, 0x85, 0xdd, 0x15, 0x5c, 0x4b, 0x4a, 0x99, 0x67,
+	0x07, 0xbf, 0x5a, 0x2b, 0xdb, 0x51, 0x4f, 0xd1, 0xb7, 0x89, 0x9c, 0xc6, 0xfa, 0xae, 0x38, 0xed,
+	0x2a, 0x99, 0x5b, 0x6f, 0xe7, 0x69, 0x70, 0xfe, 0xd7, 0xd3, 0xf0, 0xe5, 0xd1, 0x5f, 0xd7, 0x4d,
+	0xeb, 0xd5, 0x75, 0xd3, 0xfa, 0xe7, 0xba, 0x69, 0xfd, 0x72, 0xd3, 0xdc, 0x7a, 0x75, 0xd3, 0xdc,
+	0xfa, 0xfb, 0xa6, 0xb9, 0xf5, 0xd3, 0xfe, 0x15, 0x57, 0xc3, 0xe9, 0x45, 0x27, 0x94, 0x93, 0xfb,
+	0xe9, 0x98, 0x86, 0xa3, 0xe1, 0xf3, 0xfb, 0x59, 0xb2, 0x8b, 0x92, 0xf9, 0xc7, 0x72, 0xf4, 0xdf,
+	0x00, 0xf4, 0x46, 0x08, 0xcf, 0xc1, 0x08, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -748,6 +933,47 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.PolicyChunk) > 0 {
+		i -= len(m.PolicyChunk)
+		copy(dAtA[i:], m.PolicyChunk)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.PolicyChunk)))
+		i--
+		dAtA[i] = 0x5a
+	}
+	if m.PolicyLength != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.PolicyLength))
+		i--
+		dAtA[i] = 0x50
+	}
+	if m.PolicyOffset != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.PolicyOffset))
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.PolicyVersion != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.PolicyVersion))
+		i--
+		dAtA[i] = 0x40
+	}
+	if len(m.ScopedAddrs) > 0 {
+		for iNdEx := len(m.ScopedAddrs) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.ScopedAddrs[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x3a
+		}
+	}
+	if m.MaintenanceSeconds != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.MaintenanceSeconds))
+		i--
+		dAtA[i] = 0x30
+	}
 	if len(m.RelayVpnIp) > 0 {
 		dAtA3 := make([]byte, len(m.RelayVpnIp)*10)
 		var j2 int
@@ -827,6 +1053,11 @@ func (m *Ip4AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Priority != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Priority))
+		i--
+		dAtA[i] = 0x18
+	}
 	if m.Port != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
 		i--
@@ -860,6 +1091,11 @@ func (m *Ip6AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Priority != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Priority))
+		i--
+		dAtA[i] = 0x20
+	}
 	if m.Port != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
 		i--
@@ -931,6 +1167,13 @@ func (m *NebulaHandshake) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Padding) > 0 {
+		i -= len(m.Padding)
+		copy(dAtA[i:], m.Padding)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Padding)))
+		i--
+		dAtA[i] = 0x1a
+	}
 	if len(m.Hmac) > 0 {
 		i -= len(m.Hmac)
 		copy(dAtA[i:], m.Hmac)
@@ -973,6 +1216,39 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.CertChain) > 0 {
+		for iNdEx := len(m.CertChain) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.CertChain[iNdEx])
+			copy(dAtA[i:], m.CertChain[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.CertChain[iNdEx])))
+			i--
+			dAtA[i] = 0x52
+		}
+	}
+	if len(m.Metadata) > 0 {
+		for k := range m.Metadata {
+			v := m.Metadata[k]
+			baseI := i
+			i -= len(v)
+			copy(dAtA[i:], v)
+			i = encodeVarintNebula(dAtA, i, uint64(len(v)))
+			i--
+			dAtA[i] = 0x12
+			i -= len(k)
+			copy(dAtA[i:], k)
+			i = encodeVarintNebula(dAtA, i, uint64(len(k)))
+			i--
+			dAtA[i] = 0xa
+			i = encodeVarintNebula(dAtA, i, uint64(baseI-i))
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if m.Compression != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Compression))
+		i--
+		dAtA[i] = 0x40
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -1051,6 +1327,66 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *ScopedAddrs) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *ScopedAddrs) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *ScopedAddrs) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Ip6AndPorts) > 0 {
+		for iNdEx := len(m.Ip6AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Ip6AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
+	if len(m.Ip4AndPorts) > 0 {
+		for iNdEx := len(m.Ip4AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Ip4AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if len(m.Groups) > 0 {
+		for iNdEx := len(m.Groups) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Groups[iNdEx])
+			copy(dAtA[i:], m.Groups[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Groups[iNdEx])))
+			i--
+			dAtA[i] = 0xa
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintNebula(dAtA []byte, offset int, v uint64) int {
 	offset -= sovNebula(v)
 	base := offset
@@ -1109,6 +1445,28 @@ func (m *NebulaMetaDetails) Size() (n int) {
 		}
 		n += 1 + sovNebula(uint64(l)) + l
 	}
+	if m.MaintenanceSeconds != 0 {
+		n += 1 + sovNebula(uint64(m.MaintenanceSeconds))
+	}
+	if len(m.ScopedAddrs) > 0 {
+		for _, e := range m.ScopedAddrs {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if m.PolicyVersion != 0 {
+		n += 1 + sovNebula(uint64(m.PolicyVersion))
+	}
+	if m.PolicyOffset != 0 {
+		n += 1 + sovNebula(uint64(m.PolicyOffset))
+	}
+	if m.PolicyLength != 0 {
+		n += 1 + sovNebula(uint64(m.PolicyLength))
+	}
+	l = len(m.PolicyChunk)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1124,6 +1482,9 @@ func (m *Ip4AndPort) Size() (n int) {
 	if m.Port != 0 {
 		n += 1 + sovNebula(uint64(m.Port))
 	}
+	if m.Priority != 0 {
+		n += 1 + sovNebula(uint64(m.Priority))
+	}
 	return n
 }
 
@@ -1142,6 +1503,9 @@ func (m *Ip6AndPort) Size() (n int) {
 	if m.Port != 0 {
 		n += 1 + sovNebula(uint64(m.Port))
 	}
+	if m.Priority != 0 {
+		n += 1 + sovNebula(uint64(m.Priority))
+	}
 	return n
 }
 
@@ -1174,6 +1538,10 @@ func (m *NebulaHandshake) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovNebula(uint64(l))
 	}
+	l = len(m.Padding)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1199,6 +1567,23 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if m.Compression != 0 {
+		n += 1 + sovNebula(uint64(m.Compression))
+	}
+	if len(m.Metadata) > 0 {
+		for k, v := range m.Metadata {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovNebula(uint64(len(k))) + 1 + len(v) + sovNebula(uint64(len(v)))
+			n += mapEntrySize + 1 + sovNebula(uint64(mapEntrySize))
+		}
+	}
+	if len(m.CertChain) > 0 {
+		for _, b := range m.CertChain {
+			l = len(b)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1226,6 +1611,33 @@ func (m *NebulaControl) Size() (n int) {
 	return n
 }
 
+func (m *ScopedAddrs) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.Groups) > 0 {
+		for _, s := range m.Groups {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.Ip4AndPorts) > 0 {
+		for _, e := range m.Ip4AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.Ip6AndPorts) > 0 {
+		for _, e := range m.Ip6AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovNebula(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -1548,17 +1960,161 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 			} else {
 				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIp", wireType)
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaintenanceSeconds", wireType)
 			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
+			m.MaintenanceSeconds = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaintenanceSeconds |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
 			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ScopedAddrs", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ScopedAddrs = append(m.ScopedAddrs, &ScopedAddrs{})
+			if err := m.ScopedAddrs[len(m.ScopedAddrs)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PolicyVersion", wireType)
+			}
+			m.PolicyVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PolicyVersion |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PolicyOffset", wireType)
+			}
+			m.PolicyOffset = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PolicyOffset |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PolicyLength", wireType)
+			}
+			m.PolicyLength = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PolicyLength |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PolicyChunk", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PolicyChunk = append(m.PolicyChunk[:0], dAtA[iNdEx:postIndex]...)
+			if m.PolicyChunk == nil {
+				m.PolicyChunk = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
 			}
 			iNdEx += skippy
 		}
@@ -1636,6 +2192,25 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
+			}
+			m.Priority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Priority |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1743,6 +2318,25 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
+			}
+			m.Priority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Priority |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1951,6 +2545,40 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				m.Hmac = []byte{}
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Padding", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Padding = append(m.Padding[:0], dAtA[iNdEx:postIndex]...)
+			if m.Padding == nil {
+				m.Padding = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2111,6 +2739,184 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			m.Compression = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Compression |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Metadata == nil {
+				m.Metadata = make(map[string]string)
+			}
+			var mapkey string
+			var mapvalue string
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowNebula
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					wire |= uint64(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowNebula
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthNebula
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey < 0 {
+						return ErrInvalidLengthNebula
+					}
+					if postStringIndexmapkey > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var stringLenmapvalue uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowNebula
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapvalue |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapvalue := int(stringLenmapvalue)
+					if intStringLenmapvalue < 0 {
+						return ErrInvalidLengthNebula
+					}
+					postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+					if postStringIndexmapvalue < 0 {
+						return ErrInvalidLengthNebula
+					}
+					if postStringIndexmapvalue > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = string(dAtA[iNdEx:postStringIndexmapvalue])
+					iNdEx = postStringIndexmapvalue
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipNebula(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if (skippy < 0) || (iNdEx+skippy) < 0 {
+						return ErrInvalidLengthNebula
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
+				}
+			}
+			m.Metadata[mapkey] = mapvalue
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CertChain", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CertChain = append(m.CertChain, make([]byte, postIndex-iNdEx))
+			copy(m.CertChain[len(m.CertChain)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2277,6 +3083,156 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *ScopedAddrs) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: ScopedAddrs: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: ScopedAddrs: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Groups", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Groups = append(m.Groups, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip4AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ip4AndPorts = append(m.Ip4AndPorts, &Ip4AndPort{})
+			if err := m.Ip4AndPorts[len(m.Ip4AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip6AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ip6AndPorts = append(m.Ip6AndPorts, &Ip6AndPort{})
+			if err := m.Ip6AndPorts[len(m.Ip6AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipNebula(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
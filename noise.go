@@ -12,17 +12,26 @@ type endianness interface {
 	PutUint64(b []byte, v uint64)
 }
 
-var noiseEndianness endianness = binary.BigEndian
-
 type NebulaCipherState struct {
 	c noise.Cipher
+	// e is the byte order of the nonce, which depends on the cipher. It lives here rather than in a package global
+	// so multiple nebula instances with different ciphers can run in a single process.
+	e endianness
 	//k [32]byte
 	//n uint64
 }
 
-func NewNebulaCipherState(s *noise.CipherState) *NebulaCipherState {
-	return &NebulaCipherState{c: s.Cipher()}
+func NewNebulaCipherState(s *noise.CipherState, cipher string) *NebulaCipherState {
+	return &NebulaCipherState{c: s.Cipher(), e: cipherEndianness(cipher)}
+
+}
 
+// cipherEndianness returns the nonce byte order for the cipher, cipher is expected to be validated already
+func cipherEndianness(cipher string) endianness {
+	if cipher == "chachapoly" {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
 }
 
 // EncryptDanger encrypts and authenticates a given payload.
@@ -45,7 +54,7 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.e.PutUint64(nb[4:], n)
 		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
@@ -60,7 +69,7 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.e.PutUint64(nb[4:], n)
 		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
 	} else {
 		return []byte{}, nil
@@ -0,0 +1,41 @@
+package nebula
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNebulaCipherState_Endianness(t *testing.T) {
+	var k [32]byte
+	aes := &NebulaCipherState{c: noiseutil.CipherAESGCM.Cipher(k), e: cipherEndianness("aes")}
+	chacha := &NebulaCipherState{c: noise.CipherChaChaPoly.Cipher(k), e: cipherEndianness("chachapoly")}
+
+	// Both ciphers live side by side, each uses its own nonce byte order
+	nb := make([]byte, 12)
+	out, err := aes.EncryptDanger(nil, []byte("ad"), []byte("hi"), 1, nb)
+	assert.NoError(t, err)
+
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], 1)
+	p, err := aes.c.(cipher.AEAD).Open(nil, nonce, out, []byte("ad"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hi"), p)
+
+	out, err = chacha.EncryptDanger(nil, []byte("ad"), []byte("hi"), 1, nb)
+	assert.NoError(t, err)
+
+	nonce = make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], 1)
+	p, err = chacha.c.(cipher.AEAD).Open(nil, nonce, out, []byte("ad"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hi"), p)
+
+	p, err = chacha.DecryptDanger(nil, []byte("ad"), out, 1, nb)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hi"), p)
+}
@@ -0,0 +1,49 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// maxNonceAES is the most messages that are sent with one AES-GCM key. RFC 8446 bounds a key to 2^34.5 cipher
+	// blocks, a 9001 byte packet, the largest mtu, is 2^9.2 blocks.
+	maxNonceAES uint64 = 1 << 25
+	// maxNonceChaChaPoly is the most messages that are sent with one ChaCha20-Poly1305 key. The cipher has no practical
+	// bound so this is the rekey limit wireguard uses, well clear of the 64 bit counter running out.
+	maxNonceChaChaPoly uint64 = 1 << 60
+)
+
+// defaultNonceSafetyMargin is the fraction of maxNonce left unused when a tunnel is rehandshaked
+const defaultNonceSafetyMargin = 0.01
+
+// maxNonce returns the message counter a key of cipher must not be used past, an unknown cipher is treated as the
+// default aes
+func maxNonce(cipher string) uint64 {
+	if cipher == "chachapoly" {
+		return maxNonceChaChaPoly
+	}
+	return maxNonceAES
+}
+
+// getNonceLimit reads handshakes.nonce_safety_margin and returns the message counter at which a tunnel using the
+// configured cipher is rehandshaked
+func getNonceLimit(c *config.C) (uint64, error) {
+	margin := c.GetFloat64("handshakes.nonce_safety_margin", defaultNonceSafetyMargin)
+	if margin <= 0 || margin >= 1 {
+		return 0, fmt.Errorf("handshakes.nonce_safety_margin must be greater than 0 and less than 1: %v", margin)
+	}
+
+	return nonceLimit(c.GetString("cipher", "aes"), margin), nil
+}
+
+func nonceLimit(cipher string, margin float64) uint64 {
+	m := maxNonce(cipher)
+	return m - uint64(margin*float64(m))
+}
+
+// nonceFraction returns how much of the maxNonce of cipher the message counter of hostinfo has used
+func nonceFraction(hostinfo *HostInfo, cipher string) float64 {
+	return float64(hostinfo.ConnectionState.messageCounter.Load()) / float64(maxNonce(cipher))
+}
@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getNonceLimit(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// The default is 1% short of the aes limit
+	limit, err := getNonceLimit(c)
+	assert.NoError(t, err)
+	assert.Equal(t, nonceLimit("aes", defaultNonceSafetyMargin), limit)
+	assert.Equal(t, maxNonceAES-335544, limit)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"nonce_safety_margin": 0.5}
+	limit, err = getNonceLimit(c)
+	assert.NoError(t, err)
+	assert.Equal(t, maxNonceAES/2, limit)
+
+	// chachapoly keys may be used for far longer
+	c.Settings["cipher"] = "chachapoly"
+	limit, err = getNonceLimit(c)
+	assert.NoError(t, err)
+	assert.Equal(t, maxNonceChaChaPoly/2, limit)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"nonce_safety_margin": 0}
+	_, err = getNonceLimit(c)
+	assert.EqualError(t, err, "handshakes.nonce_safety_margin must be greater than 0 and less than 1: 0")
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"nonce_safety_margin": 1}
+	_, err = getNonceLimit(c)
+	assert.EqualError(t, err, "handshakes.nonce_safety_margin must be greater than 0 and less than 1: 1")
+}
+
+func TestConnectionManager_nonceRehandshake(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	peerIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+
+	hostMap := NewHostMap(l, nil, vpncidr, nil)
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &cert.NebulaCertificate{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:          hostMap,
+		inside:           &test.NoopTun{},
+		outside:          &udp.NoopConn{},
+		firewall:         &Firewall{},
+		lightHouse:       lh,
+		pki:              &PKI{},
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		l:                l,
+	}
+	ifce.pki.cs.Store(cs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, NewPunchyFromConfig(l, config.NewC(l)))
+	nc.nonceLimit.Store(nonceLimit("aes", 0.01))
+	nc.metricNonceFraction.Update(0)
+	p := []byte("")
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	hostinfo := &HostInfo{
+		vpnIp:         peerIp,
+		localIndexId:  1099,
+		remoteIndexId: 9901,
+	}
+	hostinfo.ConnectionState = &ConnectionState{
+		myCert: &cert.NebulaCertificate{},
+		H:      &noise.HandshakeState{},
+	}
+	nc.hostMap.unlockedAddHostInfo(hostinfo, ifce)
+
+	// A tunnel well below the limit is left alone
+	hostinfo.ConnectionState.messageCounter.Store(maxNonceAES / 2)
+	nc.In(hostinfo.localIndexId)
+	nc.doTrafficCheck(hostinfo.localIndexId, p, nb, out, time.Now())
+	assert.Nil(t, ifce.handshakeManager.QueryVpnIp(peerIp))
+	assert.InDelta(t, 0.5, nc.metricNonceFraction.Value(), 0.0001)
+
+	// Just short of the margin it is still left alone
+	limit := nonceLimit("aes", 0.01)
+	hostinfo.ConnectionState.messageCounter.Store(limit - 1)
+	nc.In(hostinfo.localIndexId)
+	nc.doTrafficCheck(hostinfo.localIndexId, p, nb, out, time.Now())
+	assert.Nil(t, ifce.handshakeManager.QueryVpnIp(peerIp))
+
+	// Once in the margin it is rehandshaked before the key is used past its limit
+	hostinfo.ConnectionState.messageCounter.Store(limit)
+	nc.In(hostinfo.localIndexId)
+	nc.doTrafficCheck(hostinfo.localIndexId, p, nb, out, time.Now())
+	assert.NotNil(t, ifce.handshakeManager.QueryVpnIp(peerIp))
+	assert.InDelta(t, 0.99, nc.metricNonceFraction.Value(), 0.0001)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -32,12 +33,18 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		nb []byte,
 		q int,
 		localCache firewall.ConntrackCache,
+		ecn byte,
 	) {
-		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
+		// Check the underlay source before anything else, packets from filtered addresses get no further work
+		if !f.remoteCIDRFilter.Load().allowed(addr.IP) {
+			return
+		}
+
+		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache, ecn)
 	}
 }
 
-func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache, ecn byte) {
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -52,7 +59,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 	//l.Error("in packet ", header, packet[HeaderLen:])
 	if addr != nil {
 		if ip4 := addr.IP.To4(); ip4 != nil {
-			if ipMaskContains(f.lightHouse.myVpnIp, f.lightHouse.myVpnZeros, iputil.VpnIp(binary.BigEndian.Uint32(ip4))) {
+			if ipMaskContains(f.lightHouse.myVpnIp.Load(), f.lightHouse.myVpnZeros, iputil.VpnIp(binary.BigEndian.Uint32(ip4))) {
 				if f.l.Level >= logrus.DebugLevel {
 					f.l.WithField("udpAddr", addr).Debug("Refusing to process double encrypted packet")
 				}
@@ -69,6 +76,13 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 		hostinfo = f.hostMap.QueryIndex(h.RemoteIndex)
 	}
 
+	var previousKey bool
+	if hostinfo == nil && h.Type == header.Message && h.Subtype == header.MessageNone {
+		// The tunnel may have just been replaced by a new handshake, packets that were in flight can still use its key
+		hostinfo = f.hostMap.QueryPreviousKey(h.RemoteIndex)
+		previousKey = hostinfo != nil
+	}
+
 	var ci *ConnectionState
 	if hostinfo != nil {
 		ci = hostinfo.ConnectionState
@@ -83,10 +97,30 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 
 		switch h.Subtype {
 		case header.MessageNone:
-			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache) {
+			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache, ecn) {
+				return
+			}
+
+			if previousKey {
+				// The tunnel is gone, the packet must not roam or keep it alive
+				f.hostMap.metricPreviousKeyDecrypted.Inc(1)
+				return
+			}
+		case header.MessageFragment:
+			if !f.fragmentToTun(hostinfo, h, out, packet, fwPacket, nb, q, localCache) {
+				return
+			}
+		case header.MessageCompressed:
+			if !f.decompressToTun(hostinfo, h, out, packet, fwPacket, nb, q, localCache) {
 				return
 			}
 		case header.MessageRelay:
+			// Only a sample of the packets we forward are timed, the clock is not read for every packet
+			var received time.Time
+			if f.relayManager.sampleForward(h.MessageCounter) {
+				received = time.Now()
+			}
+
 			// The entire body is sent as AD, not encrypted.
 			// The packet consists of a 16-byte parsed Nebula header, Associated Data-protected payload, and a trailing 16-byte AEAD signature value.
 			// The packet is guaranteed to be at least 16 bytes at this point, b/c it got past the h.Parse() call above. If it's
@@ -118,7 +152,8 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			case TerminalType:
 				// If I am the target of this relay, process the unwrapped packet
 				// From this recursive point, all these variables are 'burned'. We shouldn't rely on them again.
-				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
+				hops := f.relayManager.hopsLeft(h.Reserved, via)
+				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay, relayHops: hops}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache, ecn)
 				return
 			case ForwardingType:
 				// Find the target HostInfo relay object
@@ -132,9 +167,19 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 				if targetRelay.State == Established {
 					switch targetRelay.Type {
 					case ForwardingType:
+						// A packet that loops through relays runs out of hops, drop it instead of amplifying it
+						hops, ok := f.relayManager.forwardHops(h.Reserved, via)
+						if !ok {
+							hostinfo.logger(f.l).
+								WithFields(logrus.Fields{"relayTo": relay.PeerIp, "relayFrom": hostinfo.vpnIp, "maxHops": f.relayManager.getMaxHops()}).
+								Warn("Dropping relayed packet that passed through too many relays, check for a relay loop")
+							return
+						}
+
 						// Forward this packet through the relay tunnel
 						// Find the target HostInfo
-						f.SendVia(targetHI, targetRelay, signedPayload, nb, out, false)
+						f.sendVia(targetHI, targetRelay, signedPayload, nb, out, false, hops)
+						f.relayManager.observeForward(received)
 						return
 					case TerminalType:
 						hostinfo.logger(f.l).Error("Unexpected Relay Type of Terminal")
@@ -189,6 +234,10 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, addr)
 			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+		} else if h.Subtype == header.TestReply {
+			f.rttMetrics.observeTestReply(hostinfo)
+			f.pinger.reply(hostinfo.vpnIp)
+			f.mtuProber.reply(hostinfo.vpnIp, len(d))
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -215,7 +264,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 		hostinfo.logger(f.l).WithField("udpAddr", addr).
 			Info("Close tunnel received, tearing down.")
 
-		f.closeTunnel(hostinfo)
+		f.closeTunnel(hostinfo, "close tunnel received")
 		return
 
 	case header.Control:
@@ -250,12 +299,18 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 	f.connectionManager.In(hostinfo.localIndexId)
 }
 
-// closeTunnel closes a tunnel locally, it does not send a closeTunnel packet to the remote
-func (f *Interface) closeTunnel(hostInfo *HostInfo) {
+// closeTunnel closes a tunnel locally, it does not send a closeTunnel packet to the remote. reason is reported to
+// events.webhook_url and the host map event subscribers if this was the last tunnel to the vpn ip.
+func (f *Interface) closeTunnel(hostInfo *HostInfo, reason string) {
 	final := f.hostMap.DeleteHostInfo(hostInfo)
 	if final {
 		// We no longer have any tunnels with this vpn ip, clear learned lighthouse state to lower memory usage
 		f.lightHouse.DeleteVpnIp(hostInfo.vpnIp)
+		f.tunnelLifetime.tornDown(hostInfo, time.Now())
+		f.rttMetrics.forget(hostInfo.vpnIp)
+		f.events.tunnelDown(hostInfo, reason)
+		f.eventStream.tunnelDown(hostInfo, reason)
+		f.keepWarm.dropped(hostInfo.vpnIp)
 	}
 }
 
@@ -266,6 +321,13 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udp.Addr) {
 	if addr != nil && !hostinfo.remote.Equals(addr) {
+		if !f.roaming.Load() {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
+					Debug("handshakes.roaming is disabled, ignoring roam")
+			}
+			return
+		}
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, addr.IP) {
 			hostinfo.logger(f.l).WithField("newAddr", addr).Debug("lighthouse.remote_allow_list denied roaming")
 			return
@@ -280,9 +342,15 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udp.Addr) {
 
 		hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
 			Info("Host roamed to new udp ip/port.")
+		if hostinfo.remote == nil && hostinfo.autoRelayed {
+			// A hole punch made it through, the tunnel moves off the relay relay.auto picked
+			f.metricAutoRelayUps.Inc(1)
+		}
 		hostinfo.lastRoam = time.Now()
 		hostinfo.lastRoamRemote = hostinfo.remote
 		hostinfo.SetRemote(addr)
+		f.metricRoams.Inc(1)
+		f.eventStream.endpointChanged(hostinfo, "roamed")
 	}
 
 }
@@ -309,11 +377,19 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 		return fmt.Errorf("packet is less than %v bytes", ipv4.HeaderLen)
 	}
 
-	// Is it an ipv4 packet?
-	if int((data[0]>>4)&0x0f) != 4 {
-		return fmt.Errorf("packet is not ipv4, type: %v", int((data[0]>>4)&0x0f))
+	// Which ip version is it?
+	switch int((data[0] >> 4) & 0x0f) {
+	case 4:
+	case 6:
+		return newPacket6(data, incoming, fp)
+	default:
+		return fmt.Errorf("packet is not ipv4 or ipv6, type: %v", int((data[0]>>4)&0x0f))
 	}
 
+	fp.IPv6 = false
+	fp.LocalIP6 = [16]byte{}
+	fp.RemoteIP6 = [16]byte{}
+
 	// Adjust our start position based on the advertised ip header length
 	ihl := int(data[0]&0x0f) << 2
 
@@ -364,6 +440,78 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 	return nil
 }
 
+// newPacket6 is newPacket for ipv6, extension headers are walked to find the upper layer protocol
+func newPacket6(data []byte, incoming bool, fp *firewall.Packet) error {
+	if len(data) < ipv6.HeaderLen {
+		return fmt.Errorf("packet is less than %v bytes", ipv6.HeaderLen)
+	}
+
+	fp.IPv6 = true
+	fp.LocalIP = 0
+	fp.RemoteIP = 0
+	fp.Fragment = false
+
+	proto := data[6]
+	offset := ipv6.HeaderLen
+
+walk:
+	for {
+		switch proto {
+		case 0, 43, 60: // hop-by-hop options, routing, destination options
+			if len(data) < offset+8 {
+				return fmt.Errorf("packet is too short for ipv6 extension header %v", proto)
+			}
+			proto = data[offset]
+			offset += (int(data[offset+1]) + 1) * 8
+
+		case 44: // fragment
+			if len(data) < offset+8 {
+				return fmt.Errorf("packet is too short for ipv6 extension header %v", proto)
+			}
+			proto = data[offset]
+			// Only the first fragment has the upper layer header
+			fp.Fragment = fp.Fragment || binary.BigEndian.Uint16(data[offset+2:offset+4])&0xfff8 != 0
+			offset += 8
+
+		default:
+			break walk
+		}
+	}
+
+	// Firewall handles protocol checks
+	fp.Protocol = proto
+
+	noPorts := fp.Fragment || proto == firewall.ProtoICMPv6
+	minLen := offset
+	if !noPorts {
+		minLen += minFwPacketLen
+	}
+	if len(data) < minLen {
+		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, offset)
+	}
+
+	// Firewall packets are locally oriented
+	src, dst := &fp.RemoteIP6, &fp.LocalIP6
+	if !incoming {
+		src, dst = dst, src
+	}
+	copy(src[:], data[8:24])
+	copy(dst[:], data[24:40])
+
+	if noPorts {
+		fp.RemotePort = 0
+		fp.LocalPort = 0
+	} else if incoming {
+		fp.RemotePort = binary.BigEndian.Uint16(data[offset : offset+2])
+		fp.LocalPort = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	} else {
+		fp.LocalPort = binary.BigEndian.Uint16(data[offset : offset+2])
+		fp.RemotePort = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	}
+
+	return nil
+}
+
 func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []byte, h *header.H, nb []byte) ([]byte, error) {
 	var err error
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], mc, nb)
@@ -380,7 +528,7 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
-func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache, ecn byte) bool {
 	var err error
 
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
@@ -404,7 +552,19 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
-	dropReason := f.firewall.Drop(out, *fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	if f.reflectECN.Load() {
+		iputil.DecapsulateECN(out, ecn)
+	}
+
+	return f.firewallToTun(hostinfo, out, fwPacket, nb, q, localCache)
+}
+
+// firewallToTun writes a decrypted and validated inbound packet to the tun device if the firewall allows it
+func (f *Interface) firewallToTun(hostinfo *HostInfo, out []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+	dropReason := f.checkReversePath(hostinfo, fwPacket)
+	if dropReason == nil {
+		dropReason = f.firewall.Drop(out, *fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	}
 	if dropReason != nil {
 		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, out, q)
 		if f.l.Level >= logrus.DebugLevel {
@@ -415,14 +575,109 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
+	if !f.inspect(hostinfo.vpnIp, true, out) {
+		return false
+	}
+
 	f.connectionManager.In(hostinfo.localIndexId)
-	_, err = f.readers[q].Write(out)
+	if f.routingTTL.Load() && (fwPacket.IPv6 || fwPacket.LocalIP != f.myVpnIp.Load()) && iputil.DecrementTTL(out) {
+		// We are routing this packet to an unsafe network and it ran out of hops
+		f.sendTimeExceeded(out, hostinfo, nb, q)
+		return true
+	}
+
+	_, err := f.readers[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
 	}
 	return true
 }
 
+// checkReversePath makes sure a packet we are about to forward to an unsafe network would have its return traffic
+// routed through the tunnel it arrived on, using the hostmap for vpn ips and the unsafe routes for everything else.
+// It only applies when firewall.rpf is enabled, packets for our own vpn ip are not forwarded and never checked.
+func (f *Interface) checkReversePath(hostinfo *HostInfo, fp *firewall.Packet) error {
+	fw := f.firewall
+	if !fw.rpf || fp.IPv6 || fp.LocalIP == f.myVpnIp.Load() {
+		return nil
+	}
+
+	via := fp.RemoteIP
+	if !f.hostMap.vpnCIDRContains(fp.RemoteIP) {
+		via = f.inside.RouteFor(fp.RemoteIP)
+	}
+
+	if via != hostinfo.vpnIp {
+		fw.incomingMetrics.droppedRPF.Inc(1)
+		return ErrReversePath
+	}
+
+	return nil
+}
+
+// fragmentToTun decrypts a fragment and, once every fragment of the packet has arrived, writes the reassembled packet
+// to the tun device.
+func (f *Interface) fragmentToTun(hostinfo *HostInfo, h *header.H, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+	if f.fragmenter == nil {
+		hostinfo.logger(f.l).Debugln("dropping fragment, tun.fragment is not enabled")
+		return false
+	}
+
+	out, err := f.decrypt(hostinfo, h.MessageCounter, out, packet, h, nb)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt fragment")
+		return false
+	}
+
+	out = f.fragmenter.reassemble(hostinfo.localIndexId, out, out)
+	if out == nil {
+		// Waiting on more fragments, the fragment itself was authentic
+		return true
+	}
+
+	err = newPacket(out, true, fwPacket)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).WithField("packet", out).
+			Warnf("Error while validating inbound packet")
+		return false
+	}
+
+	return f.firewallToTun(hostinfo, out, fwPacket, nb, q, localCache)
+}
+
+// decompressToTun decrypts and decompresses a packet from a tunnel that negotiated compression and writes it to the
+// tun device.
+func (f *Interface) decompressToTun(hostinfo *HostInfo, h *header.H, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+	if hostinfo.ConnectionState.compression == compressionNone {
+		hostinfo.logger(f.l).Debugln("dropping compressed packet, compression was not negotiated")
+		return false
+	}
+
+	out, err := f.decrypt(hostinfo, h.MessageCounter, out, packet, h, nb)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt compressed packet")
+		return false
+	}
+
+	ok := false
+	err = f.compressor.decompress(out, func(p []byte) {
+		err := newPacket(p, true, fwPacket)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).WithField("packet", p).
+				Warnf("Error while validating inbound packet")
+			return
+		}
+
+		ok = f.firewallToTun(hostinfo, p, fwPacket, nb, q, localCache)
+	})
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Error("Failed to decompress packet")
+		return false
+	}
+
+	return ok
+}
+
 func (f *Interface) maybeSendRecvError(endpoint *udp.Addr, index uint32) {
 	if f.sendRecvErrorConfig.ShouldSendRecvError(endpoint.IP) {
 		f.sendRecvError(endpoint, index)
@@ -464,7 +719,7 @@ func (f *Interface) handleRecvError(addr *udp.Addr, h *header.H) {
 		return
 	}
 
-	f.closeTunnel(hostinfo)
+	f.closeTunnel(hostinfo, "recv errors exceeded")
 	// We also delete it from pending hostmap to allow for fast reconnect.
 	f.handshakeManager.DeleteHostInfo(hostinfo)
 }
@@ -491,42 +746,58 @@ func (f *Interface) sendMeta(ci *ConnectionState, endpoint *net.UDPAddr, meta *N
 }
 */
 
-func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, error) {
+// RecombineCertAndValidate rebuilds the peer certificate with the static key from the handshake and verifies it against
+// the CAs in pki, with pki.ca_expiry applied. rawChain is the intermediate CAs the peer sent along with it, they are
+// returned so the certificate can be verified again later.
+func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, rawChain [][]byte, pki *PKI) (*cert.NebulaCertificate, []*cert.NebulaCertificate, error) {
 	pk := h.PeerStatic()
 
 	if pk == nil {
-		return nil, errors.New("no peer static key was present")
+		return nil, nil, errors.New("no peer static key was present")
 	}
 
 	if rawCertBytes == nil {
-		return nil, errors.New("provided payload was empty")
+		return nil, nil, errors.New("provided payload was empty")
 	}
 
 	r := &cert.RawNebulaCertificate{}
 	err := proto.Unmarshal(rawCertBytes, r)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling cert: %s", err)
+		return nil, nil, fmt.Errorf("error unmarshaling cert: %s", err)
 	}
 
 	// If the Details are nil, just exit to avoid crashing
 	if r.Details == nil {
-		return nil, fmt.Errorf("certificate did not contain any details")
+		return nil, nil, fmt.Errorf("certificate did not contain any details")
 	}
 
 	r.Details.PublicKey = pk
 	recombined, err := proto.Marshal(r)
 	if err != nil {
-		return nil, fmt.Errorf("error while recombining certificate: %s", err)
+		return nil, nil, fmt.Errorf("error while recombining certificate: %s", err)
+	}
+
+	if len(rawChain) > cert.MaxIntermediates {
+		return nil, nil, fmt.Errorf("certificate chain had %v intermediates, no more than %v are allowed", len(rawChain), cert.MaxIntermediates)
+	}
+
+	var chain []*cert.NebulaCertificate
+	for _, raw := range rawChain {
+		c, err := cert.UnmarshalNebulaCertificate(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling intermediate ca: %s", err)
+		}
+		chain = append(chain, c)
 	}
 
 	c, _ := cert.UnmarshalNebulaCertificate(recombined)
-	isValid, err := c.Verify(time.Now(), caPool)
+	isValid, err := pki.VerifyCert(c, pki.GetCAPool().WithIntermediates(chain), time.Now(), false)
 	if err != nil {
-		return c, fmt.Errorf("certificate validation failed: %s", err)
+		return c, nil, fmt.Errorf("certificate validation failed: %s", err)
 	} else if !isValid {
 		// This case should never happen but here's to defensive programming!
-		return c, errors.New("certificate validation failed but did not return an error")
+		return c, nil, errors.New("certificate validation failed but did not return an error")
 	}
 
-	return c, nil
+	return c, chain, nil
 }
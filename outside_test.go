@@ -3,9 +3,16 @@ package nebula
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/ipv4"
 )
@@ -33,7 +40,7 @@ func Test_newPacket(t *testing.T) {
 
 	// not an ipv4 packet
 	err = newPacket([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
-	assert.EqualError(t, err, "packet is not ipv4, type: 0")
+	assert.EqualError(t, err, "packet is not ipv4 or ipv6, type: 0")
 
 	// invalid ihl
 	err = newPacket([]byte{4<<4 | (8 >> 2 & 0x0f), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
@@ -81,3 +88,194 @@ func Test_newPacket(t *testing.T) {
 	assert.Equal(t, p.RemotePort, uint16(6))
 	assert.Equal(t, p.LocalPort, uint16(5))
 }
+
+func Test_newPacket6(t *testing.T) {
+	p := &firewall.Packet{}
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+
+	hdr := func(next uint8, ext ...byte) []byte {
+		b := make([]byte, 40, 40+len(ext)+4)
+		b[0] = 6 << 4
+		b[6] = next
+		copy(b[8:24], src)
+		copy(b[24:40], dst)
+		return append(b, ext...)
+	}
+
+	// length fail
+	err := newPacket(hdr(firewall.ProtoTCP)[:30], true, p)
+	assert.EqualError(t, err, "packet is less than 40 bytes")
+
+	err = newPacket(hdr(firewall.ProtoTCP), true, p)
+	assert.EqualError(t, err, "packet is less than 44 bytes, ip header len: 40")
+
+	// incoming tcp
+	err = newPacket(append(hdr(firewall.ProtoTCP), 0, 3, 0, 4), true, p)
+	assert.Nil(t, err)
+	assert.True(t, p.IPv6)
+	assert.Equal(t, uint8(firewall.ProtoTCP), p.Protocol)
+	assert.Equal(t, dst, p.LocalAddr())
+	assert.Equal(t, src, p.RemoteAddr())
+	assert.Equal(t, iputil.VpnIp(0), p.LocalIP)
+	assert.Equal(t, uint16(3), p.RemotePort)
+	assert.Equal(t, uint16(4), p.LocalPort)
+
+	// outgoing udp behind a hop-by-hop and a destination options header
+	ext := []byte{60, 0, 0, 0, 0, 0, 0, 0, firewall.ProtoUDP, 1}
+	ext = append(ext, make([]byte, 14)...)
+	err = newPacket(append(hdr(0, ext...), 0, 5, 0, 6), false, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoUDP), p.Protocol)
+	assert.Equal(t, src, p.LocalAddr())
+	assert.Equal(t, dst, p.RemoteAddr())
+	assert.Equal(t, uint16(5), p.LocalPort)
+	assert.Equal(t, uint16(6), p.RemotePort)
+	assert.False(t, p.Fragment)
+
+	// truncated extension header
+	err = newPacket(hdr(43, 0, 0), true, p)
+	assert.EqualError(t, err, "packet is too short for ipv6 extension header 43")
+
+	// icmpv6 has no ports
+	err = newPacket(hdr(firewall.ProtoICMPv6), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(firewall.ProtoICMPv6), p.Protocol)
+	assert.Equal(t, uint16(0), p.LocalPort)
+	assert.Equal(t, uint16(0), p.RemotePort)
+
+	// a later fragment has no ports
+	err = newPacket(hdr(44, firewall.ProtoTCP, 0, 0, 8, 0, 0, 0, 1), true, p)
+	assert.Nil(t, err)
+	assert.True(t, p.Fragment)
+	assert.Equal(t, uint8(firewall.ProtoTCP), p.Protocol)
+	assert.Equal(t, uint16(0), p.LocalPort)
+
+	// an ipv4 packet after an ipv6 packet clears the ipv6 fields
+	h := ipv4.Header{
+		Version:  1,
+		Len:      20,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: firewall.ProtoTCP,
+	}
+	b, _ := h.Marshal()
+	err = newPacket(append(b, 0, 3, 0, 4), true, p)
+	assert.Nil(t, err)
+	assert.False(t, p.IPv6)
+	assert.Equal(t, [16]byte{}, p.LocalIP6)
+	assert.Equal(t, [16]byte{}, p.RemoteIP6)
+}
+
+func Test_handleHostRoaming(t *testing.T) {
+	l := test.NewLogger()
+	lh := &LightHouse{}
+	lh.remoteAllowList.Store(&RemoteAllowList{})
+
+	f := &Interface{
+		lightHouse:  lh,
+		metricRoams: metrics.NewCounter(),
+		l:           l,
+	}
+	f.roaming.Store(true)
+
+	first := udp.NewAddr(net.IPv4(1, 1, 1, 1), 4242)
+	second := udp.NewAddr(net.IPv4(2, 2, 2, 2), 4242)
+	hostinfo := &HostInfo{
+		vpnIp:   iputil.Ip2VpnIp(net.IPv4(10, 0, 0, 2)),
+		remotes: NewRemoteList(nil),
+	}
+	hostinfo.SetRemote(first)
+
+	// Same address, nothing to do
+	f.handleHostRoaming(hostinfo, first)
+	assert.True(t, hostinfo.remote.Equals(first))
+	assert.Equal(t, int64(0), f.metricRoams.Count())
+
+	// The peer switched source addresses mid session
+	f.handleHostRoaming(hostinfo, second)
+	assert.True(t, hostinfo.remote.Equals(second))
+	assert.True(t, hostinfo.lastRoamRemote.Equals(first))
+	assert.Equal(t, int64(1), f.metricRoams.Count())
+
+	// Roaming straight back is suppressed to avoid flapping
+	f.handleHostRoaming(hostinfo, first)
+	assert.True(t, hostinfo.remote.Equals(second))
+	assert.Equal(t, int64(1), f.metricRoams.Count())
+
+	// Once the suppression window is over we may roam back
+	hostinfo.lastRoam = time.Now().Add(-RoamingSuppressSeconds * time.Second)
+	f.handleHostRoaming(hostinfo, first)
+	assert.True(t, hostinfo.remote.Equals(first))
+	assert.Equal(t, int64(2), f.metricRoams.Count())
+
+	// Relayed packets have no address
+	f.handleHostRoaming(hostinfo, nil)
+	assert.True(t, hostinfo.remote.Equals(first))
+
+	// Disabled roaming leaves the remote alone
+	f.roaming.Store(false)
+	f.handleHostRoaming(hostinfo, second)
+	assert.True(t, hostinfo.remote.Equals(first))
+	assert.Equal(t, int64(2), f.metricRoams.Count())
+}
+
+func Test_checkReversePath(t *testing.T) {
+	l := test.NewLogger()
+	_, vpnNet, _ := net.ParseCIDR("10.128.0.0/24")
+	myIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 1))
+	peerIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 2))
+	otherIp := iputil.Ip2VpnIp(net.IPv4(10, 128, 0, 3))
+
+	// The peer is the gateway for 192.168.1.0/24, the other host for 192.168.2.0/24
+	routes := cidr.NewTree4[iputil.VpnIp]()
+	_, peerNet, _ := net.ParseCIDR("192.168.1.0/24")
+	routes.AddCIDR(peerNet, peerIp)
+	_, otherNet, _ := net.ParseCIDR("192.168.2.0/24")
+	routes.AddCIDR(otherNet, otherIp)
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"rpf": true}
+	fw, err := NewFirewallFromConfig(l, &cert.NebulaCertificate{}, conf)
+	assert.NoError(t, err)
+	assert.True(t, fw.rpf)
+
+	f := &Interface{
+		hostMap:  NewHostMap(l, nil, vpnNet, nil),
+		inside:   &simulateTestDevice{routes: routes},
+		firewall: fw,
+	}
+	f.myVpnIp.Store(myIp)
+	hostinfo := &HostInfo{vpnIp: peerIp}
+	dropped := fw.incomingMetrics.droppedRPF.Count()
+
+	forwarded := func(src net.IP) *firewall.Packet {
+		return &firewall.Packet{
+			LocalIP:  iputil.Ip2VpnIp(net.IPv4(172, 16, 0, 1)),
+			RemoteIP: iputil.Ip2VpnIp(src),
+		}
+	}
+
+	// Packets for us are never checked
+	assert.NoError(t, f.checkReversePath(hostinfo, &firewall.Packet{LocalIP: myIp, RemoteIP: otherIp}))
+
+	// Sources that route back through the peer pass
+	assert.NoError(t, f.checkReversePath(hostinfo, forwarded(peerIp.ToIP())))
+	assert.NoError(t, f.checkReversePath(hostinfo, forwarded(net.IPv4(192, 168, 1, 10))))
+
+	// A spoofed source that belongs to another host, its network or nothing we route to fails
+	assert.ErrorIs(t, f.checkReversePath(hostinfo, forwarded(otherIp.ToIP())), ErrReversePath)
+	assert.ErrorIs(t, f.checkReversePath(hostinfo, forwarded(net.IPv4(192, 168, 2, 10))), ErrReversePath)
+	assert.ErrorIs(t, f.checkReversePath(hostinfo, forwarded(net.IPv4(8, 8, 8, 8))), ErrReversePath)
+	assert.Equal(t, int64(3), fw.incomingMetrics.droppedRPF.Count()-dropped)
+
+	// The check runs for every forwarded packet and must not allocate
+	fp := forwarded(net.IPv4(192, 168, 1, 10))
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		_ = f.checkReversePath(hostinfo, fp)
+	}))
+
+	// Nothing is checked when rpf is off
+	fw.rpf = false
+	assert.NoError(t, f.checkReversePath(hostinfo, forwarded(otherIp.ToIP())))
+}
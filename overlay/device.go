@@ -15,3 +15,50 @@ type Device interface {
 	RouteFor(iputil.VpnIp) iputil.VpnIp
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
+
+// RouteTagger is implemented by devices that support the tag on tun.unsafe_routes entries
+type RouteTagger interface {
+	// RouteTagFor returns the via for ip, the same as RouteFor, along with the tag of the route that matched. The tag is
+	// empty if the route has none.
+	RouteTagFor(iputil.VpnIp) (iputil.VpnIp, string)
+}
+
+// RouteMatcher is implemented by devices that support on_unreachable on tun.unsafe_routes entries
+type RouteMatcher interface {
+	// RoutesFor returns the unsafe route RouteFor used for ip followed by every less specific one that matches ip
+	RoutesFor(iputil.VpnIp) []RouteMatch
+}
+
+// Route6Tagger is implemented by devices that route ipv6 traffic over tun.unsafe_routes
+type Route6Tagger interface {
+	// RouteTagFor6 returns the via and the tag of the unsafe route that matches the ipv6 address ip, the via is 0 if
+	// no route matches
+	RouteTagFor6(ip [16]byte) (iputil.VpnIp, string)
+}
+
+// MTURefresher is implemented by devices that can re-read their mtu after it was changed outside of nebula
+type MTURefresher interface {
+	RefreshMTU() (int, error)
+}
+
+// MTUSetter is implemented by devices that can change their mtu while running, routes without their own mtu follow it
+type MTUSetter interface {
+	SetMTU(mtu int) error
+}
+
+// RouteLister is implemented by devices that can report the routes they are currently using
+type RouteLister interface {
+	ListRoutes() []Route
+}
+
+// Recreator is implemented by devices that can be torn down and opened again after they stopped working
+type Recreator interface {
+	// Recreate closes the device and opens it again with its address and routes. It returns the device and queues-1
+	// multiqueue readers to use in place of the old ones.
+	Recreate(queues int) ([]io.ReadWriteCloser, error)
+}
+
+// CidrSetter is implemented by devices that can move to a new address in the same network while running
+type CidrSetter interface {
+	SetCidr(cidr *net.IPNet) error
+}
@@ -0,0 +1,157 @@
+package overlay
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// IPRule is a policy routing rule that directs matching traffic into a routing table, usually tun.route_table
+type IPRule struct {
+	Priority int
+	From     *net.IPNet
+	To       *net.IPNet
+	FwMark   int
+	FwMask   int
+	Table    int
+}
+
+func parseIPRules(c *config.C, routeTable int) ([]IPRule, error) {
+	r := c.Get("tun.ip_rules")
+	if r == nil {
+		return []IPRule{}, nil
+	}
+
+	rawRules, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tun.ip_rules is not an array")
+	}
+
+	rules := make([]IPRule, len(rawRules))
+	priorities := map[int]int{}
+	for i, r := range rawRules {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %v in tun.ip_rules is invalid", i+1)
+		}
+
+		rule := IPRule{Table: routeTable}
+
+		rPriority, ok := m["priority"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.priority in tun.ip_rules is not present", i+1)
+		}
+
+		priority, ok := rPriority.(int)
+		if !ok {
+			return nil, fmt.Errorf("entry %v.priority in tun.ip_rules is not an integer: %v", i+1, rPriority)
+		}
+
+		// Priority 0 is reserved for the local table lookup
+		if priority < 1 || int64(priority) > math.MaxUint32 {
+			return nil, fmt.Errorf("entry %v.priority in tun.ip_rules is out of range: %v", i+1, priority)
+		}
+
+		if other, ok := priorities[priority]; ok {
+			return nil, fmt.Errorf("entry %v.priority in tun.ip_rules conflicts with entry %v: %v", i+1, other, priority)
+		}
+		priorities[priority] = i + 1
+		rule.Priority = priority
+
+		var err error
+		rule.From, err = parseIPRuleCIDR(m, "from", i)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.To, err = parseIPRuleCIDR(m, "to", i)
+		if err != nil {
+			return nil, err
+		}
+
+		if rMark, ok := m["fwmark"]; ok {
+			rule.FwMark, rule.FwMask, err = parseFwMark(rMark)
+			if err != nil {
+				return nil, fmt.Errorf("entry %v.fwmark in tun.ip_rules is invalid: %s", i+1, err)
+			}
+		}
+
+		if rule.From == nil && rule.To == nil && rule.FwMark == 0 {
+			return nil, fmt.Errorf("entry %v in tun.ip_rules must have at least one of from, to, or fwmark", i+1)
+		}
+
+		if rTable, ok := m["table"]; ok {
+			switch v := rTable.(type) {
+			case int:
+				rule.Table = v
+			case string:
+				rule.Table, err = lookupRouteTable(v)
+				if err != nil {
+					return nil, fmt.Errorf("entry %v.table in tun.ip_rules is invalid: %s", i+1, err)
+				}
+			default:
+				return nil, fmt.Errorf("entry %v.table in tun.ip_rules must be an integer or a table name: %v", i+1, rTable)
+			}
+
+			if rule.Table < 1 || int64(rule.Table) > math.MaxUint32 {
+				return nil, fmt.Errorf("entry %v.table in tun.ip_rules is out of range: %v", i+1, rule.Table)
+			}
+		}
+
+		rules[i] = rule
+	}
+
+	return rules, nil
+}
+
+func parseIPRuleCIDR(m map[interface{}]interface{}, key string, i int) (*net.IPNet, error) {
+	r, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+
+	_, n, err := net.ParseCIDR(fmt.Sprintf("%v", r))
+	if err != nil {
+		return nil, fmt.Errorf("entry %v.%s in tun.ip_rules failed to parse: %v", i+1, key, err)
+	}
+
+	if n.IP.To4() == nil {
+		return nil, fmt.Errorf("entry %v.%s in tun.ip_rules is not an ipv4 network: %v", i+1, key, n)
+	}
+
+	return n, nil
+}
+
+// parseFwMark accepts a mark as an integer or as a string in the `ip rule` style of mark or mark/mask
+func parseFwMark(r interface{}) (int, int, error) {
+	switch v := r.(type) {
+	case int:
+		if v < 1 || int64(v) > math.MaxUint32 {
+			return 0, 0, fmt.Errorf("out of range: %v", v)
+		}
+		return v, 0, nil
+
+	case string:
+		markStr, maskStr, hasMask := strings.Cut(v, "/")
+		mark, err := strconv.ParseUint(markStr, 0, 32)
+		if err != nil || mark == 0 {
+			return 0, 0, fmt.Errorf("could not parse mark: %v", markStr)
+		}
+
+		var mask uint64
+		if hasMask {
+			mask, err = strconv.ParseUint(maskStr, 0, 32)
+			if err != nil || mask == 0 {
+				return 0, 0, fmt.Errorf("could not parse mask: %v", maskStr)
+			}
+		}
+
+		return int(mark), int(mask), nil
+	}
+
+	return 0, 0, fmt.Errorf("must be an integer or a string: %v", r)
+}
@@ -0,0 +1,95 @@
+package overlay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseIPRules(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// test no rules config
+	rules, err := parseIPRules(c, 100)
+	assert.Nil(t, err)
+	assert.Len(t, rules, 0)
+
+	// not an array
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": "hi"}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "tun.ip_rules is not an array")
+
+	// weird rule
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{"asdf"}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1 in tun.ip_rules is invalid")
+
+	// no priority
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1.priority in tun.ip_rules is not present")
+
+	// bad priority
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 0}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1.priority in tun.ip_rules is out of range: 0")
+
+	// no selector
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 100}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1 in tun.ip_rules must have at least one of from, to, or fwmark")
+
+	// bad from
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 100, "from": "nope"}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1.from in tun.ip_rules failed to parse: invalid CIDR address: nope")
+
+	// ipv6 to
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 100, "to": "fd00::/8"}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1.to in tun.ip_rules is not an ipv4 network: fd00::/8")
+
+	// bad fwmark
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 100, "fwmark": "0x1/zz"}}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 1.fwmark in tun.ip_rules is invalid: could not parse mask: zz")
+
+	// conflicting priorities
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{
+		map[interface{}]interface{}{"priority": 100, "fwmark": 1},
+		map[interface{}]interface{}{"priority": 100, "from": "10.0.0.0/8"},
+	}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, rules)
+	assert.EqualError(t, err, "entry 2.priority in tun.ip_rules conflicts with entry 1: 100")
+
+	// happy case
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{
+		map[interface{}]interface{}{"priority": 100, "fwmark": "0x10/0xff"},
+		map[interface{}]interface{}{"priority": 101, "from": "10.0.0.0/8", "to": "172.16.0.0/12", "table": 200},
+		map[interface{}]interface{}{"priority": 102, "fwmark": 3, "table": "main"},
+	}}
+	rules, err = parseIPRules(c, 100)
+	assert.Nil(t, err)
+	assert.Len(t, rules, 3)
+
+	assert.Equal(t, IPRule{Priority: 100, FwMark: 0x10, FwMask: 0xff, Table: 100}, rules[0])
+
+	_, from, _ := net.ParseCIDR("10.0.0.0/8")
+	_, to, _ := net.ParseCIDR("172.16.0.0/12")
+	assert.Equal(t, IPRule{Priority: 101, From: from, To: to, Table: 200}, rules[1])
+
+	assert.Equal(t, IPRule{Priority: 102, FwMark: 3, Table: RouteTableMain}, rules[2])
+}
@@ -1,11 +1,15 @@
 package overlay
 
 import (
+	"bufio"
 	"fmt"
 	"math"
 	"net"
+	"os"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cidr"
@@ -19,25 +23,316 @@ type Route struct {
 	Cidr    *net.IPNet
 	Via     *iputil.VpnIp
 	Install bool
+	Tag     string
+	// Src is the preferred source address of the installed route, nil lets the kernel pick
+	Src net.IP
+	// OnUnreachable is what happens to traffic for the route while its via is unreachable
+	OnUnreachable OnUnreachable
 }
 
-func makeRouteTree(l *logrus.Logger, routes []Route, allowMTU bool) (*cidr.Tree4[iputil.VpnIp], error) {
-	routeTree := cidr.NewTree4[iputil.VpnIp]()
-	for _, r := range routes {
+// OnUnreachable is what happens to traffic for an unsafe route while its via is unreachable, the last handshake with
+// the via timed out and no tunnel was made since
+type OnUnreachable int
+
+const (
+	// OnUnreachableDrop keeps trying to handshake with the via, the traffic is dropped when the handshake times out
+	OnUnreachableDrop OnUnreachable = iota
+	// OnUnreachableReject answers the source with an ICMP host unreachable
+	OnUnreachableReject
+	// OnUnreachableNext sends the traffic over the next less specific unsafe route that matches it
+	OnUnreachableNext
+)
+
+func (o OnUnreachable) String() string {
+	switch o {
+	case OnUnreachableDrop:
+		return "drop"
+	case OnUnreachableReject:
+		return "reject"
+	case OnUnreachableNext:
+		return "next"
+	default:
+		return fmt.Sprintf("OnUnreachable(%d)", int(o))
+	}
+}
+
+// RouteMatch is an unsafe route that matched an address
+type RouteMatch struct {
+	Via           iputil.VpnIp
+	Tag           string
+	OnUnreachable OnUnreachable
+}
+
+// routeTarget is what a route in a route tree points at, the via and the tag of the route. next is the most specific
+// route that contains this one, nil if there is none.
+type routeTarget struct {
+	via           iputil.VpnIp
+	tag           string
+	onUnreachable OnUnreachable
+	next          *routeTarget
+}
+
+// routeMatches returns the route in routeTree that matches ip followed by every less specific route that matches it
+func routeMatches(routeTree *cidr.RouteTree[routeTarget], ip iputil.VpnIp) []RouteMatch {
+	ok, r := routeTree.MostSpecificContains(ip)
+	if !ok {
+		return nil
+	}
+
+	matches := []RouteMatch{{Via: r.via, Tag: r.tag, OnUnreachable: r.onUnreachable}}
+	for n := r.next; n != nil; n = n.next {
+		matches = append(matches, RouteMatch{Via: n.via, Tag: n.tag, OnUnreachable: n.onUnreachable})
+	}
+	return matches
+}
+
+// routeTagFor6 returns the via and the tag of the route in routeTree that matches the ipv6 address ip
+func routeTagFor6(routeTree *cidr.RouteTree[routeTarget], ip [16]byte) (iputil.VpnIp, string) {
+	_, r := routeTree.MostSpecificContainsIP6(ip)
+	return r.via, r.tag
+}
+
+// isIPv6Route returns true if r routes ipv6 traffic
+func isIPv6Route(r Route) bool {
+	return r.Cidr != nil && len(r.Cidr.Mask) != net.IPv4len
+}
+
+// RouteTableMain is the linux main routing table, where routes are installed unless tun.route_table says otherwise
+const RouteTableMain = 254
+
+// rtTablesPath is where iproute2 keeps the routing table name to id mappings
+var rtTablesPath = "/etc/iproute2/rt_tables"
+
+// parseRouteTable returns the routing table id from tun.route_table, which may be an id or a name from rt_tables
+func parseRouteTable(c *config.C) (int, error) {
+	r := c.Get("tun.route_table")
+	if r == nil {
+		return RouteTableMain, nil
+	}
+
+	var table int
+	switch v := r.(type) {
+	case int:
+		table = v
+	case string:
+		var err error
+		table, err = lookupRouteTable(v)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("tun.route_table must be an integer or a table name, got: %v", r)
+	}
+
+	if table < 1 || int64(table) > math.MaxUint32 {
+		return 0, fmt.Errorf("tun.route_table %v is out of range", table)
+	}
+
+	return table, nil
+}
+
+// lookupRouteTable resolves a routing table name or id using the same names as `ip route`
+func lookupRouteTable(name string) (int, error) {
+	switch name {
+	case "main":
+		return RouteTableMain, nil
+	case "default":
+		return 253, nil
+	case "local":
+		return 255, nil
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	f, err := os.Open(rtTablesPath)
+	if err != nil {
+		return 0, fmt.Errorf("tun.route_table %s could not be resolved: %s", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != name {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("tun.route_table %s has an invalid id in %s: %s", name, rtTablesPath, fields[0])
+		}
+		return id, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("tun.route_table %s could not be resolved: %s", name, err)
+	}
+
+	return 0, fmt.Errorf("tun.route_table %s was not found in %s", name, rtTablesPath)
+}
+
+func makeRouteTree(l *logrus.Logger, routes []Route, allowMTU bool) (*cidr.RouteTree[routeTarget], error) {
+	routeTree := cidr.NewRouteTree[routeTarget]()
+	targets := make([]*routeTarget, len(routes))
+	for i, r := range routes {
 		if !allowMTU && r.MTU > 0 {
 			l.WithField("route", r).Warnf("route MTU is not supported in %s", runtime.GOOS)
 		}
 
+		if !allowMTU && r.Src != nil {
+			l.WithField("route", r).Warnf("route src is not supported in %s", runtime.GOOS)
+		}
+
 		if r.Via != nil {
-			routeTree.AddCIDR(r.Cidr, *r.Via)
+			targets[i] = &routeTarget{via: *r.Via, tag: r.Tag, onUnreachable: r.OnUnreachable}
+		}
+	}
+
+	// Link every route to the most specific one containing it, which is the next match for any address it matches.
+	// A later route replaces an earlier one with the same cidr in the tree so it wins here too.
+	for i, t := range targets {
+		if t == nil {
+			continue
+		}
+
+		ones, _ := routes[i].Cidr.Mask.Size()
+		nextOnes := -1
+		for j, o := range targets {
+			if o == nil {
+				continue
+			}
+
+			oOnes, _ := routes[j].Cidr.Mask.Size()
+			if oOnes < ones && oOnes >= nextOnes && routes[j].Cidr.Contains(routes[i].Cidr.IP) {
+				t.next = o
+				nextOnes = oOnes
+			}
+		}
+	}
+
+	for i, t := range targets {
+		if t != nil {
+			routeTree.AddCIDR(routes[i].Cidr, *t)
 		}
 	}
 	return routeTree, nil
 }
 
-func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
-	var err error
+// routeOverlaps returns a warning for every entry in unsafeRoutes that overlaps the vpn network or an entry in routes.
+// Traffic for the vpn network, and so for every entry in routes, is always sent straight to the vpn ip it is addressed
+// to, an unsafe route only ever carries the part of its cidr outside the vpn network.
+func routeOverlaps(network *net.IPNet, routes []Route, unsafeRoutes []Route) []string {
+	var warnings []string
+	for _, u := range unsafeRoutes {
+		if !cidrsOverlap(u.Cidr, network) {
+			continue
+		}
+
+		warnings = append(warnings, fmt.Sprintf(
+			"tun.unsafe_routes entry %v overlaps the network attached to the certificate %v, traffic for the network is never sent via %v",
+			u.Cidr, network, u.Via,
+		))
+
+		for _, r := range routes {
+			if cidrsOverlap(u.Cidr, r.Cidr) {
+				warnings = append(warnings, fmt.Sprintf(
+					"tun.unsafe_routes entry %v overlaps tun.routes entry %v, the tun.routes entry takes precedence", u.Cidr, r.Cidr,
+				))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// warnRouteOverlaps logs every overlap found by routeOverlaps
+func warnRouteOverlaps(l *logrus.Logger, network *net.IPNet, routes []Route, unsafeRoutes []Route) {
+	for _, w := range routeOverlaps(network, routes, unsafeRoutes) {
+		l.Warn(w)
+	}
+}
+
+// limitRoutes enforces tun.max_routes on the routes that will be installed, 0 is no limit. With tun.max_routes_action
+// error, the default, installing more routes than the limit is an error. With truncate the routes past the limit are
+// kept for routing within nebula but are not installed, and a warning is logged.
+func limitRoutes(l *logrus.Logger, c *config.C, routes []Route) ([]Route, error) {
+	maxRoutes := c.GetInt("tun.max_routes", 0)
+	if maxRoutes < 0 {
+		return nil, fmt.Errorf("tun.max_routes can not be negative: %v", maxRoutes)
+	}
+
+	action := c.GetString("tun.max_routes_action", "error")
+	if action != "error" && action != "truncate" {
+		return nil, fmt.Errorf("tun.max_routes_action must be error or truncate: %v", action)
+	}
+
+	installed := 0
+	for _, r := range routes {
+		if r.Install {
+			installed++
+		}
+	}
+
+	if maxRoutes == 0 || installed <= maxRoutes {
+		return routes, nil
+	}
+
+	if action == "error" {
+		return nil, fmt.Errorf("tun.routes and tun.unsafe_routes would install %v routes, more than tun.max_routes: %v", installed, maxRoutes)
+	}
+
+	limited := make([]Route, len(routes))
+	copy(limited, routes)
+	installed = 0
+	for i := range limited {
+		if !limited[i].Install {
+			continue
+		}
+
+		installed++
+		if installed > maxRoutes {
+			limited[i].Install = false
+		}
+	}
+
+	l.WithField("routes", installed).WithField("maxRoutes", maxRoutes).
+		Warn("tun.routes and tun.unsafe_routes would install more routes than tun.max_routes, the routes past the limit are not installed")
+	return limited, nil
+}
+
+// resolvedRouteLimit returns how many routes for resolve hostnames may be installed next to routes without going over
+// tun.max_routes, -1 when there is no limit
+func resolvedRouteLimit(c *config.C, routes []Route) int {
+	maxRoutes := c.GetInt("tun.max_routes", 0)
+	if maxRoutes <= 0 {
+		return -1
+	}
+
+	for _, r := range routes {
+		if r.Install {
+			maxRoutes--
+		}
+	}
+
+	if maxRoutes < 0 {
+		return 0
+	}
+	return maxRoutes
+}
+
+// cidrsOverlap returns true if a and b share any address, one cidr always contains the other when they do
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP.Mask(b.Mask)) || b.Contains(a.IP.Mask(a.Mask))
+}
 
+func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 	r := c.Get("tun.routes")
 	if r == nil {
 		return []Route{}, nil
@@ -59,21 +354,14 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v in tun.routes is invalid", i+1)
 		}
 
-		rMtu, ok := m["mtu"]
-		if !ok {
-			return nil, fmt.Errorf("entry %v.mtu in tun.routes is not present", i+1)
-		}
-
-		mtu, ok := rMtu.(int)
-		if !ok {
-			mtu, err = strconv.Atoi(rMtu.(string))
-			if err != nil {
-				return nil, fmt.Errorf("entry %v.mtu in tun.routes is not an integer: %v", i+1, err)
-			}
+		mtus, err := parseRouteMTUs(i, m, "tun.routes", true)
+		if err != nil {
+			return nil, err
 		}
 
-		if mtu < 500 {
-			return nil, fmt.Errorf("entry %v.mtu in tun.routes is below 500: %v", i+1, mtu)
+		// tun.routes are within the ipv4 network of the certificate, only unsafe routes can be ipv6
+		if mtus.mtu6 != 0 {
+			return nil, fmt.Errorf("entry %v.mtu6 in tun.routes is not supported, these routes are always ipv4", i+1)
 		}
 
 		rRoute, ok := m["route"]
@@ -81,9 +369,14 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.routes is not present", i+1)
 		}
 
+		src, err := parseRouteSrc(i, m, network, "tun.routes")
+		if err != nil {
+			return nil, err
+		}
+
 		r := Route{
 			Install: true,
-			MTU:     mtu,
+			Src:     src,
 		}
 
 		_, r.Cidr, err = net.ParseCIDR(fmt.Sprintf("%v", rRoute))
@@ -91,6 +384,8 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.routes failed to parse: %v", i+1, err)
 		}
 
+		r.MTU = mtus.forFamily(r.Cidr)
+
 		if !ipWithin(network, r.Cidr) {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.routes is not contained within the network attached to the certificate; route: %v, network: %v",
@@ -107,8 +402,6 @@ func parseRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 }
 
 func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
-	var err error
-
 	r := c.Get("tun.unsafe_routes")
 	if r == nil {
 		return []Route{}, nil
@@ -123,26 +416,21 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 		return []Route{}, nil
 	}
 
-	routes := make([]Route, len(rawRoutes))
+	routes := make([]Route, 0, len(rawRoutes))
 	for i, r := range rawRoutes {
 		m, ok := r.(map[interface{}]interface{})
 		if !ok {
 			return nil, fmt.Errorf("entry %v in tun.unsafe_routes is invalid", i+1)
 		}
 
-		var mtu int
-		if rMtu, ok := m["mtu"]; ok {
-			mtu, ok = rMtu.(int)
-			if !ok {
-				mtu, err = strconv.Atoi(rMtu.(string))
-				if err != nil {
-					return nil, fmt.Errorf("entry %v.mtu in tun.unsafe_routes is not an integer: %v", i+1, err)
-				}
-			}
+		if _, ok := m["resolve"]; ok {
+			// Handled by parseResolveRoutes
+			continue
+		}
 
-			if mtu != 0 && mtu < 500 {
-				return nil, fmt.Errorf("entry %v.mtu in tun.unsafe_routes is below 500: %v", i+1, mtu)
-			}
+		mtus, err := parseRouteMTUs(i, m, "tun.unsafe_routes", false)
+		if err != nil {
+			return nil, err
 		}
 
 		rMetric, ok := m["metric"]
@@ -162,19 +450,9 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.metric in tun.unsafe_routes is not in range (0-%d) : %v", i+1, math.MaxInt32, metric)
 		}
 
-		rVia, ok := m["via"]
-		if !ok {
-			return nil, fmt.Errorf("entry %v.via in tun.unsafe_routes is not present", i+1)
-		}
-
-		via, ok := rVia.(string)
-		if !ok {
-			return nil, fmt.Errorf("entry %v.via in tun.unsafe_routes is not a string: found %T", i+1, rVia)
-		}
-
-		nVia := net.ParseIP(via)
-		if nVia == nil {
-			return nil, fmt.Errorf("entry %v.via in tun.unsafe_routes failed to parse address: %v", i+1, via)
+		viaVpnIp, err := parseUnsafeRouteVia(i, m)
+		if err != nil {
+			return nil, err
 		}
 
 		rRoute, ok := m["route"]
@@ -182,8 +460,6 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.unsafe_routes is not present", i+1)
 		}
 
-		viaVpnIp := iputil.Ip2VpnIp(nVia)
-
 		install := true
 		rInstall, ok := m["install"]
 		if ok {
@@ -193,11 +469,28 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			}
 		}
 
+		tag, err := parseRouteTag(i, m)
+		if err != nil {
+			return nil, err
+		}
+
+		src, err := parseRouteSrc(i, m, network, "tun.unsafe_routes")
+		if err != nil {
+			return nil, err
+		}
+
+		onUnreachable, err := parseRouteOnUnreachable(i, m)
+		if err != nil {
+			return nil, err
+		}
+
 		r := Route{
-			Via:     &viaVpnIp,
-			MTU:     mtu,
-			Metric:  metric,
-			Install: install,
+			Via:           &viaVpnIp,
+			Metric:        metric,
+			Install:       install,
+			Tag:           tag,
+			Src:           src,
+			OnUnreachable: onUnreachable,
 		}
 
 		_, r.Cidr, err = net.ParseCIDR(fmt.Sprintf("%v", rRoute))
@@ -205,6 +498,25 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.unsafe_routes failed to parse: %v", i+1, err)
 		}
 
+		// An ipv4 mapped network would be routed as ipv6 and never match ipv4 traffic
+		if len(r.Cidr.Mask) != net.IPv4len && r.Cidr.IP.To4() != nil {
+			return nil, fmt.Errorf("entry %v.route in tun.unsafe_routes is an ipv4 mapped ipv6 network, use the ipv4 network: %v", i+1, rRoute)
+		}
+
+		// src is always the ipv4 vpn ip
+		if src != nil && len(r.Cidr.Mask) != net.IPv4len {
+			return nil, fmt.Errorf("entry %v.src in tun.unsafe_routes can not be used on an ipv6 route: %v", i+1, rRoute)
+		}
+
+		r.MTU = mtus.forFamily(r.Cidr)
+		if r.MTU != 0 && r.MTU < minIPv6MTU && len(r.Cidr.Mask) != net.IPv4len {
+			key := "mtu"
+			if mtus.mtu6 != 0 {
+				key = "mtu6"
+			}
+			return nil, fmt.Errorf("entry %v.%s in tun.unsafe_routes is below the ipv6 minimum of %v for an ipv6 route: %v", i+1, key, minIPv6MTU, r.MTU)
+		}
+
 		if ipWithin(network, r.Cidr) {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.unsafe_routes is contained within the network attached to the certificate; route: %v, network: %v",
@@ -214,12 +526,223 @@ func parseUnsafeRoutes(c *config.C, network *net.IPNet) ([]Route, error) {
 			)
 		}
 
-		routes[i] = r
+		routes = append(routes, r)
+	}
+
+	return routes, nil
+}
+
+// parseResolveRoutes returns the entries in tun.unsafe_routes that have a resolve hostname instead of a route
+func parseResolveRoutes(c *config.C) ([]resolveRoute, error) {
+	rawRoutes, ok := c.Get("tun.unsafe_routes").([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	var routes []resolveRoute
+	for i, r := range rawRoutes {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		rResolve, ok := m["resolve"]
+		if !ok {
+			continue
+		}
+
+		hostname, ok := rResolve.(string)
+		if !ok || hostname == "" {
+			return nil, fmt.Errorf("entry %v.resolve in tun.unsafe_routes is not a hostname: %v", i+1, rResolve)
+		}
+
+		if _, ok := m["route"]; ok {
+			return nil, fmt.Errorf("entry %v in tun.unsafe_routes can not have both a route and a resolve hostname", i+1)
+		}
+
+		via, err := parseUnsafeRouteVia(i, m)
+		if err != nil {
+			return nil, err
+		}
+
+		tag, err := parseRouteTag(i, m)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := m["on_unreachable"]; ok {
+			return nil, fmt.Errorf("entry %v.on_unreachable in tun.unsafe_routes is not supported with a resolve hostname", i+1)
+		}
+
+		install := true
+		if rInstall, ok := m["install"]; ok {
+			install, err = strconv.ParseBool(fmt.Sprintf("%v", rInstall))
+			if err != nil {
+				return nil, fmt.Errorf("entry %v.install in tun.unsafe_routes is not a boolean: %v", i+1, err)
+			}
+		}
+
+		routes = append(routes, resolveRoute{hostname: hostname, via: via, tag: tag, install: install})
 	}
 
 	return routes, nil
 }
 
+func parseUnsafeRouteVia(i int, m map[interface{}]interface{}) (iputil.VpnIp, error) {
+	rVia, ok := m["via"]
+	if !ok {
+		return 0, fmt.Errorf("entry %v.via in tun.unsafe_routes is not present", i+1)
+	}
+
+	via, ok := rVia.(string)
+	if !ok {
+		return 0, fmt.Errorf("entry %v.via in tun.unsafe_routes is not a string: found %T", i+1, rVia)
+	}
+
+	nVia := net.ParseIP(via)
+	if nVia == nil {
+		return 0, fmt.Errorf("entry %v.via in tun.unsafe_routes failed to parse address: %v", i+1, via)
+	}
+
+	// Vpn ips are ipv4 only, a v6 via would be truncated to its last 4 bytes
+	if nVia.To4() == nil {
+		return 0, fmt.Errorf("entry %v.via in tun.unsafe_routes is not an ipv4 address, vpn ips are ipv4 only: %v", i+1, via)
+	}
+
+	return iputil.Ip2VpnIp(nVia), nil
+}
+
+// minIPv6MTU is the smallest link mtu ipv6 allows, RFC 8200
+const minIPv6MTU = 1280
+
+// routeMTUs are the mtu settings of a route entry. mtu4 and mtu6 override mtu for routes of their address family since
+// the overhead of the two differs, 0 is not set.
+type routeMTUs struct {
+	mtu  int
+	mtu4 int
+	mtu6 int
+}
+
+// forFamily returns the mtu for a route to cidr, 0 when none is set for its family
+func (r routeMTUs) forFamily(cidr *net.IPNet) int {
+	family := r.mtu6
+	if len(cidr.Mask) == net.IPv4len {
+		family = r.mtu4
+	}
+
+	if family != 0 {
+		return family
+	}
+	return r.mtu
+}
+
+// parseRouteMTUs returns the mtu, mtu4 and mtu6 of a route entry in key, each must be at least 500. When required at
+// least one of them must be set, otherwise a missing or 0 mtu follows the tun mtu.
+func parseRouteMTUs(i int, m map[interface{}]interface{}, key string, required bool) (routeMTUs, error) {
+	var mtus routeMTUs
+	present := false
+	for _, f := range []struct {
+		name string
+		mtu  *int
+	}{{"mtu", &mtus.mtu}, {"mtu4", &mtus.mtu4}, {"mtu6", &mtus.mtu6}} {
+		rMtu, ok := m[f.name]
+		if !ok {
+			continue
+		}
+		present = true
+
+		mtu, ok := rMtu.(int)
+		if !ok {
+			var err error
+			mtu, err = strconv.Atoi(fmt.Sprintf("%v", rMtu))
+			if err != nil {
+				return mtus, fmt.Errorf("entry %v.%s in %s is not an integer: %v", i+1, f.name, key, err)
+			}
+		}
+
+		if (required || mtu != 0) && mtu < 500 {
+			return mtus, fmt.Errorf("entry %v.%s in %s is below 500: %v", i+1, f.name, key, mtu)
+		}
+
+		*f.mtu = mtu
+	}
+
+	if required && !present {
+		return mtus, fmt.Errorf("entry %v.mtu in %s is not present", i+1, key)
+	}
+
+	return mtus, nil
+}
+
+// parseRouteTag returns the optional tag of a tun.unsafe_routes entry, traffic sent through routes that share a tag is
+// counted together. The tag becomes part of a metric name so it is limited to letters, numbers, _ and -.
+func parseRouteTag(i int, m map[interface{}]interface{}) (string, error) {
+	rTag, ok := m["tag"]
+	if !ok {
+		return "", nil
+	}
+
+	tag, ok := rTag.(string)
+	if !ok || !routeTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("entry %v.tag in tun.unsafe_routes must only contain letters, numbers, _ and -: %v", i+1, rTag)
+	}
+
+	return tag, nil
+}
+
+var routeTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func parseRouteOnUnreachable(i int, m map[interface{}]interface{}) (OnUnreachable, error) {
+	rOnUnreachable, ok := m["on_unreachable"]
+	if !ok {
+		return OnUnreachableDrop, nil
+	}
+
+	switch fmt.Sprintf("%v", rOnUnreachable) {
+	case "drop":
+		return OnUnreachableDrop, nil
+	case "reject":
+		return OnUnreachableReject, nil
+	case "next":
+		return OnUnreachableNext, nil
+	default:
+		return OnUnreachableDrop, fmt.Errorf("entry %v.on_unreachable in tun.unsafe_routes must be one of drop, reject or next: %v", i+1, rOnUnreachable)
+	}
+}
+
+// parseRouteSrc returns the optional preferred source address of a route entry in key. It must be an overlay ip of
+// this node, which is the ip of network, so replies to traffic that came in over nebula leave with the right address.
+func parseRouteSrc(i int, m map[interface{}]interface{}, network *net.IPNet, key string) (net.IP, error) {
+	rSrc, ok := m["src"]
+	if !ok {
+		return nil, nil
+	}
+
+	src := net.ParseIP(fmt.Sprintf("%v", rSrc))
+	if src == nil {
+		return nil, fmt.Errorf("entry %v.src in %s failed to parse address: %v", i+1, key, rSrc)
+	}
+
+	if !src.Equal(network.IP) {
+		return nil, fmt.Errorf("entry %v.src in %s is not an overlay ip of this node; src: %v, vpn ip: %v", i+1, key, rSrc, network.IP)
+	}
+
+	return src.To4(), nil
+}
+
+// renumberRouteSrc returns a copy of routes with every preferred source address, which parseRouteSrc only allows to be
+// our vpn ip, moved to ip
+func renumberRouteSrc(routes []Route, ip net.IP) []Route {
+	out := make([]Route, len(routes))
+	for i, r := range routes {
+		if r.Src != nil {
+			r.Src = ip.To4()
+		}
+		out[i] = r
+	}
+	return out
+}
+
 func ipWithin(o *net.IPNet, i *net.IPNet) bool {
 	// Make sure o contains the lowest form of i
 	if !o.Contains(i.IP.Mask(i.Mask)) {
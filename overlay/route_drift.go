@@ -0,0 +1,119 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// routeDriftRepairer is implemented by the devices that can tell when an installed route was removed from the kernel
+// routing table by something other than nebula
+type routeDriftRepairer interface {
+	// installedRoutes returns the routes nebula installed and the destinations the kernel has routes for on the device
+	installedRoutes() ([]Route, []*net.IPNet, error)
+	// restoreRoute installs r again, unless a reload removed it in the meantime
+	restoreRoute(r Route) error
+}
+
+// routeDriftChecker periodically puts back the installed tun.routes and tun.unsafe_routes that were removed from the
+// kernel routing table outside of nebula
+type routeDriftChecker struct {
+	l        *logrus.Logger
+	d        routeDriftRepairer
+	interval time.Duration
+	detected metrics.Counter
+}
+
+// newRouteDriftCheckerFromConfig returns nil if tun.route_drift_interval is 0 or the device can not be checked
+func newRouteDriftCheckerFromConfig(c *config.C, l *logrus.Logger, d Device) (*routeDriftChecker, error) {
+	interval := c.GetDuration("tun.route_drift_interval", 0)
+	if interval < 0 {
+		return nil, fmt.Errorf("tun.route_drift_interval must not be negative: %v", interval)
+	}
+
+	if interval == 0 {
+		return nil, nil
+	}
+
+	rd, ok := d.(routeDriftRepairer)
+	if !ok {
+		l.Warn("tun.route_drift_interval is not supported on this platform and will be ignored")
+		return nil, nil
+	}
+
+	return &routeDriftChecker{
+		l:        l,
+		d:        rd,
+		interval: interval,
+		detected: metrics.GetOrRegisterCounter("route_drift_detected", util.MetricsRegistry(c)),
+	}, nil
+}
+
+// run checks the routes every interval until ctx is done
+func (rc *routeDriftChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rc.check()
+		}
+	}
+}
+
+// check re-adds every installed route the kernel no longer has, returns the routes that were restored
+func (rc *routeDriftChecker) check() []Route {
+	routes, present, err := rc.d.installedRoutes()
+	if err != nil {
+		rc.l.WithError(err).Error("Failed to list the kernel routes to check for route drift")
+		return nil
+	}
+
+	var restored []Route
+	for _, r := range missingRoutes(routes, present) {
+		rc.detected.Inc(1)
+		if err := rc.d.restoreRoute(r); err != nil {
+			rc.l.WithError(err).WithFields(routeFields(&r)).WithField("route", r.Cidr).
+				Error("Failed to restore a route that was removed outside of nebula")
+			continue
+		}
+
+		rc.l.WithFields(routeFields(&r)).WithField("route", r.Cidr).
+			Warn("Restored a route that was removed outside of nebula")
+		restored = append(restored, r)
+	}
+
+	return restored
+}
+
+// missingRoutes returns the routes that should be installed and have no matching destination in present
+func missingRoutes(routes []Route, present []*net.IPNet) []Route {
+	have := make(map[string]struct{}, len(present))
+	for _, p := range present {
+		if p != nil {
+			have[p.String()] = struct{}{}
+		}
+	}
+
+	var missing []Route
+	for _, r := range routes {
+		if !r.Install {
+			continue
+		}
+
+		if _, ok := have[r.Cidr.String()]; !ok {
+			missing = append(missing, r)
+		}
+	}
+
+	return missing
+}
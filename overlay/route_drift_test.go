@@ -0,0 +1,92 @@
+package overlay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/slackhq/nebula/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// driftTun is a kernel routing table that routes can be removed from behind our back
+type driftTun struct {
+	routes []Route
+	kernel map[string]*net.IPNet
+}
+
+func (d *driftTun) installedRoutes() ([]Route, []*net.IPNet, error) {
+	var present []*net.IPNet
+	for _, n := range d.kernel {
+		present = append(present, n)
+	}
+	return d.routes, present, nil
+}
+
+func (d *driftTun) restoreRoute(r Route) error {
+	d.kernel[r.Cidr.String()] = r.Cidr
+	return nil
+}
+
+func TestRouteDriftChecker_check(t *testing.T) {
+	route := func(cidr string, install bool) Route {
+		_, n, _ := net.ParseCIDR(cidr)
+		return Route{Cidr: n, Install: install}
+	}
+
+	d := &driftTun{
+		routes: []Route{route("10.1.0.0/24", true), route("10.2.0.0/24", true), route("10.3.0.0/24", false)},
+		kernel: map[string]*net.IPNet{},
+	}
+	for _, r := range d.routes[:2] {
+		d.kernel[r.Cidr.String()] = r.Cidr
+	}
+
+	l, hook := test.NewNullLogger()
+	rc := &routeDriftChecker{l: l, d: d, detected: metrics.NewCounter()}
+
+	// Nothing has drifted
+	assert.Empty(t, rc.check())
+	assert.Equal(t, int64(0), rc.detected.Count())
+
+	// A route removed outside of nebula is put back, routes that are not installed are left alone
+	delete(d.kernel, "10.2.0.0/24")
+	restored := rc.check()
+	assert.Len(t, restored, 1)
+	assert.Equal(t, "10.2.0.0/24", restored[0].Cidr.String())
+	assert.Contains(t, d.kernel, "10.2.0.0/24")
+	assert.NotContains(t, d.kernel, "10.3.0.0/24")
+	assert.Equal(t, int64(1), rc.detected.Count())
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "Restored a route that was removed outside of nebula", hook.LastEntry().Message)
+
+	assert.Empty(t, rc.check())
+	assert.Equal(t, int64(1), rc.detected.Count())
+}
+
+func TestNewRouteDriftCheckerFromConfig(t *testing.T) {
+	l, _ := test.NewNullLogger()
+	c := config.NewC(l)
+	d := struct {
+		Device
+		*driftTun
+	}{driftTun: &driftTun{kernel: map[string]*net.IPNet{}}}
+
+	// The check is off unless an interval is set
+	rc, err := newRouteDriftCheckerFromConfig(c, l, d)
+	assert.NoError(t, err)
+	assert.Nil(t, rc)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_drift_interval": "30s"}
+	rc, err = newRouteDriftCheckerFromConfig(c, l, d)
+	assert.NoError(t, err)
+	assert.NotNil(t, rc)
+	assert.Equal(t, 30*time.Second, rc.interval)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_drift_interval": "-1s"}
+	_, err = newRouteDriftCheckerFromConfig(c, l, d)
+	assert.EqualError(t, err, "tun.route_drift_interval must not be negative: -1s")
+}
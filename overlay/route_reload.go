@@ -0,0 +1,176 @@
+package overlay
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// routeReloader is implemented by the devices that can apply changes to tun.routes and tun.unsafe_routes without a
+// restart
+type routeReloader interface {
+	reloadRoutes(routes []Route) error
+}
+
+// routeChange is a single difference between two sets of routes, Old is nil for an added route and New is nil for a
+// removed one
+type routeChange struct {
+	Cidr string
+	Old  *Route
+	New  *Route
+}
+
+func (rc routeChange) kind() string {
+	switch {
+	case rc.Old == nil:
+		return "added"
+	case rc.New == nil:
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+// diffRoutes returns the routes that were added to, removed from, or changed between old and new. Routes are matched
+// by cidr, a cidr that is listed more than once is matched in the order it is listed.
+func diffRoutes(old, new []Route) []routeChange {
+	key := func(routes []Route) []string {
+		seen := map[string]int{}
+		keys := make([]string, len(routes))
+		for i, r := range routes {
+			c := r.Cidr.String()
+			keys[i] = fmt.Sprintf("%s#%d", c, seen[c])
+			seen[c]++
+		}
+		return keys
+	}
+
+	oldKeys := key(old)
+	oldByKey := make(map[string]int, len(old))
+	for i, k := range oldKeys {
+		oldByKey[k] = i
+	}
+
+	var changes []routeChange
+	newKeys := key(new)
+	matched := make(map[string]struct{}, len(new))
+	for i, k := range newKeys {
+		n := new[i]
+		o, ok := oldByKey[k]
+		if !ok {
+			changes = append(changes, routeChange{Cidr: n.Cidr.String(), New: &n})
+			continue
+		}
+
+		matched[k] = struct{}{}
+		if !routesEqual(old[o], n) {
+			changes = append(changes, routeChange{Cidr: n.Cidr.String(), Old: &old[o], New: &n})
+		}
+	}
+
+	for i, k := range oldKeys {
+		if _, ok := matched[k]; !ok {
+			changes = append(changes, routeChange{Cidr: old[i].Cidr.String(), Old: &old[i]})
+		}
+	}
+
+	return changes
+}
+
+func routesEqual(a, b Route) bool {
+	if a.MTU != b.MTU || a.Metric != b.Metric || a.Install != b.Install || a.Tag != b.Tag || !a.Src.Equal(b.Src) || a.OnUnreachable != b.OnUnreachable {
+		return false
+	}
+
+	if a.Via == nil || b.Via == nil {
+		return a.Via == b.Via
+	}
+
+	return *a.Via == *b.Via
+}
+
+func routeFields(r *Route) logrus.Fields {
+	f := logrus.Fields{"mtu": r.MTU, "metric": r.Metric, "install": r.Install}
+	if r.Via != nil {
+		f["via"] = r.Via.String()
+	}
+	if r.Tag != "" {
+		f["tag"] = r.Tag
+	}
+	if r.Src != nil {
+		f["src"] = r.Src.String()
+	}
+	if r.OnUnreachable != OnUnreachableDrop {
+		f["on_unreachable"] = r.OnUnreachable.String()
+	}
+	return f
+}
+
+// logRouteChanges logs each change as its own event so the old and new values of every route can be audited
+func logRouteChanges(l *logrus.Logger, changes []routeChange) {
+	for _, rc := range changes {
+		e := l.WithField("route", rc.Cidr).WithField("change", rc.kind())
+		if rc.Old != nil {
+			e = e.WithField("old", routeFields(rc.Old))
+		}
+		if rc.New != nil {
+			e = e.WithField("new", routeFields(rc.New))
+		}
+		e.Info("Route changed")
+	}
+}
+
+// wireRouteReload reloads tun.routes and tun.unsafe_routes on a config reload, devices that are not a routeReloader
+// keep running with the routes they started with. Routes are checked against the current address of d, which moves
+// when pki.allow_renumber loads a certificate with a new vpn ip. What is left of tun.max_routes is handed to resolver,
+// which may be nil, so the routes for resolve hostnames stay under it.
+func wireRouteReload(c *config.C, l *logrus.Logger, d Device, routes []Route, resolver *routeResolver) {
+	c.RegisterReloadCallback(func(c *config.C) {
+		if !c.HasChanged("tun.routes") && !c.HasChanged("tun.unsafe_routes") && !c.HasChanged("tun.max_routes") && !c.HasChanged("tun.max_routes_action") {
+			return
+		}
+
+		tunCidr := d.Cidr()
+
+		newRoutes, err := parseRoutes(c, tunCidr)
+		if err != nil {
+			l.WithError(err).Error("Could not parse tun.routes, keeping the current routes")
+			return
+		}
+
+		unsafeRoutes, err := parseUnsafeRoutes(c, tunCidr)
+		if err != nil {
+			l.WithError(err).Error("Could not parse tun.unsafe_routes, keeping the current routes")
+			return
+		}
+		warnRouteOverlaps(l, tunCidr, newRoutes, unsafeRoutes)
+		newRoutes, err = limitRoutes(l, c, append(newRoutes, unsafeRoutes...))
+		if err != nil {
+			l.WithError(err).Error("Could not apply tun.max_routes, keeping the current routes")
+			return
+		}
+
+		changes := diffRoutes(routes, newRoutes)
+		if len(changes) == 0 {
+			resolver.setInstallLimit(resolvedRouteLimit(c, routes))
+			return
+		}
+
+		rr, ok := d.(routeReloader)
+		if !ok {
+			l.Warnf("tun.routes and tun.unsafe_routes can not be reloaded in %s, restart to apply the changes", runtime.GOOS)
+			return
+		}
+
+		if err := rr.reloadRoutes(newRoutes); err != nil {
+			l.WithError(err).Error("Failed to reload tun.routes and tun.unsafe_routes")
+			return
+		}
+
+		logRouteChanges(l, changes)
+		routes = newRoutes
+		resolver.setInstallLimit(resolvedRouteLimit(c, routes))
+	})
+}
@@ -0,0 +1,139 @@
+package overlay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diffRoutes(t *testing.T) {
+	route := func(cidr string, via string, mtu int, metric int, install bool) Route {
+		_, n, _ := net.ParseCIDR(cidr)
+		r := Route{Cidr: n, MTU: mtu, Metric: metric, Install: install}
+		if via != "" {
+			v := iputil.Ip2VpnIp(net.ParseIP(via))
+			r.Via = &v
+		}
+		return r
+	}
+
+	old := []Route{
+		route("10.0.0.0/16", "", 8800, 0, true),
+		route("1.0.0.0/24", "10.0.0.1", 0, 0, true),
+		route("2.0.0.0/24", "10.0.0.1", 0, 0, true),
+		route("3.0.0.0/24", "10.0.0.1", 1300, 0, true),
+		route("4.0.0.0/24", "10.0.0.1", 0, 0, true),
+	}
+
+	assert.Empty(t, diffRoutes(old, old))
+
+	new := []Route{
+		// mtu changed
+		route("10.0.0.0/16", "", 9000, 0, true),
+		// unchanged
+		route("1.0.0.0/24", "10.0.0.1", 0, 0, true),
+		// via changed
+		route("2.0.0.0/24", "10.0.0.2", 0, 0, true),
+		// metric and install changed
+		route("4.0.0.0/24", "10.0.0.1", 0, 100, false),
+		// added
+		route("5.0.0.0/24", "10.0.0.1", 0, 0, true),
+		// 3.0.0.0/24 was removed
+	}
+
+	changes := diffRoutes(old, new)
+	if !assert.Len(t, changes, 5) {
+		return
+	}
+
+	assert.Equal(t, routeChange{Cidr: "10.0.0.0/16", Old: &old[0], New: &new[0]}, changes[0])
+	assert.Equal(t, "changed", changes[0].kind())
+	assert.Equal(t, routeChange{Cidr: "2.0.0.0/24", Old: &old[2], New: &new[2]}, changes[1])
+	assert.Equal(t, routeChange{Cidr: "4.0.0.0/24", Old: &old[4], New: &new[3]}, changes[2])
+	assert.Equal(t, routeChange{Cidr: "5.0.0.0/24", New: &new[4]}, changes[3])
+	assert.Equal(t, "added", changes[3].kind())
+	assert.Equal(t, routeChange{Cidr: "3.0.0.0/24", Old: &old[3]}, changes[4])
+	assert.Equal(t, "removed", changes[4].kind())
+
+	// A cidr listed twice is matched in order
+	dupes := append(old, route("1.0.0.0/24", "10.0.0.9", 0, 0, true))
+	changes = diffRoutes(old, dupes)
+	assert.Equal(t, []routeChange{{Cidr: "1.0.0.0/24", New: &dupes[5]}}, changes)
+	changes = diffRoutes(dupes, old)
+	assert.Equal(t, []routeChange{{Cidr: "1.0.0.0/24", Old: &dupes[5]}}, changes)
+
+	// Setting a src is a change
+	withSrc := append([]Route(nil), old...)
+	withSrc[1].Src = net.IP{10, 0, 0, 5}
+	changes = diffRoutes(old, withSrc)
+	assert.Equal(t, []routeChange{{Cidr: "1.0.0.0/24", Old: &old[1], New: &withSrc[1]}}, changes)
+}
+
+func Test_wireRouteReload(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+
+	assert.NoError(t, c.LoadString(`tun: {unsafe_routes: [{route: 1.0.0.0/24, via: 10.0.0.1}, {route: 2.0.0.0/24, via: 10.0.0.1}]}`))
+	routes, err := parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+
+	d := &reloadingDevice{cidr: n}
+	wireRouteReload(c, l, d, routes, nil)
+
+	assert.NoError(t, c.ReloadConfigString(`tun: {unsafe_routes: [{route: 1.0.0.0/24, via: 10.0.0.2}, {route: 3.0.0.0/24, via: 10.0.0.1}]}`))
+	assert.Len(t, d.routes, 2)
+
+	var events []logrus.Fields
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Route changed" {
+			events = append(events, e.Data)
+		}
+	}
+
+	assert.Equal(t, []logrus.Fields{
+		{
+			"route":  "1.0.0.0/24",
+			"change": "changed",
+			"old":    logrus.Fields{"mtu": 0, "metric": 0, "install": true, "via": "10.0.0.1"},
+			"new":    logrus.Fields{"mtu": 0, "metric": 0, "install": true, "via": "10.0.0.2"},
+		},
+		{
+			"route":  "3.0.0.0/24",
+			"change": "added",
+			"new":    logrus.Fields{"mtu": 0, "metric": 0, "install": true, "via": "10.0.0.1"},
+		},
+		{
+			"route":  "2.0.0.0/24",
+			"change": "removed",
+			"old":    logrus.Fields{"mtu": 0, "metric": 0, "install": true, "via": "10.0.0.1"},
+		},
+	}, events)
+
+	// Changes are diffed against the routes from the last reload
+	hook.Reset()
+	assert.NoError(t, c.ReloadConfigString(`tun: {unsafe_routes: [{route: 1.0.0.0/24, via: 10.0.0.2}, {route: 3.0.0.0/24, via: 10.0.0.1, metric: 10}]}`))
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, "changed", hook.LastEntry().Data["change"])
+	assert.Equal(t, "3.0.0.0/24", hook.LastEntry().Data["route"])
+}
+
+type reloadingDevice struct {
+	Device
+	cidr   *net.IPNet
+	routes []Route
+}
+
+func (d *reloadingDevice) Cidr() *net.IPNet {
+	return d.cidr
+}
+
+func (d *reloadingDevice) reloadRoutes(routes []Route) error {
+	d.routes = routes
+	return nil
+}
@@ -0,0 +1,533 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// resolveRoute is an entry in tun.unsafe_routes with a resolve hostname instead of a route, the addresses the hostname
+// resolves to are routed via the vpn ip
+type resolveRoute struct {
+	hostname string
+	via      iputil.VpnIp
+	tag      string
+	install  bool
+}
+
+// resolvedRouteInstaller is implemented by devices that install a route for each address a resolve hostname resolves to
+type resolvedRouteInstaller interface {
+	// installResolvedRoutes replaces the installed routes for resolved addresses, old, with new
+	installResolvedRoutes(old, new []Route)
+}
+
+type resolver interface {
+	// lookup returns the ipv4 and ipv6 addresses host resolves to and how long they may be cached for
+	lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+}
+
+// maxResolveJitter is the largest fraction of a ttl that a refresh can be moved earlier by
+const maxResolveJitter = 0.5
+
+// routeResolver resolves the resolve hostnames in tun.unsafe_routes whenever their dns ttl runs out and keeps a route
+// tree of the results
+type routeResolver struct {
+	l        *logrus.Logger
+	resolver resolver
+	network  *net.IPNet
+	routes   []resolveRoute
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	jitter   float64
+	timeout  time.Duration
+	maxAddrs int
+	rand     func() float64
+
+	// addrs holds the last successful lookup for each entry in routes, expires is when those addresses run out of ttl
+	// and next is when each entry is due to be looked up again, they are only touched by resolve
+	addrs   [][]netip.Addr
+	expires []time.Time
+	next    []time.Time
+	tree    atomic.Pointer[cidr.RouteTree[routeTarget]]
+
+	// installer installs the routes for the resolved addresses, nil if the device can not. wanted is every resolved
+	// route that asked to be installed, installed is what the installer was last given and limit is how many of wanted
+	// fit under tun.max_routes, -1 for no limit. They are guarded by installLock since a reload can change limit.
+	installer   resolvedRouteInstaller
+	installLock sync.Mutex
+	wanted      []Route
+	installed   []Route
+	limit       int
+}
+
+// newRouteResolverFromConfig returns nil if no entry in tun.unsafe_routes has a resolve hostname
+func newRouteResolverFromConfig(c *config.C, l *logrus.Logger, network *net.IPNet) (*routeResolver, error) {
+	routes, err := parseResolveRoutes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	minTTL := c.GetDuration("tun.resolve.min_ttl", time.Second)
+	if minTTL < time.Second {
+		return nil, fmt.Errorf("tun.resolve.min_ttl must be at least 1s: %v", minTTL)
+	}
+
+	maxTTL := c.GetDuration("tun.resolve.max_ttl", time.Hour)
+	if maxTTL < minTTL {
+		return nil, fmt.Errorf("tun.resolve.max_ttl must be at least tun.resolve.min_ttl: %v", maxTTL)
+	}
+
+	jitter := c.GetFloat64("tun.resolve.jitter", 0.1)
+	if jitter < 0 || jitter > maxResolveJitter {
+		return nil, fmt.Errorf("tun.resolve.jitter must be between 0 and %v: %v", maxResolveJitter, jitter)
+	}
+
+	timeout := c.GetDuration("tun.resolve.timeout", 5*time.Second)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("tun.resolve.timeout must be greater than 0: %v", timeout)
+	}
+
+	maxAddrs := c.GetInt("tun.resolve.max_addresses", 64)
+	if maxAddrs < 1 {
+		return nil, fmt.Errorf("tun.resolve.max_addresses must be greater than 0: %v", maxAddrs)
+	}
+
+	return newRouteResolver(l, newDNSResolver(l), network, routes, minTTL, maxTTL, jitter, timeout, maxAddrs), nil
+}
+
+func newRouteResolver(l *logrus.Logger, r resolver, network *net.IPNet, routes []resolveRoute, minTTL, maxTTL time.Duration, jitter float64, timeout time.Duration, maxAddrs int) *routeResolver {
+	rr := &routeResolver{
+		l:        l,
+		network:  network,
+		resolver: r,
+		routes:   routes,
+		minTTL:   minTTL,
+		maxTTL:   maxTTL,
+		jitter:   jitter,
+		timeout:  timeout,
+		maxAddrs: maxAddrs,
+		rand:     rand.Float64,
+		addrs:    make([][]netip.Addr, len(routes)),
+		expires:  make([]time.Time, len(routes)),
+		next:     make([]time.Time, len(routes)),
+		limit:    -1,
+	}
+	rr.tree.Store(cidr.NewRouteTree[routeTarget]())
+	return rr
+}
+
+// run resolves the hostnames right away and then again as each of them expires until ctx is done
+func (rr *routeResolver) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		next := rr.resolve(ctx, time.Now())
+		timer.Reset(time.Until(next))
+	}
+}
+
+// refreshIn returns how long to wait before looking a hostname up again given the ttl of its records. The ttl is
+// clamped to min_ttl and max_ttl and then moved earlier by up to jitter so routers sharing a record do not all look it
+// up in step.
+func (rr *routeResolver) refreshIn(ttl time.Duration) time.Duration {
+	if ttl < rr.minTTL {
+		ttl = rr.minTTL
+	} else if ttl > rr.maxTTL {
+		ttl = rr.maxTTL
+	}
+
+	ttl -= time.Duration(rr.rand() * rr.jitter * float64(ttl))
+	if ttl < rr.minTTL {
+		return rr.minTTL
+	}
+	return ttl
+}
+
+// resolve looks up every hostname that is due at now and swaps in a new route tree if any of the addresses changed.
+// A failed lookup keeps the addresses from the last successful one until their ttl runs out, the hostname is tried
+// again after min_ttl or when the addresses expire, whichever is first. Returns when the next hostname is due.
+func (rr *routeResolver) resolve(ctx context.Context, now time.Time) time.Time {
+	changed := false
+	for i, r := range rr.routes {
+		if now.Before(rr.next[i]) {
+			continue
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, rr.timeout)
+		addrs, ttl, err := rr.resolver.lookup(timeoutCtx, r.hostname)
+		cancel()
+		if err != nil {
+			rr.l.WithError(err).WithField("hostname", r.hostname).Error("DNS resolution failed for tun.unsafe_routes entry")
+			rr.next[i] = now.Add(rr.refreshIn(rr.minTTL))
+			if now.Before(rr.expires[i]) {
+				if rr.expires[i].Before(rr.next[i]) {
+					rr.next[i] = rr.expires[i]
+				}
+			} else if len(rr.addrs[i]) > 0 {
+				rr.l.WithField("hostname", r.hostname).WithField("oldAddrs", rr.addrs[i]).
+					Warn("Resolved addresses for tun.unsafe_routes entry expired, they are no longer routed")
+				rr.addrs[i] = nil
+				changed = true
+			}
+			continue
+		}
+
+		// The addresses are kept for their ttl, or min_ttl if that is longer, and refreshed before then
+		if ttl < rr.minTTL {
+			ttl = rr.minTTL
+		}
+		rr.expires[i] = now.Add(ttl)
+		rr.next[i] = now.Add(rr.refreshIn(ttl))
+
+		addrs = rr.filterAddrs(r.hostname, addrs)
+		if len(addrs) > rr.maxAddrs {
+			rr.l.WithField("hostname", r.hostname).WithField("addresses", len(addrs)).
+				Warnf("Hostname resolved to more than tun.resolve.max_addresses, only routing the first %v", rr.maxAddrs)
+			addrs = addrs[:rr.maxAddrs]
+		}
+
+		if !equalAddrs(rr.addrs[i], addrs) {
+			rr.l.WithField("hostname", r.hostname).WithField("via", r.via).
+				WithField("oldAddrs", rr.addrs[i]).WithField("newAddrs", addrs).
+				Info("Resolved addresses changed for tun.unsafe_routes entry")
+			rr.addrs[i] = addrs
+			changed = true
+		}
+	}
+
+	if changed {
+		tree := cidr.NewRouteTree[routeTarget]()
+		var wanted []Route
+		for i, r := range rr.routes {
+			via := r.via
+			for _, a := range rr.addrs[i] {
+				// A /32 for an ipv4 address and a /128 for an ipv6 one
+				n := &net.IPNet{IP: a.AsSlice(), Mask: net.CIDRMask(a.BitLen(), a.BitLen())}
+				tree.AddCIDR(n, routeTarget{via: r.via, tag: r.tag})
+				if r.install {
+					wanted = append(wanted, Route{Cidr: n, Via: &via, Install: true, Tag: r.tag})
+				}
+			}
+		}
+		rr.tree.Store(tree)
+
+		rr.installLock.Lock()
+		rr.wanted = wanted
+		rr.unlockedInstall()
+		rr.installLock.Unlock()
+	}
+
+	next := rr.next[0]
+	for _, n := range rr.next[1:] {
+		if n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// setInstallLimit changes how many resolved routes may be installed and reinstalls them if that changed what fits
+func (rr *routeResolver) setInstallLimit(limit int) {
+	if rr == nil {
+		return
+	}
+
+	rr.installLock.Lock()
+	defer rr.installLock.Unlock()
+	if rr.limit == limit {
+		return
+	}
+
+	rr.limit = limit
+	rr.unlockedInstall()
+}
+
+// unlockedInstall hands the installer the wanted routes that fit under limit, the ones past it are still routed within
+// nebula through the route tree but are not installed. installLock must be held.
+func (rr *routeResolver) unlockedInstall() {
+	installed := rr.wanted
+	if rr.limit >= 0 && len(installed) > rr.limit {
+		rr.l.WithField("routes", len(installed)).WithField("limit", rr.limit).
+			Warn("Resolved routes would install more routes than tun.max_routes, the routes past the limit are not installed")
+		installed = installed[:rr.limit]
+	}
+
+	if rr.installer != nil {
+		rr.installer.installResolvedRoutes(rr.installed, installed)
+	}
+	rr.installed = installed
+}
+
+// routeFor returns the via and tag for ip if it is one of the resolved addresses
+func (rr *routeResolver) routeFor(ip iputil.VpnIp) (bool, routeTarget) {
+	if rr == nil {
+		return false, routeTarget{}
+	}
+
+	return rr.tree.Load().MostSpecificContains(ip)
+}
+
+// routeFor6 returns the via and tag for the ipv6 address ip if it is one of the resolved addresses
+func (rr *routeResolver) routeFor6(ip [16]byte) (bool, routeTarget) {
+	if rr == nil {
+		return false, routeTarget{}
+	}
+
+	return rr.tree.Load().MostSpecificContainsIP6(ip)
+}
+
+// filterAddrs returns the unique addresses in addrs that are outside of our vpn network, sorted so the result is stable
+// between lookups
+func (rr *routeResolver) filterAddrs(hostname string, addrs []netip.Addr) []netip.Addr {
+	seen := map[netip.Addr]struct{}{}
+	out := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		a = a.Unmap()
+		if _, ok := seen[a]; ok {
+			continue
+		}
+
+		if rr.network.Contains(a.AsSlice()) {
+			// Just like the route in an unsafe_route the addresses must not be in the network attached to the certificate
+			rr.l.WithField("hostname", hostname).WithField("addr", a).
+				Warn("Ignoring resolved address within the network attached to the certificate")
+			continue
+		}
+
+		seen[a] = struct{}{}
+		out = append(out, a)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Less(out[j])
+	})
+	return out
+}
+
+func equalAddrs(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// systemResolverTTL is how long the addresses from the system resolver are kept, it does not expose record ttls
+const systemResolverTTL = time.Minute
+
+// newDNSResolver queries the nameservers in resolv.conf directly so the record ttls are known. Where there is no
+// resolv.conf it falls back to the system resolver.
+func newDNSResolver(l *logrus.Logger) resolver {
+	conf, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil || len(conf.Servers) == 0 {
+		l.WithError(err).Info("Could not read the nameservers from resolv.conf, tun.unsafe_routes resolve entries will use the system resolver and ignore record ttls")
+		return &systemResolver{}
+	}
+
+	return &dnsResolver{conf: conf, client: &dns.Client{}, tcpClient: &dns.Client{Net: "tcp"}, hostsPath: hostsPath}
+}
+
+// resolvConfPath is where newDNSResolver reads the nameservers from
+var resolvConfPath = "/etc/resolv.conf"
+
+// hostsPath is the hosts file dnsResolver consults before asking any nameserver, like the system resolver does
+var hostsPath = "/etc/hosts"
+
+// hostsTTL is how long addresses found in the hosts file are kept before it is read again
+const hostsTTL = time.Minute
+
+type systemResolver struct{}
+
+func (systemResolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	return addrs, systemResolverTTL, err
+}
+
+type dnsResolver struct {
+	conf   *dns.ClientConfig
+	client *dns.Client
+	// tcpClient repeats a query whose udp answer was truncated
+	tcpClient *dns.Client
+	hostsPath string
+}
+
+// lookup returns the addresses for host from the hosts file if it is listed there. Otherwise it asks the nameservers
+// for the A and AAAA records of host, trying each of the search domain expansions until one has either. The ttl is the
+// lowest of any record in the answers, including the CNAMEs leading to the addresses.
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if addrs := lookupHosts(r.hostsPath, host); len(addrs) > 0 {
+		return addrs, hostsTTL, nil
+	}
+
+	var lastErr error
+	for _, name := range r.conf.NameList(host) {
+		var addrs []netip.Addr
+		var ttl uint32
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			qAddrs, qTTL, err := r.query(ctx, name, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			if len(addrs) == 0 || qTTL < ttl {
+				ttl = qTTL
+			}
+			addrs = append(addrs, qAddrs...)
+		}
+
+		if len(addrs) > 0 {
+			return addrs, time.Duration(ttl) * time.Second, nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no names to look up")
+	}
+	return nil, 0, lastErr
+}
+
+// query asks each nameserver in turn for the records of type qtype, A or AAAA, for name. It returns the addresses and
+// the lowest ttl in the first answer that has any.
+func (r *dnsResolver) query(ctx context.Context, name string, qtype uint16) ([]netip.Addr, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+
+	lastErr := fmt.Errorf("%s: no nameservers", name)
+	for _, server := range r.conf.Servers {
+		addr := net.JoinHostPort(server, r.conf.Port)
+		in, _, err := r.client.ExchangeContext(ctx, m, addr)
+		if err == nil && in.Truncated {
+			// The answer did not fit in a udp response, ask again over tcp to get all the records
+			in, _, err = r.tcpClient.ExchangeContext(ctx, m, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if in.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("%s: %s", name, dns.RcodeToString[in.Rcode])
+			if in.Rcode == dns.RcodeNameError {
+				// The name does not exist, no point asking another server
+				break
+			}
+			continue
+		}
+
+		var addrs []netip.Addr
+		var ttl uint32
+		for i, ans := range in.Answer {
+			if i == 0 || ans.Header().Ttl < ttl {
+				ttl = ans.Header().Ttl
+			}
+
+			var ip net.IP
+			switch rr := ans.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+
+		if len(addrs) == 0 {
+			return nil, 0, fmt.Errorf("%s: no %s records", name, dns.TypeToString[qtype])
+		}
+
+		return addrs, ttl, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+// lookupHosts returns the addresses the hosts file at path lists for host, names are matched without regard to case
+// or a trailing dot. A missing or unreadable hosts file has no entries.
+func lookupHosts(path string, host string) []netip.Addr {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	var addrs []netip.Addr
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				addrs = append(addrs, addr)
+				break
+			}
+		}
+	}
+
+	return addrs
+}
+
+// resolvedRoutes is embedded in the devices that support tun.unsafe_routes entries with a resolve hostname
+type resolvedRoutes struct {
+	resolved *routeResolver
+}
+
+func (rr *resolvedRoutes) setRouteResolver(r *routeResolver) {
+	rr.resolved = r
+}
+
+// resolvedRouteFor returns the via and tag for ip if it is an address a resolve hostname resolved to. Resolved routes
+// are always a /32 so they are at least as specific as any other route.
+func (rr *resolvedRoutes) resolvedRouteFor(ip iputil.VpnIp) (bool, routeTarget) {
+	return rr.resolved.routeFor(ip)
+}
+
+// resolvedRouteFor6 is resolvedRouteFor for an ipv6 address, whose resolved routes are always a /128
+func (rr *resolvedRoutes) resolvedRouteFor6(ip [16]byte) (bool, routeTarget) {
+	return rr.resolved.routeFor6(ip)
+}
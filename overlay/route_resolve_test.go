@@ -0,0 +1,404 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubResolver struct {
+	answers map[string][]netip.Addr
+	ttls    map[string]time.Duration
+	err     error
+	lookups []string
+}
+
+func (s *stubResolver) lookup(_ context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	s.lookups = append(s.lookups, host)
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	return s.answers[host], s.ttls[host], nil
+}
+
+func Test_parseResolveRoutes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+
+	// Nothing to resolve
+	rr, err := newRouteResolverFromConfig(c, l, n)
+	assert.NoError(t, err)
+	assert.Nil(t, rr)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.1", "route": "1.0.0.0/24", "resolve": "example.com"},
+	}}
+	_, err = parseResolveRoutes(c)
+	assert.EqualError(t, err, "entry 1 in tun.unsafe_routes can not have both a route and a resolve hostname")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.1", "resolve": "example.com", "on_unreachable": "next"},
+	}}
+	_, err = parseResolveRoutes(c)
+	assert.EqualError(t, err, "entry 1.on_unreachable in tun.unsafe_routes is not supported with a resolve hostname")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"resolve": "example.com"},
+	}}
+	_, err = parseResolveRoutes(c)
+	assert.EqualError(t, err, "entry 1.via in tun.unsafe_routes is not present")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.1", "resolve": ""},
+	}}
+	_, err = parseResolveRoutes(c)
+	assert.EqualError(t, err, "entry 1.resolve in tun.unsafe_routes is not a hostname: ")
+
+	// Resolve entries are left out of the regular unsafe routes and the other way around
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"unsafe_routes": []interface{}{
+			map[interface{}]interface{}{"via": "10.0.0.1", "route": "1.0.0.0/24"},
+			map[interface{}]interface{}{"via": "10.0.0.2", "resolve": "example.com"},
+		},
+		"resolve": map[interface{}]interface{}{"max_addresses": 0},
+	}
+	routes, err := parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Len(t, routes, 1)
+	assert.Equal(t, "1.0.0.0/24", routes[0].Cidr.String())
+
+	resolveRoutes, err := parseResolveRoutes(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []resolveRoute{{hostname: "example.com", via: iputil.Ip2VpnIp(net.IP{10, 0, 0, 2}), install: true}}, resolveRoutes)
+
+	_, err = newRouteResolverFromConfig(c, l, n)
+	assert.EqualError(t, err, "tun.resolve.max_addresses must be greater than 0: 0")
+}
+
+func TestRouteResolver_resolve(t *testing.T) {
+	l := test.NewLogger()
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	via1 := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+	via2 := iputil.Ip2VpnIp(net.IP{10, 0, 0, 2})
+
+	s := &stubResolver{answers: map[string][]netip.Addr{
+		"a.example.com": {netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("1.1.1.2"), netip.MustParseAddr("1.1.1.1")},
+		"b.example.com": {netip.MustParseAddr("2.2.2.2"), netip.MustParseAddr("10.0.0.50")},
+		"c.example.com": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("::ffff:3.3.3.3")},
+	}}
+
+	rr := newRouteResolver(l, s, n, []resolveRoute{
+		{hostname: "a.example.com", via: via1},
+		{hostname: "b.example.com", via: via2},
+		{hostname: "c.example.com", via: via2},
+	}, time.Second, time.Hour, 0, time.Second, 2)
+
+	routeFor := func(ip string) iputil.VpnIp {
+		ok, r := rr.routeFor(iputil.Ip2VpnIp(net.ParseIP(ip)))
+		if !ok {
+			return 0
+		}
+		return r.via
+	}
+
+	// Nothing is routed until the first lookup
+	assert.Equal(t, iputil.VpnIp(0), routeFor("1.1.1.1"))
+
+	now := time.Now()
+
+	now = now.Add(time.Hour)
+	rr.resolve(context.Background(), now)
+	assert.Equal(t, via1, routeFor("1.1.1.1"))
+	assert.Equal(t, via1, routeFor("1.1.1.2"))
+	assert.Equal(t, via2, routeFor("2.2.2.2"))
+	// Addresses in our own network are never routed
+	assert.Equal(t, iputil.VpnIp(0), routeFor("10.0.0.50"))
+	// Ipv6 addresses are routed as well, v4 mapped ones as the ipv4 address
+	ok, r := rr.routeFor6(netip.MustParseAddr("2001:db8::1").As16())
+	assert.True(t, ok)
+	assert.Equal(t, via2, r.via)
+	ok, _ = rr.routeFor6(netip.MustParseAddr("2001:db8::2").As16())
+	assert.False(t, ok)
+	assert.Equal(t, via2, routeFor("3.3.3.3"))
+
+	// The addresses change, the old ones are gone and the new ones route
+	s.answers["a.example.com"] = []netip.Addr{netip.MustParseAddr("1.1.1.3")}
+	tree := rr.tree.Load()
+	now = now.Add(time.Hour)
+	rr.resolve(context.Background(), now)
+	assert.NotSame(t, tree, rr.tree.Load())
+	assert.Equal(t, iputil.VpnIp(0), routeFor("1.1.1.1"))
+	assert.Equal(t, iputil.VpnIp(0), routeFor("1.1.1.2"))
+	assert.Equal(t, via1, routeFor("1.1.1.3"))
+	assert.Equal(t, via2, routeFor("2.2.2.2"))
+
+	// Nothing changed, the tree stays as is
+	tree = rr.tree.Load()
+	now = now.Add(time.Hour)
+	rr.resolve(context.Background(), now)
+	assert.Same(t, tree, rr.tree.Load())
+
+	// Only max_addresses are routed for a hostname
+	s.answers["a.example.com"] = []netip.Addr{netip.MustParseAddr("1.1.1.6"), netip.MustParseAddr("1.1.1.5"), netip.MustParseAddr("1.1.1.4")}
+	now = now.Add(time.Hour)
+	rr.resolve(context.Background(), now)
+	assert.Equal(t, via1, routeFor("1.1.1.4"))
+	assert.Equal(t, via1, routeFor("1.1.1.5"))
+	assert.Equal(t, iputil.VpnIp(0), routeFor("1.1.1.6"))
+
+	// A failed lookup keeps the last addresses while their ttl lasts
+	s.ttls = map[string]time.Duration{"a.example.com": time.Minute, "b.example.com": time.Minute, "c.example.com": time.Minute}
+	now = now.Add(time.Hour)
+	rr.resolve(context.Background(), now)
+	s.err = errors.New("dns is down")
+	next := rr.resolve(context.Background(), now.Add(time.Minute-time.Second))
+	assert.Equal(t, via1, routeFor("1.1.1.4"))
+	assert.Equal(t, via2, routeFor("2.2.2.2"))
+	// It is retried after min_ttl, which here is also when the addresses expire
+	assert.Equal(t, now.Add(time.Minute), next)
+
+	// Once the ttl runs out they are no longer routed
+	rr.resolve(context.Background(), now.Add(time.Minute))
+	assert.Equal(t, iputil.VpnIp(0), routeFor("1.1.1.4"))
+	assert.Equal(t, iputil.VpnIp(0), routeFor("2.2.2.2"))
+}
+
+type stubInstaller struct {
+	installed []string
+}
+
+func (s *stubInstaller) installResolvedRoutes(old, new []Route) {
+	s.installed = nil
+	for _, r := range new {
+		s.installed = append(s.installed, r.Cidr.String()+" via "+r.Via.String())
+	}
+}
+
+func TestRouteResolver_install(t *testing.T) {
+	l := test.NewLogger()
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	via := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+
+	s := &stubResolver{answers: map[string][]netip.Addr{
+		"a.example.com": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("1.1.1.2")},
+		"b.example.com": {netip.MustParseAddr("2.2.2.2")},
+	}}
+
+	rr := newRouteResolver(l, s, n, []resolveRoute{
+		{hostname: "a.example.com", via: via, install: true},
+		{hostname: "b.example.com", via: via},
+	}, time.Second, time.Hour, 0, time.Second, 64)
+	si := &stubInstaller{}
+	rr.installer = si
+
+	// Every address of an entry with install gets a /32 or /128 through the device
+	now := time.Now()
+	rr.resolve(context.Background(), now)
+	assert.Equal(t, []string{"1.1.1.1/32 via 10.0.0.1", "1.1.1.2/32 via 10.0.0.1", "2001:db8::1/128 via 10.0.0.1"}, si.installed)
+	ok, _ := rr.routeFor(iputil.Ip2VpnIp(net.IP{2, 2, 2, 2}))
+	assert.True(t, ok)
+
+	// The installed routes follow the addresses
+	s.answers["a.example.com"] = []netip.Addr{netip.MustParseAddr("1.1.1.3")}
+	rr.resolve(context.Background(), now.Add(time.Hour))
+	assert.Equal(t, []string{"1.1.1.3/32 via 10.0.0.1"}, si.installed)
+	assert.Len(t, rr.installed, 1)
+}
+
+func TestRouteResolver_installLimit(t *testing.T) {
+	l := test.NewLogger()
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	via := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+
+	s := &stubResolver{answers: map[string][]netip.Addr{
+		"a.example.com": {netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("1.1.1.2"), netip.MustParseAddr("1.1.1.3")},
+	}}
+
+	rr := newRouteResolver(l, s, n, []resolveRoute{
+		{hostname: "a.example.com", via: via, install: true},
+	}, time.Second, time.Hour, 0, time.Second, 64)
+	si := &stubInstaller{}
+	rr.installer = si
+
+	// Two static routes of a tun.max_routes of 4 leave room for 2 resolved routes
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`tun: {max_routes: 4}`))
+	_, r1, _ := net.ParseCIDR("2.0.0.0/24")
+	_, r2, _ := net.ParseCIDR("3.0.0.0/24")
+	rr.setInstallLimit(resolvedRouteLimit(c, []Route{{Cidr: r1, Install: true}, {Cidr: r2, Install: true}, {Cidr: r2}}))
+
+	// The routes past the limit are not installed but are still routed within nebula
+	rr.resolve(context.Background(), time.Now())
+	assert.Equal(t, []string{"1.1.1.1/32 via 10.0.0.1", "1.1.1.2/32 via 10.0.0.1"}, si.installed)
+	ok, _ := rr.routeFor(iputil.Ip2VpnIp(net.IP{1, 1, 1, 3}))
+	assert.True(t, ok)
+
+	// A new limit is applied right away
+	rr.setInstallLimit(1)
+	assert.Equal(t, []string{"1.1.1.1/32 via 10.0.0.1"}, si.installed)
+
+	// Static routes that use the whole of tun.max_routes leave no room
+	rr.setInstallLimit(resolvedRouteLimit(c, []Route{{Cidr: r1, Install: true}, {Cidr: r2, Install: true}, {Cidr: r1, Install: true}, {Cidr: r2, Install: true}}))
+	assert.Empty(t, si.installed)
+
+	// No tun.max_routes is no limit
+	require.NoError(t, c.ReloadConfigString(`tun: {}`))
+	rr.setInstallLimit(resolvedRouteLimit(c, nil))
+	assert.Len(t, si.installed, 3)
+}
+
+func TestRouteResolver_ttl(t *testing.T) {
+	l := test.NewLogger()
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	via := iputil.Ip2VpnIp(net.IP{10, 0, 0, 1})
+
+	s := &stubResolver{
+		answers: map[string][]netip.Addr{
+			"short.example.com": {netip.MustParseAddr("1.1.1.1")},
+			"long.example.com":  {netip.MustParseAddr("2.2.2.2")},
+			"tiny.example.com":  {netip.MustParseAddr("3.3.3.3")},
+			"huge.example.com":  {netip.MustParseAddr("4.4.4.4")},
+		},
+		ttls: map[string]time.Duration{
+			"short.example.com": 45 * time.Second,
+			"long.example.com":  5 * time.Minute,
+			"tiny.example.com":  time.Second,
+			"huge.example.com":  24 * time.Hour,
+		},
+	}
+
+	rr := newRouteResolver(l, s, n, []resolveRoute{
+		{hostname: "short.example.com", via: via},
+		{hostname: "long.example.com", via: via},
+		{hostname: "tiny.example.com", via: via},
+		{hostname: "huge.example.com", via: via},
+	}, 10*time.Second, 10*time.Minute, 0, time.Second, 64)
+
+	// Everything is looked up right away, tiny is clamped up to min_ttl and huge down to max_ttl
+	now := time.Now()
+	next := rr.resolve(context.Background(), now)
+	assert.Equal(t, []string{"short.example.com", "long.example.com", "tiny.example.com", "huge.example.com"}, s.lookups)
+	assert.Equal(t, now.Add(10*time.Second), next)
+	assert.Equal(t, []time.Time{now.Add(45 * time.Second), now.Add(5 * time.Minute), now.Add(10 * time.Second), now.Add(10 * time.Minute)}, rr.next)
+
+	// Only the hostnames whose ttl ran out are looked up again
+	s.lookups = nil
+	next = rr.resolve(context.Background(), now.Add(10*time.Second))
+	assert.Equal(t, []string{"tiny.example.com"}, s.lookups)
+	assert.Equal(t, now.Add(20*time.Second), next)
+
+	s.lookups = nil
+	next = rr.resolve(context.Background(), now.Add(45*time.Second))
+	assert.Equal(t, []string{"short.example.com", "tiny.example.com"}, s.lookups)
+	assert.Equal(t, now.Add(55*time.Second), next)
+
+	// A shorter ttl on the next answer is honored
+	s.lookups = nil
+	s.ttls["long.example.com"] = 20 * time.Second
+	rr.resolve(context.Background(), now.Add(5*time.Minute))
+	assert.Equal(t, []string{"short.example.com", "long.example.com", "tiny.example.com"}, s.lookups)
+	assert.Equal(t, now.Add(5*time.Minute+20*time.Second), rr.next[1])
+
+	// A failed lookup is retried after min_ttl
+	s.lookups = nil
+	s.err = errors.New("dns is down")
+	rr.resolve(context.Background(), now.Add(10*time.Minute))
+	assert.Equal(t, []string{"short.example.com", "long.example.com", "tiny.example.com", "huge.example.com"}, s.lookups)
+	assert.Equal(t, now.Add(10*time.Minute+10*time.Second), rr.next[3])
+	ok, _ := rr.routeFor(iputil.Ip2VpnIp(net.IP{4, 4, 4, 4}))
+	assert.True(t, ok)
+}
+
+func TestRouteResolver_refreshIn(t *testing.T) {
+	l := test.NewLogger()
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	rr := newRouteResolver(l, &stubResolver{}, n, nil, 10*time.Second, 10*time.Minute, 0.2, time.Second, 64)
+
+	// The full jitter moves a refresh earlier by the fraction
+	rr.rand = func() float64 { return 1 }
+	assert.Equal(t, 4*time.Minute, rr.refreshIn(5*time.Minute))
+	assert.Equal(t, 8*time.Minute, rr.refreshIn(time.Hour))
+	// But never below min_ttl
+	assert.Equal(t, 10*time.Second, rr.refreshIn(11*time.Second))
+	assert.Equal(t, 10*time.Second, rr.refreshIn(0))
+
+	// No jitter leaves the clamped ttl alone
+	rr.rand = func() float64 { return 0 }
+	assert.Equal(t, 5*time.Minute, rr.refreshIn(5*time.Minute))
+}
+
+func TestDNSResolver_lookup(t *testing.T) {
+	// Answers over udp are truncated, the full answer is only available over tcp
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+		} else if q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer,
+				&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.IP{1, 1, 1, 1}},
+				&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{2, 2, 2, 2}},
+			)
+		} else if q.Qtype == dns.TypeAAAA && q.Name != "v4.example.com." {
+			m.Answer = append(m.Answer,
+				&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 20}, AAAA: net.ParseIP("2001:db8::1")},
+			)
+		}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	require.NoError(t, err)
+
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(hosts, []byte("# comment\n127.0.0.1 localhost\n10.1.1.1 Pinned.Example.com pinned # the pinned host\n::1 pinned.example.com\n10.1.1.2 pinned.example.com.\n"), 0600))
+
+	r := &dnsResolver{
+		conf:      &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port, Ndots: 1},
+		client:    &dns.Client{},
+		tcpClient: &dns.Client{Net: "tcp"},
+		hostsPath: hosts,
+	}
+
+	// A and AAAA records are both asked for, the ttl is the lowest of either
+	addrs, ttl, err := r.lookup(context.Background(), "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2.2.2.2"), netip.MustParseAddr("2001:db8::1")}, addrs)
+	assert.Equal(t, 20*time.Second, ttl)
+
+	// A hostname without AAAA records only has its ipv4 addresses
+	addrs, ttl, err = r.lookup(context.Background(), "v4.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2.2.2.2")}, addrs)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	// Hostnames in the hosts file never reach the nameservers
+	addrs, ttl, err = r.lookup(context.Background(), "pinned.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.1.1"), netip.MustParseAddr("::1"), netip.MustParseAddr("10.1.1.2")}, addrs)
+	assert.Equal(t, hostsTTL, ttl)
+}
@@ -3,6 +3,8 @@ package overlay
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/slackhq/nebula/config"
@@ -69,6 +71,12 @@ func Test_parseRoutes(t *testing.T) {
 	assert.Nil(t, routes)
 	assert.EqualError(t, err, "entry 1.route in tun.routes failed to parse: invalid CIDR address: nope")
 
+	// ipv6 route, the vpn network is always ipv4
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{map[interface{}]interface{}{"mtu": "500", "route": "fd00::/64"}}}
+	routes, err = parseRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.route in tun.routes is not contained within the network attached to the certificate; route: fd00::/64, network: 10.0.0.0/24")
+
 	// below network range
 	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{map[interface{}]interface{}{"mtu": "500", "route": "1.0.0.0/8"}}}
 	routes, err = parseRoutes(c, n)
@@ -109,6 +117,144 @@ func Test_parseRoutes(t *testing.T) {
 	}
 }
 
+func Test_parseRouteMTUs(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+
+	// mtu4 overrides mtu for an ipv4 route
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{
+		map[interface{}]interface{}{"mtu": "1300", "mtu4": 1400, "route": "10.0.0.0/29"},
+		map[interface{}]interface{}{"mtu": "1300", "route": "10.0.0.8/29"},
+		map[interface{}]interface{}{"mtu4": "1420", "route": "10.0.0.16/29"},
+	}}
+	routes, err := parseRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1400, 1300, 1420}, []int{routes[0].MTU, routes[1].MTU, routes[2].MTU})
+
+	// tun.routes are always ipv4
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{
+		map[interface{}]interface{}{"mtu": "1300", "mtu6": "1280", "route": "10.0.0.0/29"},
+	}}
+	_, err = parseRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu6 in tun.routes is not supported, these routes are always ipv4")
+
+	// The floor applies to mtu4 as well
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{
+		map[interface{}]interface{}{"mtu4": "0", "route": "10.0.0.0/29"},
+	}}
+	_, err = parseRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu4 in tun.routes is below 500: 0")
+
+	// The floor applies to each family
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "1300", "mtu6": "499", "route": "fd00::/64"},
+	}}
+	_, err = parseUnsafeRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu6 in tun.unsafe_routes is below 500: 499")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu4": "nope", "route": "1.0.0.0/8"},
+	}}
+	_, err = parseUnsafeRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu4 in tun.unsafe_routes is not an integer: strconv.Atoi: parsing \"nope\": invalid syntax")
+
+	// An unsafe route without an mtu for its family follows the tun mtu
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu4": "1400", "route": "1.0.0.0/8"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu6": "1280", "route": "2.0.0.0/8"},
+	}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1400, 0}, []int{routes[0].MTU, routes[1].MTU})
+
+	// An ipv6 unsafe route picks mtu6, or mtu, and neither may be below the ipv6 minimum
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "1300", "mtu6": "1400", "route": "fd00::/64"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "1300", "mtu4": "1400", "route": "fd01::/64"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu4": "1400", "route": "fd02::/64"},
+	}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1400, 1300, 0}, []int{routes[0].MTU, routes[1].MTU, routes[2].MTU})
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "1400", "mtu6": "1200", "route": "fd00::/64"},
+	}}
+	_, err = parseUnsafeRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu6 in tun.unsafe_routes is below the ipv6 minimum of 1280 for an ipv6 route: 1200")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "1200", "route": "fd00::/64"},
+	}}
+	_, err = parseUnsafeRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.mtu in tun.unsafe_routes is below the ipv6 minimum of 1280 for an ipv6 route: 1200")
+
+	mtus := routeMTUs{mtu: 1300, mtu4: 1400, mtu6: 1280}
+	_, v6, _ := net.ParseCIDR("fd00::/64")
+	assert.Equal(t, 1280, mtus.forFamily(v6))
+	assert.Equal(t, 1300, routeMTUs{mtu: 1300, mtu4: 1400}.forFamily(v6))
+}
+
+func Test_parseRouteSrc(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	n := &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"routes": []interface{}{
+			map[interface{}]interface{}{"mtu": "1300", "route": "10.0.0.128/25", "src": "10.0.0.1"},
+		},
+		"unsafe_routes": []interface{}{
+			map[interface{}]interface{}{"via": "10.0.0.2", "route": "1.0.0.0/24", "src": "10.0.0.1"},
+			map[interface{}]interface{}{"via": "10.0.0.2", "route": "2.0.0.0/24"},
+		},
+	}
+	routes, err := parseRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, routes[0].Src)
+
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, routes[0].Src)
+	assert.Nil(t, routes[1].Src)
+
+	// src must be our own overlay ip
+	c.Settings["tun"] = map[interface{}]interface{}{"routes": []interface{}{
+		map[interface{}]interface{}{"mtu": "1300", "route": "10.0.0.128/25", "src": "10.0.0.2"},
+	}}
+	_, err = parseRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.src in tun.routes is not an overlay ip of this node; src: 10.0.0.2, vpn ip: 10.0.0.1")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "1.0.0.0/24", "src": "nope"},
+	}}
+	_, err = parseUnsafeRoutes(c, n)
+	assert.EqualError(t, err, "entry 1.src in tun.unsafe_routes failed to parse address: nope")
+}
+
+func Test_renumberRouteSrc(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	n := &net.IPNet{IP: net.IP{10, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "1.0.0.0/24", "src": "10.0.0.1"},
+		map[interface{}]interface{}{"via": "10.0.0.2", "route": "2.0.0.0/24"},
+	}}
+	routes, err := parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+
+	// After a renumber the routes with a src use the new vpn ip, the rest still let the kernel pick
+	renumbered := renumberRouteSrc(routes, net.ParseIP("10.0.0.9"))
+	assert.Equal(t, net.IP{10, 0, 0, 9}, renumbered[0].Src)
+	assert.Nil(t, renumbered[1].Src)
+	assert.Equal(t, routes[0].Cidr, renumbered[0].Cidr)
+
+	// The original routes are left alone
+	assert.Equal(t, net.IP{10, 0, 0, 1}, routes[0].Src)
+}
+
 func Test_parseUnsafeRoutes(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
@@ -171,6 +317,32 @@ func Test_parseUnsafeRoutes(t *testing.T) {
 	assert.Nil(t, routes)
 	assert.EqualError(t, err, "entry 1.route in tun.unsafe_routes failed to parse: invalid CIDR address: nope")
 
+	// ipv6 via
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "fd00::1", "route": "1.0.0.0/8"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.via in tun.unsafe_routes is not an ipv4 address, vpn ips are ipv4 only: fd00::1")
+
+	// ipv6 route, this used to be truncated into 0.0.0.0/0
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "2001:db8::/64"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, err)
+	assert.Len(t, routes, 1)
+	assert.Equal(t, "2001:db8::/64", routes[0].Cidr.String())
+	assert.Equal(t, "127.0.0.1", routes[0].Via.String())
+
+	// ipv6 route with a src, which is always the ipv4 vpn ip
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "2001:db8::/64", "src": "10.0.0.0"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.src in tun.unsafe_routes can not be used on an ipv6 route: 2001:db8::/64")
+
+	// ipv4 mapped ipv6 route
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "::ffff:1.0.0.0/104"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.route in tun.unsafe_routes is an ipv4 mapped ipv6 network, use the ipv4 network: ::ffff:1.0.0.0/104")
+
 	// within network range
 	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "10.0.0.0/24"}}}
 	routes, err = parseUnsafeRoutes(c, n)
@@ -213,6 +385,30 @@ func Test_parseUnsafeRoutes(t *testing.T) {
 	assert.Nil(t, routes)
 	assert.EqualError(t, err, "entry 1.install in tun.unsafe_routes is not a boolean: strconv.ParseBool: parsing \"nope\": invalid syntax")
 
+	// bad tag
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.0/29", "tag": "my office"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.tag in tun.unsafe_routes must only contain letters, numbers, _ and -: my office")
+
+	// bad on_unreachable
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.0/29", "on_unreachable": "retry"}}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, routes)
+	assert.EqualError(t, err, "entry 1.on_unreachable in tun.unsafe_routes must be one of drop, reject or next: retry")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.0/29"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.8/29", "on_unreachable": "drop"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.16/29", "on_unreachable": "reject"},
+		map[interface{}]interface{}{"via": "127.0.0.1", "route": "1.0.0.24/29", "on_unreachable": "next"},
+	}}
+	routes, err = parseUnsafeRoutes(c, n)
+	assert.Nil(t, err)
+	assert.Equal(t, []OnUnreachable{OnUnreachableDrop, OnUnreachableDrop, OnUnreachableReject, OnUnreachableNext}, []OnUnreachable{
+		routes[0].OnUnreachable, routes[1].OnUnreachable, routes[2].OnUnreachable, routes[3].OnUnreachable,
+	})
+
 	// happy case
 	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
 		map[interface{}]interface{}{"via": "127.0.0.1", "mtu": "9000", "route": "1.0.0.0/29", "install": "t"},
@@ -249,6 +445,58 @@ func Test_parseUnsafeRoutes(t *testing.T) {
 	}
 }
 
+func Test_parseRouteTable(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rtTables := filepath.Join(t.TempDir(), "rt_tables")
+	assert.Nil(t, os.WriteFile(rtTables, []byte("# comment\n255\tlocal\n100 nebula\nbad  broken\n"), 0600))
+	oldPath := rtTablesPath
+	rtTablesPath = rtTables
+	defer func() { rtTablesPath = oldPath }()
+
+	// defaults to main
+	table, err := parseRouteTable(c)
+	assert.Nil(t, err)
+	assert.Equal(t, RouteTableMain, table)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": 100}
+	table, err = parseRouteTable(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, table)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": "main"}
+	table, err = parseRouteTable(c)
+	assert.Nil(t, err)
+	assert.Equal(t, RouteTableMain, table)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": "200"}
+	table, err = parseRouteTable(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, table)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": "nebula"}
+	table, err = parseRouteTable(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, table)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": "broken"}
+	_, err = parseRouteTable(c)
+	assert.EqualError(t, err, "tun.route_table broken has an invalid id in "+rtTables+": bad")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": "nope"}
+	_, err = parseRouteTable(c)
+	assert.EqualError(t, err, "tun.route_table nope was not found in "+rtTables)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": 0}
+	_, err = parseRouteTable(c)
+	assert.EqualError(t, err, "tun.route_table 0 is out of range")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"route_table": true}
+	_, err = parseRouteTable(c)
+	assert.EqualError(t, err, "tun.route_table must be an integer or a table name, got: true")
+}
+
 func Test_makeRouteTree(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
@@ -256,7 +504,7 @@ func Test_makeRouteTree(t *testing.T) {
 
 	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
 		map[interface{}]interface{}{"via": "192.168.0.1", "route": "1.0.0.0/28"},
-		map[interface{}]interface{}{"via": "192.168.0.2", "route": "1.0.0.1/32"},
+		map[interface{}]interface{}{"via": "192.168.0.2", "route": "1.0.0.1/32", "tag": "office"},
 	}}
 	routes, err := parseUnsafeRoutes(c, n)
 	assert.NoError(t, err)
@@ -267,14 +515,168 @@ func Test_makeRouteTree(t *testing.T) {
 	ip := iputil.Ip2VpnIp(net.ParseIP("1.0.0.2"))
 	ok, r := routeTree.MostSpecificContains(ip)
 	assert.True(t, ok)
-	assert.Equal(t, iputil.Ip2VpnIp(net.ParseIP("192.168.0.1")), r)
+	assert.Equal(t, routeTarget{via: iputil.Ip2VpnIp(net.ParseIP("192.168.0.1"))}, r)
 
 	ip = iputil.Ip2VpnIp(net.ParseIP("1.0.0.1"))
 	ok, r = routeTree.MostSpecificContains(ip)
 	assert.True(t, ok)
-	assert.Equal(t, iputil.Ip2VpnIp(net.ParseIP("192.168.0.2")), r)
+	// The tag of the matching route comes along with the via
+	assert.Equal(t, iputil.Ip2VpnIp(net.ParseIP("192.168.0.2")), r.via)
+	assert.Equal(t, "office", r.tag)
 
 	ip = iputil.Ip2VpnIp(net.ParseIP("1.1.0.1"))
 	ok, r = routeTree.MostSpecificContains(ip)
 	assert.False(t, ok)
+
+	// v6 routes are kept apart from the v4 routes
+	via := iputil.Ip2VpnIp(net.ParseIP("192.168.0.3"))
+	_, v6Cidr, _ := net.ParseCIDR("fd00::/64")
+	routeTree, err = makeRouteTree(l, append(routes, Route{Cidr: v6Cidr, Via: &via}), true)
+	assert.NoError(t, err)
+
+	ok, r = routeTree.MostSpecificContainsIP(net.ParseIP("fd00::1.0.0.2"))
+	assert.True(t, ok)
+	assert.Equal(t, via, r.via)
+
+	var ip6 [16]byte
+	copy(ip6[:], net.ParseIP("fd00::1.0.0.2"))
+	rVia, _ := routeTagFor6(routeTree, ip6)
+	assert.Equal(t, via, rVia)
+
+	copy(ip6[:], net.ParseIP("fd01::1"))
+	rVia, _ = routeTagFor6(routeTree, ip6)
+	assert.Equal(t, iputil.VpnIp(0), rVia)
+
+	ok, r = routeTree.MostSpecificContains(iputil.Ip2VpnIp(net.ParseIP("1.0.0.2")))
+	assert.True(t, ok)
+	assert.Equal(t, routeTarget{via: iputil.Ip2VpnIp(net.ParseIP("192.168.0.1"))}, r)
+}
+
+func Test_routeMatches(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"unsafe_routes": []interface{}{
+		map[interface{}]interface{}{"via": "192.168.0.1", "route": "0.0.0.0/0", "on_unreachable": "reject"},
+		map[interface{}]interface{}{"via": "192.168.0.2", "route": "1.0.0.0/28", "tag": "office", "on_unreachable": "next"},
+		map[interface{}]interface{}{"via": "192.168.0.3", "route": "1.0.0.0/30", "on_unreachable": "next"},
+		map[interface{}]interface{}{"via": "192.168.0.4", "route": "1.0.0.8/30"},
+		map[interface{}]interface{}{"via": "192.168.0.5", "route": "2.0.0.0/24", "on_unreachable": "next"},
+	}}
+	routes, err := parseUnsafeRoutes(c, n)
+	assert.NoError(t, err)
+	routeTree, err := makeRouteTree(l, routes, true)
+	assert.NoError(t, err)
+
+	via := func(ip string) iputil.VpnIp {
+		return iputil.Ip2VpnIp(net.ParseIP(ip))
+	}
+
+	// Every route that contains the address, most specific first
+	assert.Equal(t, []RouteMatch{
+		{Via: via("192.168.0.3"), OnUnreachable: OnUnreachableNext},
+		{Via: via("192.168.0.2"), Tag: "office", OnUnreachable: OnUnreachableNext},
+		{Via: via("192.168.0.1"), OnUnreachable: OnUnreachableReject},
+	}, routeMatches(routeTree, via("1.0.0.1")))
+
+	// A sibling of a route is not a match
+	assert.Equal(t, []RouteMatch{
+		{Via: via("192.168.0.4")},
+		{Via: via("192.168.0.2"), Tag: "office", OnUnreachable: OnUnreachableNext},
+		{Via: via("192.168.0.1"), OnUnreachable: OnUnreachableReject},
+	}, routeMatches(routeTree, via("1.0.0.9")))
+
+	assert.Equal(t, []RouteMatch{
+		{Via: via("192.168.0.5"), OnUnreachable: OnUnreachableNext},
+		{Via: via("192.168.0.1"), OnUnreachable: OnUnreachableReject},
+	}, routeMatches(routeTree, via("2.0.0.1")))
+
+	assert.Equal(t, []RouteMatch{{Via: via("192.168.0.1"), OnUnreachable: OnUnreachableReject}}, routeMatches(routeTree, via("3.0.0.1")))
+
+	// Without a default route there may be nothing to match
+	routeTree, err = makeRouteTree(l, routes[1:], true)
+	assert.NoError(t, err)
+	assert.Nil(t, routeMatches(routeTree, via("3.0.0.1")))
+}
+
+func Test_routeOverlaps(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.128.0.0/16")
+	route := func(cidr string, via string) Route {
+		_, n, _ := net.ParseCIDR(cidr)
+		r := Route{Cidr: n, Install: true}
+		if via != "" {
+			v := iputil.Ip2VpnIp(net.ParseIP(via))
+			r.Via = &v
+		}
+		return r
+	}
+
+	routes := []Route{route("10.128.1.0/24", ""), route("10.128.2.0/24", "")}
+
+	// Unsafe routes outside of the vpn network do not overlap anything
+	assert.Empty(t, routeOverlaps(network, routes, []Route{route("192.168.0.0/16", "10.128.0.1"), route("10.0.0.0/16", "10.128.0.1")}))
+
+	// A supernet of the vpn network overlaps it and every safe route
+	assert.Equal(t, []string{
+		"tun.unsafe_routes entry 10.0.0.0/8 overlaps the network attached to the certificate 10.128.0.0/16, traffic for the network is never sent via 10.128.0.1",
+		"tun.unsafe_routes entry 10.0.0.0/8 overlaps tun.routes entry 10.128.1.0/24, the tun.routes entry takes precedence",
+		"tun.unsafe_routes entry 10.0.0.0/8 overlaps tun.routes entry 10.128.2.0/24, the tun.routes entry takes precedence",
+	}, routeOverlaps(network, routes, []Route{route("10.0.0.0/8", "10.128.0.1")}))
+
+	// Without safe routes only the network is reported
+	assert.Len(t, routeOverlaps(network, nil, []Route{route("0.0.0.0/0", "10.128.0.1")}), 1)
+
+	assert.True(t, cidrsOverlap(network, routes[0].Cidr))
+	assert.True(t, cidrsOverlap(routes[0].Cidr, network))
+	assert.False(t, cidrsOverlap(routes[0].Cidr, routes[1].Cidr))
+}
+
+func Test_limitRoutes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	route := func(cidr string, install bool) Route {
+		_, n, _ := net.ParseCIDR(cidr)
+		return Route{Cidr: n, Install: install}
+	}
+	routes := []Route{
+		route("10.0.1.0/24", true),
+		route("10.0.2.0/24", false),
+		route("10.0.3.0/24", true),
+		route("10.0.4.0/24", true),
+	}
+
+	// No limit by default
+	limited, err := limitRoutes(l, c, routes)
+	assert.NoError(t, err)
+	assert.Equal(t, routes, limited)
+
+	// Routes that are not installed do not count
+	c.Settings["tun"] = map[interface{}]interface{}{"max_routes": 3}
+	limited, err = limitRoutes(l, c, routes)
+	assert.NoError(t, err)
+	assert.Equal(t, routes, limited)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"max_routes": 2}
+	_, err = limitRoutes(l, c, routes)
+	assert.EqualError(t, err, "tun.routes and tun.unsafe_routes would install 3 routes, more than tun.max_routes: 2")
+
+	// Truncating keeps every route but only installs up to the limit
+	c.Settings["tun"] = map[interface{}]interface{}{"max_routes": 2, "max_routes_action": "truncate"}
+	limited, err = limitRoutes(l, c, routes)
+	assert.NoError(t, err)
+	assert.Len(t, limited, 4)
+	assert.True(t, limited[0].Install)
+	assert.False(t, limited[1].Install)
+	assert.True(t, limited[2].Install)
+	assert.False(t, limited[3].Install)
+	assert.True(t, routes[3].Install, "the routes passed in should not be changed")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"max_routes": -1}
+	_, err = limitRoutes(l, c, routes)
+	assert.EqualError(t, err, "tun.max_routes can not be negative: -1")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"max_routes": 2, "max_routes_action": "nope"}
+	_, err = limitRoutes(l, c, routes)
+	assert.EqualError(t, err, "tun.max_routes_action must be error or truncate: nope")
 }
@@ -1,7 +1,10 @@
 package overlay
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"runtime"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -10,7 +13,30 @@ import (
 
 const DefaultMTU = 1300
 
-func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr *net.IPNet, fd *int, routines int) (Device, error) {
+// routeResolverSetter is implemented by the devices that support tun.unsafe_routes entries with a resolve hostname
+type routeResolverSetter interface {
+	setRouteResolver(*routeResolver)
+}
+
+func NewDeviceFromConfig(ctx context.Context, c *config.C, l *logrus.Logger, tunCidr *net.IPNet, fd *int, routines int) (Device, error) {
+	disabledBy := ""
+	switch {
+	case c.GetBool("lighthouse.serve_only", false):
+		disabledBy = "lighthouse.serve_only"
+	case c.GetBool("tun.disabled", false):
+		disabledBy = "tun.disabled"
+	}
+
+	if disabledBy != "" {
+		// No device is opened and nothing is installed, the node only handles handshakes, lighthouse and relay traffic
+		if err := validateDisabledTun(c, disabledBy); err != nil {
+			return nil, util.NewContextualError("Invalid tun config", nil, err)
+		}
+
+		tun := newDisabledTun(tunCidr, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), util.MetricsRegistry(c), l)
+		return tun, nil
+	}
+
 	routes, err := parseRoutes(c, tunCidr)
 	if err != nil {
 		return nil, util.NewContextualError("Could not parse tun.routes", nil, err)
@@ -20,15 +46,35 @@ func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr *net.IPNet, fd *
 	if err != nil {
 		return nil, util.NewContextualError("Could not parse tun.unsafe_routes", nil, err)
 	}
-	routes = append(routes, unsafeRoutes...)
+	warnRouteOverlaps(l, tunCidr, routes, unsafeRoutes)
+	routes, err = limitRoutes(l, c, append(routes, unsafeRoutes...))
+	if err != nil {
+		return nil, util.NewContextualError("Could not apply tun.max_routes", nil, err)
+	}
 
-	switch {
-	case c.GetBool("tun.disabled", false):
-		tun := newDisabledTun(tunCidr, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
-		return tun, nil
+	routeTable, err := parseRouteTable(c)
+	if err != nil {
+		return nil, util.NewContextualError("Could not parse tun.route_table", nil, err)
+	}
+
+	ipRules, err := parseIPRules(c, routeTable)
+	if err != nil {
+		return nil, util.NewContextualError("Could not parse tun.ip_rules", nil, err)
+	}
+
+	if len(ipRules) > 0 && runtime.GOOS != "linux" {
+		l.Warnf("tun.ip_rules is not supported in %s and will be ignored", runtime.GOOS)
+	}
+
+	rr, err := newRouteResolverFromConfig(c, l, tunCidr)
+	if err != nil {
+		return nil, util.NewContextualError("Could not parse tun.unsafe_routes", nil, err)
+	}
 
+	var d Device
+	switch {
 	case fd != nil:
-		return newTunFromFd(
+		d, err = newTunFromFd(
 			l,
 			*fd,
 			tunCidr,
@@ -36,10 +82,12 @@ func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr *net.IPNet, fd *
 			routes,
 			c.GetInt("tun.tx_queue", 500),
 			c.GetBool("tun.use_system_route_table", false),
+			routeTable,
+			ipRules,
 		)
 
 	default:
-		return newTun(
+		d, err = newTun(
 			l,
 			c.GetString("tun.dev", ""),
 			tunCidr,
@@ -48,6 +96,62 @@ func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr *net.IPNet, fd *
 			c.GetInt("tun.tx_queue", 500),
 			routines > 1,
 			c.GetBool("tun.use_system_route_table", false),
+			routeTable,
+			ipRules,
 		)
 	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	wireRouteReload(c, l, d, routes, rr)
+
+	rd, err := newRouteDriftCheckerFromConfig(c, l, d)
+	if err != nil {
+		return nil, util.NewContextualError("Could not parse tun.route_drift_interval", nil, err)
+	}
+
+	if rd != nil {
+		go rd.run(ctx)
+	}
+
+	if rr == nil {
+		return d, nil
+	}
+
+	rs, ok := d.(routeResolverSetter)
+	if !ok {
+		l.Warnf("tun.unsafe_routes with a resolve hostname are not supported in %s and will be ignored", runtime.GOOS)
+		return d, nil
+	}
+
+	rs.setRouteResolver(rr)
+	if ri, ok := d.(resolvedRouteInstaller); ok {
+		rr.installer = ri
+		rr.setInstallLimit(resolvedRouteLimit(c, routes))
+	} else {
+		l.Infof("tun.unsafe_routes with a resolve hostname are not installed in the route table in %s, a route that covers the addresses must send them to nebula", runtime.GOOS)
+	}
+	go rr.run(ctx)
+	return d, nil
+}
+
+// validateDisabledTun returns an error if anything that would be installed on a tun device is configured while the
+// tun is disabled by disabledBy
+func validateDisabledTun(c *config.C, disabledBy string) error {
+	for _, k := range []string{"tun.routes", "tun.unsafe_routes", "tun.ip_rules"} {
+		v := c.Get(k)
+		if v == nil {
+			continue
+		}
+
+		if l, ok := v.([]interface{}); ok && len(l) == 0 {
+			continue
+		}
+
+		return fmt.Errorf("%s can not be set when %s is true", k, disabledBy)
+	}
+
+	return nil
 }
@@ -21,11 +21,12 @@ import (
 
 type tun struct {
 	io.ReadWriteCloser
+	resolvedRoutes
 	Device     string
 	cidr       *net.IPNet
 	DefaultMTU int
 	Routes     []Route
-	routeTree  *cidr.Tree4[iputil.VpnIp]
+	routeTree  *cidr.RouteTree[routeTarget]
 	l          *logrus.Logger
 
 	// cache out buffer since we need to prepend 4 bytes for tun metadata
@@ -69,7 +70,7 @@ type ifreqMTU struct {
 	pad  [8]byte
 }
 
-func newTun(l *logrus.Logger, name string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool) (*tun, error) {
+func newTun(l *logrus.Logger, name string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool, _ int, _ []IPRule) (*tun, error) {
 	routeTree, err := makeRouteTree(l, routes, false)
 	if err != nil {
 		return nil, err
@@ -162,7 +163,7 @@ func (t *tun) deviceBytes() (o [16]byte) {
 	return
 }
 
-func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool) (*tun, error) {
+func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool, _ int, _ []IPRule) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in Darwin")
 }
 
@@ -284,6 +285,11 @@ func (t *tun) Activate() error {
 			continue
 		}
 
+		if isIPv6Route(r) {
+			t.l.WithField("route", r.Cidr).Warn("ipv6 unsafe_routes are not installed on this platform, add the route to the system by hand")
+			continue
+		}
+
 		copy(routeAddr.IP[:], r.Cidr.IP.To4())
 		copy(maskAddr.IP[:], net.IP(r.Cidr.Mask).To4())
 
@@ -304,12 +310,33 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	ok, r := t.routeTree.MostSpecificContains(ip)
-	if ok {
-		return r
+	r, _ := t.RouteTagFor(ip)
+	return r
+}
+
+func (t *tun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *tun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *tun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
 	}
 
-	return 0
+	return routeTagFor6(t.routeTree, ip)
 }
 
 // Get the LinkAddr for the interface of the given name
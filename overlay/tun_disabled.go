@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
@@ -13,7 +14,7 @@ import (
 
 type disabledTun struct {
 	read chan []byte
-	cidr *net.IPNet
+	cidr atomic.Pointer[net.IPNet]
 
 	// Track these metrics since we don't have the tun device to do it for us
 	tx metrics.Counter
@@ -21,16 +22,16 @@ type disabledTun struct {
 	l  *logrus.Logger
 }
 
-func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, l *logrus.Logger) *disabledTun {
+func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, registry metrics.Registry, l *logrus.Logger) *disabledTun {
 	tun := &disabledTun{
-		cidr: cidr,
 		read: make(chan []byte, queueLen),
 		l:    l,
 	}
+	tun.cidr.Store(cidr)
 
 	if metricsEnabled {
-		tun.tx = metrics.GetOrRegisterCounter("messages.tx.message", nil)
-		tun.rx = metrics.GetOrRegisterCounter("messages.rx.message", nil)
+		tun.tx = metrics.GetOrRegisterCounter("messages.tx.message", registry)
+		tun.rx = metrics.GetOrRegisterCounter("messages.rx.message", registry)
 	} else {
 		tun.tx = &metrics.NilCounter{}
 		tun.rx = &metrics.NilCounter{}
@@ -48,7 +49,13 @@ func (*disabledTun) RouteFor(iputil.VpnIp) iputil.VpnIp {
 }
 
 func (t *disabledTun) Cidr() *net.IPNet {
-	return t.cidr
+	return t.cidr.Load()
+}
+
+// SetCidr records the new address, there is no device to move
+func (t *disabledTun) SetCidr(cidr *net.IPNet) error {
+	t.cidr.Store(cidr)
+	return nil
 }
 
 func (*disabledTun) Name() string {
@@ -5,11 +5,13 @@ package overlay
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -22,18 +24,35 @@ import (
 
 type tun struct {
 	io.ReadWriteCloser
+	resolvedRoutes
 	fd         int
 	Device     string
-	cidr       *net.IPNet
+	cidr       atomic.Pointer[net.IPNet]
 	MaxMTU     int
 	DefaultMTU int
 	TXQueueLen int
 
 	Routes          []Route
-	routeTree       atomic.Pointer[cidr.Tree4[iputil.VpnIp]]
+	RouteTable      int
+	IPRules         []IPRule
+	routeTree       atomic.Pointer[cidr.RouteTree[routeTarget]]
 	routeChan       chan struct{}
 	useSystemRoutes bool
 
+	// mtuLock guards MaxMTU and Routes once the device has been activated and the link watcher is running
+	mtuLock  sync.Mutex
+	linkChan chan struct{}
+
+	// resolvedInstall are the routes for the addresses resolve hostnames resolved to, they are installed once the
+	// device is active. Both are guarded by mtuLock.
+	resolvedInstall []Route
+	active          bool
+
+	multiqueue bool
+	fromFd     bool
+	// recreated holds the multiqueue readers opened by Recreate, the old ones are closed by the caller
+	recreated []io.ReadWriteCloser
+
 	l *logrus.Logger
 }
 
@@ -61,7 +80,7 @@ type ifreqQLEN struct {
 	pad   [8]byte
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []Route, txQueueLen int, useSystemRoutes bool) (*tun, error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []Route, txQueueLen int, useSystemRoutes bool, routeTable int, ipRules []IPRule) (*tun, error) {
 	routeTree, err := makeRouteTree(l, routes, true)
 	if err != nil {
 		return nil, err
@@ -73,36 +92,26 @@ func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU in
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		Device:          "tun0",
-		cidr:            cidr,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
 		Routes:          routes,
+		RouteTable:      routeTable,
+		IPRules:         ipRules,
 		useSystemRoutes: useSystemRoutes,
+		fromFd:          true,
 		l:               l,
 	}
+	t.cidr.Store(cidr)
 	t.routeTree.Store(routeTree)
 	return t, nil
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, txQueueLen int, multiqueue bool, useSystemRoutes bool) (*tun, error) {
-	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, txQueueLen int, multiqueue bool, useSystemRoutes bool, routeTable int, ipRules []IPRule) (*tun, error) {
+	file, name, err := openTun(deviceName, multiqueue)
 	if err != nil {
 		return nil, err
 	}
 
-	var req ifReq
-	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
-	if multiqueue {
-		req.Flags |= unix.IFF_MULTI_QUEUE
-	}
-	copy(req.Name[:], deviceName)
-	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
-		return nil, err
-	}
-	name := strings.Trim(string(req.Name[:]), "\x00")
-
-	file := os.NewFile(uintptr(fd), "/dev/net/tun")
-
 	maxMTU := defaultMTU
 	for _, r := range routes {
 		if r.MTU == 0 {
@@ -123,18 +132,80 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		Device:          name,
-		cidr:            cidr,
 		MaxMTU:          maxMTU,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
 		Routes:          routes,
+		RouteTable:      routeTable,
+		IPRules:         ipRules,
 		useSystemRoutes: useSystemRoutes,
+		multiqueue:      multiqueue,
 		l:               l,
 	}
+	t.cidr.Store(cidr)
 	t.routeTree.Store(routeTree)
 	return t, nil
 }
 
+// openTun opens the tun device deviceName, creating it if it does not exist. An empty deviceName lets the kernel pick
+// one, the name of the device is returned.
+func openTun(deviceName string, multiqueue bool) (*os.File, string, error) {
+	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var req ifReq
+	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if multiqueue {
+		req.Flags |= unix.IFF_MULTI_QUEUE
+	}
+	copy(req.Name[:], deviceName)
+	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
+		return nil, "", err
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), strings.Trim(string(req.Name[:]), "\x00"), nil
+}
+
+// Recreate closes the device, removing its routes and ip rules, then opens it again under the same name and activates
+// it. The caller must close the multiqueue readers of the old device. The returned queues replace the device and its
+// readers, the first one takes the place of the device itself.
+func (t *tun) Recreate(queues int) ([]io.ReadWriteCloser, error) {
+	if t.fromFd {
+		return nil, fmt.Errorf("a tun device passed in as a file descriptor can not be recreated")
+	}
+
+	t.Close()
+	t.routeChan = nil
+	t.linkChan = nil
+	t.recreated = nil
+
+	file, _, err := openTun(t.Device, t.multiqueue)
+	if err != nil {
+		return nil, err
+	}
+	// Write and Close use the new device from here on, the old fd is already closed
+	t.ReadWriteCloser = file
+	t.fd = int(file.Fd())
+
+	if err = t.Activate(); err != nil {
+		return nil, err
+	}
+
+	rwcs := []io.ReadWriteCloser{file}
+	for i := 1; i < queues; i++ {
+		q, err := t.NewMultiQueueReader()
+		if err != nil {
+			return nil, err
+		}
+		t.recreated = append(t.recreated, q)
+		rwcs = append(rwcs, q)
+	}
+
+	return rwcs, nil
+}
+
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
@@ -154,10 +225,35 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.Load().MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *tun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.Load().MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *tun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree.Load(), ip)
+}
+
+func (t *tun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree.Load(), ip)
+}
+
 func (t *tun) Write(b []byte) (int, error) {
 	var nn int
 	max := len(b)
@@ -197,8 +293,9 @@ func (t *tun) Activate() error {
 
 	var addr, mask [4]byte
 
-	copy(addr[:], t.cidr.IP.To4())
-	copy(mask[:], t.cidr.Mask)
+	cidr := t.cidr.Load()
+	copy(addr[:], cidr.IP.To4())
+	copy(mask[:], cidr.Mask)
 
 	s, err := unix.Socket(
 		unix.AF_INET,
@@ -262,21 +359,10 @@ func (t *tun) Activate() error {
 	}
 
 	// Default route
-	dr := &net.IPNet{IP: t.cidr.IP.Mask(t.cidr.Mask), Mask: t.cidr.Mask}
-	nr := netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       dr,
-		MTU:       t.DefaultMTU,
-		AdvMSS:    t.advMSS(Route{}),
-		Scope:     unix.RT_SCOPE_LINK,
-		Src:       t.cidr.IP,
-		Protocol:  unix.RTPROT_KERNEL,
-		Table:     unix.RT_TABLE_MAIN,
-		Type:      unix.RTN_UNICAST,
-	}
+	nr := t.defaultRoute(link)
 	err = netlink.RouteReplace(&nr)
 	if err != nil {
-		return fmt.Errorf("failed to set mtu %v on the default route %v; %v", t.DefaultMTU, dr, err)
+		return fmt.Errorf("failed to set mtu %v on the default route %v; %v", nr.MTU, nr.Dst, err)
 	}
 
 	// Path routes
@@ -285,22 +371,27 @@ func (t *tun) Activate() error {
 			continue
 		}
 
-		nr := netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst:       r.Cidr,
-			MTU:       r.MTU,
-			AdvMSS:    t.advMSS(r),
-			Scope:     unix.RT_SCOPE_LINK,
+		nr := t.pathRoute(link, r)
+		err = netlink.RouteAdd(&nr)
+		if err != nil {
+			return fmt.Errorf("failed to set mtu %v on route %v; %v", nr.MTU, r.Cidr, err)
 		}
+	}
 
-		if r.Metric > 0 {
-			nr.Priority = r.Metric
+	// Resolved routes, a lookup may have finished before the device was up
+	t.mtuLock.Lock()
+	t.active = true
+	for _, r := range t.resolvedInstall {
+		nr := t.pathRoute(link, r)
+		if err := netlink.RouteReplace(&nr); err != nil {
+			t.l.WithError(err).WithField("route", r.Cidr).Error("Failed to install resolved route")
 		}
+	}
+	t.mtuLock.Unlock()
 
-		err = netlink.RouteAdd(&nr)
-		if err != nil {
-			return fmt.Errorf("failed to set mtu %v on route %v; %v", r.MTU, r.Cidr, err)
-		}
+	// Policy routing rules
+	if err = t.addIPRules(); err != nil {
+		return err
 	}
 
 	// Run the interface
@@ -309,25 +400,109 @@ func (t *tun) Activate() error {
 		return fmt.Errorf("failed to run tun device: %s", err)
 	}
 
+	t.watchLink()
+
 	return nil
 }
 
+// defaultRoute builds the route for the overlay network itself
+func (t *tun) defaultRoute(link netlink.Link) netlink.Route {
+	cidr := t.cidr.Load()
+	return netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask},
+		MTU:       t.routeMTU(Route{}),
+		AdvMSS:    t.advMSS(Route{}),
+		Scope:     unix.RT_SCOPE_LINK,
+		Src:       cidr.IP,
+		Protocol:  unix.RTPROT_KERNEL,
+		Table:     unix.RT_TABLE_MAIN,
+		Type:      unix.RTN_UNICAST,
+	}
+}
+
+// pathRoute builds the route for a configured tun.routes or tun.unsafe_routes entry, in the tun.route_table table
+func (t *tun) pathRoute(link netlink.Link, r Route) netlink.Route {
+	nr := netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       r.Cidr,
+		AdvMSS:    t.advMSS(r),
+		Scope:     unix.RT_SCOPE_LINK,
+		Table:     t.RouteTable,
+		Src:       r.Src,
+	}
+
+	// A route without an mtu inherits the device mtu
+	if r.MTU != 0 {
+		nr.MTU = t.routeMTU(r)
+	}
+
+	if r.Metric > 0 {
+		nr.Priority = r.Metric
+	}
+
+	return nr
+}
+
 func (t *tun) Cidr() *net.IPNet {
-	return t.cidr
+	return t.cidr.Load()
+}
+
+// SetCidr moves the device to the address in cidr, which must be in the same network as the current one. The old
+// address is removed before the new one is added, the kernel would otherwise drop the new one along with the old
+// primary address. The default route and the routes with a src, which was the old address, are then replaced to use
+// the new address as their source.
+func (t *tun) SetCidr(cidr *net.IPNet) error {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	old := t.cidr.Load()
+	if err = netlink.AddrDel(link, &netlink.Addr{IPNet: old}); err != nil {
+		return fmt.Errorf("failed to remove the tun address %v: %s", old, err)
+	}
+
+	if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: cidr}); err != nil {
+		if rErr := netlink.AddrAdd(link, &netlink.Addr{IPNet: old}); rErr != nil {
+			t.l.WithError(rErr).WithField("cidr", old).Error("Failed to restore the tun address")
+		}
+		return fmt.Errorf("failed to set tun address %v: %s", cidr, err)
+	}
+
+	t.cidr.Store(cidr)
+	t.mtuLock.Lock()
+	t.Routes = renumberRouteSrc(t.Routes, cidr.IP)
+	t.mtuLock.Unlock()
+	t.reinstallRoutes()
+	return nil
 }
 
 func (t *tun) Name() string {
 	return t.Device
 }
 
-func (t *tun) advMSS(r Route) int {
+// routeMTU returns the mtu for the route, clamped to the current device mtu
+func (t *tun) routeMTU(r Route) int {
 	mtu := r.MTU
 	if r.MTU == 0 {
 		mtu = t.DefaultMTU
 	}
 
+	if t.MaxMTU > 0 && mtu > t.MaxMTU {
+		return t.MaxMTU
+	}
+	return mtu
+}
+
+func (t *tun) advMSS(r Route) int {
+	mtu := t.routeMTU(r)
+
 	// We only need to set advmss if the route MTU does not match the device MTU
 	if mtu != t.MaxMTU {
+		if isIPv6Route(r) {
+			return mtu - 60
+		}
 		return mtu - 40
 	}
 	return 0
@@ -364,7 +539,7 @@ func (t *tun) updateRoutes(r netlink.RouteUpdate) {
 		return
 	}
 
-	if !t.cidr.Contains(r.Gw) {
+	if !t.cidr.Load().Contains(r.Gw) {
 		// Gateway isn't in our overlay network, ignore
 		t.l.WithField("route", r).Debug("Ignoring route update, not in our network")
 		return
@@ -376,19 +551,19 @@ func (t *tun) updateRoutes(r netlink.RouteUpdate) {
 		return
 	}
 
-	newTree := cidr.NewTree4[iputil.VpnIp]()
+	newTree := cidr.NewRouteTree[routeTarget]()
 	if r.Type == unix.RTM_NEWROUTE {
 		for _, oldR := range t.routeTree.Load().List() {
 			newTree.AddCIDR(oldR.CIDR, oldR.Value)
 		}
 
 		t.l.WithField("destination", r.Dst).WithField("via", r.Gw).Info("Adding route")
-		newTree.AddCIDR(r.Dst, iputil.Ip2VpnIp(r.Gw))
+		newTree.AddCIDR(r.Dst, routeTarget{via: iputil.Ip2VpnIp(r.Gw)})
 
 	} else {
 		gw := iputil.Ip2VpnIp(r.Gw)
 		for _, oldR := range t.routeTree.Load().List() {
-			if bytes.Equal(oldR.CIDR.IP, r.Dst.IP) && bytes.Equal(oldR.CIDR.Mask, r.Dst.Mask) && oldR.Value == gw {
+			if bytes.Equal(oldR.CIDR.IP, r.Dst.IP) && bytes.Equal(oldR.CIDR.Mask, r.Dst.Mask) && oldR.Value.via == gw {
 				// This is the record to delete
 				t.l.WithField("destination", r.Dst).WithField("via", r.Gw).Info("Removing route")
 				continue
@@ -401,14 +576,366 @@ func (t *tun) updateRoutes(r netlink.RouteUpdate) {
 	t.routeTree.Store(newTree)
 }
 
+// watchLink listens for changes to the tun device made outside of nebula, like an operator changing the mtu
+func (t *tun) watchLink() {
+	lch := make(chan netlink.LinkUpdate)
+	doneChan := make(chan struct{})
+
+	if err := netlink.LinkSubscribe(lch, doneChan); err != nil {
+		t.l.WithError(err).Errorf("failed to subscribe to tun device changes")
+		return
+	}
+
+	t.linkChan = doneChan
+
+	go func() {
+		for {
+			select {
+			case u := <-lch:
+				if t.handleLinkUpdate(u) {
+					t.reinstallRoutes()
+				}
+			case <-doneChan:
+				// netlink.LinkSubscribe will close the lch for us
+				return
+			}
+		}
+	}()
+}
+
+// handleLinkUpdate updates the cached device mtu if the update is for our device, returns true if it changed
+func (t *tun) handleLinkUpdate(u netlink.LinkUpdate) bool {
+	if u.Link == nil || u.Attrs().Name != t.Device {
+		return false
+	}
+
+	return t.setMTU(u.Attrs().MTU)
+}
+
+// setMTU updates the cached device mtu, returns true if it changed
+func (t *tun) setMTU(mtu int) bool {
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+
+	if mtu <= 0 || mtu == t.MaxMTU {
+		return false
+	}
+
+	t.l.WithField("oldMtu", t.MaxMTU).WithField("newMtu", mtu).Info("Tun device mtu changed")
+	t.MaxMTU = mtu
+	return true
+}
+
+// RefreshMTU re-reads the mtu from the tun device and re-clamps the route mtus if it changed
+func (t *tun) RefreshMTU() (int, error) {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	mtu := link.Attrs().MTU
+	if t.setMTU(mtu) {
+		t.reinstallRoutes()
+	}
+
+	return mtu, nil
+}
+
+// SetMTU changes the mtu of the tun device along with the mtu of the routes that do not set their own
+func (t *tun) SetMTU(mtu int) error {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	if err = netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set tun mtu: %s", err)
+	}
+
+	t.mtuLock.Lock()
+	t.DefaultMTU = mtu
+	t.mtuLock.Unlock()
+
+	t.setMTU(mtu)
+	t.reinstallRoutes()
+	return nil
+}
+
+// ListRoutes returns a copy of the routes in use, including the ones that are not installed
+func (t *tun) ListRoutes() []Route {
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+	return append([]Route(nil), t.Routes...)
+}
+
+// reinstallRoutes replaces the default, installed and resolved routes so they reflect the current device mtu
+func (t *tun) reinstallRoutes() {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		t.l.WithError(err).Error("Failed to get tun device link while updating route mtus")
+		return
+	}
+
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+
+	nr := t.defaultRoute(link)
+	if err := netlink.RouteReplace(&nr); err != nil {
+		t.l.WithError(err).WithField("route", nr.Dst).Error("Failed to update mtu on the default route")
+	}
+
+	for _, r := range t.Routes {
+		if !r.Install {
+			continue
+		}
+
+		nr := t.pathRoute(link, r)
+		if err := netlink.RouteReplace(&nr); err != nil {
+			t.l.WithError(err).WithField("route", r.Cidr).Error("Failed to update mtu on route")
+		}
+	}
+	if !t.active {
+		return
+	}
+
+	for _, r := range t.resolvedInstall {
+		nr := t.pathRoute(link, r)
+		if err := netlink.RouteReplace(&nr); err != nil {
+			t.l.WithError(err).WithField("route", r.Cidr).Error("Failed to update mtu on resolved route")
+		}
+	}
+}
+
+// installedRoutes returns the routes we installed and the destinations of the routes on the device in our route table
+func (t *tun) installedRoutes() ([]Route, []*net.IPNet, error) {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	t.mtuLock.Lock()
+	routes := append([]Route(nil), t.Routes...)
+	t.mtuLock.Unlock()
+
+	filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: t.RouteTable}
+	nrs, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list routes: %s", err)
+	}
+
+	present := make([]*net.IPNet, 0, len(nrs))
+	for _, nr := range nrs {
+		present = append(present, nr.Dst)
+	}
+
+	return routes, present, nil
+}
+
+// restoreRoute installs r again if it is still one of our routes
+func (t *tun) restoreRoute(r Route) error {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+
+	for _, cur := range t.Routes {
+		if cur.Install && cur.Cidr.String() == r.Cidr.String() && routesEqual(cur, r) {
+			nr := t.pathRoute(link, cur)
+			return netlink.RouteReplace(&nr)
+		}
+	}
+
+	// A reload removed or changed it while we were looking
+	return nil
+}
+
+// reloadRoutes swaps in the route tree for routes and installs the routes that were added or changed, after removing
+// the ones that were removed or changed
+func (t *tun) reloadRoutes(routes []Route) error {
+	if t.useSystemRoutes {
+		return errors.New("routes can not be reloaded while tun.use_system_route_table is enabled")
+	}
+
+	routeTree, err := makeRouteTree(t.l, routes, true)
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+
+	for _, rc := range diffRoutes(t.Routes, routes) {
+		if rc.Old != nil && rc.Old.Install {
+			nr := t.pathRoute(link, *rc.Old)
+			if err := netlink.RouteDel(&nr); err != nil {
+				t.l.WithError(err).WithField("route", rc.Cidr).Error("Failed to remove route")
+			}
+		}
+
+		if rc.New != nil && rc.New.Install {
+			nr := t.pathRoute(link, *rc.New)
+			if err := netlink.RouteReplace(&nr); err != nil {
+				t.l.WithError(err).WithField("route", rc.Cidr).Error("Failed to install route")
+			}
+		}
+	}
+
+	t.Routes = routes
+	t.routeTree.Store(routeTree)
+	return nil
+}
+
+// installResolvedRoutes removes the routes in old that are not in new and installs the ones in new, the routes are
+// installed the same way as tun.unsafe_routes entries
+func (t *tun) installResolvedRoutes(old, new []Route) {
+	t.mtuLock.Lock()
+	defer t.mtuLock.Unlock()
+
+	t.resolvedInstall = new
+	if !t.active {
+		return
+	}
+
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		t.l.WithError(err).Error("Failed to get tun device link while installing resolved routes")
+		return
+	}
+
+	for _, rc := range diffRoutes(old, new) {
+		if rc.Old != nil {
+			nr := t.pathRoute(link, *rc.Old)
+			if err := netlink.RouteDel(&nr); err != nil {
+				t.l.WithError(err).WithField("route", rc.Cidr).Error("Failed to remove resolved route")
+			}
+		}
+
+		if rc.New != nil {
+			nr := t.pathRoute(link, *rc.New)
+			if err := netlink.RouteReplace(&nr); err != nil {
+				t.l.WithError(err).WithField("route", rc.Cidr).Error("Failed to install resolved route")
+			}
+		}
+	}
+}
+
+func (t *tun) netlinkRule(r IPRule) *netlink.Rule {
+	nr := netlink.NewRule()
+	nr.Family = unix.AF_INET
+	nr.Priority = r.Priority
+	nr.Table = r.Table
+	nr.Src = r.From
+	nr.Dst = r.To
+	if r.FwMark != 0 {
+		nr.Mark = r.FwMark
+		if r.FwMask != 0 {
+			nr.Mask = r.FwMask
+		}
+	}
+	return nr
+}
+
+// addIPRules installs tun.ip_rules, refusing to share a priority with a rule we did not create
+func (t *tun) addIPRules() error {
+	if len(t.IPRules) == 0 {
+		return nil
+	}
+
+	existing, err := netlink.RuleList(unix.AF_INET)
+	if err != nil {
+		return fmt.Errorf("failed to list ip rules: %s", err)
+	}
+
+	for _, r := range t.IPRules {
+		nr := t.netlinkRule(r)
+
+		installed := false
+		for _, er := range existing {
+			if er.Priority != r.Priority {
+				continue
+			}
+
+			if er.Table != nr.Table || er.Src.String() != nr.Src.String() || er.Dst.String() != nr.Dst.String() ||
+				(nr.Mark != -1 && er.Mark != nr.Mark) {
+				return fmt.Errorf("ip rule priority %v is already in use by: %v", r.Priority, er)
+			}
+
+			// Likely left behind by a previous run, leave it be
+			installed = true
+		}
+
+		if installed {
+			continue
+		}
+
+		if err := netlink.RuleAdd(nr); err != nil {
+			return fmt.Errorf("failed to add ip rule %v; %v", nr, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *tun) removeIPRules() {
+	for _, r := range t.IPRules {
+		nr := t.netlinkRule(r)
+		if err := netlink.RuleDel(nr); err != nil {
+			t.l.WithError(err).WithField("rule", nr).Error("Failed to remove ip rule")
+		}
+	}
+}
+
+// removeRoutes deletes the installed routes from the table they were installed in. Routes in the main table would be
+// cleaned up by the kernel when the device goes away but we remove them all the same way for consistency.
+func (t *tun) removeRoutes() {
+	link, err := netlink.LinkByName(t.Device)
+	if err != nil {
+		return
+	}
+
+	t.mtuLock.Lock()
+	routes := append(append([]Route(nil), t.Routes...), t.resolvedInstall...)
+	t.mtuLock.Unlock()
+
+	for _, r := range routes {
+		if !r.Install {
+			continue
+		}
+
+		nr := t.pathRoute(link, r)
+		if err := netlink.RouteDel(&nr); err != nil {
+			t.l.WithError(err).WithField("route", r.Cidr).WithField("table", t.RouteTable).Debug("Failed to remove route")
+		}
+	}
+}
+
 func (t *tun) Close() error {
 	if t.routeChan != nil {
 		close(t.routeChan)
 	}
 
+	if t.linkChan != nil {
+		close(t.linkChan)
+	}
+
+	t.removeRoutes()
+	t.removeIPRules()
+
 	if t.ReadWriteCloser != nil {
 		t.ReadWriteCloser.Close()
 	}
 
+	for _, q := range t.recreated {
+		q.Close()
+	}
+
 	return nil
 }
@@ -3,7 +3,14 @@
 
 package overlay
 
-import "testing"
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
 
 var runAdvMSSTests = []struct {
 	name     string
@@ -32,3 +39,44 @@ func TestTunAdvMSS(t *testing.T) {
 		})
 	}
 }
+
+func TestTunHandleLinkUpdate(t *testing.T) {
+	tn := &tun{Device: "nebula1", DefaultMTU: 1440, MaxMTU: 8941, l: test.NewLogger()}
+
+	// Updates for other devices are ignored
+	u := netlink.LinkUpdate{Link: &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 1500}}}
+	assert.False(t, tn.handleLinkUpdate(u))
+	assert.Equal(t, 8941, tn.MaxMTU)
+
+	// An unchanged mtu is not a change
+	u = netlink.LinkUpdate{Link: &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "nebula1", MTU: 8941}}}
+	assert.False(t, tn.handleLinkUpdate(u))
+
+	// Lowering the device mtu below the route mtus clamps them
+	u = netlink.LinkUpdate{Link: &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "nebula1", MTU: 1300}}}
+	assert.True(t, tn.handleLinkUpdate(u))
+	assert.Equal(t, 1300, tn.MaxMTU)
+	assert.Equal(t, 1300, tn.routeMTU(Route{}))
+	assert.Equal(t, 1300, tn.routeMTU(Route{MTU: 8941}))
+	assert.Equal(t, 1200, tn.routeMTU(Route{MTU: 1200}))
+	assert.Equal(t, 0, tn.advMSS(Route{MTU: 8941}))
+	assert.Equal(t, 1160, tn.advMSS(Route{MTU: 1200}))
+}
+
+func TestTunPathRoute(t *testing.T) {
+	tn := &tun{DefaultMTU: 1440, MaxMTU: 1440, RouteTable: 100}
+	link := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "nebula1", Index: 7}}
+	_, cidr, _ := net.ParseCIDR("1.0.0.0/24")
+
+	nr := tn.pathRoute(link, Route{Cidr: cidr, MTU: 1300, Metric: 10, Src: net.IP{10, 0, 0, 1}})
+	assert.Equal(t, 7, nr.LinkIndex)
+	assert.Equal(t, cidr, nr.Dst)
+	assert.Equal(t, 100, nr.Table)
+	assert.Equal(t, 1300, nr.MTU)
+	assert.Equal(t, 10, nr.Priority)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, nr.Src)
+
+	// Without a src the kernel picks one
+	nr = tn.pathRoute(link, Route{Cidr: cidr})
+	assert.Nil(t, nr.Src)
+}
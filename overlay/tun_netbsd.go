@@ -25,11 +25,12 @@ type ifreqDestroy struct {
 }
 
 type tun struct {
+	resolvedRoutes
 	Device    string
 	cidr      *net.IPNet
 	MTU       int
 	Routes    []Route
-	routeTree *cidr.Tree4[iputil.VpnIp]
+	routeTree *cidr.RouteTree[routeTarget]
 	l         *logrus.Logger
 
 	io.ReadWriteCloser
@@ -56,13 +57,13 @@ func (t *tun) Close() error {
 	return nil
 }
 
-func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool) (*tun, error) {
+func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool, _ int, _ []IPRule) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in NetBSD")
 }
 
 var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool) (*tun, error) {
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool, _ int, _ []IPRule) (*tun, error) {
 	// Try to open tun device
 	var file *os.File
 	var err error
@@ -123,6 +124,11 @@ func (t *tun) Activate() error {
 			continue
 		}
 
+		if isIPv6Route(r) {
+			t.l.WithField("route", r.Cidr).Warn("ipv6 unsafe_routes are not installed on this platform, add the route to the system by hand")
+			continue
+		}
+
 		cmd = exec.Command("/sbin/route", "-n", "add", "-net", r.Cidr.String(), t.cidr.IP.String())
 		t.l.Debug("command: ", cmd.String())
 		if err = cmd.Run(); err != nil {
@@ -134,10 +140,35 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *tun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *tun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *tun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree, ip)
+}
+
 func (t *tun) Cidr() *net.IPNet {
 	return t.cidr
 }
@@ -19,11 +19,12 @@ import (
 )
 
 type tun struct {
+	resolvedRoutes
 	Device    string
 	cidr      *net.IPNet
 	MTU       int
 	Routes    []Route
-	routeTree *cidr.Tree4[iputil.VpnIp]
+	routeTree *cidr.RouteTree[routeTarget]
 	l         *logrus.Logger
 
 	io.ReadWriteCloser
@@ -40,13 +41,13 @@ func (t *tun) Close() error {
 	return nil
 }
 
-func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool) (*tun, error) {
+func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool, _ int, _ []IPRule) (*tun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in OpenBSD")
 }
 
 var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool) (*tun, error) {
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []Route, _ int, _ bool, _ bool, _ int, _ []IPRule) (*tun, error) {
 	if deviceName == "" {
 		return nil, fmt.Errorf("a device name in the format of tunN must be specified")
 	}
@@ -104,6 +105,11 @@ func (t *tun) Activate() error {
 			continue
 		}
 
+		if isIPv6Route(r) {
+			t.l.WithField("route", r.Cidr).Warn("ipv6 unsafe_routes are not installed on this platform, add the route to the system by hand")
+			continue
+		}
+
 		cmd = exec.Command("/sbin/route", "-n", "add", "-inet", r.Cidr.String(), t.cidr.IP.String())
 		t.l.Debug("command: ", cmd.String())
 		if err = cmd.Run(); err != nil {
@@ -115,10 +121,35 @@ func (t *tun) Activate() error {
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *tun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *tun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *tun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree, ip)
+}
+
 func (t *tun) Cidr() *net.IPNet {
 	return t.cidr
 }
@@ -0,0 +1,79 @@
+package overlay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeviceFromConfig_disabled(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.1/24")
+
+	// No device is created
+	c.Settings["tun"] = map[interface{}]interface{}{"disabled": true}
+	d, err := NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.NoError(t, err)
+	assert.IsType(t, &disabledTun{}, d)
+	assert.Equal(t, "disabled", d.Name())
+	assert.Equal(t, iputil.VpnIp(0), d.RouteFor(iputil.Ip2VpnIp(net.ParseIP("1.0.0.1"))))
+
+	// Empty lists are fine
+	c.Settings["tun"] = map[interface{}]interface{}{"disabled": true, "routes": []interface{}{}, "unsafe_routes": []interface{}{}}
+	_, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.NoError(t, err)
+
+	// Routes can not be installed without a device
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"disabled": true,
+		"unsafe_routes": []interface{}{
+			map[interface{}]interface{}{"route": "1.0.0.0/8", "via": "10.0.0.2"},
+		},
+	}
+	_, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.EqualError(t, err, "tun.unsafe_routes can not be set when tun.disabled is true")
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"disabled": true,
+		"routes":   []interface{}{map[interface{}]interface{}{"route": "10.0.0.0/24", "mtu": 1300}},
+	}
+	_, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.EqualError(t, err, "tun.routes can not be set when tun.disabled is true")
+}
+
+func TestNewDeviceFromConfig_serveOnly(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	_, n, _ := net.ParseCIDR("10.0.0.1/24")
+
+	// A serve only lighthouse opens no device and installs no routes, even with tun.disabled unset
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true, "serve_only": true}
+	d, err := NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.NoError(t, err)
+	assert.IsType(t, &disabledTun{}, d)
+	assert.NoError(t, d.Activate())
+	assert.Equal(t, iputil.VpnIp(0), d.RouteFor(iputil.Ip2VpnIp(net.ParseIP("1.0.0.1"))))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"disabled": false}
+	d, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.NoError(t, err)
+	assert.IsType(t, &disabledTun{}, d)
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"unsafe_routes": []interface{}{
+			map[interface{}]interface{}{"route": "1.0.0.0/8", "via": "10.0.0.2"},
+		},
+	}
+	_, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.EqualError(t, err, "tun.unsafe_routes can not be set when lighthouse.serve_only is true")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"ip_rules": []interface{}{map[interface{}]interface{}{"priority": 1000}}}
+	_, err = NewDeviceFromConfig(context.Background(), c, l, n, nil, 1)
+	assert.EqualError(t, err, "tun.ip_rules can not be set when lighthouse.serve_only is true")
+}
@@ -16,10 +16,11 @@ import (
 )
 
 type TestTun struct {
+	resolvedRoutes
 	Device    string
-	cidr      *net.IPNet
+	cidr      atomic.Pointer[net.IPNet]
 	Routes    []Route
-	routeTree *cidr.Tree4[iputil.VpnIp]
+	routeTree *cidr.RouteTree[routeTarget]
 	l         *logrus.Logger
 
 	closed    atomic.Bool
@@ -27,27 +28,32 @@ type TestTun struct {
 	TxPackets chan []byte // Packets transmitted outside by nebula
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, _ int, routes []Route, _ int, _ bool, _ bool) (*TestTun, error) {
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, _ int, routes []Route, _ int, _ bool, _ bool, _ int, _ []IPRule) (*TestTun, error) {
 	routeTree, err := makeRouteTree(l, routes, false)
 	if err != nil {
 		return nil, err
 	}
 
-	return &TestTun{
+	t := &TestTun{
 		Device:    deviceName,
-		cidr:      cidr,
 		Routes:    routes,
 		routeTree: routeTree,
 		l:         l,
 		rxPackets: make(chan []byte, 10),
 		TxPackets: make(chan []byte, 10),
-	}, nil
+	}
+	t.cidr.Store(cidr)
+	return t, nil
 }
 
-func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool) (*TestTun, error) {
+func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []Route, _ int, _ bool, _ int, _ []IPRule) (*TestTun, error) {
 	return nil, fmt.Errorf("newTunFromFd not supported")
 }
 
+func (t *TestTun) ListRoutes() []Route {
+	return append([]Route(nil), t.Routes...)
+}
+
 // Send will place a byte array onto the receive queue for nebula to consume
 // These are unencrypted ip layer frames destined for another nebula node.
 // packets should exit the udp side, capture them with udpConn.Get
@@ -83,16 +89,46 @@ func (t *TestTun) Get(block bool) []byte {
 //********************************************************************************************************************//
 
 func (t *TestTun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *TestTun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *TestTun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *TestTun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree, ip)
+}
+
 func (t *TestTun) Activate() error {
 	return nil
 }
 
 func (t *TestTun) Cidr() *net.IPNet {
-	return t.cidr
+	return t.cidr.Load()
+}
+
+func (t *TestTun) SetCidr(cidr *net.IPNet) error {
+	t.cidr.Store(cidr)
+	return nil
 }
 
 func (t *TestTun) Name() string {
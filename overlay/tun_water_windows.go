@@ -14,11 +14,13 @@ import (
 )
 
 type waterTun struct {
+	resolvedRoutes
+	l         *logrus.Logger
 	Device    string
 	cidr      *net.IPNet
 	MTU       int
 	Routes    []Route
-	routeTree *cidr.Tree4[iputil.VpnIp]
+	routeTree *cidr.RouteTree[routeTarget]
 
 	*water.Interface
 }
@@ -31,6 +33,7 @@ func newWaterTun(l *logrus.Logger, cidr *net.IPNet, defaultMTU int, routes []Rou
 
 	// NOTE: You cannot set the deviceName under Windows, so you must check tun.Device after calling .Activate()
 	return &waterTun{
+		l:         l,
 		cidr:      cidr,
 		MTU:       defaultMTU,
 		Routes:    routes,
@@ -85,6 +88,11 @@ func (t *waterTun) Activate() error {
 			continue
 		}
 
+		if isIPv6Route(r) {
+			t.l.WithField("route", r.Cidr).Warn("ipv6 unsafe_routes are not installed on this platform, add the route to the system by hand")
+			continue
+		}
+
 		err = exec.Command(
 			"C:\\Windows\\System32\\route.exe", "add", r.Cidr.String(), r.Via.String(), "IF", strconv.Itoa(iface.Index), "METRIC", strconv.Itoa(r.Metric),
 		).Run()
@@ -97,10 +105,35 @@ func (t *waterTun) Activate() error {
 }
 
 func (t *waterTun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *waterTun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *waterTun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *waterTun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree, ip)
+}
+
 func (t *waterTun) Cidr() *net.IPNet {
 	return t.cidr
 }
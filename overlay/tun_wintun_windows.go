@@ -19,12 +19,13 @@ import (
 const tunGUIDLabel = "Fixed Nebula Windows GUID v1"
 
 type winTun struct {
+	resolvedRoutes
 	Device    string
 	cidr      *net.IPNet
 	prefix    netip.Prefix
 	MTU       int
 	Routes    []Route
-	routeTree *cidr.Tree4[iputil.VpnIp]
+	routeTree *cidr.RouteTree[routeTarget]
 
 	tun *wintun.NativeTun
 }
@@ -104,7 +105,7 @@ func (t *winTun) Activate() error {
 			continue
 		}
 
-		if !foundDefault4 {
+		if !foundDefault4 && !isIPv6Route(r) {
 			if ones, bits := r.Cidr.Mask.Size(); ones == 0 && bits != 0 {
 				foundDefault4 = true
 			}
@@ -115,10 +116,15 @@ func (t *winTun) Activate() error {
 			return err
 		}
 
-		// Add our unsafe route
+		// Add our unsafe route, an ipv6 route is on link since the via is an ipv4 vpn ip
+		nextHop := r.Via.ToNetIpAddr()
+		if isIPv6Route(r) {
+			nextHop = netip.IPv6Unspecified()
+		}
+
 		routes = append(routes, &winipcfg.RouteData{
 			Destination: prefix,
-			NextHop:     r.Via.ToNetIpAddr(),
+			NextHop:     nextHop,
 			Metric:      uint32(r.Metric),
 		})
 	}
@@ -146,10 +152,35 @@ func (t *winTun) Activate() error {
 }
 
 func (t *winTun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
-	_, r := t.routeTree.MostSpecificContains(ip)
+	r, _ := t.RouteTagFor(ip)
 	return r
 }
 
+func (t *winTun) RouteTagFor(ip iputil.VpnIp) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return r.via, r.tag
+	}
+
+	_, r := t.routeTree.MostSpecificContains(ip)
+	return r.via, r.tag
+}
+
+func (t *winTun) RoutesFor(ip iputil.VpnIp) []RouteMatch {
+	if ok, r := t.resolvedRouteFor(ip); ok {
+		return []RouteMatch{{Via: r.via, Tag: r.tag}}
+	}
+
+	return routeMatches(t.routeTree, ip)
+}
+
+func (t *winTun) RouteTagFor6(ip [16]byte) (iputil.VpnIp, string) {
+	if ok, r := t.resolvedRouteFor6(ip); ok {
+		return r.via, r.tag
+	}
+
+	return routeTagFor6(t.routeTree, ip)
+}
+
 func (t *winTun) Cidr() *net.IPNet {
 	return t.cidr
 }
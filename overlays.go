@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// overlayNamePattern keeps overlay.name usable as a graphite path element and a prometheus label value
+var overlayNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// runningOverlays holds every overlay created by Main in this process until it is stopped, so each one can list the
+// others
+var runningOverlays = struct {
+	sync.Mutex
+	overlays []runningOverlay
+}{}
+
+// runningOverlay keeps the overlay.name the overlay started with, the name is not reloadable
+type runningOverlay struct {
+	name    string
+	control *Control
+}
+
+// ControlOverlay describes an overlay running in this process
+type ControlOverlay struct {
+	// Name is overlay.name, empty if it was not set
+	Name   string `json:"name"`
+	VpnIp  string `json:"vpnIp"`
+	Device string `json:"device"`
+}
+
+// checkOverlayName validates overlay.name, it must not be taken by a running overlay. An overlay without a name next to
+// another overlay is only warned about since its metrics can not be told apart from the others.
+func checkOverlayName(l *logrus.Logger, c *config.C) error {
+	name := util.OverlayName(c)
+	if name != "" && !overlayNamePattern.MatchString(name) {
+		return fmt.Errorf("overlay.name may only contain letters, digits, _ and -: %q", name)
+	}
+
+	runningOverlays.Lock()
+	defer runningOverlays.Unlock()
+	if name == "" {
+		if len(runningOverlays.overlays) > 0 {
+			l.Warn("overlay.name is not set and another overlay is running in this process, the metrics of this overlay can not be told apart from the others")
+		}
+		return nil
+	}
+
+	return unlockedCheckOverlayNameFree(name)
+}
+
+func unlockedCheckOverlayNameFree(name string) error {
+	for _, other := range runningOverlays.overlays {
+		if other.name == name {
+			return fmt.Errorf("overlay.name %q is already used by another overlay in this process", name)
+		}
+	}
+	return nil
+}
+
+// addOverlay lists c as running until c.Stop is called
+func addOverlay(c *Control) error {
+	runningOverlays.Lock()
+	defer runningOverlays.Unlock()
+	name := util.OverlayName(c.config)
+	if name != "" {
+		if err := unlockedCheckOverlayNameFree(name); err != nil {
+			return err
+		}
+	}
+
+	runningOverlays.overlays = append(runningOverlays.overlays, runningOverlay{name: name, control: c})
+	return nil
+}
+
+func removeOverlay(c *Control) {
+	runningOverlays.Lock()
+	defer runningOverlays.Unlock()
+	for i, other := range runningOverlays.overlays {
+		if other.control == c {
+			runningOverlays.overlays = append(runningOverlays.overlays[:i], runningOverlays.overlays[i+1:]...)
+			return
+		}
+	}
+}
+
+// listOverlays returns the running overlays sorted by name
+func listOverlays() []ControlOverlay {
+	runningOverlays.Lock()
+	overlays := make([]ControlOverlay, len(runningOverlays.overlays))
+	for i, o := range runningOverlays.overlays {
+		overlays[i] = ControlOverlay{
+			Name:   o.name,
+			VpnIp:  o.control.f.myVpnIp.Load().String(),
+			Device: o.control.f.inside.Name(),
+		}
+	}
+	runningOverlays.Unlock()
+
+	sort.SliceStable(overlays, func(i, j int) bool {
+		return overlays[i].Name < overlays[j].Name
+	})
+	return overlays
+}
+
+// MainOverlays starts one overlay for every config file listed in overlays, each with its own tun device, host map,
+// firewall, route tree and Control, as if Main was called once per file. Every file must set a unique overlay.name,
+// which is added to each log line as the overlay field. The overlays already created are stopped if one fails.
+func MainOverlays(c *config.C, configTest bool, buildVersion string, logger *logrus.Logger) ([]*Control, error) {
+	paths := c.GetStringSlice("overlays", nil)
+	if len(paths) == 0 {
+		return nil, errors.New("overlays must list at least one config path")
+	}
+
+	var controls []*Control
+	stop := func() {
+		for _, ctrl := range controls {
+			ctrl.Stop()
+		}
+	}
+
+	for _, path := range paths {
+		l := logrus.New()
+		l.Out = logger.Out
+
+		oc := config.NewC(l)
+		if err := oc.Load(path); err != nil {
+			stop()
+			return nil, util.NewContextualError("Failed to load overlay config", m{"path": path}, err)
+		}
+
+		name := util.OverlayName(oc)
+		if name == "" {
+			stop()
+			return nil, util.NewContextualError("overlay.name must be set for every entry in overlays", m{"path": path}, nil)
+		}
+		l.AddHook(overlayLogHook(name))
+
+		ctrl, err := Main(oc, configTest, buildVersion, l, nil)
+		if err != nil {
+			stop()
+			return nil, util.NewContextualError("Failed to start overlay", m{"overlay": name, "path": path}, err)
+		}
+
+		// Main returns nothing in config test mode
+		if ctrl != nil {
+			controls = append(controls, ctrl)
+		}
+	}
+
+	return controls, nil
+}
+
+// ShutdownBlockOverlays will listen for and block on term and interrupt signals, stopping every overlay in controls
+// once signalled
+func ShutdownBlockOverlays(l *logrus.Logger, controls []*Control) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT)
+
+	rawSig := <-sigChan
+	l.WithField("signal", rawSig.String()).Info("Caught signal, shutting down")
+	for _, ctrl := range controls {
+		ctrl.Stop()
+	}
+}
+
+// overlayLogHook adds the overlay name to every log line of an overlay started by MainOverlays
+type overlayLogHook string
+
+func (h overlayLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h overlayLogHook) Fire(e *logrus.Entry) error {
+	e.Data["overlay"] = string(h)
+	return nil
+}
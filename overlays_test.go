@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlays(t *testing.T) {
+	l := test.NewLogger()
+	newControl := func(name, vpnIp string) *Control {
+		c := config.NewC(l)
+		if name != "" {
+			c.Settings["overlay"] = map[interface{}]interface{}{"name": name}
+		}
+		f := &Interface{inside: &test.NoopTun{}}
+		f.myVpnIp.Store(iputil.Ip2VpnIp(net.ParseIP(vpnIp)))
+		return &Control{
+			f:      f,
+			l:      l,
+			config: c,
+		}
+	}
+
+	office := newControl("office", "10.1.0.1")
+	home := newControl("home", "10.2.0.1")
+	unnamed := newControl("", "10.3.0.1")
+
+	require.NoError(t, addOverlay(office))
+	require.NoError(t, addOverlay(home))
+	require.NoError(t, addOverlay(unnamed))
+	defer removeOverlay(unnamed)
+
+	assert.Equal(t, []ControlOverlay{
+		{Name: "", VpnIp: "10.3.0.1", Device: "noop"},
+		{Name: "home", VpnIp: "10.2.0.1", Device: "noop"},
+		{Name: "office", VpnIp: "10.1.0.1", Device: "noop"},
+	}, home.ListOverlays())
+
+	// A name can only be used once
+	assert.EqualError(t, checkOverlayName(l, office.config), `overlay.name "office" is already used by another overlay in this process`)
+	assert.EqualError(t, addOverlay(newControl("office", "10.4.0.1")), `overlay.name "office" is already used by another overlay in this process`)
+	assert.NoError(t, checkOverlayName(l, unnamed.config))
+
+	c := config.NewC(l)
+	c.Settings["overlay"] = map[interface{}]interface{}{"name": "a.b"}
+	assert.EqualError(t, checkOverlayName(l, c), `overlay.name may only contain letters, digits, _ and -: "a.b"`)
+
+	// A stopped overlay gives up its name
+	removeOverlay(office)
+	removeOverlay(home)
+	assert.NoError(t, checkOverlayName(l, office.config))
+	assert.Equal(t, []ControlOverlay{{Name: "", VpnIp: "10.3.0.1", Device: "noop"}}, unnamed.ListOverlays())
+}
+
+func TestMainOverlays(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	_, err := MainOverlays(c, true, "", l)
+	assert.EqualError(t, err, "overlays must list at least one config path")
+
+	dir := t.TempDir()
+	unnamed := filepath.Join(dir, "unnamed.yml")
+	require.NoError(t, os.WriteFile(unnamed, []byte("listen:\n  port: 4242\n"), 0600))
+
+	c.Settings["overlays"] = []interface{}{filepath.Join(dir, "missing.yml")}
+	_, err = MainOverlays(c, true, "", l)
+	assert.Error(t, err)
+
+	c.Settings["overlays"] = []interface{}{unnamed}
+	_, err = MainOverlays(c, true, "", l)
+	assert.EqualError(t, err, "overlay.name must be set for every entry in overlays")
+}
@@ -0,0 +1,545 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+const (
+	// peerPolicyChunkSize is how much of the signed document is carried by each PeerPolicyReply
+	peerPolicyChunkSize = 1024
+	// maxPeerPolicySize bounds the signed document a lighthouse will serve and a client will put together
+	maxPeerPolicySize = 256 * 1024
+	// peerPolicyFetchTimeout is how long a fetch may go without a chunk before a fetch from another lighthouse can
+	// replace it
+	peerPolicyFetchTimeout = 10 * time.Second
+	// peerPolicyChunkRetry is how long we wait for a chunk we asked for before asking the same lighthouse again
+	peerPolicyChunkRetry = time.Second
+	// peerPolicyChunkRetries is how many times a chunk is asked for again before the fetch is dropped
+	peerPolicyChunkRetries = 5
+)
+
+// peerPolicy is a verified cert.PeerPolicy
+type peerPolicy struct {
+	version uint64
+	rules   []peerPolicyRule
+}
+
+type peerPolicyRule struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// newPeerPolicy converts a verified policy, the rule cidrs have already been validated
+func newPeerPolicy(p *cert.PeerPolicy) *peerPolicy {
+	pp := &peerPolicy{version: p.Version}
+	for _, r := range p.Rules {
+		_, from, _ := net.ParseCIDR(r.From)
+		_, to, _ := net.ParseCIDR(r.To)
+		pp.rules = append(pp.rules, peerPolicyRule{from: from, to: to})
+	}
+	return pp
+}
+
+// allows reports if a rule lets from start a tunnel with to
+func (p *peerPolicy) allows(from, to iputil.VpnIp) bool {
+	fromIp, toIp := from.ToIP(), to.ToIP()
+	for _, r := range p.rules {
+		if r.from.Contains(fromIp) && r.to.Contains(toIp) {
+			return true
+		}
+	}
+	return false
+}
+
+type servedPeerPolicy struct {
+	version uint64
+	raw     []byte
+}
+
+// peerPolicyFetch is a signed document that is being put together from the chunks sent by one lighthouse
+type peerPolicyFetch struct {
+	from    iputil.VpnIp
+	version uint64
+	length  uint32
+	buf     []byte
+	updated time.Time
+
+	// requested is when the chunk at len(buf) was last asked for and retries how many times it was asked for again
+	requested time.Time
+	retries   int
+}
+
+// request returns the request for the chunk the fetch is waiting on
+func (f *peerPolicyFetch) request() *NebulaMeta {
+	return &NebulaMeta{
+		Type: NebulaMeta_PeerPolicyRequest,
+		Details: &NebulaMetaDetails{
+			PolicyVersion: f.version,
+			PolicyOffset:  uint32(len(f.buf)),
+		},
+	}
+}
+
+// peerPolicyManager serves the signed peer policy in lighthouse.peer_policy when we are a lighthouse. With
+// peer_policy.enabled it fetches the newest policy from the lighthouses and refuses handshakes the policy does not allow.
+type peerPolicyManager struct {
+	l       *logrus.Logger
+	lh      *LightHouse
+	signers func() *cert.NebulaCAPool
+
+	served atomic.Pointer[servedPeerPolicy]
+
+	enabled   bool
+	interval  time.Duration
+	current   atomic.Pointer[peerPolicy]
+	cachePath string
+	cacheLock sync.Mutex
+
+	fetchLock sync.Mutex
+	fetch     *peerPolicyFetch
+
+	metricVersion metrics.Gauge
+}
+
+// newPeerPolicyManagerFromConfig loads peer_policy and, on a lighthouse, the document in lighthouse.peer_policy
+func newPeerPolicyManagerFromConfig(l *logrus.Logger, c *config.C, lh *LightHouse, pki *PKI) (*peerPolicyManager, error) {
+	pm := &peerPolicyManager{
+		l:             l,
+		lh:            lh,
+		signers:       pki.GetCAPool,
+		enabled:       c.GetBool("peer_policy.enabled", false),
+		interval:      c.GetDuration("peer_policy.refresh_interval", 5*time.Minute),
+		cachePath:     c.GetString("peer_policy.cache", ""),
+		metricVersion: metrics.GetOrRegisterGauge("peer_policy.version", util.MetricsRegistry(c)),
+	}
+
+	if pm.interval <= 0 {
+		return nil, fmt.Errorf("peer_policy.refresh_interval must be greater than 0: %v", pm.interval)
+	}
+
+	if signers := c.GetString("peer_policy.signers", ""); signers != "" {
+		pool, err := loadPeerPolicySigners(signers)
+		if err != nil {
+			return nil, err
+		}
+		pm.signers = func() *cert.NebulaCAPool { return pool }
+	}
+
+	if pm.enabled && lh.amLighthouse {
+		l.Warn("peer_policy.enabled is ignored on a lighthouse, lighthouses only serve lighthouse.peer_policy")
+		pm.enabled = false
+	}
+
+	if pm.enabled {
+		pm.loadCache()
+	}
+
+	if err := pm.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := pm.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload lighthouse.peer_policy")
+		}
+	})
+
+	return pm, nil
+}
+
+// loadPeerPolicySigners reads the CA certificates in peer_policy.signers, a path or PEM data
+func loadPeerPolicySigners(pathOrPEM string) (*cert.NebulaCAPool, error) {
+	raw := []byte(pathOrPEM)
+	if !strings.Contains(pathOrPEM, "-----BEGIN") {
+		var err error
+		raw, err = os.ReadFile(pathOrPEM)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read peer_policy.signers file %s: %w", pathOrPEM, err)
+		}
+	}
+
+	pool, err := cert.NewCAPoolFromBytes(raw)
+	if err != nil && !errors.Is(err, cert.ErrExpired) {
+		return nil, fmt.Errorf("error while loading peer_policy.signers: %w", err)
+	}
+
+	return pool, nil
+}
+
+// loadCache starts enforcing the policy saved in peer_policy.cache by a previous run, if it still verifies
+func (pm *peerPolicyManager) loadCache() {
+	if pm.cachePath == "" {
+		return
+	}
+
+	l := pm.l.WithField("path", pm.cachePath)
+	raw, err := os.ReadFile(pm.cachePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			l.WithError(err).Warn("Unable to read the cached peer policy")
+		}
+		return
+	}
+
+	p, err := pm.verify(raw)
+	if err != nil {
+		l.WithError(err).Warn("Ignoring a cached peer policy that could not be verified")
+		return
+	}
+
+	pm.current.Store(newPeerPolicy(p))
+	pm.metricVersion.Update(int64(p.Version))
+	l.WithField("version", p.Version).WithField("rules", len(p.Rules)).Info("Loaded the cached peer policy")
+}
+
+// saveCache writes a verified document to peer_policy.cache unless a newer policy was applied in the meantime. The
+// document is written next to the cache and renamed over it so a crash never leaves half of it behind.
+func (pm *peerPolicyManager) saveCache(version uint64, raw []byte) {
+	if pm.cachePath == "" {
+		return
+	}
+
+	pm.cacheLock.Lock()
+	defer pm.cacheLock.Unlock()
+
+	if pm.version() != version {
+		return
+	}
+
+	if err := writeFileAtomic(pm.cachePath, raw); err != nil {
+		pm.l.WithError(err).WithField("path", pm.cachePath).Error("Failed to save the peer policy cache")
+	}
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// reload reads the document in lighthouse.peer_policy again, it is served once its signature is verified
+func (pm *peerPolicyManager) reload(c *config.C, initial bool) error {
+	path := c.GetString("lighthouse.peer_policy", "")
+	if !pm.lh.amLighthouse {
+		if initial && path != "" {
+			pm.l.Warn("lighthouse.peer_policy is ignored because this host is not a lighthouse")
+		}
+		return nil
+	}
+
+	if path == "" {
+		if pm.served.Swap(nil) != nil {
+			pm.l.Info("No longer serving a peer policy")
+		}
+		return nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read lighthouse.peer_policy file %s: %w", path, err)
+	}
+
+	if len(raw) > maxPeerPolicySize {
+		return fmt.Errorf("lighthouse.peer_policy file %s is larger than %v bytes", path, maxPeerPolicySize)
+	}
+
+	p, err := pm.verify(raw)
+	if err != nil {
+		return fmt.Errorf("lighthouse.peer_policy file %s: %w", path, err)
+	}
+
+	old := pm.served.Swap(&servedPeerPolicy{version: p.Version, raw: raw})
+	if old == nil || old.version != p.Version {
+		pm.l.WithField("version", p.Version).WithField("rules", len(p.Rules)).Info("Serving peer policy")
+	}
+	pm.metricVersion.Update(int64(p.Version))
+	return nil
+}
+
+// verify checks the signature of a PEM encoded document against the trusted signers
+func (pm *peerPolicyManager) verify(raw []byte) (*cert.PeerPolicy, error) {
+	sp, _, err := cert.UnmarshalSignedPeerPolicyFromPEM(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return sp.Verify(time.Now(), pm.signers())
+}
+
+// allows reports if a tunnel started by from to to is allowed. Tunnels with a lighthouse are always allowed so a
+// policy can be fetched and a bad one replaced, every other tunnel is refused until the first policy is loaded.
+func (pm *peerPolicyManager) allows(from, to iputil.VpnIp) bool {
+	if pm == nil || !pm.enabled {
+		return true
+	}
+
+	if pm.lh.IsLighthouseIP(from) || pm.lh.IsLighthouseIP(to) {
+		return true
+	}
+
+	p := pm.current.Load()
+	if p == nil {
+		return false
+	}
+
+	return p.allows(from, to)
+}
+
+// version returns the version of the policy we enforce, 0 before the first one arrived
+func (pm *peerPolicyManager) version() uint64 {
+	if p := pm.current.Load(); p != nil {
+		return p.version
+	}
+	return 0
+}
+
+// run asks the lighthouses for a newer policy every peer_policy.refresh_interval until ctx is done. In between, the
+// chunks of a fetch that did not arrive are asked for again.
+func (pm *peerPolicyManager) run(ctx context.Context, w EncWriter) {
+	ticker := time.NewTicker(pm.interval)
+	defer ticker.Stop()
+	retry := time.NewTicker(peerPolicyChunkRetry)
+	defer retry.Stop()
+
+	pm.refresh(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pm.refresh(w)
+		case now := <-retry.C:
+			pm.retry(w, now)
+		}
+	}
+}
+
+// refresh sends the version we have to every lighthouse, the ones with a newer policy answer with its first chunk
+func (pm *peerPolicyManager) refresh(w EncWriter) {
+	m := &NebulaMeta{
+		Type:    NebulaMeta_PeerPolicyRequest,
+		Details: &NebulaMetaDetails{PolicyVersion: pm.version()},
+	}
+
+	for vpnIp := range pm.lh.GetLighthouses() {
+		pm.send(w, vpnIp, m)
+	}
+}
+
+// retry asks the lighthouse of a fetch again for the chunk that has not arrived within peerPolicyChunkRetry, the
+// fetch is dropped after peerPolicyChunkRetries attempts and starts over on the next refresh
+func (pm *peerPolicyManager) retry(w EncWriter, now time.Time) {
+	pm.fetchLock.Lock()
+	f := pm.fetch
+	if f == nil || now.Sub(f.requested) < peerPolicyChunkRetry {
+		pm.fetchLock.Unlock()
+		return
+	}
+
+	if f.retries >= peerPolicyChunkRetries {
+		pm.fetch = nil
+		pm.fetchLock.Unlock()
+		pm.l.WithField("vpnIp", f.from).WithField("version", f.version).WithField("offset", len(f.buf)).
+			Warn("Dropping a peer policy fetch after the lighthouse stopped answering")
+		return
+	}
+
+	f.retries++
+	f.requested = now
+	m := f.request()
+	pm.fetchLock.Unlock()
+
+	pm.send(w, f.from, m)
+}
+
+func (pm *peerPolicyManager) send(w EncWriter, vpnIp iputil.VpnIp, m *NebulaMeta) {
+	b, err := m.Marshal()
+	if err != nil {
+		pm.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal peer policy message")
+		return
+	}
+
+	pm.lh.metricTx(m.Type, 1)
+	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, b, make([]byte, 12, 12), make([]byte, mtu))
+}
+
+// handleRequest answers a PeerPolicyRequest. A request for offset 0 carries the version the client has and is only
+// answered if we serve a newer one, a request for a later offset continues a fetch of the version we serve.
+func (pm *peerPolicyManager) handleRequest(d *NebulaMetaDetails) *NebulaMeta {
+	s := pm.served.Load()
+	if s == nil {
+		return nil
+	}
+
+	if d.PolicyOffset == 0 && s.version <= d.PolicyVersion {
+		return nil
+	}
+
+	if d.PolicyOffset > 0 && s.version != d.PolicyVersion {
+		return nil
+	}
+
+	if int(d.PolicyOffset) >= len(s.raw) {
+		return nil
+	}
+
+	end := int(d.PolicyOffset) + peerPolicyChunkSize
+	if end > len(s.raw) {
+		end = len(s.raw)
+	}
+
+	return &NebulaMeta{
+		Type: NebulaMeta_PeerPolicyReply,
+		Details: &NebulaMetaDetails{
+			PolicyVersion: s.version,
+			PolicyOffset:  d.PolicyOffset,
+			PolicyLength:  uint32(len(s.raw)),
+			PolicyChunk:   s.raw[d.PolicyOffset:end],
+		},
+	}
+}
+
+// handleReply adds a chunk sent by the lighthouse from to the fetch and returns the request for the next chunk. The
+// policy is verified and applied once the last chunk has arrived.
+func (pm *peerPolicyManager) handleReply(from iputil.VpnIp, d *NebulaMetaDetails) *NebulaMeta {
+	if !pm.enabled || len(d.PolicyChunk) == 0 || d.PolicyVersion <= pm.version() {
+		return nil
+	}
+
+	if d.PolicyLength > maxPeerPolicySize {
+		pm.l.WithField("vpnIp", from).WithField("length", d.PolicyLength).
+			Warn("Ignoring a peer policy that is too large")
+		return nil
+	}
+
+	next, done := pm.addChunk(from, d)
+	if done != nil {
+		pm.apply(done)
+	}
+	return next
+}
+
+// addChunk adds a chunk to the fetch, it returns the request for the next chunk or the fetch once it is complete
+func (pm *peerPolicyManager) addChunk(from iputil.VpnIp, d *NebulaMetaDetails) (*NebulaMeta, *peerPolicyFetch) {
+	pm.fetchLock.Lock()
+	defer pm.fetchLock.Unlock()
+
+	f := pm.fetch
+	if d.PolicyOffset == 0 {
+		// A fetch that is still moving is only replaced by a newer version
+		if f != nil && f.from != from && d.PolicyVersion <= f.version && time.Since(f.updated) < peerPolicyFetchTimeout {
+			return nil, nil
+		}
+
+		f = &peerPolicyFetch{
+			from:    from,
+			version: d.PolicyVersion,
+			length:  d.PolicyLength,
+			buf:     make([]byte, 0, d.PolicyLength),
+		}
+		pm.fetch = f
+	}
+
+	if f == nil || f.from != from || f.version != d.PolicyVersion || f.length != d.PolicyLength ||
+		int(d.PolicyOffset) != len(f.buf) {
+		// A duplicated or out of order chunk, the fetch goes on with the chunk we asked for
+		return nil, nil
+	}
+
+	if len(f.buf)+len(d.PolicyChunk) > int(f.length) {
+		pm.fetch = nil
+		return nil, nil
+	}
+
+	f.buf = append(f.buf, d.PolicyChunk...)
+	f.updated = time.Now()
+	if len(f.buf) < int(f.length) {
+		f.requested = f.updated
+		f.retries = 0
+		return f.request(), nil
+	}
+
+	pm.fetch = nil
+	return nil, f
+}
+
+// apply verifies a fetched document and starts enforcing it if it is newer than the one we have
+func (pm *peerPolicyManager) apply(f *peerPolicyFetch) {
+	l := pm.l.WithField("vpnIp", f.from).WithField("version", f.version)
+
+	p, err := pm.verify(f.buf)
+	if err != nil {
+		l.WithError(err).Error("Refusing a peer policy that could not be verified")
+		return
+	}
+
+	if p.Version != f.version {
+		l.WithField("policyVersion", p.Version).Error("Refusing a peer policy that does not have the version the lighthouse announced")
+		return
+	}
+
+	for {
+		cur := pm.current.Load()
+		if cur != nil && cur.version >= p.Version {
+			return
+		}
+
+		if pm.current.CompareAndSwap(cur, newPeerPolicy(p)) {
+			break
+		}
+	}
+
+	pm.metricVersion.Update(int64(p.Version))
+	l.WithField("rules", len(p.Rules)).Info("Peer policy updated")
+	pm.saveCache(p.Version, f.buf)
+}
+
+func (lhh *LightHouseHandler) handlePeerPolicyRequest(n *NebulaMeta, vpnIp iputil.VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse || lhh.lh.peerPolicy == nil {
+		return
+	}
+
+	if reply := lhh.lh.peerPolicy.handleRequest(n.Details); reply != nil {
+		lhh.lh.peerPolicy.send(w, vpnIp, reply)
+	}
+}
+
+func (lhh *LightHouseHandler) handlePeerPolicyReply(n *NebulaMeta, vpnIp iputil.VpnIp, w EncWriter) {
+	if lhh.lh.peerPolicy == nil || !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	if next := lhh.lh.peerPolicy.handleReply(vpnIp, n.Details); next != nil {
+		lhh.lh.peerPolicy.send(w, vpnIp, next)
+	}
+}
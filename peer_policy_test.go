@@ -0,0 +1,367 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// newPeerPolicyTestCA returns a CA pool with a single CA and a function that signs policies with it
+func newPeerPolicyTestCA(t *testing.T) (*cert.NebulaCAPool, func(*cert.PeerPolicy) []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "test ca",
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	require.NoError(t, ca.Sign(cert.Curve_CURVE25519, priv))
+
+	pool := cert.NewCAPool()
+	b, err := ca.MarshalToPEM()
+	require.NoError(t, err)
+	_, err = pool.AddCACertificate(b)
+	require.NoError(t, err)
+
+	return pool, func(p *cert.PeerPolicy) []byte {
+		b, err := cert.SignPeerPolicy(p, ca, cert.Curve_CURVE25519, priv)
+		require.NoError(t, err)
+		return b
+	}
+}
+
+func newTestPeerPolicyManager(lh *LightHouse, pool *cert.NebulaCAPool, enabled bool) *peerPolicyManager {
+	pm := &peerPolicyManager{
+		l:             lh.l,
+		lh:            lh,
+		signers:       func() *cert.NebulaCAPool { return pool },
+		enabled:       enabled,
+		interval:      time.Minute,
+		metricVersion: metrics.NilGauge{},
+	}
+	lh.peerPolicy = pm
+	return pm
+}
+
+// largePeerPolicy returns a policy big enough to be sent in several chunks, only the first rule allows anything
+func largePeerPolicy(version uint64) *cert.PeerPolicy {
+	p := &cert.PeerPolicy{Version: version, Rules: []cert.PeerPolicyRule{{From: "10.1.0.0/24", To: "10.1.1.0/24"}}}
+	for i := 0; i < 100; i++ {
+		p.Rules = append(p.Rules, cert.PeerPolicyRule{From: fmt.Sprintf("10.200.%d.0/24", i), To: "10.201.0.0/16"})
+	}
+	return p
+}
+
+// fetchPeerPolicy passes the messages between a client and a lighthouse until the client has nothing left to ask for
+func fetchPeerPolicy(t *testing.T, client, server *peerPolicyManager, clientIp, lhIp iputil.VpnIp) int {
+	lw := &testEncWriter{}
+	cw := &testEncWriter{}
+	clientHandler := client.lh.NewRequestHandler()
+	serverHandler := server.lh.NewRequestHandler()
+
+	client.refresh(cw)
+	replies := 0
+	for cw.lastReply.msg != nil {
+		require.Equal(t, lhIp, cw.lastReply.vpnIp)
+		req, err := cw.lastReply.msg.Marshal()
+		require.NoError(t, err)
+		cw.lastReply = testLhReply{}
+
+		serverHandler.HandleRequest(nil, clientIp, req, lw)
+		if lw.lastReply.msg == nil {
+			break
+		}
+		require.Equal(t, clientIp, lw.lastReply.vpnIp)
+		reply, err := lw.lastReply.msg.Marshal()
+		require.NoError(t, err)
+		lw.lastReply = testLhReply{}
+		replies++
+
+		clientHandler.HandleRequest(nil, lhIp, reply, cw)
+	}
+
+	return replies
+}
+
+func TestPeerPolicyManager_fetch(t *testing.T) {
+	pool, sign := newPeerPolicyTestCA(t)
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+	clientIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.2"))
+	peerIp := iputil.Ip2VpnIp(net.ParseIP("10.1.1.2"))
+
+	serverLh := newTestLighthouse()
+	serverLh.amLighthouse = true
+	server := newTestPeerPolicyManager(serverLh, pool, false)
+
+	clientLh := newTestLighthouse()
+	clientLh.lighthouses.Store(&map[iputil.VpnIp]struct{}{lhIp: {}})
+	client := newTestPeerPolicyManager(clientLh, pool, true)
+
+	// Only tunnels with a lighthouse are allowed until a policy arrives
+	assert.Equal(t, 0, fetchPeerPolicy(t, client, server, clientIp, lhIp))
+	assert.False(t, client.allows(peerIp, clientIp))
+	assert.True(t, client.allows(clientIp, lhIp))
+
+	raw := sign(largePeerPolicy(2))
+	require.Greater(t, len(raw), 3*peerPolicyChunkSize)
+	server.served.Store(&servedPeerPolicy{version: 2, raw: raw})
+
+	assert.Equal(t, (len(raw)+peerPolicyChunkSize-1)/peerPolicyChunkSize, fetchPeerPolicy(t, client, server, clientIp, lhIp))
+	assert.Equal(t, uint64(2), client.version())
+	assert.Nil(t, client.fetch)
+
+	assert.True(t, client.allows(iputil.Ip2VpnIp(net.ParseIP("10.1.0.9")), peerIp))
+	assert.False(t, client.allows(peerIp, iputil.Ip2VpnIp(net.ParseIP("10.1.0.9"))))
+	assert.False(t, client.allows(clientIp, iputil.Ip2VpnIp(net.ParseIP("10.3.0.1"))))
+
+	// Tunnels with a lighthouse are always allowed
+	assert.True(t, client.allows(clientIp, lhIp))
+	assert.True(t, client.allows(lhIp, peerIp))
+
+	// A lighthouse with the same version has nothing to send
+	assert.Equal(t, 0, fetchPeerPolicy(t, client, server, clientIp, lhIp))
+
+	// A newer policy replaces the old one on the next refresh
+	raw = sign(&cert.PeerPolicy{Version: 5, Rules: []cert.PeerPolicyRule{{From: "0.0.0.0/0", To: "10.1.1.0/24"}}})
+	server.served.Store(&servedPeerPolicy{version: 5, raw: raw})
+	assert.Equal(t, 1, fetchPeerPolicy(t, client, server, clientIp, lhIp))
+	assert.Equal(t, uint64(5), client.version())
+	assert.True(t, client.allows(iputil.Ip2VpnIp(net.ParseIP("10.3.0.1")), peerIp))
+
+	// An older version is never applied, even if a lighthouse claims it is newer
+	raw = sign(largePeerPolicy(3))
+	server.served.Store(&servedPeerPolicy{version: 7, raw: raw})
+	fetchPeerPolicy(t, client, server, clientIp, lhIp)
+	assert.Equal(t, uint64(5), client.version())
+
+	// A policy signed by a CA we do not trust is refused
+	_, otherSign := newPeerPolicyTestCA(t)
+	server.served.Store(&servedPeerPolicy{version: 8, raw: otherSign(largePeerPolicy(8))})
+	fetchPeerPolicy(t, client, server, clientIp, lhIp)
+	assert.Equal(t, uint64(5), client.version())
+
+	// Replies from a host that is not a lighthouse are ignored
+	server.served.Store(&servedPeerPolicy{version: 9, raw: sign(largePeerPolicy(9))})
+	clientLh.lighthouses.Store(&map[iputil.VpnIp]struct{}{})
+	client.fetch = nil
+	reply := server.handleRequest(&NebulaMetaDetails{PolicyVersion: 5})
+	require.NotNil(t, reply)
+	b, err := reply.Marshal()
+	require.NoError(t, err)
+	w := &testEncWriter{}
+	clientLh.NewRequestHandler().HandleRequest(nil, lhIp, b, w)
+	assert.Nil(t, w.lastReply.msg)
+	assert.Nil(t, client.fetch)
+}
+
+func TestPeerPolicyManager_handleReply(t *testing.T) {
+	pool, sign := newPeerPolicyTestCA(t)
+	lh1 := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+	lh2 := iputil.Ip2VpnIp(net.ParseIP("10.1.0.2"))
+
+	lh := newTestLighthouse()
+	pm := newTestPeerPolicyManager(lh, pool, true)
+	raw := sign(largePeerPolicy(2))
+
+	chunk := func(version uint64, offset int) *NebulaMetaDetails {
+		end := offset + peerPolicyChunkSize
+		if end > len(raw) {
+			end = len(raw)
+		}
+		return &NebulaMetaDetails{
+			PolicyVersion: version,
+			PolicyOffset:  uint32(offset),
+			PolicyLength:  uint32(len(raw)),
+			PolicyChunk:   raw[offset:end],
+		}
+	}
+
+	next := pm.handleReply(lh1, chunk(2, 0))
+	require.NotNil(t, next)
+	assert.Equal(t, NebulaMeta_PeerPolicyRequest, next.Type)
+	assert.Equal(t, &NebulaMetaDetails{PolicyVersion: 2, PolicyOffset: peerPolicyChunkSize}, next.Details)
+
+	// Another lighthouse can not take over a fetch that is moving, chunks that are out of order are dropped
+	assert.Nil(t, pm.handleReply(lh2, chunk(2, 0)))
+	assert.Nil(t, pm.handleReply(lh2, chunk(2, peerPolicyChunkSize)))
+	assert.Nil(t, pm.handleReply(lh1, chunk(2, 2*peerPolicyChunkSize)))
+	assert.Equal(t, lh1, pm.fetch.from)
+
+	// Unless the fetch stalled
+	pm.fetch.updated = time.Now().Add(-peerPolicyFetchTimeout)
+	assert.NotNil(t, pm.handleReply(lh2, chunk(2, 0)))
+	assert.Equal(t, lh2, pm.fetch.from)
+
+	for offset := peerPolicyChunkSize; offset < len(raw); offset += peerPolicyChunkSize {
+		pm.handleReply(lh2, chunk(2, offset))
+	}
+	assert.Equal(t, uint64(2), pm.version())
+
+	// A document that is too large is never fetched
+	assert.Nil(t, pm.handleReply(lh1, &NebulaMetaDetails{PolicyVersion: 3, PolicyLength: maxPeerPolicySize + 1, PolicyChunk: []byte{1}}))
+	assert.Nil(t, pm.fetch)
+
+	// Nothing is fetched when peer_policy.enabled is off
+	pm.enabled = false
+	pm.current.Store(nil)
+	assert.Nil(t, pm.handleReply(lh1, chunk(2, 0)))
+	assert.True(t, pm.allows(lh1, lh2))
+}
+
+func TestPeerPolicyManager_retry(t *testing.T) {
+	pool, sign := newPeerPolicyTestCA(t)
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+
+	pm := newTestPeerPolicyManager(newTestLighthouse(), pool, true)
+	raw := sign(largePeerPolicy(2))
+	w := &testEncWriter{}
+
+	// Nothing to ask for without a fetch
+	pm.retry(w, time.Now())
+	assert.Nil(t, w.lastReply.msg)
+
+	next := pm.handleReply(lhIp, &NebulaMetaDetails{PolicyVersion: 2, PolicyLength: uint32(len(raw)), PolicyChunk: raw[:peerPolicyChunkSize]})
+	require.NotNil(t, next)
+	requested := pm.fetch.requested
+
+	// The chunk is not asked for again before peerPolicyChunkRetry
+	pm.retry(w, requested.Add(peerPolicyChunkRetry/2))
+	assert.Nil(t, w.lastReply.msg)
+
+	// The lost chunk is asked for again, from the same lighthouse
+	now := requested
+	for i := 0; i < peerPolicyChunkRetries; i++ {
+		now = now.Add(peerPolicyChunkRetry)
+		pm.retry(w, now)
+		assert.Equal(t, lhIp, w.lastReply.vpnIp)
+		assert.Equal(t, next, w.lastReply.msg)
+		w.lastReply = testLhReply{}
+	}
+
+	// A chunk that arrives resets the retries
+	next = pm.handleReply(lhIp, &NebulaMetaDetails{
+		PolicyVersion: 2,
+		PolicyOffset:  peerPolicyChunkSize,
+		PolicyLength:  uint32(len(raw)),
+		PolicyChunk:   raw[peerPolicyChunkSize : 2*peerPolicyChunkSize],
+	})
+	require.NotNil(t, next)
+	assert.Equal(t, 0, pm.fetch.retries)
+
+	// A lighthouse that never answers loses the fetch
+	now = pm.fetch.requested
+	for i := 0; i <= peerPolicyChunkRetries; i++ {
+		now = now.Add(peerPolicyChunkRetry)
+		pm.retry(w, now)
+	}
+	assert.Nil(t, pm.fetch)
+}
+
+func TestPeerPolicyManager_cache(t *testing.T) {
+	l := test.NewLogger()
+	pool, sign := newPeerPolicyTestCA(t)
+	pki := &PKI{}
+	pki.caPool.Store(pool)
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+	path := filepath.Join(t.TempDir(), "policy.cache")
+
+	c := config.NewC(l)
+	c.Settings["peer_policy"] = map[interface{}]interface{}{"enabled": true, "cache": path}
+	pm, err := newPeerPolicyManagerFromConfig(l, c, newTestLighthouse(), pki)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), pm.version())
+
+	// A fetched policy is saved
+	raw := sign(&cert.PeerPolicy{Version: 3, Rules: []cert.PeerPolicyRule{{From: "10.1.0.0/24", To: "10.1.1.0/24"}}})
+	pm.handleReply(lhIp, &NebulaMetaDetails{PolicyVersion: 3, PolicyLength: uint32(len(raw)), PolicyChunk: raw})
+	assert.Equal(t, uint64(3), pm.version())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, raw, b)
+
+	// And enforced from the start of the next run
+	pm, err = newPeerPolicyManagerFromConfig(l, c, newTestLighthouse(), pki)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), pm.version())
+	assert.True(t, pm.allows(iputil.Ip2VpnIp(net.ParseIP("10.1.0.2")), iputil.Ip2VpnIp(net.ParseIP("10.1.1.2"))))
+
+	// A cache that does not verify is ignored
+	_, otherSign := newPeerPolicyTestCA(t)
+	require.NoError(t, os.WriteFile(path, otherSign(largePeerPolicy(4)), 0600))
+	pm, err = newPeerPolicyManagerFromConfig(l, c, newTestLighthouse(), pki)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), pm.version())
+	assert.False(t, pm.allows(iputil.Ip2VpnIp(net.ParseIP("10.1.0.2")), iputil.Ip2VpnIp(net.ParseIP("10.1.1.2"))))
+}
+
+func TestNewPeerPolicyManagerFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	pool, sign := newPeerPolicyTestCA(t)
+	pki := &PKI{}
+	pki.caPool.Store(pool)
+
+	lh := newTestLighthouse()
+	lh.amLighthouse = true
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.pem")
+	require.NoError(t, os.WriteFile(path, sign(largePeerPolicy(4)), 0600))
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"peer_policy": path}
+	pm, err := newPeerPolicyManagerFromConfig(l, c, lh, pki)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), pm.served.Load().version)
+
+	// The served policy is read again on reload
+	require.NoError(t, os.WriteFile(path, sign(largePeerPolicy(6)), 0600))
+	require.NoError(t, pm.reload(c, false))
+	assert.Equal(t, uint64(6), pm.served.Load().version)
+
+	// A document we can not verify is not served
+	_, otherSign := newPeerPolicyTestCA(t)
+	require.NoError(t, os.WriteFile(path, otherSign(largePeerPolicy(7)), 0600))
+	assert.ErrorIs(t, pm.reload(c, false), cert.ErrPolicySignerUnknown)
+	assert.Equal(t, uint64(6), pm.served.Load().version)
+
+	c.Settings["peer_policy"] = map[interface{}]interface{}{"refresh_interval": "0s"}
+	_, err = newPeerPolicyManagerFromConfig(l, c, lh, pki)
+	assert.EqualError(t, err, "peer_policy.refresh_interval must be greater than 0: 0s")
+
+	// The signers replace the CAs in pki.ca
+	otherPool, _ := newPeerPolicyTestCA(t)
+	var signers []byte
+	for _, ca := range otherPool.CAs {
+		signers, err = ca.MarshalToPEM()
+		require.NoError(t, err)
+	}
+	c.Settings["peer_policy"] = map[interface{}]interface{}{"signers": string(signers)}
+	_, err = newPeerPolicyManagerFromConfig(l, c, lh, pki)
+	assert.EqualError(t, err, "lighthouse.peer_policy file "+path+": peer policy signer is not a trusted CA")
+
+	// A lighthouse never enforces a policy
+	c.Settings["peer_policy"] = map[interface{}]interface{}{"enabled": true}
+	c.Settings["lighthouse"] = map[interface{}]interface{}{}
+	pm, err = newPeerPolicyManagerFromConfig(l, c, lh, pki)
+	require.NoError(t, err)
+	assert.False(t, pm.enabled)
+	assert.Nil(t, pm.served.Load())
+}
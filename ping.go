@@ -0,0 +1,264 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// PingStatus is ok when a peer replied over a direct tunnel, relayed when it replied through a relay, and failed
+// when it did not reply in time
+type PingStatus string
+
+const (
+	PingOk      PingStatus = "ok"
+	PingRelayed PingStatus = "relayed"
+	PingFailed  PingStatus = "failed"
+)
+
+// PingResult is the outcome of pinging a single peer. Rtt includes the handshake if there was no tunnel to the peer.
+// Remote is the underlay address the test request was sent to and Local the address it was sent from, if one was chosen.
+type PingResult struct {
+	VpnIp  iputil.VpnIp  `json:"vpnIp"`
+	Status PingStatus    `json:"status"`
+	Rtt    time.Duration `json:"rtt,omitempty"`
+	Remote *udp.Addr     `json:"remote,omitempty"`
+	Local  net.IP        `json:"local,omitempty"`
+}
+
+// pinger tracks the peers we are waiting on a test reply from. Replies do not reliably echo the request payload so any
+// test reply from a peer, including one for a connection manager test, completes the pings waiting on it.
+type pinger struct {
+	sync.Mutex
+	pending map[iputil.VpnIp][]chan struct{}
+}
+
+func newPinger() *pinger {
+	return &pinger{pending: map[iputil.VpnIp][]chan struct{}{}}
+}
+
+func (p *pinger) add(vpnIp iputil.VpnIp) chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+	c := make(chan struct{})
+	p.pending[vpnIp] = append(p.pending[vpnIp], c)
+	return c
+}
+
+func (p *pinger) remove(vpnIp iputil.VpnIp, c chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	pending := p.pending[vpnIp]
+	for i := range pending {
+		if pending[i] == c {
+			pending = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+
+	if len(pending) == 0 {
+		delete(p.pending, vpnIp)
+	} else {
+		p.pending[vpnIp] = pending
+	}
+}
+
+// reply is called for every test reply, it completes the pings waiting on vpnIp
+func (p *pinger) reply(vpnIp iputil.VpnIp) {
+	p.Lock()
+	pending, ok := p.pending[vpnIp]
+	if ok {
+		delete(p.pending, vpnIp)
+	}
+	p.Unlock()
+
+	for _, c := range pending {
+		close(c)
+	}
+}
+
+// ping sends a test request to vpnIp, starting a handshake if needed, and waits up to timeout for the reply
+func (f *Interface) ping(vpnIp iputil.VpnIp, timeout time.Duration) PingResult {
+	r := PingResult{VpnIp: vpnIp, Status: PingFailed}
+
+	reply := f.pinger.add(vpnIp)
+	defer f.pinger.remove(vpnIp, reply)
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	start := time.Now()
+	if hostinfo := f.hostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+		hostinfo.testSent.Store(start.UnixNano())
+	}
+	f.SendMessageToVpnIp(header.Test, header.TestRequest, vpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+
+	select {
+	case <-reply:
+	case <-t.C:
+		return r
+	}
+
+	r.Rtt = time.Since(start)
+	r.Status = PingOk
+	if hostinfo := f.hostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+		if hostinfo.remote == nil {
+			r.Status = PingRelayed
+		} else {
+			r.Remote = hostinfo.remote.Copy()
+		}
+	}
+
+	return r
+}
+
+// pingPath pings vpnIp over a specific underlay path, sending the test request to remote instead of the address the
+// tunnel is using and from local when it is set. A nil remote uses the tunnel's address. The tunnel is handshaked first
+// if needed and Rtt only covers the test request. The reply comes back over whatever path the peer uses for us, and the
+// peer roams to local like it would for any authenticated packet.
+func (f *Interface) pingPath(vpnIp iputil.VpnIp, remote *udp.Addr, local net.IP, timeout time.Duration) PingResult {
+	if remote == nil && local == nil {
+		return f.ping(vpnIp, timeout)
+	}
+
+	r := PingResult{VpnIp: vpnIp, Status: PingFailed, Local: local}
+	deadline := time.Now().Add(timeout)
+
+	hostinfo := f.hostMap.QueryVpnIp(vpnIp)
+	if hostinfo == nil {
+		// The test request has to be encrypted, get a tunnel over the usual path first
+		if f.ping(vpnIp, timeout).Status == PingFailed {
+			return r
+		}
+		hostinfo = f.hostMap.QueryVpnIp(vpnIp)
+		if hostinfo == nil {
+			return r
+		}
+	}
+
+	if remote == nil {
+		if hostinfo.remote == nil {
+			f.l.WithField("vpnIp", vpnIp).Info("Can not ping a relayed tunnel without a remote address")
+			return r
+		}
+		remote = hostinfo.remote.Copy()
+	}
+	r.Remote = remote
+
+	reply := f.pinger.add(vpnIp)
+	defer f.pinger.remove(vpnIp, reply)
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+
+	start := time.Now()
+	hostinfo.testSent.Store(start.UnixNano())
+	if err := f.sendTestFrom(hostinfo, remote, local); err != nil {
+		hostinfo.logger(f.l).WithError(err).WithField("udpAddr", remote).WithField("localAddr", local).
+			Error("Failed to send the ping")
+		return r
+	}
+
+	select {
+	case <-reply:
+	case <-t.C:
+		return r
+	}
+
+	r.Rtt = time.Since(start)
+	r.Status = PingOk
+	return r
+}
+
+// sendTestFrom sends a test request for hostinfo to remote, from the local address when it is set
+func (f *Interface) sendTestFrom(hostinfo *HostInfo, remote *udp.Addr, local net.IP) error {
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	if local == nil {
+		f.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, remote, []byte(""), nb, out)
+		return nil
+	}
+
+	w, ok := f.writers[0].(udp.SourceWriter)
+	if !ok {
+		return fmt.Errorf("%T does not support choosing the source address", f.writers[0])
+	}
+
+	ci := hostinfo.ConnectionState
+	if ci.eKey == nil {
+		return errors.New("the tunnel has no encryption key")
+	}
+
+	if noiseutil.EncryptLockNeeded {
+		ci.writeLock.Lock()
+	}
+	c := ci.messageCounter.Add(1)
+	out = header.Encode(out, header.Version, header.Test, header.TestRequest, hostinfo.remoteIndexId, c)
+	out, err := ci.eKey.EncryptDanger(out, out, nil, c, nb)
+	if noiseutil.EncryptLockNeeded {
+		ci.writeLock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.messageMetrics.Tx(header.Test, header.TestRequest, 1)
+	f.connectionManager.Out(hostinfo.localIndexId)
+	return w.WriteToFrom(out, remote, local)
+}
+
+// pingAll pings every peer in the host map, the static host map, and the lighthouses with at most concurrency pings in
+// flight. The results are sorted by vpn ip.
+func (f *Interface) pingAll(timeout time.Duration, concurrency int) []PingResult {
+	targets := map[iputil.VpnIp]struct{}{}
+	f.hostMap.RLock()
+	for vpnIp := range f.hostMap.Hosts {
+		targets[vpnIp] = struct{}{}
+	}
+	f.hostMap.RUnlock()
+
+	for vpnIp := range f.lightHouse.GetStaticHostList() {
+		targets[vpnIp] = struct{}{}
+	}
+
+	for vpnIp := range f.lightHouse.GetLighthouses() {
+		targets[vpnIp] = struct{}{}
+	}
+	delete(targets, f.myVpnIp.Load())
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]PingResult, 0, len(targets))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for vpnIp := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(vpnIp iputil.VpnIp) {
+			defer wg.Done()
+			r := f.ping(vpnIp, timeout)
+			<-sem
+
+			lock.Lock()
+			results = append(results, r)
+			lock.Unlock()
+		}(vpnIp)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].VpnIp < results[j].VpnIp
+	})
+	return results
+}
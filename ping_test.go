@@ -0,0 +1,36 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinger(t *testing.T) {
+	closed := func(c chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	p := newPinger()
+	a := p.add(iputil.VpnIp(1))
+	b := p.add(iputil.VpnIp(1))
+	c := p.add(iputil.VpnIp(2))
+
+	// A reply only completes the pings to the host that sent it
+	p.reply(iputil.VpnIp(1))
+	assert.True(t, closed(a))
+	assert.True(t, closed(b))
+	assert.False(t, closed(c))
+	assert.NotContains(t, p.pending, iputil.VpnIp(1))
+
+	// A ping that timed out is forgotten and a late reply is ignored
+	p.remove(iputil.VpnIp(2), c)
+	assert.Empty(t, p.pending)
+	p.reply(iputil.VpnIp(2))
+}
@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -11,13 +12,31 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/util"
 )
 
 type PKI struct {
-	cs     atomic.Pointer[CertState]
+	// cs is the primary certificate, it is used for every handshake we initiate
+	cs atomic.Pointer[CertState]
+	// certs holds every certificate from pki.certs, including the primary. A responder answers with the one signed by
+	// the same CA as the initiator if the primary is not, and tunnels using any of them are kept.
+	certs  atomic.Pointer[[]*CertState]
 	caPool atomic.Pointer[cert.NebulaCAPool]
-	l      *logrus.Logger
+	// requireGroups refuses handshakes from peers whose certificate has none of these groups, empty allows any peer
+	requireGroups atomic.Pointer[[]string]
+	// certChain holds the intermediate CAs between our certificate and its root, sent in handshakes so peers that only
+	// have the root can build the chain
+	certChain atomic.Pointer[[][]byte]
+	// caExpiry holds pki.ca_expiry, caExpiryWarned is when expiring root CAs were last logged in unix nanoseconds
+	caExpiry       atomic.Pointer[caExpiry]
+	caExpiryWarned atomic.Int64
+	// renumber moves the node to the vpn ip of a certificate that pki.allow_renumber let through, it is set once the
+	// interface is up
+	renumber func(*cert.NebulaCertificate) error
+	// tofu holds the fingerprints learned on first use when pki.tofu.path is set, it is not reloadable
+	tofu *tofuStore
+	l    *logrus.Logger
 }
 
 type CertState struct {
@@ -25,7 +44,10 @@ type CertState struct {
 	RawCertificate      []byte
 	RawCertificateNoKey []byte
 	PublicKey           []byte
-	PrivateKey          []byte
+	// PrivateKey is nil when the key is held by a pkcs11 token
+	PrivateKey []byte
+	// StaticKey performs every handshake operation with our private key
+	StaticKey StaticKey
 }
 
 func NewPKIFromConfig(l *logrus.Logger, c *config.C) (*PKI, error) {
@@ -35,6 +57,11 @@ func NewPKIFromConfig(l *logrus.Logger, c *config.C) (*PKI, error) {
 		return nil, err
 	}
 
+	pki.tofu, err = newTofuStoreFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load pki.tofu", nil, err)
+	}
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		rErr := pki.reload(c, false)
 		if rErr != nil {
@@ -49,6 +76,80 @@ func (p *PKI) GetCertState() *CertState {
 	return p.cs.Load()
 }
 
+// GetCertStates returns every certificate we hold, the primary first
+func (p *PKI) GetCertStates() []*CertState {
+	certs := p.certs.Load()
+	if certs == nil {
+		return []*CertState{p.cs.Load()}
+	}
+	return *certs
+}
+
+// IsCurrentCert returns true if c is one of the certificates we hold, tunnels using one of them do not need to
+// rehandshake
+func (p *PKI) IsCurrentCert(c *cert.NebulaCertificate) bool {
+	for _, cs := range p.GetCertStates() {
+		if bytes.Equal(cs.Certificate.Signature, c.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetResponderCertState returns the certificate to answer a handshake from peer with. That is the primary, unless it
+// was signed by a different CA than peer and another of our certificates was signed by the same one, which lets peers
+// that do not trust the CA of the primary yet keep connecting while it rolls out.
+func (p *PKI) GetResponderCertState(peer *cert.NebulaCertificate) *CertState {
+	primary := p.cs.Load()
+	if primary.Certificate.Details.Issuer == peer.Details.Issuer {
+		return primary
+	}
+
+	for _, cs := range p.GetCertStates() {
+		if cs.Certificate.Details.Issuer == peer.Details.Issuer {
+			return cs
+		}
+	}
+
+	return primary
+}
+
+// PromoteCert makes the certificate with fingerprint the primary, new handshakes we initiate use it from now on.
+// Tunnels using the old primary are kept. The promotion lasts until pki.certs is changed by a reload.
+func (p *PKI) PromoteCert(fingerprint string) error {
+	for _, cs := range p.GetCertStates() {
+		fp, err := cs.Certificate.Sha256Sum()
+		if err != nil || fp != fingerprint {
+			continue
+		}
+
+		p.cs.Store(cs)
+		p.reloadCertChain()
+		p.l.WithField("cert", cs.Certificate).Info("Promoted certificate to primary")
+		return nil
+	}
+
+	return fmt.Errorf("no certificate with fingerprint %s is loaded", fingerprint)
+}
+
+// CheckTofu returns true if a handshake from vpnIp may use the certificate with fingerprint under pki.tofu, nothing is
+// learned until the handshake completes. When it is refused the fingerprint learned for vpnIp is returned.
+func (p *PKI) CheckTofu(vpnIp iputil.VpnIp, fingerprint string) (string, bool) {
+	return p.tofu.check(vpnIp, fingerprint)
+}
+
+// LearnTofu pins fingerprint for vpnIp under pki.tofu after a handshake with it completed. Returns false and the
+// fingerprint that was learned if another handshake pinned a different one first.
+func (p *PKI) LearnTofu(vpnIp iputil.VpnIp, fingerprint string) (string, bool) {
+	return p.tofu.learn(vpnIp, fingerprint)
+}
+
+// ClearTofu forgets the fingerprint learned under pki.tofu for vpnIp, the next certificate it presents is learned
+// instead. Returns false if nothing was learned for vpnIp.
+func (p *PKI) ClearTofu(vpnIp iputil.VpnIp) (bool, error) {
+	return p.tofu.clear(vpnIp)
+}
+
 func (p *PKI) GetCAPool() *cert.NebulaCAPool {
 	return p.caPool.Load()
 }
@@ -62,6 +163,14 @@ func (p *PKI) reload(c *config.C, initial bool) error {
 		err.Log(p.l)
 	}
 
+	err = p.reloadCAExpiry(c, initial)
+	if err != nil {
+		if initial {
+			return err
+		}
+		err.Log(p.l)
+	}
+
 	err = p.reloadCAPool(c)
 	if err != nil {
 		if initial {
@@ -70,40 +179,182 @@ func (p *PKI) reload(c *config.C, initial bool) error {
 		err.Log(p.l)
 	}
 
+	if initial || c.HasChanged("pki.ca") || c.HasChanged("pki.ca_expiry") {
+		p.checkCAExpiry(time.Now(), true)
+	}
+
+	p.reloadCertChain()
+
+	if initial || c.HasChanged("pki.require_groups") {
+		groups := c.GetStringSlice("pki.require_groups", []string{})
+		p.requireGroups.Store(&groups)
+		if !initial {
+			p.l.WithField("requireGroups", groups).Info("pki.require_groups has changed")
+		}
+	}
+
 	return nil
 }
 
+// HasRequiredGroup returns true if c has at least one of the groups in pki.require_groups, or if none are required
+func (p *PKI) HasRequiredGroup(c *cert.NebulaCertificate) bool {
+	required := p.requireGroups.Load()
+	if required == nil || len(*required) == 0 {
+		return true
+	}
+
+	return hasAnyGroup(*required, c.Details.Groups)
+}
+
+// GetCertChain returns the marshalled intermediate CAs that sign our certificate, nil if it was signed by a root
+func (p *PKI) GetCertChain() [][]byte {
+	chain := p.certChain.Load()
+	if chain == nil {
+		return nil
+	}
+	return *chain
+}
+
+// GetCertChainFor returns the marshalled intermediate CAs that sign cs, which is the same as GetCertChain for the
+// primary
+func (p *PKI) GetCertChainFor(cs *CertState) [][]byte {
+	if cs == p.cs.Load() {
+		return p.GetCertChain()
+	}
+
+	caPool := p.caPool.Load()
+	if caPool == nil {
+		return nil
+	}
+
+	var raw [][]byte
+	for _, c := range caPool.GetChainForCert(cs.Certificate) {
+		b, err := c.Marshal()
+		if err != nil {
+			p.l.WithError(err).WithField("cert", c).Error("Failed to marshal an intermediate ca")
+			return nil
+		}
+		raw = append(raw, b)
+	}
+	return raw
+}
+
+// reloadCertChain finds the intermediates for our certificate in the CA pool, it runs after both have been loaded
+func (p *PKI) reloadCertChain() {
+	cs := p.cs.Load()
+	caPool := p.caPool.Load()
+	if cs == nil || caPool == nil {
+		return
+	}
+
+	var raw [][]byte
+	for _, c := range caPool.GetChainForCert(cs.Certificate) {
+		b, err := c.Marshal()
+		if err != nil {
+			p.l.WithError(err).WithField("cert", c).Error("Failed to marshal an intermediate ca")
+			return
+		}
+		raw = append(raw, b)
+	}
+
+	p.certChain.Store(&raw)
+	if len(raw) > 0 {
+		p.l.WithField("intermediates", len(raw)).Debug("Sending intermediate CAs with our certificate")
+	}
+}
+
 func (p *PKI) reloadCert(c *config.C, initial bool) *util.ContextualError {
-	cs, err := newCertStateFromConfig(c)
+	certs, err := newCertStatesFromConfig(c)
 	if err != nil {
 		return util.NewContextualError("Could not load client cert", nil, err)
 	}
+	cs := certs[0]
 
+	renumbered := false
 	if !initial {
-		// did IP in cert change? if so, don't set
+		// did IP in cert change? if so, don't set unless we can renumber
 		currentCert := p.cs.Load().Certificate
 		oldIPs := currentCert.Details.Ips
 		newIPs := cs.Certificate.Details.Ips
 		if len(oldIPs) > 0 && len(newIPs) > 0 && oldIPs[0].String() != newIPs[0].String() {
+			if !c.GetBool("pki.allow_renumber", false) || p.renumber == nil {
+				return util.NewContextualError(
+					"IP in new cert was different from old",
+					m{"new_ip": newIPs[0], "old_ip": oldIPs[0]},
+					nil,
+				)
+			}
+
+			if !oldIPs[0].Contains(newIPs[0].IP) || !bytes.Equal(oldIPs[0].Mask, newIPs[0].Mask) {
+				return util.NewContextualError(
+					"Network in new cert was different from old, this requires a restart",
+					m{"new_ip": newIPs[0], "old_ip": oldIPs[0]},
+					nil,
+				)
+			}
+			renumbered = true
+		}
+
+		// Keep a promoted primary if the list it came from did not change
+		if !c.HasChanged("pki.certs") && len(certs) > 1 {
+			current := p.cs.Load().Certificate.Signature
+			for i := range certs {
+				if bytes.Equal(certs[i].Certificate.Signature, current) {
+					certs[0], certs[i] = certs[i], certs[0]
+					cs = certs[0]
+					break
+				}
+			}
+		}
+	}
+
+	oldCs, oldCerts := p.cs.Load(), p.certs.Load()
+	p.cs.Store(cs)
+	p.certs.Store(&certs)
+	if renumbered {
+		// The new certificate is only kept if we could move to its vpn ip
+		if err := p.renumber(cs.Certificate); err != nil {
+			p.cs.Store(oldCs)
+			p.certs.Store(oldCerts)
 			return util.NewContextualError(
-				"IP in new cert was different from old",
-				m{"new_ip": newIPs[0], "old_ip": oldIPs[0]},
-				nil,
+				"Could not move to the IP in the new cert",
+				m{"new_ip": cs.Certificate.Details.Ips[0], "old_ip": oldCs.Certificate.Details.Ips[0]},
+				err,
 			)
 		}
 	}
 
-	p.cs.Store(cs)
 	if initial {
 		p.l.WithField("cert", cs.Certificate).Debug("Client nebula certificate")
 	} else {
 		p.l.WithField("cert", cs.Certificate).Info("Client cert refreshed from disk")
 	}
+
+	for _, other := range certs[1:] {
+		p.l.WithField("cert", other.Certificate).Debug("Additional nebula certificate accepted as responder")
+	}
+	return nil
+}
+
+func (p *PKI) reloadCAExpiry(c *config.C, initial bool) *util.ContextualError {
+	if !initial && !c.HasChanged("pki.ca_expiry") {
+		return nil
+	}
+
+	ce, err := parseCAExpiry(c)
+	if err != nil {
+		return util.NewContextualError("Failed to load pki.ca_expiry from config", nil, err)
+	}
+
+	p.caExpiry.Store(ce)
+	if !initial {
+		p.l.WithField("warnBefore", ce.warnBefore).WithField("grace", ce.grace).Info("pki.ca_expiry has changed")
+	}
 	return nil
 }
 
 func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
-	caPool, err := loadCAPoolFromConfig(p.l, c)
+	caPool, err := loadCAPoolFromConfig(p.l, c, p.caExpiry.Load())
 	if err != nil {
 		return util.NewContextualError("Failed to load ca from config", nil, err)
 	}
@@ -113,7 +364,7 @@ func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
 	return nil
 }
 
-func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*CertState, error) {
+func newCertState(certificate *cert.NebulaCertificate, staticKey StaticKey, privateKey []byte) (*CertState, error) {
 	// Marshal the certificate to ensure it is valid
 	rawCertificate, err := certificate.Marshal()
 	if err != nil {
@@ -125,6 +376,7 @@ func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*Cert
 		RawCertificate: rawCertificate,
 		Certificate:    certificate,
 		PrivateKey:     privateKey,
+		StaticKey:      staticKey,
 		PublicKey:      publicKey,
 	}
 
@@ -139,36 +391,109 @@ func newCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*Cert
 	return cs, nil
 }
 
+// newCertStatesFromConfig loads pki.certs, or pki.cert and pki.key when it is not set. The primary is first. Every
+// certificate must be for the same vpn ip.
+func newCertStatesFromConfig(c *config.C) ([]*CertState, error) {
+	raw := c.Get("pki.certs")
+	if raw == nil {
+		cs, err := newCertStateFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		return []*CertState{cs}, nil
+	}
+
+	entries, ok := raw.([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, errors.New("pki.certs must be a list of cert and key pairs")
+	}
+
+	var certs []*CertState
+	primary := -1
+	for i, e := range entries {
+		entry, ok := e.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("pki.certs entry %v must have a cert and a key", i+1)
+		}
+
+		toString := func(k string) string {
+			v, ok := entry[k]
+			if !ok || v == nil {
+				return ""
+			}
+			return fmt.Sprintf("%v", v)
+		}
+
+		name := fmt.Sprintf("pki.certs entry %v", i+1)
+		cs, err := loadCertState(name+" cert", toString("cert"), name+" key", toString("key"))
+		if err != nil {
+			return nil, err
+		}
+
+		if isPrimary, _ := entry["primary"].(bool); isPrimary {
+			if primary >= 0 {
+				return nil, errors.New("only one of pki.certs can be primary")
+			}
+			primary = i
+		}
+
+		if len(certs) > 0 && !certs[0].Certificate.Details.Ips[0].IP.Equal(cs.Certificate.Details.Ips[0].IP) {
+			return nil, fmt.Errorf("%s is for %v, every one of pki.certs must be for %v", name,
+				cs.Certificate.Details.Ips[0].IP, certs[0].Certificate.Details.Ips[0].IP)
+		}
+		certs = append(certs, cs)
+	}
+
+	if primary < 0 {
+		return nil, errors.New("one of pki.certs must be primary")
+	}
+
+	certs[0], certs[primary] = certs[primary], certs[0]
+	return certs, nil
+}
+
 func newCertStateFromConfig(c *config.C) (*CertState, error) {
+	return loadCertState("pki.cert", c.GetString("pki.cert", ""), "pki.key", c.GetString("pki.key", ""))
+}
+
+// loadCertState loads the certificate and private key in certPathOrPEM and keyPathOrPEM, the names are used in errors
+func loadCertState(certName, certPathOrPEM, keyName, keyPathOrPEM string) (*CertState, error) {
 	var pemPrivateKey []byte
+	var rawKey []byte
+	var curve cert.Curve
 	var err error
 
-	privPathOrPEM := c.GetString("pki.key", "")
+	privPathOrPEM := keyPathOrPEM
 	if privPathOrPEM == "" {
-		return nil, errors.New("no pki.key path or PEM data provided")
+		return nil, fmt.Errorf("no %s path or PEM data provided", keyName)
 	}
 
-	if strings.Contains(privPathOrPEM, "-----BEGIN") {
-		pemPrivateKey = []byte(privPathOrPEM)
-		privPathOrPEM = "<inline>"
+	// A pkcs11 key is opened once we have the certificate to check it against
+	isPKCS11 := strings.HasPrefix(privPathOrPEM, "pkcs11:")
 
-	} else {
-		pemPrivateKey, err = os.ReadFile(privPathOrPEM)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.key file %s: %s", privPathOrPEM, err)
+	if !isPKCS11 {
+		if strings.Contains(privPathOrPEM, "-----BEGIN") {
+			pemPrivateKey = []byte(privPathOrPEM)
+			privPathOrPEM = "<inline>"
+
+		} else {
+			pemPrivateKey, err = os.ReadFile(privPathOrPEM)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read %s file %s: %s", keyName, privPathOrPEM, err)
+			}
 		}
-	}
 
-	rawKey, _, curve, err := cert.UnmarshalPrivateKey(pemPrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+		rawKey, _, curve, err = cert.UnmarshalPrivateKey(pemPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling %s %s: %s", keyName, privPathOrPEM, err)
+		}
 	}
 
 	var rawCert []byte
 
-	pubPathOrPEM := c.GetString("pki.cert", "")
+	pubPathOrPEM := certPathOrPEM
 	if pubPathOrPEM == "" {
-		return nil, errors.New("no pki.cert path or PEM data provided")
+		return nil, fmt.Errorf("no %s path or PEM data provided", certName)
 	}
 
 	if strings.Contains(pubPathOrPEM, "-----BEGIN") {
@@ -178,13 +503,13 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 	} else {
 		rawCert, err = os.ReadFile(pubPathOrPEM)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read pki.cert file %s: %s", pubPathOrPEM, err)
+			return nil, fmt.Errorf("unable to read %s file %s: %s", certName, pubPathOrPEM, err)
 		}
 	}
 
 	nebulaCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
 	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling pki.cert %s: %s", pubPathOrPEM, err)
+		return nil, fmt.Errorf("error while unmarshaling %s %s: %s", certName, pubPathOrPEM, err)
 	}
 
 	if nebulaCert.Expired(time.Now()) {
@@ -195,14 +520,30 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 		return nil, fmt.Errorf("no IPs encoded in certificate")
 	}
 
+	if isPKCS11 {
+		staticKey, err := newPKCS11StaticKey(privPathOrPEM, nebulaCert)
+		if err != nil {
+			// The uri may hold the pin so it is not logged
+			return nil, fmt.Errorf("error while opening %s: %s", keyName, err)
+		}
+
+		return newCertState(nebulaCert, staticKey, nil)
+	}
+
 	if err = nebulaCert.VerifyPrivateKey(curve, rawKey); err != nil {
 		return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
 	}
 
-	return newCertState(nebulaCert, rawKey)
+	dhFunc, err := dhFuncForCurve(curve)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertState(nebulaCert, &memoryStaticKey{dhFunc: dhFunc, private: rawKey}, rawKey)
 }
 
-func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, error) {
+// loadCAPoolFromConfig loads pki.ca, at least one root CA must not have expired or still be in pki.ca_expiry.grace
+func loadCAPoolFromConfig(l *logrus.Logger, c *config.C, ce *caExpiry) (*cert.NebulaCAPool, error) {
 	var rawCA []byte
 	var err error
 
@@ -226,8 +567,10 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.NebulaCAPool, er
 		var expired int
 		for _, crt := range caPool.CAs {
 			if crt.Expired(time.Now()) {
-				expired++
 				l.WithField("cert", crt).Warn("expired certificate present in CA pool")
+				if ce == nil || !ce.inGrace(crt, time.Now()) {
+					expired++
+				}
 			}
 		}
 
@@ -0,0 +1,205 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"gopkg.in/yaml.v2"
+)
+
+// newTestCertPEM returns a certificate for ip that claims to be issued by the hex fingerprint issuer along with its private key, both PEM
+// encoded
+func newTestCertPEM(t *testing.T, name string, ip net.IP, issuer string) (*cert.NebulaCertificate, string, string) {
+	priv := make([]byte, 32)
+	_, err := rand.Read(priv)
+	assert.NoError(t, err)
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	assert.NoError(t, err)
+
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Ips:       []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 255, 0}}},
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			Issuer:    issuer,
+		},
+	}
+	assert.NoError(t, nc.Sign(cert.Curve_CURVE25519, signer))
+
+	certPEM, err := nc.MarshalToPEM()
+	assert.NoError(t, err)
+	return nc, string(certPEM), string(cert.MarshalX25519PrivateKey(priv))
+}
+
+func TestNewCertStatesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	oldCert, oldPEM, oldKey := newTestCertPEM(t, "old", net.IP{10, 1, 1, 1}, "01")
+	newCert, newPEM, newKey := newTestCertPEM(t, "new", net.IP{10, 1, 1, 1}, "02")
+	_, otherPEM, otherKey := newTestCertPEM(t, "other", net.IP{10, 1, 1, 2}, "02")
+
+	// Without pki.certs the single cert is used
+	c.Settings["pki"] = map[interface{}]interface{}{"cert": oldPEM, "key": oldKey}
+	certs, err := newCertStatesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, oldCert.Signature, certs[0].Certificate.Signature)
+
+	// The primary comes first
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": oldKey},
+		map[interface{}]interface{}{"cert": newPEM, "key": newKey, "primary": true},
+	}}
+	certs, err = newCertStatesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Len(t, certs, 2)
+	assert.Equal(t, newCert.Signature, certs[0].Certificate.Signature)
+	assert.Equal(t, oldCert.Signature, certs[1].Certificate.Signature)
+
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": oldKey},
+		map[interface{}]interface{}{"cert": newPEM, "key": newKey},
+	}}
+	_, err = newCertStatesFromConfig(c)
+	assert.EqualError(t, err, "one of pki.certs must be primary")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": oldKey, "primary": true},
+		map[interface{}]interface{}{"cert": newPEM, "key": newKey, "primary": true},
+	}}
+	_, err = newCertStatesFromConfig(c)
+	assert.EqualError(t, err, "only one of pki.certs can be primary")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": oldKey, "primary": true},
+		map[interface{}]interface{}{"cert": otherPEM, "key": otherKey},
+	}}
+	_, err = newCertStatesFromConfig(c)
+	assert.EqualError(t, err, "pki.certs entry 2 is for 10.1.1.2, every one of pki.certs must be for 10.1.1.1")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "primary": true},
+	}}
+	_, err = newCertStatesFromConfig(c)
+	assert.EqualError(t, err, "no pki.certs entry 1 key path or PEM data provided")
+
+	// The key must pair with its own cert
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": newKey, "primary": true},
+	}}
+	_, err = newCertStatesFromConfig(c)
+	assert.EqualError(t, err, "private key is not a pair with public key in nebula cert")
+}
+
+func TestPKI_PromoteCert(t *testing.T) {
+	l := test.NewLogger()
+	oldCert, oldPEM, oldKey := newTestCertPEM(t, "old", net.IP{10, 1, 1, 1}, "01")
+	newCert, newPEM, newKey := newTestCertPEM(t, "new", net.IP{10, 1, 1, 1}, "02")
+	stale, _, _ := newTestCertPEM(t, "stale", net.IP{10, 1, 1, 1}, "01")
+	oldPeer, _, _ := newTestCertPEM(t, "peer", net.IP{10, 1, 1, 2}, "01")
+	newPeer, _, _ := newTestCertPEM(t, "peer", net.IP{10, 1, 1, 2}, "02")
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": oldPEM, "key": oldKey},
+		map[interface{}]interface{}{"cert": newPEM, "key": newKey, "primary": true},
+	}}
+
+	p := &PKI{l: l}
+	assert.Nil(t, p.reloadCert(c, true))
+	assert.Equal(t, newCert.Signature, p.GetCertState().Certificate.Signature)
+
+	// Both are current, a cert we no longer hold is not
+	assert.True(t, p.IsCurrentCert(oldCert))
+	assert.True(t, p.IsCurrentCert(newCert))
+	assert.False(t, p.IsCurrentCert(stale))
+
+	// A peer from the old CA gets the old cert during the overlap, everyone else the primary
+	assert.Equal(t, oldCert.Signature, p.GetResponderCertState(oldPeer).Certificate.Signature)
+	assert.Equal(t, newCert.Signature, p.GetResponderCertState(newPeer).Certificate.Signature)
+
+	oldFingerprint, err := oldCert.Sha256Sum()
+	assert.NoError(t, err)
+	assert.NoError(t, p.PromoteCert(oldFingerprint))
+	assert.Equal(t, oldCert.Signature, p.GetCertState().Certificate.Signature)
+	assert.EqualError(t, p.PromoteCert("nope"), "no certificate with fingerprint nope is loaded")
+
+	// A promotion outlives a reload that does not change pki.certs
+	assert.Nil(t, p.reloadCert(c, false))
+	assert.Equal(t, oldCert.Signature, p.GetCertState().Certificate.Signature)
+
+	// Dropping the old cert leaves only the new one
+	b, err := yaml.Marshal(map[interface{}]interface{}{"pki": map[interface{}]interface{}{"certs": []interface{}{
+		map[interface{}]interface{}{"cert": newPEM, "key": newKey, "primary": true},
+	}}})
+	assert.NoError(t, err)
+	assert.NoError(t, c.ReloadConfigString(string(b)))
+	assert.Nil(t, p.reloadCert(c, false))
+	assert.Equal(t, newCert.Signature, p.GetCertState().Certificate.Signature)
+	assert.False(t, p.IsCurrentCert(oldCert))
+}
+
+func TestPKI_renumber(t *testing.T) {
+	l := test.NewLogger()
+	oldCert, oldPEM, oldKey := newTestCertPEM(t, "me", net.IP{10, 1, 1, 1}, "01")
+	newCert, newPEM, newKey := newTestCertPEM(t, "me", net.IP{10, 1, 1, 5}, "01")
+	_, otherNetPEM, otherNetKey := newTestCertPEM(t, "me", net.IP{10, 1, 2, 5}, "01")
+
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"cert": oldPEM, "key": oldKey}
+	p := &PKI{l: l}
+	assert.Nil(t, p.reloadCert(c, true))
+
+	reload := func(pemCert, key string, allow bool) *util.ContextualError {
+		b, err := yaml.Marshal(map[interface{}]interface{}{"pki": map[interface{}]interface{}{
+			"cert": pemCert, "key": key, "allow_renumber": allow,
+		}})
+		assert.NoError(t, err)
+		assert.NoError(t, c.ReloadConfigString(string(b)))
+		return p.reloadCert(c, false)
+	}
+
+	// A new vpn ip is refused unless pki.allow_renumber is set and the interface can renumber
+	assert.EqualError(t, reload(newPEM, newKey, false), "IP in new cert was different from old")
+	assert.EqualError(t, reload(newPEM, newKey, true), "IP in new cert was different from old")
+
+	var renumbered []*cert.NebulaCertificate
+	var renumberErr error
+	p.renumber = func(c *cert.NebulaCertificate) error {
+		renumbered = append(renumbered, c)
+		return renumberErr
+	}
+
+	// Moving to another network needs a restart
+	assert.EqualError(t, reload(otherNetPEM, otherNetKey, true), "Network in new cert was different from old, this requires a restart")
+	assert.Empty(t, renumbered)
+
+	// The old cert is kept if we could not move to the new vpn ip
+	renumberErr = errors.New("no tun")
+	assert.EqualError(t, reload(newPEM, newKey, true), "no tun")
+	assert.Equal(t, oldCert.Signature, p.GetCertState().Certificate.Signature)
+	assert.Len(t, p.GetCertStates(), 1)
+
+	renumberErr = nil
+	assert.Nil(t, reload(newPEM, newKey, true))
+	assert.Equal(t, newCert.Signature, p.GetCertState().Certificate.Signature)
+	if assert.Len(t, renumbered, 2) {
+		assert.Equal(t, newCert.Signature, renumbered[1].Signature)
+	}
+}
@@ -0,0 +1,174 @@
+package nebula
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const maxPprofDuration = 5 * time.Minute
+
+// startPprof initializes the pprof http endpoints from config. If pprof is enabled it returns a func that serves the
+// endpoints, otherwise it returns nil. The listener must be bound to a loopback address and every request must carry
+// the configured token.
+func startPprof(l *logrus.Logger, c *config.C, configTest bool) (func(), error) {
+	if !c.GetBool("pprof.enabled", false) {
+		return nil, nil
+	}
+
+	listen := c.GetString("pprof.listen", "127.0.0.1:6060")
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("pprof.listen was invalid: %s", err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return nil, fmt.Errorf("pprof.listen must be a loopback address, got: %s", listen)
+	}
+
+	token := c.GetString("pprof.token", "")
+	if token == "" {
+		return nil, errors.New("pprof.token can not be empty")
+	}
+
+	if configTest {
+		return nil, nil
+	}
+
+	mux := newPprofMux(token)
+	return func() {
+		l.Infof("pprof listening on %s", listen)
+		err := http.ListenAndServe(listen, mux)
+		if err != nil {
+			l.WithError(err).Error("pprof listener exited")
+		}
+	}, nil
+}
+
+// newPprofMux builds the handler for the pprof endpoints. We do not use net/http/pprof since it registers itself on
+// http.DefaultServeMux and would be served by anything else listening with it.
+func newPprofMux(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/profile", pprofCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", pprofTrace)
+	mux.HandleFunc("/debug/pprof/", pprofLookup)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// pprofLookup writes a named runtime profile, ie: /debug/pprof/heap or /debug/pprof/goroutine?debug=2
+func pprofLookup(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "profile")
+		fmt.Fprintln(w, "trace")
+		return
+	}
+
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "Unknown profile: "+name, http.StatusNotFound)
+		return
+	}
+
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	}
+
+	p.WriteTo(w, debug)
+}
+
+// pprofCPUProfile runs a cpu profile for the requested number of seconds, defaulting to 30
+func pprofCPUProfile(w http.ResponseWriter, r *http.Request) {
+	d, err := pprofDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, "Could not start cpu profile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pprofSleep(r, d)
+	pprof.StopCPUProfile()
+}
+
+// pprofTrace runs an execution trace for the requested number of seconds, defaulting to 1
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	d, err := pprofDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("seconds") == "" {
+		d = time.Second
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, "Could not start trace: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pprofSleep(r, d)
+	trace.Stop()
+}
+
+func pprofDuration(r *http.Request) (time.Duration, error) {
+	s := r.FormValue("seconds")
+	if s == "" {
+		return 30 * time.Second, nil
+	}
+
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec <= 0 {
+		return 0, fmt.Errorf("seconds was invalid: %s", s)
+	}
+
+	d := time.Duration(sec) * time.Second
+	if d > maxPprofDuration {
+		return 0, fmt.Errorf("seconds must be no more than %v", maxPprofDuration.Seconds())
+	}
+
+	return d, nil
+}
+
+func pprofSleep(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
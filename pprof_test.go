@@ -0,0 +1,66 @@
+package nebula
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_startPprof(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	f, err := startPprof(l, c, false)
+	assert.Nil(t, err)
+	assert.Nil(t, f)
+
+	c.Settings["pprof"] = map[interface{}]interface{}{"enabled": true, "listen": "0.0.0.0:6060", "token": "t"}
+	_, err = startPprof(l, c, false)
+	assert.EqualError(t, err, "pprof.listen must be a loopback address, got: 0.0.0.0:6060")
+
+	c.Settings["pprof"] = map[interface{}]interface{}{"enabled": true}
+	_, err = startPprof(l, c, false)
+	assert.EqualError(t, err, "pprof.token can not be empty")
+
+	c.Settings["pprof"] = map[interface{}]interface{}{"enabled": true, "token": "t"}
+	f, err = startPprof(l, c, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, f)
+}
+
+func Test_newPprofMux(t *testing.T) {
+	h := newPprofMux("secret")
+
+	r := httptest.NewRequest("GET", "/debug/pprof/goroutine", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r.Header.Set("Authorization", "Bearer nope")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Body.Bytes())
+
+	r = httptest.NewRequest("GET", "/debug/pprof/nope", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	r = httptest.NewRequest("GET", "/debug/pprof/trace?seconds=0", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultPreviousKeyGrace   = 2 * time.Second
+	defaultPreviousKeyPackets = 256
+)
+
+// previousKey is a tunnel that was removed while a newer tunnel to the same vpn ip remained, its receive key is kept
+// so packets that were in flight when the new handshake completed can still be delivered.
+type previousKey struct {
+	hostinfo *HostInfo
+	expires  time.Time
+	// remaining is the number of packets that may still try the key
+	remaining atomic.Int64
+}
+
+// reloadPreviousKeys reads handshakes.previous_key_grace and handshakes.previous_key_packets
+func (hm *HostMap) reloadPreviousKeys(c *config.C, initial bool) {
+	if initial || c.HasChanged("handshakes.previous_key_grace") {
+		grace := c.GetDuration("handshakes.previous_key_grace", defaultPreviousKeyGrace)
+		if grace < 0 {
+			grace = 0
+		}
+		hm.previousKeyGrace.Store(int64(grace))
+		if !initial {
+			hm.l.WithField("grace", grace).Info("handshakes.previous_key_grace has changed")
+		}
+	}
+
+	if initial || c.HasChanged("handshakes.previous_key_packets") {
+		packets := c.GetInt("handshakes.previous_key_packets", defaultPreviousKeyPackets)
+		if packets < 0 {
+			packets = 0
+		}
+		hm.previousKeyPackets.Store(int64(packets))
+		if !initial {
+			hm.l.WithField("packets", packets).Info("handshakes.previous_key_packets has changed")
+		}
+	}
+}
+
+// unlockedKeepPreviousKey remembers the receive key of a hostinfo that is being deleted if another tunnel to the same
+// vpn ip remains. Expired keys are dropped at the same time, it is the only place they are.
+func (hm *HostMap) unlockedKeepPreviousKey(hostinfo *HostInfo) {
+	now := time.Now()
+	for index, pk := range hm.previousKeys {
+		if now.After(pk.expires) {
+			delete(hm.previousKeys, index)
+		}
+	}
+
+	grace := time.Duration(hm.previousKeyGrace.Load())
+	packets := hm.previousKeyPackets.Load()
+	if grace == 0 || packets == 0 {
+		return
+	}
+
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.dKey == nil {
+		return
+	}
+
+	if _, ok := hm.Hosts[hostinfo.vpnIp]; !ok {
+		// This was the last tunnel, nothing would be sending to it anymore
+		return
+	}
+
+	pk := &previousKey{hostinfo: hostinfo, expires: now.Add(grace)}
+	pk.remaining.Store(packets)
+	hm.previousKeys[hostinfo.localIndexId] = pk
+}
+
+// QueryPreviousKey returns the hostinfo of a recently replaced tunnel if its receive key can still be used for a
+// packet addressed to index. Each call uses up one of the packets the key is allowed to receive.
+func (hm *HostMap) QueryPreviousKey(index uint32) *HostInfo {
+	hm.RLock()
+	pk, ok := hm.previousKeys[index]
+	hm.RUnlock()
+
+	if !ok || time.Now().After(pk.expires) || pk.remaining.Add(-1) < 0 {
+		return nil
+	}
+
+	return pk.hostinfo
+}
@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// privilegeDrop switches nebula to an unprivileged user once the tun device is up and its routes are installed. The
+// capabilities needed to change routes and rebind sockets on a reload are kept, everything else root could do is gone.
+type privilegeDrop struct {
+	user string
+	uid  int
+	gid  int
+	ops  privilegeOps
+}
+
+// privilegeOps are the steps of a privilege drop, in the order they must happen. Capabilities must survive the uid
+// change and the groups and gid must change while we are still allowed to.
+type privilegeOps struct {
+	keepCaps   func() error
+	setgroups  func(gids []int) error
+	setgid     func(gid int) error
+	setuid     func(uid int) error
+	retainCaps func() error
+}
+
+// newPrivilegeDropFromConfig reads drop_privileges, nil is returned when no user is configured
+func newPrivilegeDropFromConfig(c *config.C) (*privilegeDrop, error) {
+	userName := c.GetString("drop_privileges.user", "")
+	groupName := c.GetString("drop_privileges.group", "")
+	if userName == "" {
+		if groupName != "" {
+			return nil, errors.New("drop_privileges.user must be set when drop_privileges.group is set")
+		}
+		return nil, nil
+	}
+
+	if !privilegeDropSupported {
+		return nil, errors.New("drop_privileges is only supported on linux")
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return nil, fmt.Errorf("drop_privileges.user %s could not be found: %s", userName, err)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("drop_privileges.user %s has an invalid uid: %s", userName, u.Uid)
+	}
+
+	if uid == 0 {
+		return nil, fmt.Errorf("drop_privileges.user %s is root", userName)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("drop_privileges.group %s could not be found: %s", groupName, err)
+		}
+		gidStr = g.Gid
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return nil, fmt.Errorf("drop_privileges.group has an invalid gid: %s", gidStr)
+	}
+
+	return &privilegeDrop{user: userName, uid: uid, gid: gid, ops: defaultPrivilegeOps}, nil
+}
+
+// drop switches every thread to the configured user and group, keeping only retainedCapabilities
+func (p *privilegeDrop) drop() error {
+	if err := p.ops.keepCaps(); err != nil {
+		return fmt.Errorf("failed to keep capabilities: %s", err)
+	}
+
+	if err := p.ops.setgroups([]int{p.gid}); err != nil {
+		return fmt.Errorf("failed to set groups: %s", err)
+	}
+
+	if err := p.ops.setgid(p.gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %s", p.gid, err)
+	}
+
+	if err := p.ops.setuid(p.uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %s", p.uid, err)
+	}
+
+	if err := p.ops.retainCaps(); err != nil {
+		return fmt.Errorf("failed to retain capabilities: %s", err)
+	}
+
+	return nil
+}
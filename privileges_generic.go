@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package nebula
+
+const privilegeDropSupported = false
+
+var defaultPrivilegeOps = privilegeOps{}
@@ -0,0 +1,46 @@
+package nebula
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const privilegeDropSupported = true
+
+// retainedCapabilities are kept after dropping privileges. CAP_NET_ADMIN lets a reload change routes and the tun mtu,
+// CAP_NET_BIND_SERVICE lets it bind the listener, ssh and dns to ports below 1024.
+var retainedCapabilities = []uint{unix.CAP_NET_ADMIN, unix.CAP_NET_BIND_SERVICE}
+
+// Capabilities belong to each thread, so each of these runs on every thread of the process. That is not possible in
+// builds with cgo and AllThreadsSyscall returns ENOTSUP.
+var defaultPrivilegeOps = privilegeOps{
+	keepCaps: func() error {
+		_, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0)
+		if errno == syscall.ENOTSUP {
+			return errors.New("not supported by builds with cgo")
+		} else if errno != 0 {
+			return errno
+		}
+		return nil
+	},
+	setgroups: syscall.Setgroups,
+	setgid:    syscall.Setgid,
+	setuid:    syscall.Setuid,
+	retainCaps: func() error {
+		hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		for _, c := range retainedCapabilities {
+			data[c/32].Effective |= 1 << (c % 32)
+			data[c/32].Permitted |= 1 << (c % 32)
+		}
+
+		_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	},
+}
@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPrivilegeDropFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := newPrivilegeDropFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	c.Settings["drop_privileges"] = map[interface{}]interface{}{"group": "nogroup"}
+	_, err = newPrivilegeDropFromConfig(c)
+	assert.EqualError(t, err, "drop_privileges.user must be set when drop_privileges.group is set")
+
+	if !privilegeDropSupported {
+		c.Settings["drop_privileges"] = map[interface{}]interface{}{"user": "nobody"}
+		_, err = newPrivilegeDropFromConfig(c)
+		assert.EqualError(t, err, "drop_privileges is only supported on linux")
+		return
+	}
+
+	c.Settings["drop_privileges"] = map[interface{}]interface{}{"user": "root"}
+	_, err = newPrivilegeDropFromConfig(c)
+	assert.EqualError(t, err, "drop_privileges.user root is root")
+
+	c.Settings["drop_privileges"] = map[interface{}]interface{}{"user": "nebula-test-no-such-user"}
+	_, err = newPrivilegeDropFromConfig(c)
+	assert.ErrorContains(t, err, "drop_privileges.user nebula-test-no-such-user could not be found")
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user to test with")
+	}
+
+	// The group defaults to the primary group of the user
+	c.Settings["drop_privileges"] = map[interface{}]interface{}{"user": "nobody"}
+	p, err = newPrivilegeDropFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "nobody", p.user)
+	assert.Equal(t, nobody.Uid, fmt.Sprint(p.uid))
+	assert.Equal(t, nobody.Gid, fmt.Sprint(p.gid))
+
+	root, err := user.LookupGroup("root")
+	if err == nil {
+		c.Settings["drop_privileges"] = map[interface{}]interface{}{"user": "nobody", "group": "root"}
+		p, err = newPrivilegeDropFromConfig(c)
+		assert.NoError(t, err)
+		assert.Equal(t, root.Gid, fmt.Sprint(p.gid))
+	}
+}
+
+func TestPrivilegeDrop_drop(t *testing.T) {
+	var calls []string
+	ops := privilegeOps{
+		keepCaps: func() error {
+			calls = append(calls, "keepCaps")
+			return nil
+		},
+		setgroups: func(gids []int) error {
+			calls = append(calls, fmt.Sprintf("setgroups %v", gids))
+			return nil
+		},
+		setgid: func(gid int) error {
+			calls = append(calls, fmt.Sprintf("setgid %d", gid))
+			return nil
+		},
+		setuid: func(uid int) error {
+			calls = append(calls, fmt.Sprintf("setuid %d", uid))
+			return nil
+		},
+		retainCaps: func() error {
+			calls = append(calls, "retainCaps")
+			return nil
+		},
+	}
+
+	// Capabilities are kept across the uid change and the group changes while we are still root
+	p := &privilegeDrop{user: "nebula", uid: 1000, gid: 2000, ops: ops}
+	assert.NoError(t, p.drop())
+	assert.Equal(t, []string{"keepCaps", "setgroups [2000]", "setgid 2000", "setuid 1000", "retainCaps"}, calls)
+
+	// A failed step stops the drop, we never run as the new user with the old groups
+	calls = nil
+	p.ops.setgid = func(int) error {
+		calls = append(calls, "setgid")
+		return errors.New("operation not permitted")
+	}
+	assert.EqualError(t, p.drop(), "failed to set gid 2000: operation not permitted")
+	assert.Equal(t, []string{"keepCaps", "setgroups [2000]", "setgid"}, calls)
+}
@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"math"
 	"sync/atomic"
 	"time"
 
@@ -14,6 +15,7 @@ type Punchy struct {
 	delay           atomic.Int64
 	respondDelay    atomic.Int64
 	punchEverything atomic.Bool
+	jitter          atomic.Uint64
 	l               *logrus.Logger
 }
 
@@ -87,6 +89,18 @@ func (p *Punchy) reload(c *config.C, initial bool) {
 			p.l.Infof("punchy.respond_delay changed to %s", p.GetRespondDelay())
 		}
 	}
+
+	if initial || c.HasChanged("punchy.jitter") {
+		j, err := getJitter(c, "punchy.jitter")
+		if err != nil {
+			p.l.WithError(err).Error("Invalid punchy.jitter, ignoring")
+		} else {
+			p.jitter.Store(math.Float64bits(j))
+			if !initial {
+				p.l.Infof("punchy.jitter changed to %v", p.GetJitter())
+			}
+		}
+	}
 }
 
 func (p *Punchy) GetPunch() bool {
@@ -108,3 +122,7 @@ func (p *Punchy) GetRespondDelay() time.Duration {
 func (p *Punchy) GetTargetEverything() bool {
 	return p.punchEverything.Load()
 }
+
+func (p *Punchy) GetJitter() float64 {
+	return math.Float64frombits(p.jitter.Load())
+}
@@ -50,6 +50,17 @@ func TestNewPunchyFromConfig(t *testing.T) {
 	c.Settings["punchy"] = map[interface{}]interface{}{"respond_delay": "1m"}
 	p = NewPunchyFromConfig(l, c)
 	assert.Equal(t, time.Minute, p.GetRespondDelay())
+
+	// punchy.jitter
+	assert.Equal(t, float64(0), p.GetJitter())
+	c.Settings["punchy"] = map[interface{}]interface{}{"jitter": 0.2}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, 0.2, p.GetJitter())
+
+	// punchy.jitter out of range is ignored
+	c.Settings["punchy"] = map[interface{}]interface{}{"jitter": 0.9}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, float64(0), p.GetJitter())
 }
 
 func TestPunchy_reload(t *testing.T) {
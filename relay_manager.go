@@ -4,42 +4,216 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
 )
 
 type relayManager struct {
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+
+	// peerRelays maps a peer to the only relays, in order of preference, we may use to reach it
+	peerRelays atomic.Pointer[map[iputil.VpnIp][]iputil.VpnIp]
+
+	// metricForwardLatency is the time in nanoseconds a relayed packet spends in this node, from the read off the
+	// socket until it is sent on to the target. Only one in forwardSampleInterval packets is recorded.
+	metricForwardLatency metrics.Histogram
+
+	// maxHops is relay.max_hops, the most relays a packet we send or forward may pass through
+	maxHops atomic.Uint32
+	// metricLoopDropped counts relayed packets dropped because they ran out of hops
+	metricLoopDropped metrics.Counter
 }
 
-func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
+const (
+	defaultRelayMaxHops = 4
+	// relayHopsSet marks the reserved header field of a relay packet as holding the hops the packet has left. Older
+	// nodes leave the field 0, their packets are given relay.max_hops.
+	relayHopsSet uint16 = 0x8000
+	relayHopsMax        = 255
+
+	// forwardSampleInterval is how many forwarded packets share one relay.forward_latency sample
+	forwardSampleInterval = 64
+)
+
+func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) (*relayManager, error) {
+	registry := util.MetricsRegistry(c)
 	rm := &relayManager{
-		l:       l,
-		hostmap: hostmap,
+		l:                    l,
+		hostmap:              hostmap,
+		metricForwardLatency: metrics.GetOrRegisterHistogram("relay.forward_latency", registry, metrics.NewExpDecaySample(1028, 0.015)),
+		metricLoopDropped:    metrics.GetOrRegisterCounter("relay_loop_dropped", registry),
+	}
+	err := rm.reload(c, true)
+	if err != nil {
+		return nil, err
 	}
-	rm.reload(c, true)
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
 			l.WithError(err).Error("Failed to reload relay_manager")
 		}
 	})
-	return rm
+	return rm, nil
 }
 
 func (rm *relayManager) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
+
+	if initial || c.HasChanged("relay.max_hops") {
+		maxHops := c.GetInt("relay.max_hops", defaultRelayMaxHops)
+		if maxHops < 1 || maxHops > relayHopsMax {
+			return fmt.Errorf("relay.max_hops must be between 1 and %d: %v", relayHopsMax, maxHops)
+		}
+		rm.maxHops.Store(uint32(maxHops))
+	}
+
+	if initial || c.HasChanged("relay.peer_relays") {
+		peerRelays, err := parsePeerRelays(c)
+		if err != nil {
+			return err
+		}
+		rm.peerRelays.Store(&peerRelays)
+	}
+
+	return nil
+}
+
+func parsePeerRelays(c *config.C) (map[iputil.VpnIp][]iputil.VpnIp, error) {
+	peerRelays := map[iputil.VpnIp][]iputil.VpnIp{}
+	for k, v := range c.GetMap("relay.peer_relays", map[interface{}]interface{}{}) {
+		peer := net.ParseIP(fmt.Sprintf("%v", k)).To4()
+		if peer == nil {
+			return nil, fmt.Errorf("relay.peer_relays key %v is not a valid vpn ip", k)
+		}
+
+		rawRelays, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("relay.peer_relays entry %v must be a list of relay vpn ips", k)
+		}
+
+		relays := make([]iputil.VpnIp, 0, len(rawRelays))
+		for _, r := range rawRelays {
+			relay := net.ParseIP(fmt.Sprintf("%v", r)).To4()
+			if relay == nil {
+				return nil, fmt.Errorf("relay.peer_relays entry %v has an invalid relay vpn ip: %v", k, r)
+			}
+			relays = append(relays, iputil.Ip2VpnIp(relay))
+		}
+
+		peerRelays[iputil.Ip2VpnIp(peer)] = relays
+	}
+
+	return peerRelays, nil
+}
+
+func (rm *relayManager) getPeerRelays() map[iputil.VpnIp][]iputil.VpnIp {
+	if p := rm.peerRelays.Load(); p != nil {
+		return *p
+	}
 	return nil
 }
 
+// relaysFor returns the relays to try for vpnIp in order of preference. If relay.peer_relays has an entry for vpnIp
+// only those relays are returned and constrained is true, otherwise the learned relays are returned as is.
+func (rm *relayManager) relaysFor(vpnIp iputil.VpnIp, learned []*iputil.VpnIp) (relays []*iputil.VpnIp, constrained bool) {
+	if rm == nil {
+		return learned, false
+	}
+
+	preferred, ok := rm.getPeerRelays()[vpnIp]
+	if !ok {
+		return learned, false
+	}
+
+	relays = make([]*iputil.VpnIp, len(preferred))
+	for i := range preferred {
+		relays[i] = &preferred[i]
+	}
+	return relays, true
+}
+
+// peerRelayAllowed returns false if relay.peer_relays constrains vpnIp to relays that do not include relay
+func (rm *relayManager) peerRelayAllowed(vpnIp, relay iputil.VpnIp) bool {
+	if rm == nil {
+		return true
+	}
+
+	preferred, ok := rm.getPeerRelays()[vpnIp]
+	if !ok {
+		return true
+	}
+
+	for _, r := range preferred {
+		if r == relay {
+			return true
+		}
+	}
+	return false
+}
+
+// peerRelayMetric counts handshakes sent to a constrained peer through relay, or with no reachable relay if relay is 0
+func peerRelayMetric(registry metrics.Registry, vpnIp, relay iputil.VpnIp) metrics.Counter {
+	name := "none"
+	if relay != 0 {
+		name = strings.ReplaceAll(relay.String(), ".", "_")
+	}
+	return metrics.GetOrRegisterCounter(
+		fmt.Sprintf("relay.peer_relays.%s.%s", strings.ReplaceAll(vpnIp.String(), ".", "_"), name),
+		registry,
+	)
+}
+
+func (rm *relayManager) getMaxHops() uint16 {
+	if rm == nil || rm.maxHops.Load() == 0 {
+		return defaultRelayMaxHops
+	}
+	return uint16(rm.maxHops.Load())
+}
+
+// originHops returns the reserved header field for a relay packet we originate
+func (rm *relayManager) originHops() uint16 {
+	return relayHopsSet | rm.getMaxHops()
+}
+
+// hopsLeft returns how many more relays a relay packet with the reserved header field reserved may pass through. A
+// packet that arrived through via, nested in another relay packet, has no more hops left than the outer packet.
+func (rm *relayManager) hopsLeft(reserved uint16, via *ViaSender) uint16 {
+	hops := rm.getMaxHops()
+	if reserved&relayHopsSet != 0 && reserved&^relayHopsSet < hops {
+		hops = reserved &^ relayHopsSet
+	}
+
+	if via != nil && via.relayHops < hops {
+		hops = via.relayHops
+	}
+	return hops
+}
+
+// forwardHops returns the reserved header field to forward a relay packet with, or false if it has no hops left and
+// must be dropped. A packet runs out of hops when it loops through relays.
+func (rm *relayManager) forwardHops(reserved uint16, via *ViaSender) (uint16, bool) {
+	hops := rm.hopsLeft(reserved, via)
+	if hops == 0 {
+		rm.metricLoopDropped.Inc(1)
+		return 0, false
+	}
+	return relayHopsSet | (hops - 1), true
+}
+
 func (rm *relayManager) GetAmRelay() bool {
 	return rm.amRelay.Load()
 }
@@ -48,6 +222,21 @@ func (rm *relayManager) setAmRelay(v bool) {
 	rm.amRelay.Store(v)
 }
 
+// sampleForward reports whether the forwarding time of the relay packet with counter should be recorded. Every
+// forwardSampleInterval packet of a tunnel is sampled, the message counter is used so no state is shared between the
+// readers.
+func (rm *relayManager) sampleForward(counter uint64) bool {
+	return counter%forwardSampleInterval == 0 && rm.GetAmRelay()
+}
+
+// observeForward records how long a packet received at received took to be forwarded
+func (rm *relayManager) observeForward(received time.Time) {
+	if received.IsZero() {
+		return
+	}
+	rm.metricForwardLatency.Update(time.Since(received).Nanoseconds())
+}
+
 // AddRelay finds an available relay index on the hostmap, and associates the relay info with it.
 // relayHostInfo is the Nebula peer which can be used as a relay to access the target vpnIp.
 func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp iputil.VpnIp, remoteIdx *uint32, relayType int, state int) (uint32, error) {
@@ -181,12 +370,12 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 	logMsg.Info("handleCreateRelayRequest")
 	// Is the source of the relay me? This should never happen, but did happen due to
 	// an issue migrating relays over to newly re-handshaked host info objects.
-	if from == f.myVpnIp {
-		logMsg.WithField("myIP", f.myVpnIp).Error("Discarding relay request from myself")
+	if from == f.myVpnIp.Load() {
+		logMsg.WithField("myIP", f.myVpnIp.Load()).Error("Discarding relay request from myself")
 		return
 	}
 	// Is the target of the relay me?
-	if target == f.myVpnIp {
+	if target == f.myVpnIp.Load() {
 		existingRelay, ok := h.relayState.QueryRelayForByIp(from)
 		if ok {
 			switch existingRelay.State {
@@ -246,6 +435,11 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		if !rm.GetAmRelay() {
 			return
 		}
+		if f.maintenance.active() {
+			rm.l.WithField("relayTo", target).WithField("vpnIp", h.vpnIp).
+				Info("Refusing to relay while down for maintenance")
+			return
+		}
 		peer := rm.hostmap.QueryVpnIp(target)
 		if peer == nil {
 			// Try to establish a connection to this host. If we get a future relay request,
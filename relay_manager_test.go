@@ -0,0 +1,162 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerRelays(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	pr, err := parsePeerRelays(c)
+	assert.NoError(t, err)
+	assert.Empty(t, pr)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"peer_relays": map[interface{}]interface{}{
+		"10.0.0.2": []interface{}{"10.0.0.128", "10.0.0.129"},
+		"10.0.0.3": []interface{}{},
+	}}
+	pr, err = parsePeerRelays(c)
+	assert.NoError(t, err)
+	assert.Equal(t, map[iputil.VpnIp][]iputil.VpnIp{
+		iputil.Ip2VpnIp(net.ParseIP("10.0.0.2")): {iputil.Ip2VpnIp(net.ParseIP("10.0.0.128")), iputil.Ip2VpnIp(net.ParseIP("10.0.0.129"))},
+		iputil.Ip2VpnIp(net.ParseIP("10.0.0.3")): {},
+	}, pr)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"peer_relays": map[interface{}]interface{}{"nope": []interface{}{}}}
+	_, err = parsePeerRelays(c)
+	assert.EqualError(t, err, "relay.peer_relays key nope is not a valid vpn ip")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"peer_relays": map[interface{}]interface{}{"10.0.0.2": "10.0.0.128"}}
+	_, err = parsePeerRelays(c)
+	assert.EqualError(t, err, "relay.peer_relays entry 10.0.0.2 must be a list of relay vpn ips")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"peer_relays": map[interface{}]interface{}{"10.0.0.2": []interface{}{"nope"}}}
+	_, err = parsePeerRelays(c)
+	assert.EqualError(t, err, "relay.peer_relays entry 10.0.0.2 has an invalid relay vpn ip: nope")
+}
+
+func TestRelayManager_relaysFor(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"peer_relays": map[interface{}]interface{}{
+		"10.0.0.2": []interface{}{"10.0.0.129", "10.0.0.128"},
+		"10.0.0.3": []interface{}{},
+	}}
+	rm, err := NewRelayManager(context.Background(), l, nil, c)
+	assert.NoError(t, err)
+
+	ip := func(s string) iputil.VpnIp { return iputil.Ip2VpnIp(net.ParseIP(s)) }
+	learnedRelay := ip("10.0.0.130")
+	learned := []*iputil.VpnIp{&learnedRelay}
+
+	// Learned relays are replaced by the configured ones, in order
+	relays, constrained := rm.relaysFor(ip("10.0.0.2"), learned)
+	assert.True(t, constrained)
+	assert.Len(t, relays, 2)
+	assert.Equal(t, ip("10.0.0.129"), *relays[0])
+	assert.Equal(t, ip("10.0.0.128"), *relays[1])
+
+	// An empty list means never relay
+	relays, constrained = rm.relaysFor(ip("10.0.0.3"), learned)
+	assert.True(t, constrained)
+	assert.Empty(t, relays)
+
+	// Everyone else uses what was learned
+	relays, constrained = rm.relaysFor(ip("10.0.0.4"), learned)
+	assert.False(t, constrained)
+	assert.Equal(t, learned, relays)
+
+	// Incoming handshakes through an unapproved relay are refused
+	assert.True(t, rm.peerRelayAllowed(ip("10.0.0.2"), ip("10.0.0.128")))
+	assert.False(t, rm.peerRelayAllowed(ip("10.0.0.2"), learnedRelay))
+	assert.False(t, rm.peerRelayAllowed(ip("10.0.0.3"), learnedRelay))
+	assert.True(t, rm.peerRelayAllowed(ip("10.0.0.4"), learnedRelay))
+}
+
+func TestRelayManager_observeForward(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	rm, err := NewRelayManager(context.Background(), l, nil, c)
+	assert.NoError(t, err)
+	before := rm.metricForwardLatency.Count()
+
+	// Packets that were not timed, because we were not a relay when they arrived, are not counted
+	rm.observeForward(time.Time{})
+	assert.Equal(t, before, rm.metricForwardLatency.Count())
+
+	rm.observeForward(time.Now().Add(-time.Millisecond))
+	assert.Equal(t, before+1, rm.metricForwardLatency.Count())
+	assert.GreaterOrEqual(t, rm.metricForwardLatency.Max(), time.Millisecond.Nanoseconds())
+}
+
+func TestRelayManager_forwardHops(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"max_hops": 3}
+	rm, err := NewRelayManager(context.Background(), l, nil, c)
+	assert.NoError(t, err)
+	before := rm.metricLoopDropped.Count()
+
+	// A packet that loops back through the same relays is forwarded until it runs out of hops
+	hops := rm.originHops()
+	forwarded := 0
+	for {
+		next, ok := rm.forwardHops(hops, nil)
+		if !ok {
+			break
+		}
+		hops = next
+		forwarded++
+		assert.Less(t, forwarded, 10, "the loop was never broken")
+	}
+	assert.Equal(t, 3, forwarded)
+	assert.Equal(t, before+1, rm.metricLoopDropped.Count())
+
+	// Packets from nodes that do not count hops get relay.max_hops
+	hops, ok := rm.forwardHops(0, nil)
+	assert.True(t, ok)
+	assert.Equal(t, relayHopsSet|2, hops)
+
+	// A packet can not claim more hops than we allow
+	hops, ok = rm.forwardHops(relayHopsSet|200, nil)
+	assert.True(t, ok)
+	assert.Equal(t, relayHopsSet|2, hops)
+
+	// A packet nested in another relay packet has no more hops than the outer one
+	_, ok = rm.forwardHops(rm.originHops(), &ViaSender{relayHops: 0})
+	assert.False(t, ok)
+	assert.Equal(t, before+2, rm.metricLoopDropped.Count())
+
+	c.Settings["relay"] = map[interface{}]interface{}{"max_hops": 0}
+	_, err = NewRelayManager(context.Background(), l, nil, c)
+	assert.EqualError(t, err, "relay.max_hops must be between 1 and 255: 0")
+}
+
+func TestRelayManager_sampleForward(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	rm, err := NewRelayManager(context.Background(), l, nil, c)
+	assert.NoError(t, err)
+
+	// Nothing is sampled when we are not a relay
+	assert.False(t, rm.sampleForward(forwardSampleInterval))
+
+	rm.setAmRelay(true)
+	sampled := 0
+	for i := uint64(1); i <= forwardSampleInterval*4; i++ {
+		if rm.sampleForward(i) {
+			sampled++
+		}
+	}
+	assert.True(t, rm.sampleForward(forwardSampleInterval))
+	assert.Equal(t, 4, sampled)
+}
@@ -0,0 +1,99 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// remoteCIDRFilter drops packets from underlay addresses outside of listen.allow_remote_cidrs or inside of
+// listen.block_remote_cidrs before any other work is done on them
+type remoteCIDRFilter struct {
+	// allow is nil when every address is allowed
+	allow *cidr.Tree6[struct{}]
+	block *cidr.Tree6[struct{}]
+
+	metricDropped metrics.Counter
+}
+
+// newRemoteCIDRFilterFromConfig returns nil if neither listen.allow_remote_cidrs or listen.block_remote_cidrs are set
+func newRemoteCIDRFilterFromConfig(c *config.C) (*remoteCIDRFilter, error) {
+	allow, err := getRemoteCIDRs(c, "listen.allow_remote_cidrs")
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := getRemoteCIDRs(c, "listen.block_remote_cidrs")
+	if err != nil {
+		return nil, err
+	}
+
+	if allow == nil && block == nil {
+		return nil, nil
+	}
+
+	return newRemoteCIDRFilter(util.MetricsRegistry(c), allow, block), nil
+}
+
+func newRemoteCIDRFilter(registry metrics.Registry, allow, block []*net.IPNet) *remoteCIDRFilter {
+	f := &remoteCIDRFilter{
+		block:         cidr.NewTree6[struct{}](),
+		metricDropped: metrics.GetOrRegisterCounter("listen.remote_cidrs.dropped", registry),
+	}
+
+	if len(allow) > 0 {
+		f.allow = cidr.NewTree6[struct{}]()
+		for _, n := range allow {
+			f.allow.AddCIDR(n, struct{}{})
+		}
+	}
+
+	for _, n := range block {
+		f.block.AddCIDR(n, struct{}{})
+	}
+
+	return f
+}
+
+func getRemoteCIDRs(c *config.C, k string) ([]*net.IPNet, error) {
+	raw := c.GetStringSlice(k, []string{})
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	cidrs := make([]*net.IPNet, len(raw))
+	for i, rawCIDR := range raw {
+		_, ipNet, err := net.ParseCIDR(rawCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("config `%s` has invalid CIDR: %s", k, rawCIDR)
+		}
+		cidrs[i] = ipNet
+	}
+
+	return cidrs, nil
+}
+
+// allowed returns true if packets from ip should be processed, a dropped packet is counted
+func (f *remoteCIDRFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.allow != nil {
+		if ok, _ := f.allow.MostSpecificContains(ip); !ok {
+			f.metricDropped.Inc(1)
+			return false
+		}
+	}
+
+	if ok, _ := f.block.MostSpecificContains(ip); ok {
+		f.metricDropped.Inc(1)
+		return false
+	}
+
+	return true
+}
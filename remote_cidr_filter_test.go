@@ -0,0 +1,76 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRemoteCIDRFilterFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rf, err := newRemoteCIDRFilterFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, rf)
+	assert.True(t, rf.allowed(net.ParseIP("1.1.1.1")))
+
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"allow_remote_cidrs": []interface{}{"10.0.0.0/8", "nope"},
+	}
+	_, err = newRemoteCIDRFilterFromConfig(c)
+	assert.EqualError(t, err, "config `listen.allow_remote_cidrs` has invalid CIDR: nope")
+
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"block_remote_cidrs": []interface{}{"10.0.0.0/33"},
+	}
+	_, err = newRemoteCIDRFilterFromConfig(c)
+	assert.EqualError(t, err, "config `listen.block_remote_cidrs` has invalid CIDR: 10.0.0.0/33")
+
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"allow_remote_cidrs": []interface{}{"10.0.0.0/8"},
+	}
+	rf, err = newRemoteCIDRFilterFromConfig(c)
+	assert.NoError(t, err)
+	assert.NotNil(t, rf)
+}
+
+func TestRemoteCIDRFilter_allowed(t *testing.T) {
+	rf := newRemoteCIDRFilter(nil,
+		[]*net.IPNet{
+			{IP: net.IP{10, 0, 0, 0}, Mask: net.IPMask{255, 0, 0, 0}},
+			{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 128)},
+		},
+		[]*net.IPNet{
+			{IP: net.IP{10, 1, 0, 0}, Mask: net.IPMask{255, 255, 0, 0}},
+			{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(128, 128)},
+		},
+	)
+
+	dropped := rf.metricDropped.Count()
+
+	// Allowed sources
+	assert.True(t, rf.allowed(net.ParseIP("10.0.0.1")))
+	assert.True(t, rf.allowed(net.ParseIP("10.255.255.255")))
+	assert.True(t, rf.allowed(net.ParseIP("::ffff:10.2.0.1")))
+	assert.True(t, rf.allowed(net.ParseIP("fd00::2")))
+	assert.Equal(t, dropped, rf.metricDropped.Count())
+
+	// Outside of the allow list
+	assert.False(t, rf.allowed(net.ParseIP("192.168.0.1")))
+	assert.False(t, rf.allowed(net.ParseIP("2001:db8::1")))
+
+	// Blocked within the allow list
+	assert.False(t, rf.allowed(net.ParseIP("10.1.0.1")))
+	assert.False(t, rf.allowed(net.ParseIP("fd00::1")))
+	assert.Equal(t, dropped+4, rf.metricDropped.Count())
+
+	// Only a block list allows everything else
+	rf = newRemoteCIDRFilter(nil, nil, []*net.IPNet{{IP: net.IP{10, 1, 0, 0}, Mask: net.IPMask{255, 255, 0, 0}}})
+	assert.True(t, rf.allowed(net.ParseIP("192.168.0.1")))
+	assert.True(t, rf.allowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, rf.allowed(net.ParseIP("10.1.2.3")))
+}
@@ -43,6 +43,10 @@ type cache struct {
 	v4    *cacheV4
 	v6    *cacheV6
 	relay *cacheRelay
+
+	// scoped holds the addresses the owner only wants handed to peers in certain groups, see
+	// lighthouse.advertise_scopes. They are only kept by lighthouses and are never used to reach the owner.
+	scoped []*ScopedAddrs
 }
 
 type cacheRelay struct {
@@ -194,6 +198,9 @@ type RemoteList struct {
 
 	// A deduplicated set of addresses. Any accessor should lock beforehand.
 	addrs []*udp.Addr
+	// priorities holds the priority the owner gave each address in addrs, see lighthouse.advertise_order. It is only
+	// kept in step with addrs while they are rebuilt.
+	priorities []uint32
 
 	// A set of relay addresses. VpnIp addresses that the remote identified as relays.
 	relays []*iputil.VpnIp
@@ -416,15 +423,53 @@ func (r *RemoteList) unlockedSetV4(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp,
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV4(ownerVpnIp)
 
-	// Reset the slice
-	c.reported = c.reported[:0]
-
 	// We can't take their array but we can take their pointers
+	reported := make([]*Ip4AndPort, 0, minInt(len(to), MaxRemotes))
 	for _, v := range to[:minInt(len(to), MaxRemotes)] {
 		if check(vpnIp, v) {
-			c.reported = append(c.reported, v)
+			reported = append(reported, v)
 		}
 	}
+
+	c.reported = stableReported(c.reported, reported)
+}
+
+// unlockedSetScoped assumes you have the write lock and resets the scoped addresses for this owner to the ones provided.
+// Scoped addresses are only handed out by a lighthouse so the deduplicated address list is left alone.
+func (r *RemoteList) unlockedSetScoped(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp, to []*ScopedAddrs, check4 checkFuncV4, check6 checkFuncV6) {
+	var scoped []*ScopedAddrs
+	for _, s := range to[:minInt(len(to), MaxRemotes)] {
+		if len(s.Groups) == 0 {
+			continue
+		}
+
+		c := &ScopedAddrs{Groups: s.Groups}
+		for _, v := range s.Ip4AndPorts[:minInt(len(s.Ip4AndPorts), MaxRemotes)] {
+			if check4(vpnIp, v) {
+				c.Ip4AndPorts = append(c.Ip4AndPorts, v)
+			}
+		}
+
+		for _, v := range s.Ip6AndPorts[:minInt(len(s.Ip6AndPorts), MaxRemotes)] {
+			if check6(vpnIp, v) {
+				c.Ip6AndPorts = append(c.Ip6AndPorts, v)
+			}
+		}
+
+		if len(c.Ip4AndPorts) > 0 || len(c.Ip6AndPorts) > 0 {
+			scoped = append(scoped, c)
+		}
+	}
+
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		if scoped == nil {
+			return
+		}
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	am.scoped = scoped
 }
 
 func (r *RemoteList) unlockedSetRelay(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp, to []uint32) {
@@ -464,15 +509,15 @@ func (r *RemoteList) unlockedSetV6(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp,
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV6(ownerVpnIp)
 
-	// Reset the slice
-	c.reported = c.reported[:0]
-
 	// We can't take their array but we can take their pointers
+	reported := make([]*Ip6AndPort, 0, minInt(len(to), MaxRemotes))
 	for _, v := range to[:minInt(len(to), MaxRemotes)] {
 		if check(vpnIp, v) {
-			c.reported = append(c.reported, v)
+			reported = append(reported, v)
 		}
 	}
+
+	c.reported = stableReported(c.reported, reported)
 }
 
 // unlockedPrependV6 assumes you have the write lock and prepends the address in the reported list for this owner
@@ -535,38 +580,34 @@ func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp iputil.VpnIp) *cacheV6 {
 // The result of this function can contain duplicates. unlockedSort handles cleaning it.
 func (r *RemoteList) unlockedCollect() {
 	addrs := r.addrs[:0]
+	priorities := r.priorities[:0]
 	relays := r.relays[:0]
 
+	add := func(u *udp.Addr, priority uint32) {
+		if !r.unlockedIsBad(u) {
+			addrs = append(addrs, u)
+			priorities = append(priorities, priority)
+		}
+	}
+
 	for _, c := range r.cache {
 		if c.v4 != nil {
 			if c.v4.learned != nil {
-				u := NewUDPAddrFromLH4(c.v4.learned)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+				add(NewUDPAddrFromLH4(c.v4.learned), c.v4.learned.Priority)
 			}
 
 			for _, v := range c.v4.reported {
-				u := NewUDPAddrFromLH4(v)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+				add(NewUDPAddrFromLH4(v), v.Priority)
 			}
 		}
 
 		if c.v6 != nil {
 			if c.v6.learned != nil {
-				u := NewUDPAddrFromLH6(c.v6.learned)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+				add(NewUDPAddrFromLH6(c.v6.learned), c.v6.learned.Priority)
 			}
 
 			for _, v := range c.v6.reported {
-				u := NewUDPAddrFromLH6(v)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+				add(NewUDPAddrFromLH6(v), v.Priority)
 			}
 		}
 
@@ -586,10 +627,12 @@ func (r *RemoteList) unlockedCollect() {
 				IP:   v6[:],
 				Port: addr.Port(),
 			})
+			priorities = append(priorities, 0)
 		}
 	}
 
 	r.addrs = addrs
+	r.priorities = priorities
 	r.relays = relays
 
 }
@@ -601,6 +644,18 @@ func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
 		return
 	}
 
+	// An address reported more than once sorts with the highest priority it was given so the copies stay together
+	for i := range r.addrs {
+		for j := 0; j < i; j++ {
+			if r.addrs[i].Equals(r.addrs[j]) {
+				if r.priorities[i] > r.priorities[j] {
+					r.priorities[j] = r.priorities[i]
+				}
+				r.priorities[i] = r.priorities[j]
+			}
+		}
+	}
+
 	lessFunc := func(i, j int) bool {
 		a := r.addrs[i]
 		b := r.addrs[j]
@@ -621,7 +676,12 @@ func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
 			// Both i an j are either preferred or not, sort within that
 		}
 
-		// ipv6 addresses 2nd
+		// The order the owner asked for 2nd, a higher priority goes first
+		if r.priorities[i] != r.priorities[j] {
+			return r.priorities[i] > r.priorities[j]
+		}
+
+		// ipv6 addresses 3rd
 		a4 := a.IP.To4()
 		b4 := b.IP.To4()
 		switch {
@@ -654,10 +714,10 @@ func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
 			// Both i an j are either ipv4 or ipv6, sort within that
 		}
 
-		// lexical order of ips 3rd
+		// lexical order of ips 4th
 		c := bytes.Compare(a.IP, b.IP)
 		if c == 0 {
-			// Ips are the same, Lexical order of ports 4th
+			// Ips are the same, Lexical order of ports 5th
 			return a.Port < b.Port
 		}
 
@@ -665,8 +725,8 @@ func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
 		return c < 0
 	}
 
-	// Sort it
-	sort.Slice(r.addrs, lessFunc)
+	// Sort it, the priorities move with their addresses
+	sort.Sort(remoteSorter{r: r, less: lessFunc})
 
 	// Deduplicate
 	a, b := 0, 1
@@ -675,15 +735,54 @@ func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
 			a++
 			if a != b {
 				r.addrs[a], r.addrs[b] = r.addrs[b], r.addrs[a]
+				r.priorities[a], r.priorities[b] = r.priorities[b], r.priorities[a]
 			}
 		}
 		b++
 	}
 
 	r.addrs = r.addrs[:a+1]
+	r.priorities = r.priorities[:a+1]
 	return
 }
 
+// remoteSorter sorts the addresses of a RemoteList and their priorities together
+type remoteSorter struct {
+	r    *RemoteList
+	less func(i, j int) bool
+}
+
+func (s remoteSorter) Len() int           { return len(s.r.addrs) }
+func (s remoteSorter) Less(i, j int) bool { return s.less(i, j) }
+func (s remoteSorter) Swap(i, j int) {
+	s.r.addrs[i], s.r.addrs[j] = s.r.addrs[j], s.r.addrs[i]
+	s.r.priorities[i], s.r.priorities[j] = s.r.priorities[j], s.r.priorities[i]
+}
+
+// stableReported orders next so the addresses that were already in prev keep their relative order ahead of any new
+// ones. A host that reorders or adds to the addresses it reports does not reshuffle the addresses we hand out.
+func stableReported[T comparable](prev, next []*T) []*T {
+	out := make([]*T, 0, len(next))
+	used := make([]bool, len(next))
+	for _, p := range prev {
+		for i, n := range next {
+			if !used[i] && *p == *n {
+				out = append(out, n)
+				used[i] = true
+				break
+			}
+		}
+	}
+
+	for i, n := range next {
+		if !used[i] {
+			out = append(out, n)
+		}
+	}
+
+	return out
+}
+
 // minInt returns the minimum integer of a or b
 func minInt(a, b int) int {
 	if a < b {
@@ -5,9 +5,48 @@ import (
 	"testing"
 
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestRemoteList_RebuildPriority(t *testing.T) {
+	rl := NewRemoteList(nil)
+	rl.unlockedSetV4(
+		0,
+		0,
+		[]*Ip4AndPort{
+			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("70.199.182.92"))), Port: 1475},
+			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("172.17.0.182"))), Port: 10101, Priority: 1},
+			{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("192.168.1.1"))), Port: 10101, Priority: 2},
+		},
+		func(iputil.VpnIp, *Ip4AndPort) bool { return true },
+	)
+	rl.unlockedSetV6(
+		0,
+		0,
+		[]*Ip6AndPort{NewIp6AndPort(net.ParseIP("1::1"), 1)},
+		func(iputil.VpnIp, *Ip6AndPort) bool { return true },
+	)
+
+	// Another owner knows an address without its priority, the copies are still deduplicated
+	rl.unlockedSetV4(
+		1,
+		0,
+		[]*Ip4AndPort{{Ip: uint32(iputil.Ip2VpnIp(net.ParseIP("192.168.1.1"))), Port: 10101}},
+		func(iputil.VpnIp, *Ip4AndPort) bool { return true },
+	)
+
+	// A higher priority goes first, the usual order applies to the rest
+	rl.Rebuild([]*net.IPNet{})
+	assert.Equal(t, []string{"192.168.1.1:10101", "172.17.0.182:10101", "[1::1]:1", "70.199.182.92:1475"}, udpAddrStrings(rl.addrs))
+
+	// Preferred ranges still go first
+	_, ipNet, err := net.ParseCIDR("70.0.0.0/8")
+	assert.NoError(t, err)
+	rl.Rebuild([]*net.IPNet{ipNet})
+	assert.Equal(t, []string{"70.199.182.92:1475", "192.168.1.1:10101", "172.17.0.182:10101", "[1::1]:1"}, udpAddrStrings(rl.addrs))
+}
+
 func TestRemoteList_Rebuild(t *testing.T) {
 	rl := NewRemoteList(nil)
 	rl.unlockedSetV4(
@@ -233,3 +272,11 @@ func BenchmarkSortRebuild(b *testing.B) {
 		}
 	})
 }
+
+func udpAddrStrings(addrs []*udp.Addr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
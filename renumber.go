@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+)
+
+// renumber moves this node to the vpn ip in crt, a certificate that pki.allow_renumber let through with a new vpn ip in
+// the same network. It runs once crt is our certificate, if the tun device can not move to the new address an error is
+// returned and the old certificate is put back.
+//
+// Tunnels to the lighthouses are closed and opened again with our update, so they forget the old vpn ip and learn the
+// new one right away. Every other tunnel is re-handshaked with the new certificate, peers keep the tunnel to our old
+// vpn ip until it goes idle.
+func (f *Interface) renumber(crt *cert.NebulaCertificate) error {
+	network := crt.Details.Ips[0]
+	vpnIp := iputil.Ip2VpnIp(network.IP)
+	oldVpnIp := f.myVpnIp.Load()
+
+	cs, ok := f.inside.(overlay.CidrSetter)
+	if !ok {
+		return fmt.Errorf("the tun device can not change its address in %s", runtime.GOOS)
+	}
+
+	if err := cs.SetCidr(network); err != nil {
+		return err
+	}
+
+	f.myVpnIp.Store(vpnIp)
+	f.lightHouse.myVpnIp.Store(vpnIp)
+	f.firewall.setLocalIps(crt)
+
+	lighthouses := f.lightHouse.GetLighthouses()
+	var closed, rehandshaked []*HostInfo
+	f.hostMap.RLock()
+	for peer, hostinfo := range f.hostMap.Hosts {
+		if _, ok := lighthouses[peer]; ok {
+			closed = append(closed, hostinfo)
+		} else {
+			rehandshaked = append(rehandshaked, hostinfo)
+		}
+	}
+	f.hostMap.RUnlock()
+
+	f.l.WithField("oldVpnIp", oldVpnIp).WithField("vpnIp", vpnIp).
+		WithField("tunnels", len(closed)+len(rehandshaked)).
+		Info("Moved to the vpn ip in the new certificate")
+
+	for _, hostinfo := range closed {
+		f.sendCloseTunnel(hostinfo)
+		f.closeTunnel(hostinfo, "renumbered")
+	}
+
+	for _, hostinfo := range rehandshaked {
+		hostinfo.logger(f.l).WithField("reason", "local vpn ip changed").Info("Re-handshaking with remote")
+		f.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
+	}
+
+	f.lightHouse.SendUpdate()
+	return nil
+}
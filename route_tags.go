@@ -0,0 +1,40 @@
+package nebula
+
+import (
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// routeTagMetrics counts the traffic sent through tun.unsafe_routes entries by their tag, so many routes can be tracked
+// as a few logical groups without a metric for every cidr
+type routeTagMetrics struct {
+	// counters maps a tag to its *routeTagCounters, tags can come and go with a reload so they are registered on first
+	// use
+	counters sync.Map
+	registry metrics.Registry
+}
+
+type routeTagCounters struct {
+	packets metrics.Counter
+	bytes   metrics.Counter
+}
+
+// tx counts a packet of size bytes that was sent through a route with tag, untagged routes are not counted
+func (m *routeTagMetrics) tx(tag string, size int) {
+	if tag == "" {
+		return
+	}
+
+	c, ok := m.counters.Load(tag)
+	if !ok {
+		c, _ = m.counters.LoadOrStore(tag, &routeTagCounters{
+			packets: metrics.GetOrRegisterCounter("route_tags."+tag+".tx.packets", m.registry),
+			bytes:   metrics.GetOrRegisterCounter("route_tags."+tag+".tx.bytes", m.registry),
+		})
+	}
+
+	counters := c.(*routeTagCounters)
+	counters.packets.Inc(1)
+	counters.bytes.Inc(int64(size))
+}
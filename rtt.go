@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/util"
+)
+
+var defaultRttBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// rttMetrics exports the round trip time of tunnel tests, sent by the connection manager and Control.Ping, as a
+// bucketed histogram. Buckets are cumulative like prometheus, network.rtt.le_10ms counts every sample of 10ms or less,
+// and network.rtt.le_inf counts them all. With per_peer the same set is kept for every peer under
+// network.rtt.peer.<vpn ip> until the last tunnel to the peer is closed.
+type rttMetrics struct {
+	buckets []time.Duration
+	perPeer bool
+
+	registry metrics.Registry
+	all      *durationHistogram
+
+	sync.Mutex
+	peers map[iputil.VpnIp]*durationHistogram
+}
+
+// durationHistogram is a set of cumulative bucket counters and a sum, the way prometheus exports a histogram
+type durationHistogram struct {
+	// buckets has one counter for every bucket and a final one for +Inf
+	buckets []metrics.Counter
+	sum     metrics.Counter
+}
+
+// newRttMetricsFromConfig reads stats.rtt, buckets are a list of durations and must be in increasing order
+func newRttMetricsFromConfig(c *config.C) (*rttMetrics, error) {
+	buckets, err := parseDurationBuckets(c, "stats.rtt.buckets", defaultRttBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRttMetrics(util.MetricsRegistry(c), buckets, c.GetBool("stats.rtt.per_peer", false)), nil
+}
+
+// parseDurationBuckets reads a list of histogram buckets from k, they must be positive and in increasing order
+func parseDurationBuckets(c *config.C, k string, d []time.Duration) ([]time.Duration, error) {
+	raw := c.GetStringSlice(k, nil)
+	if len(raw) == 0 {
+		return d, nil
+	}
+
+	buckets := make([]time.Duration, len(raw))
+	for i, s := range raw {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s entry %v failed to parse: %v", k, i+1, err)
+		}
+
+		if d <= 0 || (i > 0 && d <= buckets[i-1]) {
+			return nil, fmt.Errorf("%s must be positive and in increasing order: %s", k, s)
+		}
+		buckets[i] = d
+	}
+
+	return buckets, nil
+}
+
+func newRttMetrics(registry metrics.Registry, buckets []time.Duration, perPeer bool) *rttMetrics {
+	r := &rttMetrics{
+		buckets:  buckets,
+		perPeer:  perPeer,
+		registry: registry,
+		peers:    map[iputil.VpnIp]*durationHistogram{},
+	}
+	r.all = newDurationHistogram(registry, "network.rtt", buckets)
+	return r
+}
+
+// newDurationHistogram registers the counters for buckets under prefix, prefix.le_<bucket>, prefix.le_inf and
+// prefix.sum_ns
+func newDurationHistogram(registry metrics.Registry, prefix string, buckets []time.Duration) *durationHistogram {
+	h := &durationHistogram{
+		buckets: make([]metrics.Counter, len(buckets)+1),
+		sum:     metrics.GetOrRegisterCounter(prefix+".sum_ns", registry),
+	}
+
+	for i, b := range buckets {
+		h.buckets[i] = metrics.GetOrRegisterCounter(prefix+".le_"+durationBucketName(b), registry)
+	}
+	h.buckets[len(buckets)] = metrics.GetOrRegisterCounter(prefix+".le_inf", registry)
+
+	return h
+}
+
+// unregisterDurationHistogram removes the counters newDurationHistogram registered for prefix and buckets
+func unregisterDurationHistogram(registry metrics.Registry, prefix string, buckets []time.Duration) {
+	registry.Unregister(prefix + ".sum_ns")
+	for _, b := range buckets {
+		registry.Unregister(prefix + ".le_" + durationBucketName(b))
+	}
+	registry.Unregister(prefix + ".le_inf")
+}
+
+// durationBucketName makes a bucket usable in a metric name, 2.5ms becomes 2_5ms
+func durationBucketName(d time.Duration) string {
+	return strings.ReplaceAll(d.String(), ".", "_")
+}
+
+// record adds a sample for vpnIp
+func (r *rttMetrics) record(vpnIp iputil.VpnIp, rtt time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.all.update(r.buckets, rtt)
+	if !r.perPeer {
+		return
+	}
+
+	r.Lock()
+	h, ok := r.peers[vpnIp]
+	if !ok {
+		h = newDurationHistogram(r.registry, rttPeerPrefix(vpnIp), r.buckets)
+		r.peers[vpnIp] = h
+	}
+	r.Unlock()
+
+	h.update(r.buckets, rtt)
+}
+
+// forget unregisters the histogram of vpnIp, called once the last tunnel to it is closed so the series of peers that
+// come and go do not pile up
+func (r *rttMetrics) forget(vpnIp iputil.VpnIp) {
+	if r == nil || !r.perPeer {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.peers[vpnIp]; !ok {
+		return
+	}
+
+	delete(r.peers, vpnIp)
+	unregisterDurationHistogram(r.registry, rttPeerPrefix(vpnIp), r.buckets)
+}
+
+func rttPeerPrefix(vpnIp iputil.VpnIp) string {
+	return "network.rtt.peer." + strings.ReplaceAll(vpnIp.String(), ".", "_")
+}
+
+func (h *durationHistogram) update(buckets []time.Duration, d time.Duration) {
+	// The first bucket that holds d and every bucket after it
+	i := sort.Search(len(buckets), func(i int) bool { return d <= buckets[i] })
+	for ; i < len(h.buckets); i++ {
+		h.buckets[i].Inc(1)
+	}
+	h.sum.Inc(d.Nanoseconds())
+}
+
+// observeTestReply completes the round trip started by the last test request sent to hostinfo, if there was one
+func (r *rttMetrics) observeTestReply(hostinfo *HostInfo) {
+	if r == nil {
+		return
+	}
+
+	sent := hostinfo.testSent.Swap(0)
+	if sent == 0 {
+		return
+	}
+
+	r.record(hostinfo.vpnIp, time.Duration(time.Now().UnixNano()-sent))
+}
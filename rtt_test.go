@@ -0,0 +1,117 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRttMetricsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	r, err := newRttMetricsFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRttBuckets, r.buckets)
+	assert.False(t, r.perPeer)
+
+	c.Settings["stats"] = map[interface{}]interface{}{"rtt": map[interface{}]interface{}{
+		"buckets":  []interface{}{"2.5ms", "10ms", "1s"},
+		"per_peer": true,
+	}}
+	r, err = newRttMetricsFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{2500 * time.Microsecond, 10 * time.Millisecond, time.Second}, r.buckets)
+	assert.True(t, r.perPeer)
+
+	c.Settings["stats"] = map[interface{}]interface{}{"rtt": map[interface{}]interface{}{"buckets": []interface{}{"10ms", "5ms"}}}
+	_, err = newRttMetricsFromConfig(c)
+	assert.EqualError(t, err, "stats.rtt.buckets must be positive and in increasing order: 5ms")
+
+	c.Settings["stats"] = map[interface{}]interface{}{"rtt": map[interface{}]interface{}{"buckets": []interface{}{"fast"}}}
+	_, err = newRttMetricsFromConfig(c)
+	assert.EqualError(t, err, "stats.rtt.buckets entry 1 failed to parse: time: invalid duration \"fast\"")
+}
+
+func TestRttMetrics_record(t *testing.T) {
+	registry := metrics.NewRegistry()
+	r := newRttMetrics(registry, []time.Duration{2500 * time.Microsecond, 10 * time.Millisecond, 50 * time.Millisecond}, true)
+	count := func(name string) int64 {
+		c, ok := registry.Get(name).(metrics.Counter)
+		if !ok {
+			return -1
+		}
+		return c.Count()
+	}
+
+	peer1 := iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))
+	peer2 := iputil.Ip2VpnIp(net.ParseIP("10.1.0.2"))
+	r.record(peer1, time.Millisecond)
+	r.record(peer1, 10*time.Millisecond)
+	r.record(peer2, 20*time.Millisecond)
+	r.record(peer2, time.Second)
+
+	// Buckets are cumulative, a sample lands in the first bucket that holds it and every one after
+	assert.Equal(t, int64(1), count("network.rtt.le_2_5ms"))
+	assert.Equal(t, int64(2), count("network.rtt.le_10ms"))
+	assert.Equal(t, int64(3), count("network.rtt.le_50ms"))
+	assert.Equal(t, int64(4), count("network.rtt.le_inf"))
+	assert.Equal(t, (time.Millisecond + 30*time.Millisecond + time.Second).Nanoseconds(), count("network.rtt.sum_ns"))
+
+	assert.Equal(t, int64(1), count("network.rtt.peer.10_1_0_1.le_2_5ms"))
+	assert.Equal(t, int64(2), count("network.rtt.peer.10_1_0_1.le_10ms"))
+	assert.Equal(t, int64(2), count("network.rtt.peer.10_1_0_1.le_inf"))
+	assert.Equal(t, int64(0), count("network.rtt.peer.10_1_0_2.le_10ms"))
+	assert.Equal(t, int64(1), count("network.rtt.peer.10_1_0_2.le_50ms"))
+	assert.Equal(t, int64(2), count("network.rtt.peer.10_1_0_2.le_inf"))
+
+	// Forgetting a peer unregisters its series and leaves the rest alone
+	r.forget(peer1)
+	assert.Equal(t, int64(-1), count("network.rtt.peer.10_1_0_1.le_2_5ms"))
+	assert.Equal(t, int64(-1), count("network.rtt.peer.10_1_0_1.le_inf"))
+	assert.Equal(t, int64(-1), count("network.rtt.peer.10_1_0_1.sum_ns"))
+	assert.Equal(t, int64(2), count("network.rtt.peer.10_1_0_2.le_inf"))
+	assert.Equal(t, int64(4), count("network.rtt.le_inf"))
+
+	// A new sample starts it over from 0
+	r.record(peer1, time.Millisecond)
+	assert.Equal(t, int64(1), count("network.rtt.peer.10_1_0_1.le_inf"))
+
+	// Without per_peer only the aggregate is kept
+	registry = metrics.NewRegistry()
+	r = newRttMetrics(registry, []time.Duration{10 * time.Millisecond}, false)
+	r.record(peer1, time.Millisecond)
+	assert.Equal(t, int64(1), count("network.rtt.le_10ms"))
+	assert.Equal(t, int64(-1), count("network.rtt.peer.10_1_0_1.le_10ms"))
+}
+
+func TestRttMetrics_observeTestReply(t *testing.T) {
+	registry := metrics.NewRegistry()
+	r := newRttMetrics(registry, []time.Duration{time.Minute}, false)
+	hostinfo := &HostInfo{vpnIp: iputil.Ip2VpnIp(net.ParseIP("10.1.0.1"))}
+	le := metrics.GetOrRegisterCounter("network.rtt.le_1m0s", registry)
+
+	// A reply we did not time, like the one after a handshake, is not a sample
+	r.observeTestReply(hostinfo)
+	assert.Equal(t, int64(0), le.Count())
+
+	hostinfo.testSent.Store(time.Now().Add(-time.Second).UnixNano())
+	r.observeTestReply(hostinfo)
+	assert.Equal(t, int64(1), le.Count())
+	assert.GreaterOrEqual(t, metrics.GetOrRegisterCounter("network.rtt.sum_ns", registry).Count(), time.Second.Nanoseconds())
+
+	// Only the first reply to a test counts
+	r.observeTestReply(hostinfo)
+	assert.Equal(t, int64(1), le.Count())
+
+	// Nothing is recorded when rtt metrics are not in use
+	var nilMetrics *rttMetrics
+	hostinfo.testSent.Store(time.Now().UnixNano())
+	nilMetrics.observeTestReply(hostinfo)
+}
@@ -0,0 +1,252 @@
+package nebula
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// sendQueues holds the settings for the per peer outbound queues. When enabled every packet written directly to a
+// peer goes through a bounded queue owned by that peer, a slow or congested path only backs up its own queue and
+// drops its own packets once the queue is full.
+type sendQueues struct {
+	depth    int
+	headDrop bool
+
+	// paceRate is the bytes per second each queue is drained at when listen.pace.rate is set, paceBurst is how many
+	// bytes may go out back to back before the pacing kicks in
+	paceRate  float64
+	paceBurst float64
+
+	metricDropped metrics.Counter
+	metricPaced   metrics.Counter
+}
+
+// defaultPacedSendQueueDepth is the queue depth used when listen.pace.rate is set without listen.send_queue_depth
+const defaultPacedSendQueueDepth = 256
+
+// newSendQueuesFromConfig returns nil if neither listen.send_queue_depth nor listen.pace.rate are set
+func newSendQueuesFromConfig(c *config.C) (*sendQueues, error) {
+	depth := c.GetInt("listen.send_queue_depth", 0)
+	if depth < 0 {
+		return nil, fmt.Errorf("listen.send_queue_depth can not be negative: %v", depth)
+	}
+
+	rate := c.GetInt("listen.pace.rate", 0)
+	if rate < 0 {
+		return nil, fmt.Errorf("listen.pace.rate can not be negative: %v", rate)
+	}
+
+	burst := c.GetInt("listen.pace.burst", 0)
+	if burst < 0 {
+		return nil, fmt.Errorf("listen.pace.burst can not be negative: %v", burst)
+	}
+
+	if depth == 0 {
+		if rate == 0 {
+			return nil, nil
+		}
+		// Pacing holds packets back so they need somewhere to wait
+		depth = defaultPacedSendQueueDepth
+	}
+
+	var headDrop bool
+	switch v := c.GetString("listen.send_queue_drop", "tail"); v {
+	case "tail":
+	case "head":
+		headDrop = true
+	default:
+		return nil, fmt.Errorf("listen.send_queue_drop must be one of tail or head: %v", v)
+	}
+
+	s := newSendQueues(util.MetricsRegistry(c), depth, headDrop)
+	s.paceRate = float64(rate)
+	s.paceBurst = float64(burst)
+	return s, nil
+}
+
+func newSendQueues(registry metrics.Registry, depth int, headDrop bool) *sendQueues {
+	return &sendQueues{
+		depth:         depth,
+		headDrop:      headDrop,
+		metricDropped: metrics.GetOrRegisterCounter("send_queue.dropped", registry),
+		metricPaced:   metrics.GetOrRegisterCounter("send_queue.paced", registry),
+	}
+}
+
+// get returns the queue for hostinfo, creating it and starting its worker on first use
+func (s *sendQueues) get(hostinfo *HostInfo, l *logrus.Logger) *sendQueue {
+	if q := hostinfo.sendQueue.Load(); q != nil {
+		return q
+	}
+
+	q := &sendQueue{
+		packets: make([]queuedPacket, s.depth),
+		parent:  s,
+		l:       hostinfo.logger(l),
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+
+	if s.paceRate > 0 {
+		q.pacer = &pacer{rate: s.paceRate, burst: s.paceBurst}
+	}
+
+	if !hostinfo.sendQueue.CompareAndSwap(nil, q) {
+		// Another routine beat us to it
+		return hostinfo.sendQueue.Load()
+	}
+
+	go q.run()
+	return q
+}
+
+type queuedPacket struct {
+	w    udp.Conn
+	addr *udp.Addr
+	ecn  byte
+	b    []byte
+}
+
+// sendQueue is a ring of packets waiting to be written for a single peer, drained by one worker that lives as long as
+// the hostinfo. Every slot owns a buffer that packets are copied into, the worker trades a spare buffer for the one it
+// takes out so once the buffers have grown to the packet size queueing does not allocate.
+type sendQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	packets []queuedPacket
+	head    int
+	len     int
+	closed  bool
+
+	// pacer is nil unless listen.pace.rate is set, it is only used by the worker
+	pacer *pacer
+
+	parent *sendQueues
+	l      *logrus.Entry
+}
+
+// push queues a copy of b to be written to addr with w. It returns false if a packet had to be dropped to respect the
+// queue depth, which is b itself when tail dropping or the queue is closed and the oldest queued packet when head
+// dropping.
+func (q *sendQueue) push(w udp.Conn, addr *udp.Addr, ecn byte, b []byte) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		q.parent.metricDropped.Inc(1)
+		return false
+	}
+
+	ok := true
+	if q.len == len(q.packets) {
+		q.parent.metricDropped.Inc(1)
+		if !q.parent.headDrop {
+			return false
+		}
+
+		// The oldest slot is the next one written to below, it keeps its buffer
+		q.head = (q.head + 1) % len(q.packets)
+		q.len--
+		ok = false
+	}
+
+	p := &q.packets[(q.head+q.len)%len(q.packets)]
+	p.w = w
+	p.addr = addr
+	p.ecn = ecn
+	p.b = append(p.b[:0], b...)
+	q.len++
+
+	q.cond.Signal()
+	return ok
+}
+
+// pop waits for the oldest packet and removes it, the emptied slot takes spare as its buffer so the returned buffer
+// belongs to the caller. ok is false once the queue is closed.
+func (q *sendQueue) pop(spare []byte) (p queuedPacket, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for q.len == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return p, false
+	}
+
+	p = q.packets[q.head]
+	q.packets[q.head] = queuedPacket{b: spare[:0]}
+	q.head = (q.head + 1) % len(q.packets)
+	q.len--
+	return p, true
+}
+
+// close stops the worker and drops anything still queued, it is called when the hostinfo is deleted
+func (q *sendQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.packets = nil
+	q.len = 0
+	q.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *sendQueue) run() {
+	var spare []byte
+	for {
+		p, ok := q.pop(spare)
+		if !ok {
+			return
+		}
+
+		if q.pacer != nil {
+			if d := q.pacer.reserve(time.Now(), len(p.b)); d > 0 {
+				q.parent.metricPaced.Inc(1)
+				time.Sleep(d)
+			}
+		}
+
+		if err := p.w.WriteToECN(p.b, p.addr, p.ecn); err != nil {
+			q.l.WithError(err).WithField("udpAddr", p.addr).Error("Failed to write outgoing packet")
+		}
+
+		spare = p.b
+	}
+}
+
+// pacer is a token bucket that delays packets instead of dropping them. Tokens are bytes, they accrue at rate per second
+// up to burst and a packet may go out whenever the bucket is not in debt, which it then goes into by its size. With no
+// burst every packet is spaced from the one before it by the time it takes to send that one at rate.
+type pacer struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes worth of tokens and returns how long to wait from now before sending them
+func (p *pacer) reserve(now time.Time, n int) time.Duration {
+	if p.last.IsZero() {
+		p.tokens = p.burst
+	} else {
+		p.tokens = math.Min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	}
+	p.last = now
+
+	var wait time.Duration
+	if p.tokens < 0 {
+		wait = time.Duration(-p.tokens / p.rate * float64(time.Second))
+	}
+
+	p.tokens -= float64(n)
+	return wait
+}
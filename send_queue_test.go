@@ -0,0 +1,209 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingConn hands every write to the test and waits for it to be released
+type blockingConn struct {
+	udp.Conn
+	writes  chan []byte
+	release chan struct{}
+}
+
+func (c *blockingConn) WriteToECN(b []byte, _ *udp.Addr, _ byte) error {
+	c.writes <- b
+	<-c.release
+	return nil
+}
+
+func Test_newSendQueuesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Disabled by default
+	s, err := newSendQueuesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	c.Settings["listen"] = map[interface{}]interface{}{"send_queue_depth": -1}
+	_, err = newSendQueuesFromConfig(c)
+	assert.EqualError(t, err, "listen.send_queue_depth can not be negative: -1")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"send_queue_depth": 10, "send_queue_drop": "middle"}
+	_, err = newSendQueuesFromConfig(c)
+	assert.EqualError(t, err, "listen.send_queue_drop must be one of tail or head: middle")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"send_queue_depth": 10}
+	s, err = newSendQueuesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, s.depth)
+	assert.False(t, s.headDrop)
+
+	c.Settings["listen"] = map[interface{}]interface{}{"send_queue_depth": 10, "send_queue_drop": "head"}
+	s, err = newSendQueuesFromConfig(c)
+	assert.NoError(t, err)
+	assert.True(t, s.headDrop)
+
+	// Pacing enables the queues on its own
+	c.Settings["listen"] = map[interface{}]interface{}{"pace": map[interface{}]interface{}{"rate": 1000000, "burst": 3000}}
+	s, err = newSendQueuesFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPacedSendQueueDepth, s.depth)
+	assert.Equal(t, float64(1000000), s.paceRate)
+	assert.Equal(t, float64(3000), s.paceBurst)
+
+	c.Settings["listen"] = map[interface{}]interface{}{"pace": map[interface{}]interface{}{"rate": -1}}
+	_, err = newSendQueuesFromConfig(c)
+	assert.EqualError(t, err, "listen.pace.rate can not be negative: -1")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"pace": map[interface{}]interface{}{"rate": 1000, "burst": -1}}
+	_, err = newSendQueuesFromConfig(c)
+	assert.EqualError(t, err, "listen.pace.burst can not be negative: -1")
+}
+
+func TestPacer_reserve(t *testing.T) {
+	now := time.Now()
+	p := &pacer{rate: 1000}
+
+	// The first packet goes right away, each one after waits for the one before it to be paid for
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+	assert.Equal(t, 100*time.Millisecond, p.reserve(now, 200))
+	assert.Equal(t, 300*time.Millisecond, p.reserve(now, 100))
+
+	// Time that passes pays the debt off
+	now = now.Add(400 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+
+	// An idle peer only saves up burst
+	p = &pacer{rate: 1000, burst: 250}
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+	assert.Equal(t, time.Duration(0), p.reserve(now, 100))
+	assert.Equal(t, 50*time.Millisecond, p.reserve(now, 100))
+}
+
+// timedConn records when each packet was written
+type timedConn struct {
+	udp.Conn
+	writes chan time.Time
+}
+
+func (c *timedConn) WriteToECN(_ []byte, _ *udp.Addr, _ byte) error {
+	c.writes <- time.Now()
+	return nil
+}
+
+func TestSendQueue_pace(t *testing.T) {
+	l := test.NewLogger()
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+
+	// 1000 byte packets at 100KB/s should go out every 10ms
+	s := newSendQueues(nil, 32, false)
+	s.paceRate = 100000
+	conn := &timedConn{writes: make(chan time.Time, 32)}
+	q := s.get(&HostInfo{}, l)
+
+	const packets = 21
+	for i := 0; i < packets; i++ {
+		assert.True(t, q.push(conn, addr, 0, make([]byte, 1000)))
+	}
+
+	sent := make([]time.Time, packets)
+	for i := range sent {
+		sent[i] = <-conn.writes
+	}
+
+	for i := 1; i < packets; i++ {
+		assert.GreaterOrEqual(t, sent[i].Sub(sent[i-1]), 5*time.Millisecond, "packet %v", i)
+	}
+
+	// Sleeps can overshoot but the average spacing should stay close to the target
+	avg := sent[packets-1].Sub(sent[0]) / (packets - 1)
+	assert.InDelta(t, float64(10*time.Millisecond), float64(avg), float64(2*time.Millisecond))
+}
+
+func TestSendQueue_overflow(t *testing.T) {
+	l := test.NewLogger()
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+
+	run := func(headDrop bool) [][]byte {
+		s := newSendQueues(nil, 2, headDrop)
+		dropped := s.metricDropped.Count()
+		conn := &blockingConn{writes: make(chan []byte), release: make(chan struct{})}
+
+		hostinfo := &HostInfo{}
+		q := s.get(hostinfo, l)
+		assert.Same(t, q, s.get(hostinfo, l))
+
+		// The first packet is picked up right away and holds the drain up in the write
+		b := []byte{1}
+		assert.True(t, q.push(conn, addr, 0, b))
+		// The queue keeps its own copy
+		b[0] = 100
+		written := [][]byte{<-conn.writes}
+
+		// Fill the queue and overflow it
+		assert.True(t, q.push(conn, addr, 0, []byte{2}))
+		assert.True(t, q.push(conn, addr, 0, []byte{3}))
+		assert.False(t, q.push(conn, addr, 0, []byte{4}))
+		assert.False(t, q.push(conn, addr, 0, []byte{5}))
+		assert.Equal(t, int64(2), s.metricDropped.Count()-dropped)
+
+		for i := 0; i < 2; i++ {
+			conn.release <- struct{}{}
+			written = append(written, <-conn.writes)
+		}
+		conn.release <- struct{}{}
+
+		return written
+	}
+
+	// Tail drop refuses the new packets
+	assert.Equal(t, [][]byte{{1}, {2}, {3}}, run(false))
+
+	// Head drop makes room for them by dropping the oldest
+	assert.Equal(t, [][]byte{{1}, {4}, {5}}, run(true))
+}
+
+// discardConn drops every write
+type discardConn struct {
+	udp.Conn
+}
+
+func (discardConn) WriteToECN(_ []byte, _ *udp.Addr, _ byte) error {
+	return nil
+}
+
+func TestSendQueue_close(t *testing.T) {
+	l := test.NewLogger()
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	s := newSendQueues(nil, 64, false)
+	q := s.get(&HostInfo{}, l)
+
+	// Once the slot buffers are grown queueing a packet does not allocate
+	b := make([]byte, 1300)
+	for i := 0; i < 128; i++ {
+		q.push(discardConn{}, addr, 0, b)
+	}
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		q.push(discardConn{}, addr, 0, b)
+	}))
+
+	// A closed queue stops its worker and drops what it is given
+	dropped := s.metricDropped.Count()
+	q.close()
+	_, ok := q.pop(nil)
+	assert.False(t, ok)
+	assert.False(t, q.push(discardConn{}, addr, 0, b))
+	assert.Equal(t, int64(1), s.metricDropped.Count()-dropped)
+}
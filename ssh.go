@@ -2,6 +2,7 @@ package nebula
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,15 +15,28 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
 	"github.com/slackhq/nebula/udp"
 )
 
+const (
+	// tunnelEventKeepalive is written to an idle subscribe-hostmap stream so a client that went away is noticed
+	tunnelEventKeepalive = "keepalive"
+
+	// hostMapEventBuffer is how many events a subscribe-hostmap client may fall behind
+	hostMapEventBuffer = 1024
+	// hostMapEventKeepalive is how often an idle subscribe-hostmap stream writes a keepalive
+	hostMapEventKeepalive = 15 * time.Second
+)
+
 type sshListHostMapFlags struct {
 	Json    bool
 	Pretty  bool
@@ -35,10 +49,26 @@ type sshPrintCertFlags struct {
 	Raw    bool
 }
 
+type sshLogLevelFlags struct {
+	For time.Duration
+}
+
 type sshPrintTunnelFlags struct {
 	Pretty bool
 }
 
+type sshSimulateFlags struct {
+	Proto   string
+	Inbound bool
+	Pretty  bool
+}
+
+type sshDumpConntrackFlags struct {
+	VpnIp  string
+	Proto  string
+	Pretty bool
+}
+
 type sshChangeRemoteFlags struct {
 	Address string
 }
@@ -51,6 +81,26 @@ type sshCreateTunnelFlags struct {
 	Address string
 }
 
+type sshMaintenanceFlags struct {
+	Timeout time.Duration
+	Up      bool
+}
+
+type sshPingFlags struct {
+	Timeout time.Duration
+	Remote  string
+	Local   string
+	Json    bool
+	Pretty  bool
+}
+
+type sshPingAllFlags struct {
+	Timeout     time.Duration
+	Concurrency int
+	Json        bool
+	Pretty      bool
+}
+
 func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) {
 	c.RegisterReloadCallback(func(c *config.C) {
 		if c.GetBool("sshd.enabled", false) {
@@ -153,10 +203,23 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 		l.Info("no ssh users to authorize")
 	}
 
+	control, err := configSSHControl(l, c)
+	if err != nil {
+		return nil, err
+	}
+
 	var runner func()
 	if c.GetBool("sshd.enabled", false) {
 		ssh.Stop()
 		runner = func() {
+			if control.listen != "" {
+				go func() {
+					if err := ssh.RunControl(control.listen, control.token, control.observerToken, control.tls); err != nil {
+						l.WithField("err", err).Warn("Failed to run the control server")
+					}
+				}()
+			}
+
 			if err := ssh.Run(listen); err != nil {
 				l.WithField("err", err).Warn("Failed to run the SSH server")
 			}
@@ -168,10 +231,67 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 	return runner, nil
 }
 
+// sshControlConfig is the optional tcp control listener config from sshd.control
+type sshControlConfig struct {
+	listen        string
+	token         string
+	observerToken string
+	tls           *tls.Config
+}
+
+// configSSHControl reads the optional tcp control listener config from sshd.control, an empty listen address means it
+// is disabled
+func configSSHControl(l *logrus.Logger, c *config.C) (sshControlConfig, error) {
+	listen := c.GetString("sshd.control.listen", "")
+	if listen == "" {
+		return sshControlConfig{}, nil
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return sshControlConfig{}, fmt.Errorf("invalid sshd.control.listen address: %s", err)
+	}
+
+	token := c.GetString("sshd.control.token", "")
+	if token == "" {
+		return sshControlConfig{}, fmt.Errorf("sshd.control.token must be provided")
+	}
+
+	observerToken := c.GetString("sshd.control.observer_token", "")
+	if observerToken == token {
+		return sshControlConfig{}, fmt.Errorf("sshd.control.observer_token must not be the same as sshd.control.token")
+	}
+
+	cc := sshControlConfig{listen: listen, token: token, observerToken: observerToken}
+
+	certFile := c.GetString("sshd.control.cert", "")
+	keyFile := c.GetString("sshd.control.key", "")
+	if certFile == "" && keyFile == "" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			l.WithField("listen", listen).Warn("sshd.control has no tls configured, the token and commands will be sent in the clear")
+		}
+		return cc, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return sshControlConfig{}, fmt.Errorf("sshd.control.cert and sshd.control.key must both be provided to use tls")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return sshControlConfig{}, fmt.Errorf("error while loading sshd.control tls certificate: %s", err)
+	}
+
+	cc.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return cc, nil
+}
+
 func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface) {
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-hostmap",
 		ShortDescription: "List all known previously connected hosts",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
@@ -188,6 +308,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-pending-hostmap",
 		ShortDescription: "List all handshaking hosts",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
@@ -204,6 +325,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-lighthouse-addrmap",
 		ShortDescription: "List all lighthouse map entries",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
@@ -216,6 +338,32 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "list-overlays",
+		ShortDescription: "List the overlays running in this process by their overlay.name",
+		ReadOnly:         true,
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshListHostMapFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshListOverlays(fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "subscribe-hostmap",
+		ShortDescription: "Streams host map changes as json lines until the connection closes",
+		Help:             "Writes an up event for every tunnel that is already up, then one per line as tunnels come up, go down, change their underlay address (endpoint) or lose a relay (relay_lost). A keepalive is written every 15s while idle. A client that falls more than 1024 events behind is sent overflow and the stream ends.",
+		ReadOnly:         true,
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshSubscribeHostMap(f, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "reload",
 		ShortDescription: "Reloads configuration from disk, same as sending HUP to the process",
@@ -224,6 +372,14 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "refresh-mtu",
+		ShortDescription: "Re-reads the tun device mtu and updates route mtus to match",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshRefreshMTU(f, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "start-cpu-profile",
 		ShortDescription: "Starts a cpu profile and write output to the provided file",
@@ -245,6 +401,23 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Callback:         sshGetHeapProfile,
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "diag",
+		ShortDescription: "Saves a tarball of diagnostics with secrets redacted to the provided path, for support tickets",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshDiag(f, c, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "capture",
+		ShortDescription: "Writes the decrypted packets of a peer to a pcap file, for a duration or a packet count",
+		Help:             "Usage: capture <vpn ip> <file> <duration|count> or capture stop. One capture runs at a time, for at most 1h and 64MiB.",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshCapture(f, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "mutex-profile-fraction",
 		ShortDescription: "Gets or sets runtime.SetMutexProfileFraction",
@@ -257,11 +430,18 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Callback:         sshGetMutexProfile,
 	})
 
+	levelOverride := &logLevelOverride{l: l, c: c}
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "log-level",
 		ShortDescription: "Gets or sets the current log level",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshLogLevelFlags{}
+			fl.DurationVar(&s.For, "for", 0, "go back to logging.level after this long, 0 keeps the level until the next change")
+			return fl, &s
+		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			return sshLogLevel(l, fs, a, w)
+			return sshLogLevel(l, levelOverride, fs, a, w)
 		},
 	})
 
@@ -276,6 +456,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "version",
 		ShortDescription: "Prints the currently running version of nebula",
+		ReadOnly:         true,
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshVersion(f, fs, a, w)
 		},
@@ -284,6 +465,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-cert",
 		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn ip",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshPrintCertFlags{}
@@ -297,9 +479,27 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "promote-cert",
+		ShortDescription: "Makes the loaded certificate with the provided fingerprint the primary, used for new handshakes",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPromoteCert(f, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "tofu-clear",
+		ShortDescription: "Forgets the certificate fingerprint learned under pki.tofu for the provided vpn ip",
+		Help:             "The next certificate the vpn ip presents is learned instead, use it when a host was given a new certificate.",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshTofuClear(f, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-tunnel",
 		ShortDescription: "Prints json details about a tunnel for the provided vpn ip",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshPrintTunnelFlags{}
@@ -314,6 +514,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-relays",
 		ShortDescription: "Prints json details about all relay info",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshPrintTunnelFlags{}
@@ -325,6 +526,71 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "dump-firewall",
+		ShortDescription: "Prints json details about the active firewall rules and settings",
+		ReadOnly:         true,
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshDumpFirewall(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "dump-conntrack",
+		ShortDescription: "Prints json details about the active conntrack entries",
+		ReadOnly:         true,
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshDumpConntrackFlags{}
+			fl.StringVar(&s.VpnIp, "vpn-ip", "", "Only print the entries for the peer with this vpn ip")
+			fl.StringVar(&s.Proto, "proto", "any", "Only print the entries for this protocol, tcp, udp, icmp, any, or a protocol number")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshDumpConntrack(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-keepalive",
+		ShortDescription: "Prints the keepalive interval in effect for every tunnel, or the provided vpn ip",
+		ReadOnly:         true,
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPrintKeepalive(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "simulate",
+		ShortDescription: "Shows the route and firewall decision for a packet without sending it",
+		ReadOnly:         true,
+		Help:             "Usage: simulate [-inbound] [-proto tcp|udp|icmp] <from ip:port> <to ip:port>",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshSimulateFlags{}
+			fl.StringVar(&s.Proto, "proto", "tcp", "The protocol of the packet, tcp, udp, icmp, or a protocol number")
+			fl.BoolVar(&s.Inbound, "inbound", false, "Treat the packet as received from a peer instead of sent to one")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshSimulate(f, fs, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "change-remote",
 		ShortDescription: "Changes the remote address used in the tunnel for the provided vpn ip",
@@ -368,6 +634,59 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "maintenance",
+		ShortDescription: "Advertises this node as down for maintenance to the lighthouses and peers relaying through it",
+		Help:             "Lighthouses stop handing out our addresses and peers relaying through us move to another relay until the timeout passes or -up is used.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshMaintenanceFlags{}
+			fl.DurationVar(&s.Timeout, "timeout", time.Hour, "How long to stay in maintenance before returning to normal on our own")
+			fl.BoolVar(&s.Up, "up", false, "Leave maintenance now")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshMaintenance(f, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "ping",
+		ShortDescription: "Pings a peer over a chosen underlay path and reports the path used and round trip time",
+		Help:             "Takes a vpn ip. Use -remote to send to one address of a multi-homed peer and -local to send from one of ours.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPingFlags{}
+			fl.DurationVar(&s.Timeout, "timeout", 5*time.Second, "How long to wait for a reply")
+			fl.StringVar(&s.Remote, "remote", "", "The ip:port of the peer to send to instead of the one the tunnel is using")
+			fl.StringVar(&s.Local, "local", "", "The local ip to send from")
+			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPing(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "ping-all",
+		ShortDescription: "Pings every known peer and reports which are reachable, directly or relayed",
+		Help:             "Peers in the hostmap, the static host map, and the lighthouses are pinged, handshaking with them if needed.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPingAllFlags{}
+			fl.DurationVar(&s.Timeout, "timeout", 5*time.Second, "How long to wait for a reply from each peer")
+			fl.IntVar(&s.Concurrency, "concurrency", 16, "How many peers to ping at the same time")
+			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPingAll(f, fs, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "query-lighthouse",
 		ShortDescription: "Query the lighthouses for the provided vpn ip",
@@ -376,6 +695,15 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 			return sshQueryLighthouse(f, fs, a, w)
 		},
 	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "lighthouse",
+		ShortDescription: "Manage our registration with the lighthouses",
+		Help:             "`lighthouse refresh` discovers our local addresses and sends them to every lighthouse now instead of waiting for lighthouse.interval, then prints the addresses that were sent.",
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshLighthouse(f, a, w)
+		},
+	})
 }
 
 func sshListHostMap(hl controlHostLister, a interface{}, w sshd.StringWriter) error {
@@ -476,6 +804,76 @@ func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWr
 	return nil
 }
 
+func sshListOverlays(a interface{}, w sshd.StringWriter) error {
+	fs, ok := a.(*sshListHostMapFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	overlays := listOverlays()
+	if fs.Json || fs.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if fs.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(overlays)
+	}
+
+	for _, o := range overlays {
+		name := o.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		err := w.WriteLine(fmt.Sprintf("%s: %s on %s", name, o.VpnIp, o.Device))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sshSubscribeHostMap writes an up event for every tunnel that is already up and then every host map change as a line
+// of json, until the client goes away, the client falls behind or the overlay stops
+func sshSubscribeHostMap(ifce *Interface, w sshd.StringWriter) error {
+	// Subscribe before listing so nothing that happens in between is missed, a tunnel may be reported up twice
+	events := ifce.eventStream.subscribe(hostMapEventBuffer)
+	defer ifce.eventStream.unsubscribe(events)
+
+	js := json.NewEncoder(w.GetWriter())
+	var existing []TunnelEvent
+	ifce.hostMap.RLock()
+	for _, hostinfo := range ifce.hostMap.Hosts {
+		existing = append(existing, newTunnelEvent(tunnelEventUp, hostinfo, "existing tunnel"))
+	}
+	ifce.hostMap.RUnlock()
+
+	for _, e := range existing {
+		if err := js.Encode(e); err != nil {
+			return nil
+		}
+	}
+
+	keepalive := time.NewTicker(hostMapEventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := js.Encode(e); err != nil {
+				return nil
+			}
+		case now := <-keepalive.C:
+			if err := js.Encode(TunnelEvent{Event: tunnelEventKeepalive, Time: now}); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
 func sshStartCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
 		err := w.WriteLine("No path to write profile provided")
@@ -498,6 +896,73 @@ func sshStartCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
 	return err
 }
 
+func sshDiag(ifce *Interface, c *config.C, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No path to write diagnostics provided")
+	}
+
+	file, err := os.OpenFile(a[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to create diagnostics file: %s", err))
+	}
+	defer file.Close()
+
+	err = writeDiagnostics(file, ifce, c)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to write diagnostics: %s", err))
+	}
+
+	return w.WriteLine(fmt.Sprintf("Diagnostics saved to %s", a[0]))
+}
+
+func sshCapture(ifce *Interface, a []string, w sshd.StringWriter) error {
+	if len(a) == 1 && a[0] == "stop" {
+		pc := ifce.capture.Load()
+		if pc == nil {
+			return w.WriteLine("No capture is running")
+		}
+		pc.stop()
+		return w.WriteLine("Capture stopped")
+	}
+
+	if len(a) != 3 {
+		return w.WriteLine("Usage: capture <vpn ip> <file> <duration|count>")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	var count int
+	duration, err := time.ParseDuration(a[2])
+	if err != nil {
+		count, err = strconv.Atoi(a[2])
+		if err != nil || count < 1 {
+			return w.WriteLine(fmt.Sprintf("The provided limit is not a duration or a packet count: %s", a[2]))
+		}
+	} else if duration <= 0 || duration > maxCaptureDuration {
+		return w.WriteLine(fmt.Sprintf("The provided duration must be greater than 0 and at most %s", maxCaptureDuration))
+	}
+
+	if ifce.capture.Load() != nil {
+		return w.WriteLine(errCaptureRunning.Error())
+	}
+
+	file, err := os.OpenFile(a[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to create capture file: %s", err))
+	}
+
+	pc := newPacketCapture(ifce.l, iputil.Ip2VpnIp(parsedIp), file, duration, count)
+	if err := ifce.startCapture(pc); err != nil {
+		file.Close()
+		return w.WriteLine(err.Error())
+	}
+
+	return w.WriteLine(fmt.Sprintf("Capturing packets for %s to %s", parsedIp, a[1]))
+}
+
 func sshVersion(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
 	return w.WriteLine(fmt.Sprintf("%s", ifce.version))
 }
@@ -525,6 +990,31 @@ func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.Stri
 	return json.NewEncoder(w.GetWriter()).Encode(cm)
 }
 
+func sshLighthouse(ifce *Interface, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 || a[0] != "refresh" {
+		return w.WriteLine("Usage: lighthouse refresh")
+	}
+
+	sent := ifce.lightHouse.SendUpdate()
+	lighthouses := len(ifce.lightHouse.GetLighthouses())
+	if lighthouses == 0 {
+		return w.WriteLine("There are no lighthouses to update")
+	}
+
+	err := w.WriteLine(fmt.Sprintf("Sent %v addresses to %v lighthouses", len(sent), lighthouses))
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range sent {
+		if err := w.WriteLine(addr.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
 	flags, ok := fs.(*sshCloseTunnelFlags)
 	if !ok {
@@ -563,7 +1053,7 @@ func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		)
 	}
 
-	ifce.closeTunnel(hostInfo)
+	ifce.closeTunnel(hostInfo, "closed by ssh")
 	return w.WriteLine("Closed")
 }
 
@@ -713,9 +1203,15 @@ func sshGetMutexProfile(fs interface{}, a []string, w sshd.StringWriter) error {
 	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
 }
 
-func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
+func sshLogLevel(l *logrus.Logger, o *logLevelOverride, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshLogLevelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
 	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.GetLevel()))
 	}
 
 	level, err := logrus.ParseLevel(a[0])
@@ -723,8 +1219,11 @@ func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWrit
 		return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
 	}
 
-	l.SetLevel(level)
-	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+	o.set(level, flags.For)
+	if flags.For > 0 {
+		return w.WriteLine(fmt.Sprintf("Log level is: %s for %s", l.GetLevel(), flags.For))
+	}
+	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.GetLevel()))
 }
 
 func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
@@ -735,9 +1234,9 @@ func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWri
 	logFormat := strings.ToLower(a[0])
 	switch logFormat {
 	case "text":
-		l.Formatter = &logrus.TextFormatter{}
+		l.SetFormatter(&logrus.TextFormatter{})
 	case "json":
-		l.Formatter = &logrus.JSONFormatter{}
+		l.SetFormatter(&logrus.JSONFormatter{})
 	default:
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
@@ -745,6 +1244,42 @@ func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWri
 	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
 }
 
+func sshPromoteCert(ifce *Interface, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No certificate fingerprint was provided")
+	}
+
+	if err := ifce.pki.PromoteCert(a[0]); err != nil {
+		return w.WriteLine(err.Error())
+	}
+	return w.WriteLine(fmt.Sprintf("Promoted %s to primary", a[0]))
+}
+
+func sshTofuClear(ifce *Interface, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := iputil.Ip2VpnIp(parsedIp)
+	if vpnIp == 0 {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	cleared, err := ifce.pki.ClearTofu(vpnIp)
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+	if !cleared {
+		return w.WriteLine(fmt.Sprintf("No fingerprint was learned for vpn ip: %v", a[0]))
+	}
+	return w.WriteLine(fmt.Sprintf("Cleared the fingerprint learned for %v", a[0]))
+}
+
 func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
 	args, ok := fs.(*sshPrintCertFlags)
 	if !ok {
@@ -942,3 +1477,289 @@ func sshReload(c *config.C, w sshd.StringWriter) error {
 	c.ReloadConfig()
 	return err
 }
+
+func sshMaintenance(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshMaintenanceFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if flags.Up {
+		if !ifce.endMaintenance() {
+			return w.WriteLine("Not in maintenance")
+		}
+		return w.WriteLine("Left maintenance")
+	}
+
+	if err := ifce.startMaintenance(flags.Timeout); err != nil {
+		return w.WriteLine(err.Error())
+	}
+	return w.WriteLine(fmt.Sprintf("In maintenance for %s", flags.Timeout))
+}
+
+func sshRefreshMTU(f *Interface, w sshd.StringWriter) error {
+	r, ok := f.inside.(overlay.MTURefresher)
+	if !ok {
+		return w.WriteLine("The tun device does not support refreshing the mtu")
+	}
+
+	mtu, err := r.RefreshMTU()
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Failed to refresh the mtu: %s", err))
+	}
+
+	return w.WriteLine(fmt.Sprintf("Tun device mtu is %d", mtu))
+}
+
+func sshDumpFirewall(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(ifce.firewall.Dump())
+}
+
+func sshDumpConntrack(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	args, ok := fs.(*sshDumpConntrackFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	var vpnIp iputil.VpnIp
+	if args.VpnIp != "" {
+		ip := net.ParseIP(args.VpnIp).To4()
+		if ip == nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", args.VpnIp))
+		}
+		vpnIp = iputil.Ip2VpnIp(ip)
+	}
+
+	proto, ok := sshParseProto(args.Proto)
+	if !ok {
+		return w.WriteLine(fmt.Sprintf("The provided proto could not be parsed: %s", args.Proto))
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(ifce.firewall.DumpConntrack(vpnIp, proto))
+}
+
+func sshPrintKeepalive(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	var vpnIp iputil.VpnIp
+	if len(a) > 0 {
+		parsedIp := net.ParseIP(a[0])
+		if parsedIp == nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		}
+		vpnIp = iputil.Ip2VpnIp(parsedIp)
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(ifce.connectionManager.keepaliveIntervals(vpnIp))
+}
+
+// sshParseProto parses a protocol name or number, any is firewall.ProtoAny
+func sshParseProto(proto string) (uint8, bool) {
+	switch proto {
+	case "any":
+		return firewall.ProtoAny, true
+	case "tcp":
+		return firewall.ProtoTCP, true
+	case "udp":
+		return firewall.ProtoUDP, true
+	case "icmp":
+		return firewall.ProtoICMP, true
+	default:
+		p, err := strconv.ParseUint(proto, 10, 8)
+		if err != nil {
+			return 0, false
+		}
+		return uint8(p), true
+	}
+}
+
+func sshPing(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPingFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn ip was provided")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := iputil.Ip2VpnIp(parsedIp)
+	if vpnIp == 0 {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	if args.Timeout <= 0 {
+		return w.WriteLine("-timeout must be greater than 0")
+	}
+
+	var remote *udp.Addr
+	if args.Remote != "" {
+		ip, port, err := udp.ParseIPAndPort(args.Remote)
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided remote could not be parsed: %s", args.Remote))
+		}
+		remote = udp.NewAddr(ip, port)
+	}
+
+	var local net.IP
+	if args.Local != "" {
+		local = net.ParseIP(args.Local)
+		if local == nil {
+			return w.WriteLine(fmt.Sprintf("The provided local ip could not be parsed: %s", args.Local))
+		}
+	}
+
+	r := ifce.pingPath(vpnIp, remote, local, args.Timeout)
+
+	if args.Json || args.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if args.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(r)
+	}
+
+	line := fmt.Sprintf("%s: %s", r.VpnIp, r.Status)
+	if r.Status != PingFailed {
+		line += fmt.Sprintf(" %s", r.Rtt)
+	}
+	if r.Remote != nil {
+		line += fmt.Sprintf(" via %s", r.Remote)
+	}
+	if r.Local != nil {
+		line += fmt.Sprintf(" from %s", r.Local)
+	}
+	return w.WriteLine(line)
+}
+
+func sshPingAll(ifce *Interface, fs interface{}, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPingAllFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if args.Timeout <= 0 {
+		return w.WriteLine("-timeout must be greater than 0")
+	}
+
+	if args.Concurrency < 1 {
+		return w.WriteLine("-concurrency must be greater than 0")
+	}
+
+	results := ifce.pingAll(args.Timeout, args.Concurrency)
+
+	if args.Json || args.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if args.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(results)
+	}
+
+	for _, r := range results {
+		line := fmt.Sprintf("%s: %s", r.VpnIp, r.Status)
+		if r.Status != PingFailed {
+			line += fmt.Sprintf(" %s", r.Rtt)
+		}
+
+		err := w.WriteLine(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshSimulate(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshSimulateFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	if len(a) != 2 {
+		return w.WriteLine("A from and to address must be provided, ip:port")
+	}
+
+	proto, ok := sshParseProto(args.Proto)
+	if !ok || proto == firewall.ProtoAny {
+		return w.WriteLine(fmt.Sprintf("The provided proto could not be parsed: %s", args.Proto))
+	}
+
+	var ips [2]iputil.VpnIp
+	var ports [2]uint16
+	for i, v := range a {
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided address could not be parsed: %s", v))
+		}
+
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return w.WriteLine(fmt.Sprintf("The provided ip could not be parsed: %s", host))
+		}
+
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return w.WriteLine(fmt.Sprintf("The provided port could not be parsed: %s", port))
+		}
+
+		ips[i] = iputil.Ip2VpnIp(ip)
+		ports[i] = uint16(p)
+	}
+
+	// Outbound packets are from us, inbound packets are to us
+	fp := firewall.Packet{
+		LocalIP:    ips[0],
+		RemoteIP:   ips[1],
+		LocalPort:  ports[0],
+		RemotePort: ports[1],
+		Protocol:   proto,
+	}
+	if args.Inbound {
+		fp.LocalIP, fp.RemoteIP = fp.RemoteIP, fp.LocalIP
+		fp.LocalPort, fp.RemotePort = fp.RemotePort, fp.LocalPort
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(simulatePacket(ifce, fp, args.Inbound))
+}
@@ -29,6 +29,9 @@ type Command struct {
 	Help             string
 	Flags            CommandFlags
 	Callback         CommandCallback
+
+	// ReadOnly commands only report state, they are the only commands an observer may run
+	ReadOnly bool
 }
 
 func execCommand(c *Command, args []string, w StringWriter) error {
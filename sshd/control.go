@@ -0,0 +1,117 @@
+package sshd
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// controlAuthTimeout is how long a control client has to send the token after connecting
+const controlAuthTimeout = 10 * time.Second
+
+// RunControl begins listening for control connections on a tcp address, wrapped in tls if tlsConfig is not nil.
+// A client must send the token as the first line, after which every line it sends is run as a command, the same as
+// an ssh exec, with the output written back on the connection. A client that sends observerToken instead may only run
+// ReadOnly commands, an empty observerToken disables observers.
+func (s *SSHServer) RunControl(addr string, token string, observerToken string, tlsConfig *tls.Config) error {
+	s.connsLock.Lock()
+	stops := s.controlStops
+	s.connsLock.Unlock()
+
+	ln, err := s.controlListen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	s.connsLock.Lock()
+	if s.controlStops != stops {
+		// Stop ran while the listener was being bound and could not close it
+		s.connsLock.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.controlListener = ln
+	s.connsLock.Unlock()
+
+	s.l.WithField("controlListener", addr).WithField("tls", tlsConfig != nil).Info("Control server is listening")
+	s.serveControl(ln, token, observerToken)
+	s.l.Info("Control server stopped listening")
+	return nil
+}
+
+// serveControl accepts control connections until ln is closed
+func (s *SSHServer) serveControl(ln net.Listener, token string, observerToken string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.l.WithError(err).Warn("Error in control listener, shutting down")
+			}
+			break
+		}
+
+		s.connsLock.Lock()
+		s.controlConns[c] = struct{}{}
+		s.connsLock.Unlock()
+
+		go func() {
+			s.handleControl(c, token, observerToken)
+			s.connsLock.Lock()
+			delete(s.controlConns, c)
+			s.connsLock.Unlock()
+		}()
+	}
+
+	s.connsLock.Lock()
+	for c := range s.controlConns {
+		c.Close()
+	}
+	s.connsLock.Unlock()
+}
+
+func (s *SSHServer) handleControl(c net.Conn, token string, observerToken string) {
+	defer c.Close()
+	l := s.l.WithField("remoteAddress", c.RemoteAddr())
+
+	r := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(controlAuthTimeout))
+	given, err := r.ReadString('\n')
+	if err != nil {
+		l.WithError(err).Warn("Control client did not authenticate")
+		return
+	}
+
+	given = strings.TrimRight(given, "\r\n")
+	readOnly := false
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		if observerToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(observerToken)) != 1 {
+			l.Warn("Control client sent an invalid token")
+			_, _ = c.Write([]byte("unauthorized\n"))
+			return
+		}
+		readOnly = true
+	}
+
+	_ = c.SetReadDeadline(time.Time{})
+	l.WithField("observer", readOnly).Info("Control client authenticated")
+
+	w := &stringWriter{c}
+	for {
+		line, err := r.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			dispatchCommand(s.commands, line, w, readOnly)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestControlServer(t *testing.T) (*SSHServer, net.Listener) {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	s, err := NewSSHServer(logrus.NewEntry(l))
+	assert.Nil(t, err)
+
+	s.RegisterCommand(&Command{
+		Name:             "echo",
+		ShortDescription: "echoes the arguments",
+		ReadOnly:         true,
+		Callback: func(fs interface{}, a []string, w StringWriter) error {
+			return w.WriteLine(a[0])
+		},
+	})
+
+	s.RegisterCommand(&Command{
+		Name:             "mutate",
+		ShortDescription: "pretends to change something",
+		Callback: func(fs interface{}, a []string, w StringWriter) error {
+			return w.WriteLine("mutated")
+		},
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serveControl(ln, "secret", "observer")
+	return s, ln
+}
+
+func TestSSHServer_serveControl(t *testing.T) {
+	_, ln := newTestControlServer(t)
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	_, err = c.Write([]byte("secret\necho hello\necho \"there friend\"\n"))
+	assert.Nil(t, err)
+	c.(*net.TCPConn).CloseWrite()
+
+	b, err := io.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nthere friend\n", string(b))
+}
+
+func TestSSHServer_serveControlRejected(t *testing.T) {
+	_, ln := newTestControlServer(t)
+	defer ln.Close()
+
+	for _, token := range []string{"nope\n", "\n", "secret2\n"} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		_, err = c.Write([]byte(token))
+		assert.Nil(t, err)
+
+		b, err := io.ReadAll(c)
+		assert.Nil(t, err)
+		assert.Equal(t, "unauthorized\n", string(b))
+	}
+}
+
+func TestSSHServer_serveControlObserver(t *testing.T) {
+	_, ln := newTestControlServer(t)
+	defer ln.Close()
+
+	run := func(input string) string {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		_, err = c.Write([]byte(input))
+		assert.Nil(t, err)
+		c.(*net.TCPConn).CloseWrite()
+
+		b, err := io.ReadAll(c)
+		assert.Nil(t, err)
+		return string(b)
+	}
+
+	// Observers can only run read only commands
+	assert.Equal(t, "hello\npermission denied: mutate\n", run("observer\necho hello\nmutate\n"))
+
+	// The full token can run anything
+	assert.Equal(t, "hello\nmutated\n", run("secret\necho hello\nmutate\n"))
+}
+
+func TestSSHServer_RunControlStop(t *testing.T) {
+	s, ln := newTestControlServer(t)
+	ln.Close()
+
+	// Stop on reload races the goroutine running RunControl, run with -race
+	done := make(chan error)
+	go func() {
+		done <- s.RunControl("127.0.0.1:0", "secret", "", nil)
+	}()
+
+	assert.Eventually(t, func() bool {
+		s.connsLock.Lock()
+		defer s.connsLock.Unlock()
+		return s.controlListener != nil
+	}, time.Second, time.Millisecond)
+
+	s.Stop()
+	assert.Nil(t, <-done)
+}
+
+func TestSSHServer_RunControlStopWhileListening(t *testing.T) {
+	s, ln := newTestControlServer(t)
+	ln.Close()
+
+	// Stop runs right after RunControl started, before it stored the listener it bound
+	var bound net.Listener
+	s.controlListen = func(network, address string) (net.Listener, error) {
+		l, err := net.Listen(network, address)
+		bound = l
+		s.Stop()
+		return l, err
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.RunControl("127.0.0.1:0", "secret", "", nil)
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("RunControl kept serving after Stop")
+	}
+
+	// The listener was closed rather than leaked
+	_, err := bound.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	s.connsLock.Lock()
+	assert.Nil(t, s.controlListener)
+	s.connsLock.Unlock()
+
+	// A run started after Stop, like on reload, serves as usual
+	s.controlListen = net.Listen
+	go func() {
+		done <- s.RunControl("127.0.0.1:0", "secret", "", nil)
+	}()
+	assert.Eventually(t, func() bool {
+		s.connsLock.Lock()
+		defer s.connsLock.Unlock()
+		return s.controlListener != nil
+	}, time.Second, time.Millisecond)
+	s.Stop()
+	assert.Nil(t, <-done)
+}
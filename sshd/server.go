@@ -23,10 +23,18 @@ type SSHServer struct {
 	commands    *radix.Tree
 	listener    net.Listener
 
-	// Locks the conns/counter to avoid concurrent map access
-	connsLock sync.Mutex
-	conns     map[int]*session
-	counter   int
+	// Listener for token authenticated control connections, see RunControl. Guarded by connsLock since Stop runs on
+	// reload while RunControl may be setting it. controlStops counts the calls to Stop so RunControl can tell one ran
+	// while it was binding the listener.
+	controlListener net.Listener
+	controlStops    uint64
+	controlListen   func(network, address string) (net.Listener, error)
+
+	// Locks the conns/counter/controlListener to avoid concurrent access
+	connsLock    sync.Mutex
+	conns        map[int]*session
+	controlConns map[net.Conn]struct{}
+	counter      int
 }
 
 // NewSSHServer creates a new ssh server rigged with default commands and prepares to listen
@@ -36,6 +44,9 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 		l:           l,
 		commands:    radix.New(),
 		conns:       make(map[int]*session),
+
+		controlConns:  make(map[net.Conn]struct{}),
+		controlListen: net.Listen,
 	}
 
 	s.config = &ssh.ServerConfig{
@@ -48,6 +59,7 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 	s.RegisterCommand(&Command{
 		Name:             "help",
 		ShortDescription: "prints available commands or help <command> for specific usage info",
+		ReadOnly:         true,
 		Callback: func(a interface{}, args []string, w StringWriter) error {
 			return helpCallback(s.commands, args, w)
 		},
@@ -169,6 +181,18 @@ func (s *SSHServer) Stop() {
 			s.l.WithError(err).Warn("Failed to close the sshd listener")
 		}
 	}
+
+	s.connsLock.Lock()
+	ln := s.controlListener
+	s.controlListener = nil
+	s.controlStops++
+	s.connsLock.Unlock()
+
+	if ln != nil {
+		if err := ln.Close(); err != nil {
+			s.l.WithError(err).Warn("Failed to close the control listener")
+		}
+	}
 }
 
 func (s *SSHServer) closeSessions() {
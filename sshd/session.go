@@ -146,6 +146,12 @@ func (s *session) handleInput(channel ssh.Channel) {
 }
 
 func (s *session) dispatchCommand(line string, w StringWriter) {
+	dispatchCommand(s.commands, line, w, false)
+}
+
+// dispatchCommand parses a line of input and runs the matching command, writing any output to w. When readOnly is true
+// only commands marked ReadOnly are run.
+func dispatchCommand(commands *radix.Tree, line string, w StringWriter, readOnly bool) {
 	args, err := shlex.Split(line, true)
 	if err != nil {
 		//todo: LOG IT
@@ -153,11 +159,11 @@ func (s *session) dispatchCommand(line string, w StringWriter) {
 	}
 
 	if len(args) == 0 {
-		dumpCommands(s.commands, w)
+		dumpCommands(commands, w)
 		return
 	}
 
-	c, err := lookupCommand(s.commands, args[0])
+	c, err := lookupCommand(commands, args[0])
 	if err != nil {
 		//TODO: handle the error
 		return
@@ -168,12 +174,19 @@ func (s *session) dispatchCommand(line string, w StringWriter) {
 		//TODO: log error
 		_ = err
 
-		dumpCommands(s.commands, w)
+		dumpCommands(commands, w)
 		return
 	}
 
 	if checkHelpArgs(args) {
-		s.dispatchCommand(fmt.Sprintf("%s %s", "help", c.Name), w)
+		dispatchCommand(commands, fmt.Sprintf("%s %s", "help", c.Name), w, readOnly)
+		return
+	}
+
+	if readOnly && !c.ReadOnly {
+		err := w.WriteLine(fmt.Sprintf("permission denied: %s", c.Name))
+		//TODO: log error
+		_ = err
 		return
 	}
 
@@ -0,0 +1,57 @@
+package nebula
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// processStart is when nebula started, the startup gauges are measured from it
+var processStart = time.Now()
+
+// startupMetrics records how long after nebula started the first tunnel came up as `startup.first_tunnel_ms`, and the
+// first tunnel to each lighthouse as `startup.first_lighthouse_tunnel_ms.<vpn ip>` with the dots in the vpn ip replaced
+// by underscores. Each gauge is set once, tunnels that come up again later leave it alone.
+type startupMetrics struct {
+	sync.Mutex
+	start    time.Time
+	registry metrics.Registry
+
+	firstTunnel bool
+	lighthouses map[iputil.VpnIp]struct{}
+}
+
+func newStartupMetrics(registry metrics.Registry, start time.Time) *startupMetrics {
+	return &startupMetrics{
+		start:       start,
+		registry:    registry,
+		lighthouses: map[iputil.VpnIp]struct{}{},
+	}
+}
+
+// tunnelUp is called with the first tunnel to vpnIp, it sets the gauges that have not been set yet
+func (s *startupMetrics) tunnelUp(vpnIp iputil.VpnIp, lh *LightHouse, now time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	elapsed := now.Sub(s.start).Milliseconds()
+	if !s.firstTunnel {
+		s.firstTunnel = true
+		metrics.GetOrRegisterGauge("startup.first_tunnel_ms", s.registry).Update(elapsed)
+	}
+
+	if _, ok := s.lighthouses[vpnIp]; ok || !lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	s.lighthouses[vpnIp] = struct{}{}
+	name := "startup.first_lighthouse_tunnel_ms." + strings.ReplaceAll(vpnIp.String(), ".", "_")
+	metrics.GetOrRegisterGauge(name, s.registry).Update(elapsed)
+}
@@ -0,0 +1,63 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartupMetrics_tunnelUp(t *testing.T) {
+	l := test.NewLogger()
+	registry := metrics.NewRegistry()
+	gauge := func(name string) int64 {
+		g, ok := registry.Get(name).(metrics.Gauge)
+		if !ok {
+			return -1
+		}
+		return g.Value()
+	}
+
+	lhIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.1"))
+	lh := newTestLighthouse()
+	lh.lighthouses.Store(&map[iputil.VpnIp]struct{}{lhIp: {}})
+
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hostMap := NewHostMap(l, nil, vpncidr, nil)
+	start := time.Now().Add(-3 * time.Second)
+	f := &Interface{
+		hostMap:        hostMap,
+		lightHouse:     lh,
+		startupMetrics: newStartupMetrics(registry, start),
+		l:              l,
+	}
+
+	// Nothing is set until a tunnel comes up
+	assert.Equal(t, int64(-1), gauge("startup.first_tunnel_ms"))
+
+	// The first tunnel sets the first tunnel gauge but it is not to a lighthouse
+	vpnIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+	hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: vpnIp, localIndexId: 1, remoteIndexId: 1}, f)
+	first := gauge("startup.first_tunnel_ms")
+	assert.InDelta(t, (3 * time.Second).Milliseconds(), first, float64(time.Second.Milliseconds()))
+	assert.Equal(t, int64(-1), gauge("startup.first_lighthouse_tunnel_ms.172_1_1_1"))
+
+	// A later tunnel to the lighthouse sets its own gauge and leaves the first tunnel gauge alone
+	f.startupMetrics.start = start.Add(-time.Minute)
+	hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: lhIp, localIndexId: 2, remoteIndexId: 2}, f)
+	assert.Equal(t, first, gauge("startup.first_tunnel_ms"))
+	lhFirst := gauge("startup.first_lighthouse_tunnel_ms.172_1_1_1")
+	assert.InDelta(t, (63 * time.Second).Milliseconds(), lhFirst, float64(time.Second.Milliseconds()))
+
+	// Tunnels that come up again do not change either gauge
+	f.startupMetrics.start = start.Add(-time.Hour)
+	lhInfo := hostMap.Hosts[lhIp]
+	f.closeTunnel(lhInfo, "test")
+	hostMap.unlockedAddHostInfo(&HostInfo{vpnIp: lhIp, localIndexId: 3, remoteIndexId: 3}, f)
+	assert.Equal(t, first, gauge("startup.first_tunnel_ms"))
+	assert.Equal(t, lhFirst, gauge("startup.first_lighthouse_tunnel_ms.172_1_1_1"))
+}
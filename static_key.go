@@ -0,0 +1,183 @@
+package nebula
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+// StaticKey performs the handshake's Diffie-Hellman operations with our static private key. The private key is held in
+// memory by default, a pki.key using the pkcs11: scheme keeps it on a PKCS#11 token instead.
+type StaticKey interface {
+	// DH returns the shared secret between our static private key and pubkey
+	DH(pubkey []byte) ([]byte, error)
+}
+
+type memoryStaticKey struct {
+	dhFunc  noise.DHFunc
+	private []byte
+}
+
+func (k *memoryStaticKey) DH(pubkey []byte) ([]byte, error) {
+	return k.dhFunc.DH(k.private, pubkey)
+}
+
+// staticKeyDH sends static key operations to a StaticKey. The handshake state is given an empty private key for our
+// static keypair so any DH with an empty private key is ours, ephemeral keys are generated and used in memory as usual.
+type staticKeyDH struct {
+	noise.DHFunc
+	key StaticKey
+}
+
+func (d staticKeyDH) DH(privkey, pubkey []byte) ([]byte, error) {
+	if len(privkey) == 0 {
+		return d.key.DH(pubkey)
+	}
+	return d.DHFunc.DH(privkey, pubkey)
+}
+
+func dhFuncForCurve(curve cert.Curve) (noise.DHFunc, error) {
+	switch curve {
+	case cert.Curve_CURVE25519:
+		return noise.DH25519, nil
+	case cert.Curve_P256:
+		return noiseutil.DHP256, nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+// pkcs11Token is the part of a PKCS#11 session nebula needs, the private key object never leaves the token
+type pkcs11Token interface {
+	// PublicKey returns the public key paired with the private key object, in the same encoding as a nebula certificate
+	PublicKey() ([]byte, error)
+	// DeriveKey performs ECDH between the private key object and pubkey (CKM_ECDH1_DERIVE)
+	DeriveKey(pubkey []byte) ([]byte, error)
+}
+
+// pkcs11Open opens a session on the token described by uri and finds the private key object. openPKCS11 is only
+// implemented by builds with the pkcs11 tag and cgo, see static_key_pkcs11.go.
+var pkcs11Open = openPKCS11
+
+type pkcs11StaticKey struct {
+	token pkcs11Token
+}
+
+func (k *pkcs11StaticKey) DH(pubkey []byte) ([]byte, error) {
+	return k.token.DeriveKey(pubkey)
+}
+
+// pkcs11URI holds the attributes of an RFC 7512 PKCS#11 URI that are used to find the private key object
+type pkcs11URI struct {
+	// Token is the label of the token holding the key
+	Token string
+	// Object is the label of the private key object
+	Object string
+	// ID is the CKA_ID of the private key object
+	ID []byte
+	// ModulePath is the PKCS#11 library to load
+	ModulePath string
+	// Pin is the user pin used to log in to the token, read from PinSource if set
+	Pin       string
+	PinSource string
+}
+
+func parsePKCS11URI(raw string) (*pkcs11URI, error) {
+	rest, ok := strings.CutPrefix(raw, "pkcs11:")
+	if !ok {
+		return nil, fmt.Errorf("not a pkcs11 uri: %s", raw)
+	}
+
+	path, query, _ := strings.Cut(rest, "?")
+	u := &pkcs11URI{}
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+
+		k, v, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case "token":
+			u.Token = v
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		}
+	}
+
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+
+		k, v, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.Pin = v
+		case "pin-source":
+			u.PinSource = v
+		}
+	}
+
+	if u.Object == "" && len(u.ID) == 0 {
+		return nil, errors.New("pkcs11 uri must have an object or id attribute")
+	}
+
+	return u, nil
+}
+
+func splitPKCS11Attr(attr string) (string, string, error) {
+	k, v, ok := strings.Cut(attr, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid pkcs11 uri attribute: %s", attr)
+	}
+
+	v, err := url.PathUnescape(v)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid pkcs11 uri attribute %s: %w", k, err)
+	}
+
+	return k, v, nil
+}
+
+// newPKCS11StaticKey opens the token described by rawURI and makes sure its key pairs with nebulaCert
+func newPKCS11StaticKey(rawURI string, nebulaCert *cert.NebulaCertificate) (StaticKey, error) {
+	uri, err := parsePKCS11URI(rawURI)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := pkcs11Open(uri)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pkcs11 token: %w", err)
+	}
+
+	pub, err := token.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the public key from the pkcs11 token: %w", err)
+	}
+
+	if !bytes.Equal(pub, nebulaCert.Details.PublicKey) {
+		return nil, errors.New("pkcs11 key is not a pair with public key in nebula cert")
+	}
+
+	return &pkcs11StaticKey{token: token}, nil
+}
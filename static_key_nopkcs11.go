@@ -0,0 +1,10 @@
+//go:build !cgo || !pkcs11
+
+package nebula
+
+import "errors"
+
+// openPKCS11 refuses pkcs11: keys, building with `-tags pkcs11` and cgo enabled links a PKCS#11 library instead
+func openPKCS11(_ *pkcs11URI) (pkcs11Token, error) {
+	return nil, errors.New("pkcs11 keys are not supported by this build, it must be built with -tags pkcs11")
+}
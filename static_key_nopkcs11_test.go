@@ -0,0 +1,36 @@
+//go:build !cgo || !pkcs11
+
+package nebula
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCertStateFromConfig_pkcs11Unsupported(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	certPEM, err := newTestP256Cert(t, "host", net.IP{10, 1, 1, 1}, key.PublicKey().Bytes()).MarshalToPEM()
+	assert.NoError(t, err)
+	certPath := filepath.Join(t.TempDir(), "host.crt")
+	assert.NoError(t, os.WriteFile(certPath, certPEM, 0600))
+
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"key":  "pkcs11:object=nebula?pin-value=1234",
+		"cert": certPath,
+	}
+
+	// Builds without the pkcs11 tag refuse pkcs11 keys at load, and the pin must not end up in the error
+	_, err = newCertStateFromConfig(c)
+	assert.EqualError(t, err, "error while opening pki.key: unable to open pkcs11 token: pkcs11 keys are not supported by this build, it must be built with -tags pkcs11")
+}
@@ -0,0 +1,193 @@
+//go:build cgo && pkcs11
+
+package nebula
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// p11Token is a logged in session on a PKCS#11 token. A session must not be used concurrently so every operation holds
+// the lock.
+type p11Token struct {
+	sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	private pkcs11.ObjectHandle
+	public  pkcs11.ObjectHandle
+}
+
+func openPKCS11(uri *pkcs11URI) (pkcs11Token, error) {
+	if uri.ModulePath == "" {
+		return nil, errors.New("pkcs11 uri must have a module-path attribute")
+	}
+
+	ctx := pkcs11.New(uri.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load pkcs11 module %s", uri.ModulePath)
+	}
+
+	t, err := newP11Token(ctx, uri)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newP11Token(ctx *pkcs11.Ctx, uri *pkcs11URI) (*p11Token, error) {
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return nil, fmt.Errorf("unable to initialize pkcs11 module: %w", err)
+	}
+
+	slot, err := findP11Slot(ctx, uri.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open a pkcs11 session: %w", err)
+	}
+
+	pin := uri.Pin
+	if uri.PinSource != "" {
+		b, err := os.ReadFile(uri.PinSource)
+		if err != nil {
+			ctx.CloseSession(session)
+			return nil, fmt.Errorf("unable to read the pkcs11 pin-source: %w", err)
+		}
+		pin = strings.TrimSpace(string(b))
+	}
+
+	if pin != "" {
+		err = ctx.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			ctx.CloseSession(session)
+			return nil, fmt.Errorf("unable to log in to the pkcs11 token: %w", err)
+		}
+	}
+
+	t := &p11Token{ctx: ctx, session: session}
+	if t.private, err = t.findObject(pkcs11.CKO_PRIVATE_KEY, uri); err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+
+	if t.public, err = t.findObject(pkcs11.CKO_PUBLIC_KEY, uri); err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// findP11Slot returns the slot of the token with label, or the first slot with a token when label is empty
+func findP11Slot(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list pkcs11 slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		if label == "" {
+			return slot, nil
+		}
+
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pkcs11 token not found: %s", label)
+}
+
+func (t *p11Token) findObject(class uint, uri *pkcs11URI) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if uri.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, uri.Object))
+	}
+	if len(uri.ID) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, uri.ID))
+	}
+
+	if err := t.ctx.FindObjectsInit(t.session, template); err != nil {
+		return 0, fmt.Errorf("unable to search the pkcs11 token: %w", err)
+	}
+
+	objs, _, err := t.ctx.FindObjects(t.session, 1)
+	t.ctx.FindObjectsFinal(t.session)
+	if err != nil {
+		return 0, fmt.Errorf("unable to search the pkcs11 token: %w", err)
+	}
+
+	if len(objs) == 0 {
+		if class == pkcs11.CKO_PRIVATE_KEY {
+			return 0, errors.New("pkcs11 private key object not found")
+		}
+		return 0, errors.New("pkcs11 public key object not found")
+	}
+
+	return objs[0], nil
+}
+
+// PublicKey reads CKA_EC_POINT, a DER octet string holding the uncompressed point that nebula P256 certificates carry
+func (t *p11Token) PublicKey() ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	attrs, err := t.ctx.GetAttributeValue(t.session, t.public, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return nil, err
+	}
+
+	var point []byte
+	if _, err := asn1.Unmarshal(attrs[0].Value, &point); err != nil {
+		return nil, fmt.Errorf("invalid CKA_EC_POINT: %w", err)
+	}
+
+	return point, nil
+}
+
+// DeriveKey derives a session object with CKM_ECDH1_DERIVE, reads the shared secret out of it and destroys it
+func (t *p11Token) DeriveKey(pubkey []byte) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	mech := []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, pubkey)),
+	}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+	}
+
+	obj, err := t.ctx.DeriveKey(t.session, mech, t.private, template)
+	if err != nil {
+		return nil, err
+	}
+	defer t.ctx.DestroyObject(t.session, obj)
+
+	attrs, err := t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, err
+	}
+
+	return attrs[0].Value, nil
+}
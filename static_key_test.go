@@ -0,0 +1,166 @@
+package nebula
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockToken keeps its private key to itself like a PKCS#11 token would
+type mockToken struct {
+	key     *ecdh.PrivateKey
+	derives int
+}
+
+func (t *mockToken) PublicKey() ([]byte, error) {
+	return t.key.PublicKey().Bytes(), nil
+}
+
+func (t *mockToken) DeriveKey(pubkey []byte) ([]byte, error) {
+	t.derives++
+	pub, err := ecdh.P256().NewPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return t.key.ECDH(pub)
+}
+
+func newTestP256Cert(t *testing.T, name string, ip net.IP, pub []byte) *cert.NebulaCertificate {
+	signer, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Ips:       []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 255, 0}}},
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			Curve:     cert.Curve_P256,
+		},
+	}
+	assert.NoError(t, nc.Sign(cert.Curve_P256, signer.Bytes()))
+	return nc
+}
+
+func TestParsePKCS11URI(t *testing.T) {
+	u, err := parsePKCS11URI("pkcs11:token=nebula;object=host%20key;id=%01%02?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	assert.NoError(t, err)
+	assert.Equal(t, &pkcs11URI{
+		Token:      "nebula",
+		Object:     "host key",
+		ID:         []byte{1, 2},
+		ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+		Pin:        "1234",
+	}, u)
+
+	_, err = parsePKCS11URI("pkcs11:token=nebula")
+	assert.EqualError(t, err, "pkcs11 uri must have an object or id attribute")
+
+	_, err = parsePKCS11URI("pkcs11:object")
+	assert.EqualError(t, err, "invalid pkcs11 uri attribute: object")
+
+	_, err = parsePKCS11URI("pkcs11:object=%zz")
+	assert.EqualError(t, err, "invalid pkcs11 uri attribute object: invalid URL escape \"%zz\"")
+}
+
+func TestNewCertStateFromConfig_pkcs11(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	token := &mockToken{key: key}
+
+	nc := newTestP256Cert(t, "host", net.IP{10, 1, 1, 1}, key.PublicKey().Bytes())
+	certPEM, err := nc.MarshalToPEM()
+	assert.NoError(t, err)
+
+	certPath := filepath.Join(t.TempDir(), "host.crt")
+	assert.NoError(t, os.WriteFile(certPath, certPEM, 0600))
+
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"key":  "pkcs11:object=nebula?pin-value=1234",
+		"cert": certPath,
+	}
+
+	defer func(open func(*pkcs11URI) (pkcs11Token, error)) { pkcs11Open = open }(pkcs11Open)
+	var opened *pkcs11URI
+	pkcs11Open = func(uri *pkcs11URI) (pkcs11Token, error) {
+		opened = uri
+		return token, nil
+	}
+
+	cs, err := newCertStateFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "nebula", opened.Object)
+	assert.Equal(t, "1234", opened.Pin)
+	assert.Nil(t, cs.PrivateKey)
+	assert.Equal(t, &pkcs11StaticKey{token: token}, cs.StaticKey)
+
+	// The token key must pair with the certificate
+	other, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	token.key = other
+	_, err = newCertStateFromConfig(c)
+	assert.EqualError(t, err, "error while opening pki.key: pkcs11 key is not a pair with public key in nebula cert")
+}
+
+func TestNewConnectionState_pkcs11Handshake(t *testing.T) {
+	l := test.NewLogger()
+
+	// The initiator only has the token
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	token := &mockToken{key: key}
+	ics, err := newCertState(
+		newTestP256Cert(t, "initiator", net.IP{10, 1, 1, 1}, key.PublicKey().Bytes()),
+		&pkcs11StaticKey{token: token},
+		nil,
+	)
+	assert.NoError(t, err)
+
+	// The responder holds its key in memory
+	rkey, err := ecdh.P256().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rcs, err := newCertState(
+		newTestP256Cert(t, "responder", net.IP{10, 1, 1, 2}, rkey.PublicKey().Bytes()),
+		&memoryStaticKey{dhFunc: noiseutil.DHP256, private: rkey.Bytes()},
+		rkey.Bytes(),
+	)
+	assert.NoError(t, err)
+
+	ci := NewConnectionState(l, nil, "aes", ics, true, noise.HandshakeIX, []byte{}, 0, ReplayWindow)
+	cr := NewConnectionState(l, nil, "aes", rcs, false, noise.HandshakeIX, []byte{}, 0, ReplayWindow)
+
+	msg, _, _, err := ci.H.WriteMessage(nil, nil)
+	assert.NoError(t, err)
+	_, _, _, err = cr.H.ReadMessage(nil, msg)
+	assert.NoError(t, err)
+
+	msg, rEnc, _, err := cr.H.WriteMessage(nil, nil)
+	assert.NoError(t, err)
+	_, iEnc, _, err := ci.H.ReadMessage(nil, msg)
+	assert.NoError(t, err)
+
+	// IX uses our static key for se on the initiator side, that has to have gone through the token
+	assert.Equal(t, 1, token.derives)
+	assert.Equal(t, ics.PublicKey, cr.H.PeerStatic())
+
+	out, err := iEnc.Encrypt(nil, nil, []byte("hello"))
+	assert.NoError(t, err)
+	plain, err := rEnc.Decrypt(nil, nil, out)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain)
+}
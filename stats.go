@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	graphite "github.com/cyberdelia/go-metrics-graphite"
@@ -17,6 +18,7 @@ import (
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
 )
 
 // startStats initializes stats from config. On success, if any further work
@@ -50,11 +52,12 @@ func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest b
 		return nil, fmt.Errorf("stats.type was not understood: %s", mType)
 	}
 
-	metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
-	metrics.RegisterRuntimeMemStats(metrics.DefaultRegistry)
+	registry := util.MetricsRegistry(c)
+	metrics.RegisterDebugGCStats(registry)
+	metrics.RegisterRuntimeMemStats(registry)
 
-	go metrics.CaptureDebugGCStats(metrics.DefaultRegistry, interval)
-	go metrics.CaptureRuntimeMemStats(metrics.DefaultRegistry, interval)
+	go metrics.CaptureDebugGCStats(registry, interval)
+	go metrics.CaptureRuntimeMemStats(registry, interval)
 
 	return startFn, nil
 }
@@ -67,6 +70,9 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *config.C, configTe
 	}
 
 	prefix := c.GetString("stats.prefix", "nebula")
+	if name := util.OverlayName(c); name != "" {
+		prefix += "." + name
+	}
 	addr, err := net.ResolveTCPAddr(proto, host)
 	if err != nil {
 		return fmt.Errorf("error while setting up graphite sink: %s", err)
@@ -74,7 +80,7 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *config.C, configTe
 
 	if !configTest {
 		l.Infof("Starting graphite. Interval: %s, prefix: %s, addr: %s", i, prefix, addr)
-		go graphite.Graphite(metrics.DefaultRegistry, i, prefix, addr)
+		go graphite.Graphite(util.MetricsRegistry(c), i, prefix, addr)
 	}
 	return nil
 }
@@ -93,10 +99,35 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildV
 		return nil, fmt.Errorf("stats.path should not be empty")
 	}
 
+	// Overlays in the same process can share a listener, the metrics of a named overlay carry an overlay label
+	var pl *prometheusListener
 	pr := prometheus.NewRegistry()
-	pClient := mp.NewPrometheusProvider(metrics.DefaultRegistry, namespace, subsystem, pr, i)
+	if !configTest {
+		pl = getPrometheusListener(listen)
+		pr = pl.registry
+	}
+
+	pClient, err := registerPrometheusStats(c, pr, namespace, subsystem, buildVersion, i)
+	if err != nil {
+		return nil, fmt.Errorf("stats.listen %s is shared with another overlay, each one needs a unique overlay.name: %w", listen, err)
+	}
+
+	var startFn func()
 	if !configTest {
 		go pClient.UpdatePrometheusMetrics()
+		startFn = func() {
+			pl.serve(l, listen, path)
+		}
+	}
+
+	return startFn, nil
+}
+
+// registerPrometheusStats exports the metrics of the overlay in c and our version information to pr, the metrics of a
+// named overlay carry an overlay label with its name
+func registerPrometheusStats(c *config.C, pr prometheus.Registerer, namespace, subsystem, buildVersion string, i time.Duration) (*mp.PrometheusConfig, error) {
+	if name := util.OverlayName(c); name != "" {
+		pr = prometheus.WrapRegistererWith(prometheus.Labels{"overlay": name}, pr)
 	}
 
 	// Export our version information as labels on a static gauge
@@ -111,17 +142,57 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *config.C, buildV
 			"boringcrypto": strconv.FormatBool(boringEnabled()),
 		},
 	})
-	pr.MustRegister(g)
+	if err := pr.Register(g); err != nil {
+		return nil, err
+	}
 	g.Set(1)
 
-	var startFn func()
-	if !configTest {
-		startFn = func() {
-			l.Infof("Prometheus stats listening on %s at %s", listen, path)
-			http.Handle(path, promhttp.HandlerFor(pr, promhttp.HandlerOpts{ErrorLog: l}))
-			log.Fatal(http.ListenAndServe(listen, nil))
+	return mp.NewPrometheusProvider(util.MetricsRegistry(c), namespace, subsystem, pr, i), nil
+}
+
+// prometheusListeners holds a listener for every stats.listen in use, so overlays in the same process can share one
+var prometheusListeners = struct {
+	sync.Mutex
+	m map[string]*prometheusListener
+}{m: map[string]*prometheusListener{}}
+
+type prometheusListener struct {
+	sync.Mutex
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+	paths    map[string]struct{}
+	started  bool
+}
+
+func getPrometheusListener(listen string) *prometheusListener {
+	prometheusListeners.Lock()
+	defer prometheusListeners.Unlock()
+
+	pl, ok := prometheusListeners.m[listen]
+	if !ok {
+		pl = &prometheusListener{
+			registry: prometheus.NewRegistry(),
+			mux:      http.NewServeMux(),
+			paths:    map[string]struct{}{},
 		}
+		prometheusListeners.m[listen] = pl
 	}
+	return pl
+}
 
-	return startFn, nil
+// serve adds path to the listener and blocks serving it, only the first overlay to call serve on a listener opens it
+func (pl *prometheusListener) serve(l *logrus.Logger, listen, path string) {
+	pl.Lock()
+	if _, ok := pl.paths[path]; !ok {
+		pl.mux.Handle(path, promhttp.HandlerFor(pl.registry, promhttp.HandlerOpts{ErrorLog: l}))
+		pl.paths[path] = struct{}{}
+	}
+	started := pl.started
+	pl.started = true
+	pl.Unlock()
+
+	l.Infof("Prometheus stats listening on %s at %s", listen, path)
+	if !started {
+		log.Fatal(http.ListenAndServe(listen, pl.mux))
+	}
 }
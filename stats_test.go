@@ -0,0 +1,71 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_registerPrometheusStats(t *testing.T) {
+	l := test.NewLogger()
+	newOverlay := func(name string) *config.C {
+		c := config.NewC(l)
+		c.Settings["overlay"] = map[interface{}]interface{}{"name": name}
+		return c
+	}
+
+	ca := newOverlay("stats-test-a")
+	cb := newOverlay("stats-test-b")
+	require.NotSame(t, util.MetricsRegistry(ca), util.MetricsRegistry(cb))
+	assert.Same(t, util.MetricsRegistry(ca), util.MetricsRegistry(newOverlay("stats-test-a")))
+
+	// Each overlay counts its own handshakes
+	newInitiatorHandshakeMetrics(util.MetricsRegistry(ca)).completed.Inc(2)
+	newInitiatorHandshakeMetrics(util.MetricsRegistry(cb)).completed.Inc(5)
+
+	pr := prometheus.NewRegistry()
+	pa, err := registerPrometheusStats(ca, pr, "nebula", "", "1.2.3", time.Second)
+	require.NoError(t, err)
+	pb, err := registerPrometheusStats(cb, pr, "nebula", "", "1.2.3", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, pa.UpdatePrometheusMetricsOnce())
+	require.NoError(t, pb.UpdatePrometheusMetricsOnce())
+
+	families, err := pr.Gather()
+	require.NoError(t, err)
+
+	completed := map[string]float64{}
+	infos := 0
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var overlay string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "overlay" {
+					overlay = lp.GetValue()
+				}
+			}
+
+			switch mf.GetName() {
+			case "nebula_handshakes_initiator_completed":
+				completed[overlay] = m.GetGauge().GetValue()
+			case "nebula_info":
+				assert.NotEmpty(t, overlay)
+				infos++
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"stats-test-a": 2, "stats-test-b": 5}, completed)
+	assert.Equal(t, 2, infos)
+
+	// Overlays without a name can not share a prometheus registry
+	_, err = registerPrometheusStats(config.NewC(l), pr, "nebula", "", "1.2.3", time.Second)
+	assert.Error(t, err)
+	_, err = registerPrometheusStats(newOverlay("stats-test-a"), pr, "nebula", "", "1.2.3", time.Second)
+	assert.Error(t, err)
+}
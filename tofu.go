@@ -0,0 +1,192 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"gopkg.in/yaml.v2"
+)
+
+// tofuStore remembers the certificate fingerprint of the first completed handshake with each vpn ip, handshakes for
+// that vpn ip must present the same certificate from then on. What it learns is saved to pki.tofu.path so it survives a
+// restart.
+type tofuStore struct {
+	sync.Mutex
+	path         string
+	fingerprints map[iputil.VpnIp]string
+	l            *logrus.Logger
+
+	// saveLock orders the writes to path so an older snapshot never replaces a newer one. pending is set when there is
+	// something to save and saving while a goroutine is writing, learning a burst of fingerprints is saved in a few
+	// writes instead of one each.
+	saveLock sync.Mutex
+	pending  atomic.Bool
+	saving   atomic.Bool
+}
+
+// newTofuStoreFromConfig loads the fingerprints learned so far from pki.tofu.path, nil is returned if it is not set
+func newTofuStoreFromConfig(l *logrus.Logger, c *config.C) (*tofuStore, error) {
+	path := c.GetString("pki.tofu.path", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	t := &tofuStore{
+		path:         path,
+		fingerprints: map[iputil.VpnIp]string{},
+		l:            l,
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pki.tofu.path file %s: %s", path, err)
+	}
+
+	var saved map[string]string
+	if err := yaml.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("unable to parse pki.tofu.path file %s: %s", path, err)
+	}
+
+	for k, fingerprint := range saved {
+		ip := net.ParseIP(k)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("pki.tofu.path file %s has an invalid vpn ip: %v", path, k)
+		}
+		t.fingerprints[iputil.Ip2VpnIp(ip)] = fingerprint
+	}
+
+	l.WithField("path", path).WithField("hosts", len(t.fingerprints)).Info("Loaded fingerprints learned on first use")
+	return t, nil
+}
+
+// check returns true if fingerprint may be used by vpnIp, which is when nothing was learned for vpnIp yet or it matches
+// what was. The learned fingerprint is returned. A nil store allows everything.
+func (t *tofuStore) check(vpnIp iputil.VpnIp, fingerprint string) (string, bool) {
+	if t == nil {
+		return "", true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if learned, ok := t.fingerprints[vpnIp]; ok {
+		return learned, learned == fingerprint
+	}
+
+	return fingerprint, true
+}
+
+// learn pins fingerprint for vpnIp once a handshake with it has completed and saves it in the background. If another
+// handshake pinned a different fingerprint first that one is kept, false and the learned fingerprint are returned. A
+// nil store allows everything.
+func (t *tofuStore) learn(vpnIp iputil.VpnIp, fingerprint string) (string, bool) {
+	if t == nil {
+		return "", true
+	}
+
+	t.Lock()
+	if learned, ok := t.fingerprints[vpnIp]; ok {
+		t.Unlock()
+		return learned, learned == fingerprint
+	}
+
+	t.fingerprints[vpnIp] = fingerprint
+	t.Unlock()
+
+	t.l.WithField("vpnIp", vpnIp).WithField("fingerprint", fingerprint).Info("Learned certificate fingerprint on first use")
+	t.saveAsync()
+	return fingerprint, true
+}
+
+// clear forgets the fingerprint learned for vpnIp so the next certificate it presents is learned instead. Returns
+// false if nothing was learned for vpnIp.
+func (t *tofuStore) clear(vpnIp iputil.VpnIp) (bool, error) {
+	if t == nil {
+		return false, errors.New("pki.tofu.path is not set")
+	}
+
+	t.Lock()
+	learned, ok := t.fingerprints[vpnIp]
+	if !ok {
+		t.Unlock()
+		return false, nil
+	}
+
+	delete(t.fingerprints, vpnIp)
+	t.Unlock()
+
+	if err := t.save(); err != nil {
+		// Put it back unless a handshake learned a new one in the meantime
+		t.Lock()
+		if _, ok := t.fingerprints[vpnIp]; !ok {
+			t.fingerprints[vpnIp] = learned
+		}
+		t.Unlock()
+		return false, err
+	}
+
+	t.l.WithField("vpnIp", vpnIp).WithField("fingerprint", learned).Info("Cleared certificate fingerprint learned on first use")
+	return true, nil
+}
+
+// saveAsync saves the learned fingerprints from a background goroutine, a save that is asked for while one is already
+// running is picked up by that goroutine
+func (t *tofuStore) saveAsync() {
+	t.pending.Store(true)
+	if !t.saving.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		for {
+			for t.pending.Swap(false) {
+				if err := t.save(); err != nil {
+					// The fingerprints are still enforced until we restart
+					t.l.WithError(err).WithField("path", t.path).Error("Could not save the fingerprints learned on first use")
+				}
+			}
+
+			t.saving.Store(false)
+			// A save asked for between the last check and now would otherwise be lost
+			if !t.pending.Load() || !t.saving.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+// save writes every learned fingerprint to a temporary file that replaces pki.tofu.path, so a crash never leaves it
+// half written. The fingerprints are copied under the lock but written without it, handshakes are not held up by disk.
+func (t *tofuStore) save() error {
+	t.saveLock.Lock()
+	defer t.saveLock.Unlock()
+
+	t.Lock()
+	saved := make(map[string]string, len(t.fingerprints))
+	for vpnIp, fingerprint := range t.fingerprints {
+		saved[vpnIp.String()] = fingerprint
+	}
+	t.Unlock()
+
+	b, err := yaml.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.path)
+}
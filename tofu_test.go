@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTofuStore(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "tofu.yml")
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"tofu": map[interface{}]interface{}{"path": path}}
+
+	vpnIp := iputil.Ip2VpnIp(net.ParseIP("10.1.1.1"))
+	otherIp := iputil.Ip2VpnIp(net.ParseIP("10.1.1.2"))
+
+	ts, err := newTofuStoreFromConfig(l, c)
+	assert.NoError(t, err)
+
+	// Nothing is learned until a handshake completes
+	learned, ok := ts.check(vpnIp, "aa")
+	assert.True(t, ok)
+	assert.Equal(t, "aa", learned)
+	_, ok = ts.check(vpnIp, "bb")
+	assert.True(t, ok)
+
+	// The first completed handshake pins its fingerprint
+	learned, ok = ts.learn(vpnIp, "aa")
+	assert.True(t, ok)
+	assert.Equal(t, "aa", learned)
+	learned, ok = ts.check(vpnIp, "aa")
+	assert.True(t, ok)
+	assert.Equal(t, "aa", learned)
+
+	// A different one is refused and the learned one is returned, also when it raced the first one to complete
+	learned, ok = ts.check(vpnIp, "bb")
+	assert.False(t, ok)
+	assert.Equal(t, "aa", learned)
+	learned, ok = ts.learn(vpnIp, "bb")
+	assert.False(t, ok)
+	assert.Equal(t, "aa", learned)
+
+	// Every vpn ip learns its own
+	_, ok = ts.learn(otherIp, "bb")
+	assert.True(t, ok)
+
+	// What was learned is saved in the background and survives a restart
+	waitTofuSaved(t, ts)
+	ts, err = newTofuStoreFromConfig(l, c)
+	assert.NoError(t, err)
+	_, ok = ts.check(vpnIp, "bb")
+	assert.False(t, ok)
+	_, ok = ts.check(otherIp, "bb")
+	assert.True(t, ok)
+
+	// Clearing forgets the fingerprint so the next one is learned, also after a restart
+	cleared, err := ts.clear(vpnIp)
+	assert.NoError(t, err)
+	assert.True(t, cleared)
+	cleared, err = ts.clear(vpnIp)
+	assert.NoError(t, err)
+	assert.False(t, cleared)
+
+	ts, err = newTofuStoreFromConfig(l, c)
+	assert.NoError(t, err)
+	learned, ok = ts.learn(vpnIp, "bb")
+	assert.True(t, ok)
+	assert.Equal(t, "bb", learned)
+	_, ok = ts.check(vpnIp, "aa")
+	assert.False(t, ok)
+	waitTofuSaved(t, ts)
+
+	// A broken file is an error
+	assert.NoError(t, os.WriteFile(path, []byte("nope: aa"), 0600))
+	_, err = newTofuStoreFromConfig(l, c)
+	assert.EqualError(t, err, "pki.tofu.path file "+path+" has an invalid vpn ip: nope")
+
+	// Without pki.tofu.path everything is allowed and there is nothing to clear
+	ts, err = newTofuStoreFromConfig(l, config.NewC(l))
+	assert.NoError(t, err)
+	assert.Nil(t, ts)
+	_, ok = ts.check(vpnIp, "cc")
+	assert.True(t, ok)
+	_, ok = ts.learn(vpnIp, "cc")
+	assert.True(t, ok)
+	_, err = ts.clear(vpnIp)
+	assert.EqualError(t, err, "pki.tofu.path is not set")
+}
+
+func TestTofuStore_saveBatched(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "tofu.yml")
+	c := config.NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"tofu": map[interface{}]interface{}{"path": path}}
+
+	ts, err := newTofuStoreFromConfig(l, c)
+	assert.NoError(t, err)
+
+	// Every fingerprint learned in a burst ends up saved
+	for i := 1; i <= 100; i++ {
+		_, ok := ts.learn(iputil.Ip2VpnIp(net.IPv4(10, 1, 1, byte(i))), "aa")
+		assert.True(t, ok)
+	}
+	waitTofuSaved(t, ts)
+
+	ts, err = newTofuStoreFromConfig(l, c)
+	assert.NoError(t, err)
+	assert.Len(t, ts.fingerprints, 100)
+}
+
+// waitTofuSaved waits for the background save of what ts learned to finish
+func waitTofuSaved(t *testing.T, ts *tofuStore) {
+	assert.Eventually(t, func() bool {
+		return !ts.pending.Load() && !ts.saving.Load()
+	}, time.Second, time.Millisecond)
+}
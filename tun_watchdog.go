@@ -0,0 +1,326 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/util"
+)
+
+// tunWatchdogMaxBackoff is the longest the watchdog waits before recreating the device
+const tunWatchdogMaxBackoff = time.Minute
+
+// tunWatchdog recreates the tun device once reading from or writing to it failed tun.watchdog.errors times in a row,
+// which happens when the device is stuck in an error state, for example after the interface flapped. The wait before
+// each recreate doubles for every recreate within tun.watchdog.window. Once max_recreates is used up within the
+// window it gives up and the error is returned, which stops nebula instead of recreating the device in a loop.
+type tunWatchdog struct {
+	sync.Mutex
+	l      *logrus.Logger
+	device overlay.Recreator
+	queues []*watchedTunQueue
+
+	threshold    int64
+	backoff      time.Duration
+	maxRecreates int
+	window       time.Duration
+
+	// errors counts the failed reads and writes since the last one that worked
+	errors atomic.Int64
+	// generation is bumped every time the device is recreated, an error seen on an older generation is stale
+	generation atomic.Uint64
+	closed     atomic.Bool
+	recreates  []time.Time
+	// failed is set once the watchdog gave up, every queue returns it from then on
+	failed error
+	// recreating is closed once the running recreate is done, nil while none is running
+	recreating chan struct{}
+
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	metricRecreated metrics.Counter
+}
+
+// newTunWatchdogFromConfig returns nil unless tun.watchdog.enabled is set and the device can be recreated
+func newTunWatchdogFromConfig(l *logrus.Logger, c *config.C, device overlay.Device, fromFd bool) (*tunWatchdog, error) {
+	if !c.GetBool("tun.watchdog.enabled", false) {
+		return nil, nil
+	}
+
+	threshold := c.GetInt("tun.watchdog.errors", 10)
+	if threshold < 1 {
+		return nil, fmt.Errorf("tun.watchdog.errors must be at least 1: %v", threshold)
+	}
+
+	backoff := c.GetDuration("tun.watchdog.backoff", time.Second)
+	if backoff <= 0 {
+		return nil, fmt.Errorf("tun.watchdog.backoff must be greater than 0: %v", backoff)
+	}
+
+	maxRecreates := c.GetInt("tun.watchdog.max_recreates", 3)
+	if maxRecreates < 1 {
+		return nil, fmt.Errorf("tun.watchdog.max_recreates must be at least 1: %v", maxRecreates)
+	}
+
+	window := c.GetDuration("tun.watchdog.window", 10*time.Minute)
+	if window <= 0 {
+		return nil, fmt.Errorf("tun.watchdog.window must be greater than 0: %v", window)
+	}
+
+	if device == nil {
+		// Only testing the config
+		return nil, nil
+	}
+
+	r, ok := device.(overlay.Recreator)
+	if !ok || fromFd {
+		l.Warnf("tun.watchdog is not supported in %s or for a tun device passed in as a file descriptor and will be ignored", runtime.GOOS)
+		return nil, nil
+	}
+
+	return newTunWatchdog(l, util.MetricsRegistry(c), r, threshold, backoff, maxRecreates, window), nil
+}
+
+func newTunWatchdog(l *logrus.Logger, registry metrics.Registry, device overlay.Recreator, threshold int, backoff time.Duration, maxRecreates int, window time.Duration) *tunWatchdog {
+	return &tunWatchdog{
+		l:               l,
+		device:          device,
+		threshold:       int64(threshold),
+		backoff:         backoff,
+		maxRecreates:    maxRecreates,
+		window:          window,
+		now:             time.Now,
+		sleep:           time.Sleep,
+		metricRecreated: metrics.GetOrRegisterCounter("tun_recreated", registry),
+	}
+}
+
+// wrap returns rwc watched for errors, or rwc itself if there is no watchdog. It must be called for the device and
+// each of its multiqueue readers in order.
+func (w *tunWatchdog) wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if w == nil {
+		return rwc
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	q := &watchedTunQueue{w: w}
+	q.rwc.Store(&tunQueue{rwc})
+	w.queues = append(w.queues, q)
+	return q
+}
+
+// close stops the watchdog, errors from the device being closed are returned as they are
+func (w *tunWatchdog) close() {
+	if w == nil {
+		return
+	}
+
+	w.closed.Store(true)
+}
+
+// fatal records err, returned by the device of generation, and starts recreating the device in the background if it
+// failed too many times in a row. Readers wait for the recreate to finish, writers are called from the udp readers
+// and return right away so the packet is dropped instead. A nil return means the operation can be tried again on the
+// current queue, otherwise the error must be returned.
+func (w *tunWatchdog) fatal(generation uint64, err error, wait bool) error {
+	if w.closed.Load() {
+		return err
+	}
+
+	w.Lock()
+	if w.failed != nil {
+		w.Unlock()
+		return w.failed
+	}
+
+	if w.generation.Load() != generation {
+		// The device was recreated since
+		w.Unlock()
+		return nil
+	}
+
+	if w.recreating == nil {
+		if w.errors.Add(1) < w.threshold {
+			w.Unlock()
+			return nil
+		}
+
+		w.recreating = make(chan struct{})
+		go w.recreateLoop(err, w.recreating)
+	}
+	done := w.recreating
+	w.Unlock()
+
+	if !wait {
+		return err
+	}
+
+	<-done
+	if w.closed.Load() {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	return w.failed
+}
+
+// recreateLoop waits out the backoff and recreates the device until that works or max_recreates is used up, then
+// closes done. The lock is only held to update the state so fatal never blocks on it for long.
+func (w *tunWatchdog) recreateLoop(err error, done chan struct{}) {
+	defer func() {
+		w.Lock()
+		w.recreating = nil
+		w.Unlock()
+		close(done)
+	}()
+
+	for {
+		w.Lock()
+		now := w.now()
+		recent := w.recreates[:0]
+		for _, t := range w.recreates {
+			if now.Sub(t) < w.window {
+				recent = append(recent, t)
+			}
+		}
+		w.recreates = recent
+
+		if len(w.recreates) >= w.maxRecreates {
+			w.failed = fmt.Errorf("tun device recreated %v times within %v and still failing: %w", len(w.recreates), w.window, err)
+			w.l.WithError(err).WithField("recreates", len(w.recreates)).WithField("window", w.window).
+				Error("Giving up on the tun device")
+			w.Unlock()
+			return
+		}
+
+		backoff := w.backoff << len(w.recreates)
+		if backoff > tunWatchdogMaxBackoff {
+			backoff = tunWatchdogMaxBackoff
+		}
+		w.Unlock()
+
+		w.l.WithError(err).WithField("errors", w.errors.Load()).WithField("backoff", backoff).
+			Warn("Tun device is failing, recreating it")
+		w.sleep(backoff)
+		if w.closed.Load() {
+			return
+		}
+
+		w.Lock()
+		w.recreates = append(w.recreates, w.now())
+		queues := w.queues
+		w.Unlock()
+
+		err = w.recreate(queues)
+		if err == nil {
+			return
+		}
+
+		w.l.WithError(err).Error("Failed to recreate the tun device")
+	}
+}
+
+// recreate replaces the device and every queue with new ones
+func (w *tunWatchdog) recreate(queues []*watchedTunQueue) error {
+	// The device itself is closed by Recreate
+	for _, q := range queues[1:] {
+		q.current().Close()
+	}
+
+	rwcs, err := w.device.Recreate(len(queues))
+	if err != nil {
+		return err
+	}
+
+	for i, q := range queues {
+		q.rwc.Store(&tunQueue{rwcs[i]})
+	}
+
+	w.generation.Add(1)
+	w.errors.Store(0)
+	w.metricRecreated.Inc(1)
+	w.l.Info("Recreated the tun device")
+	return nil
+}
+
+// ok resets the error count after an operation worked
+func (w *tunWatchdog) ok() {
+	if w.errors.Load() != 0 {
+		w.errors.Store(0)
+	}
+}
+
+type tunQueue struct {
+	io.ReadWriteCloser
+}
+
+// watchedTunQueue is a queue of the tun device that reports its errors to the watchdog and is swapped for the new
+// queue when the device is recreated
+type watchedTunQueue struct {
+	w   *tunWatchdog
+	rwc atomic.Pointer[tunQueue]
+}
+
+func (q *watchedTunQueue) current() io.ReadWriteCloser {
+	return q.rwc.Load().ReadWriteCloser
+}
+
+// Read only returns an error once the watchdog gave up on the device or it was closed
+func (q *watchedTunQueue) Read(p []byte) (int, error) {
+	for {
+		generation := q.w.generation.Load()
+		n, err := q.current().Read(p)
+		if err == nil {
+			q.w.ok()
+			return n, nil
+		}
+
+		if err = q.w.fatal(generation, err, true); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Write drops the packet when it fails, only errors that point at a broken device count towards recreating it. It
+// never waits for a recreate, packets written in the meantime fail.
+func (q *watchedTunQueue) Write(p []byte) (int, error) {
+	generation := q.w.generation.Load()
+	n, err := q.current().Write(p)
+	if err == nil {
+		q.w.ok()
+		return n, nil
+	}
+
+	if !isFatalTunErr(err) {
+		return n, err
+	}
+
+	if ferr := q.w.fatal(generation, err, false); ferr != nil {
+		return n, ferr
+	}
+	return n, err
+}
+
+func (q *watchedTunQueue) Close() error {
+	return q.current().Close()
+}
+
+// isFatalTunErr returns true for write errors that mean the device itself is broken rather than the packet
+func isFatalTunErr(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO)
+}
@@ -0,0 +1,231 @@
+package nebula
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenTunQueue fails every read and write with err once broken
+type brokenTunQueue struct {
+	err    error
+	closed bool
+}
+
+func (q *brokenTunQueue) Read(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, &os.PathError{Op: "read", Path: "/dev/net/tun", Err: q.err}
+	}
+	return copy(p, "hello"), nil
+}
+
+func (q *brokenTunQueue) Write(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, &os.PathError{Op: "write", Path: "/dev/net/tun", Err: q.err}
+	}
+	return len(p), nil
+}
+
+func (q *brokenTunQueue) Close() error {
+	q.closed = true
+	return nil
+}
+
+// recreatableTun hands out working queues when recreated, unless recreateErr is set
+type recreatableTun struct {
+	overlay.Device
+	recreates   int
+	recreateErr error
+	queues      []*brokenTunQueue
+}
+
+func (t *recreatableTun) Recreate(queues int) ([]io.ReadWriteCloser, error) {
+	t.recreates++
+	if t.recreateErr != nil {
+		return nil, t.recreateErr
+	}
+
+	t.queues = t.queues[:0]
+	rwcs := make([]io.ReadWriteCloser, queues)
+	for i := range rwcs {
+		q := &brokenTunQueue{}
+		t.queues = append(t.queues, q)
+		rwcs[i] = q
+	}
+	return rwcs, nil
+}
+
+func newTestTunWatchdog(device overlay.Recreator) (*tunWatchdog, *[]time.Duration) {
+	w := newTunWatchdog(test.NewLogger(), metrics.NewRegistry(), device, 3, time.Second, 2, 10*time.Minute)
+	var sleeps []time.Duration
+	w.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return w, &sleeps
+}
+
+func Test_newTunWatchdogFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	device := &recreatableTun{}
+
+	w, err := newTunWatchdogFromConfig(l, c, device, false)
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	// A nil watchdog leaves the device alone
+	q := &brokenTunQueue{}
+	assert.Equal(t, q, w.wrap(q))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"watchdog": map[interface{}]interface{}{"enabled": true}}
+	w, err = newTunWatchdogFromConfig(l, c, device, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), w.threshold)
+	assert.Equal(t, time.Second, w.backoff)
+	assert.Equal(t, 3, w.maxRecreates)
+	assert.Equal(t, 10*time.Minute, w.window)
+
+	// A device passed in as a file descriptor can not be recreated
+	w, err = newTunWatchdogFromConfig(l, c, device, true)
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"watchdog": map[interface{}]interface{}{"enabled": true, "errors": 0}}
+	_, err = newTunWatchdogFromConfig(l, c, device, false)
+	assert.EqualError(t, err, "tun.watchdog.errors must be at least 1: 0")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"watchdog": map[interface{}]interface{}{"enabled": true, "max_recreates": 0}}
+	_, err = newTunWatchdogFromConfig(l, c, device, false)
+	assert.EqualError(t, err, "tun.watchdog.max_recreates must be at least 1: 0")
+}
+
+func TestTunWatchdog_recreate(t *testing.T) {
+	device := &recreatableTun{}
+	w, sleeps := newTestTunWatchdog(device)
+	old := []*brokenTunQueue{{}, {}}
+	readers := []io.ReadWriteCloser{w.wrap(old[0]), w.wrap(old[1])}
+
+	// Some failed writes in a row that the device recovers from are not enough
+	old[0].err = syscall.EIO
+	for i := 0; i < 2; i++ {
+		_, err := readers[0].Write([]byte("hello"))
+		assert.True(t, errors.Is(err, syscall.EIO))
+	}
+	old[0].err = nil
+	_, err := readers[0].Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, device.recreates)
+
+	// Errors that are about the packet do not count
+	old[0].err = syscall.EINVAL
+	for i := 0; i < 5; i++ {
+		_, err := readers[0].Write([]byte("hello"))
+		assert.True(t, errors.Is(err, syscall.EINVAL))
+	}
+	assert.Equal(t, 0, device.recreates)
+
+	// A read that keeps failing recreates the device once and then reads from the new one
+	old[0].err = syscall.EBADF
+	old[1].err = syscall.EBADF
+	p := make([]byte, 10)
+	n, err := readers[0].Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(p[:n]))
+	assert.Equal(t, 1, device.recreates)
+	assert.Equal(t, []time.Duration{time.Second}, *sleeps)
+	assert.Equal(t, int64(1), w.metricRecreated.Count())
+	assert.True(t, old[1].closed, "the old multiqueue reader should be closed")
+
+	// The other queue uses its new queue as well, without another recreate
+	n, err = readers[1].Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = readers[1].Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, device.recreates)
+}
+
+func TestTunWatchdog_crashLoop(t *testing.T) {
+	device := &recreatableTun{}
+	w, sleeps := newTestTunWatchdog(device)
+	now := time.Now()
+	w.now = func() time.Time { return now }
+	reader := w.wrap(&brokenTunQueue{err: syscall.EIO})
+
+	// The device keeps failing after it was recreated, the backoff doubles each time
+	p := make([]byte, 10)
+	_, err := reader.Read(p)
+	require.NoError(t, err)
+	device.queues[0].err = syscall.EIO
+	_, err = reader.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *sleeps)
+
+	// max_recreates are used up within the window, the watchdog gives up
+	device.queues[0].err = syscall.EIO
+	_, err = reader.Read(p)
+	assert.EqualError(t, err, "tun device recreated 2 times within 10m0s and still failing: read /dev/net/tun: input/output error")
+	assert.Equal(t, 2, device.recreates)
+	_, err = reader.Write([]byte("hello"))
+	assert.Equal(t, w.failed, err)
+
+	// A device that can not be recreated uses up the recreates as well
+	device = &recreatableTun{recreateErr: errors.New("no such device")}
+	w, _ = newTestTunWatchdog(device)
+	_, err = w.wrap(&brokenTunQueue{err: syscall.ENODEV}).Read(p)
+	assert.EqualError(t, err, "tun device recreated 2 times within 10m0s and still failing: no such device")
+	assert.Equal(t, 2, device.recreates)
+
+	// Errors from closing the device are returned as they are
+	w, _ = newTestTunWatchdog(&recreatableTun{})
+	w.close()
+	_, err = w.wrap(&brokenTunQueue{err: os.ErrClosed}).Read(p)
+	assert.True(t, errors.Is(err, os.ErrClosed))
+}
+
+func TestTunWatchdog_writeDuringRecreate(t *testing.T) {
+	device := &recreatableTun{}
+	w, _ := newTestTunWatchdog(device)
+	sleeping := make(chan time.Duration)
+	wake := make(chan struct{})
+	w.sleep = func(d time.Duration) {
+		sleeping <- d
+		<-wake
+	}
+	old := &brokenTunQueue{err: syscall.EIO}
+	q := w.wrap(old)
+
+	// The write that reaches the threshold starts the recreate and returns without waiting for the backoff
+	for i := 0; i < 3; i++ {
+		_, err := q.Write([]byte("hello"))
+		assert.True(t, errors.Is(err, syscall.EIO))
+	}
+	assert.Equal(t, time.Second, <-sleeping)
+
+	// Writes keep failing fast while the recreate is running, without starting another one
+	for i := 0; i < 5; i++ {
+		_, err := q.Write([]byte("hello"))
+		assert.True(t, errors.Is(err, syscall.EIO))
+	}
+
+	// A reader waits for the recreate and then uses the new device
+	read := make(chan error)
+	go func() {
+		_, err := q.Read(make([]byte, 10))
+		read <- err
+	}()
+	close(wake)
+	require.NoError(t, <-read)
+	assert.Equal(t, 1, device.recreates)
+
+	_, err := q.Write([]byte("hello"))
+	assert.NoError(t, err)
+}
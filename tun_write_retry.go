@@ -0,0 +1,98 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// tunWriteRetry retries tun writes that failed because the kernel was momentarily out of buffer space. The backoff
+// doubles after every attempt and the packet is dropped once retries run out, a write blocks the routine for at most
+// backoff * (2^retries - 1).
+type tunWriteRetry struct {
+	retries int
+	backoff time.Duration
+
+	// metricRetried counts the writes that succeeded after a retry, metricDropped the ones that ran out of retries
+	metricRetried metrics.Counter
+	metricDropped metrics.Counter
+}
+
+// newTunWriteRetryFromConfig returns nil if tun.write_retries is 0
+func newTunWriteRetryFromConfig(c *config.C) (*tunWriteRetry, error) {
+	retries := c.GetInt("tun.write_retries", 3)
+	if retries < 0 || retries > 10 {
+		return nil, fmt.Errorf("tun.write_retries must be between 0 and 10: %v", retries)
+	}
+
+	if retries == 0 {
+		return nil, nil
+	}
+
+	backoff := c.GetDuration("tun.write_retry_backoff", 100*time.Microsecond)
+	if backoff <= 0 {
+		return nil, fmt.Errorf("tun.write_retry_backoff must be greater than 0: %v", backoff)
+	}
+
+	return newTunWriteRetry(util.MetricsRegistry(c), retries, backoff), nil
+}
+
+func newTunWriteRetry(registry metrics.Registry, retries int, backoff time.Duration) *tunWriteRetry {
+	return &tunWriteRetry{
+		retries:       retries,
+		backoff:       backoff,
+		metricRetried: metrics.GetOrRegisterCounter("tun.write.retried", registry),
+		metricDropped: metrics.GetOrRegisterCounter("tun.write.dropped", registry),
+	}
+}
+
+// wrap returns rwc with retrying writes, or rwc itself if retries are disabled
+func (r *tunWriteRetry) wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if r == nil {
+		return rwc
+	}
+
+	return &retryingTunWriter{ReadWriteCloser: rwc, r: r}
+}
+
+type retryingTunWriter struct {
+	io.ReadWriteCloser
+	r *tunWriteRetry
+}
+
+func (w *retryingTunWriter) Write(p []byte) (int, error) {
+	n, err := w.ReadWriteCloser.Write(p)
+	if err == nil || !isTransientWriteErr(err) {
+		return n, err
+	}
+
+	backoff := w.r.backoff
+	for i := 0; i < w.r.retries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+
+		n, err = w.ReadWriteCloser.Write(p)
+		if err == nil {
+			w.r.metricRetried.Inc(1)
+			return n, nil
+		}
+
+		if !isTransientWriteErr(err) {
+			return n, err
+		}
+	}
+
+	w.r.metricDropped.Inc(1)
+	return n, err
+}
+
+// isTransientWriteErr returns true for errors that mean the kernel had no room for the packet right now
+func isTransientWriteErr(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN)
+}
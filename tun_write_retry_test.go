@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyTun fails the first `failures` writes with err
+type flakyTun struct {
+	io.ReadWriteCloser
+	err      error
+	failures int
+	writes   int
+}
+
+func (t *flakyTun) Write(p []byte) (int, error) {
+	t.writes++
+	if t.writes <= t.failures {
+		// The tun devices return the errno wrapped in a PathError
+		return 0, &os.PathError{Op: "write", Path: "/dev/net/tun", Err: t.err}
+	}
+	return len(p), nil
+}
+
+func Test_newTunWriteRetryFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	r, err := newTunWriteRetryFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, r.retries)
+	assert.Equal(t, 100*time.Microsecond, r.backoff)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"write_retries": 0}
+	r, err = newTunWriteRetryFromConfig(c)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	// A nil tunWriteRetry leaves the device alone
+	tun := &flakyTun{}
+	assert.Equal(t, tun, r.wrap(tun))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"write_retries": 11}
+	_, err = newTunWriteRetryFromConfig(c)
+	assert.EqualError(t, err, "tun.write_retries must be between 0 and 10: 11")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"write_retry_backoff": "0s"}
+	_, err = newTunWriteRetryFromConfig(c)
+	assert.EqualError(t, err, "tun.write_retry_backoff must be greater than 0: 0s")
+}
+
+func TestTunWriteRetry(t *testing.T) {
+	r := newTunWriteRetry(nil, 3, time.Microsecond)
+	retried, dropped := r.metricRetried.Count(), r.metricDropped.Count()
+
+	t.Log("An ENOBUFS that clears up on a retry is written")
+	tun := &flakyTun{err: syscall.ENOBUFS, failures: 2}
+	n, err := r.wrap(tun).Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 3, tun.writes)
+	assert.Equal(t, retried+1, r.metricRetried.Count())
+	assert.Equal(t, dropped, r.metricDropped.Count())
+
+	t.Log("The packet is dropped once the retries run out")
+	tun = &flakyTun{err: syscall.EAGAIN, failures: 10}
+	_, err = r.wrap(tun).Write([]byte("hello"))
+	assert.True(t, errors.Is(err, syscall.EAGAIN))
+	assert.Equal(t, 4, tun.writes)
+	assert.Equal(t, retried+1, r.metricRetried.Count())
+	assert.Equal(t, dropped+1, r.metricDropped.Count())
+
+	t.Log("Other errors are not retried")
+	tun = &flakyTun{err: syscall.EINVAL, failures: 1}
+	_, err = r.wrap(tun).Write([]byte("hello"))
+	assert.True(t, errors.Is(err, syscall.EINVAL))
+	assert.Equal(t, 1, tun.writes)
+	assert.Equal(t, dropped+1, r.metricDropped.Count())
+}
@@ -0,0 +1,54 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+var defaultTunnelLifetimeBuckets = []time.Duration{
+	10 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// tunnelLifetimeMetrics exports how long tunnels stayed up as a bucketed histogram under tunnels.lifetime. A tunnel is
+// up from the handshake that first connects us to a vpn ip until the last tunnel to it is torn down, rehandshakes in
+// between do not start a new one. Many samples in the small buckets point to a flapping peer.
+type tunnelLifetimeMetrics struct {
+	buckets   []time.Duration
+	histogram *durationHistogram
+}
+
+// newTunnelLifetimeMetricsFromConfig reads stats.tunnel_lifetime, buckets are a list of durations and must be in
+// increasing order
+func newTunnelLifetimeMetricsFromConfig(c *config.C) (*tunnelLifetimeMetrics, error) {
+	buckets, err := parseDurationBuckets(c, "stats.tunnel_lifetime.buckets", defaultTunnelLifetimeBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTunnelLifetimeMetrics(util.MetricsRegistry(c), buckets), nil
+}
+
+func newTunnelLifetimeMetrics(registry metrics.Registry, buckets []time.Duration) *tunnelLifetimeMetrics {
+	return &tunnelLifetimeMetrics{
+		buckets:   buckets,
+		histogram: newDurationHistogram(registry, "tunnels.lifetime", buckets),
+	}
+}
+
+// tornDown records the lifetime of the tunnel hostinfo was the last of
+func (t *tunnelLifetimeMetrics) tornDown(hostinfo *HostInfo, now time.Time) {
+	if t == nil || hostinfo.tunnelUp.IsZero() {
+		return
+	}
+
+	t.histogram.update(t.buckets, now.Sub(hostinfo.tunnelUp))
+}
@@ -0,0 +1,68 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTunnelLifetimeMetricsFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	tl, err := newTunnelLifetimeMetricsFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTunnelLifetimeBuckets, tl.buckets)
+
+	c.Settings["stats"] = map[interface{}]interface{}{"tunnel_lifetime": map[interface{}]interface{}{"buckets": []interface{}{"1m", "30s"}}}
+	_, err = newTunnelLifetimeMetricsFromConfig(c)
+	assert.EqualError(t, err, "stats.tunnel_lifetime.buckets must be positive and in increasing order: 30s")
+}
+
+func TestTunnelLifetimeMetrics_tornDown(t *testing.T) {
+	l := test.NewLogger()
+	registry := metrics.NewRegistry()
+	count := func(name string) int64 {
+		c, ok := registry.Get(name).(metrics.Counter)
+		if !ok {
+			return -1
+		}
+		return c.Count()
+	}
+
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hostMap := NewHostMap(l, nil, vpncidr, nil)
+	f := &Interface{
+		hostMap:        hostMap,
+		lightHouse:     newTestLighthouse(),
+		tunnelLifetime: newTunnelLifetimeMetrics(registry, []time.Duration{time.Minute, 5 * time.Minute}),
+		l:              l,
+	}
+
+	vpnIp := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+	first := &HostInfo{vpnIp: vpnIp, localIndexId: 1, remoteIndexId: 1}
+	hostMap.unlockedAddHostInfo(first, f)
+	assert.False(t, first.tunnelUp.IsZero())
+
+	// A rehandshake carries the time the tunnel came up over to the new hostinfo
+	first.tunnelUp = time.Now().Add(-2 * time.Minute)
+	second := &HostInfo{vpnIp: vpnIp, localIndexId: 2, remoteIndexId: 2}
+	hostMap.unlockedAddHostInfo(second, f)
+	assert.Equal(t, first.tunnelUp, second.tunnelUp)
+
+	// Tearing down the older hostinfo does not end the tunnel
+	f.closeTunnel(first, "test")
+	assert.Equal(t, int64(0), count("tunnels.lifetime.le_inf"))
+
+	// Tearing down the last one records the lifetime in the 5m bucket
+	f.closeTunnel(second, "test")
+	assert.Equal(t, int64(0), count("tunnels.lifetime.le_1m0s"))
+	assert.Equal(t, int64(1), count("tunnels.lifetime.le_5m0s"))
+	assert.Equal(t, int64(1), count("tunnels.lifetime.le_inf"))
+	assert.InDelta(t, (2 * time.Minute).Nanoseconds(), count("tunnels.lifetime.sum_ns"), float64(time.Second))
+}
@@ -1,6 +1,9 @@
 package udp
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
@@ -18,6 +21,7 @@ type EncReader func(
 	nb []byte,
 	q int,
 	localCache firewall.ConntrackCache,
+	ecn byte,
 )
 
 type Conn interface {
@@ -25,10 +29,42 @@ type Conn interface {
 	LocalAddr() (*Addr, error)
 	ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int)
 	WriteTo(b []byte, addr *Addr) error
+	// WriteToECN is WriteTo with the ECN bits of the outer ip header set to ecn when listen.reflect_ecn is enabled and
+	// the platform supports it
+	WriteToECN(b []byte, addr *Addr, ecn byte) error
 	ReloadConfig(c *config.C)
 	Close() error
 }
 
+// DontFragmenter is implemented by conns that can send a single packet with the DF bit set, ignoring the path mtu the
+// kernel has cached. A packet that is too large for the path is then dropped or rejected instead of fragmented. Other
+// packets are sent the way they would be otherwise.
+type DontFragmenter interface {
+	WriteToDontFragment(b []byte, addr *Addr) error
+}
+
+// SourceWriter is implemented by conns that can send a packet from a specific local address when the listener is bound
+// to more than one, the source address must be of the same family as addr
+type SourceWriter interface {
+	WriteToFrom(b []byte, addr *Addr, src net.IP) error
+}
+
+// GetBufferSizes returns the listen.read_buffer and listen.write_buffer socket buffer sizes, 0 means the value was not
+// set and the system default should be kept
+func GetBufferSizes(c *config.C) (read int, write int, err error) {
+	read = c.GetInt("listen.read_buffer", 0)
+	if c.IsSet("listen.read_buffer") && read <= 0 {
+		return 0, 0, fmt.Errorf("listen.read_buffer must be a positive number of bytes: %v", c.Get("listen.read_buffer"))
+	}
+
+	write = c.GetInt("listen.write_buffer", 0)
+	if c.IsSet("listen.write_buffer") && write <= 0 {
+		return 0, 0, fmt.Errorf("listen.write_buffer must be a positive number of bytes: %v", c.Get("listen.write_buffer"))
+	}
+
+	return read, write, nil
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
@@ -43,6 +79,9 @@ func (NoopConn) ListenOut(_ EncReader, _ LightHouseHandlerFunc, _ *firewall.Conn
 func (NoopConn) WriteTo(_ []byte, _ *Addr) error {
 	return nil
 }
+func (NoopConn) WriteToECN(_ []byte, _ *Addr, _ byte) error {
+	return nil
+}
 func (NoopConn) ReloadConfig(_ *config.C) {
 	return
 }
@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+type connBox struct {
+	c Conn
+}
+
+// SwapConn is a Conn whose underlying connection can be replaced while it is in use, this allows the listen port to
+// change without a restart. Writes always go to the current connection.
+type SwapConn struct {
+	cur atomic.Pointer[connBox]
+}
+
+func NewSwapConn(c Conn) *SwapConn {
+	s := &SwapConn{}
+	s.cur.Store(&connBox{c: c})
+	return s
+}
+
+// Conn returns the current underlying connection
+func (s *SwapConn) Conn() Conn {
+	return s.cur.Load().c
+}
+
+// Swap replaces the underlying connection and returns the previous one. The caller is responsible for calling ListenOut
+// on the new connection and closing the old one, any ListenOut running on the old connection continues until it is
+// closed.
+func (s *SwapConn) Swap(c Conn) Conn {
+	return s.cur.Swap(&connBox{c: c}).c
+}
+
+func (s *SwapConn) Rebind() error {
+	return s.Conn().Rebind()
+}
+
+func (s *SwapConn) LocalAddr() (*Addr, error) {
+	return s.Conn().LocalAddr()
+}
+
+func (s *SwapConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	s.Conn().ListenOut(r, lhf, cache, q)
+}
+
+func (s *SwapConn) WriteTo(b []byte, addr *Addr) error {
+	return s.Conn().WriteTo(b, addr)
+}
+
+func (s *SwapConn) WriteToECN(b []byte, addr *Addr, ecn byte) error {
+	return s.Conn().WriteToECN(b, addr, ecn)
+}
+
+func (s *SwapConn) ReloadConfig(c *config.C) {
+	s.Conn().ReloadConfig(c)
+}
+
+func (s *SwapConn) WriteToDontFragment(b []byte, addr *Addr) error {
+	d, ok := s.Conn().(DontFragmenter)
+	if !ok {
+		return fmt.Errorf("%T does not support setting the DF bit", s.Conn())
+	}
+	return d.WriteToDontFragment(b, addr)
+}
+
+func (s *SwapConn) WriteToFrom(b []byte, addr *Addr, src net.IP) error {
+	w, ok := s.Conn().(SourceWriter)
+	if !ok {
+		return fmt.Errorf("%T does not support choosing the source address", s.Conn())
+	}
+	return w.WriteToFrom(b, addr, src)
+}
+
+func (s *SwapConn) Close() error {
+	return s.Conn().Close()
+}
+
+// unwrapConn returns the current underlying connection if c is a SwapConn
+func unwrapConn(c Conn) Conn {
+	if s, ok := c.(*SwapConn); ok {
+		return s.Conn()
+	}
+	return c
+}
@@ -80,6 +80,17 @@ func (a AddrSlice) Equal(b AddrSlice) bool {
 	return true
 }
 
+// Contains returns true if b is in the slice
+func (a AddrSlice) Contains(b *Addr) bool {
+	for _, v := range a {
+		if v.Equals(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func ParseIPAndPort(s string) (net.IP, uint16, error) {
 	rIp, sPort, err := net.SplitHostPort(s)
 	if err != nil {
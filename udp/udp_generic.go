@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
@@ -42,6 +43,11 @@ func (u *GenericConn) WriteTo(b []byte, addr *Addr) error {
 	return err
 }
 
+// WriteToECN ignores ecn, the standard library has no way to set it per packet
+func (u *GenericConn) WriteToECN(b []byte, addr *Addr, _ byte) error {
+	return u.WriteTo(b, addr)
+}
+
 func (u *GenericConn) LocalAddr() (*Addr, error) {
 	a := u.UDPConn.LocalAddr()
 
@@ -61,7 +67,7 @@ func (u *GenericConn) ReloadConfig(c *config.C) {
 	// TODO
 }
 
-func NewUDPStatsEmitter(udpConns []Conn) func() {
+func NewUDPStatsEmitter(udpConns []Conn, _ metrics.Registry) func() {
 	// No UDP stats for non-linux
 	return func() {}
 }
@@ -88,6 +94,6 @@ func (u *GenericConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *f
 
 		udpAddr.IP = rua.IP
 		udpAddr.Port = uint16(rua.Port)
-		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l), 0)
 	}
 }
@@ -7,6 +7,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -21,11 +23,24 @@ import (
 //TODO: make it support reload as best you can!
 
 type StdConn struct {
-	sysFd int
-	l     *logrus.Logger
-	batch int
+	sysFd  int
+	l      *logrus.Logger
+	batch  int
+	closed atomic.Bool
+
+	// reflectECN is set when listen.reflect_ecn is enabled, the tos fields hold the DSCP bits of the socket so they
+	// are kept when we set ECN on a packet
+	reflectECN atomic.Bool
+	tos4       atomic.Uint32
+	tos6       atomic.Uint32
+
+	// dfLock serializes WriteToDontFragment so one call can not restore the path mtu discovery modes another changed
+	dfLock sync.Mutex
 }
 
+// ecnControlLen is enough room for the single IP_TOS or IPV6_TCLASS control message we ask for
+const ecnControlLen = 64
+
 var x int
 
 // From linux/sock_diag.h
@@ -84,12 +99,15 @@ func (u *StdConn) Rebind() error {
 	return nil
 }
 
+// setsockoptInt is swapped out by tests to see the socket options we set
+var setsockoptInt = unix.SetsockoptInt
+
 func (u *StdConn) SetRecvBuffer(n int) error {
-	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
+	return setsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
 }
 
 func (u *StdConn) SetSendBuffer(n int) error {
-	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, n)
+	return setsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, n)
 }
 
 func (u *StdConn) GetRecvBuffer() (int, error) {
@@ -134,9 +152,17 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 		read = u.ReadSingle
 	}
 
+	// The kernel only fills these in while listen.reflect_ecn is enabled
+	controls := make([][]byte, len(msgs))
+	for i := range msgs {
+		controls[i] = make([]byte, ecnControlLen)
+		msgs[i].Hdr.Control = &controls[i][0]
+		msgs[i].Hdr.Controllen = ecnControlLen
+	}
+
 	for {
 		n, err := read(msgs)
-		if err != nil {
+		if err != nil || u.closed.Load() {
 			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
 			return
 		}
@@ -145,7 +171,9 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 		for i := 0; i < n; i++ {
 			udpAddr.IP = names[i][8:24]
 			udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
-			r(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+			ecn := parseECN(controls[i][:msgs[i].Hdr.Controllen])
+			msgs[i].Hdr.Controllen = ecnControlLen
+			r(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], h, fwPacket, lhf, nb, q, cache.Get(u.l), ecn)
 		}
 	}
 }
@@ -221,14 +249,222 @@ func (u *StdConn) WriteTo(b []byte, addr *Addr) error {
 	}
 }
 
+// WriteToECN sets the ECN bits of the outer ip header with a control message, the DSCP bits of the socket are kept
+func (u *StdConn) WriteToECN(b []byte, addr *Addr, ecn byte) error {
+	if ecn == 0 || !u.reflectECN.Load() {
+		return u.WriteTo(b, addr)
+	}
+
+	var rsa unix.RawSockaddrInet6
+	rsa.Family = unix.AF_INET6
+	p := (*[2]byte)(unsafe.Pointer(&rsa.Port))
+	p[0] = byte(addr.Port >> 8)
+	p[1] = byte(addr.Port)
+	copy(rsa.Addr[:], addr.IP)
+
+	var control [ecnControlLen]byte
+	cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	cmsg.SetLen(unix.CmsgLen(4))
+	if addr.IP.To4() != nil {
+		// ipv4 mapped addresses are sent by the ipv4 stack which only looks at ipv4 control messages
+		cmsg.Level = unix.IPPROTO_IP
+		cmsg.Type = unix.IP_TOS
+		*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = int32(u.tos4.Load() | uint32(ecn&0x03))
+	} else {
+		cmsg.Level = unix.IPPROTO_IPV6
+		cmsg.Type = unix.IPV6_TCLASS
+		*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = int32(u.tos6.Load() | uint32(ecn&0x03))
+	}
+
+	iov := unix.Iovec{Base: &b[0]}
+	iov.SetLen(len(b))
+
+	msg := unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&rsa)),
+		Namelen: unix.SizeofSockaddrInet6,
+		Iov:     &iov,
+		Control: &control[0],
+	}
+	msg.SetIovlen(1)
+	msg.SetControllen(unix.CmsgSpace(4))
+
+	_, _, err := unix.Syscall(unix.SYS_SENDMSG, uintptr(u.sysFd), uintptr(unsafe.Pointer(&msg)), 0)
+	if err != 0 {
+		return &net.OpError{Op: "sendmsg", Err: err}
+	}
+
+	return nil
+}
+
+// WriteToFrom sends b to addr from the local address src with an IP_PKTINFO or IPV6_PKTINFO control message, which lets
+// a listener bound to the wildcard address pick the path out of a multi-homed host
+func (u *StdConn) WriteToFrom(b []byte, addr *Addr, src net.IP) error {
+	if (addr.IP.To4() == nil) != (src.To4() == nil) {
+		return fmt.Errorf("source address %v is not the same family as %v", src, addr)
+	}
+
+	var rsa unix.RawSockaddrInet6
+	rsa.Family = unix.AF_INET6
+	p := (*[2]byte)(unsafe.Pointer(&rsa.Port))
+	p[0] = byte(addr.Port >> 8)
+	p[1] = byte(addr.Port)
+	copy(rsa.Addr[:], addr.IP.To16())
+
+	var control [ecnControlLen]byte
+	cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	var dataLen int
+	if v4 := src.To4(); v4 != nil {
+		// ipv4 mapped addresses are sent by the ipv4 stack which only looks at ipv4 control messages
+		dataLen = unix.SizeofInet4Pktinfo
+		cmsg.Level = unix.IPPROTO_IP
+		cmsg.Type = unix.IP_PKTINFO
+		info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&control[unix.CmsgLen(0)]))
+		copy(info.Spec_dst[:], v4)
+	} else {
+		dataLen = unix.SizeofInet6Pktinfo
+		cmsg.Level = unix.IPPROTO_IPV6
+		cmsg.Type = unix.IPV6_PKTINFO
+		info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&control[unix.CmsgLen(0)]))
+		copy(info.Addr[:], src.To16())
+	}
+	cmsg.SetLen(unix.CmsgLen(dataLen))
+
+	iov := unix.Iovec{Base: &b[0]}
+	iov.SetLen(len(b))
+
+	msg := unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&rsa)),
+		Namelen: unix.SizeofSockaddrInet6,
+		Iov:     &iov,
+		Control: &control[0],
+	}
+	msg.SetIovlen(1)
+	msg.SetControllen(unix.CmsgSpace(dataLen))
+
+	_, _, err := unix.Syscall(unix.SYS_SENDMSG, uintptr(u.sysFd), uintptr(unsafe.Pointer(&msg)), 0)
+	if err != 0 {
+		return &net.OpError{Op: "sendmsg", Err: err}
+	}
+
+	return nil
+}
+
+// parseECN returns the ECN bits from the IP_TOS or IPV6_TCLASS control message, 0 if there was neither
+func parseECN(control []byte) byte {
+	for len(control) >= unix.CmsgLen(0) {
+		cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		l := int(cmsg.Len)
+		if l < unix.CmsgLen(0) || l > len(control) {
+			return 0
+		}
+
+		data := control[unix.CmsgLen(0):l]
+		switch {
+		case cmsg.Level == unix.IPPROTO_IP && cmsg.Type == unix.IP_TOS && len(data) >= 1:
+			return data[0] & 0x03
+		case cmsg.Level == unix.IPPROTO_IPV6 && cmsg.Type == unix.IPV6_TCLASS && len(data) >= 4:
+			return byte(*(*int32)(unsafe.Pointer(&data[0]))) & 0x03
+		}
+
+		next := unix.CmsgSpace(l - unix.CmsgLen(0))
+		if next > len(control) {
+			return 0
+		}
+		control = control[next:]
+	}
+
+	return 0
+}
+
+// setReflectECN asks the kernel for the ECN bits of received packets and remembers the DSCP bits to send with
+func (u *StdConn) setReflectECN(enable bool) error {
+	v := 0
+	if enable {
+		v = 1
+	}
+
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_RECVTOS, v); err != nil {
+		return fmt.Errorf("unable to set IP_RECVTOS: %s", err)
+	}
+
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, v); err != nil {
+		return fmt.Errorf("unable to set IPV6_RECVTCLASS: %s", err)
+	}
+
+	tos4, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_TOS)
+	if err != nil {
+		return fmt.Errorf("unable to get IP_TOS: %s", err)
+	}
+
+	tos6, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	if err != nil {
+		return fmt.Errorf("unable to get IPV6_TCLASS: %s", err)
+	}
+
+	u.tos4.Store(uint32(tos4) &^ 0x03)
+	u.tos6.Store(uint32(tos6) &^ 0x03)
+	u.reflectECN.Store(enable)
+	return nil
+}
+
+// WriteToDontFragment sends b with the DF bit set and without the kernel fragmenting it to a cached path mtu. A packet
+// larger than the local interface mtu fails to send and one larger than the path mtu is dropped on the way. Linux has
+// no per packet control for ipv4 so the path mtu discovery mode of the socket is switched for this one write and
+// restored before returning, whether or not the write succeeded.
+func (u *StdConn) WriteToDontFragment(b []byte, addr *Addr) (err error) {
+	u.dfLock.Lock()
+	defer u.dfLock.Unlock()
+
+	pmtud4, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+	if err != nil {
+		return fmt.Errorf("unable to get IP_MTU_DISCOVER: %s", err)
+	}
+	pmtud6, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	if err != nil {
+		return fmt.Errorf("unable to get IPV6_MTU_DISCOVER: %s", err)
+	}
+
+	if err = unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE); err != nil {
+		return fmt.Errorf("unable to set IP_MTU_DISCOVER: %s", err)
+	}
+	defer func() {
+		if rerr := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, pmtud4); rerr != nil && err == nil {
+			err = fmt.Errorf("unable to restore IP_MTU_DISCOVER: %s", rerr)
+		}
+	}()
+
+	if err = unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE); err != nil {
+		return fmt.Errorf("unable to set IPV6_MTU_DISCOVER: %s", err)
+	}
+	defer func() {
+		if rerr := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, pmtud6); rerr != nil && err == nil {
+			err = fmt.Errorf("unable to restore IPV6_MTU_DISCOVER: %s", rerr)
+		}
+	}()
+
+	return u.WriteTo(b, addr)
+}
+
 func (u *StdConn) ReloadConfig(c *config.C) {
-	b := c.GetInt("listen.read_buffer", 0)
-	if b > 0 {
-		err := u.SetRecvBuffer(b)
+	reflectECN := c.GetBool("listen.reflect_ecn", false)
+	if reflectECN != u.reflectECN.Load() {
+		if err := u.setReflectECN(reflectECN); err != nil {
+			u.l.WithError(err).Error("Failed to set listen.reflect_ecn")
+		}
+	}
+
+	read, write, err := GetBufferSizes(c)
+	if err != nil {
+		u.l.WithError(err).Error("Failed to set the udp socket buffers")
+		return
+	}
+
+	if read > 0 {
+		err := u.SetRecvBuffer(read)
 		if err == nil {
 			s, err := u.GetRecvBuffer()
 			if err == nil {
-				u.l.WithField("size", s).Info("listen.read_buffer was set")
+				u.l.WithField("size", s).WithField("requested", read).Info("listen.read_buffer was set")
 			} else {
 				u.l.WithError(err).Warn("Failed to get listen.read_buffer")
 			}
@@ -237,13 +473,12 @@ func (u *StdConn) ReloadConfig(c *config.C) {
 		}
 	}
 
-	b = c.GetInt("listen.write_buffer", 0)
-	if b > 0 {
-		err := u.SetSendBuffer(b)
+	if write > 0 {
+		err := u.SetSendBuffer(write)
 		if err == nil {
 			s, err := u.GetSendBuffer()
 			if err == nil {
-				u.l.WithField("size", s).Info("listen.write_buffer was set")
+				u.l.WithField("size", s).WithField("requested", write).Info("listen.write_buffer was set")
 			} else {
 				u.l.WithError(err).Warn("Failed to get listen.write_buffer")
 			}
@@ -263,34 +498,36 @@ func (u *StdConn) getMemInfo(meminfo *_SK_MEMINFO) error {
 }
 
 func (u *StdConn) Close() error {
-	//TODO: this will not interrupt the read loop
+	// Closing the fd will not interrupt a blocked read, shutdown will wake it and the read loop will see closed
+	u.closed.Store(true)
+	_ = unix.Shutdown(u.sysFd, unix.SHUT_RDWR)
 	return syscall.Close(u.sysFd)
 }
 
-func NewUDPStatsEmitter(udpConns []Conn) func() {
+func NewUDPStatsEmitter(udpConns []Conn, registry metrics.Registry) func() {
 	// Check if our kernel supports SO_MEMINFO before registering the gauges
 	var udpGauges [][_SK_MEMINFO_VARS]metrics.Gauge
 	var meminfo _SK_MEMINFO
-	if err := udpConns[0].(*StdConn).getMemInfo(&meminfo); err == nil {
+	if err := unwrapConn(udpConns[0]).(*StdConn).getMemInfo(&meminfo); err == nil {
 		udpGauges = make([][_SK_MEMINFO_VARS]metrics.Gauge, len(udpConns))
 		for i := range udpConns {
 			udpGauges[i] = [_SK_MEMINFO_VARS]metrics.Gauge{
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rmem_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rcvbuf", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.sndbuf", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.fwd_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_queued", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.optmem", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.backlog", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.drops", i), nil),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rmem_alloc", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rcvbuf", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_alloc", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.sndbuf", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.fwd_alloc", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_queued", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.optmem", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.backlog", i), registry),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.drops", i), registry),
 			}
 		}
 	}
 
 	return func() {
 		for i, gauges := range udpGauges {
-			if err := udpConns[i].(*StdConn).getMemInfo(&meminfo); err == nil {
+			if err := unwrapConn(udpConns[i]).(*StdConn).getMemInfo(&meminfo); err == nil {
 				for j := 0; j < _SK_MEMINFO_VARS; j++ {
 					gauges[j].Update(int64(meminfo[j]))
 				}
@@ -0,0 +1,190 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestStdConn_reflectECN(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"reflect_ecn": true}
+
+	for _, ip := range []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback} {
+		rx, err := NewListener(l, ip, 0, false, 64)
+		if err != nil {
+			t.Skipf("unable to listen on %v: %v", ip, err)
+		}
+		defer rx.Close()
+
+		tx, err := NewListener(l, ip, 0, false, 64)
+		assert.NoError(t, err)
+		defer tx.Close()
+
+		rx.ReloadConfig(c)
+		tx.ReloadConfig(c)
+
+		got := make(chan byte, 4)
+		go rx.ListenOut(func(_ *Addr, _ []byte, _ []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache, ecn byte) {
+			got <- ecn
+		}, nil, nil, 0)
+
+		addr, err := rx.LocalAddr()
+		assert.NoError(t, err)
+		addr.IP = ip.To16()
+
+		for _, ecn := range []byte{0, 1, 2, 3} {
+			assert.NoError(t, tx.WriteToECN([]byte{1, 2, 3}, addr, ecn))
+			select {
+			case v := <-got:
+				assert.Equal(t, ecn, v, "ip: %v", ip)
+			case <-time.After(time.Second):
+				t.Fatalf("packet to %v was not received", ip)
+			}
+		}
+	}
+}
+
+func TestStdConn_WriteToFrom(t *testing.T) {
+	l := test.NewLogger()
+
+	rx, err := NewListener(l, net.ParseIP("127.0.0.1"), 0, false, 64)
+	if err != nil {
+		t.Skipf("unable to listen on 127.0.0.1: %v", err)
+	}
+	defer rx.Close()
+
+	tx, err := NewListener(l, net.IPv6zero, 0, false, 64)
+	if err != nil {
+		t.Skipf("unable to listen on [::]: %v", err)
+	}
+	defer tx.Close()
+
+	got := make(chan *Addr, 4)
+	go rx.ListenOut(func(from *Addr, _ []byte, _ []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache, _ byte) {
+		got <- from.Copy()
+	}, nil, nil, 0)
+
+	addr, err := rx.LocalAddr()
+	assert.NoError(t, err)
+	addr.IP = net.ParseIP("127.0.0.1").To16()
+
+	w := tx.(SourceWriter)
+	for _, src := range []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")} {
+		assert.NoError(t, w.WriteToFrom([]byte{1, 2, 3}, addr, src))
+		select {
+		case from := <-got:
+			assert.True(t, src.Equal(from.IP), "expected %v, got %v", src, from.IP)
+		case <-time.After(time.Second):
+			t.Fatalf("packet from %v was not received", src)
+		}
+	}
+
+	assert.Error(t, w.WriteToFrom([]byte{1, 2, 3}, addr, net.IPv6loopback))
+}
+
+func TestStdConn_WriteToDontFragment(t *testing.T) {
+	l := test.NewLogger()
+
+	rx, err := NewListener(l, net.ParseIP("127.0.0.1"), 0, false, 64)
+	if err != nil {
+		t.Skipf("unable to listen on 127.0.0.1: %v", err)
+	}
+	defer rx.Close()
+
+	tx, err := NewListener(l, net.IPv6zero, 0, false, 64)
+	if err != nil {
+		t.Skipf("unable to listen on [::]: %v", err)
+	}
+	defer tx.Close()
+
+	got := make(chan int, 4)
+	go rx.ListenOut(func(_ *Addr, _ []byte, p []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache, _ byte) {
+		got <- len(p)
+	}, nil, nil, 0)
+
+	addr, err := rx.LocalAddr()
+	assert.NoError(t, err)
+	addr.IP = net.ParseIP("127.0.0.1").To16()
+
+	fd := tx.(*StdConn).sysFd
+	pmtud4, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+	assert.NoError(t, err)
+	pmtud6, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	assert.NoError(t, err)
+
+	assert.NoError(t, tx.(DontFragmenter).WriteToDontFragment([]byte{1, 2, 3}, addr))
+	select {
+	case n := <-got:
+		assert.Equal(t, 3, n)
+	case <-time.After(time.Second):
+		t.Fatal("packet was not received")
+	}
+
+	// A packet larger than the interface mtu fails to send, the socket is left as it was either way
+	err = tx.(DontFragmenter).WriteToDontFragment(make([]byte, 70000), addr)
+	assert.Error(t, err)
+
+	v, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+	assert.NoError(t, err)
+	assert.Equal(t, pmtud4, v)
+	v, err = unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	assert.NoError(t, err)
+	assert.Equal(t, pmtud6, v)
+}
+
+func TestStdConn_buffers(t *testing.T) {
+	l := test.NewLogger()
+
+	type call struct {
+		opt   int
+		value int
+	}
+	var calls []call
+	setsockoptInt = func(fd, level, opt, value int) error {
+		assert.Equal(t, unix.SOL_SOCKET, level)
+		calls = append(calls, call{opt, value})
+		return unix.SetsockoptInt(fd, level, opt, value)
+	}
+	defer func() { setsockoptInt = unix.SetsockoptInt }()
+
+	u, err := NewListener(l, net.ParseIP("127.0.0.1"), 0, false, 64)
+	if err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer u.Close()
+
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"read_buffer": 262144, "write_buffer": 131072}
+	u.ReloadConfig(c)
+	assert.Equal(t, []call{{unix.SO_RCVBUFFORCE, 262144}, {unix.SO_SNDBUFFORCE, 131072}}, calls)
+
+	// Nothing is set when the buffers are left out
+	calls = nil
+	c.Settings["listen"] = map[interface{}]interface{}{}
+	u.ReloadConfig(c)
+	assert.Empty(t, calls)
+
+	// Non positive values are rejected
+	c.Settings["listen"] = map[interface{}]interface{}{"read_buffer": -1, "write_buffer": 131072}
+	u.ReloadConfig(c)
+	assert.Empty(t, calls)
+
+	_, _, err = GetBufferSizes(c)
+	assert.EqualError(t, err, "listen.read_buffer must be a positive number of bytes: -1")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"write_buffer": 0}
+	_, _, err = GetBufferSizes(c)
+	assert.EqualError(t, err, "listen.write_buffer must be a positive number of bytes: 0")
+}
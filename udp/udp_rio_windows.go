@@ -139,7 +139,7 @@ func (u *RIOConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 		p := (*[2]byte)(unsafe.Pointer(&udpAddr.Port))
 		p[0] = byte(rua.Port >> 8)
 		p[1] = byte(rua.Port)
-		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l), 0)
 	}
 }
 
@@ -295,6 +295,11 @@ func (u *RIOConn) WriteTo(buf []byte, addr *Addr) error {
 	return winrio.SendEx(u.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, 0, 0)
 }
 
+// WriteToECN ignores ecn, setting it is not supported with RIO
+func (u *RIOConn) WriteToECN(buf []byte, addr *Addr, _ byte) error {
+	return u.WriteTo(buf, addr)
+}
+
 func (u *RIOConn) LocalAddr() (*Addr, error) {
 	sa, err := windows.Getsockname(u.sock)
 	if err != nil {
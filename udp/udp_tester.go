@@ -9,6 +9,7 @@ import (
 	"net"
 	"sync/atomic"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
@@ -119,6 +120,32 @@ func (u *TesterConn) WriteTo(b []byte, addr *Addr) error {
 	return nil
 }
 
+func (u *TesterConn) WriteToECN(b []byte, addr *Addr, _ byte) error {
+	return u.WriteTo(b, addr)
+}
+
+// WriteToFrom records src as the source of the packet, the router delivers it the same as any other
+func (u *TesterConn) WriteToFrom(b []byte, addr *Addr, src net.IP) error {
+	if u.closed.Load() {
+		return io.ErrClosedPipe
+	}
+
+	p := &Packet{
+		Data:     make([]byte, len(b), len(b)),
+		FromIp:   make([]byte, 16),
+		FromPort: u.Addr.Port,
+		ToIp:     make([]byte, 16),
+		ToPort:   addr.Port,
+	}
+
+	copy(p.Data, b)
+	copy(p.ToIp, addr.IP.To16())
+	copy(p.FromIp, src.To16())
+
+	u.TxPackets <- p
+	return nil
+}
+
 func (u *TesterConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	h := &header.H{}
@@ -133,13 +160,13 @@ func (u *TesterConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *fi
 		}
 		ua.Port = p.FromPort
 		copy(ua.IP, p.FromIp.To16())
-		r(ua, plaintext[:0], p.Data, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		r(ua, plaintext[:0], p.Data, h, fwPacket, lhf, nb, q, cache.Get(u.l), 0)
 	}
 }
 
 func (u *TesterConn) ReloadConfig(*config.C) {}
 
-func NewUDPStatsEmitter(_ []Conn) func() {
+func NewUDPStatsEmitter(_ []Conn, _ metrics.Registry) func() {
 	// No UDP stats for non-linux
 	return func() {}
 }
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+var overlayRegistries = struct {
+	sync.Mutex
+	m map[string]metrics.Registry
+}{m: map[string]metrics.Registry{}}
+
+// OverlayName returns overlay.name, the name that tells the overlays running in the same process apart
+func OverlayName(c *config.C) string {
+	return c.GetString("overlay.name", "")
+}
+
+// MetricsRegistry returns the registry that holds the metrics of the overlay named by overlay.name. Every name gets its
+// own registry so overlays in the same process do not share counters, overlays without a name use
+// metrics.DefaultRegistry.
+func MetricsRegistry(c *config.C) metrics.Registry {
+	name := OverlayName(c)
+	if name == "" {
+		return metrics.DefaultRegistry
+	}
+
+	overlayRegistries.Lock()
+	defer overlayRegistries.Unlock()
+	r, ok := overlayRegistries.m[name]
+	if !ok {
+		r = metrics.NewRegistry()
+		overlayRegistries.m[name] = r
+	}
+	return r
+}